@@ -0,0 +1,94 @@
+package accountserver
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/middleware"
+	"go.uber.org/zap"
+)
+
+// accountAuditor checks the account databases on the local devices,
+// quarantining any that are corrupt.
+type accountAuditor struct {
+	r         *Replicator
+	interval  time.Duration
+	perSecond int64
+	passed    int64
+	failed    int64
+}
+
+func newAccountAuditor(r *Replicator, interval time.Duration, perSecond int64) *accountAuditor {
+	return &accountAuditor{r: r, interval: interval, perSecond: perSecond}
+}
+
+func (a *accountAuditor) auditAccount(dbFile string) error {
+	db, err := sqliteOpenAccount(dbFile)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.(*sqliteAccount).audit()
+}
+
+// run makes one pass over the accounts on the local devices, auditing up
+// to perSecond of them a second, and reports how it went to recon.
+func (a *accountAuditor) run() {
+	start := time.Now()
+	a.passed, a.failed = 0, 0
+	devices, err := a.r.Ring.LocalDevices(a.r.serverPort)
+	if err != nil {
+		a.r.logger.Error("Error getting local devices from ring", zap.Error(err))
+		return
+	}
+	for _, dev := range devices {
+		devicePath := filepath.Join(a.r.deviceRoot, dev.Device)
+		if mounted, err := fs.IsMount(devicePath); a.r.checkMounts && (err != nil || !mounted) {
+			a.r.logger.Error("Not auditing accounts on unmounted device", zap.String("device", dev.Device), zap.Error(err))
+			continue
+		}
+		filepath.Walk(filepath.Join(devicePath, "accounts"), func(path string, fi os.FileInfo, err error) error {
+			if err != nil || !strings.HasSuffix(path, ".db") {
+				return nil
+			}
+			if err := a.auditAccount(path); err != nil {
+				a.r.logger.Error("Account failed audit", zap.String("dbFile", path), zap.Error(err))
+				a.failed++
+			} else {
+				a.passed++
+			}
+			if a.perSecond > 0 {
+				due := time.Duration(float64(a.passed+a.failed) / float64(a.perSecond) * float64(time.Second))
+				if d := due - time.Since(start); d > 0 {
+					time.Sleep(d)
+				}
+			}
+			return nil
+		})
+	}
+	a.r.logger.Info("Account auditor pass complete", zap.Duration("timeTook", time.Since(start)),
+		zap.Int64("passed", a.passed), zap.Int64("failed", a.failed))
+	if err := middleware.DumpReconCache(a.r.reconCachePath, "account", map[string]interface{}{
+		"account_audits_passed":          a.passed,
+		"account_audits_failed":          a.failed,
+		"account_audits_since":           float64(start.UnixNano()) / float64(time.Second),
+		"account_auditor_pass_completed": time.Since(start).Seconds(),
+	}); err != nil {
+		a.r.logger.Error("account-auditor saving recon data", zap.Error(err))
+	}
+}
+
+// runForever starts a pass every interval, or as soon as the last one
+// finishes if it took longer.
+func (a *accountAuditor) runForever() {
+	for {
+		start := time.Now()
+		a.run()
+		if d := a.interval - time.Since(start); d > 0 {
+			time.Sleep(d)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package accountserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/test"
+	"go.uber.org/zap"
+)
+
+func TestAuditAccount(t *testing.T) {
+	db, _, cleanup, err := createTestDatabase("1410586890.28563")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, mergeItemsByName(db, []string{"a", "b"}))
+	require.Nil(t, db.audit())
+
+	_, err = db.Exec("UPDATE account_stat SET container_count = 5")
+	require.Nil(t, err)
+	require.Contains(t, db.audit().Error(), "account stats say 5 containers, 0 objects and 0 bytes, but there are 2 containers, 0 objects and 0 bytes")
+	_, err = db.Exec("UPDATE account_stat SET container_count = 2")
+	require.Nil(t, err)
+	require.Nil(t, db.audit())
+
+	_, err = db.Exec("UPDATE policy_stat SET bytes_used = 10")
+	require.Nil(t, err)
+	require.Contains(t, db.audit().Error(), "policy 0 stats say 2 containers, 0 objects and 10 bytes, but there are 2 containers, 0 objects and 0 bytes")
+}
+
+func TestAuditAccountBadMetadata(t *testing.T) {
+	db, dbFile, cleanup, err := createTestDatabase("1410586890.28563")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, db.connect())
+	_, err = db.Exec("UPDATE account_stat SET metadata = 'not json'")
+	require.Nil(t, err)
+	err = db.audit()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "Invalid metadata")
+	require.False(t, fs.Exists(dbFile))
+}
+
+func TestAccountAuditorRun(t *testing.T) {
+	db, dbFile, cleanup, err := createTestDatabase("1410586890.28563")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, mergeItemsByName(db, []string{"a"}))
+	deviceRoot := filepath.Dir(filepath.Dir(filepath.Dir(filepath.Dir(filepath.Dir(filepath.Dir(dbFile))))))
+	r := &Replicator{
+		deviceRoot:     deviceRoot,
+		reconCachePath: deviceRoot,
+		logger:         zap.NewNop(),
+		Ring:           &test.FakeRing{MockLocalDevices: []*ring.Device{{Device: "device"}}},
+	}
+	a := newAccountAuditor(r, time.Hour, 0)
+	a.run()
+	require.Equal(t, int64(1), a.passed)
+	require.Equal(t, int64(0), a.failed)
+
+	data, err := ioutil.ReadFile(filepath.Join(deviceRoot, "account.recon"))
+	require.Nil(t, err)
+	recon := map[string]interface{}{}
+	require.Nil(t, json.Unmarshal(data, &recon))
+	require.Equal(t, float64(1), recon["account_audits_passed"])
+	require.Equal(t, float64(0), recon["account_audits_failed"])
+}
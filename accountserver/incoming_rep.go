@@ -16,8 +16,10 @@
 package accountserver
 
 import (
+	"crypto/md5"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"os"
@@ -105,6 +107,8 @@ func (server *AccountServer) AccountReplicateHandler(writer http.ResponseWriter,
 		return nil
 	}
 	switch op {
+	// Replicators from before databases were created with "create" and
+	// merge_items send the whole database file for this.
 	case "complete_rsync":
 		var tmpFileName string
 		if err := extractArgs(&tmpFileName); err != nil {
@@ -130,6 +134,14 @@ func (server *AccountServer) AccountReplicateHandler(writer http.ResponseWriter,
 			status := server.replicateMergeSyncs(request, vars, records)
 			srv.StandardResponse(writer, status)
 		}
+	case "create":
+		var account, putTimestamp string
+		if err := extractArgs(&account, &putTimestamp); err != nil {
+			srv.StandardResponse(writer, http.StatusBadRequest)
+		} else {
+			status := server.replicateCreate(request, vars, account, putTimestamp)
+			srv.StandardResponse(writer, status)
+		}
 	case "sync":
 		var maxRow int64
 		var hash, id, createdAt, putTimestamp, deleteTimestamp, metadata string
@@ -182,6 +194,30 @@ func (server *AccountServer) replicateCompleteRsync(request *http.Request, vars
 	return http.StatusNoContent
 }
 
+// replicateCreate makes an empty database for an account that's missing here.
+// The replicator then syncs its info and merges in its rows.
+func (server *AccountServer) replicateCreate(request *http.Request, vars map[string]string, account, putTimestamp string) int {
+	h := md5.New()
+	fmt.Fprintf(h, "%s/%s%s", server.hashPathPrefix, account, server.hashPathSuffix)
+	if fmt.Sprintf("%032x", h.Sum(nil)) != vars["hash"] {
+		return http.StatusBadRequest
+	}
+	if db, err := server.accountEngine.GetByHash(vars["device"], vars["hash"], vars["partition"]); err == nil {
+		server.accountEngine.Return(db)
+		return http.StatusAccepted
+	}
+	_, db, err := server.accountEngine.Create(map[string]string{"device": vars["device"], "partition": vars["partition"],
+		"account": account}, putTimestamp, map[string][]string{})
+	if err != nil {
+		srv.GetLogger(request).Error("Error creating database.",
+			zap.String("vars['hash']", vars["hash"]),
+			zap.Error(err))
+		return http.StatusInternalServerError
+	}
+	server.accountEngine.Return(db)
+	return http.StatusCreated
+}
+
 func (server *AccountServer) replicateMergeItems(request *http.Request, vars map[string]string, records []*ContainerRecord, remoteID string) int {
 	db, err := server.accountEngine.GetByHash(vars["device"], vars["hash"], vars["partition"])
 	if err != nil {
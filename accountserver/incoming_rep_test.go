@@ -196,6 +196,32 @@ func TestServerReplicateCompleteRsyncNotFound(t *testing.T) {
 	require.Equal(t, http.StatusNotFound, rsp.Status)
 }
 
+func TestServerReplicateCreate(t *testing.T) {
+	handler, cleanup, err := makeTestServer()
+	require.Nil(t, err)
+	defer cleanup()
+
+	replicate := func(hash string) int {
+		msg, err := json.Marshal([]interface{}{"create", "a", common.CanonicalTimestamp(100)})
+		require.Nil(t, err)
+		rsp := test.MakeCaptureResponse()
+		req, err := http.NewRequest("REPLICATE", "/device/1/"+hash, bytes.NewBuffer(msg))
+		require.Nil(t, err)
+		handler.ServeHTTP(rsp, req)
+		return rsp.Status
+	}
+	require.Equal(t, http.StatusBadRequest, replicate("ffffffffffffffffffffffffffffffff"))
+	require.Equal(t, http.StatusCreated, replicate("fd2d8dafa0570422b397941531342ca4"))
+	require.Equal(t, http.StatusAccepted, replicate("fd2d8dafa0570422b397941531342ca4"))
+
+	rsp := test.MakeCaptureResponse()
+	req, err := http.NewRequest("HEAD", "/device/1/a", nil)
+	require.Nil(t, err)
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 204, rsp.Status)
+	require.Equal(t, common.CanonicalTimestamp(100), rsp.Header().Get("X-Put-Timestamp"))
+}
+
 func TestServerReplicateSyncNotFound(t *testing.T) {
 	handler, cleanup, err := makeTestServer()
 	require.Nil(t, err)
@@ -363,7 +389,7 @@ func TestServerReplicateBadJsonOp(t *testing.T) {
 	handler, cleanup, err := makeTestServer()
 	require.Nil(t, err)
 	defer cleanup()
-	for _, op := range []string{"complete_rsync", "merge_items", "merge_syncs", "sync"} {
+	for _, op := range []string{"complete_rsync", "create", "merge_items", "merge_syncs", "sync"} {
 		msg, err := json.Marshal([]string{op})
 		require.Nil(t, err)
 		rsp := test.MakeCaptureResponse()
@@ -0,0 +1,268 @@
+package accountserver
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/troubling/hummingbird/client"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/middleware"
+	"github.com/troubling/nectar"
+	"go.uber.org/zap"
+)
+
+// newDirectClient makes the client the reaper deletes an account's containers
+// and objects with.
+var newDirectClient = client.NewDirectClient
+
+// reaperStats counts what the reaper has done since the replicator started.
+type reaperStats struct {
+	accounts   int64
+	containers int64
+	objects    int64
+	failures   int64
+}
+
+// try to reap account for given database. will spin off a go routine to do
+// actual deleting
+func (r *Replicator) TryToReapAccount(dbFile string) {
+	r.reaperLock.Lock()
+	defer r.reaperLock.Unlock()
+
+	if r.reaperLastCheckin.IsZero() {
+		r.reaperLastCheckin = time.Now()
+		go r.reapAccount(dbFile, r.reaperCanceler)
+	} else if time.Since(r.reaperLastCheckin) > deviceLockupTimeout {
+		close(r.reaperCanceler)
+		r.reaperCanceler = make(chan struct{})
+		r.reaperLastCheckin = time.Now()
+		go r.reapAccount(dbFile, r.reaperCanceler)
+	} else {
+		r.logger.Debug("Wanted to reap an account but one is already running", zap.String("dbFile", dbFile))
+	}
+}
+
+// reaperRecon saves the reaper's counts, and the account it's reaping if any,
+// to recon.
+func (r *Replicator) reaperRecon(account string) {
+	recon := map[string]interface{}{
+		"account_reaper_accounts":   atomic.LoadInt64(&r.reaperStats.accounts),
+		"account_reaper_containers": atomic.LoadInt64(&r.reaperStats.containers),
+		"account_reaper_objects":    atomic.LoadInt64(&r.reaperStats.objects),
+		"account_reaper_failures":   atomic.LoadInt64(&r.reaperStats.failures),
+		"account_reaper_account":    account,
+		"account_reaper_last":       float64(time.Now().UnixNano()) / float64(time.Second),
+	}
+	if err := middleware.DumpReconCache(r.reconCachePath, "account", recon); err != nil {
+		r.logger.Error("account-reaper saving recon data", zap.Error(err))
+	}
+}
+
+// reapContainer deletes the container's objects a page at a time, and then
+// the container. Each page's deletes finish before the next page is listed,
+// so the container is empty by the time it's deleted. If any objects couldn't
+// be deleted the container is left for the next time the account is reaped.
+func (r *Replicator) reapContainer(cont string, dc nectar.Client, contObjChan chan *contObj, canceler chan struct{}) error {
+	var failed int64
+	marker := ""
+	for {
+		objs, resp := dc.GetContainer(cont, marker, "", 10000, "", "", false, map[string]string{})
+		if resp == nil {
+			return fmt.Errorf("no response listing container")
+		} else if resp.StatusCode == http.StatusNotFound {
+			return nil
+		} else if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("listing container gave status %d", resp.StatusCode)
+		}
+		if len(objs) == 0 {
+			break
+		}
+		wg := &sync.WaitGroup{}
+		for _, obj := range objs {
+			wg.Add(1)
+			select {
+			case contObjChan <- &contObj{cont: cont, obj: obj.Name, wg: wg, failed: &failed}:
+			case <-canceler:
+				return nil
+			}
+		}
+		wg.Wait()
+		marker = objs[len(objs)-1].Name
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d objects could not be deleted", failed)
+	}
+	resp := dc.DeleteContainer(cont, map[string]string{"X-Timestamp": common.GetTimestamp()})
+	if resp == nil {
+		return fmt.Errorf("no response deleting container")
+	} else if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("deleting container gave status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+type contObj struct {
+	cont   string
+	obj    string
+	wg     *sync.WaitGroup
+	failed *int64
+}
+
+// in case the db didn't get completely deleted- try again tomorrow
+func (r *Replicator) pushBackDeleteIfNeeded(dbFile string) {
+	db, err := sqliteOpenAccount(dbFile)
+	if err != nil {
+		r.logger.Error("error on opening dbfile", zap.String("dbFile", dbFile), zap.Error(err))
+		return
+	}
+	defer db.Close()
+	if d, err := db.IsDeleted(); err != nil {
+		r.logger.Error("error on checking IsDeleted", zap.String("dbFile", dbFile), zap.Error(err))
+		return
+	} else if !d {
+		r.logger.Error("pushBackDeleteIfNeeded was call on active account", zap.String("dbFile", dbFile))
+		return
+	}
+	info, err := db.GetInfo()
+	if err != nil {
+		r.logger.Error("pushBackDeleteIfNeeded getInfo error", zap.String("dbFile", dbFile), zap.Error(err))
+		return
+	}
+	if info.ObjectCount > 0 || info.ContainerCount > 0 {
+		if dti, err := strconv.ParseFloat(info.DeleteTimestamp, 64); err == nil {
+			dti += common.ONE_DAY
+			db.Delete(common.CanonicalTimestamp(dti))
+		} else {
+			r.logger.Error("invalid timestamp error", zap.String("dbFile", dbFile), zap.Error(err))
+			return
+		}
+	}
+}
+
+// reapAccount deletes the containers of a deleted account, reaping up to
+// reaperContainerConcurrency containers at a time with reaperConcurrency
+// object deletes between them.
+func (r *Replicator) reapAccount(dbFile string, canceler chan struct{}) {
+	defer func() {
+		// let the next account be reaped, unless this reap was given up on
+		// and another has already started
+		r.reaperLock.Lock()
+		if r.reaperCanceler == canceler {
+			r.reaperLastCheckin = time.Time{}
+		}
+		r.reaperLock.Unlock()
+	}()
+	defer r.pushBackDeleteIfNeeded(dbFile)
+
+	db, err := sqliteOpenAccount(dbFile)
+	if err != nil {
+		r.logger.Error("error on opening dbfile", zap.String("dbFile", dbFile), zap.Error(err))
+		return
+	}
+	defer db.Close()
+	if d, err := db.IsDeleted(); err != nil {
+		r.logger.Error("error on checking IsDeleted", zap.String("dbFile", dbFile), zap.Error(err))
+		return
+	} else if !d {
+		r.logger.Error("reapAccount was call on active account", zap.String("dbFile", dbFile))
+		return
+	}
+	info, err := db.GetInfo()
+	if err != nil {
+		r.logger.Error("reapAccount getInfo errpr", zap.String("dbFile", dbFile), zap.Error(err))
+		return
+	}
+	dc, err := newDirectClient(info.Account, srv.DefaultConfigLoader{}, r.certFile, r.keyFile, r.logger)
+	if err != nil {
+		r.logger.Error("Could not create client to reap account.", zap.String("account", info.Account), zap.Error(err))
+		return
+	}
+	r.reaperLock.Lock()
+	r.reaperAccount = info.Account
+	r.reaperLock.Unlock()
+	r.reaperRecon(info.Account)
+	defer func() {
+		r.reaperLock.Lock()
+		r.reaperAccount = ""
+		r.reaperLock.Unlock()
+		atomic.AddInt64(&r.reaperStats.accounts, 1)
+		r.reaperRecon("")
+	}()
+
+	wg := sync.WaitGroup{}
+	contObjChan := make(chan *contObj, r.reaperConcurrency)
+	var objsDeleted int64
+	for i := 0; i < r.reaperConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for co := range contObjChan {
+				if resp := dc.DeleteObject(co.cont, co.obj, map[string]string{"X-Timestamp": common.GetTimestamp()}); resp == nil || (resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound) {
+					r.logger.Debug("invalid reap object resp", zap.String("container", co.cont), zap.String("obj", co.obj))
+					atomic.AddInt64(co.failed, 1)
+					atomic.AddInt64(&r.reaperStats.failures, 1)
+				} else {
+					atomic.AddInt64(&objsDeleted, 1)
+					atomic.AddInt64(&r.reaperStats.objects, 1)
+				}
+				co.wg.Done()
+				r.reaperCheckin <- struct{}{}
+			}
+		}()
+	}
+	contWg := sync.WaitGroup{}
+	contChan := make(chan string)
+	for i := 0; i < r.reaperContainerConcurrency; i++ {
+		contWg.Add(1)
+		go func() {
+			defer contWg.Done()
+			for cont := range contChan {
+				if err := r.reapContainer(cont, dc, contObjChan, canceler); err != nil {
+					r.logger.Error("error reaping container", zap.String("account", info.Account), zap.String("container", cont), zap.Error(err))
+					atomic.AddInt64(&r.reaperStats.failures, 1)
+				} else {
+					atomic.AddInt64(&r.reaperStats.containers, 1)
+				}
+			}
+		}()
+	}
+	marker := ""
+	conts, err := db.ListContainers(1000, marker, "", "", "", false)
+	if err != nil {
+		r.logger.Error("ListContainers error", zap.Error(err))
+		conts = nil // should already be nil
+	}
+	var contr interface{}
+ContLoop:
+	for len(conts) > 0 {
+		contr, conts = conts[0], conts[1:]
+		cont, ok := contr.(*ContainerListingRecord)
+		if !ok {
+			r.logger.Error("invalid listing", zap.String("record", fmt.Sprintf("%v", contr)))
+			break ContLoop
+		}
+		select {
+		case contChan <- cont.Name:
+		case <-canceler:
+			break ContLoop
+		}
+		marker = cont.Name
+		if len(conts) == 0 {
+			conts, err = db.ListContainers(1000, marker, "", "", "", false)
+			if err != nil {
+				r.logger.Error("ListContainers error", zap.Error(err))
+				break ContLoop
+			}
+		}
+	}
+	close(contChan)
+	contWg.Wait()
+	close(contObjChan)
+	wg.Wait()
+	r.logger.Info("reaped account", zap.String("account", info.Account), zap.Int64("objectsDeleted", objsDeleted), zap.Bool("Errored Out", err != nil), zap.Error(err))
+}
@@ -0,0 +1,117 @@
+package accountserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/nectar"
+	"github.com/troubling/nectar/nectarutil"
+	"go.uber.org/zap"
+)
+
+// reaperTestClient keeps the objects in each of an account's containers, and
+// won't delete any object named "bad".
+type reaperTestClient struct {
+	nectar.Client
+	lock       sync.Mutex
+	containers map[string]map[string]bool
+}
+
+func (c *reaperTestClient) GetContainer(container string, marker string, endMarker string, limit int, prefix string, delimiter string, reverse bool, headers map[string]string) ([]*nectar.ObjectRecord, *http.Response) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	objs, ok := c.containers[container]
+	if !ok {
+		return nil, nectarutil.ResponseStub(404, "")
+	}
+	names := []string{}
+	for name := range objs {
+		if name > marker {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	listing := []*nectar.ObjectRecord{}
+	for _, name := range names {
+		listing = append(listing, &nectar.ObjectRecord{Name: name})
+	}
+	return listing, nectarutil.ResponseStub(200, "")
+}
+
+func (c *reaperTestClient) DeleteObject(container string, obj string, headers map[string]string) *http.Response {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if obj == "bad" {
+		return nectarutil.ResponseStub(503, "")
+	}
+	delete(c.containers[container], obj)
+	return nectarutil.ResponseStub(204, "")
+}
+
+func (c *reaperTestClient) DeleteContainer(container string, headers map[string]string) *http.Response {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.containers[container]) > 0 {
+		return nectarutil.ResponseStub(409, "")
+	}
+	delete(c.containers, container)
+	return nectarutil.ResponseStub(204, "")
+}
+
+func TestReapAccount(t *testing.T) {
+	c, dbFile, cleanup, err := createTestDatabase(common.GetTimestamp())
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, mergeItemsByName(c, []string{"c1", "c2", "c3"}))
+	deleted := common.GetTimestamp()
+	require.Nil(t, c.Delete(deleted))
+
+	fc := &reaperTestClient{containers: map[string]map[string]bool{
+		"c1": {"o1": true, "o2": true},
+		"c2": {"o3": true, "bad": true},
+	}}
+	defer func(f func(string, srv.ConfigLoader, string, string, srv.LowLevelLogger) (nectar.Client, error)) {
+		newDirectClient = f
+	}(newDirectClient)
+	newDirectClient = func(account string, cnf srv.ConfigLoader, certFile, keyFile string, logger srv.LowLevelLogger) (nectar.Client, error) {
+		require.Equal(t, "a", account)
+		return fc, nil
+	}
+	r := &Replicator{
+		logger:                     zap.NewNop(),
+		reconCachePath:             filepath.Dir(dbFile),
+		reaperCanceler:             make(chan struct{}),
+		reaperCheckin:              make(chan struct{}, 10),
+		reaperLastCheckin:          time.Now(),
+		reaperConcurrency:          2,
+		reaperContainerConcurrency: 2,
+	}
+	r.reapAccount(dbFile, r.reaperCanceler)
+
+	// c2 is kept until its last object can be deleted, and c3 was already gone.
+	require.Equal(t, map[string]map[string]bool{"c2": {"bad": true}}, fc.containers)
+	require.Equal(t, reaperStats{accounts: 1, containers: 2, objects: 3, failures: 2}, r.reaperStats)
+	require.True(t, r.reaperLastCheckin.IsZero())
+
+	data, err := ioutil.ReadFile(filepath.Join(filepath.Dir(dbFile), "account.recon"))
+	require.Nil(t, err)
+	recon := map[string]interface{}{}
+	require.Nil(t, json.Unmarshal(data, &recon))
+	require.Equal(t, float64(3), recon["account_reaper_objects"])
+	require.Equal(t, float64(2), recon["account_reaper_failures"])
+	require.Equal(t, "", recon["account_reaper_account"])
+
+	// The account still lists containers, so it'll be reaped again tomorrow.
+	info, err := c.GetInfo()
+	require.Nil(t, err)
+	require.True(t, info.DeleteTimestamp > deleted)
+}
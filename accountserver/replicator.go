@@ -33,7 +33,6 @@ import (
 	"strconv"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/justinas/alice"
@@ -47,9 +46,7 @@ import (
 	"github.com/troubling/hummingbird/common/srv"
 	"github.com/troubling/hummingbird/common/tracing"
 	"github.com/troubling/hummingbird/middleware"
-	"github.com/troubling/nectar"
 	"github.com/uber-go/tally"
-	promreporter "github.com/uber-go/tally/prometheus"
 	"go.uber.org/zap"
 	"golang.org/x/net/http2"
 )
@@ -76,12 +73,14 @@ type Replicator struct {
 	checkin           chan string
 	startRun          chan string
 	client            common.HTTPClient
+	backends          *common.BackendTransport
 	certFile          string
 	keyFile           string
 	runningDevices    map[string]*replicationDevice
 	reclaimAge        int64
 	logLevel          zap.AtomicLevel
 	metricsCloser     io.Closer
+	metricsScope      tally.Scope
 	traceCloser       io.Closer
 	tracer            opentracing.Tracer
 	clientTracer      opentracing.Tracer
@@ -90,6 +89,13 @@ type Replicator struct {
 	reaperLastCheckin time.Time
 	reaperCanceler    chan struct{}
 	reaperCheckin     chan struct{}
+	reaperAccount     string
+	reaperStats       reaperStats
+	// seconds after an account is deleted before it's reaped
+	reaperDelay                int64
+	reaperConcurrency          int
+	reaperContainerConcurrency int
+	auditor                    *accountAuditor
 }
 
 type statUpdate struct {
@@ -102,9 +108,9 @@ type replicationDevice struct {
 	i interface {
 		sendReplicationMessage(dev *ring.Device, part uint64, ringHash string, args ...interface{}) (int, []byte, error)
 		sync(dev *ring.Device, part uint64, ringHash string, info *AccountInfo) (*AccountInfo, error)
-		rsync(dev *ring.Device, c ReplicableAccount, part uint64, op string) error
-		usync(dev *ring.Device, c ReplicableAccount, part uint64, localID string, point int64) error
-		chooseReplicationStrategy(localInfo, remoteInfo *AccountInfo, usyncThreshold int64) string
+		create(dev *ring.Device, part uint64, ringHash string, info *AccountInfo) error
+		usync(dev *ring.Device, c ReplicableAccount, part uint64, localID string, point int64, maxUsyncs int) error
+		chooseReplicationStrategy(localInfo, remoteInfo *AccountInfo) string
 		replicateDatabaseToDevice(dev *ring.Device, c ReplicableAccount, part uint64) error
 		replicateDatabase(dbFile string) error
 		checkForReaping(dbFile string) error
@@ -164,34 +170,23 @@ func (rd *replicationDevice) sync(dev *ring.Device, part uint64, ringHash string
 	return &remoteInfo, nil
 }
 
-func (rd *replicationDevice) rsync(dev *ring.Device, c ReplicableAccount, part uint64, op string) error {
-	tmpFilename := common.UUID()
-	fp, release, err := c.OpenDatabaseFile()
+// create has the remote device make an empty database for the account, for
+// usync to fill in.
+func (rd *replicationDevice) create(dev *ring.Device, part uint64, ringHash string, info *AccountInfo) error {
+	status, _, err := rd.i.sendReplicationMessage(dev, part, ringHash, "create", info.Account, info.PutTimestamp)
 	if err != nil {
-		return fmt.Errorf("Error opening databae: %v", err)
-	}
-	defer release()
-	req, err := http.NewRequest("PUT", fmt.Sprintf("%s://%s:%d/%s/tmp/%s", dev.Scheme, dev.Ip, dev.Port, dev.Device, tmpFilename), fp)
-	if err != nil {
-		return fmt.Errorf("creating request: %v", err)
-	}
-	req.Cancel = rd.cancel
-	resp, err := rd.r.client.Do(req)
-	if err != nil {
-		return fmt.Errorf("putting database to %s/%s: %v", dev.Ip, dev.Device, err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode/100 != 2 {
-		return fmt.Errorf("bad status code %d rsyncing file with %s/%s", resp.StatusCode, dev.Ip, dev.Device)
-	}
-	status, _, err := rd.i.sendReplicationMessage(dev, part, c.RingHash(), op, tmpFilename)
-	if err != nil || status/100 != 2 {
-		return fmt.Errorf("sending %s message to %s/%s: status %d: %v", op, dev.Ip, dev.Device, status, err)
+		return fmt.Errorf("sending create request to %s/%s: %v", dev.Ip, dev.Device, err)
+	} else if status == http.StatusInsufficientStorage {
+		return errDeviceNotMounted
+	} else if status/100 != 2 {
+		return fmt.Errorf("bad status code %d creating database on %s/%s", status, dev.Ip, dev.Device)
 	}
 	return nil
 }
 
-func (rd *replicationDevice) usync(dev *ring.Device, c ReplicableAccount, part uint64, localID string, point int64) error {
+// usync sends the remote database the rows after point, in at most maxUsyncs
+// merge_items requests, or in as many as it takes if maxUsyncs is 0.
+func (rd *replicationDevice) usync(dev *ring.Device, c ReplicableAccount, part uint64, localID string, point int64, maxUsyncs int) error {
 	objects, err := c.ItemsSince(point, int(rd.r.perUsync))
 	if err != nil {
 		return fmt.Errorf("getting object records from %s: %v", c.RingHash(), err)
@@ -201,7 +196,7 @@ func (rd *replicationDevice) usync(dev *ring.Device, c ReplicableAccount, part u
 	if err != nil {
 		return fmt.Errorf("Error getting sync table: %v", err)
 	}
-	for len(objects) != 0 && usyncs < rd.r.maxUsyncs {
+	for len(objects) != 0 && (maxUsyncs == 0 || usyncs < maxUsyncs) {
 		status, _, err := rd.i.sendReplicationMessage(dev, part, c.RingHash(), "merge_items", objects, localID)
 		if err != nil || status/100 != 2 {
 			return fmt.Errorf("Bad response to merge_items with %s/%s: status %d: %v", dev.Ip, dev.Device, status, err)
@@ -212,7 +207,7 @@ func (rd *replicationDevice) usync(dev *ring.Device, c ReplicableAccount, part u
 			return fmt.Errorf("getting object records from database: %s, %v", c.RingHash(), err)
 		}
 	}
-	if usyncs >= rd.r.maxUsyncs {
+	if maxUsyncs > 0 && usyncs >= maxUsyncs {
 		rd.i.incrementStat("diff_capped")
 		return fmt.Errorf("capping usync at %d requests", usyncs)
 	}
@@ -226,10 +221,10 @@ func (rd *replicationDevice) usync(dev *ring.Device, c ReplicableAccount, part u
 	return nil
 }
 
-func (rd *replicationDevice) chooseReplicationStrategy(localInfo, remoteInfo *AccountInfo, usyncThreshold int64) string {
+func (rd *replicationDevice) chooseReplicationStrategy(localInfo, remoteInfo *AccountInfo) string {
 	switch {
 	case remoteInfo == nil:
-		return "complete_rsync"
+		return "create"
 	case localInfo.MaxRow == -1:
 		return "empty"
 	case localInfo.MaxRow == remoteInfo.Point:
@@ -251,27 +246,34 @@ func (rd *replicationDevice) replicateDatabaseToDevice(dev *ring.Device, c Repli
 	if err != nil {
 		return err
 	}
-	strategy := rd.i.chooseReplicationStrategy(info, remoteInfo, rd.r.perUsync*3)
+	strategy := rd.i.chooseReplicationStrategy(info, remoteInfo)
 	rd.i.incrementStat(strategy)
 	switch strategy {
 	case "empty", "hashmatch", "no_change":
 		rd.r.logger.Debug("Not replicating anything.",
 			zap.String("strategy", strategy),
 			zap.String("RingHash", c.RingHash()))
-	case "complete_rsync":
+	case "create", "diff":
 		rd.r.logger.Debug("Replicating ringhash",
 			zap.String("RingHash", c.RingHash()),
 			zap.String("Ip", dev.Ip),
 			zap.String("Device", dev.Device),
 			zap.String("strategy", strategy))
-		return rd.i.rsync(dev, c, part, strategy)
-	case "diff":
-		rd.r.logger.Debug("Replicating ringhash",
-			zap.String("RingHash", c.RingHash()),
-			zap.String("Ip", dev.Ip),
-			zap.String("Device", dev.Device),
-			zap.String("strategy", strategy))
-		return rd.i.usync(dev, c, part, info.ID, remoteInfo.Point)
+		maxUsyncs := rd.r.maxUsyncs
+		if strategy == "create" {
+			// A new database is filled in all at once, rather than serving
+			// part of the listing for passes to come.
+			maxUsyncs = 0
+			if err := rd.i.create(dev, part, c.RingHash(), info); err != nil {
+				return err
+			}
+			if remoteInfo, err = rd.i.sync(dev, part, c.RingHash(), info); err != nil {
+				return err
+			} else if remoteInfo == nil {
+				return fmt.Errorf("no database on %s/%s after creating it", dev.Ip, dev.Device)
+			}
+		}
+		return rd.i.usync(dev, c, part, info.ID, remoteInfo.Point, maxUsyncs)
 	}
 	return nil
 }
@@ -304,7 +306,7 @@ func (rd *replicationDevice) checkForReaping(dbFile string) error {
 	if info.DeleteTimestamp > info.PutTimestamp {
 		if dti, err := strconv.ParseFloat(info.DeleteTimestamp, 64); err == nil {
 			dt := time.Unix(int64(dti), 0)
-			cutOff := time.Now().Add(time.Second * time.Duration(-rd.r.reclaimAge))
+			cutOff := time.Now().Add(time.Second * time.Duration(-rd.r.reaperDelay))
 
 			if dt.Before(cutOff) {
 				doDelete = true
@@ -334,7 +336,7 @@ func (rd *replicationDevice) replicateDatabase(dbFile string) error {
 	}
 	if isD, err := c.IsDeleted(); err == nil && isD {
 		doDelete := false
-		if info, err := c.GetInfo(); err == nil && info.ObjectCount == 0 && info.DeleteTimestamp > info.PutTimestamp {
+		if info, err := c.GetInfo(); err == nil && info.ObjectCount == 0 && info.ContainerCount == 0 && info.DeleteTimestamp > info.PutTimestamp {
 			if dti, err := strconv.ParseFloat(info.DeleteTimestamp, 64); err == nil {
 				dt := time.Unix(int64(dti), 0)
 				cutOff := time.Now().Add(time.Second * time.Duration(-rd.r.reclaimAge))
@@ -539,21 +541,24 @@ func (server *Replicator) Background(flags *flag.FlagSet) chan struct{} {
 		go func() {
 			defer close(ch)
 			server.Run()
+			if server.auditor != nil {
+				server.auditor.run()
+			}
 		}()
 		return ch
 	}
 	go server.RunForever()
+	if server.auditor != nil {
+		go server.auditor.runForever()
+	}
 	return nil
 }
 
 func (server *Replicator) GetHandler(config conf.Config, metricsPrefix string) http.Handler {
-	var metricsScope tally.Scope
-	metricsScope, server.metricsCloser = tally.NewRootScope(tally.ScopeOptions{
-		Prefix:         metricsPrefix,
-		Tags:           map[string]string{},
-		CachedReporter: promreporter.NewReporter(promreporter.Options{}),
-		Separator:      promreporter.DefaultSeparator,
-	}, time.Second)
+	server.metricsScope, server.metricsCloser = srv.NewMetricsScope(config, metricsPrefix)
+	if server.backends != nil {
+		server.backends.SetMetricsScope(server.metricsScope)
+	}
 	commonHandlers := alice.New(
 		middleware.NewDebugResponses(config.GetBool("debug", "debug_x_source_code", false)),
 		server.LogRequest,
@@ -567,7 +572,7 @@ func (server *Replicator) GetHandler(config conf.Config, metricsPrefix string) h
 	router.Get("/healthcheck", commonHandlers.ThenFunc(server.HealthcheckHandler))
 	router.Get("/debug/pprof/:parm", http.DefaultServeMux)
 	router.Post("/debug/pprof/:parm", http.DefaultServeMux)
-	return alice.New(middleware.Metrics(metricsScope), middleware.ServerTracer(server.tracer)).Then(router)
+	return alice.New(middleware.Metrics(server.metricsScope), middleware.ServerTracer(server.tracer)).Then(router)
 }
 
 func (server *Replicator) Finalize() {
@@ -687,13 +692,25 @@ func (r *Replicator) runLoopCheck(reportTimer <-chan time.Time) {
 			}
 			rd.lifetimeStats["passes"]++
 		}
+		if r.metricsScope != nil {
+			r.metricsScope.Counter(fmt.Sprintf("%s_passes", device)).Inc(1)
+		}
 	case update := <-r.sendStat:
 		if rd, ok := r.runningDevices[update.device]; ok {
 			rd.stats[update.stat] += update.value
 		}
+		if r.metricsScope != nil {
+			r.metricsScope.Counter(fmt.Sprintf("%s_%s", update.device, update.stat)).Inc(update.value)
+		}
 	case <-reportTimer:
 		r.reportStats()
 		r.verifyDevices()
+		r.reaperLock.Lock()
+		account := r.reaperAccount
+		r.reaperLock.Unlock()
+		if account != "" {
+			r.reaperRecon(account)
+		}
 	}
 }
 
@@ -739,174 +756,6 @@ func (r *Replicator) Run() {
 	r.reportStats()
 }
 
-// try to reap account for given database. will spin off a go routine to do
-// actual deleting
-func (r *Replicator) TryToReapAccount(dbFile string) {
-	r.reaperLock.Lock()
-	defer r.reaperLock.Unlock()
-
-	if r.reaperLastCheckin.IsZero() {
-		r.reaperLastCheckin = time.Now()
-		go r.reapAccount(dbFile, r.reaperCanceler)
-	} else if time.Since(r.reaperLastCheckin) > deviceLockupTimeout {
-		close(r.reaperCanceler)
-		r.reaperCanceler = make(chan struct{})
-		r.reaperLastCheckin = time.Now()
-		go r.reapAccount(dbFile, r.reaperCanceler)
-	} else {
-		r.logger.Debug("Wanted to reap an account but one is already running", zap.String("dbFile", dbFile))
-	}
-}
-func (r *Replicator) reapContainer(cont string, dc nectar.Client, contObjChan chan *contObj, canceler chan struct{}) error {
-	// TODO: add something here that will delete the container if it is empty
-	// the reaper will just make 2 passes to get all the way done
-	marker := ""
-	objs, resp := dc.GetContainer(cont, marker, "", 10000, "", "", false, map[string]string{})
-	var obj *nectar.ObjectRecord
-	hdrs := map[string]string{}
-	for len(objs) > 0 {
-		obj, objs = objs[0], objs[1:]
-		contObjChan <- &contObj{cont, obj.Name}
-		marker = obj.Name
-		if len(objs) == 0 {
-			objs, resp = dc.GetContainer(cont, marker, "", 10000, "", "", false, map[string]string{})
-		}
-		select {
-		case <-canceler:
-			return nil
-		default:
-		}
-	}
-	hdrs["X-Timestamp"] = common.GetTimestamp()
-	if resp = dc.DeleteContainer(cont, hdrs); resp == nil || resp.StatusCode/100 != 2 {
-		r.logger.Debug("invalid reap cont resp", zap.String("container", cont))
-	}
-	return nil
-}
-
-type contObj struct {
-	cont string
-	obj  string
-}
-
-// in case the db didn't get completely deleted- try again tomorrow
-func (r *Replicator) pushBackDeleteIfNeeded(dbFile string) {
-	db, err := sqliteOpenAccount(dbFile)
-	if err != nil {
-		r.logger.Error("error on opening dbfile", zap.String("dbFile", dbFile), zap.Error(err))
-		return
-	}
-	defer db.Close()
-	if d, err := db.IsDeleted(); err != nil {
-		r.logger.Error("error on checking IsDeleted", zap.String("dbFile", dbFile), zap.Error(err))
-		return
-	} else if !d {
-		r.logger.Error("pushBackDeleteIfNeeded was call on active account", zap.String("dbFile", dbFile))
-		return
-	}
-	info, err := db.GetInfo()
-	if err != nil {
-		r.logger.Error("pushBackDeleteIfNeeded getInfo error", zap.String("dbFile", dbFile), zap.Error(err))
-		return
-	}
-	if info.ObjectCount > 0 {
-		if dti, err := strconv.ParseFloat(info.DeleteTimestamp, 64); err == nil {
-			dti += common.ONE_DAY
-			db.Delete(common.CanonicalTimestamp(dti))
-		} else {
-			r.logger.Error("invalid timestamp error", zap.String("dbFile", dbFile), zap.Error(err))
-			return
-		}
-	}
-}
-
-func (r *Replicator) reapAccount(dbFile string, canceler chan struct{}) {
-	defer r.pushBackDeleteIfNeeded(dbFile)
-
-	db, err := sqliteOpenAccount(dbFile)
-	if err != nil {
-		r.logger.Error("error on opening dbfile", zap.String("dbFile", dbFile), zap.Error(err))
-		return
-	}
-	defer db.Close()
-	if d, err := db.IsDeleted(); err != nil {
-		r.logger.Error("error on checking IsDeleted", zap.String("dbFile", dbFile), zap.Error(err))
-		return
-	} else if !d {
-		r.logger.Error("reapAccount was call on active account", zap.String("dbFile", dbFile))
-		return
-	}
-	info, err := db.GetInfo()
-	if err != nil {
-		r.logger.Error("reapAccount getInfo errpr", zap.String("dbFile", dbFile), zap.Error(err))
-		return
-	}
-	dc, err := client.NewDirectClient(info.Account, srv.DefaultConfigLoader{}, r.certFile, r.keyFile, r.logger)
-	if err != nil {
-		r.logger.Error("Could not create client to reap account.", zap.String("account", info.Account), zap.Error(err))
-		return
-	}
-	wg := sync.WaitGroup{}
-	conc := 20 // TODO: make config
-	wg.Add(conc)
-	contObjChan := make(chan *contObj, conc)
-	var objsDeleted int64
-
-	for i := 0; i < conc; i++ {
-		go func() {
-			defer wg.Done()
-			for {
-				co := <-contObjChan
-				if co == nil {
-					return
-				}
-				if resp := dc.DeleteObject(co.cont, co.obj, map[string]string{"X-Timestamp": common.GetTimestamp()}); resp == nil || resp.StatusCode/100 != 2 {
-					r.logger.Debug("invalid reap object resp", zap.String("container", co.cont), zap.String("obj", co.obj))
-				} else {
-					atomic.AddInt64(&objsDeleted, 1)
-				}
-				r.reaperCheckin <- struct{}{}
-			}
-		}()
-	}
-	marker := ""
-	conts, err := db.ListContainers(1000, marker, "", "", "", false)
-	if err != nil {
-		r.logger.Error("ListContainers error", zap.Error(err))
-		conts = nil // should already be nil
-	}
-	var contr interface{}
-ContLoop:
-	for len(conts) > 0 {
-		contr, conts = conts[0], conts[1:]
-		cont, ok := contr.(*ContainerListingRecord)
-		if ok {
-			if err = r.reapContainer(cont.Name, dc, contObjChan, canceler); err != nil {
-				r.logger.Error("error reaping container", zap.String("account", info.Account), zap.String("container", cont.Name), zap.Error(err))
-			}
-			marker = cont.Name
-		} else {
-			r.logger.Error("invalid listing", zap.String("record", fmt.Sprintf("%v", contr)))
-			break ContLoop
-		}
-		if len(conts) == 0 {
-			conts, err = db.ListContainers(1000, marker, "", "", "", false)
-			if err != nil {
-				r.logger.Error("ListContainers error", zap.Error(err))
-				break ContLoop
-			}
-		}
-		select {
-		case <-canceler:
-			break ContLoop
-		default:
-		}
-	}
-	close(contObjChan)
-	wg.Wait()
-	r.logger.Info("reaped account", zap.String("account", info.Account), zap.Int64("objectsDeleted", objsDeleted), zap.Bool("Errored Out", err != nil), zap.Error(err))
-}
-
 // NewReplicator uses the config settings and command-line flags to configure and return a replicator daemon struct.
 func NewReplicator(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader) (*srv.IpPort, srv.Server, srv.LowLevelLogger, error) {
 	var ipPort *srv.IpPort
@@ -936,10 +785,15 @@ func NewReplicator(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLo
 	port := int(serverconf.GetInt("account-replicator", "bind_port", common.DefaultAccountReplicatorPort))
 	certFile := serverconf.GetDefault("account-replicator", "cert_file", "")
 	keyFile := serverconf.GetDefault("account-replicator", "key_file", "")
+	caFile := serverconf.GetDefault("account-replicator", "ca_file", "")
+	if err := common.SetClusterCA(caFile); err != nil {
+		return ipPort, nil, nil, err
+	}
 
+	backendConfig := common.LoadBackendConfig(serverconf.GetSection("account-replicator"), common.DefaultBackendConfig)
 	transport := &http.Transport{
 		Dial:                (&net.Dialer{Timeout: time.Second}).Dial,
-		MaxIdleConnsPerHost: 100,
+		MaxIdleConnsPerHost: backendConfig.MaxIdleConnsPerNode,
 		MaxIdleConns:        0,
 	}
 	if certFile != "" && keyFile != "" {
@@ -952,31 +806,36 @@ func NewReplicator(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLo
 			return ipPort, nil, nil, fmt.Errorf("Error setting up http2: %v", err)
 		}
 	}
+	backends := common.NewBackendTransport(common.NewSigningTransport(transport, conf.GetBackendSigningKeys()), backendConfig)
 	c := &http.Client{
 		Timeout:   time.Minute * 15,
-		Transport: transport,
+		Transport: backends,
 	}
 	server := &Replicator{
-		runningDevices: make(map[string]*replicationDevice),
-		perUsync:       3000,
-		maxUsyncs:      25,
-		sendStat:       make(chan statUpdate),
-		checkin:        make(chan string),
-		reaperCheckin:  make(chan struct{}),
-		reaperCanceler: make(chan struct{}),
-		startRun:       make(chan string),
-		reconCachePath: serverconf.GetDefault("account-replicator", "recon_cache_path", "/var/cache/swift"),
-		checkMounts:    serverconf.GetBool("account-replicator", "mount_check", true),
-		deviceRoot:     serverconf.GetDefault("account-replicator", "devices", "/srv/node"),
-		serverPort:     port,
-		reclaimAge:     serverconf.GetInt("account-replicator", "reclaim_age", 604800),
-		logger:         logger,
-		concurrencySem: make(chan struct{}, concurrency),
-		Ring:           ring,
-		client:         c,
-		certFile:       certFile,
-		keyFile:        keyFile,
-		logLevel:       logLevel,
+		runningDevices:             make(map[string]*replicationDevice),
+		perUsync:                   3000,
+		maxUsyncs:                  25,
+		sendStat:                   make(chan statUpdate),
+		checkin:                    make(chan string),
+		reaperCheckin:              make(chan struct{}),
+		reaperCanceler:             make(chan struct{}),
+		reaperConcurrency:          int(serverconf.GetInt("account-reaper", "concurrency", 20)),
+		reaperContainerConcurrency: int(serverconf.GetInt("account-reaper", "container_concurrency", 4)),
+		startRun:                   make(chan string),
+		reconCachePath:             serverconf.GetDefault("account-replicator", "recon_cache_path", "/var/cache/swift"),
+		checkMounts:                serverconf.GetBool("account-replicator", "mount_check", true),
+		deviceRoot:                 serverconf.GetDefault("account-replicator", "devices", "/srv/node"),
+		serverPort:                 port,
+		reclaimAge:                 serverconf.GetInt("account-replicator", "reclaim_age", 604800),
+		reaperDelay:                serverconf.GetInt("account-reaper", "delay_reaping", serverconf.GetInt("account-replicator", "reclaim_age", 604800)),
+		logger:                     logger,
+		concurrencySem:             make(chan struct{}, concurrency),
+		Ring:                       ring,
+		client:                     c,
+		backends:                   backends,
+		certFile:                   certFile,
+		keyFile:                    keyFile,
+		logLevel:                   logLevel,
 	}
 	if serverconf.HasSection("tracing") {
 		server.tracer, server.traceCloser, err = tracing.Init("account-replicator", server.logger, serverconf.GetSection("tracing"))
@@ -993,6 +852,14 @@ func NewReplicator(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLo
 			return ipPort, nil, nil, fmt.Errorf("Error setting up tracing client: %v", err)
 		}
 	}
-	ipPort = &srv.IpPort{Ip: ip, Port: port, CertFile: certFile, KeyFile: keyFile}
+	if serverconf.HasSection("account-auditor") {
+		server.auditor = newAccountAuditor(server,
+			time.Duration(serverconf.GetFloat("account-auditor", "interval", 1800)*float64(time.Second)),
+			serverconf.GetInt("account-auditor", "accounts_per_second", 200))
+	}
+	ipPort = &srv.IpPort{Ip: ip, Port: port, CertFile: certFile, KeyFile: keyFile, CAFile: caFile,
+		ClientCertOptional: !serverconf.GetBool("account-replicator", "require_client_cert", true),
+		HTTP2:              srv.NewHTTP2Config(serverconf.GetSection("account-replicator")),
+		UnixSocket:         serverconf.GetDefault("account-replicator", "bind_unix_socket", "")}
 	return ipPort, server, logger, nil
 }
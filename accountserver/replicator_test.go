@@ -19,7 +19,6 @@ import (
 	"encoding/json"
 	"errors"
 	"flag"
-	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -47,9 +46,9 @@ type patchableReplicationDevice struct {
 	rd                         *replicationDevice
 	_sendReplicationMessage    func(dev *ring.Device, part uint64, ringHash string, args ...interface{}) (int, []byte, error)
 	_sync                      func(dev *ring.Device, part uint64, ringHash string, info *AccountInfo) (*AccountInfo, error)
-	_rsync                     func(dev *ring.Device, c ReplicableAccount, part uint64, op string) error
-	_usync                     func(dev *ring.Device, c ReplicableAccount, part uint64, localID string, point int64) error
-	_chooseReplicationStrategy func(localInfo, remoteInfo *AccountInfo, usyncThreshold int64) string
+	_create                    func(dev *ring.Device, part uint64, ringHash string, info *AccountInfo) error
+	_usync                     func(dev *ring.Device, c ReplicableAccount, part uint64, localID string, point int64, maxUsyncs int) error
+	_chooseReplicationStrategy func(localInfo, remoteInfo *AccountInfo) string
 	_replicateDatabaseToDevice func(dev *ring.Device, c ReplicableAccount, part uint64) error
 	_replicateDatabase         func(dbFile string) error
 	_findAccountDbs            func(devicePath string, results chan string)
@@ -68,23 +67,23 @@ func (d *patchableReplicationDevice) sync(dev *ring.Device, part uint64, ringHas
 	}
 	return d.rd.sync(dev, part, ringHash, info)
 }
-func (d *patchableReplicationDevice) rsync(dev *ring.Device, c ReplicableAccount, part uint64, op string) error {
-	if d._rsync != nil {
-		return d._rsync(dev, c, part, op)
+func (d *patchableReplicationDevice) create(dev *ring.Device, part uint64, ringHash string, info *AccountInfo) error {
+	if d._create != nil {
+		return d._create(dev, part, ringHash, info)
 	}
-	return d.rd.rsync(dev, c, part, op)
+	return d.rd.create(dev, part, ringHash, info)
 }
-func (d *patchableReplicationDevice) usync(dev *ring.Device, c ReplicableAccount, part uint64, localID string, point int64) error {
+func (d *patchableReplicationDevice) usync(dev *ring.Device, c ReplicableAccount, part uint64, localID string, point int64, maxUsyncs int) error {
 	if d._usync != nil {
-		return d._usync(dev, c, part, localID, point)
+		return d._usync(dev, c, part, localID, point, maxUsyncs)
 	}
-	return d.rd.usync(dev, c, part, localID, point)
+	return d.rd.usync(dev, c, part, localID, point, maxUsyncs)
 }
-func (d *patchableReplicationDevice) chooseReplicationStrategy(localInfo, remoteInfo *AccountInfo, usyncThreshold int64) string {
+func (d *patchableReplicationDevice) chooseReplicationStrategy(localInfo, remoteInfo *AccountInfo) string {
 	if d._chooseReplicationStrategy != nil {
-		return d._chooseReplicationStrategy(localInfo, remoteInfo, usyncThreshold)
+		return d._chooseReplicationStrategy(localInfo, remoteInfo)
 	}
-	return d.rd.chooseReplicationStrategy(localInfo, remoteInfo, usyncThreshold)
+	return d.rd.chooseReplicationStrategy(localInfo, remoteInfo)
 }
 func (d *patchableReplicationDevice) replicateDatabaseToDevice(dev *ring.Device, c ReplicableAccount, part uint64) error {
 	if d._replicateDatabaseToDevice != nil {
@@ -299,31 +298,23 @@ func TestReplicatorSyncUnmounted(t *testing.T) {
 	require.Equal(t, err, errDeviceNotMounted)
 }
 
-func TestReplicatorRsync(t *testing.T) {
-	tmpFileName := ""
+func TestReplicatorCreate(t *testing.T) {
 	dev, cleanup1 := testServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "PUT" {
-			written, err := io.Copy(ioutil.Discard, r.Body)
-			require.Nil(t, err)
-			require.True(t, written > 0)
-			tmpFileName = filepath.Base(r.URL.Path)
-		} else if r.Method == "REPLICATE" {
-			var args []interface{}
-			body, err := ioutil.ReadAll(r.Body)
-			require.Nil(t, err)
-			require.Nil(t, json.Unmarshal(body, &args))
-			require.Equal(t, args[0], "complete_rsync")
-			require.Equal(t, args[1], tmpFileName)
-		}
+		var args []interface{}
+		body, err := ioutil.ReadAll(r.Body)
+		require.Nil(t, err)
+		require.Nil(t, json.Unmarshal(body, &args))
+		require.Equal(t, []interface{}{"create", "a", "1410586890.28563"}, args)
+		w.WriteHeader(http.StatusCreated)
 	}))
 	defer cleanup1()
 	rd := newTestReplicationDevice(&ring.Device{}, &Replicator{client: http.DefaultClient})
 	c, _, cleanup2, err := createTestDatabase("1410586890.28563")
 	require.Nil(t, err)
-	require.Nil(t, mergeItemsByName(c, []string{"a", "b", "c"}))
 	defer cleanup2()
-	err = rd.rsync(dev, c, 1, "complete_rsync")
+	info, err := c.GetInfo()
 	require.Nil(t, err)
+	require.Nil(t, rd.create(dev, 1, c.RingHash(), info))
 }
 
 func TestReplicatorUsync(t *testing.T) {
@@ -346,23 +337,41 @@ func TestReplicatorUsync(t *testing.T) {
 	require.Nil(t, err)
 	require.Nil(t, mergeItemsByName(c, []string{"a", "b", "c"}))
 	defer cleanup2()
-	err = rd.usync(dev, c, 1, "12345", -1)
+	err = rd.usync(dev, c, 1, "12345", -1, 5)
+	require.Nil(t, err)
+}
+
+func TestReplicatorUsyncCapped(t *testing.T) {
+	requests := 0
+	dev, cleanup1 := testServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer cleanup1()
+	rd := newTestReplicationDevice(&ring.Device{}, &Replicator{client: http.DefaultClient, perUsync: 1, maxUsyncs: 2})
+	c, _, cleanup2, err := createTestDatabase("1410586890.28563")
 	require.Nil(t, err)
+	defer cleanup2()
+	require.Nil(t, mergeItemsByName(c, []string{"a", "b", "c"}))
+	require.NotNil(t, rd.usync(dev, c, 1, "12345", -1, 2))
+	require.Equal(t, 2, requests)
+
+	// With no cap, every row is sent, as when a database is created.
+	requests = 0
+	require.Nil(t, rd.usync(dev, c, 1, "12345", -1, 0))
+	require.Equal(t, 4, requests)
 }
 
 func TestReplicatorChooseReplicationStrategy(t *testing.T) {
 	rd := newTestReplicationDevice(&ring.Device{}, &Replicator{client: http.DefaultClient})
-	require.Equal(t, "complete_rsync", rd.chooseReplicationStrategy(&AccountInfo{}, nil, 100))
-	require.Equal(t, "empty", rd.chooseReplicationStrategy(&AccountInfo{MaxRow: -1}, &AccountInfo{}, 100))
-	require.Equal(t, "no_change", rd.chooseReplicationStrategy(&AccountInfo{MaxRow: 123}, &AccountInfo{Point: 123}, 100))
+	require.Equal(t, "create", rd.chooseReplicationStrategy(&AccountInfo{}, nil))
+	require.Equal(t, "empty", rd.chooseReplicationStrategy(&AccountInfo{MaxRow: -1}, &AccountInfo{}))
+	require.Equal(t, "no_change", rd.chooseReplicationStrategy(&AccountInfo{MaxRow: 123}, &AccountInfo{Point: 123}))
 	require.Equal(t, "hashmatch", rd.chooseReplicationStrategy(
 		&AccountInfo{Hash: "somehash", MaxRow: 10},
-		&AccountInfo{Hash: "somehash", Point: 9},
-		100))
+		&AccountInfo{Hash: "somehash", Point: 9}))
 	require.Equal(t, "diff", rd.chooseReplicationStrategy(
 		&AccountInfo{Hash: "somehash1", MaxRow: 10},
-		&AccountInfo{Hash: "somehash2", Point: 9},
-		100))
+		&AccountInfo{Hash: "somehash2", Point: 9}))
 }
 
 func TestReplicatorReplicateDatabaseToDevice(t *testing.T) {
@@ -370,36 +379,50 @@ func TestReplicatorReplicateDatabaseToDevice(t *testing.T) {
 	require.Nil(t, err)
 	defer cleanup()
 	rd := newTestReplicationDevice(&ring.Device{}, &Replicator{})
-	currentMethod := "complete_rsync"
-	rsyncCalled := false
+	currentMethod := "create"
+	createCalled := false
 	usyncCalled := false
+	usyncCap := -1
 	rd._sync = func(dev *ring.Device, part uint64, ringHash string, info *AccountInfo) (*AccountInfo, error) {
 		return &AccountInfo{}, nil
 	}
-	rd._chooseReplicationStrategy = func(localInfo, remoteInfo *AccountInfo, usyncThreshold int64) string {
+	rd._chooseReplicationStrategy = func(localInfo, remoteInfo *AccountInfo) string {
 		return currentMethod
 	}
-	rd._rsync = func(dev *ring.Device, c ReplicableAccount, part uint64, op string) error {
-		rsyncCalled = true
+	rd._create = func(dev *ring.Device, part uint64, ringHash string, info *AccountInfo) error {
+		createCalled = true
 		return nil
 	}
-	rd._usync = func(dev *ring.Device, c ReplicableAccount, part uint64, localID string, point int64) error {
+	rd._usync = func(dev *ring.Device, c ReplicableAccount, part uint64, localID string, point int64, maxUsyncs int) error {
 		usyncCalled = true
+		usyncCap = maxUsyncs
 		return nil
 	}
 	require.Nil(t, rd.replicateDatabaseToDevice(&ring.Device{}, c, 1))
-	require.True(t, rsyncCalled)
-	require.False(t, usyncCalled)
-	rsyncCalled = false
+	require.True(t, createCalled)
+	require.True(t, usyncCalled)
+	require.Equal(t, 0, usyncCap)
+	createCalled = false
+	usyncCalled = false
 	currentMethod = "diff"
+	rd.rd.r.maxUsyncs = 25
 	require.Nil(t, rd.replicateDatabaseToDevice(&ring.Device{}, c, 1))
 	require.True(t, usyncCalled)
-	require.False(t, rsyncCalled)
+	require.False(t, createCalled)
+	require.Equal(t, 25, usyncCap)
 	usyncCalled = false
 	currentMethod = "no_change"
 	require.Nil(t, rd.replicateDatabaseToDevice(&ring.Device{}, c, 1))
 	require.False(t, usyncCalled)
-	require.False(t, rsyncCalled)
+	require.False(t, createCalled)
+
+	// The database has to be there to merge into once it's created.
+	currentMethod = "create"
+	rd._sync = func(dev *ring.Device, part uint64, ringHash string, info *AccountInfo) (*AccountInfo, error) {
+		return nil, nil
+	}
+	require.NotNil(t, rd.replicateDatabaseToDevice(&ring.Device{}, c, 1))
+	require.False(t, usyncCalled)
 }
 
 func TestFindAccounts(t *testing.T) {
@@ -604,6 +627,13 @@ func TestNewReplicator(t *testing.T) {
 	require.NotNil(t, replicator.checkin)
 	require.NotNil(t, replicator.concurrencySem)
 	require.False(t, replicator.checkMounts)
+	require.Equal(t, int64(604800), replicator.reaperDelay)
+
+	config, err = conf.StringConfig("[account-replicator]\nmount_check=false\nbind_port=1000\nreclaim_age=86400")
+	require.Nil(t, err)
+	_, r, _, err = NewReplicator(config, &flag.FlagSet{}, confLoader)
+	require.Nil(t, err)
+	require.Equal(t, int64(86400), r.(*Replicator).reaperDelay)
 
 	config, err = conf.StringConfig("")
 	require.Nil(t, err)
@@ -790,8 +820,7 @@ func TestReplicateSyncOnMessageError(t *testing.T) {
 
 func TestSomeDatabaseFailures(t *testing.T) {
 	rd := newTestReplicationDevice(&ring.Device{}, &Replicator{Ring: &handoffJobRing{}})
-	require.NotNil(t, rd.rsync(&ring.Device{}, fakeDatabase{}, 1, "complete_rsync"))
-	require.NotNil(t, rd.usync(&ring.Device{}, fakeDatabase{}, 1, "123", 3))
+	require.NotNil(t, rd.usync(&ring.Device{}, fakeDatabase{}, 1, "123", 3, 5))
 }
 
 func TestCheckForReaping(t *testing.T) {
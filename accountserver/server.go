@@ -34,11 +34,11 @@ import (
 	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/conf"
 	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/ring"
 	"github.com/troubling/hummingbird/common/srv"
 	"github.com/troubling/hummingbird/common/tracing"
 	"github.com/troubling/hummingbird/middleware"
 	"github.com/uber-go/tally"
-	promreporter "github.com/uber-go/tally/prometheus"
 	"go.uber.org/zap"
 )
 
@@ -58,6 +58,10 @@ type AccountServer struct {
 	metricsCloser    io.Closer
 	traceCloser      io.Closer
 	tracer           opentracing.Tracer
+	disableFile      string
+	readyChecks      []middleware.ReadyCheck
+	signingKeys      [][]byte
+	adminAuth        *middleware.AdminAuth
 }
 
 func formatTimestamp(ts string) (string, error) {
@@ -413,11 +417,16 @@ func (server *AccountServer) ContainerPutHandler(writer http.ResponseWriter, req
 	srv.StandardResponse(writer, http.StatusCreated)
 }
 
-// HealthcheckHandler implements a basic health check, that just returns "OK".
+// HealthcheckHandler implements a basic health check, that just returns "OK",
+// or a 503 while the disable_path file exists.
 func (server *AccountServer) HealthcheckHandler(writer http.ResponseWriter, request *http.Request) {
-	writer.Header().Set("Content-Length", "2")
-	writer.WriteHeader(http.StatusOK)
-	writer.Write([]byte("OK"))
+	middleware.HealthcheckHandler(server.disableFile)(writer, request)
+}
+
+// ReadyHandler reports whether the server's ring, devices and databases are
+// ready for it to serve requests.
+func (server *AccountServer) ReadyHandler(writer http.ResponseWriter, request *http.Request) {
+	middleware.ReadyHandler(server.disableFile, server.readyChecks...)(writer, request)
 }
 
 // ReconHandler delegates incoming /recon calls to the common recon handler.
@@ -486,17 +495,13 @@ func (server *AccountServer) updateDeviceLocks(seconds int64) {
 // GetHandler returns the server's http handler - it sets up routes and instantiates middleware.
 func (server *AccountServer) GetHandler(config conf.Config, metricsPrefix string) http.Handler {
 	var metricsScope tally.Scope
-	metricsScope, server.metricsCloser = tally.NewRootScope(tally.ScopeOptions{
-		Prefix:         metricsPrefix,
-		Tags:           map[string]string{},
-		CachedReporter: promreporter.NewReporter(promreporter.Options{}),
-		Separator:      promreporter.DefaultSeparator,
-	}, time.Second)
+	metricsScope, server.metricsCloser = srv.NewMetricsScope(config, metricsPrefix)
 	commonHandlers := alice.New(
 		middleware.NewDebugResponses(config.GetBool("debug", "debug_x_source_code", false)),
 		server.LogRequest,
 		middleware.RecoverHandler,
 		middleware.ValidateRequest,
+		middleware.BackendSignature(server.signingKeys),
 		server.AcquireDevice,
 	)
 	router := srv.NewRouter()
@@ -504,11 +509,15 @@ func (server *AccountServer) GetHandler(config conf.Config, metricsPrefix string
 	router.Get("/loglevel", server.logLevel)
 	router.Put("/loglevel", server.logLevel)
 	router.Get("/healthcheck", commonHandlers.ThenFunc(server.HealthcheckHandler))
+	router.Get("/ready", commonHandlers.ThenFunc(server.ReadyHandler))
+	router.Head("/ready", commonHandlers.ThenFunc(server.ReadyHandler))
 	router.Get("/diskusage", commonHandlers.ThenFunc(server.DiskUsageHandler))
 	router.Put("/ring/*ring_path", commonHandlers.ThenFunc(middleware.RingHandler))
 	router.Get("/recon/:method/:recon_type", commonHandlers.ThenFunc(server.ReconHandler))
 	router.Get("/recon/:method", commonHandlers.ThenFunc(server.ReconHandler))
-	router.Delete("/recon/:device/:method/:recon_type/*item_path", commonHandlers.ThenFunc(server.ReconHandler))
+	router.Get("/recon/:device/:method/:recon_type/*item_path", commonHandlers.Then(server.adminAuth.Require(middleware.AdminRoleQuarantine, http.HandlerFunc(server.ReconHandler))))
+	router.Put("/recon/:device/:method/:recon_type/*item_path", commonHandlers.Then(server.adminAuth.Require(middleware.AdminRoleQuarantine, http.HandlerFunc(server.ReconHandler))))
+	router.Delete("/recon/:device/:method/:recon_type/*item_path", commonHandlers.Then(server.adminAuth.Require(middleware.AdminRoleQuarantine, http.HandlerFunc(server.ReconHandler))))
 	router.Get("/debug/pprof/:parm", http.DefaultServeMux)
 	router.Post("/debug/pprof/:parm", http.DefaultServeMux)
 	router.Put("/:device/tmp/:filename", commonHandlers.ThenFunc(server.TmpUploadHandler))
@@ -534,6 +543,7 @@ func NewServer(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader
 	if err != nil {
 		return ipPort, nil, nil, err
 	}
+	server.signingKeys = conf.GetBackendSigningKeys()
 	server.policyList, err = cnf.GetPolicies()
 	if err != nil {
 		return ipPort, nil, nil, err
@@ -547,6 +557,10 @@ func NewServer(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader
 	bindPort := int(serverconf.GetInt("app:account-server", "bind_port", common.DefaultAccountServerPort))
 	certFile := serverconf.GetDefault("app:account-server", "cert_file", "")
 	keyFile := serverconf.GetDefault("app:account-server", "key_file", "")
+	caFile := serverconf.GetDefault("app:account-server", "ca_file", "")
+	if err := common.SetClusterCA(caFile); err != nil {
+		return ipPort, nil, nil, err
+	}
 
 	logLevelString := serverconf.GetDefault("app:account-server", "log_level", "INFO")
 	server.logLevel = zap.NewAtomicLevel()
@@ -554,6 +568,10 @@ func NewServer(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader
 	if server.logger, err = srv.SetupLogger("account-server", &server.logLevel, flags); err != nil {
 		return ipPort, nil, nil, fmt.Errorf("Error setting up logger: %v", err)
 	}
+	if server.adminAuth, err = middleware.NewAdminAuth(serverconf.GetDefault("app:account-server", "admin_tokens", ""),
+		serverconf.GetDefault("app:account-server", "admin_cert_roles", ""), server.logger); err != nil {
+		return ipPort, nil, nil, err
+	}
 	server.accountEngine = newLRUEngine(server.driveRoot, server.hashPathPrefix, server.hashPathSuffix, 32)
 	if serverconf.HasSection("tracing") {
 		server.tracer, server.traceCloser, err = tracing.Init("accountserver", server.logger, serverconf.GetSection("tracing"))
@@ -561,6 +579,17 @@ func NewServer(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader
 			return ipPort, nil, nil, fmt.Errorf("Error setting up tracer: %v", err)
 		}
 	}
-	ipPort = &srv.IpPort{Ip: bindIP, Port: bindPort, CertFile: certFile, KeyFile: keyFile}
+	server.disableFile = serverconf.GetDefault("app:account-server", "disable_path", "")
+	server.readyChecks = []middleware.ReadyCheck{
+		middleware.RingCheck(bindPort, map[string]func() (ring.Ring, error){"account": func() (ring.Ring, error) {
+			return cnf.GetRing("account", server.hashPathPrefix, server.hashPathSuffix, 0)
+		}}),
+		middleware.DevicesCheck(server.driveRoot, server.checkMounts),
+		middleware.DBCheck(server.driveRoot, server.checkMounts),
+	}
+	ipPort = &srv.IpPort{Ip: bindIP, Port: bindPort, CertFile: certFile, KeyFile: keyFile, CAFile: caFile,
+		ClientCertOptional: !serverconf.GetBool("app:account-server", "require_client_cert", true),
+		HTTP2:              srv.NewHTTP2Config(serverconf.GetSection("app:account-server")),
+		UnixSocket:         serverconf.GetDefault("app:account-server", "bind_unix_socket", "")}
 	return ipPort, server, server.logger, nil
 }
@@ -28,6 +28,7 @@ import (
 	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/conf"
 	"github.com/troubling/hummingbird/common/test"
+	"github.com/troubling/hummingbird/middleware"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -35,6 +36,10 @@ import (
 var makeTestServerCounter uint64 = 0
 
 func makeTestServer() (http.Handler, func(), error) {
+	return makeTestServerWithAdminTokens("")
+}
+
+func makeTestServerWithAdminTokens(adminTokens string) (http.Handler, func(), error) {
 	dir, err := ioutil.TempDir("", "")
 	if err != nil {
 		return nil, nil, err
@@ -52,6 +57,13 @@ func makeTestServer() (http.Handler, func(), error) {
 		accountEngine:    newLRUEngine(dir, "changeme", "changeme", 32),
 		diskInUse:        common.NewKeyedLimit(2, 2),
 		autoCreatePrefix: ".",
+		policyList: conf.PolicyList{
+			0: &conf.Policy{Index: 0, Type: "replication", Name: "gold", Default: true},
+			1: &conf.Policy{Index: 1, Type: "hec", Name: "ec"},
+		},
+	}
+	if server.adminAuth, err = middleware.NewAdminAuth(adminTokens, "", server.logger); err != nil {
+		return nil, nil, err
 	}
 	cleanup := func() {
 		os.RemoveAll(dir)
@@ -258,6 +270,51 @@ func TestAccountPutContainersGet(t *testing.T) {
 	require.Equal(t, "application/xml; charset=utf-8", rsp.Header().Get("Content-Type"))
 }
 
+func TestAccountPolicyStats(t *testing.T) {
+	handler, cleanup, err := makeTestServer()
+	require.Nil(t, err)
+	defer cleanup()
+
+	rsp := test.MakeCaptureResponse()
+	req, err := http.NewRequest("PUT", "/device/1/a", nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Timestamp", "100000000.00001")
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 201, rsp.Status)
+
+	putContainer := func(container, objectCount, bytesUsed, policy string) {
+		rsp := test.MakeCaptureResponse()
+		req, err := http.NewRequest("PUT", "/device/1/a/"+container, nil)
+		require.Nil(t, err)
+		req.Header.Set("X-Put-Timestamp", common.GetTimestamp())
+		req.Header.Set("X-Object-Count", objectCount)
+		req.Header.Set("X-Bytes-Used", bytesUsed)
+		req.Header.Set("X-Backend-Storage-Policy-Index", policy)
+		handler.ServeHTTP(rsp, req)
+		require.Equal(t, 201, rsp.Status)
+	}
+	putContainer("c1", "2", "10", "0")
+	putContainer("c2", "3", "30", "1")
+	putContainer("c3", "1", "5", "2")
+	// A container update replaces its old counts rather than adding to them.
+	putContainer("c1", "4", "20", "0")
+
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("HEAD", "/device/1/a", nil)
+	require.Nil(t, err)
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 204, rsp.Status)
+	require.Equal(t, "8", rsp.Header().Get("X-Account-Object-Count"))
+	require.Equal(t, "55", rsp.Header().Get("X-Account-Bytes-Used"))
+	require.Equal(t, "1", rsp.Header().Get("X-Account-Storage-Policy-Gold-Container-Count"))
+	require.Equal(t, "4", rsp.Header().Get("X-Account-Storage-Policy-Gold-Object-Count"))
+	require.Equal(t, "20", rsp.Header().Get("X-Account-Storage-Policy-Gold-Bytes-Used"))
+	require.Equal(t, "3", rsp.Header().Get("X-Account-Storage-Policy-Ec-Object-Count"))
+	require.Equal(t, "30", rsp.Header().Get("X-Account-Storage-Policy-Ec-Bytes-Used"))
+	// Policies the server doesn't know are named by their index.
+	require.Equal(t, "5", rsp.Header().Get("X-Account-Storage-Policy-2-Bytes-Used"))
+}
+
 func TestContainerGetTextEmpty(t *testing.T) {
 	handler, cleanup, err := makeTestServer()
 	require.Nil(t, err)
@@ -350,3 +407,21 @@ func TestAccountAutoCreateOnPut(t *testing.T) {
 	handler.ServeHTTP(rsp, req)
 	require.Equal(t, 204, rsp.Status)
 }
+
+func TestAccountQuarantineNeedsAdminRole(t *testing.T) {
+	handler, cleanup, err := makeTestServerWithAdminTokens("s3cr3t:quarantine")
+	require.Nil(t, err)
+	defer cleanup()
+	for _, method := range []string{"GET", "PUT", "DELETE"} {
+		rsp := test.MakeCaptureResponse()
+		req, err := http.NewRequest(method, "/recon/device/quarantined/accounts/abc", nil)
+		require.Nil(t, err)
+		handler.ServeHTTP(rsp, req)
+		require.Equal(t, 403, rsp.Status, method)
+
+		rsp = test.MakeCaptureResponse()
+		req.Header.Set("X-Admin-Token", "s3cr3t")
+		handler.ServeHTTP(rsp, req)
+		require.NotEqual(t, 403, rsp.Status, method)
+	}
+}
@@ -1218,3 +1218,107 @@ func sqliteRename(fromFile, toFile string) error {
 	}
 	return nil
 }
+
+// statCounts runs a query for storage policy indexes and their container
+// counts, object counts and bytes used.
+func statCounts(db *sql.DB, query string) (map[int][3]int64, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := map[int][3]int64{}
+	for rows.Next() {
+		var policyIndex int
+		var containerCount, objectCount, bytesUsed int64
+		if err := rows.Scan(&policyIndex, &containerCount, &objectCount, &bytesUsed); err != nil {
+			return nil, err
+		}
+		counts[policyIndex] = [3]int64{containerCount, objectCount, bytesUsed}
+	}
+	return counts, rows.Err()
+}
+
+// audit checks the database passes sqlite's integrity check and has valid
+// metadata, quarantining it if not. It also checks the account's stats, and
+// those of each policy, add up to the container rows.
+func (db *sqliteAccount) audit() error {
+	if err := db.connect(); err != nil {
+		return err
+	}
+	quarantine := func(msg string, err error) error {
+		return fmt.Errorf("%s: %v; %v", msg, err, common.QuarantineDir(path.Dir(db.accountFile), 4, "accounts"))
+	}
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		if common.IsCorruptDBError(err) {
+			return quarantine("Failed to audit integrity_check", err)
+		}
+		return err
+	}
+	problems := []string{}
+	for rows.Next() {
+		var problem string
+		if err := rows.Scan(&problem); err != nil {
+			rows.Close()
+			return err
+		}
+		if problem != "ok" {
+			problems = append(problems, problem)
+		}
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		if common.IsCorruptDBError(err) {
+			return quarantine("Failed to audit integrity_check", err)
+		}
+		return err
+	} else if len(problems) > 0 {
+		return quarantine("Failed integrity_check", errors.New(strings.Join(problems, "; ")))
+	}
+	var rawMetadata string
+	if err := db.QueryRow("SELECT metadata FROM account_stat").Scan(&rawMetadata); err != nil {
+		if common.IsCorruptDBError(err) {
+			return quarantine("Failed to audit account_stat", err)
+		}
+		return err
+	}
+	if rawMetadata != "" {
+		metadata := map[string][]string{}
+		if err := json.Unmarshal([]byte(rawMetadata), &metadata); err != nil {
+			return quarantine("Invalid metadata", err)
+		}
+	}
+	var stat, total [3]int64
+	if err := db.QueryRow("SELECT container_count, object_count, bytes_used FROM account_stat").Scan(&stat[0], &stat[1], &stat[2]); err != nil {
+		return err
+	}
+	if err := db.QueryRow("SELECT COUNT(*) - IFNULL(SUM(deleted), 0), IFNULL(SUM(object_count), 0), IFNULL(SUM(bytes_used), 0) FROM container").Scan(&total[0], &total[1], &total[2]); err != nil {
+		return err
+	}
+	if stat != total {
+		return fmt.Errorf("account stats say %d containers, %d objects and %d bytes, but there are %d containers, %d objects and %d bytes",
+			stat[0], stat[1], stat[2], total[0], total[1], total[2])
+	}
+	stats, err := statCounts(db.DB, "SELECT storage_policy_index, container_count, object_count, bytes_used FROM policy_stat")
+	if err != nil {
+		return err
+	}
+	containers, err := statCounts(db.DB, "SELECT storage_policy_index, SUM(1 - deleted), SUM(object_count), SUM(bytes_used) FROM container GROUP BY storage_policy_index")
+	if err != nil {
+		return err
+	}
+	for index := range stats {
+		if _, ok := containers[index]; !ok {
+			containers[index] = [3]int64{}
+		}
+	}
+	for index, counts := range containers {
+		if stats[index] != counts {
+			return fmt.Errorf("policy %d stats say %d containers, %d objects and %d bytes, but there are %d containers, %d objects and %d bytes",
+				index, stats[index][0], stats[index][1], stats[index][2], counts[0], counts[1], counts[2])
+		}
+	}
+	return nil
+}
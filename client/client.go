@@ -3,11 +3,13 @@ package client
 import (
 	"io"
 	"net/http"
+	"time"
 
 	"context"
 
 	"github.com/troubling/hummingbird/common/ring"
 	"github.com/troubling/hummingbird/common/srv"
+	"github.com/uber-go/tally"
 )
 
 // RequestClient is similar to github.com/troubling/nectar.Client, but its calls accept a context and it is scoped to a specific API request.
@@ -37,9 +39,22 @@ type RequestClient interface {
 	SetUserAgent(string)
 }
 
+// TrailerReader is a PUT body with trailers to pass on to the object servers.
+// Only the keys in Trailer() before the body is read are sent; their values
+// are taken once it has all been read.
+type TrailerReader interface {
+	io.Reader
+	Trailer() http.Header
+}
+
 // ProxyClient is the factory for RequestClients, and manages any persistent/shared client resources.
 type ProxyClient interface {
 	NewRequestClient(mc ring.MemcacheRing, lc map[string]*ContainerInfo, logger srv.LowLevelLogger) RequestClient
+	// SetMetricsScope has the backend connections report to scope.
+	SetMetricsScope(scope tally.Scope)
+	// ErrorLimitedNodes returns the ip:port of each backend node being
+	// skipped for its errors, with when it will be tried again.
+	ErrorLimitedNodes() map[string]time.Time
 	Close() error
 }
 
@@ -53,4 +68,6 @@ type ContainerInfo struct {
 	Metadata           map[string]string
 	SysMetadata        map[string]string
 	StoragePolicyIndex int
+	// StatusCode is 404 for containers cached as not found.
+	StatusCode int
 }
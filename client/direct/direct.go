@@ -0,0 +1,293 @@
+// Package direct makes requests straight to the object and container servers
+// a ring says hold something, without going through a proxy, for tools like
+// custom auditors and migrators.
+package direct
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/nectar"
+	"golang.org/x/net/http2"
+)
+
+// StatusError is returned for a response that wasn't a success.
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	// Header is the response's headers, which for an object that's been
+	// deleted have the tombstone's X-Backend-Timestamp.
+	Header http.Header
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s %s: %d %s", e.Method, e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// IsNotFound reports whether err is a 404 from the server.
+func IsNotFound(err error) bool {
+	se, ok := err.(*StatusError)
+	return ok && se.StatusCode == http.StatusNotFound
+}
+
+// Client sends requests to the backend servers.
+type Client struct {
+	HTTPClient common.HTTPClient
+	// Retries is how many more times a request is tried after it couldn't
+	// be sent or got a server error, waiting RetryDelay before the first
+	// retry and twice as long before each one after that. Requests with
+	// bodies that can't be rewound aren't retried.
+	Retries    int
+	RetryDelay time.Duration
+	UserAgent  string
+}
+
+// NewClient returns a Client that uses the cluster's client certificate if
+// certFile and keyFile are given, and signs its requests with the cluster's
+// backend signing keys if it has any. Connecting and waiting for a response's
+// headers time out on their own, but bodies can take as long as they need;
+// the request's context sets any overall deadline.
+func NewClient(certFile, keyFile string) (*Client, error) {
+	transport := &http.Transport{
+		MaxIdleConnsPerHost:   100,
+		MaxIdleConns:          0,
+		IdleConnTimeout:       5 * time.Second,
+		DisableCompression:    true,
+		Dial:                  (&net.Dialer{Timeout: 10 * time.Second}).Dial,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+	}
+	if certFile != "" && keyFile != "" {
+		tlsConf, err := common.NewClientTLSConfig(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error getting TLS config: %v", err)
+		}
+		transport.TLSClientConfig = tlsConf
+		if err = http2.ConfigureTransport(transport); err != nil {
+			return nil, fmt.Errorf("Error setting up http2: %v", err)
+		}
+	}
+	return &Client{
+		HTTPClient: &http.Client{
+			Transport: common.NewSigningTransport(transport, conf.GetBackendSigningKeys()),
+		},
+		Retries:    2,
+		RetryDelay: 100 * time.Millisecond,
+		UserAgent:  "direct-client",
+	}, nil
+}
+
+func nodeURL(dev *ring.Device, partition uint64, parts ...string) string {
+	u := fmt.Sprintf("%s://%s:%d/%s/%d", dev.Scheme, dev.Ip, dev.Port, dev.Device, partition)
+	for _, part := range parts {
+		u += "/" + common.Urlencode(part)
+	}
+	return u
+}
+
+// do sends the request, retrying as the client allows, and returns the
+// response if it was a success, which the caller has to close.
+func (c *Client) do(ctx context.Context, method, u string, headers http.Header, body io.Reader) (*http.Response, error) {
+	seeker, rewindable := body.(io.Seeker)
+	if body == nil {
+		rewindable = true
+	}
+	delay := c.RetryDelay
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(delay):
+			}
+			delay *= 2
+			if seeker != nil {
+				if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+					return nil, err
+				}
+			}
+		}
+		req, err := http.NewRequest(method, u, body)
+		if err != nil {
+			return nil, err
+		}
+		if seeker != nil && req.Body != http.NoBody {
+			// Sending closes the body, which would stop it being retried.
+			req.Body = ioutil.NopCloser(body)
+		}
+		req = req.WithContext(ctx)
+		for k, v := range headers {
+			req.Header[k] = v
+		}
+		if c.UserAgent != "" {
+			req.Header.Set("User-Agent", c.UserAgent)
+		}
+		resp, err := c.HTTPClient.Do(req)
+		retry := rewindable && attempt < c.Retries && ctx.Err() == nil
+		if err != nil {
+			if retry {
+				continue
+			}
+			return nil, err
+		}
+		if resp.StatusCode/100 == 2 {
+			return resp, nil
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		// A 507 is an unmounted drive, which isn't going to get better.
+		if retry && resp.StatusCode/100 == 5 && resp.StatusCode != http.StatusInsufficientStorage {
+			continue
+		}
+		return nil, &StatusError{Method: method, URL: u, StatusCode: resp.StatusCode, Header: resp.Header}
+	}
+}
+
+// doHeaders sends the request and returns the response's headers.
+func (c *Client) doHeaders(ctx context.Context, method, u string, headers http.Header, body io.Reader) (http.Header, error) {
+	resp, err := c.do(ctx, method, u, headers, body)
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.Header, nil
+}
+
+// withDefaults returns a copy of headers with the storage policy and an
+// X-Timestamp for now if it doesn't already have one.
+func withDefaults(headers http.Header, policy int, timestamp bool) http.Header {
+	h := make(http.Header, len(headers)+2)
+	for k, v := range headers {
+		h[k] = v
+	}
+	if policy >= 0 {
+		h.Set("X-Backend-Storage-Policy-Index", strconv.Itoa(policy))
+	}
+	if timestamp && h.Get("X-Timestamp") == "" {
+		h.Set("X-Timestamp", common.GetTimestamp())
+	}
+	return h
+}
+
+// HeadObject returns the object's metadata from dev.
+func (c *Client) HeadObject(ctx context.Context, dev *ring.Device, partition uint64, policy int, account, container, obj string, headers http.Header) (http.Header, error) {
+	return c.doHeaders(ctx, "HEAD", nodeURL(dev, partition, account, container, obj), withDefaults(headers, policy, false), nil)
+}
+
+// GetObject returns the object from dev, whose body the caller has to close.
+func (c *Client) GetObject(ctx context.Context, dev *ring.Device, partition uint64, policy int, account, container, obj string, headers http.Header) (*http.Response, error) {
+	return c.do(ctx, "GET", nodeURL(dev, partition, account, container, obj), withDefaults(headers, policy, false), nil)
+}
+
+// PutObject stores the object on dev. Headers need a Content-Type and
+// should have the Content-Length, and X-Timestamp is now if they don't
+// have one.
+func (c *Client) PutObject(ctx context.Context, dev *ring.Device, partition uint64, policy int, account, container, obj string, headers http.Header, body io.Reader) (http.Header, error) {
+	return c.doHeaders(ctx, "PUT", nodeURL(dev, partition, account, container, obj), withDefaults(headers, policy, true), body)
+}
+
+// DeleteObject deletes the object on dev, as of now if headers don't have
+// an X-Timestamp.
+func (c *Client) DeleteObject(ctx context.Context, dev *ring.Device, partition uint64, policy int, account, container, obj string, headers http.Header) error {
+	_, err := c.doHeaders(ctx, "DELETE", nodeURL(dev, partition, account, container, obj), withDefaults(headers, policy, true), nil)
+	return err
+}
+
+// HeadContainer returns the container's metadata from dev.
+func (c *Client) HeadContainer(ctx context.Context, dev *ring.Device, partition uint64, account, container string, headers http.Header) (http.Header, error) {
+	return c.doHeaders(ctx, "HEAD", nodeURL(dev, partition, account, container), withDefaults(headers, -1, false), nil)
+}
+
+// GetContainer returns a page of the container's listing from dev, with
+// options like marker, prefix and limit as query parameters.
+func (c *Client) GetContainer(ctx context.Context, dev *ring.Device, partition uint64, account, container string, options map[string]string, headers http.Header) ([]*nectar.ObjectRecord, http.Header, error) {
+	query := url.Values{"format": {"json"}}
+	for k, v := range options {
+		if v != "" {
+			query.Set(k, v)
+		}
+	}
+	resp, err := c.do(ctx, "GET", nodeURL(dev, partition, account, container)+"?"+query.Encode(), withDefaults(headers, -1, false), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	var listing []*nectar.ObjectRecord
+	if resp.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(resp.Body).Decode(&listing); err != nil {
+			return nil, nil, err
+		}
+	}
+	return listing, resp.Header, nil
+}
+
+// PutContainer creates the container on dev, or updates its metadata.
+// X-Timestamp is now if headers don't have one, and they should have the
+// X-Backend-Storage-Policy-Index for a new container.
+func (c *Client) PutContainer(ctx context.Context, dev *ring.Device, partition uint64, account, container string, headers http.Header) error {
+	_, err := c.doHeaders(ctx, "PUT", nodeURL(dev, partition, account, container), withDefaults(headers, -1, true), nil)
+	return err
+}
+
+// DeleteContainer deletes the container on dev, as of now if headers don't
+// have an X-Timestamp.
+func (c *Client) DeleteContainer(ctx context.Context, dev *ring.Device, partition uint64, account, container string, headers http.Header) error {
+	_, err := c.doHeaders(ctx, "DELETE", nodeURL(dev, partition, account, container), withDefaults(headers, -1, true), nil)
+	return err
+}
+
+// HeadAccount returns the account's metadata from dev.
+func (c *Client) HeadAccount(ctx context.Context, dev *ring.Device, partition uint64, account string, headers http.Header) (http.Header, error) {
+	return c.doHeaders(ctx, "HEAD", nodeURL(dev, partition, account), withDefaults(headers, -1, false), nil)
+}
+
+// RemoveHandoffObject removes the object whose hash is given from dev
+// without leaving a tombstone, the way the replicator cleans up a handoff
+// once the primaries have the object. Only engines that replicate through
+// the object server, like the replicated engine, support it.
+func (c *Client) RemoveHandoffObject(ctx context.Context, dev *ring.Device, policy int, hash, timestamp string) error {
+	u := fmt.Sprintf("%s://%s:%d/rep-obj/%s/%s", dev.Scheme, dev.ReplicationIp, dev.ReplicationPort, dev.Device, hash)
+	_, err := c.doHeaders(ctx, "DELETE", u, withDefaults(http.Header{"X-Timestamp": {timestamp}}, policy, false), nil)
+	return err
+}
+
+func quarantineURL(dev *ring.Device, reconType, name string) string {
+	return fmt.Sprintf("%s://%s:%d/recon/%s/quarantined/%s/%s", dev.Scheme, dev.Ip, dev.Port, dev.Device, reconType, common.Urlencode(name))
+}
+
+// GetQuarantined returns an item quarantined on dev, whose body the caller
+// has to close: an account or container's database, or an object's data
+// with the metadata it was stored with as headers and its name in
+// X-Backend-Quarantined-Name. The reconType is accounts, containers, objects
+// or objects-<policy index>, and name is the item's name on the device.
+func (c *Client) GetQuarantined(ctx context.Context, dev *ring.Device, reconType, name string, headers http.Header) (*http.Response, error) {
+	return c.do(ctx, "GET", quarantineURL(dev, reconType, name), headers, nil)
+}
+
+// RestoreQuarantined moves an account or container database quarantined on
+// dev back into partition, for its replicator to bring up to date. The
+// server refuses with a 409 if there's already a database there.
+func (c *Client) RestoreQuarantined(ctx context.Context, dev *ring.Device, reconType, name string, partition uint64, headers http.Header) error {
+	_, err := c.doHeaders(ctx, "PUT", quarantineURL(dev, reconType, name)+"?partition="+strconv.FormatUint(partition, 10), headers, nil)
+	return err
+}
+
+// RemoveQuarantined moves an item quarantined on dev to its quarantine
+// history, which andrewd purges after a while.
+func (c *Client) RemoveQuarantined(ctx context.Context, dev *ring.Device, reconType, name string, headers http.Header) error {
+	_, err := c.doHeaders(ctx, "DELETE", quarantineURL(dev, reconType, name), headers, nil)
+	return err
+}
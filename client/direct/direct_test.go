@@ -0,0 +1,124 @@
+package direct
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/ring"
+)
+
+func testDevice(t *testing.T, ts *httptest.Server, device string) *ring.Device {
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(ts.URL, "http://"))
+	require.Nil(t, err)
+	p, err := strconv.Atoi(port)
+	require.Nil(t, err)
+	return &ring.Device{Scheme: "http", Ip: host, Port: p, Device: device}
+}
+
+func TestClient(t *testing.T) {
+	failures := 1
+	var puts []*http.Request
+	var putBodies []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			w.WriteHeader(503)
+			return
+		}
+		switch {
+		case r.Method == "PUT":
+			body, _ := ioutil.ReadAll(r.Body)
+			puts = append(puts, r)
+			putBodies = append(putBodies, string(body))
+			w.WriteHeader(201)
+		case r.URL.Path == "/sda/1/a/c" && r.Method == "GET":
+			require.Equal(t, "json", r.URL.Query().Get("format"))
+			require.Equal(t, "o", r.URL.Query().Get("prefix"))
+			require.Equal(t, "", r.URL.Query().Get("marker"))
+			w.Write([]byte(`[{"name": "o 1", "bytes": 5}]`))
+		case r.URL.Path == "/sda/1/a/c/o 1":
+			w.Header().Set("X-Object-Meta-Color", "blue")
+			w.WriteHeader(200)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer ts.Close()
+	dev := testDevice(t, ts, "sda")
+	c := &Client{HTTPClient: http.DefaultClient, Retries: 1, RetryDelay: time.Millisecond}
+	ctx := context.Background()
+
+	// Server errors are retried, rewinding the body.
+	_, err := c.PutObject(ctx, dev, 1, 2, "a", "c", "o 1", http.Header{"Content-Type": {"text/plain"}}, strings.NewReader("hello"))
+	require.Nil(t, err)
+	require.Equal(t, []string{"hello"}, putBodies)
+	require.Equal(t, "/sda/1/a/c/o 1", puts[0].URL.Path)
+	require.Equal(t, "2", puts[0].Header.Get("X-Backend-Storage-Policy-Index"))
+	require.NotEqual(t, "", puts[0].Header.Get("X-Timestamp"))
+
+	// Bodies the client would close, like files, are kept open to retry.
+	f, err := ioutil.TempFile("", "")
+	require.Nil(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	_, err = f.WriteString("hello file")
+	require.Nil(t, err)
+	_, err = f.Seek(0, io.SeekStart)
+	require.Nil(t, err)
+	failures = 1
+	_, err = c.PutObject(ctx, dev, 1, 2, "a", "c", "o 1", http.Header{"Content-Type": {"text/plain"}}, f)
+	require.Nil(t, err)
+	require.Equal(t, []string{"hello", "hello file"}, putBodies)
+
+	headers, err := c.HeadObject(ctx, dev, 1, 2, "a", "c", "o 1", nil)
+	require.Nil(t, err)
+	require.Equal(t, "blue", headers.Get("X-Object-Meta-Color"))
+	_, err = c.HeadObject(ctx, dev, 1, 2, "a", "c", "missing", nil)
+	require.True(t, IsNotFound(err))
+
+	listing, _, err := c.GetContainer(ctx, dev, 1, "a", "c", map[string]string{"prefix": "o", "marker": ""}, nil)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(listing))
+	require.Equal(t, "o 1", listing[0].Name)
+
+	// Past its retries, the server's error is returned.
+	failures = 2
+	err = c.DeleteContainer(ctx, dev, 1, "a", "c", nil)
+	require.Equal(t, 503, err.(*StatusError).StatusCode)
+}
+
+func TestQuorum(t *testing.T) {
+	devs := []*ring.Device{{Device: "sda"}, {Device: "sdb"}, {Device: "sdc"}}
+	require.Equal(t, 2, QuorumSize(3))
+	require.Equal(t, 2, QuorumSize(4))
+	failOn := func(failing ...string) func(context.Context, *ring.Device) error {
+		return func(ctx context.Context, dev *ring.Device) error {
+			for _, f := range failing {
+				if dev.Device == f {
+					return errors.New("failed")
+				}
+			}
+			return nil
+		}
+	}
+	results, err := Quorum(context.Background(), devs, failOn("sdb"))
+	require.Nil(t, err)
+	require.Equal(t, "sdb", results[1].Device.Device)
+	require.NotNil(t, results[1].Err)
+	_, err = Quorum(context.Background(), devs, failOn("sdb", "sdc"))
+	require.NotNil(t, err)
+	require.Equal(t, 2, err.(*QuorumError).Needed)
+	_, err = Quorum(context.Background(), nil, failOn())
+	require.NotNil(t, err)
+}
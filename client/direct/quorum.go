@@ -0,0 +1,93 @@
+package direct
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/troubling/hummingbird/common/ring"
+)
+
+// QuorumSize is how many of replicas have to succeed for the request as a
+// whole to succeed, the same as the proxy requires.
+func QuorumSize(replicas int) int {
+	return int(math.Ceil(float64(replicas) / 2.0))
+}
+
+// NodeResult is how a request to one node went.
+type NodeResult struct {
+	Device *ring.Device
+	Err    error
+}
+
+// QuorumError is returned when too few nodes succeeded.
+type QuorumError struct {
+	Needed  int
+	Results []NodeResult
+}
+
+func (e *QuorumError) Error() string {
+	var errs []string
+	for _, r := range e.Results {
+		if r.Err != nil {
+			errs = append(errs, fmt.Sprintf("%s:%d/%s: %v", r.Device.Ip, r.Device.Port, r.Device.Device, r.Err))
+		}
+	}
+	return fmt.Sprintf("needed %d of %d nodes to succeed: %s", e.Needed, len(e.Results), strings.Join(errs, "; "))
+}
+
+// Each calls f for every one of devs at once, and returns how each went, in
+// the same order as devs.
+func Each(ctx context.Context, devs []*ring.Device, f func(ctx context.Context, dev *ring.Device) error) []NodeResult {
+	results := make([]NodeResult, len(devs))
+	done := make(chan struct{}, len(devs))
+	for i, dev := range devs {
+		go func(i int, dev *ring.Device) {
+			results[i] = NodeResult{Device: dev, Err: f(ctx, dev)}
+			done <- struct{}{}
+		}(i, dev)
+	}
+	for range devs {
+		<-done
+	}
+	return results
+}
+
+// Quorum calls f for every one of devs at once, returning a *QuorumError
+// unless a quorum of them, and at least one, succeeded.
+func Quorum(ctx context.Context, devs []*ring.Device, f func(ctx context.Context, dev *ring.Device) error) ([]NodeResult, error) {
+	results := Each(ctx, devs, f)
+	successes := 0
+	for _, r := range results {
+		if r.Err == nil {
+			successes++
+		}
+	}
+	needed := QuorumSize(len(devs))
+	if needed == 0 {
+		needed = 1
+	}
+	if successes < needed {
+		return results, &QuorumError{Needed: needed, Results: results}
+	}
+	return results, nil
+}
+
+// ObjectNodes returns the object's partition and primary nodes in r.
+func ObjectNodes(r ring.Ring, account, container, obj string) (uint64, []*ring.Device) {
+	partition := r.GetPartition(account, container, obj)
+	return partition, r.GetNodes(partition)
+}
+
+// ContainerNodes returns the container's partition and primary nodes in r.
+func ContainerNodes(r ring.Ring, account, container string) (uint64, []*ring.Device) {
+	partition := r.GetPartition(account, container, "")
+	return partition, r.GetNodes(partition)
+}
+
+// AccountNodes returns the account's partition and primary nodes in r.
+func AccountNodes(r ring.Ring, account string) (uint64, []*ring.Device) {
+	partition := r.GetPartition(account, "", "")
+	return partition, r.GetNodes(partition)
+}
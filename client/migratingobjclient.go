@@ -0,0 +1,105 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/nectar/nectarutil"
+)
+
+// migratingObjectClient is the object client for a container whose objects
+// are being moved to another storage policy. New objects are written to the
+// policy being moved to, and objects are looked for there before the policy
+// being moved from. Requests with an X-Backend-Storage-Policy-Index go to
+// just that policy, which is how the mover reaches each copy.
+type migratingObjectClient struct {
+	from       proxyObjectClient
+	fromPolicy int
+	to         proxyObjectClient
+	toPolicy   int
+}
+
+func (oc *migratingObjectClient) only(headers http.Header) proxyObjectClient {
+	switch headers.Get("X-Backend-Storage-Policy-Index") {
+	case strconv.Itoa(oc.fromPolicy):
+		return oc.from
+	case strconv.Itoa(oc.toPolicy):
+		return oc.to
+	}
+	return nil
+}
+
+func (oc *migratingObjectClient) putObject(ctx context.Context, account, container, obj string, headers http.Header, src io.Reader) *http.Response {
+	if only := oc.only(headers); only != nil {
+		return only.putObject(ctx, account, container, obj, headers, src)
+	}
+	return oc.to.putObject(ctx, account, container, obj, headers, src)
+}
+
+func (oc *migratingObjectClient) postObject(ctx context.Context, account, container, obj string, headers http.Header) *http.Response {
+	if only := oc.only(headers); only != nil {
+		return only.postObject(ctx, account, container, obj, headers)
+	}
+	resp := oc.to.postObject(ctx, account, container, obj, headers)
+	if resp.StatusCode != http.StatusNotFound {
+		return resp
+	}
+	resp.Body.Close()
+	return oc.from.postObject(ctx, account, container, obj, headers)
+}
+
+func (oc *migratingObjectClient) getObject(ctx context.Context, account, container, obj string, headers http.Header) *http.Response {
+	if only := oc.only(headers); only != nil {
+		return only.getObject(ctx, account, container, obj, headers)
+	}
+	resp := oc.to.getObject(ctx, account, container, obj, headers)
+	if resp.StatusCode != http.StatusNotFound {
+		return resp
+	}
+	resp.Body.Close()
+	return oc.from.getObject(ctx, account, container, obj, headers)
+}
+
+func (oc *migratingObjectClient) grepObject(ctx context.Context, account, container, obj string, search string) *http.Response {
+	resp := oc.to.grepObject(ctx, account, container, obj, search)
+	if resp.StatusCode != http.StatusNotFound {
+		return resp
+	}
+	resp.Body.Close()
+	return oc.from.grepObject(ctx, account, container, obj, search)
+}
+
+func (oc *migratingObjectClient) headObject(ctx context.Context, account, container, obj string, headers http.Header) *http.Response {
+	if only := oc.only(headers); only != nil {
+		return only.headObject(ctx, account, container, obj, headers)
+	}
+	resp := oc.to.headObject(ctx, account, container, obj, headers)
+	if resp.StatusCode != http.StatusNotFound {
+		return resp
+	}
+	resp.Body.Close()
+	return oc.from.headObject(ctx, account, container, obj, headers)
+}
+
+// deleteObject deletes the object from both policies, since it may not have
+// been moved yet.
+func (oc *migratingObjectClient) deleteObject(ctx context.Context, account, container, obj string, headers http.Header) *http.Response {
+	if only := oc.only(headers); only != nil {
+		return only.deleteObject(ctx, account, container, obj, headers)
+	}
+	fromResp := oc.from.deleteObject(ctx, account, container, obj, headers)
+	fromResp.Body.Close()
+	resp := oc.to.deleteObject(ctx, account, container, obj, headers)
+	if resp.StatusCode == http.StatusNotFound && fromResp.StatusCode/100 == 2 {
+		resp.Body.Close()
+		return nectarutil.ResponseStub(fromResp.StatusCode, "")
+	}
+	return resp
+}
+
+func (oc *migratingObjectClient) ring() (ring.Ring, *http.Response) {
+	return oc.to.ring()
+}
@@ -0,0 +1,82 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/nectar/nectarutil"
+)
+
+// fakeObjectClient answers every request with its status and records the
+// methods it was asked for.
+type fakeObjectClient struct {
+	status int
+	calls  []string
+}
+
+func (oc *fakeObjectClient) respond(method string) *http.Response {
+	oc.calls = append(oc.calls, method)
+	return nectarutil.ResponseStub(oc.status, "")
+}
+
+func (oc *fakeObjectClient) putObject(ctx context.Context, account, container, obj string, headers http.Header, src io.Reader) *http.Response {
+	return oc.respond("PUT")
+}
+
+func (oc *fakeObjectClient) postObject(ctx context.Context, account, container, obj string, headers http.Header) *http.Response {
+	return oc.respond("POST")
+}
+
+func (oc *fakeObjectClient) getObject(ctx context.Context, account, container, obj string, headers http.Header) *http.Response {
+	return oc.respond("GET")
+}
+
+func (oc *fakeObjectClient) grepObject(ctx context.Context, account, container, obj string, search string) *http.Response {
+	return oc.respond("GREP")
+}
+
+func (oc *fakeObjectClient) headObject(ctx context.Context, account, container, obj string, headers http.Header) *http.Response {
+	return oc.respond("HEAD")
+}
+
+func (oc *fakeObjectClient) deleteObject(ctx context.Context, account, container, obj string, headers http.Header) *http.Response {
+	return oc.respond("DELETE")
+}
+
+func (oc *fakeObjectClient) ring() (ring.Ring, *http.Response) {
+	return nil, nil
+}
+
+func TestMigratingObjectClient(t *testing.T) {
+	from := &fakeObjectClient{status: 200}
+	to := &fakeObjectClient{status: 404}
+	oc := &migratingObjectClient{from: from, fromPolicy: 0, to: to, toPolicy: 1}
+	ctx := context.Background()
+
+	require.Equal(t, 404, oc.putObject(ctx, "a", "c", "o", http.Header{}, nil).StatusCode)
+	require.Equal(t, []string{"PUT"}, to.calls)
+	require.Equal(t, 0, len(from.calls))
+
+	require.Equal(t, 200, oc.getObject(ctx, "a", "c", "o", http.Header{}).StatusCode)
+	require.Equal(t, 200, oc.headObject(ctx, "a", "c", "o", http.Header{}).StatusCode)
+	require.Equal(t, 200, oc.postObject(ctx, "a", "c", "o", http.Header{}).StatusCode)
+	require.Equal(t, 200, oc.deleteObject(ctx, "a", "c", "o", http.Header{}).StatusCode)
+	require.Equal(t, []string{"GET", "HEAD", "POST", "DELETE"}, from.calls)
+
+	// The mover picks the policy.
+	from.calls, to.calls = nil, nil
+	require.Equal(t, 404, oc.getObject(ctx, "a", "c", "o", http.Header{"X-Backend-Storage-Policy-Index": {"1"}}).StatusCode)
+	require.Equal(t, 200, oc.deleteObject(ctx, "a", "c", "o", http.Header{"X-Backend-Storage-Policy-Index": {"0"}}).StatusCode)
+	require.Equal(t, []string{"GET"}, to.calls)
+	require.Equal(t, []string{"DELETE"}, from.calls)
+
+	// Once the object's been moved it's found in the new policy first.
+	from.calls, to.calls = nil, nil
+	to.status = 200
+	require.Equal(t, 200, oc.getObject(ctx, "a", "c", "o", http.Header{}).StatusCode)
+	require.Equal(t, 0, len(from.calls))
+}
@@ -9,6 +9,7 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/ring"
 )
 
@@ -21,12 +22,34 @@ type ringFilter interface {
 	ring() ring.Ring
 }
 
+// writeAffSection is a region, or a zone within one if zone isn't -1, that
+// writes prefer or skip.
+type writeAffSection struct {
+	zone   int
+	region int
+}
+
+// preferredForWrites reports whether dev is in one of the write affinity
+// sections; with none, every device is.
+func preferredForWrites(waffs []writeAffSection, dev *ring.Device) bool {
+	return len(waffs) == 0 || inWriteAffSections(waffs, dev)
+}
+
+func inWriteAffSections(waffs []writeAffSection, dev *ring.Device) bool {
+	for _, af := range waffs {
+		if af.region == dev.Region && (af.zone == -1 || af.zone == dev.Zone) {
+			return true
+		}
+	}
+	return false
+}
+
 type writeNodeIter struct {
 	mutex        sync.Mutex
 	devs         []*ring.Device
 	nonPreferred []*ring.Device
 	more         ring.MoreNodes
-	waffRegion   int
+	waffs        []writeAffSection
 	waffCount    int
 	limit        int
 }
@@ -46,7 +69,7 @@ func (wni *writeNodeIter) next() *ring.Device {
 				return dev
 			}
 		}
-		if wni.waffCount <= 0 || wni.waffRegion == -1 || dev.Region == wni.waffRegion {
+		if wni.waffCount <= 0 || preferredForWrites(wni.waffs, dev) {
 			wni.waffCount--
 			return dev
 		}
@@ -65,6 +88,23 @@ func (wni *writeNodeIter) Next() *ring.Device {
 	return wni.next()
 }
 
+// fixedReadNodes is a ringFilter that reads from just the given devices, in
+// order.
+type fixedReadNodes struct {
+	ringFilter
+	devs []*ring.Device
+}
+
+func (f *fixedReadNodes) getReadNodes(partition uint64) ([]*ring.Device, ring.MoreNodes) {
+	return f.devs, noMoreNodes{}
+}
+
+type noMoreNodes struct{}
+
+func (noMoreNodes) Next() *ring.Device {
+	return nil
+}
+
 type readAffSection struct {
 	zone   int
 	region int
@@ -74,9 +114,28 @@ type readAffSection struct {
 type clientRingFilter struct {
 	ring.Ring
 	raffs       []readAffSection
-	waffRegion  int
+	waffs       []writeAffSection
 	waffCount   int
 	deviceLimit int
+	latencies   *nodeLatency
+	backends    *common.BackendTransport
+	// handoffDepth is how many handoffs are looked at, with 0 for all of them.
+	handoffDepth int
+	// writeExcludes are the regions, or zones within them, writes skip.
+	writeExcludes []writeAffSection
+}
+
+func (a *clientRingFilter) errorLimited(dev *ring.Device) bool {
+	return a.backends != nil && a.backends.Ejected(nodeLatencyKey(dev))
+}
+
+func (a *clientRingFilter) excludedForWrites(dev *ring.Device) bool {
+	return a.errorLimited(dev) || inWriteAffSections(a.writeExcludes, dev)
+}
+
+// moreNodes returns the handoffs for partition, less any being error limited.
+func (a *clientRingFilter) moreNodes(partition uint64) ring.MoreNodes {
+	return ring.NewHandoffIter(a.Ring, partition, ring.NodeIterOptions{HandoffDepth: a.handoffDepth, Exclude: a.errorLimited})
 }
 
 func (a *clientRingFilter) ring() ring.Ring {
@@ -99,8 +158,21 @@ func (a *clientRingFilter) getReadNodes(partition uint64) ([]*ring.Device, ring.
 		}
 	}
 	rand.Shuffle(len(devs), func(i, j int) { devs[i], devs[j] = devs[j], devs[i] })
-	sort.SliceStable(devs, func(i, j int) bool { return d2a[devs[i]] < d2a[devs[j]] })
-	return devs, a.Ring.GetMoreNodes(partition)
+	affinities := []ring.Affinity{func(dev *ring.Device) float64 { return float64(d2a[dev]) }}
+	if a.latencies != nil { // within each affinity tier, prefer the nodes that have been answering fastest.
+		averages := a.latencies.averages(devs)
+		affinities = append(affinities, func(dev *ring.Device) float64 { return float64(averages[dev]) })
+	}
+	ring.SortByAffinity(devs, affinities...)
+	if a.backends != nil { // error limited nodes go last, in case they're all there is.
+		sort.SliceStable(devs, func(i, j int) bool { return !a.errorLimited(devs[i]) && a.errorLimited(devs[j]) })
+	}
+	if len(a.waffs) > 0 {
+		// Recent writes may have gone to the handoffs write affinity
+		// prefers instead of the primaries, so look there first.
+		return devs, &writeNodeIter{more: a.moreNodes(partition), waffs: a.waffs, waffCount: a.waffCount, limit: math.MaxInt32}
+	}
+	return devs, a.moreNodes(partition)
 }
 
 func (a *clientRingFilter) getWriteNodes(partition uint64) ([]*ring.Device, ring.MoreNodes) {
@@ -109,27 +181,49 @@ func (a *clientRingFilter) getWriteNodes(partition uint64) ([]*ring.Device, ring
 	if a.deviceLimit == 0 {
 		a.deviceLimit = len(devs)
 	}
+	count := len(devs)
+	if a.deviceLimit < count {
+		count = a.deviceLimit
+	}
+	// Handoffs stand in for error limited and excluded primaries.
+	available := make([]*ring.Device, 0, len(devs))
+	for _, dev := range devs {
+		if !a.excludedForWrites(dev) {
+			available = append(available, dev)
+		}
+	}
 	more := &writeNodeIter{
-		devs:       devs,
-		more:       a.GetMoreNodes(partition),
-		waffRegion: a.waffRegion,
-		waffCount:  a.waffCount,
-		limit:      a.deviceLimit,
-	}
-	if a.deviceLimit < len(devs) {
-		ndevs = make([]*ring.Device, a.deviceLimit)
-	} else {
-		ndevs = make([]*ring.Device, len(devs))
+		devs:      available,
+		more:      ring.NewHandoffIter(a.Ring, partition, ring.NodeIterOptions{HandoffDepth: a.handoffDepth, Exclude: a.excludedForWrites}),
+		waffs:     a.waffs,
+		waffCount: a.waffCount,
+		limit:     a.deviceLimit,
 	}
-	for i := range ndevs {
-		ndevs[i] = more.next()
+	for i := 0; i < count; i++ {
+		if dev := more.next(); dev != nil {
+			ndevs = append(ndevs, dev)
+		}
 	}
 	return ndevs, more
 }
 
+// parseWriteAffSections parses a list of regions and zones within them, like
+// "r1, r2z3".
+func parseWriteAffSections(s string) []writeAffSection {
+	var waffs []writeAffSection
+	for _, section := range strings.Split(s, ",") {
+		var zone, region int
+		if n, err := fmt.Sscanf(strings.TrimSpace(section), "r%dz%d", &region, &zone); err == nil && n == 2 {
+			waffs = append(waffs, writeAffSection{zone: zone, region: region})
+		} else if n, err := fmt.Sscanf(strings.TrimSpace(section), "r%d", &region); err == nil && n == 1 {
+			waffs = append(waffs, writeAffSection{zone: -1, region: region})
+		}
+	}
+	return waffs
+}
+
 func newClientRingFilter(r ring.Ring, readAff, writeAff, waffCount string, deviceLimit int) *clientRingFilter {
-	waffRegion := -1
-	fmt.Sscanf(writeAff, "r%d", &waffRegion)
+	waffs := parseWriteAffSections(writeAff)
 
 	wc := 0
 	var f float64
@@ -156,7 +250,7 @@ func newClientRingFilter(r ring.Ring, readAff, writeAff, waffCount string, devic
 	return &clientRingFilter{
 		Ring:        r,
 		raffs:       raffs,
-		waffRegion:  waffRegion,
+		waffs:       waffs,
 		waffCount:   wc,
 		deviceLimit: deviceLimit,
 	}
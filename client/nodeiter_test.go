@@ -1,9 +1,13 @@
 package client
 
 import (
+	"errors"
+	"net/http"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/ring"
 	"github.com/troubling/hummingbird/common/test"
 )
@@ -30,6 +34,43 @@ func TestAffinityReadOrder(t *testing.T) {
 	require.Equal(t, "sdc", devs[2].Device)
 }
 
+func TestLatencyReadOrder(t *testing.T) {
+	sda := &ring.Device{Id: 0, Region: 1, Zone: 1, Ip: "1.1.1.1", Port: 6000, Device: "sda"}
+	sdb := &ring.Device{Id: 1, Region: 1, Zone: 1, Ip: "2.2.2.2", Port: 6000, Device: "sdb"}
+	sdc := &ring.Device{Id: 2, Region: 2, Zone: 1, Ip: "3.3.3.3", Port: 6000, Device: "sdc"}
+	devices := []*ring.Device{sda, sdb, sdc}
+	r := &test.FakeRing{MockDevices: []*ring.Device{sda, sdb, sdc}}
+	now := time.Now()
+	latencies := newNodeLatency(0.5)
+	latencies.now = func() time.Time { return now }
+	a := newClientRingFilter(r, "r1=100", "", "", 0)
+	a.latencies = latencies
+	latencies.observe(sda, 40*time.Millisecond)
+	latencies.observe(sdb, 20*time.Millisecond)
+	latencies.observe(sdc, time.Millisecond)
+	for i := 0; i < 10; i++ {
+		devs, _ := a.getReadNodes(1)
+		require.Equal(t, "sdb", devs[0].Device)
+		require.Equal(t, "sda", devs[1].Device)
+		require.Equal(t, "sdc", devs[2].Device) // still behind the preferred region
+	}
+
+	latencies.observe(sdb, 100*time.Millisecond)
+	require.Equal(t, 60*time.Millisecond, latencies.averages(devices)[sdb])
+	devs, _ := a.getReadNodes(1)
+	require.Equal(t, "sda", devs[0].Device)
+
+	// Once its samples are stale sda is unmeasured, so it's tried first.
+	now = now.Add(2 * latencySampleTTL)
+	latencies.observe(sdb, 100*time.Millisecond)
+	require.Equal(t, 100*time.Millisecond, latencies.averages(devices)[sdb])
+	_, ok := latencies.averages(devices)[sda]
+	require.False(t, ok)
+	devs, _ = a.getReadNodes(1)
+	require.Equal(t, "sda", devs[0].Device)
+	require.Equal(t, "sdb", devs[1].Device)
+}
+
 type fakeRing struct {
 	*test.FakeRing
 	nodes []*ring.Device
@@ -148,3 +189,131 @@ func TestWriteAffinityNonPreferred(t *testing.T) {
 	require.Equal(t, 4, more.Next().Id)
 	require.Equal(t, 5, more.Next().Id)
 }
+
+type sliceMoreNodes struct {
+	devs []*ring.Device
+}
+
+func (m *sliceMoreNodes) Next() *ring.Device {
+	if len(m.devs) == 0 {
+		return nil
+	}
+	dev := m.devs[0]
+	m.devs = m.devs[1:]
+	return dev
+}
+
+func TestWriteAffinityZones(t *testing.T) {
+	r := &fakeRing{
+		FakeRing: &test.FakeRing{
+			MockGetMoreNodes: &sliceMoreNodes{devs: []*ring.Device{
+				{Id: 3, Region: 1, Zone: 1, Device: "sdd"},
+				{Id: 4, Region: 2, Zone: 2, Device: "sde"},
+			}},
+		},
+		nodes: []*ring.Device{
+			{Id: 0, Region: 1, Zone: 1, Device: "sda"},
+			{Id: 1, Region: 2, Zone: 1, Device: "sdb"},
+			{Id: 2, Region: 3, Zone: 1, Device: "sdc"},
+		},
+	}
+	a := newClientRingFilter(r, "", "r1, r2z2", "", 0)
+	require.Equal(t, []writeAffSection{{zone: -1, region: 1}, {zone: 2, region: 2}}, a.waffs)
+	devs, _ := a.getWriteNodes(1)
+	require.Equal(t, 3, len(devs))
+	require.Equal(t, 0, devs[0].Id)
+	require.Equal(t, 3, devs[1].Id)
+	require.Equal(t, 4, devs[2].Id)
+}
+
+func TestReadNodesPreferWriteAffinityHandoffs(t *testing.T) {
+	handoffs := []*ring.Device{
+		{Id: 3, Region: 2, Zone: 1, Device: "sdd"},
+		{Id: 4, Region: 1, Zone: 1, Device: "sde"},
+		{Id: 5, Region: 2, Zone: 1, Device: "sdf"},
+		{Id: 6, Region: 1, Zone: 1, Device: "sdg"},
+	}
+	r := &fakeRing{
+		FakeRing: &test.FakeRing{MockGetMoreNodes: &sliceMoreNodes{devs: handoffs}},
+		nodes: []*ring.Device{
+			{Id: 0, Region: 1, Zone: 1, Device: "sda"},
+			{Id: 1, Region: 2, Zone: 1, Device: "sdb"},
+			{Id: 2, Region: 2, Zone: 1, Device: "sdc"},
+		},
+	}
+	// The handoffs writes went to are read before the others.
+	a := newClientRingFilter(r, "r1=100", "r1", "", 0)
+	devs, more := a.getReadNodes(1)
+	require.Equal(t, 0, devs[0].Id)
+	var ids []int
+	for dev := more.Next(); dev != nil; dev = more.Next() {
+		ids = append(ids, dev.Id)
+	}
+	require.Equal(t, []int{4, 6, 3, 5}, ids)
+
+	// Without write affinity they're read in ring order.
+	r.FakeRing.MockGetMoreNodes = &sliceMoreNodes{devs: handoffs}
+	a = newClientRingFilter(r, "r1=100", "", "", 0)
+	_, more = a.getReadNodes(1)
+	require.Equal(t, 3, more.Next().Id)
+}
+
+// failingTransport fails every request.
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestErrorLimitedNodesSkipped(t *testing.T) {
+	sda := &ring.Device{Id: 0, Ip: "1.1.1.1", Port: 6000, Device: "sda"}
+	sdb := &ring.Device{Id: 1, Ip: "2.2.2.2", Port: 6000, Device: "sdb"}
+	sdc := &ring.Device{Id: 2, Ip: "3.3.3.3", Port: 6000, Device: "sdc"}
+	sdd := &ring.Device{Id: 3, Ip: "4.4.4.4", Port: 6000, Device: "sdd"}
+	r := &fakeRing{FakeRing: &test.FakeRing{MockMoreNodes: sdd}, nodes: []*ring.Device{sda, sdb, sdc}}
+	backends := common.NewBackendTransport(failingTransport{}, common.BackendConfig{ErrorLimit: 1, ErrorInterval: time.Minute})
+	req, err := http.NewRequest("GET", "http://2.2.2.2:6000/sdb/1", nil)
+	require.Nil(t, err)
+	_, err = backends.RoundTrip(req)
+	require.NotNil(t, err)
+	a := newClientRingFilter(r, "", "", "", 0)
+	a.backends = backends
+
+	for i := 0; i < 10; i++ {
+		devs, _ := a.getReadNodes(1)
+		require.Equal(t, 3, len(devs))
+		require.Equal(t, "sdb", devs[2].Device)
+	}
+	devs, _ := a.getWriteNodes(1)
+	require.ElementsMatch(t, []*ring.Device{sda, sdc, sdd}, devs)
+}
+
+func TestWriteExcludes(t *testing.T) {
+	sda := &ring.Device{Id: 0, Region: 1, Zone: 1, Ip: "1.1.1.1", Port: 6000, Device: "sda"}
+	sdb := &ring.Device{Id: 1, Region: 2, Zone: 1, Ip: "2.2.2.2", Port: 6000, Device: "sdb"}
+	sdc := &ring.Device{Id: 2, Region: 1, Zone: 2, Ip: "3.3.3.3", Port: 6000, Device: "sdc"}
+	sdd := &ring.Device{Id: 3, Region: 2, Zone: 2, Ip: "4.4.4.4", Port: 6000, Device: "sdd"}
+	sde := &ring.Device{Id: 4, Region: 1, Zone: 3, Ip: "5.5.5.5", Port: 6000, Device: "sde"}
+	sdf := &ring.Device{Id: 5, Region: 1, Zone: 3, Ip: "6.6.6.6", Port: 6000, Device: "sdf"}
+	fr := &fakeRing{FakeRing: &test.FakeRing{}, nodes: []*ring.Device{sda, sdb, sdc}}
+	a := newClientRingFilter(fr, "", "", "", 0)
+	a.writeExcludes = parseWriteAffSections("r2")
+
+	// Region 2's primary is replaced by the first handoff outside it.
+	fr.MockGetMoreNodes = &sliceMoreNodes{devs: []*ring.Device{sdd, sde, sdf}}
+	devs, more := a.getWriteNodes(1)
+	require.Equal(t, []*ring.Device{sda, sdc, sde}, devs)
+	require.Equal(t, sdf, more.Next())
+	require.Nil(t, more.Next())
+
+	// And only as far as the handoff search depth goes.
+	a.handoffDepth = 1
+	fr.MockGetMoreNodes = &sliceMoreNodes{devs: []*ring.Device{sdd, sde, sdf}}
+	devs, _ = a.getWriteNodes(1)
+	require.Equal(t, []*ring.Device{sda, sdc}, devs)
+
+	// Reads still go to region 2.
+	a.handoffDepth = 0
+	devs, _ = a.getReadNodes(1)
+	require.ElementsMatch(t, []*ring.Device{sda, sdb, sdc}, devs)
+}
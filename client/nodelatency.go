@@ -0,0 +1,73 @@
+package client
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/troubling/hummingbird/common/ring"
+)
+
+// latencyErrorPenalty is recorded for requests that fail outright, so a node
+// that's down sinks behind the ones that are answering.
+const latencyErrorPenalty = time.Second
+
+// latencySampleTTL is how long a node's average is trusted without a fresh
+// sample; after that it's treated as unmeasured, which puts it back at the
+// front of its affinity tier so a node that was slow once gets another try.
+const latencySampleTTL = time.Minute
+
+type nodeLatencySample struct {
+	average time.Duration
+	updated time.Time
+}
+
+// nodeLatency keeps an exponentially weighted moving average of the time each
+// backend server takes to start answering requests.
+type nodeLatency struct {
+	lock    sync.Mutex
+	weight  float64
+	samples map[string]*nodeLatencySample
+	now     func() time.Time
+}
+
+func newNodeLatency(weight float64) *nodeLatency {
+	if weight <= 0 || weight > 1 {
+		weight = 0.3
+	}
+	return &nodeLatency{weight: weight, samples: map[string]*nodeLatencySample{}, now: time.Now}
+}
+
+func nodeLatencyKey(dev *ring.Device) string {
+	return fmt.Sprintf("%s:%d", dev.Ip, dev.Port)
+}
+
+// observe records a request to dev that took d to respond.
+func (nl *nodeLatency) observe(dev *ring.Device, d time.Duration) {
+	key := nodeLatencyKey(dev)
+	nl.lock.Lock()
+	defer nl.lock.Unlock()
+	now := nl.now()
+	s, ok := nl.samples[key]
+	if !ok || now.Sub(s.updated) > latencySampleTTL {
+		nl.samples[key] = &nodeLatencySample{average: d, updated: now}
+		return
+	}
+	s.average = time.Duration(nl.weight*float64(d) + (1-nl.weight)*float64(s.average))
+	s.updated = now
+}
+
+// averages returns the current average for each of devs, 0 for those that
+// are unmeasured.
+func (nl *nodeLatency) averages(devs []*ring.Device) map[*ring.Device]time.Duration {
+	averages := make(map[*ring.Device]time.Duration, len(devs))
+	nl.lock.Lock()
+	defer nl.lock.Unlock()
+	now := nl.now()
+	for _, dev := range devs {
+		if s, ok := nl.samples[nodeLatencyKey(dev)]; ok && now.Sub(s.updated) <= latencySampleTTL {
+			averages[dev] = s.average
+		}
+	}
+	return averages
+}
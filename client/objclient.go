@@ -8,6 +8,7 @@ import (
 	"math"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/troubling/hummingbird/common"
@@ -105,6 +106,18 @@ func (oc *standardObjectClient) putObject(ctx context.Context, account, containe
 	responsec := make(chan *http.Response)
 	devs, more := oc.objectRing.getWriteNodes(objectPartition)
 	objectReplicaCount := len(devs)
+	// Each backend request gets its own trailer map, filled in once the body
+	// has been copied to it and before it's closed.
+	var srcTrailer http.Header
+	var trailerKeys []string
+	if tr, ok := src.(TrailerReader); ok {
+		srcTrailer = tr.Trailer()
+		for key := range srcTrailer {
+			trailerKeys = append(trailerKeys, key)
+		}
+	}
+	var trailersLock sync.Mutex
+	trailers := map[io.WriteCloser]http.Header{}
 
 	devToRequest := func(index int, dev *ring.Device) (*http.Request, error) {
 		trp, wp := io.Pipe()
@@ -125,6 +138,15 @@ func (oc *standardObjectClient) putObject(ctx context.Context, account, containe
 		req.Header.Set("X-Container-Partition", strconv.FormatUint(containerPartition, 10))
 		addUpdateHeaders("X-Container", req.Header, containerDevices, index, objectReplicaCount)
 		req.Header.Set("Expect", "100-continue")
+		if len(trailerKeys) > 0 {
+			req.Trailer = make(http.Header, len(trailerKeys))
+			for _, key := range trailerKeys {
+				req.Trailer[key] = nil
+			}
+			trailersLock.Lock()
+			trailers[wp] = req.Trailer
+			trailersLock.Unlock()
+		}
 		return req, nil
 	}
 
@@ -175,7 +197,7 @@ func (oc *standardObjectClient) putObject(ctx context.Context, account, containe
 			if resp != nil {
 				responseClassCounts[resp.StatusCode/100]++
 				if responseClassCounts[resp.StatusCode/100] >= quorum {
-					timeout := time.After(time.Duration(PostQuorumTimeoutMs) * time.Millisecond)
+					timeout := time.After(oc.pdc.postQuorumTimeout)
 					for responseCount < objectReplicaCount {
 						select {
 						case <-responsec:
@@ -197,8 +219,22 @@ func (oc *standardObjectClient) putObject(ctx context.Context, account, containe
 		if !written && len(writers) >= quorum && len(writers)+responseCount == objectReplicaCount {
 			written = true
 			if _, err := common.CopyQuorum(src, quorum, writers...); err != nil {
+				// Abort the backend requests rather than letting them see a
+				// clean end of body and store a partial upload.
+				for _, w := range cWriters {
+					if pw, ok := w.(*io.PipeWriter); ok {
+						pw.CloseWithError(err)
+					}
+				}
 				return nectarutil.ResponseStub(http.StatusServiceUnavailable, "The service is currently unavailable.")
 			}
+			trailersLock.Lock()
+			for _, w := range cWriters {
+				for _, key := range trailerKeys {
+					trailers[w][key] = srcTrailer[key]
+				}
+			}
+			trailersLock.Unlock()
 			for _, w := range cWriters {
 				w.Close()
 			}
@@ -231,9 +267,96 @@ func (oc *standardObjectClient) postObject(ctx context.Context, account, contain
 	})
 }
 
+// newestReadNodes asks each of an object's primaries for just its timestamp,
+// for X-Newest requests. It returns the devices holding the newest version,
+// or a 404 response if that version is a deletion; if no primary reports a
+// timestamp it returns neither, leaving the read to go ahead as usual.
+func (oc *standardObjectClient) newestReadNodes(ctx context.Context, account, container, obj string, partition uint64) ([]*ring.Device, *http.Response) {
+	type timestampResponse struct {
+		dev       *ring.Device
+		timestamp string
+		exists    bool
+	}
+	devs, _ := oc.objectRing.getReadNodes(partition)
+	responses := make(chan timestampResponse, len(devs))
+	for _, dev := range devs {
+		go func(dev *ring.Device) {
+			tr := timestampResponse{dev: dev}
+			defer func() { responses <- tr }()
+			url := fmt.Sprintf("%s://%s:%d/%s/%d/%s/%s/%s", dev.Scheme, dev.Ip, dev.Port, dev.Device, partition,
+				common.Urlencode(account), common.Urlencode(container), common.Urlencode(obj))
+			req, err := http.NewRequest("HEAD", url, nil)
+			if err != nil {
+				return
+			}
+			req.Header.Set("User-Agent", oc.pdc.userAgent)
+			req = req.WithContext(tracing.CopySpanFromContext(ctx))
+			req.Header.Set("X-Backend-Storage-Policy-Index", strconv.Itoa(oc.policy))
+			req.Header.Set("X-Backend-Timestamp-Only", "true")
+			resp, err := oc.pdc.client.Do(req)
+			if err != nil {
+				oc.Logger.Debug("unable to HEAD object timestamp", zap.Error(err))
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode/100 == 2 || resp.StatusCode == http.StatusNotFound {
+				tr.timestamp = resp.Header.Get("X-Backend-Timestamp")
+				tr.exists = resp.StatusCode/100 == 2
+			}
+		}(dev)
+	}
+	var newest []*ring.Device
+	newestTimestamp := float64(-1)
+	deleted := ""
+	for range devs {
+		tr := <-responses
+		timestamp, err := strconv.ParseFloat(tr.timestamp, 64)
+		if err != nil || timestamp < newestTimestamp {
+			continue
+		}
+		if timestamp > newestTimestamp {
+			newestTimestamp = timestamp
+			newest = nil
+			deleted = ""
+		}
+		if tr.exists {
+			newest = append(newest, tr.dev)
+		} else {
+			deleted = tr.timestamp
+		}
+	}
+	if deleted != "" {
+		resp := nectarutil.ResponseStub(http.StatusNotFound, "")
+		resp.Header.Set("X-Backend-Timestamp", deleted)
+		return nil, resp
+	}
+	return newest, nil
+}
+
+// readRing returns the ring to read an object from, only holding the
+// devices with its newest version for X-Newest requests. It returns a
+// response instead if the newest version is a deletion.
+func (oc *standardObjectClient) readRing(ctx context.Context, account, container, obj string, partition uint64, headers http.Header) (ringFilter, *http.Response) {
+	if !common.LooksTrue(headers.Get("X-Newest")) {
+		return oc.objectRing, nil
+	}
+	devs, resp := oc.newestReadNodes(ctx, account, container, obj, partition)
+	if resp != nil {
+		return nil, resp
+	}
+	if len(devs) == 0 {
+		return oc.objectRing, nil
+	}
+	return &fixedReadNodes{ringFilter: oc.objectRing, devs: devs}, nil
+}
+
 func (oc *standardObjectClient) getObject(ctx context.Context, account, container, obj string, headers http.Header) *http.Response {
 	partition := oc.objectRing.GetPartition(account, container, obj)
-	return oc.pdc.firstResponse(oc.objectRing, partition, func(dev *ring.Device) (*http.Request, error) {
+	r, resp := oc.readRing(ctx, account, container, obj, partition, headers)
+	if resp != nil {
+		return resp
+	}
+	return oc.pdc.firstResponse(r, partition, func(dev *ring.Device) (*http.Request, error) {
 		url := fmt.Sprintf("%s://%s:%d/%s/%d/%s/%s/%s", dev.Scheme, dev.Ip, dev.Port, dev.Device, partition,
 			common.Urlencode(account), common.Urlencode(container), common.Urlencode(obj))
 		req, err := http.NewRequest("GET", url, nil)
@@ -268,7 +391,11 @@ func (oc *standardObjectClient) grepObject(ctx context.Context, account, contain
 
 func (oc *standardObjectClient) headObject(ctx context.Context, account, container, obj string, headers http.Header) *http.Response {
 	partition := oc.objectRing.GetPartition(account, container, obj)
-	return oc.pdc.firstResponse(oc.objectRing, partition, func(dev *ring.Device) (*http.Request, error) {
+	r, resp := oc.readRing(ctx, account, container, obj, partition, headers)
+	if resp != nil {
+		return resp
+	}
+	return oc.pdc.firstResponse(r, partition, func(dev *ring.Device) (*http.Request, error) {
 		url := fmt.Sprintf("%s://%s:%d/%s/%d/%s/%s/%s", dev.Scheme, dev.Ip, dev.Port, dev.Device, partition,
 			common.Urlencode(account), common.Urlencode(container), common.Urlencode(obj))
 		req, err := http.NewRequest("HEAD", url, nil)
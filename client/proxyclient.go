@@ -19,13 +19,12 @@ import (
 	"github.com/troubling/hummingbird/common/srv"
 	"github.com/troubling/hummingbird/common/tracing"
 	"github.com/troubling/nectar/nectarutil"
+	"github.com/uber-go/tally"
 	"go.uber.org/zap"
 	"golang.org/x/net/http2"
 )
 
-const PostQuorumTimeoutMs = 100
 const postPutTimeout = time.Second * 30
-const firstResponseFinalTimeout = time.Second * 30
 
 func addUpdateHeaders(prefix string, headers http.Header, devices []*ring.Device, i, replicas int) {
 	if i < len(devices) {
@@ -46,49 +45,119 @@ func addUpdateHeaders(prefix string, headers http.Header, devices []*ring.Device
 type proxyClient struct {
 	policyList        conf.PolicyList
 	client            common.HTTPClient
+	backends          *common.BackendTransport
 	AccountRing       ringFilter
 	ContainerRing     ringFilter
 	objectClients     map[int]proxyObjectClient
 	Logger            srv.LowLevelLogger
 	ClientTraceCloser io.Closer
 	userAgent         string
+	latencies         *nodeLatency
+	// concurrencyTimeout is how long reads wait for a node before asking the
+	// next one too.
+	concurrencyTimeout time.Duration
+	// containerInfoTTL is how many seconds container info, including
+	// whether the container exists, is kept in memcache.
+	containerInfoTTL int
+	// recoverableNodeTimeout is how long reads wait on the nodes they've
+	// asked, once there are no more to ask.
+	recoverableNodeTimeout time.Duration
+	// postQuorumTimeout is how long writes wait for the rest of the nodes
+	// once a quorum has answered.
+	postQuorumTimeout time.Duration
 }
 
 var _ ProxyClient = &proxyClient{}
 
+// parseUnixSockets reads a list of ip:port=path entries, for backend servers
+// on the same host that can be reached at a unix socket.
+func parseUnixSockets(value string) (map[string]string, error) {
+	sockets := map[string]string{}
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("Invalid backend_unix_sockets entry %q", entry)
+		}
+		sockets[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return sockets, nil
+}
+
 func NewProxyClient(policyList conf.PolicyList, cnf srv.ConfigLoader, logger srv.LowLevelLogger, certFile, keyFile, readAffinity, writeAffinity, writeAffinityCount string, serverconf conf.Config) (ProxyClient, error) {
+	unixSockets, err := parseUnixSockets(serverconf.GetDefault("app:proxy-server", "backend_unix_sockets", ""))
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 5 * time.Second,
+	}
+	dial := func(network, addr string) (net.Conn, error) {
+		if path, ok := unixSockets[addr]; ok {
+			return dialer.Dial("unix", path)
+		}
+		return dialer.Dial(network, addr)
+	}
+	// The proxy error limits nodes unless told not to.
+	backendDefaults := common.DefaultBackendConfig
+	backendDefaults.ErrorLimit = 10
+	backendConfig := common.LoadBackendConfig(serverconf.GetSection("app:proxy-server"), backendDefaults)
+	nodeTimeout := time.Duration(serverconf.GetFloat("app:proxy-server", "node_timeout", 10) * float64(time.Second))
 	var xport http.RoundTripper = &http.Transport{
-		MaxIdleConnsPerHost: 100,
-		MaxIdleConns:        0,
-		IdleConnTimeout:     5 * time.Second,
-		DisableCompression:  true,
-		Dial: (&net.Dialer{
-			Timeout:   10 * time.Second,
-			KeepAlive: 5 * time.Second,
-		}).Dial,
+		MaxIdleConnsPerHost:   backendConfig.MaxIdleConnsPerNode,
+		MaxIdleConns:          0,
+		IdleConnTimeout:       5 * time.Second,
+		DisableCompression:    true,
+		Dial:                  dial,
 		ExpectContinueTimeout: 10 * time.Minute, // TODO: this should probably be like infinity.
+		ResponseHeaderTimeout: nodeTimeout,
 	}
+	// Backends speak HTTP/2 over TLS, but only newer ones in the clear.
+	backendHTTP2 := serverconf.GetBool("app:proxy-server", "backend_http2", certFile != "" && keyFile != "")
 	if certFile != "" && keyFile != "" {
 		tlsConf, err := common.NewClientTLSConfig(certFile, keyFile)
 		if err != nil {
 			return nil, err
 		}
 		xport.(*http.Transport).TLSClientConfig = tlsConf
-		if err = http2.ConfigureTransport(xport.(*http.Transport)); err != nil {
-			return nil, err
+		if backendHTTP2 {
+			if err = http2.ConfigureTransport(xport.(*http.Transport)); err != nil {
+				return nil, err
+			}
 		}
+	} else if backendHTTP2 {
+		xport = srv.NewCleartextHTTP2Transport(xport.(*http.Transport))
 	}
+	backends := common.NewBackendTransport(common.NewSigningTransport(xport, conf.GetBackendSigningKeys()), backendConfig)
+	backends.OnStateChange(func(node string, ejected bool) {
+		if ejected {
+			logger.Error("Error limiting backend node", zap.String("node", node), zap.Duration("for", backendConfig.ErrorInterval))
+		} else {
+			logger.Info("Backend node no longer error limited", zap.String("node", node))
+		}
+	})
 	httpClient := &http.Client{
-		Transport: xport,
+		Transport: tracing.NewTraceTransport(backends),
 		Timeout:   120 * time.Minute,
 	}
 	// Debug hook to auto-close responses and report on it. See debug.go
 	// xport = &autoCloseResponses{transport: xport}
 	c := &proxyClient{
-		policyList: policyList,
-		client:     httpClient,
-		Logger:     logger,
-		userAgent:  "Proxy",
+		policyList:             policyList,
+		client:                 httpClient,
+		backends:               backends,
+		Logger:                 logger,
+		userAgent:              "Proxy",
+		concurrencyTimeout:     time.Second,
+		containerInfoTTL:       int(serverconf.GetInt("app:proxy-server", "recheck_container_existence", 10)),
+		recoverableNodeTimeout: time.Duration(serverconf.GetFloat("app:proxy-server", "recoverable_node_timeout", nodeTimeout.Seconds()) * float64(time.Second)),
+		postQuorumTimeout:      time.Duration(serverconf.GetFloat("app:proxy-server", "post_quorum_timeout", 0.1) * float64(time.Second)),
+	}
+	if serverconf.GetBool("app:proxy-server", "concurrent_gets", false) {
+		c.concurrencyTimeout = time.Duration(serverconf.GetFloat("app:proxy-server", "concurrency_timeout", 0.5) * float64(time.Second))
 	}
 	if serverconf.HasSection("tracing") {
 		clientTracer, clientTraceCloser, err := tracing.Init("proxydirect-client", logger, serverconf.GetSection("tracing"))
@@ -103,6 +172,10 @@ func NewProxyClient(policyList conf.PolicyList, cnf srv.ConfigLoader, logger srv
 		}
 	}
 
+	if serverconf.GetBool("app:proxy-server", "read_latency_ordering", false) {
+		c.latencies = newNodeLatency(serverconf.GetFloat("app:proxy-server", "read_latency_weight", 0.3))
+	}
+
 	if c.policyList == nil {
 		policyList, err := cnf.GetPolicies()
 		if err != nil {
@@ -118,12 +191,26 @@ func NewProxyClient(policyList conf.PolicyList, cnf srv.ConfigLoader, logger srv
 	if err != nil {
 		return nil, err
 	}
-	c.ContainerRing = newClientRingFilter(containerRing, readAffinity, "", "", 0)
+	// Writes skip the regions and zones write_exclude lists, like those in an
+	// outage, sending what they'd have had to handoffs elsewhere.
+	writeExclude := serverconf.GetDefault("app:proxy-server", "write_exclude", "")
+	handoffDepth := int(serverconf.GetInt("app:proxy-server", "handoff_search_depth", 0))
+	containerRingFilter := newClientRingFilter(containerRing, readAffinity, "", "", 0)
+	containerRingFilter.latencies = c.latencies
+	containerRingFilter.backends = backends
+	containerRingFilter.handoffDepth = handoffDepth
+	containerRingFilter.writeExcludes = parseWriteAffSections(writeExclude)
+	c.ContainerRing = containerRingFilter
 	accountRing, err := cnf.GetRing("account", hashPathPrefix, hashPathSuffix, 0)
 	if err != nil {
 		return nil, err
 	}
-	c.AccountRing = newClientRingFilter(accountRing, readAffinity, "", "", 0)
+	accountRingFilter := newClientRingFilter(accountRing, readAffinity, "", "", 0)
+	accountRingFilter.latencies = c.latencies
+	accountRingFilter.backends = backends
+	accountRingFilter.handoffDepth = handoffDepth
+	accountRingFilter.writeExcludes = parseWriteAffSections(writeExclude)
+	c.AccountRing = accountRingFilter
 	c.objectClients = make(map[int]proxyObjectClient)
 	for _, policy := range c.policyList {
 		// TODO: the intention is to (if it becomes necessary) have a policy type to object client
@@ -140,6 +227,10 @@ func NewProxyClient(policyList conf.PolicyList, cnf srv.ConfigLoader, logger srv
 		if policyWriteAffinity == "" {
 			policyWriteAffinity = writeAffinity
 		}
+		policyWriteExclude := policy.Config["write_exclude"]
+		if policyWriteExclude == "" {
+			policyWriteExclude = writeExclude
+		}
 		policyWriteAffinityCount := policy.Config["write_affinity_node_count"]
 		if policyWriteAffinityCount == "" {
 			policyWriteAffinityCount = writeAffinityCount
@@ -152,10 +243,15 @@ func NewProxyClient(policyList conf.PolicyList, cnf srv.ConfigLoader, logger srv
 				deviceLimit = 3
 			}
 		}
+		objectRingFilter := newClientRingFilter(ring, policyReadAffinity, policyWriteAffinity, policyWriteAffinityCount, deviceLimit)
+		objectRingFilter.latencies = c.latencies
+		objectRingFilter.backends = backends
+		objectRingFilter.handoffDepth = handoffDepth
+		objectRingFilter.writeExcludes = parseWriteAffSections(policyWriteExclude)
 		client := &standardObjectClient{
 			pdc:        c,
 			policy:     policy.Index,
-			objectRing: newClientRingFilter(ring, policyReadAffinity, policyWriteAffinity, policyWriteAffinityCount, deviceLimit),
+			objectRing: objectRingFilter,
 			Logger:     logger,
 		}
 		c.objectClients[policy.Index] = client
@@ -167,6 +263,22 @@ func (c *proxyClient) SetUserAgent(v string) {
 	c.userAgent = v
 }
 
+// do sends req to dev, timing how long it takes to get a response for
+// latency ordered reads.
+func (c *proxyClient) do(dev *ring.Device, req *http.Request) (*http.Response, error) {
+	if c.latencies == nil {
+		return c.client.Do(req)
+	}
+	start := time.Now()
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.latencies.observe(dev, latencyErrorPenalty)
+	} else {
+		c.latencies.observe(dev, time.Since(start))
+	}
+	return resp, err
+}
+
 // quorumResponse returns with a response representative of a quorum of nodes.
 //
 // This is analogous to swift's best_response function.
@@ -183,7 +295,7 @@ func (c *proxyClient) quorumResponse(r ringFilter, partition uint64, devToReques
 				if req, err := devToRequest(index, dev); err != nil {
 					c.Logger.Error("unable to create request", zap.Error(err))
 					resp = nectarutil.ResponseStub(http.StatusInternalServerError, err.Error())
-				} else if r, err := c.client.Do(req); err != nil {
+				} else if r, err := c.do(dev, req); err != nil {
 					c.Logger.Error("unable to get response", zap.Error(err))
 					resp = nectarutil.ResponseStub(http.StatusInternalServerError, err.Error())
 				} else {
@@ -216,7 +328,7 @@ func (c *proxyClient) quorumResponse(r ringFilter, partition uint64, devToReques
 		if resp := <-responsec; resp != nil {
 			responseClassCounts[resp.StatusCode/100]++
 			if responseClassCounts[resp.StatusCode/100] >= quorum {
-				timeout := time.After(time.Duration(PostQuorumTimeoutMs) * time.Millisecond)
+				timeout := time.After(c.postQuorumTimeout)
 				for i < int(len(devs)-1) {
 					select {
 					case <-responsec:
@@ -232,23 +344,54 @@ func (c *proxyClient) quorumResponse(r ringFilter, partition uint64, devToReques
 	return nectarutil.ResponseStub(http.StatusServiceUnavailable, "Unknown State")
 }
 
+// cancelOnClose cancels its request's context once the response body is
+// closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// firstResponse returns the first good response from the nodes. Each node
+// is given concurrencyTimeout to answer before the next is asked as well;
+// once one has answered, the requests still outstanding are cancelled.
 func (c *proxyClient) firstResponse(r ringFilter, partition uint64, devToRequest func(*ring.Device) (*http.Request, error)) (resp *http.Response) {
-	receivedResponses := make(chan *http.Response)
+	type firstResponseResult struct {
+		resp  *http.Response
+		index int
+	}
+	receivedResponses := make(chan firstResponseResult)
 	alreadyFoundGoodResponse := make(chan struct{})
 	defer close(alreadyFoundGoodResponse)
+	cancels := map[int]context.CancelFunc{}
+	defer func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}()
 	devs, more := r.getReadNodes(partition)
 	internalErrors := 0
 	notFounds := 0
 	backendHeaders := map[string]string{}
-	interpretResponse := func(resp *http.Response) *http.Response {
+	interpretResponse := func(result firstResponseResult) *http.Response {
+		resp := result.resp
 		if resp != nil && (resp.StatusCode/100 == 2 || resp.StatusCode == http.StatusPreconditionFailed ||
 			resp.StatusCode == http.StatusNotModified || resp.StatusCode == http.StatusRequestedRangeNotSatisfiable) {
 			resp.Header.Set("Accept-Ranges", "bytes")
 			if etag := resp.Header.Get("Etag"); etag != "" {
 				resp.Header.Set("Etag", strings.Trim(etag, "\""))
 			}
+			resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancels[result.index]}
+			delete(cancels, result.index)
 			return resp
 		}
+		cancels[result.index]()
+		delete(cancels, result.index)
 		if resp != nil {
 			resp.Body.Close()
 			for k := range resp.Header {
@@ -284,43 +427,46 @@ func (c *proxyClient) firstResponse(r ringFilter, partition uint64, devToRequest
 			internalErrors++
 			continue
 		}
+		ctx, cancel := context.WithCancel(req.Context())
+		cancels[requestCount] = cancel
+		req = req.WithContext(ctx)
 
 		requestsPending++
-		go func(r *http.Request) {
-			response, err := c.client.Do(r)
+		go func(dev *ring.Device, r *http.Request, index int) {
+			response, err := c.do(dev, r)
 			if err != nil {
-				c.Logger.Error("firstResponse response", zap.Error(err))
+				if r.Context().Err() == nil {
+					c.Logger.Error("firstResponse response", zap.Error(err))
+				}
 				if response != nil {
 					response.Body.Close()
 				}
 				response = nil
 			}
 			select {
-			case receivedResponses <- response:
+			case receivedResponses <- firstResponseResult{resp: response, index: index}:
 			case <-alreadyFoundGoodResponse:
 				if response != nil {
 					response.Body.Close()
 				}
 			}
-		}(req)
+		}(dev, req, requestCount)
 
 		select {
-		case resp = <-receivedResponses:
+		case result := <-receivedResponses:
 			requestsPending--
-			resp = interpretResponse(resp)
-			if resp != nil {
+			if resp = interpretResponse(result); resp != nil {
 				return resp
 			}
-		case <-time.After(time.Second):
+		case <-time.After(c.concurrencyTimeout):
 		}
 	}
-	giveUp := time.After(firstResponseFinalTimeout)
+	giveUp := time.After(c.recoverableNodeTimeout)
 	for requestsPending > 0 {
 		select {
-		case resp = <-receivedResponses:
+		case result := <-receivedResponses:
 			requestsPending--
-			resp = interpretResponse(resp)
-			if resp != nil {
+			if resp = interpretResponse(result); resp != nil {
 				return resp
 			}
 		case <-giveUp:
@@ -338,6 +484,14 @@ func (c *proxyClient) firstResponse(r ringFilter, partition uint64, devToRequest
 	return nectarutil.ResponseStub(http.StatusServiceUnavailable, "")
 }
 
+func (c *proxyClient) SetMetricsScope(scope tally.Scope) {
+	c.backends.SetMetricsScope(scope)
+}
+
+func (c *proxyClient) ErrorLimitedNodes() map[string]time.Time {
+	return c.backends.EjectedNodes()
+}
+
 func (c *proxyClient) Close() error {
 	if c.ClientTraceCloser != nil {
 		return c.ClientTraceCloser.Close()
@@ -377,7 +531,14 @@ func (c *requestClient) getObjectClient(ctx context.Context, account string, con
 		}
 		return &erroringObjectClient{st, err.Error()}
 	}
-	return c.pdc.objectClients[ci.StoragePolicyIndex]
+	oc := c.pdc.objectClients[ci.StoragePolicyIndex]
+	// Until a policy migration's cutover, the container's objects can be in either policy.
+	if target, err := strconv.Atoi(ci.SysMetadata["Policy-Migration"]); err == nil && target != ci.StoragePolicyIndex {
+		if toc, ok := c.pdc.objectClients[target]; ok && oc != nil {
+			return &migratingObjectClient{from: oc, fromPolicy: ci.StoragePolicyIndex, to: toc, toPolicy: target}
+		}
+	}
+	return oc
 }
 
 func (c *requestClient) invalidateContainerInfo(ctx context.Context, account string, container string) {
@@ -537,6 +698,20 @@ func (c *requestClient) PostContainer(ctx context.Context, account string, conta
 }
 
 func (c *requestClient) GetContainerRaw(ctx context.Context, account string, container string, options map[string]string, headers http.Header) *http.Response {
+	// A sharded container answers with its shard ranges, which are listed in its place.
+	rootHeaders := http.Header{}
+	for k, v := range headers {
+		rootHeaders[k] = v
+	}
+	rootHeaders.Set("X-Backend-Record-Type", "auto")
+	resp := c.getContainerRaw(ctx, account, container, options, rootHeaders)
+	if resp.StatusCode/100 == 2 && resp.Header.Get("X-Backend-Record-Type") == "shard" {
+		return c.mergeShardListings(ctx, container, options, headers, resp)
+	}
+	return resp
+}
+
+func (c *requestClient) getContainerRaw(ctx context.Context, account string, container string, options map[string]string, headers http.Header) *http.Response {
 	partition := c.pdc.ContainerRing.GetPartition(account, container, "")
 	query := nectarutil.Mkquery(options)
 	return c.pdc.firstResponse(c.pdc.ContainerRing, partition, func(dev *ring.Device) (*http.Request, error) {
@@ -571,11 +746,17 @@ func (c *requestClient) GetContainerInfo(ctx context.Context, account string, co
 		return nil, ContainerNotFound
 	}
 	if !contInCache && c.mc != nil {
-		if err := c.mc.GetStructured(ctx, key, &ci); err == nil {
+		if err := c.mc.GetStructured(ctx, key, &ci); err == nil && ci != nil {
+			if ci.StatusCode == http.StatusNotFound {
+				ci = nil
+			}
 			if c.lc != nil {
-				c.lcm.RLock()
+				c.lcm.Lock()
 				c.lc[key] = ci
-				c.lcm.RUnlock()
+				c.lcm.Unlock()
+			}
+			if ci == nil {
+				return nil, ContainerNotFound
 			}
 			contInCache = true
 		} else {
@@ -588,9 +769,12 @@ func (c *requestClient) GetContainerInfo(ctx context.Context, account string, co
 		if resp.StatusCode/100 != 2 {
 			if resp.StatusCode == 404 {
 				if c.lc != nil {
-					c.lcm.RLock()
+					c.lcm.Lock()
 					c.lc[key] = nil
-					c.lcm.RUnlock()
+					c.lcm.Unlock()
+				}
+				if c.mc != nil {
+					c.mc.Set(ctx, key, &ContainerInfo{StatusCode: http.StatusNotFound}, c.pdc.containerInfoTTL)
 				}
 				return nil, ContainerNotFound
 			}
@@ -612,6 +796,7 @@ func (c *requestClient) SetContainerInfo(ctx context.Context, account string, co
 	ci := &ContainerInfo{
 		Metadata:    make(map[string]string),
 		SysMetadata: make(map[string]string),
+		StatusCode:  resp.StatusCode,
 	}
 	var err error
 	if ci.ObjectCount, err = strconv.ParseInt(resp.Header.Get("X-Container-Object-Count"), 10, 64); err != nil {
@@ -642,7 +827,7 @@ func (c *requestClient) SetContainerInfo(ctx context.Context, account string, co
 		c.lcm.Unlock()
 	}
 	if c.mc != nil {
-		c.mc.Set(ctx, key, ci, 10) // throwing away error here..
+		c.mc.Set(ctx, key, ci, c.pdc.containerInfoTTL) // throwing away error here..
 	}
 	return ci, nil
 }
@@ -0,0 +1,185 @@
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/common/test"
+	"go.uber.org/zap"
+)
+
+func testServerDevice(t *testing.T, ts *httptest.Server, region int) *ring.Device {
+	u, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.Nil(t, err)
+	return &ring.Device{Scheme: "http", Ip: u.Hostname(), Port: port, Region: region, Device: "sda"}
+}
+
+func TestFirstResponseRacing(t *testing.T) {
+	cancelled := make(chan struct{}, 2)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			cancelled <- struct{}{}
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fast"))
+	}))
+	defer fast.Close()
+
+	// The slow nodes are preferred, so they're asked first.
+	r := newClientRingFilter(&test.FakeRing{MockDevices: []*ring.Device{
+		testServerDevice(t, slow, 1), testServerDevice(t, slow, 1), testServerDevice(t, fast, 2),
+	}}, "r1=100", "", "", 0)
+	c := &proxyClient{client: &http.Client{}, Logger: zap.NewNop(), concurrencyTimeout: 20 * time.Millisecond}
+	start := time.Now()
+	resp := c.firstResponse(r, 0, func(dev *ring.Device) (*http.Request, error) {
+		return http.NewRequest("GET", dev.Scheme+"://"+dev.Ip+":"+strconv.Itoa(dev.Port)+"/", nil)
+	})
+	require.Equal(t, 200, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Nil(t, resp.Body.Close())
+	require.Equal(t, "fast", string(body))
+	require.True(t, time.Since(start) < time.Second)
+
+	// Both losers were cancelled.
+	for i := 0; i < 2; i++ {
+		select {
+		case <-cancelled:
+		case <-time.After(5 * time.Second):
+			t.Fatal("slow request wasn't cancelled")
+		}
+	}
+}
+
+func TestContainerInfoCachesNotFound(t *testing.T) {
+	var heads int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&heads, 1)
+		w.WriteHeader(404)
+	}))
+	defer ts.Close()
+	dev := testServerDevice(t, ts, 1)
+	r := newClientRingFilter(&test.FakeRing{MockDevices: []*ring.Device{dev, dev, dev}, MockGetMoreNodes: &sliceMoreNodes{}}, "", "", "", 0)
+	c := &proxyClient{client: &http.Client{}, Logger: zap.NewNop(), ContainerRing: r, concurrencyTimeout: time.Second, containerInfoTTL: 10}
+	mc := &test.FakeMemcacheRing{MockGetStructured: map[string][]byte{}}
+
+	rc := c.NewRequestClient(mc, map[string]*ContainerInfo{}, zap.NewNop())
+	_, err := rc.GetContainerInfo(context.Background(), "a", "c")
+	require.Equal(t, ContainerNotFound, err)
+	headed := atomic.LoadInt64(&heads)
+	require.True(t, headed > 0)
+	require.Equal(t, []interface{}{&ContainerInfo{StatusCode: 404}}, mc.MockSetValues)
+
+	// Another request finds the 404 in memcache.
+	mc.MockGetStructured["container/a/c"] = []byte(`{"StatusCode": 404}`)
+	rc = c.NewRequestClient(mc, map[string]*ContainerInfo{}, zap.NewNop())
+	_, err = rc.GetContainerInfo(context.Background(), "a", "c")
+	require.Equal(t, ContainerNotFound, err)
+	require.Equal(t, headed, atomic.LoadInt64(&heads))
+}
+
+func TestGetContainerRawMergesShards(t *testing.T) {
+	shards := map[string][]string{
+		"/sda/0/.shards_a/c-0": {"a", "b"},
+		"/sda/0/.shards_a/c-1": {"c", "d"},
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sda/0/a/c" {
+			require.Equal(t, "auto", r.Header.Get("X-Backend-Record-Type"))
+			w.Header().Set("X-Backend-Record-Type", "shard")
+			w.Header().Set("X-Container-Object-Count", "4")
+			w.Write([]byte(`[{"account": ".shards_a", "container": "c-1", "lower": "b", "upper": "", "state": "active"},
+				{"account": ".shards_a", "container": "c-0", "lower": "", "upper": "b", "state": "active"}]`))
+			return
+		}
+		require.Equal(t, "", r.Header.Get("X-Backend-Record-Type"))
+		require.Equal(t, "json", r.URL.Query().Get("format"))
+		marker := r.URL.Query().Get("marker")
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		listing := []string{}
+		for _, name := range shards[r.URL.Path] {
+			if name > marker && strings.HasPrefix(name, r.URL.Query().Get("prefix")) && len(listing) < limit {
+				listing = append(listing, `{"name": "`+name+`", "bytes": 1}`)
+			}
+		}
+		w.Write([]byte("[" + strings.Join(listing, ",") + "]"))
+	}))
+	defer ts.Close()
+	dev := testServerDevice(t, ts, 1)
+	r := newClientRingFilter(&test.FakeRing{MockDevices: []*ring.Device{dev, dev, dev}, MockGetMoreNodes: &sliceMoreNodes{}}, "", "", "", 0)
+	c := &proxyClient{client: &http.Client{}, Logger: zap.NewNop(), ContainerRing: r, concurrencyTimeout: time.Second}
+	rc := c.NewRequestClient(nil, map[string]*ContainerInfo{}, zap.NewNop())
+
+	resp := rc.GetContainerRaw(context.Background(), "a", "c", map[string]string{"format": "json", "marker": "a", "limit": "2"}, http.Header{})
+	require.Equal(t, 200, resp.StatusCode)
+	require.Equal(t, "4", resp.Header.Get("X-Container-Object-Count"))
+	require.Equal(t, "", resp.Header.Get("X-Backend-Record-Type"))
+	body, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, `[{"name": "b", "bytes": 1},{"name": "c", "bytes": 1}]`, string(body))
+
+	resp = rc.GetContainerRaw(context.Background(), "a", "c", map[string]string{}, http.Header{})
+	require.Equal(t, 200, resp.StatusCode)
+	body, err = ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, "a\nb\nc\nd\n", string(body))
+
+	resp = rc.GetContainerRaw(context.Background(), "a", "c", map[string]string{"prefix": "d"}, http.Header{"Accept": {"application/xml"}})
+	require.Equal(t, 200, resp.StatusCode)
+	body, err = ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Contains(t, string(body), `<container name="c"><object><name>d</name><last_modified></last_modified><bytes>1</bytes>`)
+	require.NotContains(t, string(body), `<name>c</name>`)
+}
+
+func TestBackendUnixSockets(t *testing.T) {
+	_, err := parseUnixSockets("127.0.0.1:6000")
+	require.NotNil(t, err)
+	sockets, err := parseUnixSockets(" 127.0.0.1:6000 = /run/object.sock, 127.0.0.1:6001=/run/container.sock,")
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{"127.0.0.1:6000": "/run/object.sock", "127.0.0.1:6001": "/run/container.sock"}, sockets)
+
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("unix", filepath.Join(dir, "object.sock"))
+	require.Nil(t, err)
+	defer l.Close()
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("unix"))
+	}))
+	config, err := conf.StringConfig("[app:proxy-server]\nbackend_unix_sockets = 127.0.0.1:1=" + filepath.Join(dir, "object.sock") + "\n")
+	require.Nil(t, err)
+	pc, err := NewProxyClient(nil, srv.NewTestConfigLoader(&test.FakeRing{}), zap.NewNop(), "", "", "", "", "", config)
+	require.Nil(t, err)
+	// Nothing listens on port 1, so only the unix socket can answer.
+	req, err := http.NewRequest("GET", "http://127.0.0.1:1/", nil)
+	require.Nil(t, err)
+	resp, err := pc.(*proxyClient).client.Do(req)
+	require.Nil(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Nil(t, err)
+	require.Equal(t, "unix", string(body))
+}
@@ -0,0 +1,167 @@
+package sdk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+)
+
+// Authenticator gets a token and the storage URL it's for.
+type Authenticator interface {
+	// Authenticate returns the token, the storage URL, and when the token
+	// expires, or the zero time if it doesn't say.
+	Authenticate(ctx context.Context, client common.HTTPClient) (token, storageURL string, expires time.Time, err error)
+}
+
+// TempAuth authenticates with tempauth, or anything else speaking v1 auth.
+type TempAuth struct {
+	// URL is the auth URL, like http://127.0.0.1:8080/auth/v1.0.
+	URL  string
+	User string
+	Key  string
+}
+
+func (a *TempAuth) Authenticate(ctx context.Context, client common.HTTPClient) (string, string, time.Time, error) {
+	req, err := http.NewRequest("GET", a.URL, nil)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("X-Auth-User", a.User)
+	req.Header.Set("X-Auth-Key", a.Key)
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return "", "", time.Time{}, &StatusError{Method: "GET", URL: a.URL, StatusCode: resp.StatusCode}
+	}
+	token, storageURL := resp.Header.Get("X-Auth-Token"), resp.Header.Get("X-Storage-Url")
+	if token == "" || storageURL == "" {
+		return "", "", time.Time{}, fmt.Errorf("auth response from %s had no token or storage url", a.URL)
+	}
+	return token, storageURL, time.Time{}, nil
+}
+
+// Keystone authenticates with a password against Keystone's v3 API, and
+// finds the storage URL in its catalog.
+type Keystone struct {
+	// URL is Keystone's, like http://127.0.0.1:5000/ or
+	// http://127.0.0.1:5000/v3.
+	URL             string
+	Username        string
+	Password        string
+	UserDomainID    string
+	ProjectName     string
+	ProjectDomainID string
+	// Region and Interface pick the object-store endpoint; with no
+	// Region the first is used, and Interface is "public" if not set.
+	Region    string
+	Interface string
+}
+
+type keystoneDomain struct {
+	ID string `json:"id"`
+}
+
+type keystoneAuthRequest struct {
+	Auth struct {
+		Identity struct {
+			Methods  []string `json:"methods"`
+			Password struct {
+				User struct {
+					Name     string         `json:"name"`
+					Password string         `json:"password"`
+					Domain   keystoneDomain `json:"domain"`
+				} `json:"user"`
+			} `json:"password"`
+		} `json:"identity"`
+		Scope struct {
+			Project struct {
+				Name   string         `json:"name"`
+				Domain keystoneDomain `json:"domain"`
+			} `json:"project"`
+		} `json:"scope"`
+	} `json:"auth"`
+}
+
+type keystoneAuthResponse struct {
+	Token struct {
+		ExpiresAt time.Time `json:"expires_at"`
+		Catalog   []struct {
+			Type      string `json:"type"`
+			Endpoints []struct {
+				Interface string `json:"interface"`
+				Region    string `json:"region"`
+				URL       string `json:"url"`
+			} `json:"endpoints"`
+		} `json:"catalog"`
+	} `json:"token"`
+}
+
+func (a *Keystone) Authenticate(ctx context.Context, client common.HTTPClient) (string, string, time.Time, error) {
+	var body keystoneAuthRequest
+	body.Auth.Identity.Methods = []string{"password"}
+	body.Auth.Identity.Password.User.Name = a.Username
+	body.Auth.Identity.Password.User.Password = a.Password
+	body.Auth.Identity.Password.User.Domain.ID = defaultString(a.UserDomainID, "default")
+	body.Auth.Scope.Project.Name = a.ProjectName
+	body.Auth.Scope.Project.Domain.ID = defaultString(a.ProjectDomainID, "default")
+	b, err := json.Marshal(body)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	u := strings.TrimSuffix(a.URL, "/")
+	if !strings.HasSuffix(u, "/v3") {
+		u += "/v3"
+	}
+	u += "/auth/tokens"
+	req, err := http.NewRequest("POST", u, bytes.NewReader(b))
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		io.Copy(ioutil.Discard, resp.Body)
+		return "", "", time.Time{}, &StatusError{Method: "POST", URL: u, StatusCode: resp.StatusCode}
+	}
+	var ar keystoneAuthResponse
+	if err := json.NewDecoder(resp.Body).Decode(&ar); err != nil {
+		return "", "", time.Time{}, err
+	}
+	iface := defaultString(a.Interface, "public")
+	for _, service := range ar.Token.Catalog {
+		if service.Type != "object-store" {
+			continue
+		}
+		for _, ep := range service.Endpoints {
+			if ep.Interface == iface && (a.Region == "" || ep.Region == a.Region) {
+				return resp.Header.Get("X-Subject-Token"), ep.URL, ar.Token.ExpiresAt, nil
+			}
+		}
+	}
+	return "", "", time.Time{}, fmt.Errorf("no %s object-store endpoint in the catalog from %s", iface, u)
+}
+
+func defaultString(s, dfl string) string {
+	if s == "" {
+		return dfl
+	}
+	return s
+}
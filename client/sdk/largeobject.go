@@ -0,0 +1,160 @@
+package sdk
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// LargeObjectOptions say how PutSLO and PutDLO split an object into
+// segments.
+type LargeObjectOptions struct {
+	// SegmentSize is how big each segment is, 100 MiB if not set.
+	SegmentSize int64
+	// SegmentContainer is where the segments go, <container>_segments if
+	// not set. It's created if it isn't there.
+	SegmentContainer string
+	// Concurrency is how many segments are uploaded at once, 4 if not set.
+	// One more segment than that is held in memory.
+	Concurrency int
+	// Headers are sent with the manifest, like its Content-Type and
+	// metadata.
+	Headers http.Header
+}
+
+func (o LargeObjectOptions) withDefaults(container string) LargeObjectOptions {
+	if o.SegmentSize <= 0 {
+		o.SegmentSize = 100 * 1024 * 1024
+	}
+	if o.SegmentContainer == "" {
+		o.SegmentContainer = container + "_segments"
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = 4
+	}
+	return o
+}
+
+type sloSegment struct {
+	Path      string `json:"path"`
+	Etag      string `json:"etag"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
+// uploadSegments uploads src in segments named prefix followed by their
+// index, returning them in order.
+func (c *Client) uploadSegments(ctx context.Context, src io.Reader, prefix string, opts LargeObjectOptions) ([]sloSegment, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if err := c.PutContainer(ctx, opts.SegmentContainer, nil); err != nil {
+		return nil, err
+	}
+	var segments []sloSegment
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var uploadErr error
+	sem := make(chan struct{}, opts.Concurrency)
+	for i := 0; ctx.Err() == nil; i++ {
+		buf := make([]byte, opts.SegmentSize)
+		n, err := io.ReadFull(src, buf)
+		if err == io.EOF {
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			cancel()
+			wg.Wait()
+			return nil, err
+		}
+		buf = buf[:n]
+		sum := md5.Sum(buf)
+		etag := hex.EncodeToString(sum[:])
+		name := fmt.Sprintf("%s%08d", prefix, i)
+		segments = append(segments, sloSegment{Path: "/" + opts.SegmentContainer + "/" + name, Etag: etag, SizeBytes: int64(n)})
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if _, err := c.PutObject(ctx, opts.SegmentContainer, name, http.Header{"Etag": {etag}}, bytes.NewReader(buf)); err != nil {
+				lock.Lock()
+				if uploadErr == nil {
+					uploadErr = err
+				}
+				lock.Unlock()
+				cancel()
+			}
+		}()
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+	wg.Wait()
+	if uploadErr != nil {
+		return nil, uploadErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return segments, nil
+}
+
+func segmentPrefix(obj, kind string) string {
+	return fmt.Sprintf("%s/%s/%d/", obj, kind, time.Now().UnixNano())
+}
+
+// PutSLO uploads src as a static large object: segments uploaded in
+// parallel, then a manifest listing them. An empty src is uploaded as an
+// ordinary empty object.
+func (c *Client) PutSLO(ctx context.Context, container, obj string, src io.Reader, opts LargeObjectOptions) error {
+	opts = opts.withDefaults(container)
+	segments, err := c.uploadSegments(ctx, src, segmentPrefix(obj, "slo"), opts)
+	if err != nil {
+		return err
+	}
+	if len(segments) == 0 {
+		_, err := c.PutObject(ctx, container, obj, opts.Headers, bytes.NewReader(nil))
+		return err
+	}
+	manifest, err := json.Marshal(segments)
+	if err != nil {
+		return err
+	}
+	_, err = c.doHeaders(ctx, "PUT", container, obj, url.Values{"multipart-manifest": {"put"}}, opts.Headers, bytes.NewReader(manifest))
+	return err
+}
+
+// PutDLO uploads src as a dynamic large object: segments uploaded in
+// parallel under a prefix of their own, then a manifest naming the prefix.
+func (c *Client) PutDLO(ctx context.Context, container, obj string, src io.Reader, opts LargeObjectOptions) error {
+	opts = opts.withDefaults(container)
+	prefix := segmentPrefix(obj, "dlo")
+	if _, err := c.uploadSegments(ctx, src, prefix, opts); err != nil {
+		return err
+	}
+	headers := make(http.Header, len(opts.Headers)+1)
+	for k, v := range opts.Headers {
+		headers[k] = v
+	}
+	headers.Set("X-Object-Manifest", opts.SegmentContainer+"/"+prefix)
+	_, err := c.PutObject(ctx, container, obj, headers, bytes.NewReader(nil))
+	return err
+}
+
+// DeleteSLO deletes a static large object's manifest and its segments.
+func (c *Client) DeleteSLO(ctx context.Context, container, obj string, headers http.Header) error {
+	_, err := c.doHeaders(ctx, "DELETE", container, obj, url.Values{"multipart-manifest": {"delete"}}, headers, nil)
+	return err
+}
@@ -0,0 +1,182 @@
+package sdk
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// ContainerInfo is a container in an account's listing, or just a Subdir
+// when listing with a delimiter.
+type ContainerInfo struct {
+	Name         string `json:"name"`
+	Count        int64  `json:"count"`
+	Bytes        int64  `json:"bytes"`
+	LastModified string `json:"last_modified"`
+	Subdir       string `json:"subdir"`
+}
+
+// ObjectInfo is an object in a container's listing, or just a Subdir when
+// listing with a delimiter.
+type ObjectInfo struct {
+	Name         string `json:"name"`
+	Bytes        int64  `json:"bytes"`
+	Hash         string `json:"hash"`
+	ContentType  string `json:"content_type"`
+	LastModified string `json:"last_modified"`
+	Subdir       string `json:"subdir"`
+}
+
+// ListOptions narrow a listing. PageSize is how many are asked for at a
+// time, with the server's limit if it's 0.
+type ListOptions struct {
+	Prefix    string
+	Delimiter string
+	Marker    string
+	EndMarker string
+	PageSize  int
+}
+
+func (o ListOptions) query(marker string) url.Values {
+	q := url.Values{"format": {"json"}}
+	for k, v := range map[string]string{"prefix": o.Prefix, "delimiter": o.Delimiter, "marker": marker, "end_marker": o.EndMarker} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	if o.PageSize > 0 {
+		q.Set("limit", strconv.Itoa(o.PageSize))
+	}
+	return q
+}
+
+// listPage gets one page of the account's listing, or the container's if
+// container isn't empty, into page.
+func (c *Client) listPage(ctx context.Context, container string, q url.Values, page interface{}) error {
+	resp, err := c.do(ctx, "GET", container, "", q, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(page)
+}
+
+// ContainerIterator goes through an account's containers, getting them a
+// page at a time:
+//
+//	it := c.Containers(ctx, sdk.ListOptions{})
+//	for it.Next() {
+//		fmt.Println(it.Container().Name)
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type ContainerIterator struct {
+	c       *Client
+	ctx     context.Context
+	opts    ListOptions
+	marker  string
+	page    []ContainerInfo
+	current ContainerInfo
+	done    bool
+	err     error
+}
+
+// Containers returns an iterator over the account's containers.
+func (c *Client) Containers(ctx context.Context, opts ListOptions) *ContainerIterator {
+	return &ContainerIterator{c: c, ctx: ctx, opts: opts, marker: opts.Marker}
+}
+
+// Next moves on to the next container, and reports whether there was one.
+func (it *ContainerIterator) Next() bool {
+	for len(it.page) == 0 {
+		if it.done || it.err != nil {
+			return false
+		}
+		var page []ContainerInfo
+		if it.err = it.c.listPage(it.ctx, "", it.opts.query(it.marker), &page); it.err != nil {
+			return false
+		}
+		if len(page) == 0 {
+			it.done = true
+			return false
+		}
+		last := page[len(page)-1]
+		it.marker = last.Name
+		if last.Subdir != "" {
+			it.marker = last.Subdir
+		}
+		it.page = page
+	}
+	it.current, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+// Container returns the container Next moved to.
+func (it *ContainerIterator) Container() ContainerInfo {
+	return it.current
+}
+
+// Err returns the error that stopped the iterator, if one did.
+func (it *ContainerIterator) Err() error {
+	return it.err
+}
+
+// ObjectIterator goes through a container's objects, getting them a page at
+// a time, the same way as a ContainerIterator.
+type ObjectIterator struct {
+	c         *Client
+	ctx       context.Context
+	container string
+	opts      ListOptions
+	marker    string
+	page      []ObjectInfo
+	current   ObjectInfo
+	done      bool
+	err       error
+}
+
+// Objects returns an iterator over the container's objects.
+func (c *Client) Objects(ctx context.Context, container string, opts ListOptions) *ObjectIterator {
+	return &ObjectIterator{c: c, ctx: ctx, container: container, opts: opts, marker: opts.Marker}
+}
+
+// Next moves on to the next object, and reports whether there was one.
+func (it *ObjectIterator) Next() bool {
+	for len(it.page) == 0 {
+		if it.done || it.err != nil {
+			return false
+		}
+		var page []ObjectInfo
+		if it.err = it.c.listPage(it.ctx, it.container, it.opts.query(it.marker), &page); it.err != nil {
+			return false
+		}
+		if len(page) == 0 {
+			it.done = true
+			return false
+		}
+		last := page[len(page)-1]
+		it.marker = last.Name
+		if last.Subdir != "" {
+			it.marker = last.Subdir
+		}
+		it.page = page
+	}
+	it.current, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+// Object returns the object Next moved to.
+func (it *ObjectIterator) Object() ObjectInfo {
+	return it.current
+}
+
+// Err returns the error that stopped the iterator, if one did.
+func (it *ObjectIterator) Err() error {
+	return it.err
+}
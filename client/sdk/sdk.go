@@ -0,0 +1,254 @@
+// Package sdk is a client for the Swift API that Hummingbird's proxy serves,
+// for Go programs that store things in a cluster. It authenticates with
+// tempauth or Keystone, getting a new token when the old one expires or is
+// rejected, retries failed requests, lists containers and objects a page at
+// a time, and uploads large objects in parallel segments.
+package sdk
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+)
+
+// StatusError is returned for a response that wasn't a success.
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s %s: %d %s", e.Method, e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// IsNotFound reports whether err is a 404.
+func IsNotFound(err error) bool {
+	se, ok := err.(*StatusError)
+	return ok && se.StatusCode == http.StatusNotFound
+}
+
+// Client makes requests to one account, as whoever its Authenticator
+// authenticates as.
+type Client struct {
+	HTTPClient common.HTTPClient
+	Auth       Authenticator
+	// Retries is how many more times a request is tried after it couldn't
+	// be sent or got a server error, waiting RetryDelay before the first
+	// retry and twice as long before each one after that. Requests with
+	// bodies that can't be rewound aren't retried.
+	Retries    int
+	RetryDelay time.Duration
+	UserAgent  string
+
+	lock       sync.Mutex
+	token      string
+	storageURL string
+	expires    time.Time
+}
+
+// NewClient returns a Client that authenticates with auth.
+func NewClient(auth Authenticator) *Client {
+	return &Client{
+		HTTPClient: &http.Client{Timeout: 10 * time.Minute},
+		Auth:       auth,
+		Retries:    3,
+		RetryDelay: 250 * time.Millisecond,
+		UserAgent:  "hummingbird-sdk",
+	}
+}
+
+// Tokens are renewed this long before they say they expire.
+const tokenRenewBefore = 30 * time.Second
+
+// auth returns the current token and storage URL, authenticating if there
+// isn't one or it's about to expire, or if it's the one that was rejected.
+func (c *Client) auth(ctx context.Context, rejected string) (string, string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.token != "" && c.token != rejected && (c.expires.IsZero() || time.Until(c.expires) > tokenRenewBefore) {
+		return c.token, c.storageURL, nil
+	}
+	token, storageURL, expires, err := c.Auth.Authenticate(ctx, c.HTTPClient)
+	if err != nil {
+		return "", "", err
+	}
+	c.token, c.storageURL, c.expires = token, strings.TrimSuffix(storageURL, "/"), expires
+	return c.token, c.storageURL, nil
+}
+
+// StorageURL returns the URL of the account the client uses.
+func (c *Client) StorageURL(ctx context.Context) (string, error) {
+	_, storageURL, err := c.auth(ctx, "")
+	return storageURL, err
+}
+
+func itemPath(container, obj string) string {
+	p := ""
+	if container != "" {
+		p += "/" + common.Urlencode(container)
+	}
+	if obj != "" {
+		p += "/" + common.Urlencode(obj)
+	}
+	return p
+}
+
+// do sends the request for the container or object, retrying as the client
+// allows, and returns the response if it was a success, which the caller has
+// to close.
+func (c *Client) do(ctx context.Context, method, container, obj string, query url.Values, headers http.Header, body io.Reader) (*http.Response, error) {
+	seeker, rewindable := body.(io.Seeker)
+	if body == nil {
+		rewindable = true
+	}
+	delay := c.RetryDelay
+	rejected := ""
+	reauthed := false
+	for attempt, sent := 0, false; ; attempt++ {
+		if sent && seeker != nil {
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+		}
+		token, storageURL, err := c.auth(ctx, rejected)
+		if err != nil {
+			return nil, err
+		}
+		u := storageURL + itemPath(container, obj)
+		if len(query) > 0 {
+			u += "?" + query.Encode()
+		}
+		req, err := http.NewRequest(method, u, body)
+		if err != nil {
+			return nil, err
+		}
+		if body != nil && req.Body != http.NoBody {
+			// Sending closes the body, which would stop it being retried.
+			req.Body = ioutil.NopCloser(body)
+		}
+		req = req.WithContext(ctx)
+		for k, v := range headers {
+			req.Header[k] = v
+		}
+		req.Header.Set("X-Auth-Token", token)
+		if c.UserAgent != "" {
+			req.Header.Set("User-Agent", c.UserAgent)
+		}
+		resp, err := c.HTTPClient.Do(req)
+		sent = true
+		if err == nil && resp.StatusCode/100 == 2 {
+			return resp, nil
+		}
+		status := 0
+		if err == nil {
+			status = resp.StatusCode
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		// A rejected token is renewed and the request tried again, once,
+		// without counting as a retry.
+		if status == http.StatusUnauthorized && rewindable && !reauthed {
+			rejected, reauthed = token, true
+			attempt--
+			continue
+		}
+		retryable := err != nil || (status/100 == 5 && status != http.StatusInsufficientStorage)
+		if !retryable || !rewindable || attempt >= c.Retries || ctx.Err() != nil {
+			if err != nil {
+				return nil, err
+			}
+			return nil, &StatusError{Method: method, URL: u, StatusCode: status}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// doHeaders sends the request and returns the response's headers.
+func (c *Client) doHeaders(ctx context.Context, method, container, obj string, query url.Values, headers http.Header, body io.Reader) (http.Header, error) {
+	resp, err := c.do(ctx, method, container, obj, query, headers, body)
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.Header, nil
+}
+
+// HeadAccount returns the account's metadata.
+func (c *Client) HeadAccount(ctx context.Context, headers http.Header) (http.Header, error) {
+	return c.doHeaders(ctx, "HEAD", "", "", nil, headers, nil)
+}
+
+// PostAccount sets the account's metadata.
+func (c *Client) PostAccount(ctx context.Context, headers http.Header) error {
+	_, err := c.doHeaders(ctx, "POST", "", "", nil, headers, nil)
+	return err
+}
+
+// PutContainer creates the container, or updates its metadata if it's
+// already there.
+func (c *Client) PutContainer(ctx context.Context, container string, headers http.Header) error {
+	_, err := c.doHeaders(ctx, "PUT", container, "", nil, headers, nil)
+	return err
+}
+
+// HeadContainer returns the container's metadata.
+func (c *Client) HeadContainer(ctx context.Context, container string, headers http.Header) (http.Header, error) {
+	return c.doHeaders(ctx, "HEAD", container, "", nil, headers, nil)
+}
+
+// PostContainer sets the container's metadata.
+func (c *Client) PostContainer(ctx context.Context, container string, headers http.Header) error {
+	_, err := c.doHeaders(ctx, "POST", container, "", nil, headers, nil)
+	return err
+}
+
+// DeleteContainer deletes the container, which has to be empty.
+func (c *Client) DeleteContainer(ctx context.Context, container string, headers http.Header) error {
+	_, err := c.doHeaders(ctx, "DELETE", container, "", nil, headers, nil)
+	return err
+}
+
+// PutObject uploads the object, returning the response's headers, which
+// have its Etag. Bodies that are an io.Seeker, like a *bytes.Reader or an
+// *os.File, can be retried.
+func (c *Client) PutObject(ctx context.Context, container, obj string, headers http.Header, body io.Reader) (http.Header, error) {
+	return c.doHeaders(ctx, "PUT", container, obj, nil, headers, body)
+}
+
+// GetObject returns the object, whose body the caller has to close.
+func (c *Client) GetObject(ctx context.Context, container, obj string, headers http.Header) (*http.Response, error) {
+	return c.do(ctx, "GET", container, obj, nil, headers, nil)
+}
+
+// HeadObject returns the object's metadata.
+func (c *Client) HeadObject(ctx context.Context, container, obj string, headers http.Header) (http.Header, error) {
+	return c.doHeaders(ctx, "HEAD", container, obj, nil, headers, nil)
+}
+
+// PostObject sets the object's metadata.
+func (c *Client) PostObject(ctx context.Context, container, obj string, headers http.Header) error {
+	_, err := c.doHeaders(ctx, "POST", container, obj, nil, headers, nil)
+	return err
+}
+
+// DeleteObject deletes the object. For a static large object that's only
+// the manifest; DeleteSLO deletes its segments too.
+func (c *Client) DeleteObject(ctx context.Context, container, obj string, headers http.Header) error {
+	_, err := c.doHeaders(ctx, "DELETE", container, obj, nil, headers, nil)
+	return err
+}
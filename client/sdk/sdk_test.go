@@ -0,0 +1,194 @@
+package sdk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSwift is just enough of a proxy to test the client against: tempauth,
+// and containers of objects kept in memory.
+type fakeSwift struct {
+	lock      sync.Mutex
+	tokens    int
+	token     string
+	failures  int
+	objects   map[string][]byte
+	headers   map[string]http.Header
+	manifests map[string]string
+}
+
+func (f *fakeSwift) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if r.URL.Path == "/auth/v1.0" {
+		if r.Header.Get("X-Auth-User") != "test:tester" || r.Header.Get("X-Auth-Key") != "testing" {
+			w.WriteHeader(401)
+			return
+		}
+		f.tokens++
+		f.token = fmt.Sprintf("AUTH_tk%d", f.tokens)
+		w.Header().Set("X-Auth-Token", f.token)
+		w.Header().Set("X-Storage-Url", "http://"+r.Host+"/v1/AUTH_test")
+		return
+	}
+	if r.Header.Get("X-Auth-Token") != f.token {
+		w.WriteHeader(401)
+		return
+	}
+	if f.failures > 0 {
+		f.failures--
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(503)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/v1/AUTH_test/")
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) == 1 {
+		switch r.Method {
+		case "PUT":
+			w.WriteHeader(201)
+		case "GET":
+			var names []string
+			for name := range f.objects {
+				if strings.HasPrefix(name, parts[0]+"/") && strings.HasPrefix(name[len(parts[0])+1:], r.URL.Query().Get("prefix")) && name[len(parts[0])+1:] > r.URL.Query().Get("marker") {
+					names = append(names, name[len(parts[0])+1:])
+				}
+			}
+			sort.Strings(names)
+			if limit, _ := strconv.Atoi(r.URL.Query().Get("limit")); limit > 0 && len(names) > limit {
+				names = names[:limit]
+			}
+			listing := []ObjectInfo{}
+			for _, name := range names {
+				listing = append(listing, ObjectInfo{Name: name, Bytes: int64(len(f.objects[parts[0]+"/"+name]))})
+			}
+			json.NewEncoder(w).Encode(listing)
+		default:
+			w.WriteHeader(405)
+		}
+		return
+	}
+	switch r.Method {
+	case "PUT":
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Query().Get("multipart-manifest") == "put" {
+			f.manifests[path] = string(body)
+		}
+		f.objects[path] = body
+		f.headers[path] = r.Header
+		w.WriteHeader(201)
+	case "GET":
+		if body, ok := f.objects[path]; ok {
+			w.Write(body)
+		} else {
+			w.WriteHeader(404)
+		}
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+func TestClient(t *testing.T) {
+	f := &fakeSwift{objects: map[string][]byte{}, headers: map[string]http.Header{}, manifests: map[string]string{}}
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+	c := NewClient(&TempAuth{URL: ts.URL + "/auth/v1.0", User: "test:tester", Key: "testing"})
+	c.RetryDelay = time.Millisecond
+	ctx := context.Background()
+
+	require.Nil(t, c.PutContainer(ctx, "c", nil))
+	// Server errors are retried, with the body sent again.
+	f.failures = 2
+	_, err := c.PutObject(ctx, "c", "o 1", nil, strings.NewReader("hello"))
+	require.Nil(t, err)
+	require.Equal(t, "hello", string(f.objects["c/o 1"]))
+	// An expired token is replaced without the caller seeing it.
+	f.token = "AUTH_tkrevoked"
+	resp, err := c.GetObject(ctx, "c", "o 1", nil)
+	require.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Equal(t, "hello", string(body))
+	require.Equal(t, 2, f.tokens)
+	_, err = c.GetObject(ctx, "c", "missing", nil)
+	require.True(t, IsNotFound(err))
+
+	for i := 0; i < 5; i++ {
+		_, err = c.PutObject(ctx, "c", fmt.Sprintf("p%d", i), nil, strings.NewReader("x"))
+		require.Nil(t, err)
+	}
+	it := c.Objects(ctx, "c", ListOptions{Prefix: "p", PageSize: 2})
+	var names []string
+	for it.Next() {
+		names = append(names, it.Object().Name)
+	}
+	require.Nil(t, it.Err())
+	require.Equal(t, []string{"p0", "p1", "p2", "p3", "p4"}, names)
+
+	data := bytes.Repeat([]byte("0123456789"), 25)
+	require.Nil(t, c.PutSLO(ctx, "c", "big", bytes.NewReader(data), LargeObjectOptions{SegmentSize: 100, Concurrency: 2, Headers: http.Header{"Content-Type": {"text/plain"}}}))
+	var manifest []sloSegment
+	require.Nil(t, json.Unmarshal([]byte(f.manifests["c/big"]), &manifest))
+	require.Equal(t, 3, len(manifest))
+	var joined []byte
+	for i, seg := range manifest {
+		segData := f.objects[strings.TrimPrefix(seg.Path, "/")]
+		require.Equal(t, seg.SizeBytes, int64(len(segData)))
+		require.True(t, strings.HasPrefix(seg.Path, "/c_segments/big/slo/"))
+		require.True(t, strings.HasSuffix(seg.Path, fmt.Sprintf("%08d", i)))
+		joined = append(joined, segData...)
+	}
+	require.Equal(t, data, joined)
+	require.Equal(t, "text/plain", f.headers["c/big"].Get("Content-Type"))
+
+	require.Nil(t, c.PutDLO(ctx, "c", "dyn", bytes.NewReader(data), LargeObjectOptions{SegmentSize: 200, SegmentContainer: "segs"}))
+	prefix := f.headers["c/dyn"].Get("X-Object-Manifest")
+	require.True(t, strings.HasPrefix(prefix, "segs/dyn/dlo/"))
+	require.Equal(t, data[:200], f.objects[prefix+"00000000"])
+	require.Equal(t, data[200:], f.objects[prefix+"00000001"])
+}
+
+func TestKeystone(t *testing.T) {
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v3/auth/tokens", r.URL.Path)
+		var req keystoneAuthRequest
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&req))
+		if req.Auth.Identity.Password.User.Password != "secret" {
+			w.WriteHeader(401)
+			return
+		}
+		require.Equal(t, "default", req.Auth.Identity.Password.User.Domain.ID)
+		w.Header().Set("X-Subject-Token", "ks-token")
+		w.WriteHeader(201)
+		fmt.Fprintf(w, `{"token": {"expires_at": %q, "catalog": [
+			{"type": "identity", "endpoints": [{"interface": "public", "region": "east", "url": "http://keystone"}]},
+			{"type": "object-store", "endpoints": [
+				{"interface": "internal", "region": "east", "url": "http://internal/v1/AUTH_p"},
+				{"interface": "public", "region": "west", "url": "http://west/v1/AUTH_p"},
+				{"interface": "public", "region": "east", "url": "http://east/v1/AUTH_p"}]}]}}`, expires.Format(time.RFC3339))
+	}))
+	defer ts.Close()
+	ks := &Keystone{URL: ts.URL + "/", Username: "u", Password: "secret", ProjectName: "p", Region: "east"}
+	token, storageURL, exp, err := ks.Authenticate(context.Background(), http.DefaultClient)
+	require.Nil(t, err)
+	require.Equal(t, "ks-token", token)
+	require.Equal(t, "http://east/v1/AUTH_p", storageURL)
+	require.True(t, expires.Equal(exp))
+	ks.Password = "wrong"
+	_, _, _, err = ks.Authenticate(context.Background(), http.DefaultClient)
+	require.Equal(t, 401, err.(*StatusError).StatusCode)
+}
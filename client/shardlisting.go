@@ -0,0 +1,209 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/nectar/nectarutil"
+)
+
+// shardListingObject is an object in a shard's JSON listing, and how it's
+// written in an XML one.
+type shardListingObject struct {
+	XMLName       xml.Name `xml:"object" json:"-"`
+	Name          string   `xml:"name" json:"name"`
+	LastModified  string   `xml:"last_modified" json:"last_modified"`
+	Bytes         int64    `xml:"bytes" json:"bytes"`
+	ContentType   string   `xml:"content_type" json:"content_type"`
+	Hash          string   `xml:"hash" json:"hash"`
+	StorageClass  string   `xml:"storage_class,omitempty" json:"storage_class,omitempty"`
+	SymlinkPath   string   `xml:"symlink_path,omitempty" json:"symlink_path,omitempty"`
+	StoragePolicy string   `xml:"storage_policy,omitempty" json:"storage_policy,omitempty"`
+	Subdir        string   `xml:"-" json:"subdir"`
+}
+
+type shardListingSubdir struct {
+	XMLName xml.Name `xml:"subdir"`
+	Name2   string   `xml:"name,attr"`
+	Name    string   `xml:"name"`
+}
+
+// shardOutOfBounds returns true if none of the names the listing wants can
+// be in the range.
+func shardOutOfBounds(r *common.ShardRange, marker, endMarker, prefix string, reverse bool) bool {
+	// A reverse listing's marker is its upper bound and its end marker its lower.
+	if reverse {
+		marker, endMarker = endMarker, marker
+	}
+	if endMarker != "" && r.Lower >= endMarker {
+		return true
+	}
+	if marker != "" && r.Upper != "" && r.Upper <= marker {
+		return true
+	}
+	if prefix != "" {
+		if r.Upper != "" && r.Upper < prefix {
+			return true
+		}
+		if r.Lower >= prefix && !strings.HasPrefix(r.Lower, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeShardListings lists a sharded container by listing its shards in
+// turn, given the root's response with their ranges, and writes the result
+// in the format the request asked for.
+func (c *requestClient) mergeShardListings(ctx context.Context, container string, options map[string]string, headers http.Header, resp *http.Response) *http.Response {
+	var ranges []*common.ShardRange
+	err := json.NewDecoder(resp.Body).Decode(&ranges)
+	resp.Body.Close()
+	if err != nil {
+		return nectarutil.ResponseStub(http.StatusInternalServerError, err.Error())
+	}
+	common.SortShardRanges(ranges)
+	reverse := common.LooksTrue(options["reverse"])
+	if reverse {
+		for i, j := 0, len(ranges)-1; i < j; i, j = i+1, j-1 {
+			ranges[i], ranges[j] = ranges[j], ranges[i]
+		}
+	}
+	limit := 10000
+	if l, err := strconv.Atoi(options["limit"]); err == nil && l >= 0 && l < limit {
+		limit = l
+	}
+	shardHeaders := http.Header{}
+	for k, v := range headers {
+		shardHeaders[k] = v
+	}
+	shardHeaders.Del("X-Backend-Record-Type")
+	shardHeaders.Del("Accept")
+	var raws []json.RawMessage
+	var entries []*shardListingObject
+	last := ""
+	for _, r := range ranges {
+		if len(entries) >= limit {
+			break
+		}
+		if shardOutOfBounds(r, options["marker"], options["end_marker"], options["prefix"], reverse) {
+			continue
+		}
+		shardOptions := map[string]string{}
+		for k, v := range options {
+			shardOptions[k] = v
+		}
+		shardOptions["format"] = "json"
+		shardOptions["limit"] = strconv.Itoa(limit - len(entries))
+		if last != "" {
+			shardOptions["marker"] = last
+		}
+		shardResp := c.getContainerRaw(ctx, r.Account, r.Container, shardOptions, shardHeaders)
+		var listing []json.RawMessage
+		if shardResp.StatusCode/100 == 2 {
+			err = json.NewDecoder(shardResp.Body).Decode(&listing)
+		}
+		shardResp.Body.Close()
+		if shardResp.StatusCode/100 != 2 || err != nil {
+			return nectarutil.ResponseStub(http.StatusServiceUnavailable, "")
+		}
+		for _, raw := range listing {
+			entry := &shardListingObject{}
+			if err := json.Unmarshal(raw, entry); err != nil {
+				return nectarutil.ResponseStub(http.StatusInternalServerError, err.Error())
+			}
+			name := entry.Name
+			if entry.Subdir != "" {
+				name = entry.Subdir
+			}
+			// A subdir can span shards, but is only listed once.
+			if last != "" && ((!reverse && name <= last) || (reverse && name >= last)) {
+				continue
+			}
+			raws = append(raws, raw)
+			entries = append(entries, entry)
+			last = name
+			if len(entries) >= limit {
+				break
+			}
+		}
+	}
+
+	format := options["format"]
+	if format == "" {
+		accept := headers.Get("Accept")
+		if strings.Contains(accept, "application/json") {
+			format = "json"
+		} else if strings.Contains(accept, "application/xml") || strings.Contains(accept, "text/xml") {
+			format = "xml"
+		} else {
+			format = "text"
+		}
+	}
+	var body []byte
+	status := http.StatusOK
+	contentType := "text/plain; charset=utf-8"
+	switch format {
+	case "json":
+		contentType = "application/json; charset=utf-8"
+		buf := &bytes.Buffer{}
+		buf.WriteByte('[')
+		for i, raw := range raws {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.Write(raw)
+		}
+		buf.WriteByte(']')
+		body = buf.Bytes()
+	case "xml":
+		contentType = "application/xml; charset=utf-8"
+		type Container struct {
+			XMLName xml.Name `xml:"container"`
+			Name    string   `xml:"name,attr"`
+			Objects []interface{}
+		}
+		objects := []interface{}{}
+		for _, entry := range entries {
+			if entry.Subdir != "" {
+				objects = append(objects, &shardListingSubdir{Name: entry.Subdir, Name2: entry.Subdir})
+			} else {
+				objects = append(objects, entry)
+			}
+		}
+		output, err := xml.Marshal(&Container{Name: container, Objects: objects})
+		if err != nil {
+			return nectarutil.ResponseStub(http.StatusInternalServerError, err.Error())
+		}
+		body = append([]byte("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n"), output...)
+	default:
+		for _, entry := range entries {
+			if entry.Subdir != "" {
+				body = append(body, entry.Subdir+"\n"...)
+			} else {
+				body = append(body, entry.Name+"\n"...)
+			}
+		}
+		if len(body) == 0 {
+			status = http.StatusNoContent
+		}
+	}
+	merged := nectarutil.ResponseStub(status, "")
+	for k, v := range resp.Header {
+		if k != "Content-Length" && k != "Content-Type" && k != "X-Backend-Record-Type" {
+			merged.Header[k] = v
+		}
+	}
+	merged.Header.Set("Content-Type", contentType)
+	merged.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	merged.ContentLength = int64(len(body))
+	merged.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return merged
+}
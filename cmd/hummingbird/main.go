@@ -110,6 +110,7 @@ func startServer(name string, args ...string) error {
 	errfile := filepath.Join(logPath, name+".err")
 	cmd := exec.Command(serverExecutable, append([]string{name, "-c", serverConf, "-l", logfile, "-e", errfile}, args...)...)
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	cmd.Env = append(os.Environ(), "HUMMINGBIRD_PID_FILE="+filepath.Join(runPath, fmt.Sprintf("%s.pid", name)))
 	if uint32(os.Getuid()) != uid { // This is goofy.
 		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uid, Gid: gid}
 	}
@@ -169,6 +170,37 @@ func gracefulRestartServer(name string, args ...string) error {
 	return startServer(name, args...)
 }
 
+// reloadServer has a server hand its sockets to a new process, which takes
+// over as the old one finishes the requests it has in progress. Replicators
+// and andrewd don't serve requests that need to carry on, so they're just
+// restarted gracefully.
+func reloadServer(name string, args ...string) error {
+	if strings.HasSuffix(name, "-replicator") || name == "andrewd" {
+		return gracefulRestartServer(name, args...)
+	}
+	process, err := getProcess(name)
+	if err != nil {
+		return errors.New(strings.Title(name) + " server not found.")
+	}
+	defer process.Release()
+	if err := process.Signal(syscall.SIGUSR2); err != nil {
+		return errors.New("Error signaling " + name + " server: " + err.Error())
+	}
+	// The replacement only records its pid once it's ready, which the server
+	// waits up to a minute for.
+	for i := 0; i < 700; i++ {
+		time.Sleep(time.Second / 10)
+		if replacement, err := getProcess(name); err == nil {
+			replacement.Release()
+			if replacement.Pid != process.Pid {
+				fmt.Println(strings.Title(name), "server reloaded.")
+				return nil
+			}
+		}
+	}
+	return errors.New(strings.Title(name) + " server didn't reload.")
+}
+
 func gracefulShutdownServer(name string, args ...string) error {
 	process, err := getProcess(name)
 	if err != nil {
@@ -328,10 +360,15 @@ func main() {
 		fmt.Fprintf(os.Stderr, "    validate (validate ring)\n")
 		fmt.Fprintf(os.Stderr, "    write_ring (write the ring file)\n")
 		fmt.Fprintf(os.Stderr, "    pretend_min_part_hours_passed (reset min_part_hours)\n")
+		fmt.Fprintf(os.Stderr, "    set_overload <overload>[%%] (set the overload factor, as a fraction or a percentage)\n")
+		fmt.Fprintf(os.Stderr, "    set_replicas <replicas> (change the replica count, taking effect on the next rebalance)\n")
+		fmt.Fprintf(os.Stderr, "    set_min_part_hours <hours> (change min_part_hours)\n")
+		fmt.Fprintf(os.Stderr, "    check [-certfile <file> -keyfile <file>] (check the ring file against the builder and the servers in it)\n")
+		fmt.Fprintf(os.Stderr, "    compose <component_ring_file>... (write a ring, named in place of the builder file, made of per-region component rings)\n")
 		fmt.Fprintf(os.Stderr, "  <device> is of the form: [r<region>]z<zone>[s<scheme>]-<ip>:<port>[R<r_ip>:<r_port>]/<device_name>_<meta>\n")
 		fmt.Fprintf(os.Stderr, "  <scheme> can be either http or https\n")
 		fmt.Fprintf(os.Stderr, "  <search_flags> is at least one of: -region, -zone, -scheme, -ip, -port, -replication-ip, replication-port, -device, -meta, -weight\n")
-		fmt.Fprintf(os.Stderr, "  <change_flags> is at least one of: -change-ip, -change-port, -change-replication-ip, -change-replication-port, -change-device, -change-meta, -change-scheme\n")
+		fmt.Fprintf(os.Stderr, "  <change_flags> is at least one of: -change-ip, -change-port, -change-replication-ip, -change-replication-port, -change-device, -change-meta, -change-scheme, -change-disk-type, -change-capacity, -change-labels\n")
 		ringBuilderFlags.PrintDefaults()
 	}
 
@@ -371,11 +408,60 @@ func main() {
 	objectInfoFlags := flag.NewFlagSet("", flag.ExitOnError)
 	objectInfoFlags.Bool("n", false, "Don't verify file contents against stored etag")
 	objectInfoFlags.String("P", "", "Specify which policy to use")
+	objectInfoFlags.String("certfile", "", "Cert file to use for setting up https client")
+	objectInfoFlags.String("keyfile", "", "Key file to use for setting up https client")
 	objectInfoFlags.Usage = func() {
-		fmt.Fprintf(os.Stderr, "hummingbird oinfo [ARGS] OBJECT_FILE\n")
+		fmt.Fprintf(os.Stderr, "hummingbird oinfo [ARGS] OBJECT_FILE | ACCOUNT/CONTAINER/OBJECT | URL\n")
+		fmt.Fprintf(os.Stderr, "  Shows an object file's metadata, or what each of an object's nodes has for it\n")
+		fmt.Fprintf(os.Stderr, "  and where they disagree.\n")
 		objectInfoFlags.PrintDefaults()
 	}
 
+	containerInfoFlags := flag.NewFlagSet("", flag.ExitOnError)
+	containerInfoFlags.String("certfile", "", "Cert file to use for setting up https client")
+	containerInfoFlags.String("keyfile", "", "Key file to use for setting up https client")
+	containerInfoFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "hummingbird cinfo [ARGS] ACCOUNT/CONTAINER | URL\n")
+		fmt.Fprintf(os.Stderr, "  Shows what each of a container's nodes has for it and where they disagree.\n")
+		containerInfoFlags.PrintDefaults()
+	}
+
+	accountInfoFlags := flag.NewFlagSet("", flag.ExitOnError)
+	accountInfoFlags.String("certfile", "", "Cert file to use for setting up https client")
+	accountInfoFlags.String("keyfile", "", "Key file to use for setting up https client")
+	accountInfoFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "hummingbird ainfo [ARGS] ACCOUNT | URL\n")
+		fmt.Fprintf(os.Stderr, "  Shows what each of an account's nodes has for it and where they disagree.\n")
+		accountInfoFlags.PrintDefaults()
+	}
+
+	repairFlags := flag.NewFlagSet("", flag.ExitOnError)
+	repairFlags.Bool("a", false, "Check all handoff nodes, not just as many as there are replicas")
+	repairFlags.Bool("n", false, "Only show what would be done")
+	repairFlags.String("P", "", "Specify which policy to use, rather than the container's")
+	repairFlags.String("certfile", "", "Cert file to use for setting up https client")
+	repairFlags.String("keyfile", "", "Key file to use for setting up https client")
+	repairFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "hummingbird repair [ARGS] ACCOUNT/CONTAINER/OBJECT | URL\n")
+		fmt.Fprintf(os.Stderr, "  Copies the newest version of an object, or its tombstone, to the primary nodes\n")
+		fmt.Fprintf(os.Stderr, "  missing it or with an older one, then removes handoff copies.\n")
+		repairFlags.PrintDefaults()
+	}
+
+	quarantineFlags := flag.NewFlagSet("", flag.ExitOnError)
+	quarantineFlags.Bool("json", false, "Output the list in JSON format")
+	quarantineFlags.String("o", "", "File to download the item to, rather than its name on the device")
+	quarantineFlags.String("token", "", "Admin token to send, for servers with admin_tokens set")
+	quarantineFlags.String("certfile", "", "Cert file to use for setting up https client")
+	quarantineFlags.String("keyfile", "", "Key file to use for setting up https client")
+	quarantineFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "hummingbird quarantine [ARGS] list | get ITEM | restore ITEM | purge ITEM\n")
+		fmt.Fprintf(os.Stderr, "  Lists what's quarantined across the cluster, downloads an item for inspection,\n")
+		fmt.Fprintf(os.Stderr, "  puts it back, or moves it to the quarantine history for andrewd to purge.\n")
+		fmt.Fprintf(os.Stderr, "  ITEM is ip:port/device/type/name, as list shows them.\n")
+		quarantineFlags.PrintDefaults()
+	}
+
 	reconFlags := flag.NewFlagSet("", flag.ExitOnError)
 	reconFlags.Bool("progress", false, "Show andrewd progress report; state of internal processes")
 	reconFlags.Bool("md5", false, "Get md5sum of servers ring and compare to local copy")
@@ -386,10 +472,16 @@ func main() {
 	reconFlags.Bool("rd", false, "Get cluster replication pass duration stats")
 	reconFlags.Bool("rp", false, "Get cluster replication partition/sec stats")
 	reconFlags.Bool("rc", false, "List all drives with replicator cancellations")
+	reconFlags.Bool("rl", false, "List all drives that haven't finished a replication pass within -lag-limit")
+	reconFlags.Bool("au", false, "Get cluster object auditor stats and progress")
+	reconFlags.Bool("health", false, "Run the async, replication lag, auditor, quarantine, time and ring md5 reports together")
+	reconFlags.Duration("lag-limit", 24*time.Hour, "How long since a drive finished a replication pass before it's lagging")
 	reconFlags.Bool("d", false, "Show last dispersion report")
 	reconFlags.Bool("ds", false, "Show device status report")
 	reconFlags.Bool("rar", false, "Show andrewd ring action report")
 	reconFlags.Bool("rbr", false, "Show andrewd ring balance report")
+	reconFlags.Bool("wi", false, "Show andrewd's open work items, like failed disks to replace")
+	reconFlags.Bool("topo", false, "Export object ring topology, utilization and replication health as Graphviz dot")
 	reconFlags.String("c", findConfig("andrewd"), "Andrewd Config file to use (e.g. for dispersion)")
 	reconFlags.Bool("json", false, "Output in json. {\"ok\": true|false, \"msg\": \"text-output\"}")
 	reconFlags.String("certfile", "", "Cert file to use for setting up https client")
@@ -399,6 +491,17 @@ func main() {
 		reconFlags.PrintDefaults()
 	}
 
+	tempURLFlags := flag.NewFlagSet("tempurl", flag.ExitOnError)
+	tempURLFlags.String("digest", "sha256", "Digest to sign with: sha1, sha256 or sha512")
+	tempURLFlags.String("ip-range", "", "Only allow clients from this address or CIDR range")
+	tempURLFlags.Bool("prefix", false, "Allow any object whose name starts with the path's object part")
+	tempURLFlags.Bool("absolute", false, "Treat seconds as a unix time to expire at, rather than from now")
+	tempURLFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "hummingbird tempurl [ARGS] <method> <seconds> </v1/account/container/object> <key>\n")
+		fmt.Fprintf(os.Stderr, "  Print a temporary URL signed with an account or container's temp url key\n")
+		tempURLFlags.PrintDefaults()
+	}
+
 	/* main flag parser, which doesn't do much */
 
 	flag.Usage = func() {
@@ -409,7 +512,8 @@ func main() {
 		fmt.Fprintln(os.Stderr, "     hummingbird start [daemon name]    -- start a server")
 		fmt.Fprintln(os.Stderr, "     hummingbird stop [daemon name]     -- stop a server immediately")
 		fmt.Fprintln(os.Stderr, "     hummingbird shutdown [daemon name] -- gracefully stop a server")
-		fmt.Fprintln(os.Stderr, "     hummingbird reload [daemon name]   -- alias for graceful-restart")
+		fmt.Fprintln(os.Stderr, "     hummingbird reload [daemon name]   -- hand a server's sockets to a new process, without dropping requests")
+		fmt.Fprintln(os.Stderr, "     hummingbird graceful-restart [daemon name] -- gracefully stop then restart a server")
 		fmt.Fprintln(os.Stderr, "     hummingbird restart [daemon name]  -- stop then restart a server")
 		fmt.Fprintln(os.Stderr, "  The daemons are: object, proxy, object-replicator, andrewd, all, main")
 		fmt.Fprintln(os.Stderr)
@@ -427,6 +531,18 @@ func main() {
 		fmt.Fprintln(os.Stderr, "hummingbird restoredevice [ip] [device-name]")
 		fmt.Fprintln(os.Stderr, "  Reconstruct a device from its peers")
 		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "hummingbird prewarmdevice [ip] [device-name]")
+		fmt.Fprintln(os.Stderr, "  Copy a node's partitions to their handoffs before planned maintenance")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "hummingbird drain [-stop | -status] [ip] [device-name]")
+		fmt.Fprintln(os.Stderr, "  Move a device's partitions off it and report when it's safe to remove")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "hummingbird policymigrate [-status | -cutover] [account] [container] [policy]")
+		fmt.Fprintln(os.Stderr, "  Move a container's objects to another storage policy")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "hummingbird burnin [ARGS] [device ...]")
+		fmt.Fprintln(os.Stderr, "  Exercise a new node's devices and report whether they pass")
+		fmt.Fprintln(os.Stderr)
 		fmt.Fprintln(os.Stderr, "hummingbird bench CONFIG")
 		fmt.Fprintln(os.Stderr, "  Run bench tool")
 		fmt.Fprintln(os.Stderr)
@@ -457,7 +573,17 @@ func main() {
 		fmt.Fprintln(os.Stderr)
 		objectInfoFlags.Usage()
 		fmt.Fprintln(os.Stderr)
+		containerInfoFlags.Usage()
+		fmt.Fprintln(os.Stderr)
+		accountInfoFlags.Usage()
+		fmt.Fprintln(os.Stderr)
+		repairFlags.Usage()
+		fmt.Fprintln(os.Stderr)
+		quarantineFlags.Usage()
+		fmt.Fprintln(os.Stderr)
 		reconFlags.Usage()
+		fmt.Fprintln(os.Stderr)
+		tempURLFlags.Usage()
 	}
 
 	flag.Parse()
@@ -476,7 +602,9 @@ func main() {
 		processControlCommand(stopServer)
 	case "restart":
 		processControlCommand(restartServer)
-	case "reload", "graceful-restart":
+	case "reload":
+		processControlCommand(reloadServer)
+	case "graceful-restart":
 		processControlCommand(gracefulRestartServer)
 	case "shutdown", "graceful-shutdown":
 		processControlCommand(gracefulShutdownServer)
@@ -515,6 +643,18 @@ func main() {
 		objectserver.MoveParts(flag.Args()[1:], srv.DefaultConfigLoader{})
 	case "restoredevice":
 		objectserver.RestoreDevice(flag.Args()[1:], srv.DefaultConfigLoader{})
+	case "prewarmdevice":
+		objectserver.PrewarmDevice(flag.Args()[1:], srv.DefaultConfigLoader{})
+	case "drain":
+		objectserver.DrainDevice(flag.Args()[1:], srv.DefaultConfigLoader{})
+	case "policymigrate":
+		if pass := tools.PolicyMigrate(flag.Args()[1:], srv.DefaultConfigLoader{}); !pass {
+			os.Exit(1)
+		}
+	case "burnin":
+		if pass := objectserver.Burnin(flag.Args()[1:]); !pass {
+			os.Exit(1)
+		}
 	case "ring":
 		ringBuilderFlags.Parse(flag.Args()[1:])
 		tools.RingBuildCmd(ringBuilderFlags)
@@ -527,11 +667,30 @@ func main() {
 	case "oinfo":
 		objectInfoFlags.Parse(flag.Args()[1:])
 		tools.ObjectInfo(objectInfoFlags, srv.DefaultConfigLoader{})
+	case "cinfo":
+		containerInfoFlags.Parse(flag.Args()[1:])
+		tools.ContainerInfo(containerInfoFlags, srv.DefaultConfigLoader{})
+	case "ainfo":
+		accountInfoFlags.Parse(flag.Args()[1:])
+		tools.AccountInfo(accountInfoFlags, srv.DefaultConfigLoader{})
+	case "repair":
+		repairFlags.Parse(flag.Args()[1:])
+		tools.Repair(repairFlags, srv.DefaultConfigLoader{})
+	case "quarantine":
+		quarantineFlags.Parse(flag.Args()[1:])
+		if !tools.Quarantine(quarantineFlags, srv.DefaultConfigLoader{}) {
+			os.Exit(1)
+		}
 	case "recon":
 		reconFlags.Parse(flag.Args()[1:])
 		if pass := tools.ReconClient(reconFlags, srv.DefaultConfigLoader{}); !pass {
 			os.Exit(1)
 		}
+	case "tempurl":
+		tempURLFlags.Parse(flag.Args()[1:])
+		if !tools.TempURL(tempURLFlags) {
+			os.Exit(1)
+		}
 	case "init":
 		if err := initCommand(flag.Args()[1:]); err != nil {
 			fmt.Fprintln(os.Stderr, "init error:", err)
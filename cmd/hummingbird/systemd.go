@@ -17,24 +17,25 @@ func systemdCommand(args []string) error {
 	}
 	switch args[0] {
 	case "start":
-		for {
-			serverExecutable, err := exec.LookPath(os.Args[0])
-			if err != nil {
-				return fmt.Errorf("systemd unable to find executable in path: %q", os.Args[0])
+		serverExecutable, err := exec.LookPath(os.Args[0])
+		if err != nil {
+			return fmt.Errorf("systemd unable to find executable in path: %q", os.Args[0])
+		}
+		cmd := exec.Command(serverExecutable, args[1:]...)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Start()
+		sigchan := make(chan os.Signal, 1)
+		go func() {
+			if err := cmd.Wait(); err != nil {
+				fmt.Printf("systemd got error from subcommand: %s", err)
+				sigchan <- os.Kill
 			}
-			cmd := exec.Command(serverExecutable, args[1:]...)
-			cmd.Stdin = os.Stdin
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
-			cmd.Start()
-			sigchan := make(chan os.Signal, 1)
-			go func() {
-				if err := cmd.Wait(); err != nil {
-					fmt.Printf("systemd got error from subcommand: %s", err)
-					sigchan <- os.Kill
-				}
-			}()
-			signal.Notify(sigchan, syscall.SIGHUP, syscall.SIGTERM)
+		}()
+		signal.Notify(sigchan, syscall.SIGHUP, syscall.SIGTERM)
+		for {
+			// The server reloads its certificates on SIGHUP, and carries on.
 			sig := <-sigchan
 			cmd.Process.Signal(sig)
 			if sig != syscall.SIGHUP {
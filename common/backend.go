@@ -0,0 +1,261 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/uber-go/tally"
+)
+
+// ErrNodeEjected is returned for requests to a node that has been ejected
+// for its errors, without trying it.
+var ErrNodeEjected = errors.New("node ejected for errors")
+
+// ErrNodeBusy is returned for requests to a node that already has as many
+// in flight as it's allowed.
+var ErrNodeBusy = errors.New("too many requests in flight to node")
+
+// BackendConfig says how a BackendTransport treats the nodes it sends
+// requests to.
+type BackendConfig struct {
+	// MaxIdleConnsPerNode is how many connections to each node are kept for
+	// reuse.
+	MaxIdleConnsPerNode int
+	// MaxInFlightPerNode is how many requests can be in flight to each node
+	// at once, with 0 for no limit.
+	MaxInFlightPerNode int64
+	// ErrorLimit errors from a node within ErrorInterval eject it for
+	// ErrorInterval; 0 never ejects nodes.
+	ErrorLimit    int64
+	ErrorInterval time.Duration
+}
+
+var DefaultBackendConfig = BackendConfig{
+	MaxIdleConnsPerNode: 100,
+	ErrorInterval:       time.Minute,
+}
+
+// LoadBackendConfig reads the backend settings from a config section, with
+// those not set there as they are in dfl.
+func LoadBackendConfig(section interface {
+	GetInt(key string, dfl int64) int64
+	GetFloat(key string, dfl float64) float64
+}, dfl BackendConfig) BackendConfig {
+	return BackendConfig{
+		MaxIdleConnsPerNode: int(section.GetInt("backend_max_idle_conns_per_node", int64(dfl.MaxIdleConnsPerNode))),
+		MaxInFlightPerNode:  section.GetInt("backend_max_in_flight_per_node", dfl.MaxInFlightPerNode),
+		ErrorLimit:          section.GetInt("error_suppression_limit", dfl.ErrorLimit),
+		ErrorInterval:       time.Duration(section.GetFloat("error_suppression_interval", dfl.ErrorInterval.Seconds()) * float64(time.Second)),
+	}
+}
+
+type backendNode struct {
+	lock         sync.Mutex
+	inFlight     int64
+	errors       []time.Time
+	ejectedUntil time.Time
+	// probation is set once a node has been ejected, until it next answers;
+	// an error before then ejects it again.
+	probation bool
+}
+
+// BackendTransport sends requests on to next, shedding those to nodes that
+// are failing or have too many requests in flight already, so they can be
+// sent elsewhere.
+type BackendTransport struct {
+	next    http.RoundTripper
+	config  BackendConfig
+	lock    sync.Mutex
+	nodes   map[string]*backendNode
+	metrics tally.Scope
+	changed func(node string, ejected bool)
+}
+
+func NewBackendTransport(next http.RoundTripper, config BackendConfig) *BackendTransport {
+	return &BackendTransport{next: next, config: config, nodes: map[string]*backendNode{}}
+}
+
+// SetMetricsScope has the transport report each node's requests in flight,
+// errors, ejections and shed requests to scope, tagged with the node.
+func (t *BackendTransport) SetMetricsScope(scope tally.Scope) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.metrics = scope
+}
+
+// OnStateChange has f called whenever a node is ejected, and when one that
+// was answers successfully again.
+func (t *BackendTransport) OnStateChange(f func(node string, ejected bool)) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.changed = f
+}
+
+func (t *BackendTransport) stateChanged(host string, ejected bool) {
+	t.lock.Lock()
+	f := t.changed
+	t.lock.Unlock()
+	if f != nil {
+		f(host, ejected)
+	}
+}
+
+func (t *BackendTransport) node(host string) (*backendNode, tally.Scope) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	n, ok := t.nodes[host]
+	if !ok {
+		n = &backendNode{}
+		t.nodes[host] = n
+	}
+	if t.metrics == nil {
+		return n, tally.NoopScope
+	}
+	return n, t.metrics.Tagged(map[string]string{"node": host})
+}
+
+// Ejected reports whether requests to host are being shed for its errors.
+func (t *BackendTransport) Ejected(host string) bool {
+	n, _ := t.node(host)
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return time.Now().Before(n.ejectedUntil)
+}
+
+// EjectedNodes returns the nodes being shed for their errors, with when each
+// will be tried again.
+func (t *BackendTransport) EjectedNodes() map[string]time.Time {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now()
+	ejected := map[string]time.Time{}
+	for host, n := range t.nodes {
+		n.lock.Lock()
+		if now.Before(n.ejectedUntil) {
+			ejected[host] = n.ejectedUntil
+		}
+		n.lock.Unlock()
+	}
+	return ejected
+}
+
+func (t *BackendTransport) acquire(n *backendNode, metrics tally.Scope) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if time.Now().Before(n.ejectedUntil) {
+		return ErrNodeEjected
+	}
+	if t.config.MaxInFlightPerNode > 0 && n.inFlight >= t.config.MaxInFlightPerNode {
+		return ErrNodeBusy
+	}
+	n.inFlight++
+	metrics.Gauge("backend_in_flight").Update(float64(n.inFlight))
+	return nil
+}
+
+func (t *BackendTransport) release(n *backendNode, metrics tally.Scope) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.inFlight--
+	metrics.Gauge("backend_in_flight").Update(float64(n.inFlight))
+}
+
+// recordError counts an error from n, and reports whether it ejected it.
+func (t *BackendTransport) recordError(n *backendNode) bool {
+	if t.config.ErrorLimit <= 0 {
+		return false
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	now := time.Now()
+	recent := n.errors[:0]
+	for _, e := range n.errors {
+		if now.Sub(e) < t.config.ErrorInterval {
+			recent = append(recent, e)
+		}
+	}
+	n.errors = append(recent, now)
+	if n.probation || int64(len(n.errors)) >= t.config.ErrorLimit {
+		n.errors = n.errors[:0]
+		n.ejectedUntil = now.Add(t.config.ErrorInterval)
+		n.probation = true
+		return true
+	}
+	return false
+}
+
+// recordSuccess notes a success from n, and reports whether that took it
+// off probation.
+func (t *BackendTransport) recordSuccess(n *backendNode) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	wasOnProbation := n.probation
+	n.probation = false
+	return wasOnProbation
+}
+
+func (t *BackendTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cancel := context.CancelFunc(func() {})
+	if deadline, ok := ClientDeadline(req.Context()); ok {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, ErrDeadlineExceeded
+		}
+		var ctx context.Context
+		ctx, cancel = context.WithDeadline(req.Context(), deadline)
+		req = req.WithContext(ctx)
+		header := make(http.Header, len(req.Header)+1)
+		for k, v := range req.Header {
+			header[k] = v
+		}
+		header.Set(BudgetHeader, strconv.FormatFloat(remaining.Seconds(), 'f', 3, 64))
+		req.Header = header
+	}
+	n, metrics := t.node(req.URL.Host)
+	if err := t.acquire(n, metrics); err != nil {
+		cancel()
+		metrics.Counter("backend_shed").Inc(1)
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(req)
+	// Requests given up on, like the losers of a race between nodes, don't
+	// say anything about the node.
+	if req.Context().Err() == nil {
+		if err != nil || (resp.StatusCode/100 == 5 && resp.StatusCode != http.StatusInsufficientStorage) {
+			metrics.Counter("backend_errors").Inc(1)
+			if t.recordError(n) {
+				metrics.Counter("backend_ejections").Inc(1)
+				t.stateChanged(req.URL.Host, true)
+			}
+		} else if t.recordSuccess(n) {
+			t.stateChanged(req.URL.Host, false)
+		}
+	}
+	if err != nil {
+		t.release(n, metrics)
+		cancel()
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: func() {
+		t.release(n, metrics)
+		cancel()
+	}}
+	return resp, nil
+}
+
+// releasingBody counts its request as in flight until it's closed.
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	b.once.Do(b.release)
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,125 @@
+package common
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+type testSection map[string]float64
+
+func (s testSection) GetInt(key string, dfl int64) int64 {
+	if v, ok := s[key]; ok {
+		return int64(v)
+	}
+	return dfl
+}
+
+func (s testSection) GetFloat(key string, dfl float64) float64 {
+	if v, ok := s[key]; ok {
+		return v
+	}
+	return dfl
+}
+
+func TestLoadBackendConfig(t *testing.T) {
+	section := testSection{"backend_max_in_flight_per_node": 20, "error_suppression_limit": 5, "error_suppression_interval": 30}
+	require.Equal(t, BackendConfig{MaxIdleConnsPerNode: 100, MaxInFlightPerNode: 20, ErrorLimit: 5, ErrorInterval: 30 * time.Second},
+		LoadBackendConfig(section, DefaultBackendConfig))
+}
+
+func TestBackendTransportEjects(t *testing.T) {
+	status := http.StatusInternalServerError
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+	scope := tally.NewTestScope("", nil)
+	backends := NewBackendTransport(http.DefaultTransport, BackendConfig{ErrorLimit: 2, ErrorInterval: 50 * time.Millisecond})
+	backends.SetMetricsScope(scope)
+	var changes []bool
+	backends.OnStateChange(func(node string, ejected bool) { changes = append(changes, ejected) })
+	client := &http.Client{Transport: backends}
+	get := func() error {
+		resp, err := client.Get(ts.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	host := ts.Listener.Addr().String()
+
+	require.Nil(t, get())
+	require.False(t, backends.Ejected(host))
+	require.Nil(t, get())
+	require.True(t, backends.Ejected(host))
+	require.Contains(t, backends.EjectedNodes(), host)
+	require.NotNil(t, get())
+	require.Equal(t, int64(2), scope.Snapshot().Counters()["backend_errors+node="+host].Value())
+	require.Equal(t, int64(1), scope.Snapshot().Counters()["backend_shed+node="+host].Value())
+
+	// Once the interval is up, one more error ejects it again.
+	time.Sleep(60 * time.Millisecond)
+	require.False(t, backends.Ejected(host))
+	require.Nil(t, get())
+	require.True(t, backends.Ejected(host))
+
+	// And a success lets it back in for good.
+	time.Sleep(60 * time.Millisecond)
+	status = http.StatusOK
+	require.Nil(t, get())
+	status = http.StatusInternalServerError
+	require.Nil(t, get())
+	require.False(t, backends.Ejected(host))
+	require.Equal(t, int64(2), scope.Snapshot().Counters()["backend_ejections+node="+host].Value())
+	require.Equal(t, []bool{true, true, false}, changes)
+}
+
+func TestBackendTransportMaxInFlight(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	client := &http.Client{Transport: NewBackendTransport(http.DefaultTransport, BackendConfig{MaxInFlightPerNode: 1})}
+	resp, err := client.Get(ts.URL)
+	require.Nil(t, err)
+	_, err = client.Get(ts.URL)
+	require.NotNil(t, err)
+	resp.Body.Close()
+	resp, err = client.Get(ts.URL)
+	require.Nil(t, err)
+	resp.Body.Close()
+}
+
+func TestBackendTransportClientDeadline(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get(BudgetHeader)))
+	}))
+	defer ts.Close()
+	backends := NewBackendTransport(http.DefaultTransport, BackendConfig{ErrorLimit: 1, ErrorInterval: time.Minute})
+	client := &http.Client{Transport: backends}
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	require.Nil(t, err)
+	req = req.WithContext(WithClientDeadline(req.Context(), time.Now().Add(time.Minute)))
+	resp, err := client.Do(req)
+	require.Nil(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Nil(t, err)
+	budget, err := strconv.ParseFloat(string(body), 64)
+	require.Nil(t, err)
+	require.True(t, budget > 59 && budget <= 60)
+	require.Equal(t, "", req.Header.Get(BudgetHeader))
+
+	// Once the deadline has passed, requests aren't sent, and that's not
+	// held against the node.
+	req = req.WithContext(WithClientDeadline(req.Context(), time.Now().Add(-time.Second)))
+	_, err = client.Do(req)
+	require.NotNil(t, err)
+	require.False(t, backends.Ejected(ts.Listener.Addr().String()))
+}
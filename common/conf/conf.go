@@ -250,6 +250,27 @@ func normalGetHashPrefixAndSuffix() (prefix string, suffix string, err error) {
 	return "", "", fmt.Errorf("No conf found; looked for %s", configLocations)
 }
 
+// GetBackendSigningKeys returns the keys in the [backend-signing] section of
+// the same configs as the hash path prefix and suffix, which the cluster's own
+// requests to its storage servers are signed with. The first key signs, and
+// any of them are accepted, so keys can be rotated. No keys means requests
+// aren't signed or checked, as does finding no config, which
+// GetHashPrefixAndSuffix already complains about.
+var GetBackendSigningKeys = normalGetBackendSigningKeys
+
+func normalGetBackendSigningKeys() [][]byte {
+	for _, loc := range configLocations {
+		if conf, e := LoadConfig(loc); e == nil {
+			var keys [][]byte
+			for _, key := range common.SliceFromCSV(conf.GetDefault("backend-signing", "keys", "")) {
+				keys = append(keys, []byte(key))
+			}
+			return keys
+		}
+	}
+	return nil
+}
+
 func ReadResellerOptions(conf Section, defaults map[string][]string) ([]string, map[string]map[string][]string) {
 	resellerPrefixOpt := conf.GetDefault("reseller_prefix", "AUTH")
 	s := []string{}
@@ -28,7 +28,12 @@ type Policy struct {
 	Aliases    []string
 	Default    bool
 	Deprecated bool
-	Config     map[string]string
+	// ReadOnly has object servers refuse writes to the policy, and
+	// FreezeReplication stops replicators working on it; both are for
+	// migrating data between policies.
+	ReadOnly          bool
+	FreezeReplication bool
+	Config            map[string]string
 }
 
 func (p Policy) GetDbPartPower() (uint, error) {
@@ -129,13 +134,15 @@ func GetPolicies() (PolicyList, error) {
 						}
 					}
 					policies[policyIndex] = &Policy{
-						Index:      policyIndex,
-						Type:       conf.GetDefault(key, "policy_type", "replication"),
-						Name:       name,
-						Aliases:    aliases,
-						Deprecated: conf.GetBool(key, "deprecated", false),
-						Default:    conf.GetBool(key, "default", false),
-						Config:     map[string]string(conf.File[key]),
+						Index:             policyIndex,
+						Type:              conf.GetDefault(key, "policy_type", "replication"),
+						Name:              name,
+						Aliases:           aliases,
+						Deprecated:        conf.GetBool(key, "deprecated", false),
+						Default:           conf.GetBool(key, "default", false),
+						ReadOnly:          conf.GetBool(key, "read_only", false),
+						FreezeReplication: conf.GetBool(key, "freeze_replication", false),
+						Config:            map[string]string(conf.File[key]),
 					}
 				}
 			}
@@ -27,7 +27,7 @@ func TestGetPolicies(t *testing.T) {
 	tempFile, _ := ioutil.TempFile("", "INI")
 	tempFile.Write([]byte("[swift-hash]\nswift_hash_path_prefix = changeme\nswift_hash_path_suffix = changeme\n" +
 		"[storage-policy:0]\nname = gold\naliases = yellow, orange\npolicy_type = replication\ndefault = yes\n" +
-		"[storage-policy:1]\nname = silver\npolicy_type = replication\ndeprecated = yes\n"))
+		"[storage-policy:1]\nname = silver\npolicy_type = replication\ndeprecated = yes\nread_only = yes\nfreeze_replication = yes\n"))
 	oldConfigs := configLocations
 	defer func() {
 		configLocations = oldConfigs
@@ -38,6 +38,10 @@ func TestGetPolicies(t *testing.T) {
 	policyList, err := GetPolicies()
 	require.Nil(t, err)
 	require.Equal(t, policyList[0].Name, "gold")
+	require.False(t, policyList[0].ReadOnly)
+	require.False(t, policyList[0].FreezeReplication)
+	require.True(t, policyList[1].ReadOnly)
+	require.True(t, policyList[1].FreezeReplication)
 	require.Equal(t, policyList[0].Default, true)
 	require.Equal(t, policyList[0].Deprecated, false)
 	require.Equal(t, policyList[0].Aliases, []string{"gold", "yellow", "orange"})
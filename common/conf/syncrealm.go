@@ -15,7 +15,13 @@
 
 package conf
 
-import "strings"
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
 
 type SyncRealm struct {
 	Name     string
@@ -50,6 +56,40 @@ func (l SyncRealmList) ValidateSyncTo(syncHeader string) bool {
 	return true
 }
 
+// SyncToURL returns the realm and the URL of the remote container a valid
+// X-Container-Sync-To value names.
+func (l SyncRealmList) SyncToURL(syncHeader string) (SyncRealm, string, bool) {
+	if !l.ValidateSyncTo(syncHeader) {
+		return SyncRealm{}, "", false
+	}
+	parts := strings.Split(syncHeader[2:], "/")
+	realm := l[parts[0]]
+	return realm, strings.TrimRight(realm.Clusters[parts[1]], "/") + "/" + strings.Join(parts[2:], "/"), true
+}
+
+func syncSignature(realmKey, method, path, timestamp, nonce, userKey string) string {
+	mac := hmac.New(sha1.New, []byte(realmKey))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", method, path, timestamp, nonce, userKey)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SyncAuth returns the X-Container-Sync-Auth value for a container sync
+// request, signed with the realm's key and the containers' shared sync key.
+func (r SyncRealm) SyncAuth(method, path, timestamp, nonce, userKey string) string {
+	return fmt.Sprintf("%s %s %s", r.Name, nonce, syncSignature(r.Key1, method, path, timestamp, nonce, userKey))
+}
+
+// ValidSyncSignature reports whether sig signs a container sync request with
+// either of the realm's keys, so realm keys can be rotated through key2.
+func (r SyncRealm) ValidSyncSignature(method, path, timestamp, nonce, userKey, sig string) bool {
+	for _, key := range []string{r.Key1, r.Key2} {
+		if key != "" && hmac.Equal([]byte(sig), []byte(syncSignature(key, method, path, timestamp, nonce, userKey))) {
+			return true
+		}
+	}
+	return false
+}
+
 var syncRealmConfigLocations = []string{"/etc/hummingbird/container-sync-realms.conf", "/etc/swift/container-sync-realms.conf"}
 
 func GetSyncRealms() (SyncRealmList, error) {
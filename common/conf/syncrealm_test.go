@@ -0,0 +1,56 @@
+package conf
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetSyncRealms(t *testing.T) {
+	tempFile, err := ioutil.TempFile("", "INI")
+	require.Nil(t, err)
+	defer os.Remove(tempFile.Name())
+	tempFile.Write([]byte("[realm1]\nkey = one\nkey2 = two\ncluster_east = https://east.example.com/v1/\ncluster_west = https://west.example.com/v1\n"))
+	tempFile.Close()
+	oldLocations := syncRealmConfigLocations
+	defer func() { syncRealmConfigLocations = oldLocations }()
+	syncRealmConfigLocations = []string{tempFile.Name()}
+
+	realms, err := GetSyncRealms()
+	require.Nil(t, err)
+	require.Equal(t, "one", realms["realm1"].Key1)
+	require.Equal(t, "two", realms["realm1"].Key2)
+
+	realm, url, ok := realms.SyncToURL("//realm1/east/AUTH_test/c")
+	require.True(t, ok)
+	require.Equal(t, "realm1", realm.Name)
+	require.Equal(t, "https://east.example.com/v1/AUTH_test/c", url)
+	_, url, ok = realms.SyncToURL("//realm1/west/AUTH_test/c")
+	require.True(t, ok)
+	require.Equal(t, "https://west.example.com/v1/AUTH_test/c", url)
+	_, _, ok = realms.SyncToURL("//realm1/north/AUTH_test/c")
+	require.False(t, ok)
+	_, _, ok = realms.SyncToURL("https://east.example.com/v1/AUTH_test/c")
+	require.False(t, ok)
+}
+
+func TestSyncSignature(t *testing.T) {
+	realm := SyncRealm{Name: "realm1", Key1: "one", Key2: "two"}
+	auth := strings.Fields(realm.SyncAuth("PUT", "/v1/a/c/o", "1500000000.00000", "nonce", "secret"))
+	require.Equal(t, 3, len(auth))
+	require.Equal(t, "realm1", auth[0])
+	require.Equal(t, "nonce", auth[1])
+	require.True(t, realm.ValidSyncSignature("PUT", "/v1/a/c/o", "1500000000.00000", "nonce", "secret", auth[2]))
+	require.False(t, realm.ValidSyncSignature("DELETE", "/v1/a/c/o", "1500000000.00000", "nonce", "secret", auth[2]))
+	require.False(t, realm.ValidSyncSignature("PUT", "/v1/a/c/o", "1500000000.00001", "nonce", "secret", auth[2]))
+	require.False(t, realm.ValidSyncSignature("PUT", "/v1/a/c/o", "1500000000.00000", "nonce", "other", auth[2]))
+
+	// Requests signed with the realm's second key are still accepted, so the
+	// keys can be rotated one cluster at a time.
+	rotated := SyncRealm{Name: "realm1", Key1: "two"}
+	auth = strings.Fields(rotated.SyncAuth("PUT", "/v1/a/c/o", "1500000000.00000", "nonce", "secret"))
+	require.True(t, realm.ValidSyncSignature("PUT", "/v1/a/c/o", "1500000000.00000", "nonce", "secret", auth[2]))
+}
@@ -24,6 +24,8 @@ import (
 	"time"
 )
 
+// The default constraints, which the proxy's [swift-constraints] section can
+// change.
 const (
 	MAX_FILE_SIZE             = int64(5368709122)
 	MAX_META_NAME_LENGTH      = 128
@@ -39,19 +41,83 @@ const (
 	EXTRA_HEADER_COUNT        = 0
 )
 
-var DEFAULT_CONSTRAINTS = map[string]interface{}{
-	"max_file_size":             MAX_FILE_SIZE,
-	"max_meta_name_length":      MAX_META_NAME_LENGTH,
-	"max_meta_value_length":     MAX_META_VALUE_LENGTH,
-	"max_meta_count":            MAX_META_COUNT,
-	"max_meta_overall_size":     MAX_META_OVERALL_SIZE,
-	"max_header_size":           MAX_HEADER_SIZE,
-	"max_object_name_length":    MAX_OBJECT_NAME_LENGTH,
-	"container_listing_limit":   CONTAINER_LISTING_LIMIT,
-	"account_listing_limit":     ACCOUNT_LISTING_LIMIT,
-	"max_account_name_length":   MAX_ACCOUNT_NAME_LENGTH,
-	"max_container_name_length": MAX_CONTAINER_NAME_LENGTH,
-	"extra_header_count":        EXTRA_HEADER_COUNT,
+// Constraints are the limits the proxy holds client requests to.
+type Constraints struct {
+	MaxFileSize            int64
+	MaxMetaNameLength      int
+	MaxMetaValueLength     int
+	MaxMetaCount           int
+	MaxMetaOverallSize     int
+	MaxHeaderSize          int
+	MaxObjectNameLength    int
+	MaxAccountNameLength   int
+	MaxContainerNameLength int
+	ExtraHeaderCount       int
+}
+
+var DefaultConstraints = Constraints{
+	MaxFileSize:            MAX_FILE_SIZE,
+	MaxMetaNameLength:      MAX_META_NAME_LENGTH,
+	MaxMetaValueLength:     MAX_META_VALUE_LENGTH,
+	MaxMetaCount:           MAX_META_COUNT,
+	MaxMetaOverallSize:     MAX_META_OVERALL_SIZE,
+	MaxHeaderSize:          MAX_HEADER_SIZE,
+	MaxObjectNameLength:    MAX_OBJECT_NAME_LENGTH,
+	MaxAccountNameLength:   MAX_ACCOUNT_NAME_LENGTH,
+	MaxContainerNameLength: MAX_CONTAINER_NAME_LENGTH,
+	ExtraHeaderCount:       EXTRA_HEADER_COUNT,
+}
+
+// LoadConstraints returns the defaults with any of them set in section,
+// which uses the names /info reports them by.
+func LoadConstraints(section interface {
+	GetInt(key string, dfl int64) int64
+}) (*Constraints, error) {
+	c := DefaultConstraints
+	c.MaxFileSize = section.GetInt("max_file_size", c.MaxFileSize)
+	if c.MaxFileSize < 1 {
+		return nil, fmt.Errorf("max_file_size must be positive, not %d", c.MaxFileSize)
+	}
+	for _, limit := range []struct {
+		name  string
+		value *int
+		min   int
+	}{
+		{"max_meta_name_length", &c.MaxMetaNameLength, 1},
+		{"max_meta_value_length", &c.MaxMetaValueLength, 1},
+		{"max_meta_count", &c.MaxMetaCount, 0},
+		{"max_meta_overall_size", &c.MaxMetaOverallSize, 0},
+		{"max_header_size", &c.MaxHeaderSize, 1},
+		{"max_object_name_length", &c.MaxObjectNameLength, 1},
+		{"max_account_name_length", &c.MaxAccountNameLength, 1},
+		{"max_container_name_length", &c.MaxContainerNameLength, 1},
+		{"extra_header_count", &c.ExtraHeaderCount, 0},
+	} {
+		*limit.value = int(section.GetInt(limit.name, int64(*limit.value)))
+		if *limit.value < limit.min {
+			return nil, fmt.Errorf("%s must be at least %d, not %d", limit.name, limit.min, *limit.value)
+		}
+	}
+	return &c, nil
+}
+
+// Info returns the constraints as /info reports them, along with the
+// listing limits the account and container servers keep to.
+func (c *Constraints) Info() map[string]interface{} {
+	return map[string]interface{}{
+		"max_file_size":             c.MaxFileSize,
+		"max_meta_name_length":      c.MaxMetaNameLength,
+		"max_meta_value_length":     c.MaxMetaValueLength,
+		"max_meta_count":            c.MaxMetaCount,
+		"max_meta_overall_size":     c.MaxMetaOverallSize,
+		"max_header_size":           c.MaxHeaderSize,
+		"max_object_name_length":    c.MaxObjectNameLength,
+		"container_listing_limit":   CONTAINER_LISTING_LIMIT,
+		"account_listing_limit":     ACCOUNT_LISTING_LIMIT,
+		"max_account_name_length":   c.MaxAccountNameLength,
+		"max_container_name_length": c.MaxContainerNameLength,
+		"extra_header_count":        c.ExtraHeaderCount,
+	}
 }
 
 var OwnerHeaders = map[string]bool{
@@ -66,22 +132,29 @@ var OwnerHeaders = map[string]bool{
 	"x-account-access-control":        true,
 }
 
+// StorageClasses are the values X-Object-Storage-Class may be set to, as a
+// hint to the tiering daemons of where to keep the object's contents.
+var StorageClasses = map[string]bool{
+	"hot":  true,
+	"cold": true,
+}
+
 var ErrBadRequest = errors.New("bad request")
 var ErrNotFound = errors.New("not found")
 var ErrConflict = errors.New("conflict")
 var ErrDisconnect = errors.New("disconnect")
 
-func CheckMetadata(req *http.Request, targetType string) (int, string) {
+func (c *Constraints) CheckMetadata(req *http.Request, targetType string) (int, string) {
 	metaCount := 0
 	metaSize := 0
 	metaPrefix := fmt.Sprintf("X-%s-Meta-", targetType)
 	fixKeys := make(map[string]string)
 	for key := range req.Header {
 		value := req.Header.Get(key)
-		if len(value) > MAX_HEADER_SIZE {
+		if len(value) > c.MaxHeaderSize {
 			errStr := fmt.Sprintf("Header value too long: %s", key)
-			if len(key) > MAX_META_NAME_LENGTH {
-				errStr = fmt.Sprintf("Header value too long: %s", key[:MAX_META_NAME_LENGTH])
+			if len(key) > c.MaxMetaNameLength {
+				errStr = fmt.Sprintf("Header value too long: %s", key[:c.MaxMetaNameLength])
 			}
 			return http.StatusBadRequest, errStr
 		}
@@ -97,17 +170,17 @@ func CheckMetadata(req *http.Request, targetType string) (int, string) {
 		if StringInSlice(targetType, []string{"Account", "Container"}) && (strings.Contains(key, "\x00") || strings.Contains(value, "\x00")) {
 			return http.StatusBadRequest, "Metadata must be valid UTF-8"
 		}
-		if len(key) > MAX_META_NAME_LENGTH {
+		if len(key) > c.MaxMetaNameLength {
 			return http.StatusBadRequest, fmt.Sprintf("Metadata name too long: %s%s", metaPrefix, key)
 		}
-		if len(value) > MAX_META_VALUE_LENGTH {
-			return http.StatusBadRequest, fmt.Sprintf("Metadata value longer than %d: %s%s", MAX_META_VALUE_LENGTH, metaPrefix, key)
+		if len(value) > c.MaxMetaValueLength {
+			return http.StatusBadRequest, fmt.Sprintf("Metadata value longer than %d: %s%s", c.MaxMetaValueLength, metaPrefix, key)
 		}
-		if metaCount > MAX_META_COUNT {
-			return http.StatusBadRequest, fmt.Sprintf("Too many metadata items; max %d", MAX_META_COUNT)
+		if metaCount > c.MaxMetaCount {
+			return http.StatusBadRequest, fmt.Sprintf("Too many metadata items; max %d", c.MaxMetaCount)
 		}
-		if metaSize > MAX_META_OVERALL_SIZE {
-			return http.StatusBadRequest, fmt.Sprintf("Total metadata too large; max %d", MAX_META_OVERALL_SIZE)
+		if metaSize > c.MaxMetaOverallSize {
+			return http.StatusBadRequest, fmt.Sprintf("Total metadata too large; max %d", c.MaxMetaOverallSize)
 		}
 		fixedKey := strings.Replace(key, "_", "-", -1)
 		if key != fixedKey {
@@ -137,20 +210,21 @@ func handleObjDeleteHeaders(req *http.Request) (int, string) {
 			return http.StatusBadRequest, "X-Delete-After in past"
 		} else {
 			req.Header.Set("X-Delete-At", strconv.FormatInt(time.Now().Unix()+deleteAfter, 10))
+			req.Header.Del("X-Delete-After")
 		}
 	}
 	return http.StatusOK, ""
 }
 
-func CheckObjPost(req *http.Request, objectName string) (int, string) {
+func (c *Constraints) CheckObjPost(req *http.Request, objectName string) (int, string) {
 	if status, msg := handleObjDeleteHeaders(req); status != http.StatusOK {
 		return status, msg
 	}
-	return CheckMetadata(req, "Object")
+	return c.CheckMetadata(req, "Object")
 }
 
-func CheckObjPut(req *http.Request, objectName string) (int, string) {
-	if req.ContentLength > MAX_FILE_SIZE {
+func (c *Constraints) CheckObjPut(req *http.Request, objectName string) (int, string) {
+	if req.ContentLength > c.MaxFileSize {
 		return http.StatusRequestEntityTooLarge, "Your request is too large."
 	}
 	if req.Header.Get("X-Copy-From") != "" && req.ContentLength != 0 {
@@ -159,8 +233,8 @@ func CheckObjPut(req *http.Request, objectName string) (int, string) {
 	if req.Header.Get("Content-Length") == "" && !StringInSlice("chunked", req.TransferEncoding) {
 		return http.StatusLengthRequired, "Missing Content-Length header."
 	}
-	if len(objectName) > MAX_OBJECT_NAME_LENGTH {
-		return http.StatusBadRequest, fmt.Sprintf("Object name length of %d longer than %d", len(objectName), MAX_OBJECT_NAME_LENGTH)
+	if len(objectName) > c.MaxObjectNameLength {
+		return http.StatusBadRequest, fmt.Sprintf("Object name length of %d longer than %d", len(objectName), c.MaxObjectNameLength)
 	}
 	if req.Header.Get("Content-Type") == "" {
 		return http.StatusBadRequest, "No content type"
@@ -171,12 +245,22 @@ func CheckObjPut(req *http.Request, objectName string) (int, string) {
 	if strings.Contains(req.Header.Get("Content-Type"), "\x00") {
 		return http.StatusBadRequest, "Invalid Content-Type"
 	}
-	return CheckMetadata(req, "Object")
+	if sc := req.Header.Get("X-Object-Storage-Class"); sc != "" && !StorageClasses[sc] {
+		return http.StatusBadRequest, fmt.Sprintf("Invalid X-Object-Storage-Class %q", sc)
+	}
+	return c.CheckMetadata(req, "Object")
+}
+
+func (c *Constraints) CheckContainerPut(req *http.Request, containerName string) (int, string) {
+	if len(containerName) > c.MaxContainerNameLength {
+		return http.StatusBadRequest, fmt.Sprintf("Container name length of %d longer than %d", len(containerName), c.MaxContainerNameLength)
+	}
+	return c.CheckMetadata(req, "Container")
 }
 
-func CheckContainerPut(req *http.Request, containerName string) (int, string) {
-	if len(containerName) > MAX_CONTAINER_NAME_LENGTH {
-		return http.StatusBadRequest, fmt.Sprintf("Container name length of %d longer than %d", len(containerName), MAX_CONTAINER_NAME_LENGTH)
+func (c *Constraints) CheckAccountPut(req *http.Request, accountName string) (int, string) {
+	if len(accountName) > c.MaxAccountNameLength {
+		return http.StatusBadRequest, fmt.Sprintf("Account name length of %d longer than %d", len(accountName), c.MaxAccountNameLength)
 	}
-	return CheckMetadata(req, "Container")
+	return c.CheckMetadata(req, "Account")
 }
@@ -29,7 +29,7 @@ func TestPutTooBig(t *testing.T) {
 	req, err := http.NewRequest("PUT", "/v1/a/c/o", nil)
 	require.Nil(t, err)
 	req.ContentLength = MAX_FILE_SIZE + 1
-	status, _ := CheckObjPut(req, "o")
+	status, _ := DefaultConstraints.CheckObjPut(req, "o")
 	require.Equal(t, http.StatusRequestEntityTooLarge, status)
 }
 
@@ -37,11 +37,11 @@ func TestBadTransferEncoding(t *testing.T) {
 	req, err := http.NewRequest("PUT", "/v1/a/c/o", nil)
 	require.Nil(t, err)
 	req.ContentLength = -1
-	status, _ := CheckObjPut(req, "o")
+	status, _ := DefaultConstraints.CheckObjPut(req, "o")
 	require.Equal(t, http.StatusLengthRequired, status)
 
 	req.TransferEncoding = []string{"notchunked"}
-	status, _ = CheckObjPut(req, "o")
+	status, _ = DefaultConstraints.CheckObjPut(req, "o")
 	require.Equal(t, status, http.StatusLengthRequired)
 }
 
@@ -50,7 +50,7 @@ func TestLengthOnCopyFrom(t *testing.T) {
 	require.Nil(t, err)
 	req.ContentLength = 1
 	req.Header.Set("X-Copy-From", "/v1/a/c/otherobject")
-	status, _ := CheckObjPut(req, "o")
+	status, _ := DefaultConstraints.CheckObjPut(req, "o")
 	require.Equal(t, http.StatusBadRequest, status)
 }
 
@@ -59,7 +59,7 @@ func TestNameTooLong(t *testing.T) {
 	require.Nil(t, err)
 	req.ContentLength = 1
 	req.Header.Set("Content-Length", "1")
-	status, _ := CheckObjPut(req, strings.Repeat("o", MAX_OBJECT_NAME_LENGTH+1))
+	status, _ := DefaultConstraints.CheckObjPut(req, strings.Repeat("o", MAX_OBJECT_NAME_LENGTH+1))
 	require.Equal(t, http.StatusBadRequest, status)
 }
 
@@ -69,7 +69,7 @@ func TestNoContentType(t *testing.T) {
 	req.ContentLength = 1
 	req.Header.Set("Content-Length", "1")
 	req.Header.Set("Content-Type", "")
-	status, _ := CheckObjPut(req, "o")
+	status, _ := DefaultConstraints.CheckObjPut(req, "o")
 	require.Equal(t, http.StatusBadRequest, status)
 }
 
@@ -78,7 +78,7 @@ func TestNoContentLength(t *testing.T) {
 	require.Nil(t, err)
 	req.ContentLength = -1
 	req.Header.Set("Content-Length", "")
-	status, _ := CheckObjPut(req, "o")
+	status, _ := DefaultConstraints.CheckObjPut(req, "o")
 	require.Equal(t, http.StatusLengthRequired, status)
 }
 
@@ -89,11 +89,11 @@ func TestBadXDeleteAt(t *testing.T) {
 	req.Header.Set("Content-Length", "1")
 	req.Header.Set("Content-Type", "text/plain")
 	req.Header.Set("X-Delete-At", "1")
-	status, _ := CheckObjPut(req, "o")
+	status, _ := DefaultConstraints.CheckObjPut(req, "o")
 	require.Equal(t, http.StatusBadRequest, status)
 
 	req.Header.Set("X-Delete-At", "!")
-	status, _ = CheckObjPut(req, "o")
+	status, _ = DefaultConstraints.CheckObjPut(req, "o")
 	require.Equal(t, http.StatusBadRequest, status)
 }
 
@@ -104,24 +104,25 @@ func TestBadXDeleteAfter(t *testing.T) {
 	req.Header.Set("Content-Length", "1")
 	req.Header.Set("Content-Type", "text/plain")
 	req.Header.Set("X-Delete-After", "-1")
-	status, _ := CheckObjPut(req, "o")
+	status, _ := DefaultConstraints.CheckObjPut(req, "o")
 	require.Equal(t, http.StatusBadRequest, status)
-	status, _ = CheckObjPost(req, "o")
+	status, _ = DefaultConstraints.CheckObjPost(req, "o")
 	require.Equal(t, http.StatusBadRequest, status)
 
 	req.Header.Set("X-Delete-After", "!")
-	status, _ = CheckObjPut(req, "o")
+	status, _ = DefaultConstraints.CheckObjPut(req, "o")
 	require.Equal(t, http.StatusBadRequest, status)
-	status, _ = CheckObjPost(req, "o")
+	status, _ = DefaultConstraints.CheckObjPost(req, "o")
 	require.Equal(t, http.StatusBadRequest, status)
 
 	req.Header.Set("X-Delete-After", "5")
-	status, _ = CheckObjPut(req, "o")
+	status, _ = DefaultConstraints.CheckObjPut(req, "o")
 	xda := req.Header.Get("X-Delete-At")
 	require.True(t, xda == fmt.Sprintf("%d", time.Now().Unix()+5) || xda == fmt.Sprintf("%d", time.Now().Unix()+4))
+	require.Equal(t, "", req.Header.Get("X-Delete-After"))
 
 	req.Header.Set("X-Delete-After", "5")
-	status, _ = CheckObjPost(req, "o")
+	status, _ = DefaultConstraints.CheckObjPost(req, "o")
 	xda = req.Header.Get("X-Delete-At")
 	require.True(t, xda == fmt.Sprintf("%d", time.Now().Unix()+5) || xda == fmt.Sprintf("%d", time.Now().Unix()+4))
 }
@@ -130,7 +131,7 @@ func TestTooBigHeader(t *testing.T) {
 	req, err := http.NewRequest("PUT", "/v1/a/c/o", nil)
 	require.Nil(t, err)
 	req.Header.Set("X", strings.Repeat("X", MAX_HEADER_SIZE+1))
-	status, _ := CheckMetadata(req, "Object")
+	status, _ := DefaultConstraints.CheckMetadata(req, "Object")
 	require.Equal(t, http.StatusBadRequest, status)
 }
 
@@ -138,7 +139,7 @@ func TestUnnamedMeta(t *testing.T) {
 	req, err := http.NewRequest("PUT", "/v1/a/c/o", nil)
 	require.Nil(t, err)
 	req.Header.Set("X-Object-Meta-", "X")
-	status, _ := CheckMetadata(req, "Object")
+	status, _ := DefaultConstraints.CheckMetadata(req, "Object")
 	require.Equal(t, http.StatusBadRequest, status)
 }
 
@@ -146,7 +147,7 @@ func TestUnderscoreMeta(t *testing.T) {
 	req, err := http.NewRequest("PUT", "/v1/a/c/o", nil)
 	require.Nil(t, err)
 	req.Header.Set("X-Object-Meta-My_Underscore_Key", "X")
-	status, _ := CheckMetadata(req, "Object")
+	status, _ := DefaultConstraints.CheckMetadata(req, "Object")
 	require.Equal(t, http.StatusOK, status)
 	fmt.Printf("header: %+v\n", req.Header)
 	require.Equal(t, []string{"X"}, req.Header["X-Object-Meta-My-Underscore-Key"])
@@ -158,7 +159,7 @@ func TestLongMetaName(t *testing.T) {
 	req, err := http.NewRequest("PUT", "/v1/a/c/o", nil)
 	require.Nil(t, err)
 	req.Header.Set(fmt.Sprintf("X-Object-Meta-%s", strings.Repeat("X", MAX_META_NAME_LENGTH+1)), "X")
-	status, _ := CheckMetadata(req, "Object")
+	status, _ := DefaultConstraints.CheckMetadata(req, "Object")
 	require.Equal(t, http.StatusBadRequest, status)
 }
 
@@ -166,7 +167,7 @@ func TestLongMetaValue(t *testing.T) {
 	req, err := http.NewRequest("PUT", "/v1/a/c/o", nil)
 	require.Nil(t, err)
 	req.Header.Set("X-Object-Meta-Key", strings.Repeat("X", MAX_META_VALUE_LENGTH+1))
-	status, _ := CheckMetadata(req, "Object")
+	status, _ := DefaultConstraints.CheckMetadata(req, "Object")
 	require.Equal(t, http.StatusBadRequest, status)
 }
 
@@ -176,7 +177,7 @@ func TestTooManyMetas(t *testing.T) {
 	for i := 0; i < MAX_META_COUNT+1; i++ {
 		req.Header.Set(fmt.Sprintf("X-Object-Meta-%d", i), "X")
 	}
-	status, _ := CheckMetadata(req, "Object")
+	status, _ := DefaultConstraints.CheckMetadata(req, "Object")
 	require.Equal(t, http.StatusBadRequest, status)
 }
 
@@ -186,7 +187,7 @@ func TestTooMuchMeta(t *testing.T) {
 	for i := 0; i < MAX_META_COUNT; i++ {
 		req.Header.Set(fmt.Sprintf("X-Object-Meta-%d", i), strings.Repeat("X", MAX_META_VALUE_LENGTH))
 	}
-	status, _ := CheckMetadata(req, "Object")
+	status, _ := DefaultConstraints.CheckMetadata(req, "Object")
 	require.Equal(t, http.StatusBadRequest, status)
 }
 
@@ -194,6 +195,69 @@ func TestContainerNameTooLong(t *testing.T) {
 	req, err := http.NewRequest("PUT", "/v1/a/c", nil)
 	require.Nil(t, err)
 	req.ContentLength = 1
-	status, _ := CheckContainerPut(req, strings.Repeat("o", MAX_CONTAINER_NAME_LENGTH+1))
+	status, _ := DefaultConstraints.CheckContainerPut(req, strings.Repeat("o", MAX_CONTAINER_NAME_LENGTH+1))
 	require.Equal(t, http.StatusBadRequest, status)
 }
+
+func TestStorageClass(t *testing.T) {
+	req, err := http.NewRequest("PUT", "/v1/a/c/o", nil)
+	require.Nil(t, err)
+	req.Header.Set("Content-Length", "0")
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("X-Object-Storage-Class", "cold")
+	status, _ := DefaultConstraints.CheckObjPut(req, "o")
+	require.Equal(t, http.StatusOK, status)
+
+	req.Header.Set("X-Object-Storage-Class", "lukewarm")
+	status, _ = DefaultConstraints.CheckObjPut(req, "o")
+	require.Equal(t, http.StatusBadRequest, status)
+}
+
+type constraintsSection map[string]int64
+
+func (s constraintsSection) GetInt(key string, dfl int64) int64 {
+	if v, ok := s[key]; ok {
+		return v
+	}
+	return dfl
+}
+
+func TestLoadConstraints(t *testing.T) {
+	c, err := LoadConstraints(constraintsSection{"max_meta_count": 2, "max_object_name_length": 10, "max_file_size": 100})
+	require.Nil(t, err)
+	require.Equal(t, 2, c.MaxMetaCount)
+	require.Equal(t, MAX_META_VALUE_LENGTH, c.MaxMetaValueLength)
+	require.Equal(t, int64(100), c.Info()["max_file_size"])
+	require.Equal(t, 10, c.Info()["max_object_name_length"])
+
+	req, err := http.NewRequest("PUT", "/v1/a/c/o", nil)
+	require.Nil(t, err)
+	req.ContentLength = 101
+	status, _ := c.CheckObjPut(req, "o")
+	require.Equal(t, http.StatusRequestEntityTooLarge, status)
+	req.ContentLength = 1
+	req.Header.Set("Content-Length", "1")
+	req.Header.Set("Content-Type", "text/plain")
+	status, msg := c.CheckObjPut(req, strings.Repeat("o", 11))
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Equal(t, "Object name length of 11 longer than 10", msg)
+	for i := 0; i < 3; i++ {
+		req.Header.Set(fmt.Sprintf("X-Object-Meta-%d", i), "X")
+	}
+	status, msg = c.CheckObjPut(req, "o")
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Equal(t, "Too many metadata items; max 2", msg)
+
+	_, err = LoadConstraints(constraintsSection{"max_header_size": 0})
+	require.NotNil(t, err)
+	require.Equal(t, "max_header_size must be at least 1, not 0", err.Error())
+}
+
+func TestAccountNameTooLong(t *testing.T) {
+	req, err := http.NewRequest("PUT", "/v1/a", nil)
+	require.Nil(t, err)
+	status, _ := DefaultConstraints.CheckAccountPut(req, strings.Repeat("a", MAX_ACCOUNT_NAME_LENGTH+1))
+	require.Equal(t, http.StatusBadRequest, status)
+	status, _ = DefaultConstraints.CheckAccountPut(req, "a")
+	require.Equal(t, http.StatusOK, status)
+}
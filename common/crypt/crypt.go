@@ -0,0 +1,160 @@
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+)
+
+const (
+	BodyMetaHeader            = "X-Object-Sysmeta-Crypto-Body-Meta"
+	EtagHeader                = "X-Object-Sysmeta-Crypto-Etag"
+	EtagMacHeader             = "X-Object-Sysmeta-Crypto-Etag-Mac"
+	OverrideEtagHeader        = "X-Object-Sysmeta-Container-Update-Override-Etag"
+	OverrideContentTypeHeader = "X-Object-Sysmeta-Container-Update-Override-Content-Type"
+	Cipher                    = "AES_CTR_256"
+	// EncryptedValuePrefix marks metadata values that are encrypted. They're
+	// hex so they survive being lowercased or parsed as a media type.
+	EncryptedValuePrefix = "crypto-"
+)
+
+// Headers are the object sysmeta an encrypted object keeps its encryption
+// details in, which never leave the cluster.
+var Headers = []string{BodyMetaHeader, EtagHeader, EtagMacHeader, OverrideEtagHeader, OverrideContentTypeHeader}
+
+// BodyMeta is how an object's body was encrypted: with a random key, itself
+// encrypted with the object's key, and a random IV.
+type BodyMeta struct {
+	Cipher  string `json:"cipher"`
+	IV      string `json:"iv"`
+	BodyKey string `json:"body_key"`
+}
+
+// CtrStream is an AES-CTR stream for the key and IV that starts offset bytes
+// in, so ranges can be decrypted on their own.
+func CtrStream(key, iv []byte, offset int64) (cipher.Stream, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid IV length %d", len(iv))
+	}
+	counter := new(big.Int).SetBytes(iv)
+	counter.Add(counter, big.NewInt(offset/aes.BlockSize))
+	counterBytes := counter.Bytes()
+	start := make([]byte, aes.BlockSize)
+	if len(counterBytes) > aes.BlockSize {
+		counterBytes = counterBytes[len(counterBytes)-aes.BlockSize:]
+	}
+	copy(start[aes.BlockSize-len(counterBytes):], counterBytes)
+	stream := cipher.NewCTR(block, start)
+	skip := make([]byte, offset%aes.BlockSize)
+	stream.XORKeyStream(skip, skip)
+	return stream, nil
+}
+
+// RandomBytes returns n bytes from crypto/rand.
+func RandomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	return b, err
+}
+
+// EncryptValue encrypts a metadata value with a random IV, which it keeps
+// in front of the ciphertext.
+func EncryptValue(key, value []byte) (string, error) {
+	iv, err := RandomBytes(aes.BlockSize)
+	if err != nil {
+		return "", err
+	}
+	stream, err := CtrStream(key, iv, 0)
+	if err != nil {
+		return "", err
+	}
+	out := make([]byte, len(iv)+len(value))
+	copy(out, iv)
+	stream.XORKeyStream(out[len(iv):], value)
+	return EncryptedValuePrefix + hex.EncodeToString(out), nil
+}
+
+// DecryptValue decrypts a value EncryptValue made.
+func DecryptValue(key []byte, value string) ([]byte, error) {
+	if !strings.HasPrefix(value, EncryptedValuePrefix) {
+		return nil, errors.New("value is not encrypted")
+	}
+	b, err := hex.DecodeString(value[len(EncryptedValuePrefix):])
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < aes.BlockSize {
+		return nil, errors.New("encrypted value too short")
+	}
+	stream, err := CtrStream(key, b[:aes.BlockSize], 0)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(b)-aes.BlockSize)
+	stream.XORKeyStream(out, b[aes.BlockSize:])
+	return out, nil
+}
+
+// EtagMac is what conditional requests are checked against on the object
+// servers, so they don't need the plaintext etag.
+func EtagMac(key []byte, etag string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.ToLower(etag)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// DecryptHeaders decrypts an encrypted object's content type and etag in h
+// with the object's key, and removes its encryption sysmeta. It returns the
+// key and IV its body was encrypted with, or nil if it isn't encrypted.
+func DecryptHeaders(key []byte, h http.Header) (bodyKey, iv []byte, err error) {
+	meta := h.Get(BodyMetaHeader)
+	if meta == "" {
+		return nil, nil, nil
+	}
+	defer func() {
+		for _, k := range Headers {
+			h.Del(k)
+		}
+	}()
+	var bodyMeta BodyMeta
+	if err := json.Unmarshal([]byte(meta), &bodyMeta); err != nil {
+		return nil, nil, err
+	}
+	if bodyMeta.Cipher != Cipher {
+		return nil, nil, fmt.Errorf("unknown cipher %q", bodyMeta.Cipher)
+	}
+	if iv, err = hex.DecodeString(bodyMeta.IV); err != nil {
+		return nil, nil, err
+	}
+	if bodyKey, err = DecryptValue(key, bodyMeta.BodyKey); err != nil {
+		return nil, nil, err
+	}
+	if contentType := h.Get("Content-Type"); strings.HasPrefix(contentType, EncryptedValuePrefix) {
+		plain, err := DecryptValue(key, contentType)
+		if err != nil {
+			return nil, nil, err
+		}
+		h.Set("Content-Type", string(plain))
+	}
+	if etag := h.Get(EtagHeader); etag != "" {
+		plain, err := DecryptValue(key, etag)
+		if err != nil {
+			return nil, nil, err
+		}
+		h.Set("Etag", "\""+string(plain)+"\"")
+	}
+	return bodyKey, iv, nil
+}
@@ -0,0 +1,55 @@
+package crypt
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCtrStreamOffset(t *testing.T) {
+	key, iv := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{0xff}, 16)
+	plain := bytes.Repeat([]byte("abcdefghij"), 10)
+	whole := make([]byte, len(plain))
+	stream, err := CtrStream(key, iv, 0)
+	require.Nil(t, err)
+	stream.XORKeyStream(whole, plain)
+	// Counters carry over the IV's last byte, and ranges start mid-block.
+	for _, offset := range []int64{0, 1, 15, 16, 17, 35, 99} {
+		part := make([]byte, len(plain)-int(offset))
+		stream, err := CtrStream(key, iv, offset)
+		require.Nil(t, err)
+		stream.XORKeyStream(part, plain[offset:])
+		require.Equal(t, whole[offset:], part, "offset %d", offset)
+	}
+}
+
+func TestDecryptHeaders(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	h := http.Header{"Content-Type": {"text/plain"}, "Etag": {"\"abc\""}}
+	bodyKey, iv, err := DecryptHeaders(key, h)
+	require.Nil(t, err)
+	require.Nil(t, bodyKey)
+	require.Nil(t, iv)
+	require.Equal(t, "text/plain", h.Get("Content-Type"))
+
+	wrapped, err := EncryptValue(key, bytes.Repeat([]byte{2}, 32))
+	require.Nil(t, err)
+	contentType, err := EncryptValue(key, []byte("text/secret"))
+	require.Nil(t, err)
+	etag, err := EncryptValue(key, []byte("def"))
+	require.Nil(t, err)
+	h = http.Header{"Content-Type": {contentType}, "Etag": {"\"ciphertext\""}, EtagHeader: {etag}, EtagMacHeader: {"mac"},
+		BodyMetaHeader: {`{"cipher": "AES_CTR_256", "iv": "000102030405060708090a0b0c0d0e0f", "body_key": "` + wrapped + `"}`}}
+	bodyKey, iv, err = DecryptHeaders(key, h)
+	require.Nil(t, err)
+	require.Equal(t, bytes.Repeat([]byte{2}, 32), bodyKey)
+	require.Equal(t, 16, len(iv))
+	require.Equal(t, http.Header{"Content-Type": {"text/secret"}, "Etag": {"\"def\""}}, h)
+
+	h = http.Header{BodyMetaHeader: {`{"cipher": "ROT13"}`}}
+	_, _, err = DecryptHeaders(key, h)
+	require.NotNil(t, err)
+	require.Equal(t, http.Header{}, h)
+}
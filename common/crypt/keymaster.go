@@ -0,0 +1,348 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+)
+
+// minRootSecretLen is the shortest root secret the keymaster will derive
+// keys from, in bytes.
+const minRootSecretLen = 32
+
+// Keymaster derives the keys objects and container listings are encrypted
+// with from a root secret, so only the root secret needs to be kept safe.
+type Keymaster struct {
+	rootSecret []byte
+}
+
+func (k *Keymaster) key(path string) []byte {
+	mac := hmac.New(sha256.New, k.rootSecret)
+	mac.Write([]byte(path))
+	return mac.Sum(nil)
+}
+
+// ObjectKey is the key an object's body, etag and content type are
+// encrypted with.
+func (k *Keymaster) ObjectKey(account, container, obj string) []byte {
+	return k.key("/" + account + "/" + container + "/" + obj)
+}
+
+// ContainerKey is the key the etags and content types in a container's
+// listing are encrypted with.
+func (k *Keymaster) ContainerKey(account, container string) []byte {
+	return k.key("/" + account + "/" + container)
+}
+
+// NewKeymaster loads the root secret from wherever key_source says:
+//
+//	config    encryption_root_secret, base64 encoded
+//	barbican  the secret key_id in Barbican, authenticating with Keystone
+//	kmip      the symmetric key key_id on a KMIP server
+func NewKeymaster(config conf.Section) (*Keymaster, error) {
+	var secret []byte
+	var err error
+	switch source := config.GetDefault("key_source", "config"); source {
+	case "config":
+		if secret, err = base64.StdEncoding.DecodeString(config.GetDefault("encryption_root_secret", "")); err != nil {
+			return nil, fmt.Errorf("encryption_root_secret is not valid base64: %v", err)
+		}
+	case "barbican":
+		if secret, err = barbicanRootSecret(config); err != nil {
+			return nil, fmt.Errorf("Unable to get root secret from Barbican: %v", err)
+		}
+	case "kmip":
+		if secret, err = kmipRootSecret(config); err != nil {
+			return nil, fmt.Errorf("Unable to get root secret from KMIP: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown key_source %q", source)
+	}
+	if len(secret) < minRootSecretLen {
+		return nil, fmt.Errorf("The root secret must be at least %d bytes", minRootSecretLen)
+	}
+	return &Keymaster{rootSecret: secret}, nil
+}
+
+// barbicanAuthReq is the Keystone password authentication the keymaster
+// gets its token for Barbican with.
+type barbicanAuthReq struct {
+	Auth struct {
+		Identity struct {
+			Methods  []string `json:"methods"`
+			Password struct {
+				User struct {
+					Domain struct {
+						ID string `json:"id"`
+					} `json:"domain"`
+					Name     string `json:"name"`
+					Password string `json:"password"`
+				} `json:"user"`
+			} `json:"password"`
+		} `json:"identity"`
+		Scope struct {
+			Project struct {
+				Name   string `json:"name"`
+				Domain struct {
+					ID string `json:"id"`
+				} `json:"domain"`
+			} `json:"project"`
+		} `json:"scope"`
+	} `json:"auth"`
+}
+
+// barbicanRootSecret gets a token for the configured user from Keystone and
+// then the payload of the secret key_id from Barbican.
+func barbicanRootSecret(config conf.Section) ([]byte, error) {
+	keyID := config.GetDefault("key_id", "")
+	if keyID == "" {
+		return nil, errors.New("no key_id")
+	}
+	c := &http.Client{Timeout: 10 * time.Second}
+	authReq := &barbicanAuthReq{}
+	authReq.Auth.Identity.Methods = []string{"password"}
+	authReq.Auth.Identity.Password.User.Domain.ID = config.GetDefault("user_domain_id", "default")
+	authReq.Auth.Identity.Password.User.Name = config.GetDefault("username", "swift")
+	authReq.Auth.Identity.Password.User.Password = config.GetDefault("password", "password")
+	authReq.Auth.Scope.Project.Domain.ID = config.GetDefault("project_domain_id", "default")
+	authReq.Auth.Scope.Project.Name = config.GetDefault("project_name", "service")
+	authReqBody, err := json.Marshal(authReq)
+	if err != nil {
+		return nil, err
+	}
+	authURL := strings.TrimSuffix(config.GetDefault("auth_uri", "http://127.0.0.1:5000/"), "/")
+	req, err := http.NewRequest("POST", authURL+"/v3/auth/tokens", bytes.NewBuffer(authReqBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 201 {
+		return nil, fmt.Errorf("auth token request gave status %d", resp.StatusCode)
+	}
+	barbicanURL := strings.TrimSuffix(config.GetDefault("barbican_endpoint", "http://127.0.0.1:9311/"), "/")
+	if req, err = http.NewRequest("GET", barbicanURL+"/v1/secrets/"+common.Urlencode(keyID)+"/payload", nil); err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Auth-Token", resp.Header.Get("X-Subject-Token"))
+	req.Header.Set("Accept", "application/octet-stream")
+	if resp, err = c.Do(req); err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("secret request gave status %d", resp.StatusCode)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+}
+
+// The parts of KMIP's tag-type-length-value encoding needed to Get a key.
+const (
+	kmipTagKeyBlock             = 0x420040
+	kmipTagKeyMaterial          = 0x420043
+	kmipTagKeyValue             = 0x420045
+	kmipTagBatchCount           = 0x42000D
+	kmipTagBatchItem            = 0x42000F
+	kmipTagOperation            = 0x42005C
+	kmipTagProtocolVersion      = 0x420069
+	kmipTagProtocolVersionMajor = 0x42006A
+	kmipTagProtocolVersionMinor = 0x42006B
+	kmipTagRequestHeader        = 0x420077
+	kmipTagRequestMessage       = 0x420078
+	kmipTagRequestPayload       = 0x420079
+	kmipTagResponseMessage      = 0x42007B
+	kmipTagResponsePayload      = 0x42007C
+	kmipTagResultMessage        = 0x42007D
+	kmipTagResultStatus         = 0x42007F
+	kmipTagSymmetricKey         = 0x42008F
+	kmipTagUniqueIdentifier     = 0x420094
+
+	kmipTypeStructure   = 0x01
+	kmipTypeInteger     = 0x02
+	kmipTypeEnumeration = 0x05
+	kmipTypeTextString  = 0x07
+	kmipTypeByteString  = 0x08
+
+	kmipOperationGet = 0x0A
+)
+
+// kmipItem is one decoded TTLV item; structures have children, everything
+// else a value.
+type kmipItem struct {
+	tag      int
+	typ      byte
+	value    []byte
+	children []kmipItem
+}
+
+func (i kmipItem) child(tag int) *kmipItem {
+	for n := range i.children {
+		if i.children[n].tag == tag {
+			return &i.children[n]
+		}
+	}
+	return nil
+}
+
+func (i kmipItem) encode() []byte {
+	value := i.value
+	if i.typ == kmipTypeStructure {
+		value = nil
+		for _, c := range i.children {
+			value = append(value, c.encode()...)
+		}
+	}
+	b := make([]byte, 8, 8+len(value)+7)
+	b[0], b[1], b[2] = byte(i.tag>>16), byte(i.tag>>8), byte(i.tag)
+	b[3] = i.typ
+	binary.BigEndian.PutUint32(b[4:], uint32(len(value)))
+	b = append(b, value...)
+	for len(b)%8 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func kmipInt(tag int, typ byte, v uint32) kmipItem {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return kmipItem{tag: tag, typ: typ, value: b}
+}
+
+func kmipDecode(b []byte) ([]kmipItem, error) {
+	var items []kmipItem
+	for len(b) > 0 {
+		if len(b) < 8 {
+			return nil, errors.New("truncated KMIP item")
+		}
+		item := kmipItem{tag: int(b[0])<<16 | int(b[1])<<8 | int(b[2]), typ: b[3]}
+		length := int(binary.BigEndian.Uint32(b[4:]))
+		padded := (length + 7) / 8 * 8
+		if len(b) < 8+padded {
+			return nil, errors.New("truncated KMIP item")
+		}
+		item.value = b[8 : 8+length]
+		if item.typ == kmipTypeStructure {
+			children, err := kmipDecode(item.value)
+			if err != nil {
+				return nil, err
+			}
+			item.children, item.value = children, nil
+		}
+		items = append(items, item)
+		b = b[8+padded:]
+	}
+	return items, nil
+}
+
+// kmipRootSecret Gets the raw key material of the symmetric key key_id from
+// the KMIP server, using a client certificate.
+func kmipRootSecret(config conf.Section) ([]byte, error) {
+	keyID := config.GetDefault("key_id", "")
+	if keyID == "" {
+		return nil, errors.New("no key_id")
+	}
+	tlsConf, err := common.NewClientTLSConfig(config.GetDefault("kmip_cert_file", ""), config.GetDefault("kmip_key_file", ""))
+	if err != nil {
+		return nil, err
+	}
+	host := config.GetDefault("kmip_host", "127.0.0.1")
+	tlsConf.ServerName = host
+	if caFile := config.GetDefault("kmip_ca_file", ""); caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.RootCAs = x509.NewCertPool()
+		if !tlsConf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+	}
+	conn, err := tls.Dial("tcp", net.JoinHostPort(host, config.GetDefault("kmip_port", "5696")), tlsConf)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return kmipGet(conn, keyID)
+}
+
+func kmipGet(conn io.ReadWriter, keyID string) ([]byte, error) {
+	request := kmipItem{tag: kmipTagRequestMessage, typ: kmipTypeStructure, children: []kmipItem{
+		{tag: kmipTagRequestHeader, typ: kmipTypeStructure, children: []kmipItem{
+			{tag: kmipTagProtocolVersion, typ: kmipTypeStructure, children: []kmipItem{
+				kmipInt(kmipTagProtocolVersionMajor, kmipTypeInteger, 1),
+				kmipInt(kmipTagProtocolVersionMinor, kmipTypeInteger, 2),
+			}},
+			kmipInt(kmipTagBatchCount, kmipTypeInteger, 1),
+		}},
+		{tag: kmipTagBatchItem, typ: kmipTypeStructure, children: []kmipItem{
+			kmipInt(kmipTagOperation, kmipTypeEnumeration, kmipOperationGet),
+			{tag: kmipTagRequestPayload, typ: kmipTypeStructure, children: []kmipItem{
+				{tag: kmipTagUniqueIdentifier, typ: kmipTypeTextString, value: []byte(keyID)},
+			}},
+		}},
+	}}
+	if _, err := conn.Write(request.encode()); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[4:])
+	if length > 1<<20 {
+		return nil, fmt.Errorf("KMIP response too long: %d", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return nil, err
+	}
+	items, err := kmipDecode(append(header, body...))
+	if err != nil {
+		return nil, err
+	}
+	if len(items) != 1 || items[0].tag != kmipTagResponseMessage {
+		return nil, errors.New("not a KMIP response")
+	}
+	batch := items[0].child(kmipTagBatchItem)
+	if batch == nil {
+		return nil, errors.New("no batch item in KMIP response")
+	}
+	if status := batch.child(kmipTagResultStatus); status == nil || len(status.value) != 4 || binary.BigEndian.Uint32(status.value) != 0 {
+		if msg := batch.child(kmipTagResultMessage); msg != nil {
+			return nil, fmt.Errorf("KMIP Get failed: %s", msg.value)
+		}
+		return nil, errors.New("KMIP Get failed")
+	}
+	item := batch.child(kmipTagResponsePayload)
+	for _, tag := range []int{kmipTagSymmetricKey, kmipTagKeyBlock, kmipTagKeyValue, kmipTagKeyMaterial} {
+		if item != nil {
+			item = item.child(tag)
+		}
+	}
+	if item == nil || item.typ != kmipTypeByteString {
+		return nil, errors.New("no raw symmetric key in KMIP response")
+	}
+	return item.value, nil
+}
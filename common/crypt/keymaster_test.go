@@ -0,0 +1,135 @@
+package crypt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/conf"
+)
+
+var testRootSecret = base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+
+func keymasterSection(t *testing.T, settings string) conf.Section {
+	config, err := conf.StringConfig("[filter:encryption]\n" + settings)
+	require.Nil(t, err)
+	return config.GetSection("filter:encryption")
+}
+
+func TestKeymasterConfigSecret(t *testing.T) {
+	k, err := NewKeymaster(keymasterSection(t, "encryption_root_secret = "+testRootSecret))
+	require.Nil(t, err)
+	require.Equal(t, []byte("0123456789abcdef0123456789abcdef"), k.rootSecret)
+	require.Equal(t, 32, len(k.ObjectKey("a", "c", "o")))
+	require.NotEqual(t, k.ObjectKey("a", "c", "o"), k.ObjectKey("a", "c", "o2"))
+	require.NotEqual(t, k.ObjectKey("a", "c", "o"), k.ContainerKey("a", "c"))
+
+	for _, settings := range []string{
+		"",
+		"encryption_root_secret = c2hvcnQ=",
+		"encryption_root_secret = not base64!",
+		"key_source = somewhere",
+		"key_source = barbican",
+	} {
+		_, err = NewKeymaster(keymasterSection(t, settings))
+		require.NotNil(t, err, settings)
+	}
+}
+
+func TestKeymasterBarbican(t *testing.T) {
+	keystone := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v3/auth/tokens", r.URL.Path)
+		w.Header().Set("X-Subject-Token", "servicetoken")
+		w.WriteHeader(201)
+	}))
+	defer keystone.Close()
+	barbican := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/secrets/thekey/payload" || r.Header.Get("X-Auth-Token") != "servicetoken" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write([]byte("0123456789abcdef0123456789abcdef"))
+	}))
+	defer barbican.Close()
+	settings := "key_source = barbican\nauth_uri = " + keystone.URL + "/\nbarbican_endpoint = " + barbican.URL + "\n"
+	k, err := NewKeymaster(keymasterSection(t, settings+"key_id = thekey"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("0123456789abcdef0123456789abcdef"), k.rootSecret)
+	_, err = NewKeymaster(keymasterSection(t, settings+"key_id = otherkey"))
+	require.NotNil(t, err)
+}
+
+func TestKmipEncoding(t *testing.T) {
+	item := kmipItem{tag: kmipTagRequestPayload, typ: kmipTypeStructure, children: []kmipItem{
+		{tag: kmipTagUniqueIdentifier, typ: kmipTypeTextString, value: []byte("abc")},
+		kmipInt(kmipTagOperation, kmipTypeEnumeration, kmipOperationGet),
+	}}
+	b := item.encode()
+	require.Equal(t, 0, len(b)%8)
+	require.Equal(t, []byte{0x42, 0x00, 0x79, kmipTypeStructure, 0, 0, 0, 32}, b[:8])
+	items, err := kmipDecode(b)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(items))
+	require.Equal(t, []byte("abc"), items[0].child(kmipTagUniqueIdentifier).value)
+	require.Equal(t, uint32(kmipOperationGet), binary.BigEndian.Uint32(items[0].child(kmipTagOperation).value))
+	_, err = kmipDecode(b[:20])
+	require.NotNil(t, err)
+}
+
+func TestKmipGet(t *testing.T) {
+	respond := func(items ...kmipItem) []byte {
+		return kmipItem{tag: kmipTagResponseMessage, typ: kmipTypeStructure, children: []kmipItem{
+			{tag: kmipTagBatchItem, typ: kmipTypeStructure, children: items},
+		}}.encode()
+	}
+	key := bytes.Repeat([]byte{7}, 32)
+	success := respond(
+		kmipInt(kmipTagOperation, kmipTypeEnumeration, kmipOperationGet),
+		kmipInt(kmipTagResultStatus, kmipTypeEnumeration, 0),
+		kmipItem{tag: kmipTagResponsePayload, typ: kmipTypeStructure, children: []kmipItem{
+			{tag: kmipTagUniqueIdentifier, typ: kmipTypeTextString, value: []byte("thekey")},
+			{tag: kmipTagSymmetricKey, typ: kmipTypeStructure, children: []kmipItem{
+				{tag: kmipTagKeyBlock, typ: kmipTypeStructure, children: []kmipItem{
+					{tag: kmipTagKeyValue, typ: kmipTypeStructure, children: []kmipItem{
+						{tag: kmipTagKeyMaterial, typ: kmipTypeByteString, value: key},
+					}},
+				}},
+			}},
+		}})
+	failure := respond(
+		kmipInt(kmipTagResultStatus, kmipTypeEnumeration, 1),
+		kmipItem{tag: kmipTagResultMessage, typ: kmipTypeTextString, value: []byte("no such key")})
+
+	serve := func(response []byte) (string, error) {
+		client, server := net.Pipe()
+		requested := make(chan string, 1)
+		go func() {
+			defer server.Close()
+			header := make([]byte, 8)
+			if _, err := io.ReadFull(server, header); err != nil {
+				return
+			}
+			body := make([]byte, binary.BigEndian.Uint32(header[4:]))
+			io.ReadFull(server, body)
+			items, _ := kmipDecode(append(header, body...))
+			requested <- string(items[0].child(kmipTagBatchItem).child(kmipTagRequestPayload).child(kmipTagUniqueIdentifier).value)
+			server.Write(response)
+		}()
+		secret, err := kmipGet(client, "thekey")
+		client.Close()
+		require.Equal(t, "thekey", <-requested)
+		return string(secret), err
+	}
+	secret, err := serve(success)
+	require.Nil(t, err)
+	require.Equal(t, string(key), secret)
+	_, err = serve(failure)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "no such key")
+}
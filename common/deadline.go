@@ -0,0 +1,47 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// BudgetHeader tells a backend server how many seconds are left before the
+// deadline of the client request it's serving part of.
+const BudgetHeader = "X-Backend-Request-Budget"
+
+// ErrDeadlineExceeded is returned for requests made for a client request
+// whose deadline has already passed.
+var ErrDeadlineExceeded = errors.New("client deadline exceeded")
+
+type clientDeadlineKey struct{}
+
+// WithClientDeadline returns a copy of ctx carrying the deadline of the
+// client request it's for. Requests a BackendTransport sends with it carry
+// what's left of it in their BudgetHeader, and are given up on once it
+// passes.
+func WithClientDeadline(ctx context.Context, deadline time.Time) context.Context {
+	return context.WithValue(ctx, clientDeadlineKey{}, deadline)
+}
+
+// ClientDeadline returns the client deadline ctx carries, if it has one.
+func ClientDeadline(ctx context.Context) (time.Time, bool) {
+	deadline, ok := ctx.Value(clientDeadlineKey{}).(time.Time)
+	return deadline, ok
+}
+
+// RequestBudget returns the time left in a request's BudgetHeader, if it
+// has a valid one.
+func RequestBudget(header http.Header) (time.Duration, bool) {
+	value := header.Get(BudgetHeader)
+	if value == "" {
+		return 0, false
+	}
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(seconds * float64(time.Second)), true
+}
@@ -0,0 +1,20 @@
+// +build linux,amd64 linux,arm64
+
+package fs
+
+import (
+	"os"
+	"syscall"
+)
+
+const fadvDontNeed = 4
+
+// DropCache asks the kernel to drop the file's pages from the page cache, so
+// the next read of it comes from the disk. Only clean pages are dropped, so
+// the file should be synced first.
+func DropCache(f *os.File) error {
+	if _, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, f.Fd(), 0, 0, fadvDontNeed, 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
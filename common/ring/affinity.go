@@ -0,0 +1,79 @@
+package ring
+
+import "sort"
+
+// An Affinity ranks devices for a caller, those with lower values first, like
+// those closest to it or that have been answering it fastest.
+type Affinity func(dev *Device) float64
+
+// RegionAffinity prefers devices in region.
+func RegionAffinity(region int) Affinity {
+	return func(dev *Device) float64 {
+		if dev.Region == region {
+			return 0
+		}
+		return 1
+	}
+}
+
+// ZoneAffinity prefers devices in the zone within region, then the rest of
+// region.
+func ZoneAffinity(region, zone int) Affinity {
+	return func(dev *Device) float64 {
+		if dev.Region != region {
+			return 2
+		} else if dev.Zone != zone {
+			return 1
+		}
+		return 0
+	}
+}
+
+// SortByAffinity orders devs by the first of affinities, those it ranks the
+// same by the next, and so on, like by zone and then by latency, keeping the
+// order of those they all rank the same.
+func SortByAffinity(devs []*Device, affinities ...Affinity) {
+	ranks := make(map[*Device][]float64, len(devs))
+	for _, dev := range devs {
+		for _, affinity := range affinities {
+			ranks[dev] = append(ranks[dev], affinity(dev))
+		}
+	}
+	sort.SliceStable(devs, func(i, j int) bool {
+		for k := range affinities {
+			if ranks[devs[i]][k] != ranks[devs[j]][k] {
+				return ranks[devs[i]][k] < ranks[devs[j]][k]
+			}
+		}
+		return false
+	})
+}
+
+// GetNodesByAffinity returns the primary nodes for partition ordered by
+// affinities; see SortByAffinity.
+func GetNodesByAffinity(r Ring, partition uint64, affinities ...Affinity) []*Device {
+	devs := r.GetNodes(partition)
+	SortByAffinity(devs, affinities...)
+	return devs
+}
+
+type affinityNodes struct {
+	primaries []*Device
+	more      MoreNodes
+}
+
+func (a *affinityNodes) Next() *Device {
+	if len(a.primaries) > 0 {
+		dev := a.primaries[0]
+		a.primaries = a.primaries[1:]
+		return dev
+	}
+	return a.more.Next()
+}
+
+// AffinityNodes returns all the nodes for partition, its primaries ordered by
+// affinities, so those in the caller's region can be tried first, and then
+// its handoffs, in the ring's order.
+func AffinityNodes(r Ring, partition uint64, affinities ...Affinity) MoreNodes {
+	return &affinityNodes{primaries: GetNodesByAffinity(r, partition, affinities...), more: r.GetMoreNodes(partition)}
+}
@@ -150,6 +150,9 @@ type RingBuilderDevice struct {
 	ReplicationIp   string  `pickle:"replication_ip"`
 	Parts           int64   `pickle:"parts"`
 	Id              int64   `pickle:"id"`
+	DiskType        string  `pickle:"disk_type"`
+	Capacity        int64   `pickle:"capacity"`
+	Labels          string  `pickle:"labels"`
 	tiers           [4]string
 }
 
@@ -1407,6 +1410,35 @@ func (b *RingBuilder) GetBalance() float64 {
 	return balance
 }
 
+// updateDispersion records the percentage of partitions with more replicas in some tier than repPlan allows it.
+func (b *RingBuilder) updateDispersion(repPlan map[string]replicaPlan) {
+	if b.Parts == 0 {
+		b.Dispersion = 0
+		return
+	}
+	undispersed := 0
+	for part := 0; part < b.Parts; part++ {
+		replicasAtTier := make(map[string]int)
+		for _, dev := range b.devsForPart(part) {
+			for _, tier := range b.tiersForDev(dev) {
+				replicasAtTier[tier] += 1
+			}
+		}
+		for tier, count := range replicasAtTier {
+			if plan, ok := repPlan[tier]; ok && float64(count) > plan.max {
+				undispersed += 1
+				break
+			}
+		}
+	}
+	b.Dispersion = float64(undispersed) * 100 / float64(b.Parts)
+}
+
+// GetDispersion returns the percentage of partitions, as of the last rebalance, with more replicas in some tier than that tier should hold.  Anything above 0 means some partitions could not be spread out as widely as device weights and overload allow.
+func (b *RingBuilder) GetDispersion() float64 {
+	return b.Dispersion
+}
+
 // Rebalance rebalances the ring.
 //
 // This is the main work function of the builder, as it will assign and reassing partitions to devices in the ring based on weights, distinct zones, recent reassignments, etc.
@@ -1485,7 +1517,7 @@ GATHER:
 	b.debug(fmt.Sprintf("%s rebalance plan after %d attempts.", finishStatus, gatherCount+1))
 	b.DevsChanged = false
 	b.Version += 1
-	// NOTE/TODO?: Dispersion graph isn't currently implemented
+	b.updateDispersion(repPlan)
 
 	// Figure out how many parts moved
 	changedParts := 0
@@ -1575,6 +1607,47 @@ func (b *RingBuilder) UpdateDevInfo(devId int64, newIp string, newPort int64, ne
 	return nil
 }
 
+// parseLabels turns a device's labels, as name=value pairs separated by
+// commas, into a map.
+func parseLabels(labels string) map[string]string {
+	var m map[string]string
+	for _, label := range strings.Split(labels, ",") {
+		parts := strings.SplitN(strings.TrimSpace(label), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			continue
+		}
+		if m == nil {
+			m = map[string]string{}
+		}
+		m[parts[0]] = parts[1]
+	}
+	return m
+}
+
+// SetDevMetadata sets the version 2 ring metadata of a device: its disk type,
+// its capacity in bytes, and its labels, as name=value pairs separated by
+// commas. Empty strings and a negative capacity leave them as they are.
+func (b *RingBuilder) SetDevMetadata(devId int64, diskType string, capacity int64, labels string) error {
+	if devId < 0 || devId >= int64(len(b.Devs)) || b.Devs[devId] == nil {
+		return fmt.Errorf("No device with id %d", devId)
+	}
+	for _, label := range strings.Split(labels, ",") {
+		if label = strings.TrimSpace(label); label != "" && !strings.Contains(label, "=") {
+			return fmt.Errorf("Label %q isn't of the form name=value", label)
+		}
+	}
+	if diskType != "" {
+		b.Devs[devId].DiskType = diskType
+	}
+	if capacity >= 0 {
+		b.Devs[devId].Capacity = capacity
+	}
+	if labels != "" {
+		b.Devs[devId].Labels = labels
+	}
+	return nil
+}
+
 // ChangeMinPartHours changes the value used to decide if a given partition can be moved again.  This restriction is to give the overall system enough time to settl a partition to its new location before moving it to yet another location.  While no data would be lost if a partition is moved several times quickly, it could make the data unreachable for a short period of time.
 //
 // This should be set to at least the average full partition replication time.  Starting it at 24 hours and then lowering it to what the replicator reprots as the longest partition cycle is best.
@@ -1582,6 +1655,15 @@ func (b *RingBuilder) ChangeMinPartHours(minPartHours int) {
 	b.MinPartHours = minPartHours
 }
 
+// SetOverload sets how much more than its weight says a device may be given, as a fraction, to spread partitions across failure domains when the weights alone would not.
+func (b *RingBuilder) SetOverload(overload float64) error {
+	if overload < 0 {
+		return fmt.Errorf("Overload must be non-negative.")
+	}
+	b.Overload = overload
+	return nil
+}
+
 // SetReplicas sets the number of replicas in this ring.
 //
 // If the new replica count is sufficiently different that replica2Part2Dev will change size, sets devsChanged.  This is so tools can know to write out the new ring rather than bailing out due to lack of balance change.
@@ -1613,6 +1695,9 @@ func (b *RingBuilder) GetRing() *hashRing {
 				ReplicationPort: int(b.Devs[i].ReplicationPort),
 				Weight:          b.Devs[i].Weight,
 				Zone:            int(b.Devs[i].Zone),
+				DiskType:        b.Devs[i].DiskType,
+				Capacity:        b.Devs[i].Capacity,
+				Labels:          parseLabels(b.Devs[i].Labels),
 			})
 		} else {
 			data.Devs = append(data.Devs, nil)
@@ -1713,7 +1798,7 @@ func Rebalance(builderPath string, debug bool, dryrun bool, quiet bool) (int, fl
 		return changed, balance, removed, err
 	}
 	if !quiet {
-		fmt.Printf("Changed: %d Balance: %f Removed: %d\n", changed, balance, removed)
+		fmt.Printf("Changed: %d Balance: %f Removed: %d Dispersion: %f\n", changed, balance, removed, builder.GetDispersion())
 	}
 	if dryrun {
 		fmt.Println("Dry run complete; rebalance was not saved.")
@@ -1829,6 +1914,22 @@ func SetInfo(builderPath string, devs []*RingBuilderDevice, newIp string, newPor
 	return builder.Save(builderPath)
 }
 
+// SetMetadata sets the disk type, capacity and labels of devs; see
+// SetDevMetadata.
+// Note that no locking is done here, you should call LockBuilderPath first.
+func SetMetadata(builderPath string, devs []*RingBuilderDevice, diskType string, capacity int64, labels string) error {
+	builder, err := NewRingBuilderFromFile(builderPath, false)
+	if err != nil {
+		return err
+	}
+	for _, dev := range devs {
+		if err := builder.SetDevMetadata(dev.Id, diskType, capacity, labels); err != nil {
+			return err
+		}
+	}
+	return builder.Save(builderPath)
+}
+
 // Note that no locking is done here, you should call LockBuilderPath first.
 func WriteRing(builderPath string) error {
 	builder, err := NewRingBuilderFromFile(builderPath, false)
@@ -1870,6 +1971,44 @@ func PretendMinPartHoursPassed(builderPath string) error {
 	return builder.Save(builderPath)
 }
 
+// Note that no locking is done here, you should call LockBuilderPath first.
+func SetOverload(builderPath string, overload float64) error {
+	builder, err := NewRingBuilderFromFile(builderPath, false)
+	if err != nil {
+		return err
+	}
+	if err := builder.SetOverload(overload); err != nil {
+		return err
+	}
+	return builder.Save(builderPath)
+}
+
+// Note that no locking is done here, you should call LockBuilderPath first.
+func SetReplicas(builderPath string, replicas float64) error {
+	builder, err := NewRingBuilderFromFile(builderPath, false)
+	if err != nil {
+		return err
+	}
+	if replicas < 1 {
+		return fmt.Errorf("Replica count must be at least 1.")
+	}
+	builder.SetReplicas(replicas)
+	return builder.Save(builderPath)
+}
+
+// Note that no locking is done here, you should call LockBuilderPath first.
+func SetMinPartHours(builderPath string, minPartHours int) error {
+	builder, err := NewRingBuilderFromFile(builderPath, false)
+	if err != nil {
+		return err
+	}
+	if minPartHours < 0 {
+		return fmt.Errorf("Min part hours must be non-negative.")
+	}
+	builder.ChangeMinPartHours(minPartHours)
+	return builder.Save(builderPath)
+}
+
 // Note that no locking is done here, you should call LockBuilderPath first.
 func Validate(builderPath string) error {
 	builder, err := NewRingBuilderFromFile(builderPath, false)
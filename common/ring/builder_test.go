@@ -0,0 +1,47 @@
+package ring
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRingBuilderRebalance(t *testing.T) {
+	builder, err := NewRingBuilder(8, 3, 0, false)
+	require.Nil(t, err)
+	for i := 0; i < 6; i++ {
+		_, err := builder.AddDev(&RingBuilderDevice{Id: -1, Region: 1, Zone: int64(i%3 + 1), Ip: fmt.Sprintf("127.0.0.%d", i+1), Port: 6000, Device: "sda", Weight: 100})
+		require.Nil(t, err)
+	}
+	changed, balance, _, err := builder.Rebalance()
+	require.Nil(t, err)
+	require.Nil(t, builder.Validate())
+	require.Equal(t, 3*256, changed)
+	require.True(t, balance < 1)
+	require.Equal(t, 0.0, builder.GetDispersion())
+	for part := 0; part < builder.Parts; part++ {
+		zones := map[int64]bool{}
+		for _, dev := range builder.devsForPart(part) {
+			zones[dev.Zone] = true
+		}
+		require.Len(t, zones, 3)
+	}
+
+	// With min_part_hours at 0, parts move off a removed device right away.
+	builder.RemoveDev(0, false)
+	_, _, removed, err := builder.Rebalance()
+	require.Nil(t, err)
+	require.Equal(t, 1, removed)
+	require.Nil(t, builder.Validate())
+	require.Equal(t, 0.0, builder.GetDispersion())
+}
+
+func TestRingBuilderSetOverload(t *testing.T) {
+	builder, err := NewRingBuilder(8, 3, 1, false)
+	require.Nil(t, err)
+	require.Nil(t, builder.SetOverload(0.1))
+	require.Equal(t, 0.1, builder.Overload)
+	require.NotNil(t, builder.SetOverload(-0.1))
+	require.Equal(t, 0.1, builder.Overload)
+}
@@ -0,0 +1,82 @@
+package ring
+
+import (
+	"fmt"
+	"os"
+)
+
+// composeIdRange is how many device ids each component of a composite ring
+// has to itself.
+const composeIdRange = 4096
+
+// Compose writes a ring to ringPath made up of the component rings at
+// componentPaths, each usually holding the devices, and some of the replicas,
+// for one region. They must have the same partition power, and no region can
+// be in more than one of them. The composite ring has all their devices, each
+// component's ids moved into a range of composeIdRange ids of its own in the
+// order the rings are given, and all their replicas, so each partition's
+// primaries are those it has in every component.
+//
+// Components can be rebalanced, even to change their replica counts or add
+// devices, and composed again; the others' devices keep their ids and the
+// replicas they hold stay where they were.
+func Compose(ringPath string, componentPaths ...string) error {
+	if len(componentPaths) == 0 {
+		return fmt.Errorf("No component rings given")
+	}
+	composite := &ringData{}
+	regions := map[int]string{}
+	for i, componentPath := range componentPaths {
+		component, err := LoadRingMD5(componentPath, "", "")
+		if err != nil {
+			return fmt.Errorf("Error loading %s: %v", componentPath, err)
+		}
+		data := component.(*hashRing).getData()
+		if i == 0 {
+			composite.PartShift = data.PartShift
+		} else if data.PartShift != composite.PartShift {
+			return fmt.Errorf("%s has a partition power of %d, not %d like %s", componentPath, 32-data.PartShift, 32-composite.PartShift, componentPaths[0])
+		}
+		offset := i * composeIdRange
+		if len(data.Devs) > composeIdRange || offset+len(data.Devs) > int(NONE_DEV) {
+			return fmt.Errorf("Too many devices for one ring")
+		}
+		for len(composite.Devs) < offset {
+			composite.Devs = append(composite.Devs, nil)
+		}
+		componentRegions := map[int]bool{}
+		for _, dev := range data.Devs {
+			if dev == nil {
+				composite.Devs = append(composite.Devs, nil)
+				continue
+			}
+			if other, ok := regions[dev.Region]; ok {
+				return fmt.Errorf("Region %d is in both %s and %s", dev.Region, other, componentPath)
+			}
+			componentRegions[dev.Region] = true
+			renumbered := *dev
+			renumbered.Id += offset
+			composite.Devs = append(composite.Devs, &renumbered)
+		}
+		for region := range componentRegions {
+			regions[region] = componentPath
+		}
+		for _, part2dev := range data.replica2part2devId {
+			renumbered := make([]uint16, len(part2dev))
+			for part, devId := range part2dev {
+				renumbered[part] = devId + uint16(offset)
+			}
+			composite.replica2part2devId = append(composite.replica2part2devId, renumbered)
+		}
+		composite.ReplicaCount += data.ReplicaCount
+	}
+	r := &hashRing{}
+	r.data.Store(composite)
+	// Servers may pick the ring up as soon as it's in place, so it's moved
+	// there once it's complete.
+	if err := r.Save(ringPath + ".tmp"); err != nil {
+		os.Remove(ringPath + ".tmp")
+		return err
+	}
+	return os.Rename(ringPath+".tmp", ringPath)
+}
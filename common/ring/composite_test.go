@@ -0,0 +1,87 @@
+package ring
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeRegionRing writes a ring with devCount devices in region, each partition
+// having replicaCount replicas on consecutive devices.
+func writeRegionRing(t *testing.T, pth string, region int, devCount int, replicaCount int, partShift uint64) {
+	data := &ringData{ReplicaCount: replicaCount, PartShift: partShift}
+	for i := 0; i < devCount; i++ {
+		ip := fmt.Sprintf("127.0.%d.%d", region, i)
+		data.Devs = append(data.Devs, &Device{Id: i, Device: "sda", Scheme: "http", Ip: ip, Port: 6000, Region: region, ReplicationIp: ip, ReplicationPort: 6500, Weight: 1, Zone: i})
+	}
+	for i := 0; i < replicaCount; i++ {
+		part2dev := make([]uint16, 1<<(32-partShift))
+		for part := range part2dev {
+			part2dev[part] = uint16((part + i) % devCount)
+		}
+		data.replica2part2devId = append(data.replica2part2devId, part2dev)
+	}
+	r := &hashRing{}
+	r.data.Store(data)
+	require.Nil(t, r.Save(pth))
+}
+
+func TestCompose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	writeRegionRing(t, filepath.Join(dir, "r1.ring.gz"), 1, 3, 2, 28)
+	writeRegionRing(t, filepath.Join(dir, "r2.ring.gz"), 2, 2, 1, 28)
+	ringPath := filepath.Join(dir, "object.ring.gz")
+	require.Nil(t, Compose(ringPath, filepath.Join(dir, "r1.ring.gz"), filepath.Join(dir, "r2.ring.gz")))
+
+	r, err := LoadRingMD5(ringPath, "prefix", "suffix")
+	require.Nil(t, err)
+	require.Equal(t, uint64(3), r.ReplicaCount())
+	require.Equal(t, uint64(16), r.PartitionCount())
+	ids := []int{}
+	for i, dev := range r.AllDevices() {
+		if dev != nil {
+			require.Equal(t, i, dev.Id)
+			ids = append(ids, dev.Id)
+		}
+	}
+	require.Equal(t, []int{0, 1, 2, 4096, 4097}, ids)
+	nodes := r.GetNodes(1)
+	require.Equal(t, []int{1, 2, 4097}, []int{nodes[0].Id, nodes[1].Id, nodes[2].Id})
+	require.Equal(t, []int{1, 1, 2}, []int{nodes[0].Region, nodes[1].Region, nodes[2].Region})
+
+	// The primary in region 2 comes first, then the rest, then handoffs.
+	more := AffinityNodes(r, 1, RegionAffinity(2))
+	first := more.Next()
+	require.Equal(t, 4097, first.Id)
+	seen := map[int]bool{first.Id: true}
+	for dev := more.Next(); dev != nil; dev = more.Next() {
+		require.False(t, seen[dev.Id])
+		seen[dev.Id] = true
+	}
+	require.Len(t, seen, 5)
+
+	// Adding devices to one component leaves the others' ids alone.
+	writeRegionRing(t, filepath.Join(dir, "r1.ring.gz"), 1, 4, 2, 28)
+	require.Nil(t, Compose(ringPath, filepath.Join(dir, "r1.ring.gz"), filepath.Join(dir, "r2.ring.gz")))
+	r, err = LoadRingMD5(ringPath, "prefix", "suffix")
+	require.Nil(t, err)
+	require.Equal(t, 4097, r.GetNodes(1)[2].Id)
+	require.Equal(t, "127.0.2.1", r.GetNodes(1)[2].Ip)
+
+	require.NotNil(t, Compose(ringPath, filepath.Join(dir, "r1.ring.gz"), filepath.Join(dir, "r1.ring.gz")))
+	writeRegionRing(t, filepath.Join(dir, "r3.ring.gz"), 3, 2, 1, 27)
+	require.NotNil(t, Compose(ringPath, filepath.Join(dir, "r1.ring.gz"), filepath.Join(dir, "r3.ring.gz")))
+}
+
+func TestSortByAffinity(t *testing.T) {
+	devs := []*Device{{Id: 0, Region: 2, Zone: 1}, {Id: 1, Region: 1, Zone: 2}, {Id: 2, Region: 1, Zone: 1}, {Id: 3, Region: 1, Zone: 2}}
+	latency := map[int]float64{1: 0.5, 3: 0.1}
+	SortByAffinity(devs, ZoneAffinity(1, 1), func(dev *Device) float64 { return latency[dev.Id] })
+	require.Equal(t, []int{2, 3, 1, 0}, []int{devs[0].Id, devs[1].Id, devs[2].Id, devs[3].Id})
+}
@@ -170,7 +170,11 @@ type memcacheRing struct {
 	maxFreeConnectionsPerServer int64
 	tries                       int64
 	nodeWeight                  int64
-	tracing                     bool
+	// errorLimit errors from a server within errorInterval eject it from
+	// the ring for errorInterval.
+	errorLimit    int64
+	errorInterval time.Duration
+	tracing       bool
 }
 
 func NewMemcacheRing(confPath string) (*memcacheRing, error) {
@@ -192,6 +196,8 @@ func NewMemcacheRingFromConfig(config conf.Config) (*memcacheRing, error) {
 	ring.responseTimeout = config.GetInt(confSection, "response_timeout", 100)
 	ring.nodeWeight = config.GetInt(confSection, "node_weight", 50)
 	ring.tries = config.GetInt(confSection, "tries", 5)
+	ring.errorLimit = config.GetInt(confSection, "error_suppression_limit", 10)
+	ring.errorInterval = time.Duration(config.GetFloat(confSection, "error_suppression_interval", 60) * float64(time.Second))
 	for _, s := range strings.Split(config.GetDefault(confSection, "memcache_servers", ""), ",") {
 		err := ring.addServer(s)
 		if err != nil {
@@ -219,6 +225,8 @@ func (ring *memcacheRing) addServer(serverString string) error {
 	if err != nil {
 		return err
 	}
+	server.errorLimit = ring.errorLimit
+	server.errorInterval = ring.errorInterval
 	ring.servers[serverString] = server
 	for i := 0; int64(i) < ring.nodeWeight; i++ {
 		ring.ring[hashKey(fmt.Sprintf("%s-%d", serverString, i))] = serverString
@@ -397,18 +405,21 @@ type serverIterator struct {
 	key     string
 	current int
 	servers []string
+	// ejected counts the servers passed over for being ejected, which
+	// don't use up a try.
+	ejected int
 }
 
 func (ring *memcacheRing) newServerIterator(key string) *serverIterator {
-	return &serverIterator{ring, hashKey(key), -1, make([]string, 0)}
+	return &serverIterator{ring, hashKey(key), -1, make([]string, 0), 0}
 }
 
 func (it *serverIterator) next() bool {
-	return int64(len(it.servers)) < it.ring.tries
+	return int64(len(it.servers)-it.ejected) < it.ring.tries && len(it.servers) < len(it.ring.servers)
 }
 
 func (it *serverIterator) value() *server {
-	if int64(len(it.servers)) > it.ring.tries {
+	if !it.next() {
 		panic("serverIterator.Value() called when there are no more tries left")
 	}
 	if it.current == -1 {
@@ -430,9 +441,14 @@ func (ring *memcacheRing) loop(key string, fn func(*connection) error) error {
 	it := ring.newServerIterator(key)
 	for it.next() {
 		server := it.value()
+		if server.ejected() {
+			it.ejected++
+			continue
+		}
 		var conn *connection
 		conn, err = server.getConnection()
 		if err != nil {
+			server.recordError()
 			continue
 		}
 		err = fn(conn)
@@ -442,6 +458,7 @@ func (ring *memcacheRing) loop(key string, fn func(*connection) error) error {
 		} else if err == CacheMiss {
 			return err
 		}
+		server.recordError()
 	}
 	return err
 }
@@ -454,6 +471,10 @@ type server struct {
 	requestTimeout     time.Duration
 	maxFreeConnections int64
 	connections        []*connection
+	errorLimit         int64
+	errorInterval      time.Duration
+	errors             []time.Time
+	ejectedUntil       time.Time
 }
 
 func newServer(serverString string, connTimeout int64, requestTimeout int64, maxFreeConnections int64) (*server, error) {
@@ -482,6 +503,35 @@ func newServer(serverString string, connTimeout int64, requestTimeout int64, max
 	return &s, nil
 }
 
+// recordError ejects the server once it's had errorLimit errors within
+// errorInterval.
+func (s *server) recordError() {
+	if s.errorLimit <= 0 {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	recent := s.errors[:0]
+	for _, t := range s.errors {
+		if now.Sub(t) < s.errorInterval {
+			recent = append(recent, t)
+		}
+	}
+	s.errors = append(recent, now)
+	if int64(len(s.errors)) >= s.errorLimit {
+		s.errors = s.errors[:0]
+		s.ejectedUntil = now.Add(s.errorInterval)
+	}
+}
+
+// ejected reports whether the server is being skipped for its errors.
+func (s *server) ejected() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return time.Now().Before(s.ejectedUntil)
+}
+
 func (s *server) connectionCount() uint64 {
 	return uint64(len(s.connections))
 }
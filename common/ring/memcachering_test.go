@@ -361,3 +361,44 @@ func testExpiration(t *testing.T, ring *memcacheRing) {
 		}
 	}
 }
+
+func TestEjectDeadServers(t *testing.T) {
+	live, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer live.Close()
+	go func() {
+		for {
+			if _, err := live.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	iniFile := conf.Config{File: make(ini.File)}
+	section := iniFile.Section(confSection)
+	section["memcache_servers"] = live.Addr().String() + "," + deadAddr
+	section["error_suppression_limit"] = "2"
+	section["error_suppression_interval"] = "60"
+	ring, err := NewMemcacheRingFromConfig(iniFile)
+	assert.Nil(t, err)
+	ok := func(*connection) error { return nil }
+	for i := 0; i < 100 && !ring.servers[deadAddr].ejected(); i++ {
+		assert.Nil(t, ring.loop(fmt.Sprintf("key%d", i), ok))
+	}
+	assert.True(t, ring.servers[deadAddr].ejected())
+	assert.False(t, ring.servers[live.Addr().String()].ejected())
+
+	// An ejected server doesn't use up a try.
+	ring.tries = 1
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, ring.loop(fmt.Sprintf("key%d", i), ok))
+	}
+
+	// It's tried again once the interval is up.
+	ring.servers[deadAddr].ejectedUntil = time.Now()
+	assert.False(t, ring.servers[deadAddr].ejected())
+}
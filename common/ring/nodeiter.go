@@ -0,0 +1,72 @@
+package ring
+
+import "sync"
+
+// NodeIterOptions says which of a partition's nodes a node iterator yields.
+type NodeIterOptions struct {
+	// HandoffDepth is how many handoffs are looked at, including any that are
+	// excluded, with 0 for as many as the ring has.
+	HandoffDepth int
+	// Exclude, if set, says which devices to skip, like those in a region or
+	// zone that's down.
+	Exclude func(dev *Device) bool
+}
+
+// ExcludeRegion returns an Exclude function that skips devices in region.
+func ExcludeRegion(region int) func(dev *Device) bool {
+	return func(dev *Device) bool { return dev.Region == region }
+}
+
+// ExcludeZone returns an Exclude function that skips devices in the zone
+// within region.
+func ExcludeZone(region, zone int) func(dev *Device) bool {
+	return func(dev *Device) bool { return dev.Region == region && dev.Zone == zone }
+}
+
+type nodeIter struct {
+	lock      sync.Mutex
+	primaries []*Device
+	more      MoreNodes
+	handoffs  int
+	opts      NodeIterOptions
+}
+
+func (n *nodeIter) excluded(dev *Device) bool {
+	return n.opts.Exclude != nil && n.opts.Exclude(dev)
+}
+
+func (n *nodeIter) Next() *Device {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for len(n.primaries) > 0 {
+		dev := n.primaries[0]
+		n.primaries = n.primaries[1:]
+		if !n.excluded(dev) {
+			return dev
+		}
+	}
+	for n.more != nil && (n.opts.HandoffDepth <= 0 || n.handoffs < n.opts.HandoffDepth) {
+		dev := n.more.Next()
+		if dev == nil {
+			return nil
+		}
+		n.handoffs++
+		if !n.excluded(dev) {
+			return dev
+		}
+	}
+	return nil
+}
+
+// NewNodeIter returns an iterator over the nodes for partition: its
+// primaries, in the ring's order, and then its handoffs, in the order
+// GetMoreNodes gives them, which is the same each time. Handoffs are only
+// worked out as they're needed.
+func NewNodeIter(r Ring, partition uint64, opts NodeIterOptions) MoreNodes {
+	return &nodeIter{primaries: r.GetNodes(partition), more: r.GetMoreNodes(partition), opts: opts}
+}
+
+// NewHandoffIter is like NewNodeIter, but only yields the handoffs.
+func NewHandoffIter(r Ring, partition uint64, opts NodeIterOptions) MoreNodes {
+	return &nodeIter{more: r.GetMoreNodes(partition), opts: opts}
+}
@@ -0,0 +1,42 @@
+package ring
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func iterIds(more MoreNodes) []int {
+	var ids []int
+	for dev := more.Next(); dev != nil; dev = more.Next() {
+		ids = append(ids, dev.Id)
+	}
+	return ids
+}
+
+func TestNodeIter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	ringPath := filepath.Join(dir, "object.ring.gz")
+	writeRegionRing(t, ringPath, 1, 5, 2, 28)
+	r, err := LoadRingMD5(ringPath, "prefix", "suffix")
+	require.Nil(t, err)
+
+	ids := iterIds(NewNodeIter(r, 1, NodeIterOptions{}))
+	require.Len(t, ids, 5)
+	require.Equal(t, []int{1, 2}, ids[:2])
+	require.Equal(t, ids, iterIds(NewNodeIter(r, 1, NodeIterOptions{})))
+	require.Equal(t, ids[2:], iterIds(NewHandoffIter(r, 1, NodeIterOptions{})))
+	require.Equal(t, ids[:3], iterIds(NewNodeIter(r, 1, NodeIterOptions{HandoffDepth: 1})))
+
+	// Excluded handoffs still count towards the depth.
+	excluded := ids[2]
+	exclude := func(dev *Device) bool { return dev.Id == excluded || dev.Zone == 2 }
+	require.Equal(t, []int{1, ids[3]}, iterIds(NewNodeIter(r, 1, NodeIterOptions{HandoffDepth: 2, Exclude: exclude})))
+	require.Equal(t, []int{2}, iterIds(NewNodeIter(r, 1, NodeIterOptions{HandoffDepth: -1, Exclude: ExcludeZone(1, 1)}))[:1])
+	require.Nil(t, iterIds(NewNodeIter(r, 1, NodeIterOptions{Exclude: ExcludeRegion(1)})))
+}
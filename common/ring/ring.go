@@ -23,6 +23,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
@@ -63,6 +64,11 @@ type Device struct {
 	ReplicationPort int     `json:"replication_port"`
 	Weight          float64 `json:"weight"`
 	Zone            int     `json:"zone"`
+	// DiskType, Capacity in bytes, and Labels naming the device's failure
+	// domains, like its rack or power feed, are only in version 2 rings.
+	DiskType string            `json:"disk_type,omitempty"`
+	Capacity int64             `json:"capacity,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
 }
 
 type RingMD5 interface {
@@ -84,12 +90,68 @@ type ringData struct {
 }
 
 type hashRing struct {
-	data    atomic.Value
-	path    string
-	prefix  string
-	suffix  string
-	mtime   time.Time
-	calcMD5 bool
+	data   atomic.Value
+	path   string
+	prefix string
+	suffix string
+	mtime  time.Time
+	// notify has changes to the ring, once it's loaded, passed on to the
+	// functions given to OnChange.
+	notify bool
+}
+
+// A Change is a reloaded ring that differs from the one it replaced.
+type Change struct {
+	Path        string
+	MD5         string
+	PreviousMD5 string
+	// PartsMoved is how many partition replicas are assigned to a different
+	// device than before.
+	PartsMoved int
+}
+
+var changeListenersLock sync.Mutex
+var changeListeners []func(Change)
+
+// OnChange has f called whenever a ring loaded with GetRing is reloaded with
+// different contents.
+func OnChange(f func(Change)) {
+	changeListenersLock.Lock()
+	defer changeListenersLock.Unlock()
+	changeListeners = append(changeListeners, f)
+}
+
+func notifyChange(change Change) {
+	changeListenersLock.Lock()
+	listeners := changeListeners
+	changeListenersLock.Unlock()
+	for _, f := range listeners {
+		f(change)
+	}
+}
+
+// partsMoved counts the partition replicas assigned to different devices in
+// two versions of a ring, counting all of those added or dropped if the
+// replica or partition counts differ.
+func partsMoved(prev, cur *ringData) int {
+	moved := 0
+	for i := 0; i < len(prev.replica2part2devId) || i < len(cur.replica2part2devId); i++ {
+		if i >= len(prev.replica2part2devId) || i >= len(cur.replica2part2devId) || len(prev.replica2part2devId[i]) != len(cur.replica2part2devId[i]) {
+			if i < len(prev.replica2part2devId) {
+				moved += len(prev.replica2part2devId[i])
+			}
+			if i < len(cur.replica2part2devId) {
+				moved += len(cur.replica2part2devId[i])
+			}
+			continue
+		}
+		for j, devId := range cur.replica2part2devId[i] {
+			if prev.replica2part2devId[i][j] != devId {
+				moved++
+			}
+		}
+	}
+	return moved
 }
 
 type regionZone struct {
@@ -119,6 +181,10 @@ func (d *Device) Active() bool {
 	return d != nil && d.Weight >= 0
 }
 
+func (d *Device) hasMetadata() bool {
+	return d != nil && (d.DiskType != "" || d.Capacity != 0 || len(d.Labels) > 0)
+}
+
 func (r *hashRing) getData() *ringData {
 	return r.data.Load().(*ringData)
 }
@@ -289,11 +355,17 @@ func (r *hashRing) RingMatching(md5 string) RingMD5 {
 }
 
 func (r *hashRing) Reload() error {
+	return r.reload(false)
+}
+
+// reload loads the ring's file, unless it's unchanged since it was last loaded
+// and force is false.
+func (r *hashRing) reload(force bool) error {
 	fi, err := os.Stat(r.path)
 	if err != nil {
 		return err
 	}
-	if fi.ModTime() == r.mtime {
+	if fi.ModTime() == r.mtime && !force {
 		return nil
 	}
 	data := &ringData{}
@@ -302,41 +374,49 @@ func (r *hashRing) Reload() error {
 		return err
 	}
 	defer fp.Close()
-	if r.calcMD5 {
-		h := md5.New()
-		if _, err := io.Copy(h, fp); err != nil {
-			return err
-		}
-		data.md5 = fmt.Sprintf("%x", h.Sum(nil))
-		fp.Seek(0, 0)
-	}
-	gz, err := gzip.NewReader(fp)
+	// The md5 is worked out as the file's read, rather than reading it twice.
+	h := md5.New()
+	src := io.TeeReader(fp, h)
+	gz, err := gzip.NewReader(src)
 	if err != nil {
 		return err
 	}
 	magicBuf := make([]byte, 4)
-	io.ReadFull(gz, magicBuf)
-	if string(magicBuf) != "R1NG" {
+	if _, err := io.ReadFull(gz, magicBuf); err != nil || string(magicBuf) != "R1NG" {
 		return errors.New("Bad magic string")
 	}
 	var ringVersion uint16
-	binary.Read(gz, binary.BigEndian, &ringVersion)
-	if ringVersion != 1 {
+	if err := binary.Read(gz, binary.BigEndian, &ringVersion); err != nil {
+		return err
+	}
+	if ringVersion != 1 && ringVersion != 2 {
 		return fmt.Errorf("Unknown ring version %d", ringVersion)
 	}
 	var json_len uint32
-	binary.Read(gz, binary.BigEndian, &json_len)
+	if err := binary.Read(gz, binary.BigEndian, &json_len); err != nil {
+		return err
+	}
 	jsonBuf := make([]byte, json_len)
-	io.ReadFull(gz, jsonBuf)
+	if _, err := io.ReadFull(gz, jsonBuf); err != nil {
+		return err
+	}
 	if err := json.Unmarshal(jsonBuf, data); err != nil {
 		return err
 	}
 	partitionCount := 1 << (32 - data.PartShift)
 	for i := 0; i < data.ReplicaCount; i++ {
-		part2dev := make([]uint16, partitionCount)
-		binary.Read(gz, binary.LittleEndian, &part2dev)
+		part2dev, err := readPart2Dev(gz, partitionCount, len(data.Devs))
+		if err != nil {
+			return fmt.Errorf("Error reading replica %d of ring: %v", i, err)
+		}
 		data.replica2part2devId = append(data.replica2part2devId, part2dev)
 	}
+	// Whatever follows the tables still counts towards the md5.
+	io.Copy(ioutil.Discard, gz)
+	if _, err := io.Copy(ioutil.Discard, src); err != nil {
+		return err
+	}
+	data.md5 = fmt.Sprintf("%x", h.Sum(nil))
 	regionCount := make(map[int]bool)
 	zoneCount := make(map[regionZone]bool)
 	ipPortCount := make(map[ipPort]bool)
@@ -361,14 +441,54 @@ func (r *hashRing) Reload() error {
 	data.zoneCount = len(zoneCount)
 	data.ipPortCount = len(ipPortCount)
 	r.mtime = fi.ModTime()
+	prev, _ := r.data.Load().(*ringData)
 	r.data.Store(data)
+	if r.notify && prev != nil && prev.md5 != data.md5 {
+		notifyChange(Change{Path: r.path, MD5: data.md5, PreviousMD5: prev.md5, PartsMoved: partsMoved(prev, data)})
+	}
 	return nil
 }
 
-func (r *hashRing) reloader() error {
+// readPart2Dev reads a replica's partition to device table a chunk at a time,
+// so loading a large ring doesn't hold the table twice over.
+func readPart2Dev(r io.Reader, partitionCount int, devCount int) ([]uint16, error) {
+	part2dev := make([]uint16, partitionCount)
+	buf := make([]byte, 64*1024)
+	for i := 0; i < partitionCount; {
+		n := len(buf) / 2
+		if partitionCount-i < n {
+			n = partitionCount - i
+		}
+		if _, err := io.ReadFull(r, buf[:n*2]); err != nil {
+			return nil, err
+		}
+		for j := 0; j < n; j++ {
+			devId := binary.LittleEndian.Uint16(buf[j*2:])
+			if int(devId) >= devCount {
+				return nil, fmt.Errorf("partition %d assigned to unknown device %d", i+j, devId)
+			}
+			part2dev[i+j] = devId
+		}
+		i += n
+	}
+	return part2dev, nil
+}
+
+// reloader reloads the ring whenever changed says its file was written or
+// replaced, and every reloadTime in case that's missed or can't be watched for.
+func (r *hashRing) reloader(changed <-chan struct{}) {
 	for {
-		time.Sleep(reloadTime)
-		r.Reload()
+		select {
+		case _, ok := <-changed:
+			if !ok {
+				changed = nil
+				continue
+			}
+			// A file rewritten quickly can keep the same mtime.
+			r.reload(true)
+		case <-time.After(reloadTime):
+			r.Reload()
+		}
 	}
 }
 
@@ -450,18 +570,20 @@ func LoadRing(path string, prefix string, suffix string) (Ring, error) {
 	defer loadedRingsLock.Unlock()
 	ring := loadedRings[path]
 	if ring == nil {
-		ring = &hashRing{prefix: prefix, suffix: suffix, path: path, mtime: time.Unix(0, 0)}
+		ring = &hashRing{prefix: prefix, suffix: suffix, path: path, mtime: time.Unix(0, 0), notify: true}
 		if err := ring.Reload(); err != nil {
 			return nil, err
 		}
-		go ring.reloader()
+		// Without a watch, changed is nil and the ring is only polled.
+		changed, _ := watchRingFile(path)
+		go ring.reloader(changed)
 		loadedRings[path] = ring
 	}
 	return ring, nil
 }
 
 func LoadRingMD5(path string, prefix string, suffix string) (RingMD5, error) {
-	ring := &hashRing{prefix: prefix, suffix: suffix, path: path, mtime: time.Unix(0, 0), calcMD5: true}
+	ring := &hashRing{prefix: prefix, suffix: suffix, path: path, mtime: time.Unix(0, 0)}
 	if err := ring.Reload(); err != nil {
 		return nil, err
 	}
@@ -480,11 +602,17 @@ func (r *hashRing) Save(filename string) error {
 	defer gz.Close()
 	// Write out the magic string
 	_, err = gz.Write([]byte("R1NG"))
-	// Write out the version (1)
+	// Write out the version: 2 if any device has metadata, which older
+	// readers, swift's included, don't know about, and 1 otherwise.
+	data := r.getData()
 	ringVersion := uint16(1)
+	for _, dev := range data.Devs {
+		if dev.hasMetadata() {
+			ringVersion = 2
+		}
+	}
 	binary.Write(gz, binary.BigEndian, &ringVersion)
 	// Generate the json data
-	data := r.getData()
 	dataBuf, err := json.Marshal(data)
 	if err != nil {
 		return err
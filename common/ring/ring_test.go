@@ -17,12 +17,14 @@ package ring
 
 import (
 	"compress/gzip"
+	"crypto/md5"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -167,6 +169,43 @@ func TestRingReload(t *testing.T) {
 	require.Equal(t, uint64(30), ring.getData().PartShift)
 }
 
+func TestRingChangeNotified(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	ringPath := filepath.Join(dir, "object.ring.gz")
+	writeRing := func(withANil int) {
+		fp, err := os.Create(ringPath + ".tmp")
+		require.Nil(t, err)
+		require.Nil(t, writeARing(fp, 4, 1, 30, withANil))
+		require.Nil(t, fp.Close())
+		require.Nil(t, os.Rename(ringPath+".tmp", ringPath))
+	}
+	writeRing(-1)
+	changes := make(chan Change, 1)
+	OnChange(func(change Change) {
+		if change.Path == ringPath {
+			changes <- change
+		}
+	})
+	r, err := LoadRing(ringPath, "prefix", "suffix")
+	require.Nil(t, err)
+	prevMD5 := r.(*hashRing).MD5()
+
+	// Without its second device, the partition it had goes to the first.
+	writeRing(1)
+	select {
+	case change := <-changes:
+		require.Equal(t, prevMD5, change.PreviousMD5)
+		require.Equal(t, r.(*hashRing).MD5(), change.MD5)
+		require.NotEqual(t, change.PreviousMD5, change.MD5)
+		require.Equal(t, 1, change.PartsMoved)
+		require.Equal(t, 0, r.GetNodes(1)[0].Id)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Ring change not noticed")
+	}
+}
+
 func TestCounts(t *testing.T) {
 	fp, err := ioutil.TempFile("", "")
 	require.Nil(t, err)
@@ -177,3 +216,59 @@ func TestCounts(t *testing.T) {
 	require.Equal(t, uint64(2), r.ReplicaCount())
 	require.Equal(t, uint64(8), r.PartitionCount())
 }
+
+func TestRingV2Metadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	builder, err := NewRingBuilder(4, 1, 0, false)
+	require.Nil(t, err)
+	_, err = builder.AddDev(&RingBuilderDevice{Id: -1, Region: 1, Zone: 1, Ip: "127.0.0.1", Port: 6000, Device: "sda", Weight: 1, Scheme: "http"})
+	require.Nil(t, err)
+	_, _, _, err = builder.Rebalance()
+	require.Nil(t, err)
+	ringPath := dir + "/object.ring.gz"
+
+	// Rings without metadata stay version 1, for readers that only know it.
+	require.Nil(t, builder.GetRing().Save(ringPath))
+	ring, err := LoadRingMD5(ringPath, "prefix", "suffix")
+	require.Nil(t, err)
+	require.Equal(t, "", ring.AllDevices()[0].DiskType)
+	fp, err := os.Open(ringPath)
+	require.Nil(t, err)
+	gz, err := gzip.NewReader(fp)
+	require.Nil(t, err)
+	header := make([]byte, 6)
+	_, err = io.ReadFull(gz, header)
+	fp.Close()
+	require.Nil(t, err)
+	require.Equal(t, uint16(1), binary.BigEndian.Uint16(header[4:]))
+
+	require.NotNil(t, builder.SetDevMetadata(0, "ssd", 1<<40, "rack"))
+	require.Nil(t, builder.SetDevMetadata(0, "ssd", 1<<40, "rack=r1, power=a"))
+	require.Nil(t, builder.GetRing().Save(ringPath))
+	ring, err = LoadRingMD5(ringPath, "prefix", "suffix")
+	require.Nil(t, err)
+	dev := ring.AllDevices()[0]
+	require.Equal(t, "ssd", dev.DiskType)
+	require.Equal(t, int64(1<<40), dev.Capacity)
+	require.Equal(t, map[string]string{"rack": "r1", "power": "a"}, dev.Labels)
+	require.Equal(t, 1, len(ring.GetNodes(3)))
+	contents, err := ioutil.ReadFile(ringPath)
+	require.Nil(t, err)
+	require.Equal(t, fmt.Sprintf("%x", md5.Sum(contents)), ring.MD5())
+}
+
+func TestLoadRingRejectsBadTables(t *testing.T) {
+	fp, err := ioutil.TempFile("", "")
+	require.Nil(t, err)
+	defer fp.Close()
+	defer os.RemoveAll(fp.Name())
+	require.Nil(t, writeARing(fp, 4, 2, 29, -1))
+	info, err := fp.Stat()
+	require.Nil(t, err)
+	// A ring cut short isn't loaded with the rest of its tables zeroed.
+	require.Nil(t, fp.Truncate(info.Size()-8))
+	_, err = LoadRingMD5(fp.Name(), "prefix", "suffix")
+	require.NotNil(t, err)
+}
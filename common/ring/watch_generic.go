@@ -0,0 +1,11 @@
+// +build !linux
+
+package ring
+
+import "errors"
+
+// watchRingFile isn't supported here, so rings are only reloaded as they're
+// polled.
+func watchRingFile(pth string) (<-chan struct{}, error) {
+	return nil, errors.New("Watching ring files isn't supported on this platform")
+}
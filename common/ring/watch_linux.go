@@ -0,0 +1,55 @@
+// +build linux
+
+package ring
+
+import (
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// watchRingFile returns a channel that's sent to whenever the file at pth is
+// written or another is moved into its place, and closed if that can no longer
+// be watched for. It watches the file's directory, so it carries on seeing a
+// file that's been replaced, as ring files usually are.
+func watchRingFile(pth string) (<-chan struct{}, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := syscall.InotifyAddWatch(fd, filepath.Dir(pth), syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	name := filepath.Base(pth)
+	changed := make(chan struct{}, 1)
+	go func() {
+		defer syscall.Close(fd)
+		defer close(changed)
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := syscall.Read(fd, buf)
+			if err == syscall.EINTR {
+				continue
+			} else if err != nil || n <= 0 {
+				return
+			}
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+				event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				start := offset + syscall.SizeofInotifyEvent
+				offset = start + int(event.Len)
+				if offset > n {
+					break
+				}
+				if strings.TrimRight(string(buf[start:offset]), "\x00") == name {
+					select {
+					case changed <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}
+	}()
+	return changed, nil
+}
@@ -0,0 +1,79 @@
+package common
+
+import (
+	"sort"
+	"strings"
+)
+
+// ShardAccountPrefix starts the name of the account a sharded container's
+// shards are kept in, which is the prefix followed by the root container's
+// account.
+const ShardAccountPrefix = ".shards_"
+
+// The states of a shard range. A root container's ranges are created when it
+// decides to shard, and are all made active once the objects in them have
+// been copied to the shards. Until then the root container answers for them.
+const (
+	ShardStateCreated = "created"
+	ShardStateActive  = "active"
+)
+
+// ShardRange is one slice of a sharded container's namespace, holding the
+// names greater than Lower and no greater than Upper. An empty Lower or
+// Upper leaves that end of the range open.
+type ShardRange struct {
+	Account   string `json:"account"`
+	Container string `json:"container"`
+	Lower     string `json:"lower"`
+	Upper     string `json:"upper"`
+	State     string `json:"state"`
+	// Timestamp is when the bounds and state were last changed. Updates to
+	// just the counts leave it empty.
+	Timestamp string `json:"timestamp"`
+	// ObjectCount and BytesUsed are reported by the shard, as of
+	// MetaTimestamp.
+	ObjectCount   int64  `json:"object_count"`
+	BytesUsed     int64  `json:"bytes_used"`
+	MetaTimestamp string `json:"meta_timestamp"`
+}
+
+// Includes returns true if the object name belongs in the range.
+func (r *ShardRange) Includes(name string) bool {
+	return name > r.Lower && (r.Upper == "" || name <= r.Upper)
+}
+
+// ShardAccount returns the account the account's shard containers are in.
+func ShardAccount(account string) string {
+	return ShardAccountPrefix + account
+}
+
+// IsShardAccount returns true if the account holds shard containers.
+func IsShardAccount(account string) bool {
+	return strings.HasPrefix(account, ShardAccountPrefix)
+}
+
+// SortShardRanges puts shard ranges in namespace order.
+func SortShardRanges(ranges []*ShardRange) {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Lower < ranges[j].Lower })
+}
+
+// FindShardRange returns the range the object name belongs in, or nil.
+func FindShardRange(ranges []*ShardRange, name string) *ShardRange {
+	for _, r := range ranges {
+		if r.Includes(name) {
+			return r
+		}
+	}
+	return nil
+}
+
+// ShardRangesActive returns true if there are shard ranges and all of them
+// are active, meaning the shards answer for the container.
+func ShardRangesActive(ranges []*ShardRange) bool {
+	for _, r := range ranges {
+		if r.State != ShardStateActive {
+			return false
+		}
+	}
+	return len(ranges) > 0
+}
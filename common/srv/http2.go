@@ -0,0 +1,148 @@
+package srv
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/troubling/hummingbird/common/conf"
+	"golang.org/x/net/http2"
+)
+
+// HTTP2Config says how a server serves HTTP/2: over TLS to clients that ask
+// for it, and in the clear to clients that start a connection with the
+// HTTP/2 preface. Zero values are the http2 package's defaults.
+type HTTP2Config struct {
+	Disabled                     bool
+	MaxConcurrentStreams         uint32
+	MaxUploadBufferPerStream     int32
+	MaxUploadBufferPerConnection int32
+}
+
+// NewHTTP2Config reads a server's HTTP/2 settings from its config section.
+func NewHTTP2Config(section conf.Section) HTTP2Config {
+	return HTTP2Config{
+		Disabled:                     !section.GetBool("http2", true),
+		MaxConcurrentStreams:         uint32(section.GetInt("http2_max_concurrent_streams", 0)),
+		MaxUploadBufferPerStream:     int32(section.GetInt("http2_stream_window", 0)),
+		MaxUploadBufferPerConnection: int32(section.GetInt("http2_connection_window", 0)),
+	}
+}
+
+func (c HTTP2Config) server() *http2.Server {
+	return &http2.Server{
+		MaxConcurrentStreams:         c.MaxConcurrentStreams,
+		MaxUploadBufferPerStream:     c.MaxUploadBufferPerStream,
+		MaxUploadBufferPerConnection: c.MaxUploadBufferPerConnection,
+	}
+}
+
+// cleartextHTTP2 serves HTTP/2 connections made without TLS by clients that
+// know the server speaks it, passing everything else on to next. The
+// connections it takes over are no longer the http.Server's, so it keeps
+// track of them itself; they're told to finish up when the server shuts down.
+type cleartextHTTP2 struct {
+	h2     *http2.Server
+	server *http.Server
+	next   http.Handler
+	conns  sync.WaitGroup
+}
+
+func newCleartextHTTP2(server *http.Server, h2 *http2.Server, next http.Handler) (*cleartextHTTP2, error) {
+	// This has the server's Shutdown send every HTTP/2 connection a GOAWAY.
+	if err := http2.ConfigureServer(server, h2); err != nil {
+		return nil, err
+	}
+	return &cleartextHTTP2{h2: h2, server: server, next: next}, nil
+}
+
+func (c *cleartextHTTP2) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	// The HTTP/1 server reads the first line of the preface as a request.
+	if request.Method != "PRI" || request.URL.Path != "*" || request.Proto != "HTTP/2.0" || len(request.Header) != 0 {
+		c.next.ServeHTTP(writer, request)
+		return
+	}
+	hijacker, ok := writer.(http.Hijacker)
+	if !ok {
+		http.Error(writer, "HTTP/2 not supported", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	c.conns.Add(1)
+	defer c.conns.Done()
+	rest := make([]byte, len("SM\r\n\r\n"))
+	if _, err := io.ReadFull(rw, rest); err != nil || string(rest) != "SM\r\n\r\n" {
+		conn.Close()
+		return
+	}
+	c.h2.ServeConn(&prefacedConn{Conn: conn, r: io.MultiReader(strings.NewReader(http2.ClientPreface), rw)},
+		&http2.ServeConnOpts{Handler: c.next, BaseConfig: c.server})
+}
+
+// wait returns once every HTTP/2 connection taken over has closed, or with
+// ctx's error if it's done first.
+func (c *cleartextHTTP2) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		c.conns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// A prefacedConn gives the http2 package back the preface, and anything
+// buffered after it, that the HTTP/1 server read.
+type prefacedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefacedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// NewCleartextHTTP2Transport returns a transport that sends requests over
+// HTTP/2 without TLS, for backend servers known to support it, with the
+// requests to each server sharing one connection. The http2 package can only
+// wait for a 100 Continue when it's configured over TLS, so requests that
+// expect one, like object PUTs, go through h1 instead.
+func NewCleartextHTTP2Transport(h1 *http.Transport) http.RoundTripper {
+	dial := h1.Dial
+	if dial == nil {
+		dial = net.Dial
+	}
+	return &cleartextHTTP2Transport{
+		h1: h1,
+		h2: &http2.Transport{
+			DisableCompression: h1.DisableCompression,
+			AllowHTTP:          true,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return dial(network, addr)
+			},
+		},
+	}
+}
+
+type cleartextHTTP2Transport struct {
+	h1 *http.Transport
+	h2 *http2.Transport
+}
+
+func (t *cleartextHTTP2Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if strings.Contains(strings.ToLower(req.Header.Get("Expect")), "100-continue") {
+		return t.h1.RoundTrip(req)
+	}
+	return t.h2.RoundTrip(req)
+}
@@ -0,0 +1,118 @@
+package srv
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/conf"
+)
+
+func TestCleartextHTTP2(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte(r.Proto + " " + string(body)))
+	})
+	server := &http.Server{}
+	h2c, err := newCleartextHTTP2(server, HTTP2Config{}.server(), handler)
+	require.Nil(t, err)
+	server.Handler = h2c
+	go server.Serve(l)
+	url := "http://" + l.Addr().String() + "/"
+
+	client := &http.Client{Transport: NewCleartextHTTP2Transport(&http.Transport{ExpectContinueTimeout: time.Minute})}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Post(url, "text/plain", strings.NewReader("hello"))
+		require.Nil(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.Nil(t, err)
+		require.Equal(t, "HTTP/2.0 hello", string(body))
+	}
+
+	// Clients that don't know about HTTP/2 carry on as they were.
+	resp, err := http.Post(url, "text/plain", strings.NewReader("hello"))
+	require.Nil(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Nil(t, err)
+	require.Equal(t, "HTTP/1.1 hello", string(body))
+
+	// Requests that wait for a 100 Continue go over HTTP/1.
+	req, err := http.NewRequest("PUT", url, strings.NewReader("hello"))
+	require.Nil(t, err)
+	req.Header.Set("Expect", "100-continue")
+	resp, err = client.Do(req)
+	require.Nil(t, err)
+	body, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Nil(t, err)
+	require.Equal(t, "HTTP/1.1 hello", string(body))
+}
+
+func TestCleartextHTTP2Shutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})
+	server := &http.Server{}
+	h2c, err := newCleartextHTTP2(server, HTTP2Config{}.server(), handler)
+	require.Nil(t, err)
+	server.Handler = h2c
+	go server.Serve(l)
+
+	client := &http.Client{Transport: NewCleartextHTTP2Transport(&http.Transport{})}
+	result := make(chan string)
+	go func() {
+		resp, err := client.Get("http://" + l.Addr().String() + "/")
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		result <- string(body)
+	}()
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.Nil(t, server.Shutdown(ctx))
+
+	// The request in flight on the connection that was taken over is let
+	// finish, and is waited for.
+	waited := make(chan error)
+	go func() {
+		waited <- h2c.wait(ctx)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("didn't wait for the HTTP/2 connection")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	require.Equal(t, "done", <-result)
+	require.Nil(t, <-waited)
+}
+
+func TestNewHTTP2Config(t *testing.T) {
+	config, err := conf.StringConfig("[app:object-server]\nhttp2_max_concurrent_streams = 50\nhttp2_stream_window = 4194304\n")
+	require.Nil(t, err)
+	require.Equal(t, HTTP2Config{MaxConcurrentStreams: 50, MaxUploadBufferPerStream: 4194304}, NewHTTP2Config(config.GetSection("app:object-server")))
+	config, err = conf.StringConfig("[app:object-server]\nhttp2 = false\n")
+	require.Nil(t, err)
+	require.True(t, NewHTTP2Config(config.GetSection("app:object-server")).Disabled)
+}
@@ -0,0 +1,210 @@
+package srv
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/uber-go/tally"
+	"github.com/uber-go/tally/multi"
+	promreporter "github.com/uber-go/tally/prometheus"
+)
+
+// RequestDurationBuckets are the bounds of the request latency histograms.
+var RequestDurationBuckets = tally.DurationBuckets{
+	5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second, 30 * time.Second,
+}
+
+// RecordRequest counts a request and records how long it took, by method and
+// response status.
+func RecordRequest(metricsScope tally.Scope, method string, status int, duration time.Duration) {
+	metricsScope.Counter("requests").Inc(1)
+	metricsScope.Counter(method + "_requests").Inc(1)
+	metricsScope.Counter(fmt.Sprintf("%d_responses", status)).Inc(1)
+	metricsScope.Tagged(map[string]string{"method": method, "status": strconv.Itoa(status)}).
+		Histogram("request_duration_seconds", RequestDurationBuckets).RecordDuration(duration)
+}
+
+type metricsCloser []io.Closer
+
+func (m metricsCloser) Close() error {
+	var err error
+	for _, c := range m {
+		if cerr := c.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// NewMetricsScope returns the root metrics scope of a server, which is served
+// in the Prometheus format on its /metrics path and, if statsd_host is set in
+// the [metrics] section of its config, also sent to that statsd server.
+func NewMetricsScope(config conf.Config, prefix string) (tally.Scope, io.Closer) {
+	var reporter tally.CachedStatsReporter = promreporter.NewReporter(promreporter.Options{})
+	var closers metricsCloser
+	if host := config.GetDefault("metrics", "statsd_host", ""); host != "" {
+		addr := net.JoinHostPort(host, config.GetDefault("metrics", "statsd_port", "8125"))
+		if statsd, err := newStatsdReporter(addr, config.GetDefault("metrics", "statsd_prefix", "")); err == nil {
+			reporter = multi.NewMultiCachedReporter(reporter, statsd)
+			closers = append(closers, statsd)
+		}
+	}
+	scope, closer := tally.NewRootScope(tally.ScopeOptions{
+		Prefix:         prefix,
+		Tags:           map[string]string{},
+		CachedReporter: reporter,
+		Separator:      promreporter.DefaultSeparator,
+	}, time.Second)
+	ring.OnChange(func(change ring.Change) {
+		ringScope := scope.Tagged(map[string]string{"ring": filepath.Base(change.Path)})
+		ringScope.Counter("ring_changes").Inc(1)
+		ringScope.Gauge("ring_parts_moved").Update(float64(change.PartsMoved))
+	})
+	// the scope is closed first, so its last report still reaches statsd
+	return scope, append(metricsCloser{closer}, closers...)
+}
+
+// statsdMaxPacket keeps the packets sent to statsd under a typical MTU.
+const statsdMaxPacket = 1400
+
+// statsdReporter sends metrics to a statsd server over UDP. Statsd has no
+// tags, so a metric's tag values are appended to its name.
+type statsdReporter struct {
+	lock   sync.Mutex
+	conn   net.Conn
+	prefix string
+	buf    bytes.Buffer
+}
+
+func newStatsdReporter(addr, prefix string) (*statsdReporter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" {
+		prefix += "."
+	}
+	return &statsdReporter{conn: conn, prefix: prefix}, nil
+}
+
+func (r *statsdReporter) name(name string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		name += "." + tags[k]
+	}
+	return r.prefix + name
+}
+
+func (r *statsdReporter) send(name, value, kind string) {
+	line := name + ":" + value + "|" + kind
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.buf.Len() > 0 && r.buf.Len()+len(line)+1 > statsdMaxPacket {
+		r.flush()
+	}
+	if r.buf.Len() > 0 {
+		r.buf.WriteByte('\n')
+	}
+	r.buf.WriteString(line)
+}
+
+// flush must be called with the lock held.
+func (r *statsdReporter) flush() {
+	if r.buf.Len() > 0 {
+		// statsd is best effort; there's nothing to do if it's not listening
+		r.conn.Write(r.buf.Bytes())
+		r.buf.Reset()
+	}
+}
+
+func (r *statsdReporter) Flush() {
+	r.lock.Lock()
+	r.flush()
+	r.lock.Unlock()
+}
+
+func (r *statsdReporter) Close() error {
+	r.Flush()
+	return r.conn.Close()
+}
+
+func (r *statsdReporter) Capabilities() tally.Capabilities {
+	return r
+}
+
+func (r *statsdReporter) Reporting() bool {
+	return true
+}
+
+func (r *statsdReporter) Tagging() bool {
+	return false
+}
+
+func (r *statsdReporter) AllocateCounter(name string, tags map[string]string) tally.CachedCount {
+	return statsdMetric{r, r.name(name, tags)}
+}
+
+func (r *statsdReporter) AllocateGauge(name string, tags map[string]string) tally.CachedGauge {
+	return statsdMetric{r, r.name(name, tags)}
+}
+
+func (r *statsdReporter) AllocateTimer(name string, tags map[string]string) tally.CachedTimer {
+	return statsdMetric{r, r.name(name, tags)}
+}
+
+// AllocateHistogram reports each of the histogram's buckets as a counter
+// named for the bucket's upper bound.
+func (r *statsdReporter) AllocateHistogram(name string, tags map[string]string, buckets tally.Buckets) tally.CachedHistogram {
+	return statsdMetric{r, r.name(name, tags)}
+}
+
+type statsdMetric struct {
+	r    *statsdReporter
+	name string
+}
+
+func (m statsdMetric) ReportCount(value int64) {
+	m.r.send(m.name, strconv.FormatInt(value, 10), "c")
+}
+
+func (m statsdMetric) ReportGauge(value float64) {
+	m.r.send(m.name, strconv.FormatFloat(value, 'f', -1, 64), "g")
+}
+
+func (m statsdMetric) ReportTimer(interval time.Duration) {
+	m.r.send(m.name, strconv.FormatFloat(float64(interval)/float64(time.Millisecond), 'f', -1, 64), "ms")
+}
+
+func (m statsdMetric) ValueBucket(bucketLowerBound, bucketUpperBound float64) tally.CachedHistogramBucket {
+	if math.IsInf(bucketUpperBound, 1) || bucketUpperBound == math.MaxFloat64 {
+		return statsdMetric{m.r, m.name + ".le_inf"}
+	}
+	return statsdMetric{m.r, m.name + ".le_" + strconv.FormatFloat(bucketUpperBound, 'f', -1, 64)}
+}
+
+func (m statsdMetric) DurationBucket(bucketLowerBound, bucketUpperBound time.Duration) tally.CachedHistogramBucket {
+	if bucketUpperBound == time.Duration(math.MaxInt64) {
+		return statsdMetric{m.r, m.name + ".le_inf"}
+	}
+	return statsdMetric{m.r, m.name + ".le_" + strconv.FormatFloat(bucketUpperBound.Seconds(), 'f', -1, 64)}
+}
+
+func (m statsdMetric) ReportSamples(value int64) {
+	m.r.send(m.name, strconv.FormatInt(value, 10), "c")
+}
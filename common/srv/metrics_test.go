@@ -0,0 +1,43 @@
+package srv
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/conf"
+)
+
+func TestMetricsScopeStatsd(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer listener.Close()
+	port := listener.LocalAddr().(*net.UDPAddr).Port
+	config, err := conf.StringConfig(fmt.Sprintf("[metrics]\nstatsd_host=127.0.0.1\nstatsd_port=%d\nstatsd_prefix=cluster1", port))
+	require.Nil(t, err)
+
+	scope, closer := NewMetricsScope(config, "test_statsd")
+	RecordRequest(scope, "GET", 200, 30*time.Millisecond)
+	scope.Gauge("queued").Update(7)
+	// closing reports what's left, and sends it on to statsd
+	require.Nil(t, closer.Close())
+
+	var lines []string
+	buf := make([]byte, statsdMaxPacket)
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		n, _, err := listener.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+	require.Contains(t, lines, "cluster1.test_statsd_requests:1|c")
+	require.Contains(t, lines, "cluster1.test_statsd_GET_requests:1|c")
+	require.Contains(t, lines, "cluster1.test_statsd_200_responses:1|c")
+	require.Contains(t, lines, "cluster1.test_statsd_request_duration_seconds.GET.200.le_0.05:1|c")
+	require.Contains(t, lines, "cluster1.test_statsd_queued:7|g")
+}
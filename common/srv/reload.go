@@ -0,0 +1,175 @@
+package srv
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A process started to take over from another on SIGUSR2 is given its
+// listening sockets as extra files, starting at fd 3, with their addresses in
+// the order they were passed in listenersEnv.
+const listenersEnv = "HUMMINGBIRD_LISTENERS"
+
+// With pidFileEnv set, a process that hands its sockets over writes its
+// replacement's pid there, so the hummingbird command can find it.
+const pidFileEnv = "HUMMINGBIRD_PID_FILE"
+
+// The replacement is also given a pipe, at the fd in readyEnv, to write to once
+// it's serving on all its sockets.
+const readyEnv = "HUMMINGBIRD_READY_FD"
+
+// replacementReadyTimeout is how long a process waits for its replacement to
+// be ready before giving up on it and carrying on itself.
+var replacementReadyTimeout = time.Minute
+
+// signalReady tells the process this one was started to replace, if any, that
+// it's serving, so that one can stop.
+func signalReady() error {
+	fd := os.Getenv(readyEnv)
+	os.Unsetenv(readyEnv)
+	if fd == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return fmt.Errorf("Invalid %s %q", readyEnv, fd)
+	}
+	f := os.NewFile(uintptr(n), "ready")
+	defer f.Close()
+	_, err = f.Write([]byte{'\n'})
+	return err
+}
+
+// inheritedListeners returns the listening sockets handed over by the process
+// this one was started to replace, by address.
+func inheritedListeners() map[string]net.Listener {
+	listeners := map[string]net.Listener{}
+	addresses := os.Getenv(listenersEnv)
+	os.Unsetenv(listenersEnv)
+	if addresses == "" {
+		return listeners
+	}
+	for i, address := range strings.Split(addresses, ",") {
+		f := os.NewFile(uintptr(3+i), address)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err == nil {
+			listeners[address] = l
+		}
+	}
+	return listeners
+}
+
+// listen takes over an inherited socket for ip and port if there is one, or
+// opens a new one.
+func listen(inherited map[string]net.Listener, ip string, port int) (net.Listener, error) {
+	address := fmt.Sprintf("%s:%d", ip, port)
+	if l, ok := inherited[address]; ok {
+		delete(inherited, address)
+		return l, nil
+	}
+	return RetryListen(ip, port)
+}
+
+// listenUnix takes over an inherited unix socket at path if there is one, or
+// replaces whatever is there with a new one.
+func listenUnix(inherited map[string]net.Listener, path string) (net.Listener, error) {
+	if l, ok := inherited["unix:"+path]; ok {
+		delete(inherited, "unix:"+path)
+		return l, nil
+	}
+	os.Remove(path)
+	return net.Listen("unix", path)
+}
+
+// startReplacement starts another copy of this process, with the same
+// arguments, to take over the listeners, which are keyed by the address they
+// were opened for. It returns once the replacement is serving on them; if it
+// exits or isn't ready within replacementReadyTimeout, it's killed and the
+// listeners are left with this process.
+func startReplacement(listeners map[string]net.Listener) (*os.Process, error) {
+	executable, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	var addresses []string
+	var unixListeners []*net.UnixListener
+	defer func() {
+		// Without a replacement, this still owns the sockets.
+		for _, ul := range unixListeners {
+			ul.SetUnlinkOnClose(true)
+		}
+	}()
+	for address, l := range listeners {
+		if ul, ok := l.(*net.UnixListener); ok {
+			// The replacement is still using the socket after this closes it.
+			ul.SetUnlinkOnClose(false)
+			unixListeners = append(unixListeners, ul)
+		}
+		fl, ok := l.(interface {
+			File() (*os.File, error)
+		})
+		if !ok {
+			return nil, fmt.Errorf("Unable to hand over listener for %s", address)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+		addresses = append(addresses, address)
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyR.Close()
+	cmd.ExtraFiles = append(cmd.ExtraFiles, readyW)
+	cmd.Env = append(os.Environ(), listenersEnv+"="+strings.Join(addresses, ","),
+		readyEnv+"="+strconv.Itoa(2+len(cmd.ExtraFiles)))
+	err = cmd.Start()
+	// The replacement has its own copy; with this one closed, the read below
+	// ends as soon as the replacement exits.
+	readyW.Close()
+	if err != nil {
+		return nil, err
+	}
+	// Handing the sockets over left them blocking, which this process can't
+	// carry on accepting from if the replacement fails.
+	for _, f := range cmd.ExtraFiles[:len(addresses)] {
+		syscall.SetNonblock(int(f.Fd()), true)
+	}
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyR.Read(make([]byte, 1))
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(replacementReadyTimeout):
+		err = fmt.Errorf("not ready after %s", replacementReadyTimeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		go cmd.Wait()
+		return nil, fmt.Errorf("Replacement process %d failed: %v", cmd.Process.Pid, err)
+	}
+	unixListeners = nil
+	if pidFile := os.Getenv(pidFileEnv); pidFile != "" {
+		if err := ioutil.WriteFile(pidFile, []byte(strconv.Itoa(cmd.Process.Pid)), 0644); err != nil {
+			return cmd.Process, fmt.Errorf("Error writing pid file: %v", err)
+		}
+	}
+	return cmd.Process, nil
+}
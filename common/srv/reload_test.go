@@ -0,0 +1,134 @@
+package srv
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestReplacementProcess is run by TestStartReplacement as the replacement,
+// answering one request on the socket it was handed.
+func TestReplacementProcess(t *testing.T) {
+	address := os.Getenv("TEST_REPLACEMENT_ADDRESS")
+	if address == "" {
+		t.Skip("only run as a replacement process")
+	}
+	l, ok := inheritedListeners()[address]
+	require.True(t, ok)
+	done := make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("replacement"))
+		close(done)
+	})}
+	go server.Serve(l)
+	require.Nil(t, signalReady())
+	<-done
+	server.Shutdown(context.Background())
+}
+
+func TestStartReplacement(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	pidFile := filepath.Join(dir, "test.pid")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	address := l.Addr().String()
+	defer func(args []string) { os.Args = args }(os.Args)
+	os.Args = []string{os.Args[0], "-test.run=TestReplacementProcess"}
+	os.Setenv("TEST_REPLACEMENT_ADDRESS", address)
+	defer os.Unsetenv("TEST_REPLACEMENT_ADDRESS")
+	os.Setenv(pidFileEnv, pidFile)
+	defer os.Unsetenv(pidFileEnv)
+
+	process, err := startReplacement(map[string]net.Listener{address: l})
+	require.Nil(t, err)
+	// Once this process has closed its copy, only the replacement can answer.
+	l.Close()
+	resp, err := http.Get("http://" + address + "/")
+	require.Nil(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Nil(t, err)
+	require.Equal(t, "replacement", string(body))
+	state, err := process.Wait()
+	require.Nil(t, err)
+	require.True(t, state.Success())
+
+	data, err := ioutil.ReadFile(pidFile)
+	require.Nil(t, err)
+	require.Equal(t, strconv.Itoa(process.Pid), string(data))
+}
+
+func TestStartReplacementNotReady(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	pidFile := filepath.Join(dir, "test.pid")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+	defer func(args []string) { os.Args = args }(os.Args)
+	// The replacement runs no tests, so it exits without ever being ready.
+	os.Args = []string{os.Args[0], "-test.run=^$"}
+	os.Setenv(pidFileEnv, pidFile)
+	defer os.Unsetenv(pidFileEnv)
+
+	process, err := startReplacement(map[string]net.Listener{l.Addr().String(): l})
+	require.NotNil(t, err)
+	require.Nil(t, process)
+	_, err = os.Stat(pidFile)
+	require.True(t, os.IsNotExist(err))
+	// This process still has the socket.
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("original"))
+	}))
+	resp, err := http.Get("http://" + l.Addr().String() + "/")
+	require.Nil(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Nil(t, err)
+	require.Equal(t, "original", string(body))
+}
+
+func TestListenInherited(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+	inherited := map[string]net.Listener{l.Addr().String(): l}
+	got, err := listen(inherited, "127.0.0.1", port)
+	require.Nil(t, err)
+	require.Equal(t, l, got)
+	require.Empty(t, inherited)
+}
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.sock")
+	// A socket left behind by a server that didn't shut down cleanly is replaced.
+	require.Nil(t, ioutil.WriteFile(path, []byte{}, 0600))
+	l, err := listenUnix(map[string]net.Listener{}, path)
+	require.Nil(t, err)
+	defer l.Close()
+	conn, err := net.Dial("unix", path)
+	require.Nil(t, err)
+	conn.Close()
+
+	inherited := map[string]net.Listener{"unix:" + path: l}
+	got, err := listenUnix(inherited, path)
+	require.Nil(t, err)
+	require.Equal(t, l, got)
+	require.Empty(t, inherited)
+}
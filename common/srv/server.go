@@ -96,6 +96,15 @@ type IpPort struct {
 	Ip                string
 	Port              int
 	CertFile, KeyFile string
+	// CAFile has the CA certificates to verify clients against, instead of
+	// the system's.
+	CAFile string
+	// ClientCertOptional lets clients of a backend server connect without a
+	// certificate.
+	ClientCertOptional bool
+	HTTP2              HTTP2Config
+	// UnixSocket is a path to serve on as well, for clients on the same host.
+	UnixSocket string
 }
 
 func (w *customWriter) WriteHeader(status int) {
@@ -106,6 +115,12 @@ func (w *customWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	return w.ResponseWriter.(http.Hijacker).Hijack()
 }
 
+func (w *customWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 // NewCustomWriter creates an http.ResponseWriter wrapper that calls your function on WriteHeader.
 func NewCustomWriter(w http.ResponseWriter, f func(w http.ResponseWriter, status int) int) http.ResponseWriter {
 	return &customWriter{ResponseWriter: w, f: f}
@@ -130,6 +145,12 @@ func (w WebWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	return w.ResponseWriter.(http.Hijacker).Hijack()
 }
 
+func (w *WebWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func (w *WebWriter) Response() (time.Time, int) {
 	return w.ResponseStarted, w.Status
 }
@@ -359,6 +380,7 @@ func LogRequestLine(logger *zap.Logger, request *http.Request, start time.Time,
 			zap.Float64("requestTimeSeconds", time.Since(start).Seconds()),
 			zap.Float64("requestTimeToHeaderSeconds", newWriter.ResponseStarted.Sub(start).Seconds()),
 			zap.String("extraInfo", extraInfo),
+			zap.String("traceId", common.GetDefault(request.Header, "X-Trace-Id", "-")),
 		)
 		if span := opentracing.SpanFromContext(request.Context()); span != nil {
 			span.LogKV("remoteAddr", common.GetDefault(request.Header, "X-Forwarded-For", request.RemoteAddr),
@@ -493,6 +515,7 @@ type HummingbirdServer struct {
 	*http.Server
 	logger   LowLevelLogger
 	finalize func()
+	h2c      *cleartextHTTP2
 }
 
 func RetryListen(ip string, port int) (net.Listener, error) {
@@ -543,6 +566,9 @@ func RunServers(getServer func(conf.Config, *flag.FlagSet, ConfigLoader) (*IpPor
 		return
 	}
 	var wg *sync.WaitGroup
+	inherited := inheritedListeners()
+	listeners := map[string]net.Listener{}
+	shutdownTimeout := time.Duration(0)
 
 	for _, config := range configs {
 		ipPort, server, logger, err := getServer(config, flags, DefaultConfigLoader{})
@@ -550,6 +576,10 @@ func RunServers(getServer func(conf.Config, *flag.FlagSet, ConfigLoader) (*IpPor
 			fmt.Fprintf(os.Stderr, "%v\n", err)
 			os.Exit(1)
 		}
+		ring.OnChange(func(change ring.Change) {
+			logger.Info("Ring changed", zap.String("path", change.Path), zap.String("md5", change.MD5),
+				zap.String("previousMD5", change.PreviousMD5), zap.Int("partsMoved", change.PartsMoved))
+		})
 		var metricsPrefix string
 		if len(configs) == 1 {
 			metricsPrefix = fmt.Sprintf("hb_%s", server.Type())
@@ -558,20 +588,38 @@ func RunServers(getServer func(conf.Config, *flag.FlagSet, ConfigLoader) (*IpPor
 		}
 		metricsPrefix = strings.Replace(metricsPrefix, "-", "_", -1)
 		metricsPrefix = strings.Replace(metricsPrefix, ".", "_", -1)
-		sock, err := RetryListen(ipPort.Ip, ipPort.Port)
+		sock, err := listen(inherited, ipPort.Ip, ipPort.Port)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error listening: %v\n", err)
 			logger.Error("Error listening", zap.Error(err))
 			os.Exit(1)
 		}
+		listeners[fmt.Sprintf("%s:%d", ipPort.Ip, ipPort.Port)] = sock
+		var unixSock net.Listener
+		if ipPort.UnixSocket != "" {
+			if unixSock, err = listenUnix(inherited, ipPort.UnixSocket); err != nil {
+				fmt.Fprintf(os.Stderr, "Error listening on unix socket: %v\n", err)
+				logger.Error("Error listening on unix socket", zap.Error(err))
+				os.Exit(1)
+			}
+			listeners["unix:"+ipPort.UnixSocket] = unixSock
+		}
+		if t := time.Duration(config.GetFloat("DEFAULT", "graceful_shutdown_timeout", 300) * float64(time.Second)); t > shutdownTimeout {
+			shutdownTimeout = t
+		}
 		var srv HummingbirdServer
 		if ipPort.CertFile != "" && ipPort.KeyFile != "" {
-			tlsConf := &tls.Config{
-				PreferServerCipherSuites: true,
-				MinVersion:               tls.VersionTLS12,
+			clientAuth := tls.RequireAndVerifyClientCert
+			if server.Type() == "proxy" {
+				clientAuth = tls.NoClientCert
+			} else if ipPort.ClientCertOptional {
+				clientAuth = tls.VerifyClientCertIfGiven
 			}
-			if server.Type() != "proxy" {
-				tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+			tlsConf, err := common.NewServerTLSConfig(ipPort.CertFile, ipPort.KeyFile, ipPort.CAFile, clientAuth)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error getting TLS config: %v\n", err)
+				logger.Error("Error getting TLS config", zap.Error(err))
+				os.Exit(1)
 			}
 			httpServer := http.Server{
 				Handler:      server.GetHandler(config, metricsPrefix),
@@ -579,29 +627,47 @@ func RunServers(getServer func(conf.Config, *flag.FlagSet, ConfigLoader) (*IpPor
 				WriteTimeout: 24 * time.Hour,
 				TLSConfig:    tlsConf,
 			}
-			err := http2.ConfigureServer(&httpServer, nil)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error enabling http2 on server: %v\n", err)
-				logger.Error("Error enabling http2 on server", zap.Error(err))
-				os.Exit(1)
+			if !ipPort.HTTP2.Disabled {
+				if err = http2.ConfigureServer(&httpServer, ipPort.HTTP2.server()); err != nil {
+					fmt.Fprintf(os.Stderr, "Error enabling http2 on server: %v\n", err)
+					logger.Error("Error enabling http2 on server", zap.Error(err))
+					os.Exit(1)
+				}
 			}
 			srv = HummingbirdServer{
 				Server:   &httpServer,
 				logger:   logger,
 				finalize: server.Finalize,
 			}
-			go srv.ServeTLS(sock, ipPort.CertFile, ipPort.KeyFile)
+			go srv.ServeTLS(sock, "", "")
+			if unixSock != nil {
+				go srv.ServeTLS(unixSock, "", "")
+			}
 		} else {
+			httpServer := &http.Server{
+				Handler:      server.GetHandler(config, metricsPrefix),
+				ReadTimeout:  24 * time.Hour,
+				WriteTimeout: 24 * time.Hour,
+			}
 			srv = HummingbirdServer{
-				Server: &http.Server{
-					Handler:      server.GetHandler(config, metricsPrefix),
-					ReadTimeout:  24 * time.Hour,
-					WriteTimeout: 24 * time.Hour,
-				},
+				Server:   httpServer,
 				logger:   logger,
 				finalize: server.Finalize,
 			}
+			if !ipPort.HTTP2.Disabled {
+				h2c, err := newCleartextHTTP2(httpServer, ipPort.HTTP2.server(), httpServer.Handler)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error enabling http2 on server: %v\n", err)
+					logger.Error("Error enabling http2 on server", zap.Error(err))
+					os.Exit(1)
+				}
+				httpServer.Handler = h2c
+				srv.h2c = h2c
+			}
 			go srv.Serve(sock)
+			if unixSock != nil {
+				go srv.Serve(unixSock)
+			}
 		}
 		ch := server.Background(flags)
 		if ch != nil {
@@ -617,6 +683,26 @@ func RunServers(getServer func(conf.Config, *flag.FlagSet, ConfigLoader) (*IpPor
 		servers = append(servers, &srv)
 		logger.Info("Server started", zap.Int("port", ipPort.Port))
 	}
+	for _, l := range inherited {
+		l.Close()
+	}
+	if err := signalReady(); err != nil && len(servers) > 0 {
+		servers[0].logger.Error("Error signaling readiness to the replaced process", zap.Error(err))
+	}
+
+	if len(servers) > 0 {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := common.ReloadCertificates(); err != nil {
+					servers[0].logger.Error("Error reloading certificates", zap.Error(err))
+				} else {
+					servers[0].logger.Info("Certificates reloaded")
+				}
+			}
+		}()
+	}
 
 	if wg != nil {
 		wg.Wait()
@@ -625,51 +711,75 @@ func RunServers(getServer func(conf.Config, *flag.FlagSet, ConfigLoader) (*IpPor
 
 	if len(servers) > 0 {
 		c := make(chan os.Signal, 1)
-		signal.Notify(c, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGABRT)
-		s := <-c
-		switch s {
-		case syscall.SIGTERM, syscall.SIGHUP: // graceful shutdown
-			var wg sync.WaitGroup
-			ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
-			defer cancel()
-			for _, srv := range servers {
-				// Shutdown the HTTP server
-				wg.Add(1)
-				go func(hserv *HummingbirdServer) {
-					defer wg.Done()
-					if err := hserv.Shutdown(ctx); err != nil {
-						// failure/timeout shutting down the server gracefully
-						hserv.logger.Error("Error with graceful shutdown", zap.Error(err))
+		signal.Notify(c, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGABRT, syscall.SIGUSR2)
+		for {
+			s := <-c
+			switch s {
+			case syscall.SIGUSR2: // hand the sockets to a new process, then shut down gracefully
+				process, err := startReplacement(listeners)
+				if process == nil {
+					servers[0].logger.Error("Error starting replacement process; carrying on", zap.Error(err))
+					continue
+				} else if err != nil {
+					servers[0].logger.Error("Error recording replacement process", zap.Error(err))
+				}
+				servers[0].logger.Info("Replacement process started", zap.Int("pid", process.Pid))
+				process.Release()
+				gracefulShutdown(servers, shutdownTimeout)
+			case syscall.SIGTERM: // graceful shutdown
+				gracefulShutdown(servers, shutdownTimeout)
+			case syscall.SIGABRT, syscall.SIGQUIT: // drop a traceback
+				pid := os.Getpid()
+				DumpGoroutinesStackTrace(pid)
+			default:
+				for _, srv := range servers {
+					if err := srv.Close(); err != nil {
+						srv.logger.Error("Error shutdown", zap.Error(err))
 					}
-					// Wait for any async processes to quit
-					hserv.finalize()
-				}(srv)
+				}
 			}
-			// Wait for everything to complete
-			wgc := make(chan struct{})
-			go func() {
-				defer close(wgc)
-				wg.Wait()
-			}()
-			select {
-			case <-wgc:
-				// Everything has completed
-				fmt.Println("Graceful shutdown complete.")
-				return
-			case <-ctx.Done():
-				// Timeout before everything completing
-				fmt.Println("Forcing shutdown after timeout.")
-				return
+			return
+		}
+	}
+}
+
+// gracefulShutdown stops the servers accepting connections, and waits up to
+// timeout for the requests in progress to finish.
+func gracefulShutdown(servers []*HummingbirdServer, timeout time.Duration) {
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, srv := range servers {
+		// Shutdown the HTTP server
+		wg.Add(1)
+		go func(hserv *HummingbirdServer) {
+			defer wg.Done()
+			if err := hserv.Shutdown(ctx); err != nil {
+				// failure/timeout shutting down the server gracefully
+				hserv.logger.Error("Error with graceful shutdown", zap.Error(err))
 			}
-		case syscall.SIGABRT, syscall.SIGQUIT: // drop a traceback
-			pid := os.Getpid()
-			DumpGoroutinesStackTrace(pid)
-		default:
-			for _, srv := range servers {
-				if err := srv.Close(); err != nil {
-					srv.logger.Error("Error shutdown", zap.Error(err))
+			// Shutdown doesn't wait for the HTTP/2 connections taken over
+			if hserv.h2c != nil {
+				if err := hserv.h2c.wait(ctx); err != nil {
+					hserv.logger.Error("Error with graceful shutdown of HTTP/2 connections", zap.Error(err))
 				}
 			}
-		}
+			// Wait for any async processes to quit
+			hserv.finalize()
+		}(srv)
+	}
+	// Wait for everything to complete
+	wgc := make(chan struct{})
+	go func() {
+		defer close(wgc)
+		wg.Wait()
+	}()
+	select {
+	case <-wgc:
+		// Everything has completed
+		fmt.Println("Graceful shutdown complete.")
+	case <-ctx.Done():
+		// Timeout before everything completing
+		fmt.Println("Forcing shutdown after timeout.")
 	}
 }
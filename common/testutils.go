@@ -11,12 +11,14 @@ import (
 type testScope struct {
 	lock     sync.RWMutex
 	counters map[string]tally.Counter
+	gauges   map[string]tally.Gauge
 	timers   map[string]tally.Timer
 }
 
 func NewTestScope() *testScope {
 	return &testScope{
 		counters: map[string]tally.Counter{},
+		gauges:   map[string]tally.Gauge{},
 		timers:   map[string]tally.Timer{},
 	}
 }
@@ -38,7 +40,19 @@ func (t *testScope) Counter(name string) tally.Counter {
 }
 
 func (t *testScope) Gauge(name string) tally.Gauge {
-	panic("Not implemented yet.")
+	t.lock.RLock()
+	g := t.gauges[name]
+	t.lock.RUnlock()
+	if g == nil {
+		t.lock.Lock()
+		g = t.gauges[name]
+		if g == nil {
+			g = &TestGauge{}
+			t.gauges[name] = g
+		}
+		t.lock.Unlock()
+	}
+	return g
 }
 
 func (t *testScope) Timer(name string) tally.Timer {
@@ -85,6 +99,23 @@ func (c *TestCounter) Value() int64 {
 	return atomic.LoadInt64(&c.count)
 }
 
+type TestGauge struct {
+	lock  sync.Mutex
+	value float64
+}
+
+func (g *TestGauge) Update(value float64) {
+	g.lock.Lock()
+	g.value = value
+	g.lock.Unlock()
+}
+
+func (g *TestGauge) Value() float64 {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.value
+}
+
 type TestTimer struct {
 	lastRecord time.Duration
 }
@@ -0,0 +1,147 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A loadedCert is a certificate and key pair this process uses, which
+// ReloadCertificates reads again from disk.
+type loadedCert struct {
+	certFile, keyFile string
+	lock              sync.RWMutex
+	cert              *tls.Certificate
+}
+
+var loadedCerts = map[string]*loadedCert{}
+var loadedCertsLock sync.Mutex
+
+var clusterCAs *x509.CertPool
+var clusterCAsLock sync.RWMutex
+
+func (c *loadedCert) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("Unable to load cert %s %s: %s", c.certFile, c.keyFile, err.Error())
+	}
+	c.lock.Lock()
+	c.cert = &cert
+	c.lock.Unlock()
+	return nil
+}
+
+func (c *loadedCert) get() *tls.Certificate {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.cert
+}
+
+func loadCert(certFile, keyFile string) (*loadedCert, error) {
+	loadedCertsLock.Lock()
+	defer loadedCertsLock.Unlock()
+	key := certFile + "\x00" + keyFile
+	if c, ok := loadedCerts[key]; ok {
+		return c, nil
+	}
+	c := &loadedCert{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	loadedCerts[key] = c
+	return c, nil
+}
+
+// ReloadCertificates reads every certificate and key pair this process has
+// loaded from disk again, so TLS connections from then on use them. A pair
+// that can't be read keeps being served as it was.
+func ReloadCertificates() error {
+	loadedCertsLock.Lock()
+	defer loadedCertsLock.Unlock()
+	var errs []string
+	for _, c := range loadedCerts {
+		if err := c.reload(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// LoadCAFile reads the PEM encoded CA certificates in caFile.
+func LoadCAFile(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read CA file %s: %s", caFile, err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in CA file %s", caFile)
+	}
+	return pool, nil
+}
+
+// SetClusterCA has the TLS configs from NewClientTLSConfig verify the nodes
+// they connect to against the CA certificates in caFile, rather than the
+// system's. An empty caFile leaves it as it is.
+func SetClusterCA(caFile string) error {
+	if caFile == "" {
+		return nil
+	}
+	pool, err := LoadCAFile(caFile)
+	if err != nil {
+		return err
+	}
+	clusterCAsLock.Lock()
+	clusterCAs = pool
+	clusterCAsLock.Unlock()
+	return nil
+}
+
+func NewClientTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	c, err := loadCert(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	clusterCAsLock.RLock()
+	defer clusterCAsLock.RUnlock()
+	tlsConf := &tls.Config{
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return c.get(), nil
+		},
+		RootCAs:    clusterCAs,
+		MinVersion: tls.VersionTLS12,
+	}
+	return tlsConf, nil
+}
+
+// NewServerTLSConfig returns the TLS config for a server with the given
+// certificate and key, verifying client certificates against the CA
+// certificates in caFile, or the system's if it's empty.
+func NewServerTLSConfig(certFile, keyFile, caFile string, clientAuth tls.ClientAuthType) (*tls.Config, error) {
+	c, err := loadCert(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConf := &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return c.get(), nil
+		},
+		ClientAuth:               clientAuth,
+		PreferServerCipherSuites: true,
+		MinVersion:               tls.VersionTLS12,
+	}
+	if caFile != "" {
+		if tlsConf.ClientCAs, err = LoadCAFile(caFile); err != nil {
+			return nil, err
+		}
+	}
+	return tlsConf, nil
+}
@@ -0,0 +1,119 @@
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCert writes a certificate for 127.0.0.1 with commonName, signed
+// by parent, or self-signed as a CA if parent is nil.
+func writeTestCert(t *testing.T, dir, name, commonName string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	return cert, key
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	ca, caKey := writeTestCert(t, dir, "ca", "ca", nil, nil)
+	writeTestCert(t, dir, "server", "server", ca, caKey)
+	writeTestCert(t, dir, "client", "client", ca, caKey)
+	defer func() { clusterCAs = nil }()
+	require.Nil(t, SetClusterCA(filepath.Join(dir, "ca.crt")))
+
+	serverConf, err := NewServerTLSConfig(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.crt"), tls.RequireAndVerifyClientCert)
+	require.Nil(t, err)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverConf)
+	require.Nil(t, err)
+	defer l.Close()
+	peers := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			tc := conn.(*tls.Conn)
+			if tc.Handshake() == nil {
+				peers <- tc.ConnectionState().PeerCertificates[0].Subject.CommonName
+			}
+			conn.Close()
+		}
+	}()
+
+	clientConf, err := NewClientTLSConfig(filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key"))
+	require.Nil(t, err)
+	conn, err := tls.Dial("tcp", l.Addr().String(), clientConf)
+	require.Nil(t, err)
+	require.Equal(t, "server", conn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+	conn.Close()
+	require.Equal(t, "client", <-peers)
+
+	// A replaced certificate is served once the certificates are reloaded.
+	writeTestCert(t, dir, "server", "server2", ca, caKey)
+	require.Nil(t, ReloadCertificates())
+	conn, err = tls.Dial("tcp", l.Addr().String(), clientConf)
+	require.Nil(t, err)
+	require.Equal(t, "server2", conn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+	conn.Close()
+	<-peers
+
+	// A broken one is reported, and the last good one kept.
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "server.crt"), []byte("junk"), 0600))
+	require.NotNil(t, ReloadCertificates())
+	conn, err = tls.Dial("tcp", l.Addr().String(), clientConf)
+	require.Nil(t, err)
+	require.Equal(t, "server2", conn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+	conn.Close()
+	<-peers
+	writeTestCert(t, dir, "server", "server", ca, caKey)
+	require.Nil(t, ReloadCertificates())
+
+	// Clients without a certificate from the CA are turned away.
+	_, err = tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: clientConf.RootCAs})
+	if err == nil {
+		select {
+		case <-peers:
+			t.Fatal("server accepted a client without a certificate")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
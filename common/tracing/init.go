@@ -16,6 +16,7 @@
 package tracing
 
 import (
+	"fmt"
 	"io"
 	"time"
 
@@ -26,7 +27,8 @@ import (
 	"github.com/troubling/hummingbird/common/srv"
 )
 
-// Init creates a new instance of Jaeger tracer.
+// Init creates a new instance of Jaeger tracer. With exporter = otlp, its
+// spans are sent to an OTLP/HTTP collector instead of a Jaeger agent.
 func Init(serviceName string, logger srv.LowLevelLogger, section conf.Section) (opentracing.Tracer, io.Closer, error) {
 	cfg := config.Configuration{
 		Disabled: section.GetBool("disabled", false),
@@ -40,9 +42,22 @@ func Init(serviceName string, logger srv.LowLevelLogger, section conf.Section) (
 			LocalAgentHostPort:  section.GetDefault("agent_host_port", ""),
 		},
 	}
-	tracer, closer, err := cfg.New(
-		serviceName,
-		config.Logger(NewTraceLogger(logger)),
-	)
+	options := []config.Option{config.Logger(NewTraceLogger(logger))}
+	switch exporter := section.GetDefault("exporter", "jaeger"); exporter {
+	case "jaeger":
+	case "otlp":
+		if cfg.Disabled {
+			break
+		}
+		options = append(options, config.Reporter(newOtlpReporter(
+			section.GetDefault("otlp_endpoint", "http://localhost:4318/v1/traces"),
+			int(section.GetInt("otlp_queue_size", 1000)),
+			int(section.GetInt("otlp_batch_size", 100)),
+			time.Duration(section.GetFloat("otlp_flush_interval", 1)*float64(time.Second)),
+			logger)))
+	default:
+		return nil, nil, fmt.Errorf("Unknown tracing exporter %q", exporter)
+	}
+	tracer, closer, err := cfg.New(serviceName, options...)
 	return tracer, closer, err
 }
@@ -0,0 +1,228 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/uber/jaeger-client-go"
+	j "github.com/uber/jaeger-client-go/thrift-gen/jaeger"
+	"go.uber.org/zap"
+
+	"github.com/troubling/hummingbird/common/srv"
+)
+
+// OTLP span kinds and status codes.
+const (
+	otlpKindInternal = 1
+	otlpKindServer   = 2
+	otlpKindClient   = 3
+	otlpStatusError  = 2
+)
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string          `json:"timeUnixNano"`
+	Name         string          `json:"name"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code int `json:"code,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Events            []otlpEvent     `json:"events,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+func otlpAttributes(tags []*j.Tag) []otlpAttribute {
+	attributes := make([]otlpAttribute, 0, len(tags))
+	for _, tag := range tags {
+		a := otlpAttribute{Key: tag.Key}
+		switch tag.VType {
+		case j.TagType_BOOL:
+			a.Value.BoolValue = tag.VBool
+		case j.TagType_LONG:
+			if tag.VLong != nil {
+				v := strconv.FormatInt(*tag.VLong, 10)
+				a.Value.IntValue = &v
+			}
+		case j.TagType_DOUBLE:
+			a.Value.DoubleValue = tag.VDouble
+		default:
+			a.Value.StringValue = tag.VStr
+		}
+		attributes = append(attributes, a)
+	}
+	return attributes
+}
+
+// newOtlpSpan converts a finished span to OTLP, whose times are in
+// nanoseconds where Jaeger's are in microseconds.
+func newOtlpSpan(span *j.Span) otlpSpan {
+	s := otlpSpan{
+		TraceId:           fmt.Sprintf("%016x%016x", uint64(span.TraceIdHigh), uint64(span.TraceIdLow)),
+		SpanId:            fmt.Sprintf("%016x", uint64(span.SpanId)),
+		Name:              span.OperationName,
+		Kind:              otlpKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(span.StartTime*1000, 10),
+		EndTimeUnixNano:   strconv.FormatInt((span.StartTime+span.Duration)*1000, 10),
+		Attributes:        otlpAttributes(span.Tags),
+	}
+	if span.ParentSpanId != 0 {
+		s.ParentSpanId = fmt.Sprintf("%016x", uint64(span.ParentSpanId))
+	}
+	for _, tag := range span.Tags {
+		switch {
+		case tag.Key == "span.kind" && tag.VStr != nil && *tag.VStr == "server":
+			s.Kind = otlpKindServer
+		case tag.Key == "span.kind" && tag.VStr != nil && *tag.VStr == "client":
+			s.Kind = otlpKindClient
+		case tag.Key == "error" && tag.VBool != nil && *tag.VBool:
+			s.Status.Code = otlpStatusError
+		}
+	}
+	for _, l := range span.Logs {
+		e := otlpEvent{TimeUnixNano: strconv.FormatInt(l.Timestamp*1000, 10), Name: "log"}
+		for _, field := range l.Fields {
+			if field.Key == "event" && field.VStr != nil {
+				e.Name = *field.VStr
+			} else {
+				e.Attributes = append(e.Attributes, otlpAttributes([]*j.Tag{field})...)
+			}
+		}
+		s.Events = append(s.Events, e)
+	}
+	return s
+}
+
+// otlpReporter sends finished spans in batches to an OTLP/HTTP collector,
+// such as Jaeger or Tempo.
+type otlpReporter struct {
+	endpoint      string
+	client        *http.Client
+	logger        srv.LowLevelLogger
+	batchSize     int
+	flushInterval time.Duration
+	spans         chan *jaeger.Span
+	done          chan struct{}
+	wg            sync.WaitGroup
+	closeOnce     sync.Once
+	resource      []otlpAttribute
+}
+
+func newOtlpReporter(endpoint string, queueSize, batchSize int, flushInterval time.Duration, logger srv.LowLevelLogger) *otlpReporter {
+	r := &otlpReporter{
+		endpoint:      endpoint,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		logger:        logger,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		spans:         make(chan *jaeger.Span, queueSize),
+		done:          make(chan struct{}),
+	}
+	r.wg.Add(1)
+	go r.run()
+	return r
+}
+
+// Report queues the span to be sent, dropping it if the queue is full rather
+// than holding up the request it's for.
+func (r *otlpReporter) Report(span *jaeger.Span) {
+	select {
+	case r.spans <- span:
+	default:
+	}
+}
+
+func (r *otlpReporter) Close() {
+	r.closeOnce.Do(func() { close(r.done) })
+	r.wg.Wait()
+}
+
+func (r *otlpReporter) run() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(r.flushInterval)
+	defer ticker.Stop()
+	var batch []*jaeger.Span
+	for {
+		select {
+		case span := <-r.spans:
+			if batch = append(batch, span); len(batch) >= r.batchSize {
+				r.send(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			r.send(batch)
+			batch = nil
+		case <-r.done:
+			for {
+				select {
+				case span := <-r.spans:
+					batch = append(batch, span)
+				default:
+					r.send(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (r *otlpReporter) send(batch []*jaeger.Span) {
+	if len(batch) == 0 {
+		return
+	}
+	if r.resource == nil {
+		process := jaeger.BuildJaegerProcessThrift(batch[0])
+		serviceName := process.ServiceName
+		r.resource = append([]otlpAttribute{{Key: "service.name", Value: otlpValue{StringValue: &serviceName}}}, otlpAttributes(process.Tags)...)
+	}
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, span := range batch {
+		spans = append(spans, newOtlpSpan(jaeger.BuildJaegerThrift(span)))
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource":   map[string]interface{}{"attributes": r.resource},
+			"scopeSpans": []interface{}{map[string]interface{}{"scope": map[string]string{"name": "hummingbird"}, "spans": spans}},
+		}},
+	})
+	if err != nil {
+		r.logger.Error("Error encoding OTLP spans", zap.Error(err))
+		return
+	}
+	resp, err := r.client.Post(r.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		r.logger.Error("Error sending OTLP spans", zap.String("endpoint", r.endpoint), zap.Error(err))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		r.logger.Error("OTLP collector refused spans", zap.String("endpoint", r.endpoint), zap.Int("status", resp.StatusCode))
+	}
+}
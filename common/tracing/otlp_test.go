@@ -0,0 +1,70 @@
+package tracing
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/troubling/hummingbird/common/conf"
+)
+
+func TestOtlpExport(t *testing.T) {
+	var lock sync.Mutex
+	var bodies []map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var parsed map[string]interface{}
+		require.Nil(t, json.Unmarshal(body, &parsed))
+		lock.Lock()
+		bodies = append(bodies, parsed)
+		lock.Unlock()
+	}))
+	defer ts.Close()
+	config, err := conf.StringConfig("[tracing]\nexporter = otlp\notlp_endpoint = " + ts.URL + "/v1/traces\n")
+	require.Nil(t, err)
+	tracer, closer, err := Init("proxyserver", zap.NewNop(), config.GetSection("tracing"))
+	require.Nil(t, err)
+
+	parent := tracer.StartSpan("GET /v1/a/c/o")
+	ext.SpanKindRPCServer.Set(parent)
+	child := tracer.StartSpan("GET object", opentracing.ChildOf(parent.Context()))
+	ext.SpanKindRPCClient.Set(child)
+	ext.Error.Set(child, true)
+	child.Finish()
+	parent.Finish()
+	// Closing sends whatever is still queued.
+	require.Nil(t, closer.Close())
+
+	lock.Lock()
+	defer lock.Unlock()
+	var spans []interface{}
+	for _, body := range bodies {
+		rs := body["resourceSpans"].([]interface{})[0].(map[string]interface{})
+		attr := rs["resource"].(map[string]interface{})["attributes"].([]interface{})[0].(map[string]interface{})
+		require.Equal(t, "service.name", attr["key"])
+		require.Equal(t, "proxyserver", attr["value"].(map[string]interface{})["stringValue"])
+		spans = append(spans, rs["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})...)
+	}
+	require.Equal(t, 2, len(spans))
+	c, p := spans[0].(map[string]interface{}), spans[1].(map[string]interface{})
+	require.Equal(t, "GET object", c["name"])
+	require.Equal(t, float64(otlpKindClient), c["kind"])
+	require.Equal(t, float64(otlpStatusError), c["status"].(map[string]interface{})["code"])
+	require.Equal(t, p["spanId"], c["parentSpanId"])
+	require.Equal(t, p["traceId"], c["traceId"])
+	require.Equal(t, float64(otlpKindServer), p["kind"])
+	require.Equal(t, 32, len(p["traceId"].(string)))
+
+	config, err = conf.StringConfig("[tracing]\nexporter = zipkin\n")
+	require.Nil(t, err)
+	_, _, err = Init("proxyserver", zap.NewNop(), config.GetSection("tracing"))
+	require.NotNil(t, err)
+}
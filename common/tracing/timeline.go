@@ -0,0 +1,160 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TraceIdHeader carries a request's trace ID to every server it reaches.
+const TraceIdHeader = "X-Trace-Id"
+
+var validTraceId = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// ValidTraceId reports whether a client supplied trace ID can be used as is.
+func ValidTraceId(traceId string) bool {
+	return validTraceId.MatchString(traceId)
+}
+
+type traceKey struct{}
+
+// traceContext is the trace ID of a request, and where the events of its
+// timeline are kept.
+type traceContext struct {
+	id        string
+	timelines *Timelines
+}
+
+// ContextWithTraceId returns a context for the request with the trace ID,
+// whose events are recorded in timelines unless it's nil.
+func ContextWithTraceId(ctx context.Context, traceId string, timelines *Timelines) context.Context {
+	return context.WithValue(ctx, traceKey{}, &traceContext{id: traceId, timelines: timelines})
+}
+
+// TraceIdFromContext returns the context's trace ID, or "" if it has none.
+func TraceIdFromContext(ctx context.Context) string {
+	if tc, ok := ctx.Value(traceKey{}).(*traceContext); ok {
+		return tc.id
+	}
+	return ""
+}
+
+// Record adds the event to the timeline of the context's trace, if it's
+// being kept.
+func Record(ctx context.Context, event Event) {
+	if tc, ok := ctx.Value(traceKey{}).(*traceContext); ok && tc.timelines != nil {
+		tc.timelines.Add(tc.id, event)
+	}
+}
+
+// Event is a request made for a trace, either to the proxy itself or from
+// it to a backend server.
+type Event struct {
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration"`
+	// Server is "proxy", or the backend server the request was sent to.
+	Server string `json:"server"`
+	// Source is the middleware that made a proxy subrequest.
+	Source string `json:"source,omitempty"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Status int    `json:"status"`
+}
+
+// timeline is the events kept for a trace, and how many more there were.
+type timeline struct {
+	events  []Event
+	dropped int
+}
+
+// Timelines keeps the events of the most recent traces.
+type Timelines struct {
+	lock      sync.Mutex
+	max       int
+	maxEvents int
+	order     []string
+	timelines map[string]*timeline
+}
+
+// NewTimelines returns a Timelines that keeps up to max traces, forgetting
+// the oldest to make room, and the first maxEvents events of each, so a
+// client reusing one trace ID can't grow it without bound.
+func NewTimelines(max, maxEvents int) *Timelines {
+	return &Timelines{max: max, maxEvents: maxEvents, timelines: map[string]*timeline{}}
+}
+
+func (t *Timelines) Add(traceId string, event Event) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	tl, ok := t.timelines[traceId]
+	if !ok {
+		if len(t.order) >= t.max {
+			delete(t.timelines, t.order[0])
+			t.order = t.order[1:]
+		}
+		t.order = append(t.order, traceId)
+		tl = &timeline{}
+		t.timelines[traceId] = tl
+	}
+	if len(tl.events) >= t.maxEvents {
+		tl.dropped++
+		return
+	}
+	tl.events = append(tl.events, event)
+}
+
+// Get returns the trace's events in the order they started, and how many
+// more it had past the limit that weren't kept.
+func (t *Timelines) Get(traceId string) ([]Event, int) {
+	t.lock.Lock()
+	var events []Event
+	dropped := 0
+	if tl, ok := t.timelines[traceId]; ok {
+		events = append(events, tl.events...)
+		dropped = tl.dropped
+	}
+	t.lock.Unlock()
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Start.Before(events[j].Start) })
+	return events, dropped
+}
+
+// traceTransport sends requests' trace IDs on to the servers they're for,
+// recording them in the trace's timeline.
+type traceTransport struct {
+	http.RoundTripper
+}
+
+// NewTraceTransport returns a transport that passes trace IDs from requests'
+// contexts to the servers they're sent to.
+func NewTraceTransport(rt http.RoundTripper) http.RoundTripper {
+	return &traceTransport{RoundTripper: rt}
+}
+
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	traceId := TraceIdFromContext(req.Context())
+	if traceId == "" {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	if req.Header.Get(TraceIdHeader) == "" {
+		// A RoundTripper mustn't change the request it's given.
+		r := *req
+		r.Header = make(http.Header, len(req.Header)+1)
+		for k, v := range req.Header {
+			r.Header[k] = v
+		}
+		r.Header.Set(TraceIdHeader, traceId)
+		req = &r
+	}
+	start := time.Now()
+	resp, err := t.RoundTripper.RoundTrip(req)
+	status := 0
+	if err == nil {
+		status = resp.StatusCode
+	}
+	Record(req.Context(), Event{Start: start, Duration: time.Since(start).Seconds(), Server: req.URL.Host,
+		Method: req.Method, Path: req.URL.Path, Status: status})
+	return resp, err
+}
@@ -0,0 +1,61 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimelines(t *testing.T) {
+	timelines := NewTimelines(2, 2)
+	timelines.Add("a", Event{Method: "GET"})
+	timelines.Add("b", Event{Method: "PUT"})
+	timelines.Add("a", Event{Method: "HEAD"})
+	events, dropped := timelines.Get("a")
+	require.Equal(t, 2, len(events))
+	require.Equal(t, 0, dropped)
+	// Past its limit, a trace's events are only counted.
+	timelines.Add("a", Event{Method: "POST"})
+	events, dropped = timelines.Get("a")
+	require.Equal(t, []string{"GET", "HEAD"}, []string{events[0].Method, events[1].Method})
+	require.Equal(t, 1, dropped)
+	// The oldest trace makes room for a new one.
+	timelines.Add("c", Event{Method: "DELETE"})
+	events, _ = timelines.Get("a")
+	require.Equal(t, 0, len(events))
+	events, _ = timelines.Get("b")
+	require.Equal(t, 1, len(events))
+	events, _ = timelines.Get("c")
+	require.Equal(t, 1, len(events))
+}
+
+func TestTraceTransport(t *testing.T) {
+	var got string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(TraceIdHeader)
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+	timelines := NewTimelines(10, 10)
+	c := &http.Client{Transport: NewTraceTransport(http.DefaultTransport)}
+
+	// The trace ID survives the context being copied for a backend request.
+	ctx := CopySpanFromContext(ContextWithTraceId(context.Background(), "trace1", timelines))
+	req, err := http.NewRequest("HEAD", ts.URL+"/sda/1/a", nil)
+	require.Nil(t, err)
+	resp, err := c.Do(req.WithContext(ctx))
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, "trace1", got)
+	events, _ := timelines.Get("trace1")
+	require.Equal(t, 1, len(events))
+	require.Equal(t, "/sda/1/a", events[0].Path)
+	require.Equal(t, 204, events[0].Status)
+
+	require.True(t, ValidTraceId("my-trace_1.2"))
+	require.False(t, ValidTraceId("bad trace"))
+	require.False(t, ValidTraceId(""))
+}
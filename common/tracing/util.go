@@ -19,6 +19,7 @@ import (
 	"context"
 
 	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/troubling/hummingbird/common"
 )
 
 func CopySpanFromContext(ctx context.Context) context.Context {
@@ -27,5 +28,11 @@ func CopySpanFromContext(ctx context.Context) context.Context {
 	if span != nil {
 		newCtx = opentracing.ContextWithSpan(newCtx, span)
 	}
+	if tc, ok := ctx.Value(traceKey{}).(*traceContext); ok {
+		newCtx = context.WithValue(newCtx, traceKey{}, tc)
+	}
+	if deadline, ok := common.ClientDeadline(ctx); ok {
+		newCtx = common.WithClientDeadline(newCtx, deadline)
+	}
 	return newCtx
 }
@@ -17,7 +17,8 @@ package common
 
 import (
 	"crypto/md5"
-	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -26,6 +27,7 @@ import (
 	"math/rand"
 	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
@@ -126,6 +128,27 @@ func LooksTrue(check string) bool {
 	return check == "true" || check == "yes" || check == "1" || check == "on" || check == "t" || check == "y"
 }
 
+// ExpectedEtags returns the hex MD5 digests an upload's body should match,
+// from the ETag and base64 Content-MD5 values in each of the given headers
+// (or trailers). A Content-MD5 that isn't valid base64 is returned as is, so
+// it matches nothing.
+func ExpectedEtags(headers ...http.Header) []string {
+	var etags []string
+	for _, h := range headers {
+		if etag := strings.Trim(strings.ToLower(h.Get("Etag")), "\""); etag != "" {
+			etags = append(etags, etag)
+		}
+		if contentMD5 := h.Get("Content-Md5"); contentMD5 != "" {
+			if digest, err := base64.StdEncoding.DecodeString(contentMD5); err == nil {
+				etags = append(etags, hex.EncodeToString(digest))
+			} else {
+				etags = append(etags, contentMD5)
+			}
+		}
+	}
+	return etags
+}
+
 func UUID() string {
 	return fmt.Sprintf("%08x-%04x-%04x-%04x-%012x", rand.Int63n(0xffffffff), rand.Int63n(0xffff), rand.Int63n(0xffff), rand.Int63n(0xffff), rand.Int63n(0xffffffffffff))
 }
@@ -407,10 +430,122 @@ func (k *KeyedLimit) MarshalJSON() ([]byte, error) {
 	return data, err
 }
 
+// Limits returns the current per key and total limits.
+func (k *KeyedLimit) Limits() (int64, int64) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return k.limitPerKey, k.totalLimit
+}
+
+// SetLimits changes the per key and total limits; requests already holding a slot keep it.
+func (k *KeyedLimit) SetLimits(limitPerKey int64, totalLimit int64) {
+	k.lock.Lock()
+	k.limitPerKey = limitPerKey
+	k.totalLimit = totalLimit
+	k.lock.Unlock()
+}
+
 func NewKeyedLimit(limitPerKey int64, totalLimit int64) *KeyedLimit {
 	return &KeyedLimit{limitPerKey: limitPerKey, totalLimit: totalLimit, locked: make(map[string]bool), inUse: make(map[string]int64)}
 }
 
+// KeyedRateLimit is a token bucket per key, each refilled at rate bytes per
+// second and holding up to a second's worth. A rate of 0 disables limiting.
+type KeyedRateLimit struct {
+	lock    sync.Mutex
+	rate    int64
+	buckets map[string]*rateBucket
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Wait takes n bytes from key's bucket, sleeping until the bucket would have
+// been refilled enough to cover them.
+func (k *KeyedRateLimit) Wait(key string, n int) {
+	k.lock.Lock()
+	if k.rate <= 0 || n <= 0 {
+		k.lock.Unlock()
+		return
+	}
+	now := time.Now()
+	b := k.buckets[key]
+	if b == nil {
+		b = &rateBucket{tokens: float64(k.rate), last: now}
+		k.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * float64(k.rate)
+	if b.tokens > float64(k.rate) {
+		b.tokens = float64(k.rate)
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / float64(k.rate) * float64(time.Second))
+	}
+	k.lock.Unlock()
+	time.Sleep(delay)
+}
+
+// Rate returns the current rate in bytes per second.
+func (k *KeyedRateLimit) Rate() int64 {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return k.rate
+}
+
+// SetRate changes the rate in bytes per second.
+func (k *KeyedRateLimit) SetRate(rate int64) {
+	k.lock.Lock()
+	k.rate = rate
+	k.lock.Unlock()
+}
+
+func NewKeyedRateLimit(rate int64) *KeyedRateLimit {
+	return &KeyedRateLimit{rate: rate, buckets: make(map[string]*rateBucket)}
+}
+
+// ByteBudget shares a fixed number of bytes between concurrent users, such
+// as requests each holding a buffer. A total of 0 means unlimited.
+type ByteBudget struct {
+	lock  sync.Mutex
+	total int64
+	inUse int64
+}
+
+// Acquire reserves n bytes, returning false without reserving anything if
+// that would exceed the budget.
+func (b *ByteBudget) Acquire(n int64) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.total > 0 && b.inUse+n > b.total {
+		return false
+	}
+	b.inUse += n
+	return true
+}
+
+// Release returns n bytes reserved with Acquire.
+func (b *ByteBudget) Release(n int64) {
+	b.lock.Lock()
+	b.inUse -= n
+	b.lock.Unlock()
+}
+
+// Usage returns the bytes currently reserved and the budget's total.
+func (b *ByteBudget) Usage() (int64, int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.inUse, b.total
+}
+
+func NewByteBudget(total int64) *ByteBudget {
+	return &ByteBudget{total: total}
+}
+
 func Map2Headers(m map[string]string) http.Header {
 	if m == nil {
 		return nil
@@ -462,6 +597,62 @@ func ParseContentTypeForSlo(contentType string, listedSize int64) (string, int64
 	return contentType, listedSize, nil
 }
 
+// ContentTypeWithStorageClass adds an object's storage class to the content
+// type sent in its container update, so listings can show it the same way
+// they show the size of a large object manifest.
+func ContentTypeWithStorageClass(contentType, storageClass string) string {
+	if storageClass == "" {
+		return contentType
+	}
+	return contentType + ";storage_class=" + storageClass
+}
+
+// ParseContentTypeForStorageClass splits the storage class added by
+// ContentTypeWithStorageClass back out of a listed content type.
+func ParseContentTypeForStorageClass(contentType string) (string, string, error) {
+	if strings.Contains(contentType, ";") && strings.Contains(contentType, "storage_class") {
+		contentTypeCleaned, params, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return "", "", err
+		}
+		if v, ok := params["storage_class"]; ok {
+			delete(params, "storage_class")
+			return mime.FormatMediaType(contentTypeCleaned, params), v, nil
+		}
+	}
+	return contentType, "", nil
+}
+
+// ContentTypeWithSymlinkPath adds the "/v1/<account>/<container>/<object>"
+// path a symlink points to to the content type sent in its container update,
+// so listings can show it.
+func ContentTypeWithSymlinkPath(contentType, symlinkPath string) string {
+	if symlinkPath == "" {
+		return contentType
+	}
+	return contentType + ";symlink_path=" + url.QueryEscape(symlinkPath)
+}
+
+// ParseContentTypeForSymlinkPath splits the path added by
+// ContentTypeWithSymlinkPath back out of a listed content type.
+func ParseContentTypeForSymlinkPath(contentType string) (string, string, error) {
+	if strings.Contains(contentType, ";") && strings.Contains(contentType, "symlink_path") {
+		contentTypeCleaned, params, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return "", "", err
+		}
+		if v, ok := params["symlink_path"]; ok {
+			symlinkPath, err := url.QueryUnescape(v)
+			if err != nil {
+				return "", "", err
+			}
+			delete(params, "symlink_path")
+			return mime.FormatMediaType(contentTypeCleaned, params), symlinkPath, nil
+		}
+	}
+	return contentType, "", nil
+}
+
 func SliceFromCSV(csv string) []string {
 	s := []string{}
 	for _, val := range strings.Split(csv, ",") {
@@ -553,18 +744,6 @@ func GetAllRingFileMd5s() (map[string]string, error) {
 	}
 }
 
-func NewClientTLSConfig(certFile, keyFile string) (*tls.Config, error) {
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
-		return nil, fmt.Errorf("Unable to load cert %s %s: %s", certFile, keyFile, err.Error())
-	}
-	tlsConf := &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		MinVersion:   tls.VersionTLS12,
-	}
-	return tlsConf, nil
-}
-
 func IsCorruptDBError(err error) bool {
 	a := err.Error()
 	for _, b := range []string{
@@ -602,5 +781,8 @@ func QuarantineDir(dirPath string, dirDepth int, dirType string) error {
 	if err != nil {
 		return fmt.Errorf("could not quarantine; error: %s", err)
 	}
+	// Its modification time is shown as when it was quarantined.
+	now := time.Now()
+	os.Chtimes(dstDirPath, now, now)
 	return fmt.Errorf("quarantined %s to %s", dirPath, dstDirPath)
 }
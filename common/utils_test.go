@@ -310,6 +310,42 @@ func TestParseContentTypeForSlo(t *testing.T) {
 	require.NotNil(t, err)
 }
 
+func TestContentTypeStorageClass(t *testing.T) {
+	require.Equal(t, "text/html", ContentTypeWithStorageClass("text/html", ""))
+	ct, sc, err := ParseContentTypeForStorageClass(ContentTypeWithStorageClass("text/html", "cold"))
+	require.Nil(t, err)
+	require.Equal(t, "text/html", ct)
+	require.Equal(t, "cold", sc)
+
+	ct, sc, err = ParseContentTypeForStorageClass(ContentTypeWithStorageClass("text/html;swift_bytes=36", "hot"))
+	require.Nil(t, err)
+	require.Equal(t, "text/html; swift_bytes=36", ct)
+	require.Equal(t, "hot", sc)
+
+	ct, sc, err = ParseContentTypeForStorageClass("text/html")
+	require.Nil(t, err)
+	require.Equal(t, "text/html", ct)
+	require.Equal(t, "", sc)
+}
+
+func TestContentTypeSymlinkPath(t *testing.T) {
+	require.Equal(t, "text/html", ContentTypeWithSymlinkPath("text/html", ""))
+	ct, sp, err := ParseContentTypeForSymlinkPath(ContentTypeWithSymlinkPath("application/symlink", "/v1/a/c/some dir/\"o;=\""))
+	require.Nil(t, err)
+	require.Equal(t, "application/symlink", ct)
+	require.Equal(t, "/v1/a/c/some dir/\"o;=\"", sp)
+
+	ct, sp, err = ParseContentTypeForSymlinkPath(ContentTypeWithSymlinkPath("text/html;swift_bytes=36", "/v1/a/c/o"))
+	require.Nil(t, err)
+	require.Equal(t, "text/html; swift_bytes=36", ct)
+	require.Equal(t, "/v1/a/c/o", sp)
+
+	ct, sp, err = ParseContentTypeForSymlinkPath("text/html")
+	require.Nil(t, err)
+	require.Equal(t, "text/html", ct)
+	require.Equal(t, "", sp)
+}
+
 func TestSliceFromCSV(t *testing.T) {
 	var tests = []struct {
 		s        string   // input
@@ -339,3 +375,57 @@ func TestGetTransactionId(t *testing.T) {
 	require.Nil(t, err)
 	require.True(t, matched)
 }
+
+func TestKeyedLimitSetLimits(t *testing.T) {
+	k := NewKeyedLimit(1, 0)
+	require.Equal(t, int64(0), k.Acquire("sda", false))
+	require.Equal(t, int64(1), k.Acquire("sda", false))
+	k.SetLimits(2, 10)
+	perKey, total := k.Limits()
+	require.Equal(t, int64(2), perKey)
+	require.Equal(t, int64(10), total)
+	require.Equal(t, int64(0), k.Acquire("sda", false))
+	require.Equal(t, int64(2), k.Acquire("sda", false))
+}
+
+func TestKeyedRateLimit(t *testing.T) {
+	k := NewKeyedRateLimit(0)
+	start := time.Now()
+	k.Wait("sda", 1<<30)
+	require.True(t, time.Since(start) < 100*time.Millisecond)
+	k.SetRate(1000)
+	require.Equal(t, int64(1000), k.Rate())
+	// The first second's worth is available right away.
+	start = time.Now()
+	k.Wait("sda", 1000)
+	require.True(t, time.Since(start) < 100*time.Millisecond)
+	// After that, 200 more bytes take about 200ms.
+	k.Wait("sda", 200)
+	require.True(t, time.Since(start) >= 150*time.Millisecond)
+	// Other keys have their own buckets.
+	start = time.Now()
+	k.Wait("sdb", 1000)
+	require.True(t, time.Since(start) < 100*time.Millisecond)
+}
+
+func TestByteBudget(t *testing.T) {
+	b := NewByteBudget(100)
+	require.True(t, b.Acquire(60))
+	require.False(t, b.Acquire(60))
+	require.True(t, b.Acquire(40))
+	inUse, total := b.Usage()
+	require.Equal(t, int64(100), inUse)
+	require.Equal(t, int64(100), total)
+	b.Release(60)
+	require.True(t, b.Acquire(60))
+	b = NewByteBudget(0)
+	require.True(t, b.Acquire(1<<40))
+}
+
+func TestExpectedEtags(t *testing.T) {
+	require.Nil(t, ExpectedEtags(http.Header{}, nil))
+	require.Equal(t, []string{"437bba8e0bf58337674f4539e75186ac", "437bba8e0bf58337674f4539e75186ac", "garbage!"},
+		ExpectedEtags(http.Header{"Etag": []string{"\"437BBA8E0BF58337674F4539E75186AC\""}},
+			http.Header{"Content-Md5": []string{"Q3u6jgv1gzdnT0U551GGrA=="}},
+			http.Header{"Content-Md5": []string{"garbage!"}}))
+}
@@ -0,0 +1,94 @@
+package containerserver
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/middleware"
+	"go.uber.org/zap"
+)
+
+// containerAuditor checks the container databases on the local devices,
+// quarantining any that are corrupt.
+type containerAuditor struct {
+	r         *Replicator
+	interval  time.Duration
+	perSecond int64
+	passed    int64
+	failed    int64
+}
+
+func newContainerAuditor(r *Replicator, interval time.Duration, perSecond int64) *containerAuditor {
+	return &containerAuditor{r: r, interval: interval, perSecond: perSecond}
+}
+
+func (a *containerAuditor) auditContainer(dbFile string) error {
+	db, err := sqliteOpenContainer(dbFile)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.(*sqliteContainer).audit()
+}
+
+// run makes one pass over the containers on the local devices, auditing up
+// to perSecond of them a second, and reports how it went to recon.
+func (a *containerAuditor) run() {
+	start := time.Now()
+	a.passed, a.failed = 0, 0
+	devices, err := a.r.Ring.LocalDevices(a.r.serverPort)
+	if err != nil {
+		a.r.logger.Error("Error getting local devices from ring", zap.Error(err))
+		return
+	}
+	for _, dev := range devices {
+		devicePath := filepath.Join(a.r.deviceRoot, dev.Device)
+		if mounted, err := fs.IsMount(devicePath); a.r.checkMounts && (err != nil || !mounted) {
+			a.r.logger.Error("Not auditing containers on unmounted device", zap.String("device", dev.Device), zap.Error(err))
+			continue
+		}
+		filepath.Walk(filepath.Join(devicePath, "containers"), func(path string, fi os.FileInfo, err error) error {
+			if err != nil || !strings.HasSuffix(path, ".db") {
+				return nil
+			}
+			if err := a.auditContainer(path); err != nil {
+				a.r.logger.Error("Container failed audit", zap.String("dbFile", path), zap.Error(err))
+				a.failed++
+			} else {
+				a.passed++
+			}
+			if a.perSecond > 0 {
+				due := time.Duration(float64(a.passed+a.failed) / float64(a.perSecond) * float64(time.Second))
+				if d := due - time.Since(start); d > 0 {
+					time.Sleep(d)
+				}
+			}
+			return nil
+		})
+	}
+	a.r.logger.Info("Container auditor pass complete", zap.Duration("timeTook", time.Since(start)),
+		zap.Int64("passed", a.passed), zap.Int64("failed", a.failed))
+	if err := middleware.DumpReconCache(a.r.reconCachePath, "container", map[string]interface{}{
+		"container_audits_passed":          a.passed,
+		"container_audits_failed":          a.failed,
+		"container_audits_since":           float64(start.UnixNano()) / float64(time.Second),
+		"container_auditor_pass_completed": time.Since(start).Seconds(),
+	}); err != nil {
+		a.r.logger.Error("container-auditor saving recon data", zap.Error(err))
+	}
+}
+
+// runForever starts a pass every interval, or as soon as the last one
+// finishes if it took longer.
+func (a *containerAuditor) runForever() {
+	for {
+		start := time.Now()
+		a.run()
+		if d := a.interval - time.Since(start); d > 0 {
+			time.Sleep(d)
+		}
+	}
+}
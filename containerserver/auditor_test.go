@@ -0,0 +1,74 @@
+package containerserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/test"
+	"go.uber.org/zap"
+)
+
+func TestAuditContainer(t *testing.T) {
+	db, _, cleanup, err := createTestDatabase("1410586890.28563")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, mergeItemsByName(db, []string{"a", "b"}))
+	require.Nil(t, db.audit())
+
+	_, err = db.Exec("UPDATE policy_stat SET object_count = 5")
+	require.Nil(t, err)
+	require.Contains(t, db.audit().Error(), "policy 0 stats say 5 objects and 0 bytes, but there are 2 objects and 0 bytes")
+	_, err = db.Exec("UPDATE policy_stat SET object_count = 2")
+	require.Nil(t, err)
+
+	// Objects in another policy are only expected while the container is
+	// being migrated to it.
+	require.Nil(t, db.MergeItems([]*ObjectRecord{{Name: "c", CreatedAt: "10000000.00001", StoragePolicyIndex: 1}}, ""))
+	require.Contains(t, db.audit().Error(), "1 objects are in policy 1 instead of the container's policy 0")
+	require.Nil(t, db.UpdateMetadata(map[string][]string{policyMigrationKey: {"1", "1410586890.28564"}}, "1410586890.28564", ""))
+	require.Nil(t, db.audit())
+}
+
+func TestAuditContainerBadMetadata(t *testing.T) {
+	db, dbFile, cleanup, err := createTestDatabase("1410586890.28563")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, db.connect())
+	_, err = db.Exec("UPDATE container_info SET metadata = 'not json'")
+	require.Nil(t, err)
+	err = db.audit()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "Invalid metadata")
+	require.False(t, fs.Exists(dbFile))
+}
+
+func TestContainerAuditorRun(t *testing.T) {
+	db, dbFile, cleanup, err := createTestDatabase("1410586890.28563")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, mergeItemsByName(db, []string{"a"}))
+	deviceRoot := filepath.Dir(filepath.Dir(filepath.Dir(filepath.Dir(filepath.Dir(filepath.Dir(dbFile))))))
+	r := &Replicator{
+		deviceRoot:     deviceRoot,
+		reconCachePath: deviceRoot,
+		logger:         zap.NewNop(),
+		Ring:           &test.FakeRing{MockLocalDevices: []*ring.Device{{Device: "device"}}},
+	}
+	a := newContainerAuditor(r, time.Hour, 0)
+	a.run()
+	require.Equal(t, int64(1), a.passed)
+	require.Equal(t, int64(0), a.failed)
+
+	data, err := ioutil.ReadFile(filepath.Join(deviceRoot, "container.recon"))
+	require.Nil(t, err)
+	recon := map[string]interface{}{}
+	require.Nil(t, json.Unmarshal(data, &recon))
+	require.Equal(t, float64(1), recon["container_audits_passed"])
+	require.Equal(t, float64(0), recon["container_audits_failed"])
+}
@@ -25,6 +25,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/fs"
 )
 
@@ -35,6 +36,8 @@ var (
 	ErrorInvalidMetadata = fmt.Errorf("Invalid metadata value")
 	// ErrorPolicyConflict is returned when an operation conflicts with the container's existing policy.
 	ErrorPolicyConflict = fmt.Errorf("Policy conflicts with existing value")
+	// ErrorNoHistory is returned when a historical listing is requested from a container without object history.
+	ErrorNoHistory = fmt.Errorf("Object history not enabled")
 )
 
 // ContainerInfo represents the container_info database record - basic information about the container.
@@ -64,6 +67,9 @@ type ContainerInfo struct {
 	// This row isn't populated by GetInfo, it only exists for the times this is
 	// serialized during replication.
 	Point int64 `json:"point"`
+	// ShardRanges are the ranges of a sharded container's shards. Once they're
+	// all active, ObjectCount and BytesUsed include what the shards report.
+	ShardRanges []*common.ShardRange `json:"-"`
 }
 
 // ObjectListingRecord is the struct used for serializing objects in json and xml container listings.
@@ -74,6 +80,11 @@ type ObjectListingRecord struct {
 	Size         int64    `xml:"bytes" json:"bytes"`
 	ContentType  string   `xml:"content_type" json:"content_type"`
 	ETag         string   `xml:"hash" json:"hash"`
+	StorageClass string   `xml:"storage_class,omitempty" json:"storage_class,omitempty"`
+	// SymlinkPath is where a symlink points, as /v1/<account>/<container>/<object>.
+	SymlinkPath string `xml:"symlink_path,omitempty" json:"symlink_path,omitempty"`
+	// StoragePolicy is the name of the storage policy the object is in.
+	StoragePolicy string `xml:"storage_policy,omitempty" json:"storage_policy,omitempty"`
 }
 
 // SubdirListingRecord is the struct used for serializing subdirs in json and xml container listings.
@@ -102,6 +113,16 @@ type SyncRecord struct {
 	RemoteID  string `json:"remote_id"`
 }
 
+// MetadataChange is a recorded change to one of a container's ACLs, quotas or sync settings.
+type MetadataChange struct {
+	Name       string  `json:"name"`
+	Value      string  `json:"value"`
+	Previous   string  `json:"previous"`
+	Timestamp  string  `json:"timestamp"`
+	Requester  string  `json:"requester"`
+	RecordedAt float64 `json:"recorded_at"`
+}
+
 // Container is the interface implemented by a container.
 type Container interface {
 	// GetInfo returns the ContainerInfo struct for the container.
@@ -112,14 +133,24 @@ type Container interface {
 	Delete(timestamp string) error
 	// ListObjects lists the container's object entries.
 	ListObjects(limit int, marker string, endMarker string, prefix string, delimiter string, path *string, reverse bool, storagePolicyIndex int) ([]interface{}, error)
+	// ListObjectsAsOf lists the container's object entries as they were at the given timestamp.
+	ListObjectsAsOf(asOf string, limit int, marker string, endMarker string, prefix string, delimiter string, path *string, reverse bool, storagePolicyIndex int) ([]interface{}, error)
 	// GetMetadata returns the container's current metadata.
 	GetMetadata() (map[string]string, error)
-	// UpdateMetadata applies updates to the container's metadata.
-	UpdateMetadata(updates map[string][]string, timestamp string) error
+	// UpdateMetadata applies updates to the container's metadata, recording changes to audited keys as made by requester.
+	UpdateMetadata(updates map[string][]string, timestamp string, requester string) error
+	// MetadataHistory returns the recorded changes to the container's audited metadata with timestamps after since.
+	MetadataHistory(since string) ([]*MetadataChange, error)
 	// PutObject adds a new object to the container.
 	PutObject(name string, timestamp string, size int64, contentType string, etag string, storagePolicyIndex int, expires string) error
 	// DeleteObject deletes an object from the container.
 	DeleteObject(name string, timestamp string, storagePolicyIndex int) error
+	// SetStoragePolicy changes the container's storage policy, which is how a policy migration is finished.
+	SetStoragePolicy(storagePolicyIndex int) error
+	// ShardRanges returns the ranges of the container's shards, in namespace order.
+	ShardRanges() ([]*common.ShardRange, error)
+	// MergeShardRanges merges shard ranges into the container's, keeping the newest bounds and counts of each.
+	MergeShardRanges(ranges []*common.ShardRange) error
 	// ID returns a unique identifier for the container.
 	ID() string
 	// Close frees any resources associated with the container.
@@ -147,12 +178,20 @@ type ReplicableContainer interface {
 	OpenDatabaseFile() (*os.File, func(), error)
 	// CleanupTombstones removes any metadata and object tombstones older than reclaimAge seconds.
 	CleanupTombstones(reclaimAge int64) error
+	// MigrateListingIndex adds the covering listing index if the database doesn't have it yet.
+	MigrateListingIndex() error
 	// CheckSyncLinks makes sure container sync symlinks are correct for the database.
 	CheckSyncLink() error
 	// RingHash returns the container's ring hash.
 	RingHash() string
 	// Reported records the information as having been reported to an account database.
 	Reported(putTimestamp, deleteTimestamp string, objectCount, bytesUsed int64) error
+	// SetSyncPoints records how far container sync has got through the container's rows.
+	SetSyncPoints(point1, point2 int64) error
+	// FindShardBounds returns the names that split the container's objects into shards of rowsPerShard objects.
+	FindShardBounds(rowsPerShard int) ([]string, error)
+	// RemoveItems removes the object records with a ROWID no greater than maxRowid.
+	RemoveItems(maxRowid int64) error
 }
 
 // ContainerEngine is the interface of an object that creates and returns containers.
@@ -162,7 +201,7 @@ type ContainerEngine interface {
 	// Return returns a Container to the engine, where it can close or retain them as it sees fit.
 	Return(c Container)
 	// Create creates a new container.  Returns true if the container was created and a pointer to the container.
-	Create(vars map[string]string, putTimestamp string, metadata map[string][]string, policyIndex, defaultPolicyIndex int) (bool, Container, error)
+	Create(vars map[string]string, putTimestamp string, metadata map[string][]string, policyIndex, defaultPolicyIndex int, requester string) (bool, Container, error)
 	// Close releases all cached containers and any other retained resources.
 	Close()
 
@@ -182,6 +221,7 @@ type lruEngine struct {
 	hashPathPrefix string
 	hashPathSuffix string
 	maxSize        int
+	keepHistory    bool
 	cache          map[string]*lruEntry
 	used           *list.List
 	m              sync.Mutex
@@ -244,6 +284,9 @@ func (l *lruEngine) getbypath(containerFile string) (c Container, err error) {
 	if c, err = sqliteOpenContainer(containerFile); err != nil {
 		return nil, err
 	}
+	if sc, ok := c.(*sqliteContainer); ok {
+		sc.keepHistory = l.keepHistory
+	}
 	l.add(c)
 	return c, nil
 }
@@ -254,7 +297,7 @@ func (l *lruEngine) Get(vars map[string]string) (c Container, err error) {
 }
 
 // Create creates a new container.
-func (l *lruEngine) Create(vars map[string]string, putTimestamp string, metadata map[string][]string, policyIndex, defaultPolicyIndex int) (bool, Container, error) {
+func (l *lruEngine) Create(vars map[string]string, putTimestamp string, metadata map[string][]string, policyIndex, defaultPolicyIndex int, requester string) (bool, Container, error) {
 	containerFile := l.containerLocation(vars)
 	created := false
 	c, err := l.Get(vars)
@@ -263,12 +306,12 @@ func (l *lruEngine) Create(vars map[string]string, putTimestamp string, metadata
 		if policyIndex < 0 {
 			policyIndex = defaultPolicyIndex
 		}
-		err = sqliteCreateContainer(containerFile, vars["account"], vars["container"], putTimestamp, metadata, policyIndex)
+		err = sqliteCreateContainer(containerFile, vars["account"], vars["container"], putTimestamp, metadata, policyIndex, requester)
 		if err == nil {
 			c, err = l.Get(vars)
 		}
 	} else {
-		created, err = sqliteCreateExistingContainer(c, putTimestamp, metadata, policyIndex, defaultPolicyIndex)
+		created, err = sqliteCreateExistingContainer(c, putTimestamp, metadata, policyIndex, defaultPolicyIndex, requester)
 		if err != nil {
 			l.Return(c)
 			c = nil
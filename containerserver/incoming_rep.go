@@ -16,13 +16,16 @@
 package containerserver
 
 import (
+	"crypto/md5"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
 
+	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/fs"
 	"github.com/troubling/hummingbird/common/srv"
 	"go.uber.org/zap"
@@ -105,6 +108,8 @@ func (server *ContainerServer) ContainerReplicateHandler(writer http.ResponseWri
 		return nil
 	}
 	switch op {
+	// Replicators from before databases were created with "create" and
+	// merge_items send the whole database file for these.
 	case "rsync_then_merge":
 		var tmpFileName string
 		if err := extractArgs(&tmpFileName); err != nil {
@@ -138,6 +143,23 @@ func (server *ContainerServer) ContainerReplicateHandler(writer http.ResponseWri
 			status := server.replicateMergeSyncs(request, vars, records)
 			srv.StandardResponse(writer, status)
 		}
+	case "merge_shard_ranges":
+		var ranges []*common.ShardRange
+		if err := extractArgs(&ranges); err != nil {
+			srv.StandardResponse(writer, http.StatusBadRequest)
+		} else {
+			status := server.replicateMergeShardRanges(request, vars, ranges)
+			srv.StandardResponse(writer, status)
+		}
+	case "create":
+		var account, container, putTimestamp string
+		var policyIndex int
+		if err := extractArgs(&account, &container, &putTimestamp, &policyIndex); err != nil {
+			srv.StandardResponse(writer, http.StatusBadRequest)
+		} else {
+			status := server.replicateCreate(request, vars, account, container, putTimestamp, policyIndex)
+			srv.StandardResponse(writer, status)
+		}
 	case "sync":
 		var maxRow int64
 		var hash, id, createdAt, putTimestamp, deleteTimestamp, metadata string
@@ -188,6 +210,17 @@ func (server *ContainerServer) replicateRsyncThenMerge(request *http.Request, va
 			return http.StatusInternalServerError
 		}
 	}
+	if ranges, err := localDb.ShardRanges(); err != nil {
+		srv.GetLogger(request).Error("Error fetching shard ranges.",
+			zap.String("containerFile", containerFile),
+			zap.Error(err))
+		return http.StatusInternalServerError
+	} else if err := tmpDb.MergeShardRanges(ranges); err != nil {
+		srv.GetLogger(request).Error("Error merging shard ranges.",
+			zap.String("tmpContainerFile", tmpContainerFile),
+			zap.Error(err))
+		return http.StatusInternalServerError
+	}
 	if err := tmpDb.NewID(); err != nil {
 		srv.GetLogger(request).Error("Error blessing new container db",
 			zap.String("containerFile", containerFile), zap.Error(err))
@@ -236,6 +269,30 @@ func (server *ContainerServer) replicateCompleteRsync(request *http.Request, var
 	return http.StatusNoContent
 }
 
+// replicateCreate makes an empty database for a container that's missing
+// here. The replicator then syncs its info and merges in its rows.
+func (server *ContainerServer) replicateCreate(request *http.Request, vars map[string]string, account, container, putTimestamp string, policyIndex int) int {
+	h := md5.New()
+	fmt.Fprintf(h, "%s/%s/%s%s", server.hashPathPrefix, account, container, server.hashPathSuffix)
+	if fmt.Sprintf("%032x", h.Sum(nil)) != vars["hash"] {
+		return http.StatusBadRequest
+	}
+	if db, err := server.containerEngine.GetByHash(vars["device"], vars["hash"], vars["partition"]); err == nil {
+		server.containerEngine.Return(db)
+		return http.StatusAccepted
+	}
+	_, db, err := server.containerEngine.Create(map[string]string{"device": vars["device"], "partition": vars["partition"],
+		"account": account, "container": container}, putTimestamp, map[string][]string{}, policyIndex, policyIndex, "")
+	if err != nil {
+		srv.GetLogger(request).Error("Error creating database.",
+			zap.String("vars['hash']", vars["hash"]),
+			zap.Error(err))
+		return http.StatusInternalServerError
+	}
+	server.containerEngine.Return(db)
+	return http.StatusCreated
+}
+
 func (server *ContainerServer) replicateMergeItems(request *http.Request, vars map[string]string, records []*ObjectRecord, remoteID string) int {
 	db, err := server.containerEngine.GetByHash(vars["device"], vars["hash"], vars["partition"])
 	if err != nil {
@@ -266,6 +323,21 @@ func (server *ContainerServer) replicateMergeSyncs(request *http.Request, vars m
 	return http.StatusAccepted
 }
 
+func (server *ContainerServer) replicateMergeShardRanges(request *http.Request, vars map[string]string, ranges []*common.ShardRange) int {
+	db, err := server.containerEngine.GetByHash(vars["device"], vars["hash"], vars["partition"])
+	if err != nil {
+		return http.StatusNotFound
+	}
+	defer server.containerEngine.Return(db)
+	if err := db.MergeShardRanges(ranges); err != nil {
+		srv.GetLogger(request).Error("Error merging shard ranges.",
+			zap.String("RingHash", db.RingHash()),
+			zap.Error(err))
+		return http.StatusInternalServerError
+	}
+	return http.StatusAccepted
+}
+
 func (server *ContainerServer) replicateSync(request *http.Request, vars map[string]string, maxRow int64, hash, id, createdAt, putTimestamp, deleteTimestamp, metadata string) (int, []byte) {
 	db, err := server.containerEngine.GetByHash(vars["device"], vars["hash"], vars["partition"])
 	if err != nil {
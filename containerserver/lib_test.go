@@ -26,6 +26,7 @@ import (
 
 	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/middleware"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -49,7 +50,7 @@ func createTestDatabase(timestamp string) (*sqliteContainer, string, func(), err
 	if err := os.MkdirAll(filepath.Dir(dbFile), 0777); err != nil {
 		return nil, "", nil, err
 	}
-	err = sqliteCreateContainer(dbFile, "a", "c", timestamp, nil, 0)
+	err = sqliteCreateContainer(dbFile, "a", "c", timestamp, nil, 0, "")
 	if err != nil {
 		os.RemoveAll(dir)
 		return nil, "", nil, err
@@ -84,6 +85,7 @@ func makeTestServer() (http.Handler, func(), error) {
 		diskInUse:        common.NewKeyedLimit(2, 2),
 		autoCreatePrefix: ".",
 	}
+	server.adminAuth, _ = middleware.NewAdminAuth("", "", server.logger)
 	cleanup := func() {
 		os.RemoveAll(dir)
 	}
@@ -109,6 +111,7 @@ func makeTestServer2() (*ContainerServer, http.Handler, func(), error) {
 		containerEngine: newLRUEngine(dir, "changeme", "changeme", 32),
 		diskInUse:       common.NewKeyedLimit(2, 2),
 	}
+	server.adminAuth, _ = middleware.NewAdminAuth("", "", server.logger)
 	cleanup := func() {
 		os.RemoveAll(dir)
 	}
@@ -132,12 +135,18 @@ func (f fakeDatabase) Delete(timestamp string) error {
 func (f fakeDatabase) ListObjects(limit int, marker string, endMarker string, prefix string, delimiter string, path *string, reverse bool, storagePolicyIndex int) ([]interface{}, error) {
 	return nil, errors.New("")
 }
+func (f fakeDatabase) ListObjectsAsOf(asOf string, limit int, marker string, endMarker string, prefix string, delimiter string, path *string, reverse bool, storagePolicyIndex int) ([]interface{}, error) {
+	return nil, errors.New("")
+}
 func (f fakeDatabase) GetMetadata() (map[string]string, error) {
 	return nil, errors.New("")
 }
-func (f fakeDatabase) UpdateMetadata(updates map[string][]string, timestamp string) error {
+func (f fakeDatabase) UpdateMetadata(updates map[string][]string, timestamp string, requester string) error {
 	return errors.New("")
 }
+func (f fakeDatabase) MetadataHistory(since string) ([]*MetadataChange, error) {
+	return nil, errors.New("")
+}
 func (f fakeDatabase) MergeItems(records []*ObjectRecord, remoteID string) error {
 	return errors.New("")
 }
@@ -171,6 +180,9 @@ func (f fakeDatabase) Close() error {
 func (f fakeDatabase) CleanupTombstones(reclaimAge int64) error {
 	return errors.New("")
 }
+func (f fakeDatabase) MigrateListingIndex() error {
+	return errors.New("")
+}
 func (f fakeDatabase) CheckSyncLink() error {
 	return errors.New("")
 }
@@ -185,6 +197,30 @@ func (f fakeDatabase) Reported(putTimestamp, deleteTimestamp string, objectCount
 	return errors.New("")
 }
 
+func (f fakeDatabase) SetSyncPoints(point1, point2 int64) error {
+	return errors.New("")
+}
+
+func (f fakeDatabase) ShardRanges() ([]*common.ShardRange, error) {
+	return nil, errors.New("")
+}
+
+func (f fakeDatabase) MergeShardRanges(ranges []*common.ShardRange) error {
+	return errors.New("")
+}
+
+func (f fakeDatabase) SetStoragePolicy(storagePolicyIndex int) error {
+	return errors.New("")
+}
+
+func (f fakeDatabase) FindShardBounds(rowsPerShard int) ([]string, error) {
+	return nil, errors.New("")
+}
+
+func (f fakeDatabase) RemoveItems(maxRowid int64) error {
+	return errors.New("")
+}
+
 type fakeContainerEngine struct{}
 
 func (fakeContainerEngine) OpenCount() int {
@@ -197,7 +233,7 @@ func (fakeContainerEngine) Get(vars map[string]string) (c Container, err error)
 func (fakeContainerEngine) GetByHash(device, hash, partition string) (c ReplicableContainer, err error) {
 	return nil, errors.New("")
 }
-func (fakeContainerEngine) Create(vars map[string]string, putTimestamp string, metadata map[string][]string, policyIndex, defaultPolicyIndex int) (bool, Container, error) {
+func (fakeContainerEngine) Create(vars map[string]string, putTimestamp string, metadata map[string][]string, policyIndex, defaultPolicyIndex int, requester string) (bool, Container, error) {
 	return false, nil, errors.New("")
 }
 func (fakeContainerEngine) PutObject(vars map[string]string, timestamp string, size int64, contentType string, etag string, storagePolicyIndex int) error {
@@ -0,0 +1,60 @@
+package containerserver
+
+import (
+	"strconv"
+)
+
+// policyMigrationKey is the container sysmeta holding the index of the storage
+// policy the container's objects are being moved to. While it's set, the
+// proxy writes new objects to that policy and the mover copies the existing
+// ones there, and listings and counts cover both policies. The cutover then
+// makes it the container's policy and clears this.
+const policyMigrationKey = "X-Container-Sysmeta-Policy-Migration"
+
+// migrationPolicy returns the index of the storage policy the container's
+// objects are being moved to, if they are.
+func migrationPolicy(metadata map[string][]string) (int, bool) {
+	value, ok := metadata[policyMigrationKey]
+	if !ok || len(value) == 0 || value[0] == "" {
+		return 0, false
+	}
+	index, err := strconv.Atoi(value[0])
+	return index, err == nil
+}
+
+func listingName(entry interface{}) string {
+	switch e := entry.(type) {
+	case *ObjectListingRecord:
+		return e.Name
+	case *SubdirListingRecord:
+		return e.Name
+	}
+	return ""
+}
+
+// mergeListings merges the listings of a migrating container's old and new
+// policies, each already limited to the same marker, end marker and limit.
+// An object that's in both is listed as it is in the new policy, since the
+// mover only copies objects there.
+func mergeListings(older, newer []interface{}, limit int, reverse bool) []interface{} {
+	merged := make([]interface{}, 0, len(older)+len(newer))
+	for len(merged) < limit && (len(older) > 0 || len(newer) > 0) {
+		if len(older) == 0 {
+			merged, newer = append(merged, newer[0]), newer[1:]
+			continue
+		}
+		if len(newer) == 0 {
+			merged, older = append(merged, older[0]), older[1:]
+			continue
+		}
+		oldName, newName := listingName(older[0]), listingName(newer[0])
+		if oldName == newName {
+			merged, older, newer = append(merged, newer[0]), older[1:], newer[1:]
+		} else if (oldName < newName) != reverse {
+			merged, older = append(merged, older[0]), older[1:]
+		} else {
+			merged, newer = append(merged, newer[0]), newer[1:]
+		}
+	}
+	return merged
+}
@@ -0,0 +1,103 @@
+package containerserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+)
+
+func TestMergeListings(t *testing.T) {
+	obj := func(name string, policy string) interface{} {
+		return &ObjectListingRecord{Name: name, StoragePolicy: policy}
+	}
+	older := []interface{}{obj("a", "gold"), obj("c", "gold"), &SubdirListingRecord{Name: "d/"}}
+	newer := []interface{}{obj("b", "silver"), obj("c", "silver"), &SubdirListingRecord{Name: "d/"}, obj("e", "silver")}
+	merged := mergeListings(older, newer, 10, false)
+	require.Equal(t, 5, len(merged))
+	require.Equal(t, "a", merged[0].(*ObjectListingRecord).Name)
+	require.Equal(t, "b", merged[1].(*ObjectListingRecord).Name)
+	require.Equal(t, "silver", merged[2].(*ObjectListingRecord).StoragePolicy)
+	require.Equal(t, "d/", merged[3].(*SubdirListingRecord).Name)
+	require.Equal(t, "e", merged[4].(*ObjectListingRecord).Name)
+
+	require.Equal(t, 2, len(mergeListings(older, newer, 2, false)))
+
+	merged = mergeListings([]interface{}{obj("c", "gold"), obj("a", "gold")}, []interface{}{obj("b", "silver")}, 10, true)
+	require.Equal(t, 3, len(merged))
+	require.Equal(t, "c", merged[0].(*ObjectListingRecord).Name)
+	require.Equal(t, "b", merged[1].(*ObjectListingRecord).Name)
+	require.Equal(t, "a", merged[2].(*ObjectListingRecord).Name)
+}
+
+func TestPolicyMigration(t *testing.T) {
+	defer func(d time.Duration) { infoCacheTimeout = d }(infoCacheTimeout)
+	infoCacheTimeout = 0
+	server, handler, cleanup, err := makeTestServer2()
+	require.Nil(t, err)
+	defer cleanup()
+	server.policyList = conf.PolicyList{0: &conf.Policy{Index: 0, Name: "gold"}, 1: &conf.Policy{Index: 1, Name: "silver"}}
+
+	do := func(method, path string, headers map[string]string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, nil)
+		require.Nil(t, err)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	putObject := func(obj, policy string) {
+		require.Equal(t, 201, do("PUT", "/device/1/a/c/"+obj, map[string]string{"X-Timestamp": common.GetTimestamp(), "X-Size": "1",
+			"X-Content-Type": "text/plain", "X-Etag": "d41d8cd98f00b204e9800998ecf8427e", "X-Backend-Storage-Policy-Index": policy}).Code)
+	}
+	list := func(headers map[string]string) []*ObjectListingRecord {
+		w := do("GET", "/device/1/a/c?format=json", headers)
+		require.Equal(t, 200, w.Code)
+		var listing []*ObjectListingRecord
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &listing))
+		return listing
+	}
+	require.Equal(t, 201, do("PUT", "/device/1/a/c", map[string]string{"X-Timestamp": common.GetTimestamp(), "X-Backend-Storage-Policy-Index": "0"}).Code)
+	putObject("o1", "0")
+	putObject("o2", "0")
+	require.Equal(t, 204, do("POST", "/device/1/a/c", map[string]string{"X-Timestamp": common.GetTimestamp(), policyMigrationKey: "1"}).Code)
+	putObject("o3", "1")
+
+	// Both policies are listed and counted until the cutover.
+	listing := list(nil)
+	require.Equal(t, 3, len(listing))
+	require.Equal(t, "gold", listing[0].StoragePolicy)
+	require.Equal(t, "silver", listing[2].StoragePolicy)
+	require.Equal(t, 2, len(list(map[string]string{"X-Backend-Storage-Policy-Index": "0"})))
+	w := do("HEAD", "/device/1/a/c", nil)
+	require.Equal(t, "3", w.Header().Get("X-Container-Object-Count"))
+	require.Equal(t, "0", w.Header().Get("X-Backend-Storage-Policy-Index"))
+	require.Equal(t, "1", w.Header().Get(policyMigrationKey))
+
+	// Moving an object leaves it in the new policy and a tombstone in the old.
+	putObject("o1", "1")
+	require.Equal(t, 204, do("DELETE", "/device/1/a/c/o1", map[string]string{"X-Timestamp": common.GetTimestamp(), "X-Backend-Storage-Policy-Index": "0"}).Code)
+	listing = list(nil)
+	require.Equal(t, 3, len(listing))
+	require.Equal(t, "silver", listing[0].StoragePolicy)
+
+	require.Equal(t, 400, do("POST", "/device/1/a/c", map[string]string{"X-Timestamp": common.GetTimestamp(), "X-Backend-Policy-Cutover": "5"}).Code)
+	require.Equal(t, 204, do("POST", "/device/1/a/c", map[string]string{"X-Timestamp": common.GetTimestamp(),
+		"X-Backend-Policy-Cutover": "1", policyMigrationKey: ""}).Code)
+	w = do("HEAD", "/device/1/a/c", nil)
+	require.Equal(t, "1", w.Header().Get("X-Backend-Storage-Policy-Index"))
+	require.Equal(t, "silver", w.Header().Get("X-Storage-Policy"))
+	require.Equal(t, "", w.Header().Get(policyMigrationKey))
+	require.Equal(t, "2", w.Header().Get("X-Container-Object-Count"))
+	listing = list(nil)
+	require.Equal(t, 2, len(listing))
+	require.Equal(t, "o1", listing[0].Name)
+	require.Equal(t, "o3", listing[1].Name)
+}
@@ -42,13 +42,13 @@ import (
 	"github.com/troubling/hummingbird/client"
 	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/crypt"
 	"github.com/troubling/hummingbird/common/fs"
 	"github.com/troubling/hummingbird/common/ring"
 	"github.com/troubling/hummingbird/common/srv"
 	"github.com/troubling/hummingbird/common/tracing"
 	"github.com/troubling/hummingbird/middleware"
 	"github.com/uber-go/tally"
-	promreporter "github.com/uber-go/tally/prometheus"
 	"go.uber.org/zap"
 	"golang.org/x/net/http2"
 )
@@ -76,14 +76,19 @@ type Replicator struct {
 	checkin           chan string
 	startRun          chan string
 	client            common.HTTPClient
+	backends          *common.BackendTransport
 	runningDevices    map[string]*replicationDevice
 	reclaimAge        int64
 	logLevel          zap.AtomicLevel
 	metricsCloser     io.Closer
+	metricsScope      tally.Scope
 	traceCloser       io.Closer
 	tracer            opentracing.Tracer
 	clientTracer      opentracing.Tracer
 	clientTraceCloser io.Closer
+	sync              *containerSync
+	sharder           *containerSharder
+	auditor           *containerAuditor
 }
 
 type statUpdate struct {
@@ -96,9 +101,9 @@ type replicationDevice struct {
 	i interface {
 		sendReplicationMessage(dev *ring.Device, part uint64, ringHash string, args ...interface{}) (int, []byte, error)
 		sync(dev *ring.Device, part uint64, ringHash string, info *ContainerInfo) (*ContainerInfo, error)
-		rsync(dev *ring.Device, c ReplicableContainer, part uint64, op string) error
-		usync(dev *ring.Device, c ReplicableContainer, part uint64, localID string, point int64) error
-		chooseReplicationStrategy(localInfo, remoteInfo *ContainerInfo, usyncThreshold int64) string
+		create(dev *ring.Device, part uint64, ringHash string, info *ContainerInfo) error
+		usync(dev *ring.Device, c ReplicableContainer, part uint64, localID string, point int64, maxUsyncs int) error
+		chooseReplicationStrategy(localInfo, remoteInfo *ContainerInfo) string
 		replicateDatabaseToDevice(dev *ring.Device, c ReplicableContainer, part uint64, ringIndex int) error
 		replicateDatabase(dbFile string) error
 		findContainerDbs(devicePath string, results chan string)
@@ -157,34 +162,24 @@ func (rd *replicationDevice) sync(dev *ring.Device, part uint64, ringHash string
 	return &remoteInfo, nil
 }
 
-func (rd *replicationDevice) rsync(dev *ring.Device, c ReplicableContainer, part uint64, op string) error {
-	tmpFilename := common.UUID()
-	fp, release, err := c.OpenDatabaseFile()
+// create has the remote device make an empty database for the container, for
+// usync to fill in.
+func (rd *replicationDevice) create(dev *ring.Device, part uint64, ringHash string, info *ContainerInfo) error {
+	status, _, err := rd.i.sendReplicationMessage(dev, part, ringHash, "create", info.Account, info.Container,
+		info.PutTimestamp, info.StoragePolicyIndex)
 	if err != nil {
-		return fmt.Errorf("Error opening databae: %v", err)
-	}
-	defer release()
-	req, err := http.NewRequest("PUT", fmt.Sprintf("%s://%s:%d/%s/tmp/%s", dev.Scheme, dev.Ip, dev.Port, dev.Device, tmpFilename), fp)
-	if err != nil {
-		return fmt.Errorf("creating request: %v", err)
-	}
-	req.Cancel = rd.cancel
-	resp, err := rd.r.client.Do(req)
-	if err != nil {
-		return fmt.Errorf("putting database to %s/%s: %v", dev.Ip, dev.Device, err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode/100 != 2 {
-		return fmt.Errorf("bad status code %d rsyncing file with %s/%s", resp.StatusCode, dev.Ip, dev.Device)
-	}
-	status, _, err := rd.i.sendReplicationMessage(dev, part, c.RingHash(), op, tmpFilename)
-	if err != nil || status/100 != 2 {
-		return fmt.Errorf("sending %s message to %s/%s: status %d: %v", op, dev.Ip, dev.Device, status, err)
+		return fmt.Errorf("sending create request to %s/%s: %v", dev.Ip, dev.Device, err)
+	} else if status == http.StatusInsufficientStorage {
+		return errDeviceNotMounted
+	} else if status/100 != 2 {
+		return fmt.Errorf("bad status code %d creating database on %s/%s", status, dev.Ip, dev.Device)
 	}
 	return nil
 }
 
-func (rd *replicationDevice) usync(dev *ring.Device, c ReplicableContainer, part uint64, localID string, point int64) error {
+// usync sends the remote database the rows after point, in at most maxUsyncs
+// merge_items requests, or in as many as it takes if maxUsyncs is 0.
+func (rd *replicationDevice) usync(dev *ring.Device, c ReplicableContainer, part uint64, localID string, point int64, maxUsyncs int) error {
 	objects, err := c.ItemsSince(point, int(rd.r.perUsync))
 	if err != nil {
 		return fmt.Errorf("getting object records from %s: %v", c.RingHash(), err)
@@ -194,7 +189,7 @@ func (rd *replicationDevice) usync(dev *ring.Device, c ReplicableContainer, part
 	if err != nil {
 		return fmt.Errorf("Error getting sync table: %v", err)
 	}
-	for len(objects) != 0 && usyncs < rd.r.maxUsyncs {
+	for len(objects) != 0 && (maxUsyncs == 0 || usyncs < maxUsyncs) {
 		status, _, err := rd.i.sendReplicationMessage(dev, part, c.RingHash(), "merge_items", objects, localID)
 		if err != nil || status/100 != 2 {
 			return fmt.Errorf("Bad response to merge_items with %s/%s: status %d: %v", dev.Ip, dev.Device, status, err)
@@ -205,7 +200,7 @@ func (rd *replicationDevice) usync(dev *ring.Device, c ReplicableContainer, part
 			return fmt.Errorf("getting object records from database: %s, %v", c.RingHash(), err)
 		}
 	}
-	if usyncs >= rd.r.maxUsyncs {
+	if maxUsyncs > 0 && usyncs >= maxUsyncs {
 		rd.i.incrementStat("diff_capped")
 		return fmt.Errorf("capping usync at %d requests", usyncs)
 	}
@@ -219,18 +214,16 @@ func (rd *replicationDevice) usync(dev *ring.Device, c ReplicableContainer, part
 	return nil
 }
 
-func (rd *replicationDevice) chooseReplicationStrategy(localInfo, remoteInfo *ContainerInfo, usyncThreshold int64) string {
+func (rd *replicationDevice) chooseReplicationStrategy(localInfo, remoteInfo *ContainerInfo) string {
 	switch {
 	case remoteInfo == nil:
-		return "complete_rsync"
+		return "create"
 	case localInfo.MaxRow == -1:
 		return "empty"
 	case localInfo.MaxRow == remoteInfo.Point:
 		return "no_change"
 	case localInfo.Hash == remoteInfo.Hash:
 		return "hashmatch"
-	case remoteInfo.MaxRow < localInfo.MaxRow*2 && localInfo.MaxRow-remoteInfo.MaxRow > usyncThreshold:
-		return "rsync_then_merge"
 	default:
 		return "diff"
 	}
@@ -274,27 +267,52 @@ func (rd *replicationDevice) replicateDatabaseToDevice(dev *ring.Device, c Repli
 	if err != nil {
 		return err
 	}
-	strategy := rd.i.chooseReplicationStrategy(info, remoteInfo, rd.r.perUsync*3)
+	strategy := rd.i.chooseReplicationStrategy(info, remoteInfo)
 	rd.i.incrementStat(strategy)
 	switch strategy {
 	case "empty", "hashmatch", "no_change":
 		rd.r.logger.Debug("Not replicating anything.",
 			zap.String("strategy", strategy),
 			zap.String("RingHash", c.RingHash()))
-	case "complete_rsync", "rsync_then_merge":
-		rd.r.logger.Debug("Replicating ringhash",
-			zap.String("RingHash", c.RingHash()),
-			zap.String("Ip", dev.Ip),
-			zap.String("Device", dev.Device),
-			zap.String("strategy", strategy))
-		return rd.i.rsync(dev, c, part, strategy)
-	case "diff":
+	case "create", "diff":
 		rd.r.logger.Debug("Replicating ringhash",
 			zap.String("RingHash", c.RingHash()),
 			zap.String("Ip", dev.Ip),
 			zap.String("Device", dev.Device),
 			zap.String("strategy", strategy))
-		return rd.i.usync(dev, c, part, info.ID, remoteInfo.Point)
+		maxUsyncs := rd.r.maxUsyncs
+		if strategy == "create" {
+			// A new database is filled in all at once, rather than serving
+			// part of the listing for passes to come.
+			maxUsyncs = 0
+			if err := rd.i.create(dev, part, c.RingHash(), info); err != nil {
+				return err
+			}
+			if remoteInfo, err = rd.i.sync(dev, part, c.RingHash(), info); err != nil {
+				return err
+			} else if remoteInfo == nil {
+				return fmt.Errorf("no database on %s/%s after creating it", dev.Ip, dev.Device)
+			}
+		}
+		if err := rd.i.usync(dev, c, part, info.ID, remoteInfo.Point, maxUsyncs); err != nil {
+			return err
+		}
+	}
+	return rd.mergeShardRanges(dev, part, c.RingHash(), info.ShardRanges)
+}
+
+// mergeShardRanges sends a sharded container's ranges to the remote
+// database, which the object hash doesn't say anything about.
+func (rd *replicationDevice) mergeShardRanges(dev *ring.Device, part uint64, ringHash string, ranges []*common.ShardRange) error {
+	if len(ranges) == 0 {
+		return nil
+	}
+	status, _, err := rd.i.sendReplicationMessage(dev, part, ringHash, "merge_shard_ranges", ranges)
+	if err != nil {
+		return fmt.Errorf("sending merge_shard_ranges to %s/%s: %v", dev.Ip, dev.Device, err)
+	}
+	if status/100 != 2 {
+		return fmt.Errorf("Invalid status code from merge_shard_ranges: %d", status)
 	}
 	return nil
 }
@@ -332,6 +350,9 @@ func (rd *replicationDevice) replicateDatabase(dbFile string) error {
 	if err := c.CleanupTombstones(rd.r.reclaimAge); err != nil {
 		return err
 	}
+	if err := c.MigrateListingIndex(); err != nil {
+		return err
+	}
 	if err := c.CheckSyncLink(); err != nil {
 		return err
 	}
@@ -514,21 +535,36 @@ func (server *Replicator) Background(flags *flag.FlagSet) chan struct{} {
 		go func() {
 			defer close(ch)
 			server.Run()
+			if server.sync != nil {
+				server.sync.run()
+			}
+			if server.sharder != nil {
+				server.sharder.run()
+			}
+			if server.auditor != nil {
+				server.auditor.run()
+			}
 		}()
 		return ch
 	}
 	go server.RunForever()
+	if server.sync != nil {
+		go server.sync.runForever()
+	}
+	if server.sharder != nil {
+		go server.sharder.runForever()
+	}
+	if server.auditor != nil {
+		go server.auditor.runForever()
+	}
 	return nil
 }
 
 func (server *Replicator) GetHandler(config conf.Config, metricsPrefix string) http.Handler {
-	var metricsScope tally.Scope
-	metricsScope, server.metricsCloser = tally.NewRootScope(tally.ScopeOptions{
-		Prefix:         metricsPrefix,
-		Tags:           map[string]string{},
-		CachedReporter: promreporter.NewReporter(promreporter.Options{}),
-		Separator:      promreporter.DefaultSeparator,
-	}, time.Second)
+	server.metricsScope, server.metricsCloser = srv.NewMetricsScope(config, metricsPrefix)
+	if server.backends != nil {
+		server.backends.SetMetricsScope(server.metricsScope)
+	}
 	commonHandlers := alice.New(
 		middleware.NewDebugResponses(config.GetBool("debug", "debug_x_source_code", false)),
 		server.LogRequest,
@@ -542,7 +578,7 @@ func (server *Replicator) GetHandler(config conf.Config, metricsPrefix string) h
 	router.Get("/healthcheck", commonHandlers.ThenFunc(server.HealthcheckHandler))
 	router.Get("/debug/pprof/:parm", http.DefaultServeMux)
 	router.Post("/debug/pprof/:parm", http.DefaultServeMux)
-	return alice.New(middleware.Metrics(metricsScope), middleware.ServerTracer(server.tracer)).Then(router)
+	return alice.New(middleware.Metrics(server.metricsScope), middleware.ServerTracer(server.tracer)).Then(router)
 }
 
 func (server *Replicator) Finalize() {
@@ -651,10 +687,16 @@ func (r *Replicator) runLoopCheck(reportTimer <-chan time.Time) {
 			}
 			rd.lifetimeStats["passes"]++
 		}
+		if r.metricsScope != nil {
+			r.metricsScope.Counter(fmt.Sprintf("%s_passes", device)).Inc(1)
+		}
 	case update := <-r.sendStat:
 		if rd, ok := r.runningDevices[update.device]; ok {
 			rd.stats[update.stat] += update.value
 		}
+		if r.metricsScope != nil {
+			r.metricsScope.Counter(fmt.Sprintf("%s_%s", update.device, update.stat)).Inc(update.value)
+		}
 	case <-reportTimer:
 		r.reportStats()
 		r.verifyDevices()
@@ -735,10 +777,15 @@ func NewReplicator(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLo
 	port := int(serverconf.GetInt("container-replicator", "bind_port", common.DefaultContainerReplicatorPort))
 	certFile := serverconf.GetDefault("container-replicator", "cert_file", "")
 	keyFile := serverconf.GetDefault("container-replicator", "key_file", "")
+	caFile := serverconf.GetDefault("container-replicator", "ca_file", "")
+	if err := common.SetClusterCA(caFile); err != nil {
+		return ipPort, nil, nil, err
+	}
 
+	backendConfig := common.LoadBackendConfig(serverconf.GetSection("container-replicator"), common.DefaultBackendConfig)
 	transport := &http.Transport{
 		Dial:                (&net.Dialer{Timeout: time.Second}).Dial,
-		MaxIdleConnsPerHost: 100,
+		MaxIdleConnsPerHost: backendConfig.MaxIdleConnsPerNode,
 		MaxIdleConns:        0,
 	}
 	if certFile != "" && keyFile != "" {
@@ -751,9 +798,10 @@ func NewReplicator(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLo
 			return ipPort, nil, nil, fmt.Errorf("Error setting up http2: %v", err)
 		}
 	}
+	backends := common.NewBackendTransport(common.NewSigningTransport(transport, conf.GetBackendSigningKeys()), backendConfig)
 	c := &http.Client{
 		Timeout:   time.Minute * 15,
-		Transport: transport,
+		Transport: backends,
 	}
 	server := &Replicator{
 		runningDevices: make(map[string]*replicationDevice),
@@ -772,6 +820,7 @@ func NewReplicator(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLo
 		Ring:           ring,
 		accountRing:    accountRing,
 		client:         c,
+		backends:       backends,
 		logLevel:       logLevel,
 	}
 	if serverconf.HasSection("tracing") {
@@ -789,6 +838,47 @@ func NewReplicator(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLo
 			return ipPort, nil, nil, fmt.Errorf("Error setting up tracing client: %v", err)
 		}
 	}
-	ipPort = &srv.IpPort{Ip: ip, Port: port, CertFile: certFile, KeyFile: keyFile}
+	if serverconf.HasSection("container-sync") {
+		realms, err := cnf.GetSyncRealms()
+		if err != nil {
+			return ipPort, nil, nil, fmt.Errorf("Error loading container sync realms: %v", err)
+		}
+		policies, err := cnf.GetPolicies()
+		if err != nil {
+			return ipPort, nil, nil, err
+		}
+		pdc, err := client.NewProxyClient(policies, cnf, logger, certFile, keyFile, "", "", "", conf.Config{})
+		if err != nil {
+			return ipPort, nil, nil, fmt.Errorf("Could not make client: %v", err)
+		}
+		var keys *crypt.Keymaster
+		syncConf := serverconf.GetSection("container-sync")
+		// The same key settings as the proxy's encryption filter, to decrypt what it encrypted.
+		if _, ok := syncConf.Get("encryption_root_secret"); ok || syncConf.GetDefault("key_source", "") != "" {
+			if keys, err = crypt.NewKeymaster(syncConf); err != nil {
+				return ipPort, nil, nil, fmt.Errorf("Error loading container sync encryption keys: %v", err)
+			}
+		}
+		server.sync = newContainerSync(server, realms, &http.Client{Timeout: time.Minute * 15}, pdc.NewRequestClient(nil, nil, logger), keys,
+			time.Duration(serverconf.GetFloat("container-sync", "interval", 300)*float64(time.Second)),
+			time.Duration(serverconf.GetFloat("container-sync", "container_time", 60)*float64(time.Second)),
+			hashPathPrefix, hashPathSuffix)
+	}
+	if serverconf.HasSection("container-sharder") {
+		threshold := serverconf.GetInt("container-sharder", "shard_container_threshold", 1000000)
+		server.sharder = newContainerSharder(server, threshold,
+			int(serverconf.GetInt("container-sharder", "rows_per_shard", threshold/2)),
+			time.Duration(serverconf.GetFloat("container-sharder", "interval", 300)*float64(time.Second)),
+			hashPathPrefix, hashPathSuffix)
+	}
+	if serverconf.HasSection("container-auditor") {
+		server.auditor = newContainerAuditor(server,
+			time.Duration(serverconf.GetFloat("container-auditor", "interval", 1800)*float64(time.Second)),
+			serverconf.GetInt("container-auditor", "containers_per_second", 200))
+	}
+	ipPort = &srv.IpPort{Ip: ip, Port: port, CertFile: certFile, KeyFile: keyFile, CAFile: caFile,
+		ClientCertOptional: !serverconf.GetBool("container-replicator", "require_client_cert", true),
+		HTTP2:              srv.NewHTTP2Config(serverconf.GetSection("container-replicator")),
+		UnixSocket:         serverconf.GetDefault("container-replicator", "bind_unix_socket", "")}
 	return ipPort, server, logger, nil
 }
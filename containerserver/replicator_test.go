@@ -19,7 +19,6 @@ import (
 	"encoding/json"
 	"errors"
 	"flag"
-	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -32,6 +31,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/conf"
 	"github.com/troubling/hummingbird/common/fs"
 	"github.com/troubling/hummingbird/common/ring"
@@ -46,9 +46,9 @@ type patchableReplicationDevice struct {
 	rd                         *replicationDevice
 	_sendReplicationMessage    func(dev *ring.Device, part uint64, ringHash string, args ...interface{}) (int, []byte, error)
 	_sync                      func(dev *ring.Device, part uint64, ringHash string, info *ContainerInfo) (*ContainerInfo, error)
-	_rsync                     func(dev *ring.Device, c ReplicableContainer, part uint64, op string) error
-	_usync                     func(dev *ring.Device, c ReplicableContainer, part uint64, localID string, point int64) error
-	_chooseReplicationStrategy func(localInfo, remoteInfo *ContainerInfo, usyncThreshold int64) string
+	_create                    func(dev *ring.Device, part uint64, ringHash string, info *ContainerInfo) error
+	_usync                     func(dev *ring.Device, c ReplicableContainer, part uint64, localID string, point int64, maxUsyncs int) error
+	_chooseReplicationStrategy func(localInfo, remoteInfo *ContainerInfo) string
 	_replicateDatabaseToDevice func(dev *ring.Device, c ReplicableContainer, part uint64) error
 	_replicateDatabase         func(dbFile string) error
 	_findContainerDbs          func(devicePath string, results chan string)
@@ -67,23 +67,23 @@ func (d *patchableReplicationDevice) sync(dev *ring.Device, part uint64, ringHas
 	}
 	return d.rd.sync(dev, part, ringHash, info)
 }
-func (d *patchableReplicationDevice) rsync(dev *ring.Device, c ReplicableContainer, part uint64, op string) error {
-	if d._rsync != nil {
-		return d._rsync(dev, c, part, op)
+func (d *patchableReplicationDevice) create(dev *ring.Device, part uint64, ringHash string, info *ContainerInfo) error {
+	if d._create != nil {
+		return d._create(dev, part, ringHash, info)
 	}
-	return d.rd.rsync(dev, c, part, op)
+	return d.rd.create(dev, part, ringHash, info)
 }
-func (d *patchableReplicationDevice) usync(dev *ring.Device, c ReplicableContainer, part uint64, localID string, point int64) error {
+func (d *patchableReplicationDevice) usync(dev *ring.Device, c ReplicableContainer, part uint64, localID string, point int64, maxUsyncs int) error {
 	if d._usync != nil {
-		return d._usync(dev, c, part, localID, point)
+		return d._usync(dev, c, part, localID, point, maxUsyncs)
 	}
-	return d.rd.usync(dev, c, part, localID, point)
+	return d.rd.usync(dev, c, part, localID, point, maxUsyncs)
 }
-func (d *patchableReplicationDevice) chooseReplicationStrategy(localInfo, remoteInfo *ContainerInfo, usyncThreshold int64) string {
+func (d *patchableReplicationDevice) chooseReplicationStrategy(localInfo, remoteInfo *ContainerInfo) string {
 	if d._chooseReplicationStrategy != nil {
-		return d._chooseReplicationStrategy(localInfo, remoteInfo, usyncThreshold)
+		return d._chooseReplicationStrategy(localInfo, remoteInfo)
 	}
-	return d.rd.chooseReplicationStrategy(localInfo, remoteInfo, usyncThreshold)
+	return d.rd.chooseReplicationStrategy(localInfo, remoteInfo)
 }
 func (d *patchableReplicationDevice) replicateDatabaseToDevice(dev *ring.Device, c ReplicableContainer, part uint64, ringIndex int) error {
 	if d._replicateDatabaseToDevice != nil {
@@ -223,31 +223,70 @@ func TestReplicatorSyncUnmounted(t *testing.T) {
 	require.Equal(t, err, errDeviceNotMounted)
 }
 
-func TestReplicatorRsync(t *testing.T) {
-	tmpFileName := ""
+func TestReplicatorCreate(t *testing.T) {
 	dev, cleanup1 := testServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "PUT" {
-			written, err := io.Copy(ioutil.Discard, r.Body)
-			require.Nil(t, err)
-			require.True(t, written > 0)
-			tmpFileName = filepath.Base(r.URL.Path)
-		} else if r.Method == "REPLICATE" {
-			var args []interface{}
-			body, err := ioutil.ReadAll(r.Body)
-			require.Nil(t, err)
-			require.Nil(t, json.Unmarshal(body, &args))
-			require.Equal(t, args[0], "complete_rsync")
-			require.Equal(t, args[1], tmpFileName)
-		}
+		var args []interface{}
+		body, err := ioutil.ReadAll(r.Body)
+		require.Nil(t, err)
+		require.Nil(t, json.Unmarshal(body, &args))
+		require.Equal(t, []interface{}{"create", "a", "c", "1410586890.28563", float64(0)}, args)
+		w.WriteHeader(http.StatusCreated)
 	}))
 	defer cleanup1()
 	rd := newTestReplicationDevice(&ring.Device{}, &Replicator{client: http.DefaultClient})
 	c, _, cleanup2, err := createTestDatabase("1410586890.28563")
 	require.Nil(t, err)
-	require.Nil(t, mergeItemsByName(c, []string{"a", "b", "c"}))
 	defer cleanup2()
-	err = rd.rsync(dev, c, 1, "complete_rsync")
+	info, err := c.GetInfo()
 	require.Nil(t, err)
+	require.Nil(t, rd.create(dev, 1, c.RingHash(), info))
+}
+
+func TestReplicatorCreateAndMerge(t *testing.T) {
+	local, localHandler, cleanup1, err := makeTestServer2()
+	require.Nil(t, err)
+	defer cleanup1()
+	_, remoteHandler, cleanup2, err := makeTestServer2()
+	require.Nil(t, err)
+	defer cleanup2()
+	dev, cleanup3 := testServer(t, remoteHandler)
+	defer cleanup3()
+	dev.Device = "device"
+
+	do := func(handler http.Handler, method, path string, headers map[string]string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, nil)
+		require.Nil(t, err)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	require.Equal(t, 201, do(localHandler, "PUT", "/device/1/a/c", map[string]string{"X-Timestamp": common.GetTimestamp(),
+		"X-Backend-Storage-Policy-Index": "0", "X-Container-Meta-Color": "blue"}).Code)
+	for _, obj := range []string{"o1", "o2", "o3"} {
+		require.Equal(t, 201, do(localHandler, "PUT", "/device/1/a/c/"+obj, map[string]string{"X-Timestamp": common.GetTimestamp(),
+			"X-Size": "1", "X-Content-Type": "text/plain", "X-Etag": "d41d8cd98f00b204e9800998ecf8427e"}).Code)
+	}
+	c, err := local.containerEngine.GetByHash("device", "6eff33b3ff33852f4cfb514aaa7f5199", "1")
+	require.Nil(t, err)
+	defer local.containerEngine.Return(c)
+
+	rd := newTestReplicationDevice(&ring.Device{}, &Replicator{client: http.DefaultClient, perUsync: 2, maxUsyncs: 5})
+	require.Nil(t, rd.replicateDatabaseToDevice(dev, c, 1, 0))
+	w := do(remoteHandler, "GET", "/device/1/a/c", nil)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "o1\no2\no3\n", w.Body.String())
+	require.Equal(t, "blue", w.Header().Get("X-Container-Meta-Color"))
+
+	// The remote database is now up to date.
+	strategies := []string{}
+	rd._incrementStat = func(stat string) {
+		strategies = append(strategies, stat)
+	}
+	require.Nil(t, rd.replicateDatabaseToDevice(dev, c, 1, 0))
+	require.Equal(t, []string{"attempted", "no_change"}, strategies)
 }
 
 func TestReplicatorUsync(t *testing.T) {
@@ -270,27 +309,44 @@ func TestReplicatorUsync(t *testing.T) {
 	require.Nil(t, err)
 	require.Nil(t, mergeItemsByName(c, []string{"a", "b", "c"}))
 	defer cleanup2()
-	err = rd.usync(dev, c, 1, "12345", -1)
+	err = rd.usync(dev, c, 1, "12345", -1, 5)
 	require.Nil(t, err)
 }
 
+func TestReplicatorUsyncCapped(t *testing.T) {
+	requests := 0
+	dev, cleanup1 := testServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer cleanup1()
+	rd := newTestReplicationDevice(&ring.Device{}, &Replicator{client: http.DefaultClient, perUsync: 1, maxUsyncs: 2})
+	c, _, cleanup2, err := createTestDatabase("1410586890.28563")
+	require.Nil(t, err)
+	defer cleanup2()
+	require.Nil(t, mergeItemsByName(c, []string{"a", "b", "c"}))
+	require.NotNil(t, rd.usync(dev, c, 1, "12345", -1, 2))
+	require.Equal(t, 2, requests)
+
+	// With no cap, every row is sent, as when a database is created.
+	requests = 0
+	require.Nil(t, rd.usync(dev, c, 1, "12345", -1, 0))
+	require.Equal(t, 4, requests)
+}
+
 func TestReplicatorChooseReplicationStrategy(t *testing.T) {
 	rd := newTestReplicationDevice(&ring.Device{}, &Replicator{client: http.DefaultClient})
-	require.Equal(t, "complete_rsync", rd.chooseReplicationStrategy(&ContainerInfo{}, nil, 100))
-	require.Equal(t, "empty", rd.chooseReplicationStrategy(&ContainerInfo{MaxRow: -1}, &ContainerInfo{}, 100))
-	require.Equal(t, "no_change", rd.chooseReplicationStrategy(&ContainerInfo{MaxRow: 123}, &ContainerInfo{Point: 123}, 100))
+	require.Equal(t, "create", rd.chooseReplicationStrategy(&ContainerInfo{}, nil))
+	require.Equal(t, "empty", rd.chooseReplicationStrategy(&ContainerInfo{MaxRow: -1}, &ContainerInfo{}))
+	require.Equal(t, "no_change", rd.chooseReplicationStrategy(&ContainerInfo{MaxRow: 123}, &ContainerInfo{Point: 123}))
 	require.Equal(t, "hashmatch", rd.chooseReplicationStrategy(
 		&ContainerInfo{Hash: "somehash", MaxRow: 10},
-		&ContainerInfo{Hash: "somehash", Point: 9},
-		100))
-	require.Equal(t, "rsync_then_merge", rd.chooseReplicationStrategy(
+		&ContainerInfo{Hash: "somehash", Point: 9}))
+	require.Equal(t, "diff", rd.chooseReplicationStrategy(
 		&ContainerInfo{Hash: "somehash1", MaxRow: 1000},
-		&ContainerInfo{Hash: "somehash2", Point: 9},
-		100))
+		&ContainerInfo{Hash: "somehash2", Point: 9}))
 	require.Equal(t, "diff", rd.chooseReplicationStrategy(
 		&ContainerInfo{Hash: "somehash1", MaxRow: 10},
-		&ContainerInfo{Hash: "somehash2", Point: 9},
-		100))
+		&ContainerInfo{Hash: "somehash2", Point: 9}))
 }
 
 func TestReplicatorReplicateDatabaseToDevice(t *testing.T) {
@@ -298,36 +354,50 @@ func TestReplicatorReplicateDatabaseToDevice(t *testing.T) {
 	require.Nil(t, err)
 	defer cleanup()
 	rd := newTestReplicationDevice(&ring.Device{}, &Replicator{})
-	currentMethod := "complete_rsync"
-	rsyncCalled := false
+	currentMethod := "create"
+	createCalled := false
 	usyncCalled := false
+	usyncCap := -1
 	rd._sync = func(dev *ring.Device, part uint64, ringHash string, info *ContainerInfo) (*ContainerInfo, error) {
 		return &ContainerInfo{}, nil
 	}
-	rd._chooseReplicationStrategy = func(localInfo, remoteInfo *ContainerInfo, usyncThreshold int64) string {
+	rd._chooseReplicationStrategy = func(localInfo, remoteInfo *ContainerInfo) string {
 		return currentMethod
 	}
-	rd._rsync = func(dev *ring.Device, c ReplicableContainer, part uint64, op string) error {
-		rsyncCalled = true
+	rd._create = func(dev *ring.Device, part uint64, ringHash string, info *ContainerInfo) error {
+		createCalled = true
 		return nil
 	}
-	rd._usync = func(dev *ring.Device, c ReplicableContainer, part uint64, localID string, point int64) error {
+	rd._usync = func(dev *ring.Device, c ReplicableContainer, part uint64, localID string, point int64, maxUsyncs int) error {
 		usyncCalled = true
+		usyncCap = maxUsyncs
 		return nil
 	}
 	require.Nil(t, rd.replicateDatabaseToDevice(&ring.Device{}, c, 1, 0))
-	require.True(t, rsyncCalled)
-	require.False(t, usyncCalled)
-	rsyncCalled = false
+	require.True(t, createCalled)
+	require.True(t, usyncCalled)
+	require.Equal(t, 0, usyncCap)
+	createCalled = false
+	usyncCalled = false
 	currentMethod = "diff"
+	rd.rd.r.maxUsyncs = 25
 	require.Nil(t, rd.replicateDatabaseToDevice(&ring.Device{}, c, 1, 0))
 	require.True(t, usyncCalled)
-	require.False(t, rsyncCalled)
+	require.False(t, createCalled)
+	require.Equal(t, 25, usyncCap)
 	usyncCalled = false
 	currentMethod = "no_change"
 	require.Nil(t, rd.replicateDatabaseToDevice(&ring.Device{}, c, 1, 0))
 	require.False(t, usyncCalled)
-	require.False(t, rsyncCalled)
+	require.False(t, createCalled)
+
+	// The database has to be there to merge into once it's created.
+	currentMethod = "create"
+	rd._sync = func(dev *ring.Device, part uint64, ringHash string, info *ContainerInfo) (*ContainerInfo, error) {
+		return nil, nil
+	}
+	require.NotNil(t, rd.replicateDatabaseToDevice(&ring.Device{}, c, 1, 0))
+	require.False(t, usyncCalled)
 }
 
 func TestFindContainers(t *testing.T) {
@@ -718,6 +788,5 @@ func TestReplicateSyncOnMessageError(t *testing.T) {
 
 func TestSomeDatabaseFailures(t *testing.T) {
 	rd := newTestReplicationDevice(&ring.Device{}, &Replicator{Ring: &handoffJobRing{}})
-	require.NotNil(t, rd.rsync(&ring.Device{}, fakeDatabase{}, 1, "complete_rsync"))
-	require.NotNil(t, rd.usync(&ring.Device{}, fakeDatabase{}, 1, "123", 3))
+	require.NotNil(t, rd.usync(&ring.Device{}, fakeDatabase{}, 1, "123", 3, 5))
 }
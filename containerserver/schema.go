@@ -132,6 +132,7 @@ const (
 				expires INTEGER DEFAULT NULL
 			);
 		CREATE INDEX ix_object_deleted_name ON object (deleted, name);
+		CREATE INDEX ix_object_listing ON object (deleted, storage_policy_index, name, created_at, size, content_type, etag);
 		CREATE INDEX ix_object_expires ON object(expires) WHERE expires IS NOT NULL;
 		CREATE TRIGGER object_update BEFORE UPDATE ON object
 			BEGIN
@@ -202,6 +203,59 @@ const (
 		PRAGMA journal_mode = WAL;
 		PRAGMA busy_timeout = 25000;`
 
+	// Object history is optional; when enabled, every object row that is replaced or removed is archived here
+	// so listings can be answered as of a past timestamp. Rows age out with the replicator's reclaim_age.
+	objectHistoryScript = `
+		CREATE TABLE IF NOT EXISTS object_history (
+				name TEXT,
+				created_at TEXT,
+				size INTEGER,
+				content_type TEXT,
+				etag TEXT,
+				deleted INTEGER DEFAULT 0,
+				storage_policy_index INTEGER DEFAULT 0,
+				archived_at REAL
+			);
+		CREATE INDEX IF NOT EXISTS ix_object_history_name ON object_history (storage_policy_index, name, created_at);
+		CREATE INDEX IF NOT EXISTS ix_object_history_archived_at ON object_history (archived_at);
+		CREATE TRIGGER IF NOT EXISTS object_history_archive AFTER DELETE ON object
+			BEGIN
+				INSERT INTO object_history (name, created_at, size, content_type, etag, deleted, storage_policy_index, archived_at)
+				VALUES (old.name, old.created_at, old.size, old.content_type, old.etag, old.deleted, old.storage_policy_index,
+					(julianday('now') - 2440587.5) * 86400.0);
+			END;`
+
+	metadataHistoryScript = `
+		CREATE TABLE IF NOT EXISTS metadata_history (
+				name TEXT,
+				value TEXT,
+				previous TEXT,
+				timestamp TEXT,
+				requester TEXT,
+				recorded_at REAL
+			);
+		CREATE INDEX IF NOT EXISTS ix_metadata_history_timestamp ON metadata_history (timestamp);`
+
+	// A sharded container's root database keeps the ranges of names its shards hold.
+	shardRangeScript = `
+		CREATE TABLE IF NOT EXISTS shard_range (
+				account TEXT,
+				container TEXT,
+				lower TEXT,
+				upper TEXT,
+				state TEXT,
+				timestamp TEXT,
+				object_count INTEGER DEFAULT 0,
+				bytes_used INTEGER DEFAULT 0,
+				meta_timestamp TEXT DEFAULT '0',
+				PRIMARY KEY (account, container)
+			);`
+
+	// Listings are answered from this index alone, without reading the table or passing over deleted rows and other
+	// policies' rows.
+	listingIndexScript = `
+		CREATE INDEX IF NOT EXISTS ix_object_listing ON object (deleted, storage_policy_index, name, created_at, size, content_type, etag);`
+
 	// There's no real reason that adding a column with a partial index on non-default values would
 	// require a table scan, but I can't find any way to tell sqlite not to do it that isn't dark magic.
 	xExpireMigrateScript = `
@@ -276,3 +330,73 @@ func schemaMigrate(db *sql.DB) (bool, error) {
 	}
 	return hasDeletedNameIndex, tx.Commit()
 }
+
+// historyMigrate reports whether the database has an object_history table, creating it first if enable is true.
+// History is never removed here, since other openers of the database (e.g. the replicator) don't know whether
+// it was wanted; once enabled, a database keeps recording history, which ages out with reclaim_age.
+func historyMigrate(db *sql.DB, enable bool) (bool, error) {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'object_history_archive'").Scan(&count); err != nil {
+		return false, err
+	}
+	if count > 0 || !enable {
+		return count > 0, nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(objectHistoryScript); err != nil {
+		return false, fmt.Errorf("Adding object history: %v", err)
+	}
+	return true, tx.Commit()
+}
+
+// metadataHistoryMigrate adds the metadata_history table to databases created before it existed.
+func metadataHistoryMigrate(db *sql.DB) error {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'metadata_history'").Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	if _, err := db.Exec(metadataHistoryScript); err != nil {
+		return fmt.Errorf("Adding metadata history: %v", err)
+	}
+	return nil
+}
+
+// shardRangeMigrate adds the shard_range table to databases created before it existed.
+func shardRangeMigrate(db *sql.DB) error {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'shard_range'").Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	if _, err := db.Exec(shardRangeScript); err != nil {
+		return fmt.Errorf("Adding shard ranges: %v", err)
+	}
+	return nil
+}
+
+// hasListingIndex returns whether the database has the covering listing index yet.
+func hasListingIndex(db *sql.DB) (bool, error) {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'ix_object_listing'").Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// listingIndexMigrate adds the covering listing index to databases created before it existed.  This reads the whole
+// object table, so the replicator does it rather than the first request to open the database.
+func listingIndexMigrate(db *sql.DB) error {
+	if _, err := db.Exec(listingIndexScript); err != nil {
+		return fmt.Errorf("Adding listing index: %v", err)
+	}
+	return nil
+}
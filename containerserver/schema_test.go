@@ -142,6 +142,14 @@ func TestMigrateCruftyDatabase(t *testing.T) {
 	err = db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name in ('policy_stat', 'object_insert_policy_stat', 'container_info', 'container_stat_update')").Scan(&count)
 	require.Nil(t, err)
 	require.Equal(t, 4, count)
+	// The listing index is left for the replicator to add.
+	require.Nil(t, db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'ix_object_listing'").Scan(&count))
+	require.Equal(t, 0, count)
+	require.False(t, db.hasListingIndex)
+	require.Nil(t, db.MigrateListingIndex())
+	require.Nil(t, db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'ix_object_listing'").Scan(&count))
+	require.Equal(t, 1, count)
+	require.True(t, db.hasListingIndex)
 	require.Nil(t, db.QueryRow("SELECT COUNT(*) FROM container_info").Scan(&count))
 	require.Nil(t, err)
 	require.Equal(t, 1, count)
@@ -36,11 +36,11 @@ import (
 	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/conf"
 	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/ring"
 	"github.com/troubling/hummingbird/common/srv"
 	"github.com/troubling/hummingbird/common/tracing"
 	"github.com/troubling/hummingbird/middleware"
 	"github.com/uber-go/tally"
-	promreporter "github.com/uber-go/tally/prometheus"
 	"go.uber.org/zap"
 	"golang.org/x/net/http2"
 )
@@ -63,9 +63,14 @@ type ContainerServer struct {
 	syncRealms              conf.SyncRealmList
 	defaultPolicy           int
 	policyList              conf.PolicyList
+	containerRing           ring.Ring
 	metricsCloser           io.Closer
 	traceCloser             io.Closer
 	tracer                  opentracing.Tracer
+	adminAuth               *middleware.AdminAuth
+	signingKeys             [][]byte
+	disableFile             string
+	readyChecks             []middleware.ReadyCheck
 }
 
 var saveHeaders = map[string]bool{
@@ -187,6 +192,12 @@ func (server *ContainerServer) ContainerGetHandler(writer http.ResponseWriter, r
 		writer.Write([]byte(""))
 		return
 	}
+	// The proxy asks for a sharded container's ranges instead of its listing, which is in the shards.
+	if recordType := request.Header.Get("X-Backend-Record-Type"); recordType == "shard" ||
+		(recordType == "auto" && common.ShardRangesActive(info.ShardRanges)) {
+		shardRangesResponse(writer, info.ShardRanges)
+		return
+	}
 	limit := int64(10000)
 	limitStr := request.FormValue("limit")
 	if limitStr != "" {
@@ -207,12 +218,47 @@ func (server *ContainerServer) ContainerGetHandler(writer http.ResponseWriter, r
 		path = &v[0]
 	}
 	policyIndex, err := strconv.Atoi(request.Header.Get("X-Backend-Storage-Policy-Index"))
-	if err != nil {
+	explicitPolicy := err == nil
+	if !explicitPolicy {
 		policyIndex = info.StoragePolicyIndex
 	}
 	reverse := common.LooksTrue(request.Form.Get("reverse"))
-	objects, err := db.ListObjects(int(limit), marker, endMarker, prefix, delimiter, path, reverse, policyIndex)
-	if err != nil {
+	asOf := request.Form.Get("as_of")
+	if asOf != "" {
+		if asOf, err = common.GetEpochFromTimestamp(asOf); err != nil {
+			http.Error(writer, "Invalid as_of timestamp", http.StatusBadRequest)
+			return
+		}
+	}
+	listPolicy := func(policyIndex int) ([]interface{}, error) {
+		var objects []interface{}
+		var err error
+		if asOf != "" {
+			objects, err = db.ListObjectsAsOf(asOf, int(limit), marker, endMarker, prefix, delimiter, path, reverse, policyIndex)
+		} else {
+			objects, err = db.ListObjects(int(limit), marker, endMarker, prefix, delimiter, path, reverse, policyIndex)
+		}
+		if policy := server.policyList[policyIndex]; policy != nil {
+			for _, obj := range objects {
+				if or, ok := obj.(*ObjectListingRecord); ok {
+					or.StoragePolicy = policy.Name
+				}
+			}
+		}
+		return objects, err
+	}
+	objects, err := listPolicy(policyIndex)
+	// A container being migrated to another policy lists the objects in both, unless the mover asks for just one.
+	if target, ok := migrationPolicy(info.Metadata); ok && err == nil && !explicitPolicy && target != policyIndex {
+		var migrated []interface{}
+		if migrated, err = listPolicy(target); err == nil {
+			objects = mergeListings(objects, migrated, int(limit), reverse)
+		}
+	}
+	if err == ErrorNoHistory {
+		http.Error(writer, "Object history is not enabled for this container", http.StatusPreconditionFailed)
+		return
+	} else if err != nil {
 		srv.GetLogger(request).Error("Unable to list objects.", zap.Error(err))
 		srv.StandardResponse(writer, http.StatusInternalServerError)
 		return
@@ -276,6 +322,10 @@ func (server *ContainerServer) ContainerGetHandler(writer http.ResponseWriter, r
 // ContainerPutHandler handles PUT requests for a container.
 func (server *ContainerServer) ContainerPutHandler(writer http.ResponseWriter, request *http.Request) {
 	vars := srv.GetVars(request)
+	if request.Header.Get("X-Backend-Record-Type") == "shard" {
+		server.shardRangesPut(writer, request, vars)
+		return
+	}
 	timestamp, err := common.StandardizeTimestamp(request.Header.Get("X-Timestamp"))
 	if err != nil {
 		srv.StandardResponse(writer, http.StatusBadRequest)
@@ -301,7 +351,7 @@ func (server *ContainerServer) ContainerPutHandler(writer http.ResponseWriter, r
 			metadata[key] = []string{request.Header.Get(key), timestamp}
 		}
 	}
-	created, db, err := server.containerEngine.Create(vars, timestamp, metadata, policyIndex, defaultPolicyIndex)
+	created, db, err := server.containerEngine.Create(vars, timestamp, metadata, policyIndex, defaultPolicyIndex, request.Header.Get("X-Backend-Remote-User"))
 	if err == ErrorPolicyConflict {
 		srv.StandardResponse(writer, http.StatusConflict)
 		return
@@ -412,7 +462,20 @@ func (server *ContainerServer) ContainerPostHandler(writer http.ResponseWriter,
 		srv.StandardResponse(writer, http.StatusNotFound)
 		return
 	}
-	if err := db.UpdateMetadata(updates, timestamp); err == ErrorInvalidMetadata {
+	// The policy migration tool finishes a migration by switching the container to the new policy.
+	if cutover := request.Header.Get("X-Backend-Policy-Cutover"); cutover != "" {
+		policyIndex, err := strconv.Atoi(cutover)
+		if err != nil || server.policyList[policyIndex] == nil {
+			srv.StandardResponse(writer, http.StatusBadRequest)
+			return
+		}
+		if err := db.SetStoragePolicy(policyIndex); err != nil {
+			srv.GetLogger(request).Error("Unable to set storage policy.", zap.Error(err))
+			srv.StandardResponse(writer, http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := db.UpdateMetadata(updates, timestamp, request.Header.Get("X-Backend-Remote-User")); err == ErrorInvalidMetadata {
 		srv.StandardResponse(writer, http.StatusBadRequest)
 	} else if err != nil {
 		srv.StandardResponse(writer, http.StatusInternalServerError)
@@ -422,6 +485,44 @@ func (server *ContainerServer) ContainerPostHandler(writer http.ResponseWriter,
 	}
 }
 
+// MetadataHistoryHandler returns the recorded changes to a container's ACLs, quotas and sync settings as JSON, with
+// timestamps after the optional "since" query parameter.
+func (server *ContainerServer) MetadataHistoryHandler(writer http.ResponseWriter, request *http.Request) {
+	vars := srv.GetVars(request)
+	since := "0"
+	if s := request.URL.Query().Get("since"); s != "" {
+		var err error
+		if since, err = common.StandardizeTimestamp(s); err != nil {
+			srv.StandardResponse(writer, http.StatusBadRequest)
+			return
+		}
+	}
+	db, err := server.containerEngine.Get(vars)
+	if err == ErrorNoSuchContainer {
+		srv.StandardResponse(writer, http.StatusNotFound)
+		return
+	} else if err != nil {
+		srv.GetLogger(request).Error("Unable to get container", zap.Error(err))
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	defer server.containerEngine.Return(db)
+	changes, err := db.MetadataHistory(since)
+	if err != nil {
+		srv.GetLogger(request).Error("Unable to get metadata history", zap.Error(err))
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	body, err := json.Marshal(changes)
+	if err != nil {
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(body)
+}
+
 // ObjPutHandler handles the PUT of object records to a container.
 func (server *ContainerServer) ObjPutHandler(writer http.ResponseWriter, request *http.Request) {
 	vars := srv.GetVars(request)
@@ -444,7 +545,7 @@ func (server *ContainerServer) ObjPutHandler(writer http.ResponseWriter, request
 	db, err := server.containerEngine.Get(vars)
 	if err == ErrorNoSuchContainer {
 		if strings.HasPrefix(vars["account"], server.autoCreatePrefix) {
-			if _, db, err = server.containerEngine.Create(vars, timestamp, map[string][]string{}, policyIndex, 0); err != nil {
+			if _, db, err = server.containerEngine.Create(vars, timestamp, map[string][]string{}, policyIndex, 0, ""); err != nil {
 				srv.GetLogger(request).Error("Unable to auto-create container.", zap.Error(err))
 				srv.StandardResponse(writer, http.StatusInternalServerError)
 				return
@@ -459,6 +560,14 @@ func (server *ContainerServer) ObjPutHandler(writer http.ResponseWriter, request
 		return
 	}
 	defer server.containerEngine.Return(db)
+	if ranges, err := db.ShardRanges(); err != nil {
+		srv.GetLogger(request).Error("Unable to get shard ranges.", zap.Error(err))
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	} else if common.ShardRangesActive(ranges) {
+		server.shardObjUpdate(writer, request, vars, ranges, http.StatusCreated)
+		return
+	}
 	expires := request.Header.Get("X-Delete-At")
 	if err := db.PutObject(vars["obj"], timestamp, size, contentType, etag, policyIndex, expires); err != nil {
 		srv.GetLogger(request).Error("Error adding object to container.", zap.Error(err))
@@ -483,7 +592,7 @@ func (server *ContainerServer) ObjDeleteHandler(writer http.ResponseWriter, requ
 	db, err := server.containerEngine.Get(vars)
 	if err == ErrorNoSuchContainer {
 		if strings.HasPrefix(vars["account"], server.autoCreatePrefix) {
-			if _, db, err = server.containerEngine.Create(vars, timestamp, map[string][]string{}, policyIndex, 0); err != nil {
+			if _, db, err = server.containerEngine.Create(vars, timestamp, map[string][]string{}, policyIndex, 0, ""); err != nil {
 				srv.GetLogger(request).Error("Unable to auto-create container.", zap.Error(err))
 				srv.StandardResponse(writer, http.StatusInternalServerError)
 				return
@@ -498,6 +607,14 @@ func (server *ContainerServer) ObjDeleteHandler(writer http.ResponseWriter, requ
 		return
 	}
 	defer server.containerEngine.Return(db)
+	if ranges, err := db.ShardRanges(); err != nil {
+		srv.GetLogger(request).Error("Unable to get shard ranges.", zap.Error(err))
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	} else if common.ShardRangesActive(ranges) {
+		server.shardObjUpdate(writer, request, vars, ranges, http.StatusNoContent)
+		return
+	}
 	if err := db.DeleteObject(vars["obj"], timestamp, policyIndex); err != nil {
 		srv.GetLogger(request).Error("Error adding object to container.", zap.Error(err))
 		srv.StandardResponse(writer, http.StatusInternalServerError)
@@ -507,11 +624,16 @@ func (server *ContainerServer) ObjDeleteHandler(writer http.ResponseWriter, requ
 	writer.Write([]byte(""))
 }
 
-// HealthcheckHandler implements a basic health check, that just returns "OK".
+// HealthcheckHandler implements a basic health check, that just returns "OK",
+// or a 503 while the disable_path file exists.
 func (server *ContainerServer) HealthcheckHandler(writer http.ResponseWriter, request *http.Request) {
-	writer.Header().Set("Content-Length", "2")
-	writer.WriteHeader(http.StatusOK)
-	writer.Write([]byte("OK"))
+	middleware.HealthcheckHandler(server.disableFile)(writer, request)
+}
+
+// ReadyHandler reports whether the server's ring, devices and databases are
+// ready for it to serve requests.
+func (server *ContainerServer) ReadyHandler(writer http.ResponseWriter, request *http.Request) {
+	middleware.ReadyHandler(server.disableFile, server.readyChecks...)(writer, request)
 }
 
 // ReconHandler delegates incoming /recon calls to the common recon handler.
@@ -586,17 +708,13 @@ func (server *ContainerServer) updateDeviceLocks(seconds int64) {
 // GetHandler returns the server's http handler - it sets up routes and instantiates middleware.
 func (server *ContainerServer) GetHandler(config conf.Config, metricsPrefix string) http.Handler {
 	var metricsScope tally.Scope
-	metricsScope, server.metricsCloser = tally.NewRootScope(tally.ScopeOptions{
-		Prefix:         metricsPrefix,
-		Tags:           map[string]string{},
-		CachedReporter: promreporter.NewReporter(promreporter.Options{}),
-		Separator:      promreporter.DefaultSeparator,
-	}, time.Second)
+	metricsScope, server.metricsCloser = srv.NewMetricsScope(config, metricsPrefix)
 	commonHandlers := alice.New(
 		middleware.NewDebugResponses(config.GetBool("debug", "debug_x_source_code", false)),
 		server.LogRequest,
 		middleware.RecoverHandler,
 		middleware.ValidateRequest,
+		middleware.BackendSignature(server.signingKeys),
 		server.AcquireDevice,
 	)
 	router := srv.NewRouter()
@@ -604,13 +722,18 @@ func (server *ContainerServer) GetHandler(config conf.Config, metricsPrefix stri
 	router.Get("/loglevel", server.logLevel)
 	router.Put("/loglevel", server.logLevel)
 	router.Get("/healthcheck", commonHandlers.ThenFunc(server.HealthcheckHandler))
+	router.Get("/ready", commonHandlers.ThenFunc(server.ReadyHandler))
+	router.Head("/ready", commonHandlers.ThenFunc(server.ReadyHandler))
 	router.Get("/diskusage", commonHandlers.ThenFunc(server.DiskUsageHandler))
 	router.Put("/ring/*ring_path", commonHandlers.ThenFunc(middleware.RingHandler))
 	router.Get("/debug/pprof/:parm", http.DefaultServeMux)
 	router.Post("/debug/pprof/:parm", http.DefaultServeMux)
 	router.Get("/recon/:method/:recon_type", commonHandlers.ThenFunc(server.ReconHandler))
 	router.Get("/recon/:method", commonHandlers.ThenFunc(server.ReconHandler))
-	router.Delete("/recon/:device/:method/:recon_type/*item_path", commonHandlers.ThenFunc(server.ReconHandler))
+	router.Get("/recon/:device/:method/:recon_type/*item_path", commonHandlers.Then(server.adminAuth.Require(middleware.AdminRoleQuarantine, http.HandlerFunc(server.ReconHandler))))
+	router.Put("/recon/:device/:method/:recon_type/*item_path", commonHandlers.Then(server.adminAuth.Require(middleware.AdminRoleQuarantine, http.HandlerFunc(server.ReconHandler))))
+	router.Delete("/recon/:device/:method/:recon_type/*item_path", commonHandlers.Then(server.adminAuth.Require(middleware.AdminRoleQuarantine, http.HandlerFunc(server.ReconHandler))))
+	router.Get("/metadatahistory/:device/:partition/:account/:container", commonHandlers.Then(server.adminAuth.Require(middleware.AdminRoleAudit, http.HandlerFunc(server.MetadataHistoryHandler))))
 	router.Put("/:device/tmp/:filename", commonHandlers.ThenFunc(server.ContainerTmpUploadHandler))
 	router.Put("/:device/:partition/:account/:container/*obj", commonHandlers.ThenFunc(server.ObjPutHandler))
 	router.Delete("/:device/:partition/:account/:container/*obj", commonHandlers.ThenFunc(server.ObjDeleteHandler))
@@ -640,6 +763,7 @@ func NewServer(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader
 	if err != nil {
 		return ipPort, nil, nil, err
 	}
+	server.signingKeys = conf.GetBackendSigningKeys()
 	server.reconCachePath = serverconf.GetDefault("app:container-server", "recon_cache_path", "/var/cache/swift")
 	policies, err := cnf.GetPolicies()
 	if err != nil {
@@ -648,6 +772,9 @@ func NewServer(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader
 	server.policyList = policies
 	server.defaultPolicy = policies.Default()
 	server.autoCreatePrefix = serverconf.GetDefault("app:container-server", "auto_create_account_prefix", ".")
+	if server.containerRing, err = cnf.GetRing("container", server.hashPathPrefix, server.hashPathSuffix, 0); err != nil {
+		return ipPort, nil, nil, fmt.Errorf("Error loading container ring: %v", err)
+	}
 	server.driveRoot = serverconf.GetDefault("app:container-server", "devices", "/srv/node")
 	server.checkMounts = serverconf.GetBool("app:container-server", "mount_check", true)
 
@@ -658,12 +785,22 @@ func NewServer(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader
 	if server.logger, err = srv.SetupLogger("container-server", &server.logLevel, flags); err != nil {
 		return ipPort, nil, nil, fmt.Errorf("Error setting up logger: %v", err)
 	}
+	if server.adminAuth, err = middleware.NewAdminAuth(serverconf.GetDefault("app:container-server", "admin_tokens", ""),
+		serverconf.GetDefault("app:container-server", "admin_cert_roles", ""), server.logger); err != nil {
+		return ipPort, nil, nil, err
+	}
 	server.diskInUse = common.NewKeyedLimit(serverconf.GetLimit("app:container-server", "disk_limit", 0, 0))
 	bindIP := serverconf.GetDefault("app:container-server", "bind_ip", "0.0.0.0")
 	bindPort := int(serverconf.GetInt("app:container-server", "bind_port", common.DefaultContainerServerPort))
 	certFile := serverconf.GetDefault("app:container-server", "cert_file", "")
 	keyFile := serverconf.GetDefault("app:container-server", "key_file", "")
-	server.containerEngine = newLRUEngine(server.driveRoot, server.hashPathPrefix, server.hashPathSuffix, 32)
+	caFile := serverconf.GetDefault("app:container-server", "ca_file", "")
+	if err := common.SetClusterCA(caFile); err != nil {
+		return ipPort, nil, nil, err
+	}
+	containerEngine := newLRUEngine(server.driveRoot, server.hashPathPrefix, server.hashPathSuffix, 32)
+	containerEngine.keepHistory = serverconf.GetBool("app:container-server", "object_history", false)
+	server.containerEngine = containerEngine
 	connTimeout := time.Duration(serverconf.GetFloat("app:container-server", "conn_timeout", 1.0) * float64(time.Second))
 	nodeTimeout := time.Duration(serverconf.GetFloat("app:container-server", "node_timeout", 10.0) * float64(time.Second))
 	transport := &http.Transport{
@@ -685,7 +822,7 @@ func NewServer(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader
 	}
 	c := &http.Client{
 		Timeout:   nodeTimeout,
-		Transport: transport,
+		Transport: common.NewSigningTransport(transport, server.signingKeys),
 	}
 	server.updateClient = c
 	if serverconf.HasSection("tracing") {
@@ -703,6 +840,17 @@ func NewServer(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader
 			return ipPort, nil, nil, fmt.Errorf("Error setting up tracing client: %v", err)
 		}
 	}
-	ipPort = &srv.IpPort{Ip: bindIP, Port: bindPort, CertFile: certFile, KeyFile: keyFile}
+	server.disableFile = serverconf.GetDefault("app:container-server", "disable_path", "")
+	server.readyChecks = []middleware.ReadyCheck{
+		middleware.RingCheck(bindPort, map[string]func() (ring.Ring, error){"container": func() (ring.Ring, error) {
+			return cnf.GetRing("container", server.hashPathPrefix, server.hashPathSuffix, 0)
+		}}),
+		middleware.DevicesCheck(server.driveRoot, server.checkMounts),
+		middleware.DBCheck(server.driveRoot, server.checkMounts),
+	}
+	ipPort = &srv.IpPort{Ip: bindIP, Port: bindPort, CertFile: certFile, KeyFile: keyFile, CAFile: caFile,
+		ClientCertOptional: !serverconf.GetBool("app:container-server", "require_client_cert", true),
+		HTTP2:              srv.NewHTTP2Config(serverconf.GetSection("app:container-server")),
+		UnixSocket:         serverconf.GetDefault("app:container-server", "bind_unix_socket", "")}
 	return ipPort, server, server.logger, nil
 }
@@ -366,6 +366,50 @@ func TestContainerPutObjectsGet(t *testing.T) {
 	// TODO parse and validate xml.  or maybe we won't do that.
 }
 
+func TestContainerListingFields(t *testing.T) {
+	server, handler, cleanup, err := makeTestServer2()
+	require.Nil(t, err)
+	defer cleanup()
+	server.policyList = conf.PolicyList{0: &conf.Policy{Index: 0, Name: "gold"}}
+
+	rsp := test.MakeCaptureResponse()
+	req, err := http.NewRequest("PUT", "/device/1/a/c", nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Timestamp", "100000000.00001")
+	req.Header.Set("X-Backend-Storage-Policy-Index", "0")
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 201, rsp.Status)
+
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("PUT", "/device/1/a/c/link", nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Timestamp", common.GetTimestamp())
+	req.Header.Set("X-Content-Type", common.ContentTypeWithSymlinkPath("application/symlink", "/v1/a/c2/o"))
+	req.Header.Set("X-Size", "0")
+	req.Header.Set("X-Etag", "d41d8cd98f00b204e9800998ecf8427e")
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 201, rsp.Status)
+
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("GET", "/device/1/a/c?format=json", nil)
+	require.Nil(t, err)
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 200, rsp.Status)
+	var data []map[string]interface{}
+	require.Nil(t, json.Unmarshal(rsp.Body.Bytes(), &data))
+	require.Equal(t, 1, len(data))
+	require.Equal(t, "application/symlink", data[0]["content_type"])
+	require.Equal(t, "/v1/a/c2/o", data[0]["symlink_path"])
+	require.Equal(t, "gold", data[0]["storage_policy"])
+
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("GET", "/device/1/a/c?format=xml", nil)
+	require.Nil(t, err)
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 200, rsp.Status)
+	require.Contains(t, rsp.Body.String(), "<symlink_path>/v1/a/c2/o</symlink_path><storage_policy>gold</storage_policy>")
+}
+
 func TestContainerPutObjectsFails(t *testing.T) {
 	server, handler, cleanup, err := makeTestServer2()
 	require.Nil(t, err)
@@ -419,6 +463,32 @@ func TestContainerGetTextEmpty(t *testing.T) {
 	require.Equal(t, 204, rsp.Status)
 }
 
+func TestContainerGetAsOf(t *testing.T) {
+	handler, cleanup, err := makeTestServer()
+	require.Nil(t, err)
+	defer cleanup()
+
+	rsp := test.MakeCaptureResponse()
+	req, err := http.NewRequest("PUT", "/device/1/a/c", nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Timestamp", "100000000.00001")
+	req.Header.Set("X-Backend-Storage-Policy-Index", "0")
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 201, rsp.Status)
+
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("GET", "/device/1/a/c?as_of=notatime", nil)
+	require.Nil(t, err)
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 400, rsp.Status)
+
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("GET", "/device/1/a/c?as_of=100000001", nil)
+	require.Nil(t, err)
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 412, rsp.Status)
+}
+
 func TestContainerPutObjectBadRequests(t *testing.T) {
 	handler, cleanup, err := makeTestServer()
 	require.Nil(t, err)
@@ -748,3 +818,56 @@ func TestContainerVerifySync(t *testing.T) {
 	handler.ServeHTTP(rsp, req)
 	require.Equal(t, 204, rsp.Status)
 }
+
+func TestMetadataHistoryHandler(t *testing.T) {
+	handler, cleanup, err := makeTestServer()
+	require.Nil(t, err)
+	defer cleanup()
+
+	rsp := test.MakeCaptureResponse()
+	req, err := http.NewRequest("GET", "/metadatahistory/device/1/a/c", nil)
+	require.Nil(t, err)
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 404, rsp.Status)
+
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("PUT", "/device/1/a/c", nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Timestamp", "1000000000.00001")
+	req.Header.Set("X-Container-Read", ".r:*")
+	req.Header.Set("X-Backend-Remote-User", "AUTH_a,a:alice")
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 201, rsp.Status)
+
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("POST", "/device/1/a/c", nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Timestamp", "1000000001.00001")
+	req.Header.Set("X-Container-Read", "")
+	req.Header.Set("X-Backend-Remote-User", "AUTH_a,a:bob")
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 204, rsp.Status)
+
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("GET", "/metadatahistory/device/1/a/c", nil)
+	require.Nil(t, err)
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 200, rsp.Status)
+	var changes []*MetadataChange
+	require.Nil(t, json.Unmarshal(rsp.Body.Bytes(), &changes))
+	require.Equal(t, 2, len(changes))
+	require.Equal(t, ".r:*", changes[0].Value)
+	require.Equal(t, "AUTH_a,a:alice", changes[0].Requester)
+	require.Equal(t, "", changes[1].Value)
+	require.Equal(t, ".r:*", changes[1].Previous)
+	require.Equal(t, "AUTH_a,a:bob", changes[1].Requester)
+
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("GET", "/metadatahistory/device/1/a/c?since=1000000000.00001", nil)
+	require.Nil(t, err)
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 200, rsp.Status)
+	require.Nil(t, json.Unmarshal(rsp.Body.Bytes(), &changes))
+	require.Equal(t, 1, len(changes))
+	require.Equal(t, "1000000001.00001", changes[0].Timestamp)
+}
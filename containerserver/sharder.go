@@ -0,0 +1,362 @@
+package containerserver
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/middleware"
+	"go.uber.org/zap"
+)
+
+// shardBatchSize is how many rows the sharder reads from a database at a
+// time.
+const shardBatchSize = 1000
+
+// containerSharder splits containers with more than threshold objects into
+// shards of rowsPerShard objects, kept in the .shards_ account of the
+// container's account. The first primary of a container decides where to
+// split it and copies the rows to the shards, then makes the ranges active,
+// after which the container server passes object updates on to the shards
+// and the proxy lists them instead of the root. Every primary of a sharded
+// root moves rows that arrive after that on to their shards, and the first
+// primary of each shard reports its counts back to the root.
+type containerSharder struct {
+	r            *Replicator
+	threshold    int64
+	rowsPerShard int
+	interval     time.Duration
+	prefix       string
+	suffix       string
+	stats        map[string]int64
+}
+
+func newContainerSharder(r *Replicator, threshold int64, rowsPerShard int, interval time.Duration, prefix, suffix string) *containerSharder {
+	return &containerSharder{r: r, threshold: threshold, rowsPerShard: rowsPerShard, interval: interval, prefix: prefix, suffix: suffix}
+}
+
+func (s *containerSharder) ringHash(account, container string) string {
+	h := md5.New()
+	fmt.Fprintf(h, "%s/%s/%s%s", s.prefix, account, container, s.suffix)
+	return fmt.Sprintf("%032x", h.Sum(nil))
+}
+
+// request sends a request to a container server, returning whether it
+// succeeded.
+func (s *containerSharder) request(method string, dev *ring.Device, path string, headers http.Header, body []byte) bool {
+	req, err := http.NewRequest(method, fmt.Sprintf("%s://%s:%d%s", dev.Scheme, dev.Ip, dev.Port, path), bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	for k := range headers {
+		req.Header.Set(k, headers.Get(k))
+	}
+	req.Header.Set("X-Backend-Suppress-2xx-Logging", "t")
+	resp, err := s.r.client.Do(req)
+	if err != nil {
+		s.r.logger.Debug("Error sending sharder request", zap.String("method", method), zap.String("path", path), zap.Error(err))
+		return false
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode/100 == 2
+}
+
+// quorum calls send for each of the container's primaries, returning whether
+// a majority of them succeeded.
+func (s *containerSharder) quorum(account, container string, send func(dev *ring.Device, part uint64) bool) bool {
+	part := s.r.Ring.GetPartition(account, container, "")
+	nodes := s.r.Ring.GetNodes(part)
+	successes := 0
+	for _, node := range nodes {
+		if send(node, part) {
+			successes++
+		}
+	}
+	return successes >= len(nodes)/2+1
+}
+
+// putShard creates the shard container for the range.
+func (s *containerSharder) putShard(info *ContainerInfo, r *common.ShardRange) bool {
+	headers := http.Header{
+		"X-Timestamp":                    {r.Timestamp},
+		"X-Backend-Storage-Policy-Index": {strconv.Itoa(info.StoragePolicyIndex)},
+		"X-Container-Sysmeta-Shard-Root": {info.Account + "/" + info.Container},
+	}
+	return s.quorum(r.Account, r.Container, func(dev *ring.Device, part uint64) bool {
+		return s.request("PUT", dev, fmt.Sprintf("/%s/%d/%s/%s", dev.Device, part,
+			common.Urlencode(r.Account), common.Urlencode(r.Container)), headers, nil)
+	})
+}
+
+// mergeShardItems merges the rows into the range's shard container.
+func (s *containerSharder) mergeShardItems(r *common.ShardRange, rows []*ObjectRecord) bool {
+	body, err := json.Marshal([]interface{}{"merge_items", rows, ""})
+	if err != nil {
+		return false
+	}
+	hash := s.ringHash(r.Account, r.Container)
+	return s.quorum(r.Account, r.Container, func(dev *ring.Device, part uint64) bool {
+		return s.request("REPLICATE", dev, fmt.Sprintf("/%s/%d/%s", dev.Device, part, hash), nil, body)
+	})
+}
+
+// moveRows sends the rows with a ROWID greater than start and no greater
+// than maxRow to the shards they belong in, returning the ROWID of the last
+// row moved. With count, the objects moved are added to the ranges' counts.
+func (s *containerSharder) moveRows(db ReplicableContainer, ranges []*common.ShardRange, start, maxRow int64, count bool) (int64, error) {
+	point := start
+	for point < maxRow {
+		rows, err := db.ItemsSince(point, shardBatchSize)
+		if err != nil {
+			return point, err
+		}
+		if len(rows) == 0 {
+			break
+		}
+		buckets := map[*common.ShardRange][]*ObjectRecord{}
+		last := point
+		for _, row := range rows {
+			if row.Rowid > maxRow {
+				break
+			}
+			r := common.FindShardRange(ranges, row.Name)
+			if r == nil {
+				return point, fmt.Errorf("No shard range for %q", row.Name)
+			}
+			buckets[r] = append(buckets[r], row)
+			last = row.Rowid
+		}
+		for r, bucket := range buckets {
+			if !s.mergeShardItems(r, bucket) {
+				return point, fmt.Errorf("Unable to merge rows into %s/%s", r.Account, r.Container)
+			}
+			for _, row := range bucket {
+				if count && row.Deleted == 0 {
+					r.ObjectCount++
+					r.BytesUsed += row.Size
+				}
+			}
+			s.stats["moved_rows"] += int64(len(bucket))
+		}
+		if last == point {
+			break
+		}
+		point = last
+	}
+	return point, nil
+}
+
+// findShardRanges decides where to split the container, returning the new
+// ranges or nil if it's too small to split.
+func (s *containerSharder) findShardRanges(db ReplicableContainer, info *ContainerInfo) ([]*common.ShardRange, error) {
+	bounds, err := db.FindShardBounds(s.rowsPerShard)
+	if err != nil || len(bounds) == 0 {
+		return nil, err
+	}
+	timestamp := common.GetTimestamp()
+	ranges := []*common.ShardRange{}
+	lower := ""
+	for i := 0; i <= len(bounds); i++ {
+		upper := ""
+		if i < len(bounds) {
+			upper = bounds[i]
+		}
+		ranges = append(ranges, &common.ShardRange{
+			Account:   common.ShardAccount(info.Account),
+			Container: fmt.Sprintf("%s-%s-%d", info.Container, timestamp, i),
+			Lower:     lower,
+			Upper:     upper,
+			State:     common.ShardStateCreated,
+			Timestamp: timestamp,
+		})
+		lower = upper
+	}
+	return ranges, nil
+}
+
+// cleave creates the shard containers and copies the root's rows into them,
+// then makes the ranges active and removes the rows from the root.
+func (s *containerSharder) cleave(db ReplicableContainer, info *ContainerInfo) error {
+	ranges := info.ShardRanges
+	for _, r := range ranges {
+		if !s.putShard(info, r) {
+			return fmt.Errorf("Unable to create shard container %s/%s", r.Account, r.Container)
+		}
+		r.ObjectCount, r.BytesUsed = 0, 0
+	}
+	point, err := s.moveRows(db, ranges, -1, info.MaxRow, true)
+	if err != nil {
+		return err
+	}
+	timestamp := common.GetTimestamp()
+	for _, r := range ranges {
+		r.State = common.ShardStateActive
+		r.Timestamp = timestamp
+		r.MetaTimestamp = timestamp
+	}
+	if err := db.MergeShardRanges(ranges); err != nil {
+		return err
+	}
+	s.stats["cleaved"]++
+	return db.RemoveItems(point)
+}
+
+// reportShard sends the shard's counts to its root container.
+func (s *containerSharder) reportShard(db ReplicableContainer, info *ContainerInfo) error {
+	metadata, err := db.GetMetadata()
+	if err != nil {
+		return err
+	}
+	root := strings.SplitN(metadata["X-Container-Sysmeta-Shard-Root"], "/", 2)
+	if len(root) != 2 {
+		return nil
+	}
+	timestamp := common.GetTimestamp()
+	body, err := json.Marshal([]*common.ShardRange{{
+		Account:       info.Account,
+		Container:     info.Container,
+		ObjectCount:   info.ObjectCount,
+		BytesUsed:     info.BytesUsed,
+		MetaTimestamp: timestamp,
+	}})
+	if err != nil {
+		return err
+	}
+	headers := http.Header{"X-Timestamp": {timestamp}, "X-Backend-Record-Type": {"shard"}}
+	if !s.quorum(root[0], root[1], func(dev *ring.Device, part uint64) bool {
+		return s.request("PUT", dev, fmt.Sprintf("/%s/%d/%s/%s", dev.Device, part,
+			common.Urlencode(root[0]), common.Urlencode(root[1])), headers, body)
+	}) {
+		return fmt.Errorf("Unable to report shard counts to %s/%s", root[0], root[1])
+	}
+	s.stats["reported"]++
+	return nil
+}
+
+// shardContainer does whatever the database needs: reporting a shard's
+// counts, splitting a root that's grown too big, or moving a sharded root's
+// rows to its shards.
+func (s *containerSharder) shardContainer(dev *ring.Device, dbFile string) error {
+	db, err := sqliteOpenContainer(dbFile)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if deleted, err := db.IsDeleted(); err != nil || deleted {
+		return err
+	}
+	info, err := db.GetInfo()
+	if err != nil {
+		return err
+	}
+	nodes := s.r.Ring.GetNodes(s.r.Ring.GetPartition(info.Account, info.Container, ""))
+	ordinal := -1
+	for i, node := range nodes {
+		if node.Id == dev.Id {
+			ordinal = i
+		}
+	}
+	if ordinal < 0 {
+		// Handoffs leave sharding to the primaries.
+		return nil
+	}
+	s.stats["containers"]++
+	if common.IsShardAccount(info.Account) {
+		if ordinal == 0 {
+			return s.reportShard(db, info)
+		}
+		return nil
+	}
+	if common.ShardRangesActive(info.ShardRanges) {
+		point, err := s.moveRows(db, info.ShardRanges, -1, info.MaxRow, false)
+		if point > -1 {
+			if err := db.RemoveItems(point); err != nil {
+				return err
+			}
+		}
+		return err
+	}
+	if ordinal != 0 {
+		return nil
+	}
+	if len(info.ShardRanges) == 0 {
+		if info.ObjectCount < s.threshold {
+			return nil
+		}
+		ranges, err := s.findShardRanges(db, info)
+		if err != nil || ranges == nil {
+			return err
+		}
+		if err := db.MergeShardRanges(ranges); err != nil {
+			return err
+		}
+		s.stats["sharded"]++
+		if info, err = db.GetInfo(); err != nil {
+			return err
+		}
+	}
+	return s.cleave(db, info)
+}
+
+// run makes one pass over the containers on the local devices, reporting how
+// it went to recon.
+func (s *containerSharder) run() {
+	start := time.Now()
+	s.stats = map[string]int64{"containers": 0, "sharded": 0, "cleaved": 0, "moved_rows": 0, "reported": 0, "failures": 0}
+	devices, err := s.r.Ring.LocalDevices(s.r.serverPort)
+	if err != nil {
+		s.r.logger.Error("Error getting local devices from ring", zap.Error(err))
+		return
+	}
+	for _, dev := range devices {
+		devicePath := filepath.Join(s.r.deviceRoot, dev.Device)
+		if mounted, err := fs.IsMount(devicePath); s.r.checkMounts && (err != nil || !mounted) {
+			s.r.logger.Error("Not sharding containers on unmounted device", zap.String("device", dev.Device), zap.Error(err))
+			continue
+		}
+		filepath.Walk(filepath.Join(devicePath, "containers"), func(path string, fi os.FileInfo, err error) error {
+			if err == nil && strings.HasSuffix(path, ".db") {
+				if err := s.shardContainer(dev, path); err != nil {
+					s.r.logger.Error("Error sharding container", zap.String("dbFile", path), zap.Error(err))
+					s.stats["failures"]++
+				}
+			}
+			return nil
+		})
+	}
+	fields := []zap.Field{zap.Duration("timeTook", time.Since(start))}
+	recon := map[string]interface{}{"container_sharder_pass": time.Since(start).Seconds()}
+	for k, v := range s.stats {
+		fields = append(fields, zap.Int64(k, v))
+		recon[fmt.Sprintf("container_sharder_%s", k)] = v
+	}
+	s.r.logger.Info("Container sharder pass complete", fields...)
+	if err := middleware.DumpReconCache(s.r.reconCachePath, "container", recon); err != nil {
+		s.r.logger.Error("container-sharder saving recon data", zap.Error(err))
+	}
+}
+
+// runForever starts a pass every interval, or as soon as the last one
+// finishes if it took longer.
+func (s *containerSharder) runForever() {
+	for {
+		start := time.Now()
+		s.run()
+		if d := s.interval - time.Since(start); d > 0 {
+			time.Sleep(d)
+		}
+	}
+}
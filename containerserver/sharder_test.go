@@ -0,0 +1,118 @@
+package containerserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/test"
+	"go.uber.org/zap"
+)
+
+func TestSharder(t *testing.T) {
+	defer func(d time.Duration) { infoCacheTimeout = d }(infoCacheTimeout)
+	infoCacheTimeout = 0
+	server, handler, cleanup, err := makeTestServer2()
+	require.Nil(t, err)
+	defer cleanup()
+	server.autoCreatePrefix = "."
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.Nil(t, err)
+	// Every replica is the one test server's device.
+	devs := []*ring.Device{}
+	for i := 0; i < 3; i++ {
+		devs = append(devs, &ring.Device{Id: i, Scheme: "http", Ip: u.Hostname(), Port: port, Device: "device"})
+	}
+	fakeRing := &test.FakeRing{MockDevices: devs}
+	server.containerRing = fakeRing
+	r := &Replicator{Ring: fakeRing, client: http.DefaultClient, logger: zap.NewNop(), deviceRoot: server.driveRoot}
+	s := newContainerSharder(r, 4, 2, time.Second, "changeme", "changeme")
+	s.stats = map[string]int64{}
+
+	do := func(method, path string, headers map[string]string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, nil)
+		require.Nil(t, err)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	putObject := func(account, container, obj string) int {
+		return do("PUT", fmt.Sprintf("/device/0/%s/%s/%s", account, container, obj), map[string]string{
+			"X-Timestamp": common.GetTimestamp(), "X-Size": "1", "X-Content-Type": "text/plain", "X-Etag": "d41d8cd98f00b204e9800998ecf8427e"}).Code
+	}
+	listShard := func(shard *common.ShardRange) []string {
+		w := do("GET", fmt.Sprintf("/device/0/%s/%s?format=json", shard.Account, shard.Container), nil)
+		require.Equal(t, 200, w.Code)
+		var listing []*ObjectListingRecord
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &listing))
+		names := []string{}
+		for _, obj := range listing {
+			names = append(names, obj.Name)
+		}
+		return names
+	}
+	require.Equal(t, 201, do("PUT", "/device/0/a/c", map[string]string{"X-Timestamp": common.GetTimestamp()}).Code)
+	for i := 1; i <= 5; i++ {
+		require.Equal(t, 201, putObject("a", "c", fmt.Sprintf("o%d", i)))
+	}
+	location := func(account, container string) string {
+		return server.containerEngine.(*lruEngine).containerLocation(map[string]string{"device": "device", "partition": "0", "account": account, "container": container})
+	}
+
+	require.Nil(t, s.shardContainer(devs[0], location("a", "c")))
+	root, err := sqliteOpenContainer(location("a", "c"))
+	require.Nil(t, err)
+	defer root.Close()
+	info, err := root.GetInfo()
+	require.Nil(t, err)
+	require.Equal(t, 3, len(info.ShardRanges))
+	require.True(t, common.ShardRangesActive(info.ShardRanges))
+	require.Equal(t, int64(5), info.ObjectCount)
+	rows, err := root.ItemsSince(-1, 10)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(rows))
+	shards := info.ShardRanges
+	require.Equal(t, []string{"o1", "o2"}, listShard(shards[0]))
+	require.Equal(t, []string{"o3", "o4"}, listShard(shards[1]))
+	require.Equal(t, []string{"o5"}, listShard(shards[2]))
+
+	// Updates to the root now go to the shards, and listings ask for them.
+	require.Equal(t, 201, putObject("a", "c", "o6"))
+	require.Equal(t, []string{"o5", "o6"}, listShard(shards[2]))
+	w := do("GET", "/device/0/a/c", map[string]string{"X-Backend-Record-Type": "auto"})
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "shard", w.Header().Get("X-Backend-Record-Type"))
+	var listed []*common.ShardRange
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &listed))
+	require.Equal(t, 3, len(listed))
+
+	// The shard reports its new count to the root.
+	require.Nil(t, s.shardContainer(devs[0], location(shards[2].Account, shards[2].Container)))
+	info, err = root.GetInfo()
+	require.Nil(t, err)
+	require.Equal(t, int64(2), info.ShardRanges[2].ObjectCount)
+	require.Equal(t, int64(6), info.ObjectCount)
+
+	// Rows that reach the root anyway are moved on to their shards.
+	require.Nil(t, mergeItemsByName(root, []string{"o0"}))
+	require.Nil(t, s.shardContainer(devs[1], location("a", "c")))
+	require.Equal(t, []string{"o0", "o1", "o2"}, listShard(shards[0]))
+	rows, err = root.ItemsSince(-1, 10)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(rows))
+}
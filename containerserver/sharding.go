@@ -0,0 +1,106 @@
+package containerserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/srv"
+	"go.uber.org/zap"
+)
+
+// shardRangesResponse writes the container's shard ranges as the JSON
+// listing requested with an X-Backend-Record-Type of shard or auto.
+func shardRangesResponse(writer http.ResponseWriter, ranges []*common.ShardRange) {
+	output, err := json.Marshal(ranges)
+	if err != nil {
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("X-Backend-Record-Type", "shard")
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writer.Header().Set("Content-Length", strconv.Itoa(len(output)))
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(output)
+}
+
+// shardRangesPut merges the shard ranges in the body of a container PUT with
+// an X-Backend-Record-Type of shard. The sharder sends these to a root
+// container when it splits it and for the shards to report their counts.
+func (server *ContainerServer) shardRangesPut(writer http.ResponseWriter, request *http.Request, vars map[string]string) {
+	var ranges []*common.ShardRange
+	if err := json.NewDecoder(request.Body).Decode(&ranges); err != nil {
+		srv.StandardResponse(writer, http.StatusBadRequest)
+		return
+	}
+	db, err := server.containerEngine.Get(vars)
+	if err == ErrorNoSuchContainer {
+		srv.StandardResponse(writer, http.StatusNotFound)
+		return
+	} else if err != nil {
+		srv.GetLogger(request).Error("Unable to get container.", zap.Error(err))
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	defer server.containerEngine.Return(db)
+	if err := db.MergeShardRanges(ranges); err != nil {
+		srv.GetLogger(request).Error("Unable to merge shard ranges.", zap.Error(err))
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	srv.StandardResponse(writer, http.StatusAccepted)
+}
+
+// shardObjUpdate passes an object update for a sharded container on to the
+// primaries of the shard the object belongs in, succeeding if a quorum of
+// them take it.
+func (server *ContainerServer) shardObjUpdate(writer http.ResponseWriter, request *http.Request, vars map[string]string, ranges []*common.ShardRange, successStatus int) {
+	shard := common.FindShardRange(ranges, vars["obj"])
+	if shard == nil || server.containerRing == nil {
+		srv.GetLogger(request).Error("No shard for object update.", zap.String("obj", vars["obj"]))
+		srv.StandardResponse(writer, http.StatusServiceUnavailable)
+		return
+	}
+	partition := server.containerRing.GetPartition(shard.Account, shard.Container, "")
+	nodes := server.containerRing.GetNodes(partition)
+	results := make(chan bool, len(nodes))
+	for _, node := range nodes {
+		url := fmt.Sprintf("%s://%s:%d/%s/%d/%s/%s/%s", node.Scheme, node.Ip, node.Port, node.Device, partition,
+			common.Urlencode(shard.Account), common.Urlencode(shard.Container), common.Urlencode(vars["obj"]))
+		go func(url string) {
+			req, err := http.NewRequest(request.Method, url, nil)
+			if err != nil {
+				results <- false
+				return
+			}
+			req = req.WithContext(request.Context())
+			for k, v := range request.Header {
+				req.Header[k] = v
+			}
+			resp, err := server.updateClient.Do(req)
+			if err != nil {
+				srv.GetLogger(request).Debug("Error forwarding object update to shard.", zap.String("url", url), zap.Error(err))
+				results <- false
+				return
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			results <- resp.StatusCode/100 == 2
+		}(url)
+	}
+	successes := 0
+	for range nodes {
+		if <-results {
+			successes++
+		}
+	}
+	if successes < len(nodes)/2+1 {
+		srv.StandardResponse(writer, http.StatusServiceUnavailable)
+		return
+	}
+	srv.StandardResponse(writer, successStatus)
+}
@@ -17,6 +17,7 @@ package containerserver
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
 	"encoding/hex"
@@ -52,6 +53,11 @@ const (
 
 var infoCacheTimeout = time.Second * 10
 
+// listingPageSize caps how many rows each query of a delimited listing asks for; 0 asks for all that's left of the
+// listing, which BenchmarkContainerListingsPageSize finds fastest, since a query's rows are only read as far as
+// they're used.
+var listingPageSize = 0
+
 func chexor(old, name, timestamp string) string {
 	oldDigest, err := hex.DecodeString(old)
 	if err != nil {
@@ -95,6 +101,9 @@ type sqliteContainer struct {
 	*sql.DB
 	containerFile       string
 	hasDeletedNameIndex bool
+	hasListingIndex     bool
+	keepHistory         bool
+	hasHistory          bool
 	infoCache           atomic.Value
 	ringhash            string
 }
@@ -124,7 +133,39 @@ func (db *sqliteContainer) connect() error {
 		}
 		return fmt.Errorf("Error migrating database: %v", err)
 	}
+	hasHistory, err := historyMigrate(dbConn, db.keepHistory)
+	if err != nil {
+		dbConn.Close()
+		if common.IsCorruptDBError(err) {
+			return fmt.Errorf("Error migrating database: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+		}
+		return fmt.Errorf("Error migrating database: %v", err)
+	}
+	if err := metadataHistoryMigrate(dbConn); err != nil {
+		dbConn.Close()
+		if common.IsCorruptDBError(err) {
+			return fmt.Errorf("Error migrating database: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+		}
+		return fmt.Errorf("Error migrating database: %v", err)
+	}
+	hasListingIndex, err := hasListingIndex(dbConn)
+	if err != nil {
+		dbConn.Close()
+		if common.IsCorruptDBError(err) {
+			return fmt.Errorf("Error migrating database: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+		}
+		return fmt.Errorf("Error migrating database: %v", err)
+	}
+	if err := shardRangeMigrate(dbConn); err != nil {
+		dbConn.Close()
+		if common.IsCorruptDBError(err) {
+			return fmt.Errorf("Error migrating database: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+		}
+		return fmt.Errorf("Error migrating database: %v", err)
+	}
 	db.hasDeletedNameIndex = hasDeletedNameIndex
+	db.hasListingIndex = hasListingIndex
+	db.hasHistory = hasHistory
 	db.DB = dbConn
 	return nil
 }
@@ -168,6 +209,31 @@ func (db *sqliteContainer) GetInfo() (*ContainerInfo, error) {
 	} else if err := json.Unmarshal([]byte(info.RawMetadata), &info.Metadata); err != nil {
 		return nil, err
 	}
+	// Until a policy migration's cutover, the objects already moved are only counted in the new policy.
+	if target, ok := migrationPolicy(info.Metadata); ok && target != info.StoragePolicyIndex {
+		var objectCount, bytesUsed int64
+		err := db.QueryRow("SELECT object_count, bytes_used FROM policy_stat WHERE storage_policy_index = ?", target).Scan(&objectCount, &bytesUsed)
+		if err == nil {
+			info.ObjectCount += objectCount
+			info.BytesUsed += bytesUsed
+		} else if err != sql.ErrNoRows {
+			if common.IsCorruptDBError(err) {
+				return nil, fmt.Errorf("Failed to GetInfo policy_stat: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+			}
+			return nil, err
+		}
+	}
+	ranges, err := db.shardRanges()
+	if err != nil {
+		return nil, err
+	}
+	info.ShardRanges = ranges
+	if common.ShardRangesActive(ranges) {
+		for _, r := range ranges {
+			info.ObjectCount += r.ObjectCount
+			info.BytesUsed += r.BytesUsed
+		}
+	}
 	db.infoCache.Store(info)
 	return info, nil
 }
@@ -384,6 +450,12 @@ func updateRecord(rec *ObjectListingRecord) error {
 	whole, nans := math.Modf(f)
 	rec.LastModified = time.Unix(int64(whole), int64(nans*1.0e9)).In(common.GMT).Format("2006-01-02T15:04:05.000000")
 
+	if rec.ContentType, rec.StorageClass, err = common.ParseContentTypeForStorageClass(rec.ContentType); err != nil {
+		return err
+	}
+	if rec.ContentType, rec.SymlinkPath, err = common.ParseContentTypeForSymlinkPath(rec.ContentType); err != nil {
+		return err
+	}
 	rec.ContentType, rec.Size, err = common.ParseContentTypeForSlo(
 		rec.ContentType, rec.Size)
 	return err
@@ -395,7 +467,38 @@ func (db *sqliteContainer) ListObjects(limit int, marker string, endMarker strin
 	if err := db.connect(); err != nil {
 		return nil, err
 	}
-	var point, pointDirection, queryTail, queryStart string
+	queryStart := "SELECT name, created_at, size, content_type, etag FROM object WHERE deleted = 0 AND"
+	if !db.hasListingIndex && !db.hasDeletedNameIndex {
+		queryStart = "SELECT name, created_at, size, content_type, etag FROM object WHERE +deleted = 0 AND"
+	}
+	return db.listObjects(queryStart, nil, limit, marker, endMarker, prefix, delimiter, pth, reverse, storagePolicyIndex)
+}
+
+// ListObjectsAsOf implements object listings as they would have been at the asOf timestamp, using the object
+// history table to find the versions that were current then.  It returns ErrorNoHistory if the container doesn't
+// have object history, and listings older than the history's retention window will be incomplete.
+func (db *sqliteContainer) ListObjectsAsOf(asOf string, limit int, marker string, endMarker string, prefix string,
+	delimiter string, pth *string, reverse bool, storagePolicyIndex int) ([]interface{}, error) {
+	if err := db.connect(); err != nil {
+		return nil, err
+	}
+	if !db.hasHistory {
+		return nil, ErrorNoHistory
+	}
+	// SQLite takes the bare columns from the row with the MAX(created_at), giving the newest version of each name.
+	queryStart := `SELECT name, created_at, size, content_type, etag FROM (
+			SELECT name, MAX(created_at) AS created_at, size, content_type, etag, deleted, storage_policy_index FROM (
+				SELECT name, created_at, size, content_type, etag, deleted, storage_policy_index FROM object WHERE created_at <= ?
+				UNION ALL
+				SELECT name, created_at, size, content_type, etag, deleted, storage_policy_index FROM object_history WHERE created_at <= ?
+			) GROUP BY storage_policy_index, name
+		) WHERE deleted = 0 AND`
+	return db.listObjects(queryStart, []interface{}{asOf, asOf}, limit, marker, endMarker, prefix, delimiter, pth, reverse, storagePolicyIndex)
+}
+
+func (db *sqliteContainer) listObjects(queryStart string, queryStartArgs []interface{}, limit int, marker string, endMarker string,
+	prefix string, delimiter string, pth *string, reverse bool, storagePolicyIndex int) ([]interface{}, error) {
+	var point, pointDirection, queryTail string
 
 	if pth != nil {
 		if *pth != "" {
@@ -405,11 +508,6 @@ func (db *sqliteContainer) ListObjects(limit int, marker string, endMarker strin
 		delimiter = "/"
 		prefix = *pth
 	}
-	if db.hasDeletedNameIndex {
-		queryStart = "SELECT name, created_at, size, content_type, etag FROM object WHERE deleted = 0 AND"
-	} else {
-		queryStart = "SELECT name, created_at, size, content_type, etag FROM object WHERE +deleted = 0 AND"
-	}
 	if reverse {
 		marker, endMarker = endMarker, marker
 		queryTail = "ORDER BY name DESC LIMIT ?"
@@ -420,13 +518,22 @@ func (db *sqliteContainer) ListObjects(limit int, marker string, endMarker strin
 	}
 
 	results := []interface{}{}
+	// Nothing can be between the markers, or both after the marker and within the prefix.
+	if (marker != "" && endMarker != "" && marker >= endMarker) ||
+		(prefix != "" && ((endMarker != "" && endMarker <= prefix) || (marker > prefix && !strings.HasPrefix(marker, prefix)))) {
+		return results, nil
+	}
 	queryArgs := make([]interface{}, 8)
 	wheres := make([]string, 8)
 	gotResults := true
 
 	for len(results) < limit && gotResults {
+		// The last subdir went past the end of the listing, so there's nothing left to list.
+		if point != "" && ((!reverse && endMarker != "" && point >= endMarker) || (reverse && marker != "" && point <= marker)) {
+			break
+		}
 		wheres := append(wheres[:0], "storage_policy_index == ?")
-		queryArgs := append(queryArgs[:0], storagePolicyIndex)
+		queryArgs := append(append(queryArgs[:0], queryStartArgs...), storagePolicyIndex)
 		if prefix != "" {
 			wheres = append(wheres, "name BETWEEN ? AND ?")
 			queryArgs = append(queryArgs, prefix, prefix+"\xFF")
@@ -443,8 +550,12 @@ func (db *sqliteContainer) ListObjects(limit int, marker string, endMarker strin
 			wheres = append(wheres, pointDirection)
 			queryArgs = append(queryArgs, point)
 		}
+		pageSize := limit - len(results)
+		if delimiter != "" && listingPageSize > 0 && pageSize > listingPageSize {
+			pageSize = listingPageSize
+		}
 		rows, err := db.Query(queryStart+" "+strings.Join(wheres, " AND ")+" "+queryTail,
-			append(queryArgs, limit-len(results))...)
+			append(queryArgs, pageSize)...)
 		if err != nil {
 			if common.IsCorruptDBError(err) {
 				return nil, fmt.Errorf("Failed to ListObjects SELECT: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
@@ -477,6 +588,8 @@ func (db *sqliteContainer) ListObjects(limit int, marker string, endMarker strin
 					if pth == nil && dirName != marker {
 						results = append(results, &SubdirListingRecord{Name2: dirName, Name: dirName})
 					}
+					// A new query from past the subdir beats stepping over its rows, even a few of them; see
+					// BenchmarkContainerListingsDelimiter.
 					break
 				}
 			}
@@ -568,7 +681,7 @@ func (db *sqliteContainer) GetMetadata() (map[string]string, error) {
 	return metadata, nil
 }
 
-func (db *sqliteContainer) mergeMetas(a map[string][]string, b map[string][]string, deleteTimestamp string) (string, error) {
+func (db *sqliteContainer) mergeMetas(a map[string][]string, b map[string][]string, deleteTimestamp string) (map[string][]string, string, error) {
 	newMeta := map[string][]string{}
 	for k, v := range a {
 		newMeta[k] = v
@@ -594,17 +707,95 @@ func (db *sqliteContainer) mergeMetas(a map[string][]string, b map[string][]stri
 		}
 	}
 	if metaCount > maxMetaCount || metaSize > maxMetaOverallSize {
-		return "", ErrorInvalidMetadata
+		return nil, "", ErrorInvalidMetadata
 	}
 	serMeta, err := json.Marshal(newMeta)
 	if err != nil {
-		return "", err
+		return nil, "", err
+	}
+	return newMeta, string(serMeta), nil
+}
+
+// auditedMetadata reports whether changes to key are recorded in the metadata_history table.
+func auditedMetadata(key string) bool {
+	key = strings.ToLower(key)
+	switch key {
+	case "x-container-read", "x-container-write", "x-container-sync-key", "x-container-sync-to":
+		return true
+	}
+	return strings.HasPrefix(key, "x-container-meta-quota-")
+}
+
+// historyValue is how value is stored in the metadata history; sync keys are secrets, so only a fingerprint of
+// them is kept, which is still enough to tell whether a key was changed or just set again.
+func historyValue(key, value string) string {
+	if value == "" || strings.ToLower(key) != "x-container-sync-key" {
+		return value
+	}
+	sum := sha256.Sum256([]byte(value))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+// metadataString returns key's value in metadata, which is empty if it's
+// unset.
+func metadataString(metadata map[string][]string, key string) string {
+	if value, ok := metadata[key]; ok && len(value) > 0 {
+		return value[0]
+	}
+	return ""
+}
+
+// recordMetadataChanges adds a metadata_history row for each audited key whose value differs between before and
+// after.
+func recordMetadataChanges(tx *sql.Tx, before, after map[string][]string, requester string) error {
+	for key, value := range after {
+		if !auditedMetadata(key) {
+			continue
+		}
+		previous := ""
+		if old, ok := before[key]; ok {
+			previous = old[0]
+		}
+		if previous == value[0] {
+			continue
+		}
+		if _, err := tx.Exec(`INSERT INTO metadata_history (name, value, previous, timestamp, requester, recorded_at)
+							  VALUES (?, ?, ?, ?, ?, (julianday('now') - 2440587.5) * 86400.0)`,
+			key, historyValue(key, value[0]), historyValue(key, previous), value[1], requester); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MetadataHistory returns the recorded changes to the container's ACLs, quotas and sync settings with timestamps
+// after since, oldest first.
+func (db *sqliteContainer) MetadataHistory(since string) ([]*MetadataChange, error) {
+	if err := db.connect(); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT name, value, previous, timestamp, requester, recorded_at FROM metadata_history
+						   WHERE timestamp > ? ORDER BY timestamp, rowid`, since)
+	if err != nil {
+		if common.IsCorruptDBError(err) {
+			return nil, fmt.Errorf("Failed to MetadataHistory SELECT: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+		}
+		return nil, err
 	}
-	return string(serMeta), nil
+	defer rows.Close()
+	changes := []*MetadataChange{}
+	for rows.Next() {
+		c := &MetadataChange{}
+		if err := rows.Scan(&c.Name, &c.Value, &c.Previous, &c.Timestamp, &c.Requester, &c.RecordedAt); err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
 }
 
 // UpdateMetadata merges the current container metadata with new incoming metadata.
-func (db *sqliteContainer) UpdateMetadata(newMetadata map[string][]string, timestamp string) error {
+func (db *sqliteContainer) UpdateMetadata(newMetadata map[string][]string, timestamp string, requester string) error {
 	if err := db.connect(); err != nil {
 		return err
 	}
@@ -629,16 +820,31 @@ func (db *sqliteContainer) UpdateMetadata(newMetadata map[string][]string, times
 	} else if err := json.Unmarshal([]byte(metadataValue), &existingMetadata); err != nil {
 		return err
 	}
-	metastr, err := db.mergeMetas(existingMetadata, newMetadata, deleteTimestamp)
+	mergedMetadata, metastr, err := db.mergeMetas(existingMetadata, newMetadata, deleteTimestamp)
 	if err != nil {
 		return err
 	}
+	if err := recordMetadataChanges(tx, existingMetadata, mergedMetadata, requester); err != nil {
+		if common.IsCorruptDBError(err) {
+			return fmt.Errorf("Failed to UpdateMetadata INSERT: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+		}
+		return err
+	}
 	if _, err = tx.Exec("UPDATE container_info SET metadata=?, put_timestamp=MAX(put_timestamp, ?)", metastr, timestamp); err != nil {
 		if common.IsCorruptDBError(err) {
 			return fmt.Errorf("Failed to UpdateMetadata UPDATE: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
 		}
 		return err
 	}
+	// Syncing to somewhere new starts over from the first row.
+	if metadataString(existingMetadata, "X-Container-Sync-To") != metadataString(mergedMetadata, "X-Container-Sync-To") {
+		if _, err = tx.Exec("UPDATE container_info SET x_container_sync_point1 = -1, x_container_sync_point2 = -1"); err != nil {
+			if common.IsCorruptDBError(err) {
+				return fmt.Errorf("Failed to UpdateMetadata UPDATE: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+			}
+			return err
+		}
+	}
 	defer db.invalidateCache()
 	if err := tx.Commit(); err != nil {
 		if common.IsCorruptDBError(err) {
@@ -678,6 +884,24 @@ func (db *sqliteContainer) MergeSyncTable(records []*SyncRecord) error {
 	return nil
 }
 
+// MigrateListingIndex adds the covering listing index to a database that doesn't have it yet.
+func (db *sqliteContainer) MigrateListingIndex() error {
+	if err := db.connect(); err != nil {
+		return err
+	}
+	if db.hasListingIndex {
+		return nil
+	}
+	if err := listingIndexMigrate(db.DB); err != nil {
+		if common.IsCorruptDBError(err) {
+			return fmt.Errorf("Error migrating database: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+		}
+		return err
+	}
+	db.hasListingIndex = true
+	return nil
+}
+
 // CleanupTombstones removes any expired tombstoned objects or metadata.
 func (db *sqliteContainer) CleanupTombstones(reclaimAge int64) error {
 	if err := db.connect(); err != nil {
@@ -697,6 +921,16 @@ func (db *sqliteContainer) CleanupTombstones(reclaimAge int64) error {
 		}
 		return err
 	}
+	if db.hasHistory {
+		// Versions replaced before the reclaim age, and tombstones older than it, can't affect listings within the window.
+		if _, err = tx.Exec("DELETE FROM object_history WHERE archived_at < ? OR (deleted = 1 AND created_at < ?)",
+			now-float64(reclaimAge), reclaimTimestamp); err != nil {
+			if common.IsCorruptDBError(err) {
+				return fmt.Errorf("Failed to CleanupTombstones DELETE history: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+			}
+			return err
+		}
+	}
 	var metastr string
 	if err := tx.QueryRow("SELECT metadata FROM container_info").Scan(&metastr); err != nil {
 		if common.IsCorruptDBError(err) {
@@ -807,7 +1041,7 @@ func (db *sqliteContainer) SyncRemoteData(maxRow int64, hash, id, createdAt, put
 	if deleteTimestamp > localDeleteTimestamp {
 		localDeleteTimestamp = deleteTimestamp
 	}
-	metastr, err := db.mergeMetas(lm, rm, localDeleteTimestamp)
+	_, metastr, err := db.mergeMetas(lm, rm, localDeleteTimestamp)
 	if _, err = tx.Exec(`UPDATE container_info SET created_at=MIN(?, created_at), put_timestamp=MAX(?, put_timestamp),
 	  					 delete_timestamp=MAX(?, delete_timestamp), metadata=?`,
 		createdAt, putTimestamp, deleteTimestamp, metastr); err != nil {
@@ -1066,7 +1300,7 @@ func (db *sqliteContainer) closeAlreadyLocked() error {
 	return nil
 }
 
-func sqliteCreateExistingContainer(db Container, putTimestamp string, newMetadata map[string][]string, policyIndex, defaultPolicyIndex int) (bool, error) {
+func sqliteCreateExistingContainer(db Container, putTimestamp string, newMetadata map[string][]string, policyIndex, defaultPolicyIndex int, requester string) (bool, error) {
 	cdb, ok := db.(*sqliteContainer)
 	if !ok {
 		return false, errors.New("Unable to work with non-sqliteContainer")
@@ -1105,10 +1339,16 @@ func sqliteCreateExistingContainer(db Container, putTimestamp string, newMetadat
 	} else if err := json.Unmarshal([]byte(cMetadata), &existingMetadata); err != nil {
 		return false, err
 	}
-	metastr, err := cdb.mergeMetas(existingMetadata, newMetadata, cDeleteTimestamp)
+	mergedMetadata, metastr, err := cdb.mergeMetas(existingMetadata, newMetadata, cDeleteTimestamp)
 	if err != nil {
 		return false, err
 	}
+	if err := recordMetadataChanges(tx, existingMetadata, mergedMetadata, requester); err != nil {
+		if common.IsCorruptDBError(err) {
+			return false, fmt.Errorf("Failed to sqliteCreateExistingContainer INSERT: %v; %v", err, common.QuarantineDir(path.Dir(cdb.containerFile), 4, "containers"))
+		}
+		return false, err
+	}
 	if _, err := tx.Exec("UPDATE container_info SET put_timestamp = ?, storage_policy_index = ?, metadata = ?",
 		putTimestamp, policyIndex, metastr); err != nil {
 		if common.IsCorruptDBError(err) {
@@ -1127,7 +1367,7 @@ func sqliteCreateExistingContainer(db Container, putTimestamp string, newMetadat
 }
 
 func sqliteCreateContainer(containerFile string, account string, container string, putTimestamp string,
-	metadata map[string][]string, policyIndex int) error {
+	metadata map[string][]string, policyIndex int, requester string) error {
 	var serializedMetadata []byte
 	var err error
 
@@ -1171,7 +1411,7 @@ func sqliteCreateContainer(containerFile string, account string, container strin
 	}
 	defer tx.Rollback()
 	if _, err := tx.Exec(objectTableScript + policyStatTableScript + policyStatTriggerScript +
-		containerInfoTableScript + containerStatViewScript + syncTableScript); err != nil {
+		containerInfoTableScript + containerStatViewScript + syncTableScript + metadataHistoryScript + shardRangeScript); err != nil {
 		return err
 	}
 	if _, err := tx.Exec(`INSERT INTO container_info (account, container, created_at, id, put_timestamp,
@@ -1183,6 +1423,9 @@ func sqliteCreateContainer(containerFile string, account string, container strin
 	if _, err := tx.Exec("INSERT INTO policy_stat (storage_policy_index) VALUES (?)", policyIndex); err != nil {
 		return err
 	}
+	if err := recordMetadataChanges(tx, nil, metadata, requester); err != nil {
+		return err
+	}
 	if err := tx.Commit(); err != nil {
 		return err
 	}
@@ -1204,6 +1447,23 @@ func sqliteOpenContainer(containerFile string) (ReplicableContainer, error) {
 	return db, nil
 }
 
+// SetSyncPoints records how far container sync has got through the
+// container's rows: point1 for the rows this node syncs first, point2 for
+// the check that every row up to point1 has been synced.
+func (db *sqliteContainer) SetSyncPoints(point1, point2 int64) error {
+	if err := db.connect(); err != nil {
+		return err
+	}
+	if _, err := db.Exec("UPDATE container_info SET x_container_sync_point1 = ?, x_container_sync_point2 = ?", point1, point2); err != nil {
+		if common.IsCorruptDBError(err) {
+			return fmt.Errorf("Failed to SetSyncPoints UPDATE: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+		}
+		return err
+	}
+	db.invalidateCache()
+	return nil
+}
+
 func (db *sqliteContainer) Reported(putTimestamp, deleteTimestamp string, objectCount, bytesUsed int64) error {
 	if err := db.connect(); err != nil {
 		return err
@@ -1228,3 +1488,286 @@ func (db *sqliteContainer) Reported(putTimestamp, deleteTimestamp string, object
 	}
 	return nil
 }
+
+func (db *sqliteContainer) shardRanges() ([]*common.ShardRange, error) {
+	ranges := []*common.ShardRange{}
+	rows, err := db.Query(`SELECT account, container, lower, upper, state, timestamp, object_count, bytes_used, meta_timestamp
+						   FROM shard_range ORDER BY lower`)
+	if err != nil {
+		if common.IsCorruptDBError(err) {
+			return nil, fmt.Errorf("Failed to ShardRanges SELECT: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+		}
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		r := &common.ShardRange{}
+		if err := rows.Scan(&r.Account, &r.Container, &r.Lower, &r.Upper, &r.State, &r.Timestamp, &r.ObjectCount, &r.BytesUsed, &r.MetaTimestamp); err != nil {
+			if common.IsCorruptDBError(err) {
+				return nil, fmt.Errorf("Failed to ShardRanges Scan: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+			}
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	if err := rows.Err(); err != nil {
+		if common.IsCorruptDBError(err) {
+			return nil, fmt.Errorf("Failed to ShardRanges Err: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+		}
+		return nil, err
+	}
+	return ranges, nil
+}
+
+// ShardRanges returns the container's shard ranges, ordered by their lower bounds.
+func (db *sqliteContainer) ShardRanges() ([]*common.ShardRange, error) {
+	if err := db.connect(); err != nil {
+		return nil, err
+	}
+	return db.shardRanges()
+}
+
+// MergeShardRanges merges shard ranges into the container's.  A range's bounds and state come from whichever copy has
+// the latest timestamp and its counts from whichever has the latest meta timestamp.  Ranges the container doesn't have
+// are only added if they have a timestamp, so a shard reporting its counts can't create one.
+func (db *sqliteContainer) MergeShardRanges(ranges []*common.ShardRange) error {
+	if err := db.connect(); err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, r := range ranges {
+		var timestamp, metaTimestamp string
+		err := tx.QueryRow("SELECT timestamp, meta_timestamp FROM shard_range WHERE account = ? AND container = ?",
+			r.Account, r.Container).Scan(&timestamp, &metaTimestamp)
+		if err == sql.ErrNoRows {
+			if r.Timestamp == "" {
+				continue
+			}
+			metaTimestamp = r.MetaTimestamp
+			if metaTimestamp == "" {
+				metaTimestamp = "0"
+			}
+			if _, err := tx.Exec(`INSERT INTO shard_range (account, container, lower, upper, state, timestamp, object_count, bytes_used, meta_timestamp)
+								  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`, r.Account, r.Container, r.Lower, r.Upper, r.State, r.Timestamp,
+				r.ObjectCount, r.BytesUsed, metaTimestamp); err != nil {
+				if common.IsCorruptDBError(err) {
+					return fmt.Errorf("Failed to MergeShardRanges INSERT: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+				}
+				return err
+			}
+			continue
+		} else if err != nil {
+			if common.IsCorruptDBError(err) {
+				return fmt.Errorf("Failed to MergeShardRanges SELECT: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+			}
+			return err
+		}
+		if r.Timestamp > timestamp {
+			if _, err := tx.Exec("UPDATE shard_range SET lower = ?, upper = ?, state = ?, timestamp = ? WHERE account = ? AND container = ?",
+				r.Lower, r.Upper, r.State, r.Timestamp, r.Account, r.Container); err != nil {
+				if common.IsCorruptDBError(err) {
+					return fmt.Errorf("Failed to MergeShardRanges UPDATE: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+				}
+				return err
+			}
+		}
+		if r.MetaTimestamp > metaTimestamp {
+			if _, err := tx.Exec("UPDATE shard_range SET object_count = ?, bytes_used = ?, meta_timestamp = ? WHERE account = ? AND container = ?",
+				r.ObjectCount, r.BytesUsed, r.MetaTimestamp, r.Account, r.Container); err != nil {
+				if common.IsCorruptDBError(err) {
+					return fmt.Errorf("Failed to MergeShardRanges UPDATE: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+				}
+				return err
+			}
+		}
+	}
+	defer db.invalidateCache()
+	if err := tx.Commit(); err != nil {
+		if common.IsCorruptDBError(err) {
+			return fmt.Errorf("Failed to MergeShardRanges Commit: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+		}
+		return err
+	}
+	return nil
+}
+
+// SetStoragePolicy makes the container's storage policy the one its objects were migrated to.  The container's counts
+// are then those of the objects in that policy.
+func (db *sqliteContainer) SetStoragePolicy(storagePolicyIndex int) error {
+	if err := db.connect(); err != nil {
+		return err
+	}
+	defer db.invalidateCache()
+	if _, err := db.Exec("UPDATE container_info SET storage_policy_index = ?", storagePolicyIndex); err != nil {
+		if common.IsCorruptDBError(err) {
+			return fmt.Errorf("Failed to SetStoragePolicy UPDATE: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+		}
+		return err
+	}
+	return nil
+}
+
+// FindShardBounds returns the object names that split the container's objects into shards of rowsPerShard objects each.
+// The last shard holds whatever is left after the others, which is no more than rowsPerShard objects.
+func (db *sqliteContainer) FindShardBounds(rowsPerShard int) ([]string, error) {
+	if err := db.connect(); err != nil {
+		return nil, err
+	}
+	if err := db.flush(); err != nil {
+		return nil, err
+	}
+	bounds := []string{}
+	for {
+		var names []string
+		marker := ""
+		if len(bounds) > 0 {
+			marker = bounds[len(bounds)-1]
+		}
+		rows, err := db.Query("SELECT name FROM object WHERE deleted = 0 AND name > ? ORDER BY name LIMIT 2 OFFSET ?", marker, rowsPerShard-1)
+		if err != nil {
+			if common.IsCorruptDBError(err) {
+				return nil, fmt.Errorf("Failed to FindShardBounds SELECT: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+			}
+			return nil, err
+		}
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			names = append(names, name)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+		// Only split if there's something past the bound for the next shard to hold.
+		if len(names) < 2 {
+			return bounds, nil
+		}
+		bounds = append(bounds, names[0])
+	}
+}
+
+// RemoveItems deletes the object records with a ROWID no greater than maxRowid, once a sharder has moved them to
+// the shards they belong in.
+func (db *sqliteContainer) RemoveItems(maxRowid int64) error {
+	if err := db.connect(); err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM object WHERE ROWID <= ?", maxRowid); err != nil {
+		if common.IsCorruptDBError(err) {
+			return fmt.Errorf("Failed to RemoveItems DELETE: %v; %v", err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+		}
+		return err
+	}
+	db.invalidateCache()
+	return nil
+}
+
+// policyCounts runs a query for storage policy indexes and their object
+// counts and bytes used.
+func policyCounts(db *sql.DB, query string) (map[int][2]int64, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := map[int][2]int64{}
+	for rows.Next() {
+		var policyIndex int
+		var objectCount, bytesUsed int64
+		if err := rows.Scan(&policyIndex, &objectCount, &bytesUsed); err != nil {
+			return nil, err
+		}
+		counts[policyIndex] = [2]int64{objectCount, bytesUsed}
+	}
+	return counts, rows.Err()
+}
+
+// audit checks the database passes sqlite's integrity check and has valid
+// metadata, quarantining it if not. It also checks the policy stats add up
+// to the object rows, and that the objects are all in the container's
+// policy, or the one it's being migrated to.
+func (db *sqliteContainer) audit() error {
+	if err := db.connect(); err != nil {
+		return err
+	}
+	quarantine := func(msg string, err error) error {
+		return fmt.Errorf("%s: %v; %v", msg, err, common.QuarantineDir(path.Dir(db.containerFile), 4, "containers"))
+	}
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		if common.IsCorruptDBError(err) {
+			return quarantine("Failed to audit integrity_check", err)
+		}
+		return err
+	}
+	problems := []string{}
+	for rows.Next() {
+		var problem string
+		if err := rows.Scan(&problem); err != nil {
+			rows.Close()
+			return err
+		}
+		if problem != "ok" {
+			problems = append(problems, problem)
+		}
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		if common.IsCorruptDBError(err) {
+			return quarantine("Failed to audit integrity_check", err)
+		}
+		return err
+	} else if len(problems) > 0 {
+		return quarantine("Failed integrity_check", errors.New(strings.Join(problems, "; ")))
+	}
+	var rawMetadata string
+	var policyIndex int
+	if err := db.QueryRow("SELECT metadata, storage_policy_index FROM container_info").Scan(&rawMetadata, &policyIndex); err != nil {
+		if common.IsCorruptDBError(err) {
+			return quarantine("Failed to audit container_info", err)
+		}
+		return err
+	}
+	metadata := map[string][]string{}
+	if rawMetadata != "" {
+		if err := json.Unmarshal([]byte(rawMetadata), &metadata); err != nil {
+			return quarantine("Invalid metadata", err)
+		}
+	}
+	stats, err := policyCounts(db.DB, "SELECT storage_policy_index, object_count, bytes_used FROM policy_stat")
+	if err != nil {
+		return err
+	}
+	objects, err := policyCounts(db.DB, "SELECT storage_policy_index, SUM(1 - deleted), SUM(size) FROM object GROUP BY storage_policy_index")
+	if err != nil {
+		return err
+	}
+	target, migrating := migrationPolicy(metadata)
+	for index, counts := range objects {
+		if counts[0] > 0 && index != policyIndex && !(migrating && index == target) {
+			return fmt.Errorf("%d objects are in policy %d instead of the container's policy %d", counts[0], index, policyIndex)
+		}
+	}
+	for index := range stats {
+		if _, ok := objects[index]; !ok {
+			objects[index] = [2]int64{}
+		}
+	}
+	for index, counts := range objects {
+		if stats[index] != counts {
+			return fmt.Errorf("policy %d stats say %d objects and %d bytes, but there are %d objects and %d bytes",
+				index, stats[index][0], stats[index][1], counts[0], counts[1])
+		}
+	}
+	return nil
+}
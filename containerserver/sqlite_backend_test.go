@@ -16,6 +16,7 @@
 package containerserver
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -66,6 +67,86 @@ func BenchmarkContainerListings(b *testing.B) {
 	}
 }
 
+// makeBenchmarkListingDatabase returns a database with objects spread over 100 pseudo-directories and as many
+// tombstones again, in another storage policy's rows and deleted ones.
+func makeBenchmarkListingDatabase(b *testing.B) (*sqliteContainer, func()) {
+	db, _, cleanup, err := createTestDatabase("100000000.00000")
+	if err != nil {
+		b.Fatal(err)
+	}
+	records := []*ObjectRecord{}
+	for d := 0; d < 100; d++ {
+		for i := 0; i < 1000; i++ {
+			name := fmt.Sprintf("dir%03d/obj%05d", d, i)
+			records = append(records, &ObjectRecord{Name: name, CreatedAt: "100000000.00001", ContentType: "text/plain", ETag: "d41d8cd98f00b204e9800998ecf8427e", Size: 1})
+			records = append(records, &ObjectRecord{Name: name + "x", CreatedAt: "100000000.00001", Deleted: 1})
+			records = append(records, &ObjectRecord{Name: name, CreatedAt: "100000000.00001", StoragePolicyIndex: 1})
+		}
+	}
+	for i := 0; i < len(records); i += 10000 {
+		if err := db.MergeItems(records[i:i+10000], ""); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return db, cleanup
+}
+
+func BenchmarkContainerListingsPrefix(b *testing.B) {
+	db, cleanup := makeBenchmarkListingDatabase(b)
+	defer cleanup()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if records, err := db.ListObjects(100, "", "", "dir050/", "", nil, false, 0); err != nil || len(records) != 100 {
+			b.Fatal(err, len(records))
+		}
+	}
+}
+
+func BenchmarkContainerListingsDelimiter(b *testing.B) {
+	db, cleanup := makeBenchmarkListingDatabase(b)
+	defer cleanup()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if records, err := db.ListObjects(100, "", "", "", "/", nil, false, 0); err != nil || len(records) != 100 {
+			b.Fatal(err, len(records))
+		}
+	}
+}
+
+func BenchmarkContainerListingsPageSize(b *testing.B) {
+	db, cleanup := makeBenchmarkListingDatabase(b)
+	defer cleanup()
+	defer func(size int) { listingPageSize = size }(listingPageSize)
+	for _, size := range []int{10, 100, 1000, 0} {
+		listingPageSize = size
+		b.Run(fmt.Sprintf("subdirs-%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if records, err := db.ListObjects(10000, "", "", "", "/", nil, false, 0); err != nil || len(records) != 100 {
+					b.Fatal(err, len(records))
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("objects-%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if records, err := db.ListObjects(10000, "", "", "dir050/", "/", nil, false, 0); err != nil || len(records) != 1000 {
+					b.Fatal(err, len(records))
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkContainerListingsEndMarker(b *testing.B) {
+	db, cleanup := makeBenchmarkListingDatabase(b)
+	defer cleanup()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if records, err := db.ListObjects(100, "dir090/", "dir010/", "", "/", nil, false, 0); err != nil || len(records) != 0 {
+			b.Fatal(err, len(records))
+		}
+	}
+}
+
 func TestContainerListings(t *testing.T) {
 	db, _, cleanup, err := createTestDatabase("100000000.00000")
 	require.Nil(t, err)
@@ -89,6 +170,16 @@ func TestContainerUpdateRecord(t *testing.T) {
 
 	rec = &ObjectListingRecord{Name: "a", ContentType: "text/plain; swift_bytes=X", LastModified: "1.0"}
 	require.NotNil(t, updateRecord(rec))
+	rec = &ObjectListingRecord{Name: "a", ContentType: "text/plain;storage_class=cold", LastModified: "1.0"}
+	require.Nil(t, updateRecord(rec))
+	require.Equal(t, "text/plain", rec.ContentType)
+	require.Equal(t, "cold", rec.StorageClass)
+
+	rec = &ObjectListingRecord{Name: "a", ContentType: "application/symlink;symlink_path=%2Fv1%2Fa%2Fc%2Fo;storage_class=hot", LastModified: "1.0"}
+	require.Nil(t, updateRecord(rec))
+	require.Equal(t, "application/symlink", rec.ContentType)
+	require.Equal(t, "/v1/a/c/o", rec.SymlinkPath)
+	require.Equal(t, "hot", rec.StorageClass)
 }
 
 func TestContainerListingsLimit(t *testing.T) {
@@ -143,6 +234,40 @@ func TestContainerListingsPrefixLimit(t *testing.T) {
 	require.Equal(t, "a2", records[1].(*ObjectListingRecord).Name)
 }
 
+func TestContainerListingsEndMarker(t *testing.T) {
+	db, _, cleanup, err := createTestDatabase("100000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, mergeItemsByName(db, []string{"a/1", "a/2", "b/1", "b/2", "c/1"}))
+	records, err := db.ListObjects(10000, "", "b/2", "", "/", nil, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(records))
+	require.Equal(t, "a/", records[0].(*SubdirListingRecord).Name)
+	require.Equal(t, "b/", records[1].(*SubdirListingRecord).Name)
+
+	records, err = db.ListObjects(10000, "b/", "", "", "/", nil, true, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(records))
+	require.Equal(t, "a/", records[0].(*SubdirListingRecord).Name)
+
+	records, err = db.ListObjects(10000, "c", "b", "", "", nil, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(records))
+
+	records, err = db.ListObjects(10000, "", "a", "b/", "", nil, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(records))
+
+	records, err = db.ListObjects(10000, "c", "", "b/", "", nil, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(records))
+
+	records, err = db.ListObjects(10000, "b/1", "", "b/", "", nil, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(records))
+	require.Equal(t, "b/2", records[0].(*ObjectListingRecord).Name)
+}
+
 func TestContainerListingsPrefixDelim(t *testing.T) {
 	db, _, cleanup, err := createTestDatabase("100000000.00000")
 	require.Nil(t, err)
@@ -218,6 +343,44 @@ func TestContainerListingsReversePrefixDelim(t *testing.T) {
 	require.Equal(t, "US-OK-", records[2].(*SubdirListingRecord).Name)
 }
 
+func TestContainerListingsDelimiterPages(t *testing.T) {
+	db, _, cleanup, err := createTestDatabase("100000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, mergeItemsByName(db, []string{"a", "b/1", "b/2", "c--1", "c--2", "d"}))
+	// a listing continued from a subdir starts after everything in it
+	records, err := db.ListObjects(2, "", "", "", "/", nil, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(records))
+	require.Equal(t, "b/", records[1].(*SubdirListingRecord).Name)
+	records, err = db.ListObjects(2, "b/", "", "", "/", nil, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(records))
+	require.Equal(t, "c--1", records[0].(*ObjectListingRecord).Name)
+
+	records, err = db.ListObjects(2, "", "", "", "--", nil, true, 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(records))
+	require.Equal(t, "d", records[0].(*ObjectListingRecord).Name)
+	require.Equal(t, "c--", records[1].(*SubdirListingRecord).Name)
+	records, err = db.ListObjects(2, "c--", "", "", "--", nil, true, 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(records))
+	require.Equal(t, "b/2", records[0].(*ObjectListingRecord).Name)
+	require.Equal(t, "b/1", records[1].(*ObjectListingRecord).Name)
+
+	// a marker inside a subdir still lists the subdir
+	records, err = db.ListObjects(10, "b/1", "", "", "/", nil, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 4, len(records))
+	require.Equal(t, "b/", records[0].(*SubdirListingRecord).Name)
+	records, err = db.ListObjects(10, "b/2", "", "", "/", nil, true, 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(records))
+	require.Equal(t, "b/", records[0].(*SubdirListingRecord).Name)
+	require.Equal(t, "a", records[1].(*ObjectListingRecord).Name)
+}
+
 func TestContainerListingsDelimiterAndPrefix(t *testing.T) {
 	db, _, cleanup, err := createTestDatabase("100000000.00000")
 	require.Nil(t, err)
@@ -353,7 +516,7 @@ func TestCreateAndGetInfo(t *testing.T) {
 	metadata := map[string][]string{
 		"X-Container-Meta-Hi": {"There", "100000000.00001"},
 	}
-	err = sqliteCreateContainer(dbFile, "a", "c", "100000000.00000", metadata, 2)
+	err = sqliteCreateContainer(dbFile, "a", "c", "100000000.00000", metadata, 2, "")
 	require.Nil(t, err)
 	db, err := sqliteOpenContainer(dbFile)
 	require.Nil(t, err)
@@ -374,7 +537,7 @@ func TestReported(t *testing.T) {
 	require.Nil(t, err)
 	defer os.RemoveAll(dir)
 	dbFile := filepath.Join(dir, "db.db")
-	err = sqliteCreateContainer(dbFile, "a", "c", "100000000.00000", nil, 2)
+	err = sqliteCreateContainer(dbFile, "a", "c", "100000000.00000", nil, 2, "")
 	require.Nil(t, err)
 	db, err := sqliteOpenContainer(dbFile)
 	require.Nil(t, err)
@@ -460,7 +623,7 @@ func TestGetUpdateMetadata(t *testing.T) {
 	metadataValues := map[string]string{
 		"X-Container-Meta-Hi": "There",
 	}
-	err = sqliteCreateContainer(dbFile, "a", "c", "200000000.00000", metadata, 0)
+	err = sqliteCreateContainer(dbFile, "a", "c", "200000000.00000", metadata, 0, "")
 	require.Nil(t, err)
 	db, err := sqliteOpenContainer(dbFile)
 	require.Nil(t, err)
@@ -474,7 +637,7 @@ func TestGetUpdateMetadata(t *testing.T) {
 
 	require.Nil(t, db.UpdateMetadata(map[string][]string{
 		"X-Container-Meta-Hi": {"", "100000000.00001"},
-	}, "100000000.00001"))
+	}, "100000000.00001", ""))
 	m, err = db.GetMetadata()
 	require.Nil(t, err)
 	require.Equal(t, metadataValues, m)
@@ -482,8 +645,8 @@ func TestGetUpdateMetadata(t *testing.T) {
 	require.Nil(t, db.UpdateMetadata(map[string][]string{
 		"X-Container-Meta-Hi":         {"", "200000001.00001"},
 		"X-Container-Meta-Some-Other": {"value", "200000001.00001"},
-	}, "200000001.00001"))
-	require.Nil(t, db.UpdateMetadata(map[string][]string{}, "200000001.00001"))
+	}, "200000001.00001", ""))
+	require.Nil(t, db.UpdateMetadata(map[string][]string{}, "200000001.00001", ""))
 	m, err = db.GetMetadata()
 	require.Nil(t, err)
 	require.Equal(t, map[string]string{"X-Container-Meta-Some-Other": "value"}, m)
@@ -615,20 +778,20 @@ func TestCreateExistingNoPolicy(t *testing.T) {
 	require.Nil(t, err)
 	defer cleanup()
 
-	c, err := sqliteCreateExistingContainer(db, "200000001.00000", map[string][]string{}, -1, 0)
+	c, err := sqliteCreateExistingContainer(db, "200000001.00000", map[string][]string{}, -1, 0, "")
 	require.Nil(t, err)
 	require.False(t, c)
 	info, err := db.GetInfo()
 	require.Nil(t, err)
 	require.Equal(t, info.StoragePolicyIndex, 0)
 
-	c, err = sqliteCreateExistingContainer(db, "200000001.00000", map[string][]string{}, 7, 0)
+	c, err = sqliteCreateExistingContainer(db, "200000001.00000", map[string][]string{}, 7, 0, "")
 	require.NotNil(t, err)
 
 	newMetadata := map[string][]string{
 		"X-Container-Meta-Whatever": {"something", "200000002.00000"},
 	}
-	c, err = sqliteCreateExistingContainer(db, "200000002.00000", newMetadata, -1, 0)
+	c, err = sqliteCreateExistingContainer(db, "200000002.00000", newMetadata, -1, 0, "")
 	require.Nil(t, err)
 	require.False(t, c)
 	info, err = db.GetInfo()
@@ -638,7 +801,7 @@ func TestCreateExistingNoPolicy(t *testing.T) {
 	newMetadata = map[string][]string{
 		"X-Container-Meta-Another": {"whatevs", "200000003.00000"},
 	}
-	c, err = sqliteCreateExistingContainer(db, "200000003.00000", newMetadata, -1, 0)
+	c, err = sqliteCreateExistingContainer(db, "200000003.00000", newMetadata, -1, 0, "")
 	require.Nil(t, err)
 	require.False(t, c)
 	info, err = db.GetInfo()
@@ -657,7 +820,7 @@ func TestCleanupTombstones(t *testing.T) {
 	require.Nil(t, db.MergeItems([]*ObjectRecord{{Name: "a", CreatedAt: "10000000.00000", Deleted: 0}}, ""))
 	db.UpdateMetadata(map[string][]string{
 		"X-Container-Meta-Old-Value": {"", "10000000.00000"},
-	}, "10000000.00000")
+	}, "10000000.00000", "")
 	info, err := db.GetInfo()
 	require.Nil(t, err)
 	_, ok := info.Metadata["X-Container-Meta-Old-Value"]
@@ -673,6 +836,55 @@ func TestCleanupTombstones(t *testing.T) {
 	require.Equal(t, 0, count)
 }
 
+func TestListObjectsAsOf(t *testing.T) {
+	db, _, cleanup, err := createTestDatabase("200000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	db.keepHistory = true
+
+	require.Nil(t, db.MergeItems([]*ObjectRecord{
+		{Name: "a", CreatedAt: "0000000001.00000", Size: 1, ETag: "a1"},
+		{Name: "b", CreatedAt: "0000000001.00000", Size: 1, ETag: "b1"},
+	}, ""))
+	require.Nil(t, db.MergeItems([]*ObjectRecord{{Name: "a", CreatedAt: "0000000002.00000", Size: 2, ETag: "a2"}}, ""))
+	require.Nil(t, db.MergeItems([]*ObjectRecord{{Name: "b", CreatedAt: "0000000003.00000", Deleted: 1}}, ""))
+	require.Nil(t, db.MergeItems([]*ObjectRecord{{Name: "c", CreatedAt: "0000000004.00000", Size: 4, ETag: "c4"}}, ""))
+
+	listAsOf := func(asOf string) []string {
+		records, err := db.ListObjectsAsOf(asOf, 10000, "", "", "", "", nil, false, 0)
+		require.Nil(t, err)
+		entries := []string{}
+		for _, record := range records {
+			entries = append(entries, record.(*ObjectListingRecord).Name+":"+record.(*ObjectListingRecord).ETag)
+		}
+		return entries
+	}
+	require.Equal(t, []string{}, listAsOf("0000000000.50000"))
+	require.Equal(t, []string{"a:a1", "b:b1"}, listAsOf("0000000001.50000"))
+	require.Equal(t, []string{"a:a2", "b:b1"}, listAsOf("0000000002.50000"))
+	require.Equal(t, []string{"a:a2"}, listAsOf("0000000003.50000"))
+	require.Equal(t, []string{"a:a2", "c:c4"}, listAsOf("0000000005.00000"))
+
+	records, err := db.ListObjectsAsOf("0000000002.50000", 10000, "a", "", "", "", nil, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(records))
+	require.Equal(t, "b", records[0].(*ObjectListingRecord).Name)
+
+	require.Nil(t, db.CleanupTombstones(0))
+	var count int
+	require.Nil(t, db.QueryRow("SELECT COUNT(*) FROM object_history").Scan(&count))
+	require.Equal(t, 0, count)
+}
+
+func TestListObjectsAsOfNoHistory(t *testing.T) {
+	db, _, cleanup, err := createTestDatabase("200000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, mergeItemsByName(db, []string{"a"}))
+	_, err = db.ListObjectsAsOf("0000000001.00000", 10000, "", "", "", "", nil, false, 0)
+	require.Equal(t, ErrorNoHistory, err)
+}
+
 func TestDeleteRemovesMetadata(t *testing.T) {
 	db, _, cleanup, err := createTestDatabase("200000000.00000")
 	require.Nil(t, err)
@@ -680,7 +892,7 @@ func TestDeleteRemovesMetadata(t *testing.T) {
 
 	db.UpdateMetadata(map[string][]string{
 		"X-Container-Meta-Key": {"Value", "200000000.00001"},
-	}, "10000000.00001")
+	}, "10000000.00001", "")
 	require.Nil(t, db.Delete("200000001.00000"))
 	deleted, err := db.IsDeleted()
 	require.Nil(t, err)
@@ -697,12 +909,12 @@ func TestCheckSyncLink(t *testing.T) {
 	link := strings.Replace(db.containerFile, "containers", "sync_containers", -1)
 	db.UpdateMetadata(map[string][]string{
 		"X-Container-Sync-To": {"//realm/cluster/a/c", "200000000.00001"},
-	}, "20000000.00001")
+	}, "20000000.00001", "")
 	db.CheckSyncLink()
 	require.True(t, fs.Exists(link))
 	db.UpdateMetadata(map[string][]string{
 		"X-Container-Sync-To": {"", "200000001.00001"},
-	}, "20000001.00001")
+	}, "20000001.00001", "")
 	db.CheckSyncLink()
 	require.False(t, fs.Exists(link))
 }
@@ -717,7 +929,7 @@ func TestMalformed(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer os.RemoveAll(dir)
-	err = sqliteCreateContainer(dbFile, "a", "c", "200000000.00000", nil, 0)
+	err = sqliteCreateContainer(dbFile, "a", "c", "200000000.00000", nil, 0, "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -755,7 +967,7 @@ func TestNotADB(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer os.RemoveAll(dir)
-	err = sqliteCreateContainer(dbFile, "a", "c", "200000000.00000", nil, 0)
+	err = sqliteCreateContainer(dbFile, "a", "c", "200000000.00000", nil, 0, "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -783,3 +995,122 @@ func TestNotADB(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestMetadataHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	dbFile := filepath.Join(dir, "device", "containers", "1", "000", "db", "db.db")
+	require.Nil(t, os.MkdirAll(filepath.Dir(dbFile), 0777))
+	require.Nil(t, sqliteCreateContainer(dbFile, "a", "c", "100000000.00000", map[string][]string{
+		"X-Container-Read":      {".r:*", "100000000.00000"},
+		"X-Container-Meta-Test": {"value", "100000000.00000"},
+	}, 0, "AUTH_a,a:alice"))
+	c, err := sqliteOpenContainer(dbFile)
+	require.Nil(t, err)
+	db := c.(*sqliteContainer)
+	defer db.Close()
+
+	require.Nil(t, db.UpdateMetadata(map[string][]string{
+		"X-Container-Read":             {".r:*", "100000001.00000"},
+		"X-Container-Write":            {"a:bob", "100000001.00000"},
+		"X-Container-Sync-Key":         {"secret", "100000001.00000"},
+		"X-Container-Meta-Quota-Bytes": {"1000", "100000001.00000"},
+		"X-Container-Meta-Test":        {"other", "100000001.00000"},
+	}, "100000001.00000", "AUTH_a,a:bob"))
+	// Updates older than the current values change nothing, so aren't recorded.
+	require.Nil(t, db.UpdateMetadata(map[string][]string{
+		"X-Container-Write": {"", "100000000.50000"},
+	}, "100000000.50000", "AUTH_a,a:mallory"))
+
+	changes, err := db.MetadataHistory("0")
+	require.Nil(t, err)
+	require.Equal(t, 4, len(changes))
+	require.Equal(t, "X-Container-Read", changes[0].Name)
+	require.Equal(t, ".r:*", changes[0].Value)
+	require.Equal(t, "", changes[0].Previous)
+	require.Equal(t, "100000000.00000", changes[0].Timestamp)
+	require.Equal(t, "AUTH_a,a:alice", changes[0].Requester)
+	require.True(t, changes[0].RecordedAt > 0)
+	byName := map[string]*MetadataChange{}
+	for _, change := range changes[1:] {
+		require.Equal(t, "100000001.00000", change.Timestamp)
+		require.Equal(t, "AUTH_a,a:bob", change.Requester)
+		byName[change.Name] = change
+	}
+	require.Equal(t, "a:bob", byName["X-Container-Write"].Value)
+	require.Equal(t, "1000", byName["X-Container-Meta-Quota-Bytes"].Value)
+	require.True(t, strings.HasPrefix(byName["X-Container-Sync-Key"].Value, "sha256:"))
+	require.NotContains(t, byName["X-Container-Sync-Key"].Value, "secret")
+
+	changes, err = db.MetadataHistory("100000000.00000")
+	require.Nil(t, err)
+	require.Equal(t, 3, len(changes))
+}
+
+func TestShardRanges(t *testing.T) {
+	db, _, cleanup, err := createTestDatabase("100000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, mergeItemsByName(db, []string{"a"}))
+
+	// A report of counts for a range the container doesn't have is ignored.
+	require.Nil(t, db.MergeShardRanges([]*common.ShardRange{{Account: ".shards_a", Container: "c-0", ObjectCount: 5, MetaTimestamp: "100000001.00000"}}))
+	ranges, err := db.ShardRanges()
+	require.Nil(t, err)
+	require.Equal(t, 0, len(ranges))
+
+	require.Nil(t, db.MergeShardRanges([]*common.ShardRange{
+		{Account: ".shards_a", Container: "c-1", Lower: "m", State: common.ShardStateCreated, Timestamp: "100000001.00000"},
+		{Account: ".shards_a", Container: "c-0", Upper: "m", State: common.ShardStateCreated, Timestamp: "100000001.00000"},
+	}))
+	info, err := db.GetInfo()
+	require.Nil(t, err)
+	require.Equal(t, 2, len(info.ShardRanges))
+	require.Equal(t, "c-0", info.ShardRanges[0].Container)
+	require.Equal(t, int64(1), info.ObjectCount)
+
+	// Older bounds are ignored while newer counts are kept, and once every range is active the counts add up.
+	require.Nil(t, db.MergeShardRanges([]*common.ShardRange{
+		{Account: ".shards_a", Container: "c-0", Upper: "m", State: common.ShardStateActive, Timestamp: "100000002.00000"},
+		{Account: ".shards_a", Container: "c-1", Lower: "x", State: common.ShardStateActive, Timestamp: "100000000.00000"},
+		{Account: ".shards_a", Container: "c-1", ObjectCount: 3, BytesUsed: 30, MetaTimestamp: "100000003.00000"},
+	}))
+	info, err = db.GetInfo()
+	require.Nil(t, err)
+	require.Equal(t, common.ShardStateActive, info.ShardRanges[0].State)
+	require.Equal(t, "m", info.ShardRanges[1].Lower)
+	require.Equal(t, common.ShardStateCreated, info.ShardRanges[1].State)
+	require.Equal(t, int64(3), info.ShardRanges[1].ObjectCount)
+	require.Equal(t, int64(1), info.ObjectCount)
+	require.Nil(t, db.MergeShardRanges([]*common.ShardRange{
+		{Account: ".shards_a", Container: "c-1", Lower: "m", State: common.ShardStateActive, Timestamp: "100000002.00000"},
+	}))
+	info, err = db.GetInfo()
+	require.Nil(t, err)
+	require.Equal(t, int64(4), info.ObjectCount)
+	require.Equal(t, int64(30), info.BytesUsed)
+}
+
+func TestFindShardBoundsAndRemoveItems(t *testing.T) {
+	db, _, cleanup, err := createTestDatabase("100000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, mergeItemsByName(db, []string{"a", "b", "c", "d", "e", "f", "g"}))
+	bounds, err := db.FindShardBounds(3)
+	require.Nil(t, err)
+	require.Equal(t, []string{"c", "f"}, bounds)
+	bounds, err = db.FindShardBounds(7)
+	require.Nil(t, err)
+	require.Equal(t, []string{}, bounds)
+
+	items, err := db.ItemsSince(-1, 3)
+	require.Nil(t, err)
+	require.Nil(t, db.RemoveItems(items[2].Rowid))
+	items, err = db.ItemsSince(-1, 10)
+	require.Nil(t, err)
+	require.Equal(t, 4, len(items))
+	info, err := db.GetInfo()
+	require.Nil(t, err)
+	require.Equal(t, int64(4), info.ObjectCount)
+}
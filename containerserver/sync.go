@@ -0,0 +1,333 @@
+package containerserver
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/crypt"
+	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/middleware"
+	"go.uber.org/zap"
+)
+
+// syncBatchSize is how many rows container sync reads from a database at a
+// time.
+const syncBatchSize = 100
+
+// syncObjectHeaders are the headers of a local object that container sync
+// sends on with it, besides its X-Object-Meta-* metadata.
+var syncObjectHeaders = []string{"Content-Type", "Etag", "Content-Encoding", "Content-Disposition", "X-Delete-At", "X-Object-Manifest",
+	"X-Static-Large-Object"}
+
+// syncObjectClient is how container sync reads the objects it sends.
+type syncObjectClient interface {
+	GetObject(ctx context.Context, account, container, obj string, headers http.Header) *http.Response
+}
+
+// containerSync replays the object PUTs and DELETEs recorded in the
+// databases of containers with an X-Container-Sync-To to their remote
+// containers. Each replica of a database first sends the rows that hash to
+// it, then, once the others have had their turn, checks every row up to
+// there was sent, so a row is only left behind if all of them fail it.
+type containerSync struct {
+	r       *Replicator
+	realms  conf.SyncRealmList
+	client  common.HTTPClient
+	objects syncObjectClient
+	// keys decrypt objects the proxies encrypted, which are sent on in
+	// plaintext for the remote cluster to encrypt with its own keys.
+	keys          *crypt.Keymaster
+	interval      time.Duration
+	containerTime time.Duration
+	prefix        string
+	suffix        string
+	stats         map[string]int64
+}
+
+func newContainerSync(r *Replicator, realms conf.SyncRealmList, c common.HTTPClient, objects syncObjectClient, keys *crypt.Keymaster, interval, containerTime time.Duration, prefix, suffix string) *containerSync {
+	return &containerSync{r: r, realms: realms, client: c, objects: objects, keys: keys, interval: interval, containerTime: containerTime, prefix: prefix, suffix: suffix}
+}
+
+// rowOrdinal is the index of the container's replica that sends the row
+// first.
+func (s *containerSync) rowOrdinal(info *ContainerInfo, name string, replicas int) int {
+	sum := md5.Sum([]byte(s.prefix + "/" + info.Account + "/" + info.Container + "/" + name + s.suffix))
+	return int(binary.BigEndian.Uint32(sum[:4]) % uint32(replicas))
+}
+
+// remote makes a signed request for the object at objURL on the remote
+// cluster.
+func (s *containerSync) remote(method, objURL, timestamp string, realm conf.SyncRealm, userKey string, headers http.Header, body io.Reader, length int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, objURL, body)
+	if err != nil {
+		return nil, err
+	}
+	for k := range headers {
+		req.Header.Set(k, headers.Get(k))
+	}
+	if body != nil {
+		req.ContentLength = length
+	}
+	req.Header.Set("X-Timestamp", timestamp)
+	req.Header.Set("X-Container-Sync-Auth", realm.SyncAuth(method, req.URL.EscapedPath(), timestamp, common.UUID(), userKey))
+	req.Header.Set("User-Agent", "container-sync")
+	return s.client.Do(req)
+}
+
+// syncRow sends the row's PUT or DELETE to the remote container, returning
+// whether it's there now.
+func (s *containerSync) syncRow(info *ContainerInfo, row *ObjectRecord, realm conf.SyncRealm, syncURL, userKey string) bool {
+	objURL := syncURL + "/" + common.Urlencode(row.Name)
+	if row.Deleted == 1 {
+		resp, err := s.remote("DELETE", objURL, row.CreatedAt, realm, userKey, nil, nil, 0)
+		if err != nil {
+			s.r.logger.Debug("Error syncing delete", zap.String("url", objURL), zap.Error(err))
+			s.stats["failures"]++
+			return false
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound && resp.StatusCode != http.StatusConflict {
+			s.r.logger.Debug("Bad status syncing delete", zap.String("url", objURL), zap.Int("status", resp.StatusCode))
+			s.stats["failures"]++
+			return false
+		}
+		s.stats["deletes"]++
+		return true
+	}
+	if resp, err := s.remote("HEAD", objURL, row.CreatedAt, realm, userKey, nil, nil, 0); err == nil {
+		resp.Body.Close()
+		if remoteTime, err := common.ParseDate(resp.Header.Get("X-Timestamp")); resp.StatusCode/100 == 2 && err == nil {
+			if rowTime, err := common.ParseDate(row.CreatedAt); err == nil && !remoteTime.Before(rowTime) {
+				s.stats["skips"]++
+				return true
+			}
+		}
+	}
+	resp := s.objects.GetObject(context.Background(), info.Account, info.Container, row.Name, http.Header{"X-Newest": {"true"}})
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		// It's been deleted since, and its delete row is synced instead.
+		s.stats["skips"]++
+		return true
+	}
+	timestamp := resp.Header.Get("X-Timestamp")
+	objTime, err := common.ParseDate(timestamp)
+	rowTime, rowErr := common.ParseDate(row.CreatedAt)
+	if resp.StatusCode/100 != 2 || err != nil || rowErr != nil || objTime.Before(rowTime) {
+		s.r.logger.Debug("Unable to get object to sync", zap.String("account", info.Account), zap.String("container", info.Container),
+			zap.String("object", row.Name), zap.Int("status", resp.StatusCode))
+		s.stats["failures"]++
+		return false
+	}
+	var body io.Reader = resp.Body
+	if resp.Header.Get(crypt.BodyMetaHeader) != "" {
+		if s.keys == nil {
+			s.r.logger.Error("Unable to sync encrypted object without the encryption root secret", zap.String("account", info.Account),
+				zap.String("container", info.Container), zap.String("object", row.Name))
+			s.stats["failures"]++
+			return false
+		}
+		bodyKey, iv, err := crypt.DecryptHeaders(s.keys.ObjectKey(info.Account, info.Container, row.Name), resp.Header)
+		var stream cipher.Stream
+		if err == nil {
+			stream, err = crypt.CtrStream(bodyKey, iv, 0)
+		}
+		if err != nil {
+			s.r.logger.Error("Unable to decrypt object to sync", zap.String("account", info.Account), zap.String("container", info.Container),
+				zap.String("object", row.Name), zap.Error(err))
+			s.stats["failures"]++
+			return false
+		}
+		body = &cipher.StreamReader{S: stream, R: resp.Body}
+	}
+	headers := http.Header{}
+	for k := range resp.Header {
+		if strings.HasPrefix(k, "X-Object-Meta-") {
+			headers.Set(k, resp.Header.Get(k))
+		}
+	}
+	for _, k := range syncObjectHeaders {
+		if v := resp.Header.Get(k); v != "" {
+			headers.Set(k, v)
+		}
+	}
+	length, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		s.stats["failures"]++
+		return false
+	}
+	if etag := headers.Get("Etag"); etag != "" {
+		headers.Set("Etag", strings.Trim(etag, "\""))
+	}
+	putResp, err := s.remote("PUT", objURL, timestamp, realm, userKey, headers, body, length)
+	if err != nil {
+		s.r.logger.Debug("Error syncing object", zap.String("url", objURL), zap.Error(err))
+		s.stats["failures"]++
+		return false
+	}
+	putResp.Body.Close()
+	if putResp.StatusCode/100 != 2 && putResp.StatusCode != http.StatusConflict {
+		s.r.logger.Debug("Bad status syncing object", zap.String("url", objURL), zap.Int("status", putResp.StatusCode))
+		s.stats["failures"]++
+		return false
+	}
+	s.stats["puts"]++
+	return true
+}
+
+// syncContainer sends the database's new rows to its remote container, for
+// up to containerTime.
+func (s *containerSync) syncContainer(dev *ring.Device, dbFile string) {
+	db, err := sqliteOpenContainer(dbFile)
+	if err != nil {
+		s.r.logger.Error("Error opening container to sync", zap.String("dbFile", dbFile), zap.Error(err))
+		return
+	}
+	defer db.Close()
+	info, err := db.GetInfo()
+	if err != nil {
+		s.r.logger.Error("Error getting container info to sync", zap.String("dbFile", dbFile), zap.Error(err))
+		return
+	}
+	if deleted, err := db.IsDeleted(); err != nil || deleted {
+		return
+	}
+	metadata, err := db.GetMetadata()
+	if err != nil {
+		s.r.logger.Error("Error getting container metadata to sync", zap.String("dbFile", dbFile), zap.Error(err))
+		return
+	}
+	userKey := metadata["X-Container-Sync-Key"]
+	realm, syncURL, ok := s.realms.SyncToURL(metadata["X-Container-Sync-To"])
+	if !ok || userKey == "" {
+		s.stats["skipped_containers"]++
+		return
+	}
+	nodes := s.r.Ring.GetNodes(s.r.Ring.GetPartition(info.Account, info.Container, ""))
+	ordinal := -1
+	for i, node := range nodes {
+		if node.Id == dev.Id {
+			ordinal = i
+		}
+	}
+	if ordinal < 0 {
+		// Handoffs leave syncing to the primaries.
+		return
+	}
+	s.stats["containers"]++
+	point1, err := strconv.ParseInt(info.XContainerSyncPoint1, 10, 64)
+	if err != nil {
+		point1 = -1
+	}
+	point2, err := strconv.ParseInt(info.XContainerSyncPoint2, 10, 64)
+	if err != nil {
+		point2 = -1
+	}
+	stopAt := time.Now().Add(s.containerTime)
+	defer func() {
+		if err := db.SetSyncPoints(point1, point2); err != nil {
+			s.r.logger.Error("Error saving container sync points", zap.String("dbFile", dbFile), zap.Error(err))
+		}
+	}()
+
+	// Everything up to point1 has had its turn on the other replicas, so
+	// make sure each row got there. The first row that fails is where the
+	// next pass starts from.
+	retryFrom := int64(-2)
+CheckLoop:
+	for point2 < point1 && time.Now().Before(stopAt) {
+		rows, err := db.ItemsSince(point2, syncBatchSize)
+		if err != nil || len(rows) == 0 {
+			break
+		}
+		for _, row := range rows {
+			if row.Rowid > point1 || !time.Now().Before(stopAt) {
+				break CheckLoop
+			}
+			if !s.syncRow(info, row, realm, syncURL, userKey) && retryFrom == -2 {
+				retryFrom = point2
+			}
+			point2 = row.Rowid
+		}
+	}
+	if retryFrom != -2 {
+		point2 = retryFrom
+	}
+
+	// Then send this replica's share of the new rows.
+	for time.Now().Before(stopAt) {
+		rows, err := db.ItemsSince(point1, syncBatchSize)
+		if err != nil || len(rows) == 0 {
+			break
+		}
+		for _, row := range rows {
+			if !time.Now().Before(stopAt) {
+				return
+			}
+			if s.rowOrdinal(info, row.Name, len(nodes)) == ordinal {
+				s.syncRow(info, row, realm, syncURL, userKey)
+			}
+			point1 = row.Rowid
+		}
+	}
+}
+
+// run makes one pass over the sync containers on the local devices,
+// reporting how it went to recon.
+func (s *containerSync) run() {
+	start := time.Now()
+	s.stats = map[string]int64{"containers": 0, "skipped_containers": 0, "puts": 0, "deletes": 0, "skips": 0, "failures": 0}
+	devices, err := s.r.Ring.LocalDevices(s.r.serverPort)
+	if err != nil {
+		s.r.logger.Error("Error getting local devices from ring", zap.Error(err))
+		return
+	}
+	for _, dev := range devices {
+		devicePath := filepath.Join(s.r.deviceRoot, dev.Device)
+		if mounted, err := fs.IsMount(devicePath); s.r.checkMounts && (err != nil || !mounted) {
+			s.r.logger.Error("Not syncing containers on unmounted device", zap.String("device", dev.Device), zap.Error(err))
+			continue
+		}
+		filepath.Walk(filepath.Join(devicePath, "sync_containers"), func(path string, fi os.FileInfo, err error) error {
+			if err == nil && strings.HasSuffix(path, ".db") {
+				s.syncContainer(dev, path)
+			}
+			return nil
+		})
+	}
+	fields := []zap.Field{zap.Duration("timeTook", time.Since(start))}
+	recon := map[string]interface{}{"container_sync_pass": time.Since(start).Seconds()}
+	for k, v := range s.stats {
+		fields = append(fields, zap.Int64(k, v))
+		recon[fmt.Sprintf("container_sync_%s", k)] = v
+	}
+	s.r.logger.Info("Container sync pass complete", fields...)
+	if err := middleware.DumpReconCache(s.r.reconCachePath, "container", recon); err != nil {
+		s.r.logger.Error("container-sync saving recon data", zap.Error(err))
+	}
+}
+
+// runForever starts a pass every interval, or as soon as the last one
+// finishes if it took longer.
+func (s *containerSync) runForever() {
+	for {
+		start := time.Now()
+		s.run()
+		if d := s.interval - time.Since(start); d > 0 {
+			time.Sleep(d)
+		}
+	}
+}
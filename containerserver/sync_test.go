@@ -0,0 +1,250 @@
+package containerserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/crypt"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/test"
+	"go.uber.org/zap"
+)
+
+type fakeSyncObjects map[string]string
+
+func (f fakeSyncObjects) GetObject(ctx context.Context, account, container, obj string, headers http.Header) *http.Response {
+	timestamp, ok := f[obj]
+	if !ok {
+		return &http.Response{StatusCode: 404, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(""))}
+	}
+	return &http.Response{StatusCode: 200, Header: http.Header{
+		"X-Timestamp":       {timestamp},
+		"Content-Length":    {"4"},
+		"Content-Type":      {"text/plain"},
+		"X-Object-Meta-Foo": {"bar"},
+		"X-Backend-Junk":    {"nope"},
+	}, Body: ioutil.NopCloser(strings.NewReader("body"))}
+}
+
+// encryptedSyncObjects stores the objects of fakeSyncObjects the way the
+// proxy's encryption middleware does, as a large object manifest.
+type encryptedSyncObjects struct {
+	fakeSyncObjects
+	keys *crypt.Keymaster
+}
+
+func (e encryptedSyncObjects) GetObject(ctx context.Context, account, container, obj string, headers http.Header) *http.Response {
+	resp := e.fakeSyncObjects.GetObject(ctx, account, container, obj, headers)
+	if resp.StatusCode != 200 {
+		return resp
+	}
+	key := e.keys.ObjectKey(account, container, obj)
+	bodyKey, iv := bytes.Repeat([]byte{2}, 32), bytes.Repeat([]byte{3}, 16)
+	stream, _ := crypt.CtrStream(bodyKey, iv, 0)
+	body, _ := ioutil.ReadAll(resp.Body)
+	stream.XORKeyStream(body, body)
+	wrapped, _ := crypt.EncryptValue(key, bodyKey)
+	contentType, _ := crypt.EncryptValue(key, []byte("text/plain;swift_bytes=100"))
+	etag, _ := crypt.EncryptValue(key, []byte("841a2d689ad86bd1611447453c22c6fc"))
+	resp.Header.Set("Content-Type", contentType)
+	resp.Header.Set("Etag", "ciphertextetag")
+	resp.Header.Set("X-Static-Large-Object", "True")
+	resp.Header.Set(crypt.EtagHeader, etag)
+	resp.Header.Set(crypt.BodyMetaHeader, fmt.Sprintf(`{"cipher": %q, "iv": %q, "body_key": %q}`, crypt.Cipher, hex.EncodeToString(iv), wrapped))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp
+}
+
+// testSyncRemote is a remote cluster that checks container sync's
+// signatures and keeps the timestamps of the objects it's sent.
+type testSyncRemote struct {
+	sync.Mutex
+	realm   conf.SyncRealm
+	objects map[string]string
+	headers map[string]http.Header
+	deletes []string
+	bad     int
+	fail    bool
+}
+
+func (rs *testSyncRemote) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rs.Lock()
+	defer rs.Unlock()
+	auth := strings.Fields(r.Header.Get("X-Container-Sync-Auth"))
+	if len(auth) != 3 || !rs.realm.ValidSyncSignature(r.Method, r.URL.EscapedPath(), r.Header.Get("X-Timestamp"), auth[1], "secret", auth[2]) {
+		rs.bad++
+		w.WriteHeader(401)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/v1/AUTH_b/c2/")
+	switch r.Method {
+	case "HEAD":
+		if ts, ok := rs.objects[name]; ok {
+			w.Header().Set("X-Timestamp", ts)
+			w.WriteHeader(200)
+			return
+		}
+		w.WriteHeader(404)
+	case "PUT":
+		body, _ := ioutil.ReadAll(r.Body)
+		if rs.fail || string(body) != "body" || r.Header.Get("X-Object-Meta-Foo") != "bar" || r.Header.Get("X-Backend-Junk") != "" {
+			w.WriteHeader(503)
+			return
+		}
+		rs.objects[name] = r.Header.Get("X-Timestamp")
+		rs.headers[name] = r.Header
+		w.WriteHeader(201)
+	case "DELETE":
+		rs.deletes = append(rs.deletes, name)
+		w.WriteHeader(404)
+	}
+}
+
+func makeTestContainerSync(t *testing.T) (*containerSync, *testSyncRemote, *sqliteContainer, string, func()) {
+	db, dbFile, cleanup, err := createTestDatabase("100000000.00000")
+	require.Nil(t, err)
+	require.Nil(t, db.UpdateMetadata(map[string][]string{
+		"X-Container-Sync-To":  {"//realm1/east/AUTH_b/c2", "100000001.00000"},
+		"X-Container-Sync-Key": {"secret", "100000001.00000"},
+	}, "100000001.00000", ""))
+	remote := &testSyncRemote{realm: conf.SyncRealm{Name: "realm1", Key1: "one"}, objects: map[string]string{}, headers: map[string]http.Header{}}
+	ts := httptest.NewServer(remote)
+	realms := conf.SyncRealmList{"realm1": {Name: "realm1", Key1: "one", Clusters: map[string]string{"east": ts.URL + "/v1/"}}}
+	r := &Replicator{
+		logger: zap.NewNop(),
+		Ring:   &test.FakeRing{MockDevices: []*ring.Device{{Id: 0}, {Id: 1}, {Id: 2}}},
+	}
+	s := newContainerSync(r, realms, http.DefaultClient, fakeSyncObjects{"o 1": "100000002.00000", "o2": "100000003.00000", "o3": "100000004.00000"}, nil, 0, time.Minute, "changeme", "changeme")
+	s.stats = map[string]int64{}
+	return s, remote, db, dbFile, func() {
+		ts.Close()
+		cleanup()
+	}
+}
+
+// testSyncPoints returns the sync points container sync saved to the
+// database through its own connection.
+func testSyncPoints(t *testing.T, db *sqliteContainer) (string, string) {
+	db.invalidateCache()
+	info, err := db.GetInfo()
+	require.Nil(t, err)
+	return info.XContainerSyncPoint1, info.XContainerSyncPoint2
+}
+
+func TestContainerSync(t *testing.T) {
+	s, remote, db, dbFile, cleanup := makeTestContainerSync(t)
+	defer cleanup()
+	require.Nil(t, db.MergeItems([]*ObjectRecord{
+		{Name: "o 1", CreatedAt: "100000002.00000"},
+		{Name: "o2", CreatedAt: "100000003.00000"},
+		{Name: "o3", CreatedAt: "100000004.00000"},
+		{Name: "d1", CreatedAt: "100000005.00000", Deleted: 1},
+		{Name: "gone", CreatedAt: "100000006.00000"},
+	}, ""))
+	info, err := db.GetInfo()
+	require.Nil(t, err)
+	owned := 0
+	for _, name := range []string{"o 1", "o2", "o3", "d1", "gone"} {
+		if s.rowOrdinal(info, name, 3) == 0 {
+			owned++
+		}
+	}
+
+	// The first replica only sends its share of the rows.
+	s.syncContainer(&ring.Device{Id: 0}, dbFile)
+	require.Equal(t, 0, remote.bad)
+	require.Equal(t, owned, len(remote.objects)+len(remote.deletes)+int(s.stats["skips"]))
+	point1, point2 := testSyncPoints(t, db)
+	require.Equal(t, "5", point1)
+	require.Equal(t, "-1", point2)
+
+	// The next checks all of them got there.
+	s.syncContainer(&ring.Device{Id: 1}, dbFile)
+	require.Equal(t, 0, remote.bad)
+	require.Equal(t, map[string]string{"o 1": "100000002.00000", "o2": "100000003.00000", "o3": "100000004.00000"}, remote.objects)
+	require.Equal(t, []string{"d1"}, remote.deletes)
+	point1, point2 = testSyncPoints(t, db)
+	require.Equal(t, "5", point1)
+	require.Equal(t, "5", point2)
+
+	// A handoff doesn't sync.
+	require.Nil(t, db.MergeItems([]*ObjectRecord{{Name: "o4", CreatedAt: "100000007.00000"}}, ""))
+	s.syncContainer(&ring.Device{Id: 5}, dbFile)
+	point1, _ = testSyncPoints(t, db)
+	require.Equal(t, "5", point1)
+}
+
+func TestContainerSyncRetriesFailures(t *testing.T) {
+	s, remote, db, dbFile, cleanup := makeTestContainerSync(t)
+	defer cleanup()
+	require.Nil(t, db.MergeItems([]*ObjectRecord{
+		{Name: "o 1", CreatedAt: "100000002.00000"},
+		{Name: "o2", CreatedAt: "100000003.00000"},
+	}, ""))
+	require.Nil(t, db.SetSyncPoints(2, -1))
+	remote.fail = true
+	s.syncContainer(&ring.Device{Id: 0}, dbFile)
+	require.Equal(t, int64(2), s.stats["failures"])
+	_, point2 := testSyncPoints(t, db)
+	require.Equal(t, "-1", point2)
+
+	remote.fail = false
+	s.syncContainer(&ring.Device{Id: 0}, dbFile)
+	require.Equal(t, 2, len(remote.objects))
+	_, point2 = testSyncPoints(t, db)
+	require.Equal(t, "2", point2)
+}
+
+func TestContainerSyncResetOnNewSyncTo(t *testing.T) {
+	s, _, db, dbFile, cleanup := makeTestContainerSync(t)
+	defer cleanup()
+	require.Nil(t, db.MergeItems([]*ObjectRecord{{Name: "o 1", CreatedAt: "100000002.00000"}}, ""))
+	s.syncContainer(&ring.Device{Id: 0}, dbFile)
+	point1, _ := testSyncPoints(t, db)
+	require.Equal(t, "1", point1)
+	require.Nil(t, db.UpdateMetadata(map[string][]string{
+		"X-Container-Sync-To": {"//realm1/east/AUTH_b/c3", "100000010.00000"},
+	}, "100000010.00000", ""))
+	point1, point2 := testSyncPoints(t, db)
+	require.Equal(t, "-1", point1)
+	require.Equal(t, "-1", point2)
+}
+
+func TestContainerSyncEncryptedObject(t *testing.T) {
+	s, remote, db, _, cleanup := makeTestContainerSync(t)
+	defer cleanup()
+	config, err := conf.StringConfig("[container-sync]\nencryption_root_secret = " + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)))
+	require.Nil(t, err)
+	keys, err := crypt.NewKeymaster(config.GetSection("container-sync"))
+	require.Nil(t, err)
+	s.objects = encryptedSyncObjects{fakeSyncObjects{"o2": "100000003.00000"}, keys}
+	info, err := db.GetInfo()
+	require.Nil(t, err)
+	realm, syncURL, ok := s.realms.SyncToURL("//realm1/east/AUTH_b/c2")
+	require.True(t, ok)
+	row := &ObjectRecord{Name: "o2", CreatedAt: "100000003.00000"}
+
+	// Without the keys it's left alone rather than sent as ciphertext.
+	require.False(t, s.syncRow(info, row, realm, syncURL, "secret"))
+	require.Equal(t, 0, len(remote.objects))
+
+	s.keys = keys
+	require.True(t, s.syncRow(info, row, realm, syncURL, "secret"))
+	sent := remote.headers["o2"]
+	require.Equal(t, "text/plain;swift_bytes=100", sent.Get("Content-Type"))
+	require.Equal(t, "841a2d689ad86bd1611447453c22c6fc", sent.Get("Etag"))
+	require.Equal(t, "True", sent.Get("X-Static-Large-Object"))
+	require.Equal(t, "", sent.Get(crypt.BodyMetaHeader))
+}
@@ -63,6 +63,9 @@ func (server *ContainerServer) accountUpdate(writer http.ResponseWriter, request
 			schemes = append(schemes, "http")
 		}
 		ctx := tracing.CopySpanFromContext(request.Context())
+		if traceId := request.Header.Get(tracing.TraceIdHeader); traceId != "" {
+			ctx = tracing.ContextWithTraceId(ctx, traceId, nil)
+		}
 		for index, host := range hosts {
 			if err := accountUpdateHelper(ctx, info, schemes[index], host, devices[index], accpartition, vars["account"], vars["container"], request.Header.Get("X-Trans-Id"), request.Header.Get("X-Account-Override-Deleted") == "yes", server.updateClient); err != nil {
 				logger.Error(
@@ -94,6 +97,9 @@ func accountUpdateHelper(ctx context.Context, info *ContainerInfo, scheme, host,
 	req.Header.Add("X-Object-Count", strconv.FormatInt(info.ObjectCount, 10))
 	req.Header.Add("X-Bytes-Used", strconv.FormatInt(info.BytesUsed, 10))
 	req.Header.Add("X-Trans-Id", transID)
+	if traceId := tracing.TraceIdFromContext(ctx); traceId != "" {
+		req.Header.Add(tracing.TraceIdHeader, traceId)
+	}
 	req.Header.Add("X-Backend-Storage-Policy-Index", strconv.Itoa(info.StoragePolicyIndex))
 	if accountOverrideDeleted {
 		req.Header.Add("X-Account-Override-Deleted", "yes")
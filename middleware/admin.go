@@ -0,0 +1,128 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/srv"
+	"go.uber.org/zap"
+)
+
+// Roles that can be granted to admin tokens and client certificates; "*"
+// grants all of them.
+const (
+	AdminRoleAudit       = "audit"
+	AdminRoleCapacity    = "capacity"
+	AdminRoleLimits      = "limits"
+	AdminRoleLogLevel    = "loglevel"
+	AdminRoleQuarantine  = "quarantine"
+	AdminRoleReplication = "replication"
+	AdminRoleRing        = "ring"
+	AdminRoleWorkItems   = "workitems"
+)
+
+var adminRoles = map[string]bool{
+	"*":                  true,
+	AdminRoleAudit:       true,
+	AdminRoleCapacity:    true,
+	AdminRoleLimits:      true,
+	AdminRoleLogLevel:    true,
+	AdminRoleQuarantine:  true,
+	AdminRoleReplication: true,
+	AdminRoleRing:        true,
+	AdminRoleWorkItems:   true,
+}
+
+type adminPrincipal struct {
+	name  string
+	roles map[string]bool
+}
+
+// AdminAuth guards a server's operational endpoints, only letting through
+// requests with an X-Admin-Token or a client certificate granted the role the
+// endpoint requires, and logs every request to one. With no tokens or
+// certificates configured, every request is let through and still logged.
+type AdminAuth struct {
+	tokens map[string]*adminPrincipal
+	certs  map[string]*adminPrincipal
+	logger srv.LowLevelLogger
+}
+
+// NewAdminAuth parses comma separated grants of the form
+// <token>:<role>|<role>... and <certificate common name>:<role>|<role>...
+func NewAdminAuth(tokens, certs string, logger srv.LowLevelLogger) (*AdminAuth, error) {
+	a := &AdminAuth{tokens: map[string]*adminPrincipal{}, certs: map[string]*adminPrincipal{}, logger: logger}
+	for i, grant := range common.SliceFromCSV(tokens) {
+		token, roles, err := parseAdminGrant(grant)
+		if err != nil {
+			return nil, fmt.Errorf("admin_tokens: %v", err)
+		}
+		a.tokens[token] = &adminPrincipal{name: fmt.Sprintf("token %d", i+1), roles: roles}
+	}
+	for _, grant := range common.SliceFromCSV(certs) {
+		name, roles, err := parseAdminGrant(grant)
+		if err != nil {
+			return nil, fmt.Errorf("admin_cert_roles: %v", err)
+		}
+		a.certs[name] = &adminPrincipal{name: "cert " + name, roles: roles}
+	}
+	return a, nil
+}
+
+func parseAdminGrant(grant string) (string, map[string]bool, error) {
+	i := strings.LastIndex(grant, ":")
+	if i <= 0 {
+		return "", nil, fmt.Errorf("invalid grant %q", grant)
+	}
+	roles := map[string]bool{}
+	for _, role := range strings.Split(grant[i+1:], "|") {
+		role = strings.TrimSpace(role)
+		if !adminRoles[role] {
+			return "", nil, fmt.Errorf("unknown role %q", role)
+		}
+		roles[role] = true
+	}
+	return strings.TrimSpace(grant[:i]), roles, nil
+}
+
+func (a *AdminAuth) principal(request *http.Request) *adminPrincipal {
+	if token := request.Header.Get("X-Admin-Token"); token != "" {
+		for t, p := range a.tokens {
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+				return p
+			}
+		}
+	}
+	if request.TLS != nil && len(request.TLS.PeerCertificates) > 0 {
+		if p, ok := a.certs[request.TLS.PeerCertificates[0].Subject.CommonName]; ok {
+			return p
+		}
+	}
+	return nil
+}
+
+// Require wraps next so it's only served to principals with role.
+func (a *AdminAuth) Require(role string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		name := "anonymous"
+		allowed := len(a.tokens) == 0 && len(a.certs) == 0
+		if p := a.principal(request); p != nil {
+			name = p.name
+			allowed = p.roles[role] || p.roles["*"]
+		}
+		if !allowed {
+			a.logger.Info("Admin action denied", zap.String("role", role), zap.String("principal", name),
+				zap.String("method", request.Method), zap.String("path", request.URL.Path), zap.String("remoteAddr", request.RemoteAddr))
+			srv.StandardResponse(writer, http.StatusForbidden)
+			return
+		}
+		w := &srv.WebWriter{ResponseWriter: writer, Status: 200}
+		next.ServeHTTP(w, request)
+		a.logger.Info("Admin action", zap.String("role", role), zap.String("principal", name),
+			zap.String("method", request.Method), zap.String("path", request.URL.Path), zap.String("remoteAddr", request.RemoteAddr),
+			zap.Int("status", w.Status))
+	})
+}
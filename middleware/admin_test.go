@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestNewAdminAuthErrors(t *testing.T) {
+	_, err := NewAdminAuth("secret", "", zap.L())
+	require.NotNil(t, err)
+	_, err = NewAdminAuth("secret:limits|bogus", "", zap.L())
+	require.NotNil(t, err)
+	_, err = NewAdminAuth("", "ops:", zap.L())
+	require.NotNil(t, err)
+	_, err = NewAdminAuth("sec:ret:limits|ring, other:*", "ops.example.com:replication", zap.L())
+	require.Nil(t, err)
+}
+
+func TestAdminAuth(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	a, err := NewAdminAuth("limiter:limits, root:*", "ops.example.com:replication", zap.New(core))
+	require.Nil(t, err)
+	handler := a.Require(AdminRoleLimits, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	do := func(token, commonName string) int {
+		req := httptest.NewRequest("PUT", "/disklimits", nil)
+		if token != "" {
+			req.Header.Set("X-Admin-Token", token)
+		}
+		if commonName != "" {
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: commonName}}}}
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	require.Equal(t, 204, do("limiter", ""))
+	require.Equal(t, 204, do("root", ""))
+	require.Equal(t, 403, do("", ""))
+	require.Equal(t, 403, do("wrong", ""))
+	require.Equal(t, 403, do("", "ops.example.com"))
+	require.Equal(t, 403, do("", "someone.else"))
+
+	entries := logs.All()
+	require.Equal(t, 6, len(entries))
+	require.Equal(t, "Admin action", entries[0].Message)
+	require.Equal(t, "token 1", entries[0].ContextMap()["principal"])
+	require.Equal(t, int64(204), entries[0].ContextMap()["status"])
+	require.Equal(t, "token 2", entries[1].ContextMap()["principal"])
+	require.Equal(t, "Admin action denied", entries[4].Message)
+	require.Equal(t, "cert ops.example.com", entries[4].ContextMap()["principal"])
+
+	handler = a.Require(AdminRoleReplication, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req := httptest.NewRequest("POST", "/priorityrep", nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "ops.example.com"}}}}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+}
+
+func TestAdminAuthUnconfigured(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	a, err := NewAdminAuth("", "", zap.New(core))
+	require.Nil(t, err)
+	handler := a.Require(AdminRoleRing, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("PUT", "/ring/etc/hummingbird/object.ring.gz", nil))
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, 1, logs.Len())
+	require.Equal(t, "anonymous", logs.All()[0].ContextMap()["principal"])
+}
@@ -2,10 +2,11 @@ package middleware
 
 import (
 	"bufio"
-	"fmt"
 	"net"
 	"net/http"
+	"time"
 
+	"github.com/troubling/hummingbird/common/srv"
 	"github.com/uber-go/tally"
 )
 
@@ -24,14 +25,12 @@ func (mw *recordStatusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 }
 
 func Metrics(metricsScope tally.Scope) func(http.Handler) http.Handler {
-	requestsMetric := metricsScope.Counter("requests")
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-			w := &recordStatusWriter{ResponseWriter: writer}
+			start := time.Now()
+			w := &recordStatusWriter{ResponseWriter: writer, status: http.StatusOK}
 			next.ServeHTTP(w, request)
-			requestsMetric.Inc(1)
-			metricsScope.Counter(request.Method + "_requests").Inc(1)
-			metricsScope.Counter(fmt.Sprintf("%d_responses", w.status)).Inc(1)
+			srv.RecordRequest(metricsScope, request.Method, w.status, time.Since(start))
 		})
 	}
 }
@@ -0,0 +1,206 @@
+package middleware
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/ring"
+)
+
+// A ReadyCheck is something a server needs to serve requests. Check returns
+// details for the /ready response, and an error if it isn't ready.
+type ReadyCheck struct {
+	Name  string
+	Check func() (interface{}, error)
+}
+
+// HealthcheckHandler answers /healthcheck with OK while the server is up,
+// unless it has been disabled for maintenance by creating disableFile.
+func HealthcheckHandler(disableFile string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if disableFile != "" && fs.Exists(disableFile) {
+			writer.Header().Set("Content-Length", "16")
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			writer.Write([]byte("DISABLED BY FILE"))
+			return
+		}
+		writer.Header().Set("Content-Length", "2")
+		writer.WriteHeader(http.StatusOK)
+		writer.Write([]byte("OK"))
+	}
+}
+
+// ReadyHandler answers /ready with the result of each check as JSON, and a
+// 503 if any of them failed or disableFile exists.
+func ReadyHandler(disableFile string, checks ...ReadyCheck) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		ready := true
+		results := map[string]interface{}{}
+		for _, c := range checks {
+			detail, err := c.Check()
+			result := map[string]interface{}{"ok": err == nil}
+			if detail != nil {
+				result["detail"] = detail
+			}
+			if err != nil {
+				result["error"] = err.Error()
+				ready = false
+			}
+			results[c.Name] = result
+		}
+		disabled := disableFile != "" && fs.Exists(disableFile)
+		data, err := json.Marshal(map[string]interface{}{"ready": ready && !disabled, "disabled": disabled, "checks": results})
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		if ready && !disabled {
+			writer.WriteHeader(http.StatusOK)
+		} else {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if request.Method != "HEAD" {
+			writer.Write(data)
+		}
+	}
+}
+
+// RingCheck checks that the rings can be loaded, and that at least one of
+// them lists devices on this server's port.
+func RingCheck(port int, rings map[string]func() (ring.Ring, error)) ReadyCheck {
+	return ReadyCheck{Name: "ring", Check: func() (interface{}, error) {
+		detail := map[string][]string{}
+		found := false
+		for name, getRing := range rings {
+			r, err := getRing()
+			if err != nil {
+				return detail, fmt.Errorf("%s: %v", name, err)
+			}
+			devs, err := r.LocalDevices(port)
+			if err != nil {
+				return detail, fmt.Errorf("%s: %v", name, err)
+			}
+			detail[name] = []string{}
+			for _, dev := range devs {
+				detail[name] = append(detail[name], dev.Device)
+				found = true
+			}
+		}
+		if !found {
+			return detail, fmt.Errorf("no devices on port %d", port)
+		}
+		return detail, nil
+	}}
+}
+
+// RingLoadedCheck checks that the rings can be loaded and have devices, for
+// servers like the proxy that don't have devices of their own.
+func RingLoadedCheck(rings map[string]func() (ring.Ring, error)) ReadyCheck {
+	return ReadyCheck{Name: "ring", Check: func() (interface{}, error) {
+		detail := map[string]int{}
+		for name, getRing := range rings {
+			r, err := getRing()
+			if err != nil {
+				return detail, fmt.Errorf("%s: %v", name, err)
+			}
+			detail[name] = len(r.AllDevices())
+			if detail[name] == 0 {
+				return detail, fmt.Errorf("%s: no devices", name)
+			}
+		}
+		return detail, nil
+	}}
+}
+
+// mountedDevices returns the devices under driveRoot that are mounted, or
+// all of them without checkMounts, and those that aren't.
+func mountedDevices(driveRoot string, checkMounts bool) ([]string, []string, error) {
+	rootInfo, err := os.Stat(driveRoot)
+	if err != nil {
+		return nil, nil, err
+	}
+	infos, err := ioutil.ReadDir(driveRoot)
+	if err != nil {
+		return nil, nil, err
+	}
+	mounted, unmounted := []string{}, []string{}
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		if checkMounts && info.Sys().(*syscall.Stat_t).Dev == rootInfo.Sys().(*syscall.Stat_t).Dev {
+			unmounted = append(unmounted, info.Name())
+		} else {
+			mounted = append(mounted, info.Name())
+		}
+	}
+	return mounted, unmounted, nil
+}
+
+// DevicesCheck checks that at least one device under driveRoot is mounted; a
+// server with some unmounted devices can still serve the rest.
+func DevicesCheck(driveRoot string, checkMounts bool) ReadyCheck {
+	return ReadyCheck{Name: "devices", Check: func() (interface{}, error) {
+		mounted, unmounted, err := mountedDevices(driveRoot, checkMounts)
+		if err != nil {
+			return nil, err
+		}
+		detail := map[string]interface{}{"mounted": mounted, "unmounted": unmounted}
+		if len(mounted) == 0 {
+			return detail, errors.New("no devices mounted")
+		}
+		return detail, nil
+	}}
+}
+
+// DBCheck checks that a database can be created and opened in the tmp
+// directory of the mounted devices under driveRoot, failing only if it can't
+// on any of them.
+func DBCheck(driveRoot string, checkMounts bool) ReadyCheck {
+	return ReadyCheck{Name: "db", Check: func() (interface{}, error) {
+		mounted, _, err := mountedDevices(driveRoot, checkMounts)
+		if err != nil {
+			return nil, err
+		}
+		failed := map[string]string{}
+		for _, device := range mounted {
+			if err := checkDB(filepath.Join(driveRoot, device, "tmp")); err != nil {
+				failed[device] = err.Error()
+			}
+		}
+		if len(failed) > 0 && len(failed) == len(mounted) {
+			return failed, errors.New("no device can open a database")
+		} else if len(failed) > 0 {
+			return failed, nil
+		}
+		return nil, nil
+	}}
+}
+
+func checkDB(tmpDir string) error {
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(tmpDir, ".ready")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	db, err := sql.Open("sqlite3", "file:"+tmp.Name()+"?psow=1&_txlock=immediate&mode=rw")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Exec("CREATE TABLE ready (x INTEGER)")
+	return err
+}
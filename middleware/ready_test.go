@@ -0,0 +1,123 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/test"
+)
+
+func TestHealthcheckDisabledByFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	disableFile := filepath.Join(dir, "disabled")
+
+	w := httptest.NewRecorder()
+	HealthcheckHandler(disableFile)(w, httptest.NewRequest("GET", "/healthcheck", nil))
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "OK", w.Body.String())
+
+	require.Nil(t, ioutil.WriteFile(disableFile, []byte{}, 0600))
+	w = httptest.NewRecorder()
+	HealthcheckHandler(disableFile)(w, httptest.NewRequest("GET", "/healthcheck", nil))
+	require.Equal(t, 503, w.Code)
+	require.Equal(t, "DISABLED BY FILE", w.Body.String())
+
+	w = httptest.NewRecorder()
+	ReadyHandler(disableFile)(w, httptest.NewRequest("GET", "/ready", nil))
+	require.Equal(t, 503, w.Code)
+	result := map[string]interface{}{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &result))
+	require.Equal(t, false, result["ready"])
+	require.Equal(t, true, result["disabled"])
+}
+
+func TestReadyHandler(t *testing.T) {
+	ok := ReadyCheck{Name: "ok", Check: func() (interface{}, error) { return "fine", nil }}
+	bad := ReadyCheck{Name: "bad", Check: func() (interface{}, error) { return nil, errors.New("broken") }}
+
+	w := httptest.NewRecorder()
+	ReadyHandler("", ok)(w, httptest.NewRequest("GET", "/ready", nil))
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	result := map[string]interface{}{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &result))
+	require.Equal(t, true, result["ready"])
+	require.Equal(t, map[string]interface{}{"ok": map[string]interface{}{"ok": true, "detail": "fine"}}, result["checks"])
+
+	w = httptest.NewRecorder()
+	ReadyHandler("", ok, bad)(w, httptest.NewRequest("GET", "/ready", nil))
+	require.Equal(t, 503, w.Code)
+	result = map[string]interface{}{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &result))
+	require.Equal(t, false, result["ready"])
+	require.Equal(t, map[string]interface{}{"ok": false, "error": "broken"}, result["checks"].(map[string]interface{})["bad"])
+
+	w = httptest.NewRecorder()
+	ReadyHandler("", ok, bad)(w, httptest.NewRequest("HEAD", "/ready", nil))
+	require.Equal(t, 503, w.Code)
+	require.Equal(t, 0, w.Body.Len())
+}
+
+func TestRingCheck(t *testing.T) {
+	rings := map[string]func() (ring.Ring, error){
+		"object-0": func() (ring.Ring, error) { return &test.FakeRing{}, nil },
+	}
+	_, err := RingCheck(6000, rings).Check()
+	require.Equal(t, "no devices on port 6000", err.Error())
+
+	rings["object-1"] = func() (ring.Ring, error) {
+		return &test.FakeRing{MockLocalDevices: []*ring.Device{{Device: "sda"}}}, nil
+	}
+	detail, err := RingCheck(6000, rings).Check()
+	require.Nil(t, err)
+	require.Equal(t, map[string][]string{"object-0": {}, "object-1": {"sda"}}, detail)
+
+	rings["object-2"] = func() (ring.Ring, error) { return nil, errors.New("no ring") }
+	_, err = RingCheck(6000, rings).Check()
+	require.Equal(t, "object-2: no ring", err.Error())
+}
+
+func TestDevicesAndDBChecks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = DevicesCheck(dir, false).Check()
+	require.Equal(t, "no devices mounted", err.Error())
+	_, err = DBCheck(dir, false).Check()
+	require.Nil(t, err)
+
+	require.Nil(t, os.Mkdir(filepath.Join(dir, "sda"), 0755))
+	detail, err := DevicesCheck(dir, false).Check()
+	require.Nil(t, err)
+	require.Equal(t, map[string]interface{}{"mounted": []string{"sda"}, "unmounted": []string{}}, detail)
+	_, err = DBCheck(dir, false).Check()
+	require.Nil(t, err)
+	files, err := ioutil.ReadDir(filepath.Join(dir, "sda", "tmp"))
+	require.Nil(t, err)
+	require.Empty(t, files)
+
+	// With mounts checked, a directory that isn't on its own filesystem
+	// doesn't count.
+	_, err = DevicesCheck(dir, true).Check()
+	require.Equal(t, "no devices mounted", err.Error())
+
+	require.Nil(t, os.Mkdir(filepath.Join(dir, "sdb"), 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "sdb", "tmp"), []byte{}, 0600))
+	detail, err = DBCheck(dir, false).Check()
+	require.Nil(t, err)
+	require.Contains(t, detail.(map[string]string), "sdb")
+
+	os.RemoveAll(filepath.Join(dir, "sda"))
+	_, err = DBCheck(dir, false).Check()
+	require.Equal(t, "no device can open a database", err.Error())
+}
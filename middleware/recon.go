@@ -354,20 +354,29 @@ func quarantineCounts(driveRoot string) (map[string]interface{}, error) {
 	return qcounts, nil
 }
 
-func quarantineDelete(driveRoot, deviceName, reconType, itemPath string) (map[string]interface{}, error) {
+// cleanQuarantinePath checks the device, recon type and item path of a
+// request for a quarantined item, returning the cleaned device and item path.
+func cleanQuarantinePath(deviceName, reconType, itemPath string) (string, string, error) {
 	cleanedDeviceName := path.Clean(deviceName)
 	// don't allow full paths, empty paths ".", nor up paths ".."
 	if cleanedDeviceName[0] == '/' || cleanedDeviceName[0] == '.' {
-		return nil, fmt.Errorf("invalid device name given: %q", deviceName)
+		return "", "", fmt.Errorf("invalid device name given: %q", deviceName)
 	}
-	deviceName = cleanedDeviceName
 	if reconType != "accounts" && reconType != "containers" && reconType != "objects" && !strings.HasPrefix(reconType, "objects-") {
-		return nil, fmt.Errorf("invalid recon type: %q", reconType)
+		return "", "", fmt.Errorf("invalid recon type: %q", reconType)
 	}
 	cleanedItemPath := path.Clean(itemPath)
 	// don't allow full paths, empty paths ".", nor up paths ".."
 	if cleanedItemPath[0] == '/' || cleanedItemPath[0] == '.' {
-		return nil, fmt.Errorf("invalid item path given: %q", itemPath)
+		return "", "", fmt.Errorf("invalid item path given: %q", itemPath)
+	}
+	return cleanedDeviceName, cleanedItemPath, nil
+}
+
+func quarantineDelete(driveRoot, deviceName, reconType, itemPath string) (map[string]interface{}, error) {
+	deviceName, cleanedItemPath, err := cleanQuarantinePath(deviceName, reconType, itemPath)
+	if err != nil {
+		return nil, err
 	}
 	fromPath := path.Join(driveRoot, deviceName, "quarantined", reconType, cleanedItemPath)
 	toDir := path.Join(driveRoot, deviceName, "quarantined-history", reconType)
@@ -428,6 +437,8 @@ func quarantineHistoryDelete(driveRoot, deviceName, reconType, trailingPath stri
 type QuarantineDetailEntry struct {
 	NameOnDevice string
 	NameInURL    string
+	// Time is when the item was quarantined.
+	Time time.Time
 }
 
 func handleIdbMeta(metaPath string, entry *QuarantineDetailEntry) bool {
@@ -482,7 +493,7 @@ func quarantineDetail(driveRoot string) (interface{}, error) {
 						// repaired, the remaining items will be shown.
 						break
 					}
-					ent := &QuarantineDetailEntry{NameOnDevice: listingItem.Name()}
+					ent := &QuarantineDetailEntry{NameOnDevice: listingItem.Name(), Time: listingItem.ModTime()}
 					if typeToDeviceToEntries[key] == nil {
 						typeToDeviceToEntries[key] = map[string][]*QuarantineDetailEntry{}
 					}
@@ -511,7 +522,7 @@ func quarantineDetail(driveRoot string) (interface{}, error) {
 						// Check EC first (really index db items)
 						idbMeta := filepath.Join(driveRoot, device.Name(), "quarantined", key, listingItem.Name(), listingItem.Name()+".idbmeta")
 						if handleIdbMeta(idbMeta, ent) {
-							break
+							continue
 						}
 						listing2, err := ioutil.ReadDir(filepath.Join(driveRoot, device.Name(), "quarantined", key, listingItem.Name()))
 						if err != nil {
@@ -535,6 +546,111 @@ func quarantineDetail(driveRoot string) (interface{}, error) {
 	return typeToDeviceToEntries, nil
 }
 
+// quarantinedFile returns the file holding a quarantined item and, for
+// objects, the metadata it was stored with.
+func quarantinedFile(itemDir, reconType string) (string, map[string]string, error) {
+	name := filepath.Base(itemDir)
+	if reconType == "accounts" || reconType == "containers" {
+		return filepath.Join(itemDir, strings.SplitN(name, "-", 2)[0]+".db"), nil, nil
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(itemDir, name+".idbmeta")); err == nil {
+		metadata := map[string]string{}
+		if err := json.Unmarshal(data, &metadata); err != nil {
+			return "", nil, err
+		}
+		return filepath.Join(itemDir, name), metadata, nil
+	}
+	listing, err := ioutil.ReadDir(itemDir)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, listingItem := range listing {
+		if strings.HasSuffix(listingItem.Name(), ".data") {
+			dataFile := filepath.Join(itemDir, listingItem.Name())
+			metadata, err := common.SwiftObjectReadMetadata(dataFile)
+			return dataFile, metadata, err
+		}
+	}
+	// Only a tombstone or metadata was quarantined.
+	return "", nil, os.ErrNotExist
+}
+
+// serveQuarantined sends a quarantined account or container database, or
+// an object's data with the metadata it was stored with as headers and its
+// name in X-Backend-Quarantined-Name.
+func serveQuarantined(writer http.ResponseWriter, request *http.Request, driveRoot, deviceName, reconType, itemPath string) {
+	deviceName, itemPath, err := cleanQuarantinePath(deviceName, reconType, itemPath)
+	if err != nil {
+		srv.SimpleErrorResponse(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	filePath, metadata, err := quarantinedFile(filepath.Join(driveRoot, deviceName, "quarantined", reconType, itemPath), reconType)
+	var file *os.File
+	if err == nil {
+		file, err = os.Open(filePath)
+	}
+	if os.IsNotExist(err) {
+		srv.StandardResponse(writer, http.StatusNotFound)
+		return
+	} else if err != nil {
+		srv.SimpleErrorResponse(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		srv.SimpleErrorResponse(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writer.Header().Set("Content-Type", "application/octet-stream")
+	for k, v := range metadata {
+		if k == "name" {
+			writer.Header().Set("X-Backend-Quarantined-Name", v)
+		} else if k != "Content-Length" {
+			writer.Header().Set(k, v)
+		}
+	}
+	http.ServeContent(writer, request, "", stat.ModTime(), file)
+}
+
+// quarantineRestore moves a quarantined account or container database back
+// into partition, as long as there isn't already one there, for its
+// replicator to bring up to date.
+func quarantineRestore(driveRoot, deviceName, reconType, itemPath, partition string) (map[string]interface{}, error) {
+	deviceName, itemPath, err := cleanQuarantinePath(deviceName, reconType, itemPath)
+	if err != nil {
+		return nil, err
+	}
+	if reconType != "accounts" && reconType != "containers" {
+		return nil, fmt.Errorf("only accounts and containers can be restored in place, not %q", reconType)
+	}
+	if _, err := strconv.ParseUint(partition, 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid partition given: %q", partition)
+	}
+	hash := strings.SplitN(itemPath, "-", 2)[0]
+	if len(hash) != 32 || strings.Contains(itemPath, "/") {
+		return nil, fmt.Errorf("invalid item path given: %q", itemPath)
+	}
+	fromPath := filepath.Join(driveRoot, deviceName, "quarantined", reconType, itemPath)
+	toPath := filepath.Join(driveRoot, deviceName, reconType, partition, hash[29:32], hash)
+	if _, err := os.Stat(fromPath); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(toPath); err == nil {
+		return nil, &os.PathError{Op: "restore", Path: toPath, Err: os.ErrExist}
+	}
+	if err := os.MkdirAll(filepath.Dir(toPath), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(fromPath, toPath); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"message": "restore complete",
+		"path":    toPath,
+	}, nil
+}
+
 func diskUsage(driveRoot string, mountCheck bool) ([]map[string]interface{}, error) {
 	devices := make([]map[string]interface{}, 0)
 	dirInfo, err := os.Stat(driveRoot)
@@ -578,6 +694,60 @@ func diskUsage(driveRoot string, mountCheck bool) ([]map[string]interface{}, err
 	return devices, nil
 }
 
+// These are variables so tests can point them at files of their own.
+var (
+	procMountsPath = "/proc/mounts"
+	sysBlockPath   = "/sys/class/block"
+)
+
+// driveErrors returns the kernel's count of I/O errors on the disk each of
+// driveRoot's devices is mounted from, so andrewd can spot failing disks
+// before they stop working altogether. Devices whose disk can't be found,
+// like ones that aren't mounted, are left out.
+func driveErrors(driveRoot string) (map[string]int64, error) {
+	data, err := ioutil.ReadFile(procMountsPath)
+	if err != nil {
+		return nil, err
+	}
+	sources := map[string]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) >= 2 {
+			sources[fields[1]] = fields[0]
+		}
+	}
+	fileInfo, err := ioutil.ReadDir(driveRoot)
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int64{}
+	for _, info := range fileInfo {
+		source, ok := sources[filepath.Join(driveRoot, info.Name())]
+		if !ok || !strings.HasPrefix(source, "/") {
+			continue
+		}
+		// Sources like /dev/disk/by-label/x are links to the disk.
+		if resolved, err := filepath.EvalSymlinks(source); err == nil {
+			source = resolved
+		}
+		block, err := filepath.EvalSymlinks(filepath.Join(sysBlockPath, filepath.Base(source)))
+		if err != nil {
+			continue
+		}
+		// A partition's errors are counted on the disk it's part of.
+		if _, err := os.Stat(filepath.Join(block, "partition")); err == nil {
+			block = filepath.Dir(block)
+		}
+		count, err := ioutil.ReadFile(filepath.Join(block, "device", "ioerr_cnt"))
+		if err != nil {
+			continue
+		}
+		if n, err := strconv.ParseInt(strings.TrimSpace(string(count)), 0, 64); err == nil {
+			counts[info.Name()] = n
+		}
+	}
+	return counts, nil
+}
+
 func ReconHandler(driveRoot string, reconCachePath string, mountCheck bool, writer http.ResponseWriter, request *http.Request) {
 	var content interface{} = nil
 
@@ -639,7 +809,21 @@ func ReconHandler(driveRoot string, reconCachePath string, mountCheck bool, writ
 			return
 		}
 	case "expirer":
-		content, err = fromReconCache(reconCachePath, "object", "object_expiration_pass", "expired_last_pass")
+		content, err = fromReconCache(reconCachePath, "object", "object_expiration_pass", "expired_last_pass", "expirer_failures")
+		if err != nil {
+			srv.SimpleErrorResponse(writer, http.StatusInternalServerError, err.Error())
+			return
+		}
+	case "sync":
+		content, err = fromReconCache(reconCachePath, "container", "container_sync_pass", "container_sync_containers", "container_sync_skipped_containers",
+			"container_sync_puts", "container_sync_deletes", "container_sync_skips", "container_sync_failures")
+		if err != nil {
+			srv.SimpleErrorResponse(writer, http.StatusInternalServerError, err.Error())
+			return
+		}
+	case "reaper":
+		content, err = fromReconCache(reconCachePath, "account", "account_reaper_accounts", "account_reaper_containers", "account_reaper_objects",
+			"account_reaper_failures", "account_reaper_account", "account_reaper_last")
 		if err != nil {
 			srv.SimpleErrorResponse(writer, http.StatusInternalServerError, err.Error())
 			return
@@ -687,9 +871,25 @@ func ReconHandler(driveRoot string, reconCachePath string, mountCheck bool, writ
 			return
 		}
 	case "quarantined":
-		if request.Method == "DELETE" {
-			content, err = quarantineDelete(driveRoot, vars["device"], vars["recon_type"], vars["item_path"])
-		} else {
+		switch {
+		case request.Method == "DELETE":
+			if _, err = quarantineDelete(driveRoot, vars["device"], vars["recon_type"], vars["item_path"]); err == nil {
+				srv.StandardResponse(writer, http.StatusNoContent)
+				return
+			}
+		case request.Method == "PUT":
+			content, err = quarantineRestore(driveRoot, vars["device"], vars["recon_type"], vars["item_path"], request.URL.Query().Get("partition"))
+			if os.IsNotExist(err) {
+				srv.StandardResponse(writer, http.StatusNotFound)
+				return
+			} else if os.IsExist(err) {
+				srv.SimpleErrorResponse(writer, http.StatusConflict, err.Error())
+				return
+			}
+		case vars["device"] != "":
+			serveQuarantined(writer, request, driveRoot, vars["device"], vars["recon_type"], vars["item_path"])
+			return
+		default:
 			content, err = quarantineCounts(driveRoot)
 		}
 		if err != nil {
@@ -725,6 +925,12 @@ func ReconHandler(driveRoot string, reconCachePath string, mountCheck bool, writ
 		content = float64(time.Now().UnixNano()) / float64(time.Second)
 	case "hummingbirdtime":
 		content = map[string]time.Time{"time": time.Now()}
+	case "driveerrors":
+		content, err = driveErrors(driveRoot)
+		if err != nil {
+			srv.SimpleErrorResponse(writer, http.StatusInternalServerError, err.Error())
+			return
+		}
 	case "driveaudit":
 		content, err = fromReconCache(reconCachePath, "drive", "drive_audit_errors")
 		if err != nil {
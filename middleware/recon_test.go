@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"path/filepath"
@@ -398,3 +399,84 @@ func TestQuarantineDeleteAndQuarantineHistoryDelete(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestDriveErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func(m, b string) { procMountsPath, sysBlockPath = m, b }(procMountsPath, sysBlockPath)
+	procMountsPath = filepath.Join(dir, "mounts")
+	sysBlockPath = filepath.Join(dir, "class", "block")
+	driveRoot := filepath.Join(dir, "srv")
+	for _, d := range []string{"srv/d1", "srv/d2", "srv/d3", "class/block", "devices/sdb/sdb1", "devices/sdc/device", "devices/sdb/device"} {
+		require.Nil(t, os.MkdirAll(filepath.Join(dir, d), 0755))
+	}
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "devices/sdb/sdb1/partition"), []byte("1\n"), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "devices/sdb/device/ioerr_cnt"), []byte("0x1f\n"), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "devices/sdc/device/ioerr_cnt"), []byte("0x0\n"), 0644))
+	require.Nil(t, os.Symlink(filepath.Join(dir, "devices/sdb/sdb1"), filepath.Join(sysBlockPath, "sdb1")))
+	require.Nil(t, os.Symlink(filepath.Join(dir, "devices/sdc"), filepath.Join(sysBlockPath, "sdc")))
+	mounts := fmt.Sprintf("/dev/sdb1 %s/d1 xfs rw 0 0\n/dev/sdc %s/d2 xfs rw 0 0\nproc /proc proc rw 0 0\n", driveRoot, driveRoot)
+	require.Nil(t, ioutil.WriteFile(procMountsPath, []byte(mounts), 0644))
+
+	counts, err := driveErrors(driveRoot)
+	require.Nil(t, err)
+	require.Equal(t, map[string]int64{"d1": 31, "d2": 0}, counts)
+}
+
+func TestQuarantinedItems(t *testing.T) {
+	driveRoot, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(driveRoot)
+	hash := "ff2d04f90fe4099ce8ecc514bbf514b2"
+	objDir := filepath.Join(driveRoot, "sda/quarantined/objects-1/item")
+	require.Nil(t, os.MkdirAll(objDir, 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(objDir, "item"), []byte("quarantined data"), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(objDir, "item.idbmeta"), []byte(`{"name":"/a/c/o","X-Timestamp":"1500000000.00000","ETag":"abc","Content-Length":"16"}`), 0644))
+	for _, name := range []string{hash + "-1", hash + "-2"} {
+		dbDir := filepath.Join(driveRoot, "sda/quarantined/containers", name)
+		require.Nil(t, os.MkdirAll(dbDir, 0755))
+		require.Nil(t, ioutil.WriteFile(filepath.Join(dbDir, hash+".db"), []byte("database "+name), 0644))
+	}
+	quarantined := time.Unix(1500000000, 0)
+	require.Nil(t, os.Chtimes(objDir, quarantined, quarantined))
+
+	detail, err := quarantineDetail(driveRoot)
+	require.Nil(t, err)
+	entries := detail.(map[string]map[string][]*QuarantineDetailEntry)["objects-1"]["sda"]
+	require.Equal(t, 1, len(entries))
+	require.Equal(t, "/a/c/o", entries[0].NameInURL)
+	require.True(t, quarantined.Equal(entries[0].Time))
+
+	do := func(method, reconType, item, query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/recon/sda/quarantined/"+reconType+"/"+item+query, nil)
+		r = srv.SetVars(r, map[string]string{"device": "sda", "method": "quarantined", "recon_type": reconType, "item_path": item})
+		w := httptest.NewRecorder()
+		ReconHandler(driveRoot, "", false, w, r)
+		return w
+	}
+	w := do("GET", "objects-1", "item", "")
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "quarantined data", w.Body.String())
+	require.Equal(t, "/a/c/o", w.Header().Get("X-Backend-Quarantined-Name"))
+	require.Equal(t, "1500000000.00000", w.Header().Get("X-Timestamp"))
+	require.Equal(t, "abc", w.Header().Get("Etag"))
+	w = do("GET", "containers", hash+"-1", "")
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "database "+hash+"-1", w.Body.String())
+	require.Equal(t, 404, do("GET", "objects-1", "missing", "").Code)
+	require.Equal(t, 400, do("GET", "nothings", "item", "").Code)
+
+	require.Equal(t, 500, do("PUT", "objects-1", "item", "?partition=5").Code)
+	require.Equal(t, 500, do("PUT", "containers", hash+"-1", "").Code)
+	require.Equal(t, 200, do("PUT", "containers", hash+"-1", "?partition=5").Code)
+	data, err := ioutil.ReadFile(filepath.Join(driveRoot, "sda/containers/5", hash[29:], hash, hash+".db"))
+	require.Nil(t, err)
+	require.Equal(t, "database "+hash+"-1", string(data))
+	require.Equal(t, 409, do("PUT", "containers", hash+"-2", "?partition=5").Code)
+	require.Equal(t, 404, do("PUT", "containers", hash+"-1", "?partition=5").Code)
+
+	require.Equal(t, 204, do("DELETE", "objects-1", "item", "").Code)
+	_, err = os.Stat(filepath.Join(driveRoot, "sda/quarantined-history/objects-1/item"))
+	require.Nil(t, err)
+}
@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/srv"
+)
+
+// BackendSignature rejects requests that could change anything unless
+// they're signed with one of keys, so only the cluster's own servers and
+// tools can write to a storage server, its operational endpoints included.
+// Reads are let through either way, and with no keys so is everything.
+func BackendSignature(keys [][]byte) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(keys) == 0 {
+			return next
+		}
+		nonces := common.NewBackendNonces()
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			switch request.Method {
+			case "GET", "HEAD", "OPTIONS":
+				next.ServeHTTP(writer, request)
+				return
+			}
+			if !common.VerifyBackendSignature(request, keys, nonces) {
+				srv.SimpleErrorResponse(writer, http.StatusForbidden, "Invalid or missing backend signature")
+				return
+			}
+			next.ServeHTTP(writer, request)
+		})
+	}
+}
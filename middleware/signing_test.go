@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+)
+
+func TestBackendSignature(t *testing.T) {
+	handler := BackendSignature([][]byte{[]byte("new"), []byte("old")})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+	do := func(keys [][]byte, method, path string, header http.Header) int {
+		req, err := http.NewRequest(method, ts.URL+path, nil)
+		require.Nil(t, err)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		client := &http.Client{Transport: common.NewSigningTransport(&http.Transport{}, keys)}
+		resp, err := client.Do(req)
+		require.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	require.Equal(t, 403, do(nil, "PUT", "/sda/1/a/c/o", nil))
+	require.Equal(t, 201, do([][]byte{[]byte("new")}, "PUT", "/sda/1/a/c/o", nil))
+	// Keys being rotated out are still accepted.
+	require.Equal(t, 201, do([][]byte{[]byte("old"), []byte("new")}, "DELETE", "/sda/1/a/c/o", nil))
+	require.Equal(t, 403, do([][]byte{[]byte("other")}, "PUT", "/sda/1/a/c/o", nil))
+	// Reads don't need signing, but the operational endpoints' writes do.
+	require.Equal(t, 201, do(nil, "GET", "/sda/1/a/c/o", nil))
+	require.Equal(t, 201, do(nil, "GET", "/recon/quarantineddetail", nil))
+	require.Equal(t, 403, do(nil, "PUT", "/ring/object.ring.gz", nil))
+	require.Equal(t, 403, do(nil, "DELETE", "/recon/sda/quarantined/objects/x", nil))
+	require.Equal(t, 201, do([][]byte{[]byte("new")}, "PUT", "/loglevel", nil))
+
+	// A signature can't be moved to another path or host, have what it covers
+	// changed, be replayed, or be used long after.
+	sign := func(method, path string, timestamp int64, header http.Header) string {
+		req, err := http.NewRequest(method, ts.URL+path, nil)
+		require.Nil(t, err)
+		req.Header = header
+		return fmt.Sprintf("%d:nonce%d:%s", timestamp, len(header), common.BackendSignature([]byte("new"), req, timestamp, fmt.Sprintf("nonce%d", len(header))))
+	}
+	now := time.Now().Unix()
+	header := http.Header{"X-Timestamp": {"1500000000.00000"}, "X-Backend-Storage-Policy-Index": {"1"}}
+	sig := sign("PUT", "/sda/1/a/c/o", now, header)
+	withSig := func(extra map[string]string) http.Header {
+		h := http.Header{common.BackendSignatureHeader: {sig}}
+		for k, v := range header {
+			h[k] = v
+		}
+		for k, v := range extra {
+			h.Set(k, v)
+		}
+		return h
+	}
+	require.Equal(t, 403, do(nil, "PUT", "/sda/1/a/c/o2", withSig(nil)))
+	require.Equal(t, 403, do(nil, "POST", "/sda/1/a/c/o", withSig(nil)))
+	require.Equal(t, 403, do(nil, "PUT", "/sda/1/a/c/o", withSig(map[string]string{"X-Timestamp": "1600000000.00000"})))
+	require.Equal(t, 403, do(nil, "PUT", "/sda/1/a/c/o", withSig(map[string]string{"X-Backend-Storage-Policy-Index": "2"})))
+	require.Equal(t, 403, do(nil, "PUT", "/sda/1/a/c/o", withSig(map[string]string{"X-Backend-Other": "x"})))
+	require.Equal(t, 403, do(nil, "PUT", "/sda/1/a/c/o", withSig(map[string]string{"Etag": "abc"})))
+	require.Equal(t, 201, do(nil, "PUT", "/sda/1/a/c/o", withSig(nil)))
+	require.Equal(t, 403, do(nil, "PUT", "/sda/1/a/c/o", withSig(nil)))
+	hostReq, err := http.NewRequest("PUT", ts.URL+"/sda/1/a/c/o", nil)
+	require.Nil(t, err)
+	hostReq.Host = "elsewhere:6000"
+	common.SignBackendRequest(hostReq, []byte("new"))
+	require.Equal(t, 403, do(nil, "PUT", "/sda/1/a/c/o", http.Header{common.BackendSignatureHeader: hostReq.Header[common.BackendSignatureHeader]}))
+	sig = sign("PUT", "/sda/1/a/c/o", now-300, http.Header{})
+	require.Equal(t, 403, do(nil, "PUT", "/sda/1/a/c/o", http.Header{common.BackendSignatureHeader: {sig}}))
+
+	// With no keys, nothing is checked.
+	handler = BackendSignature(nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("PUT", "/sda/1/a/c/o", nil))
+	require.Equal(t, 200, w.Code)
+}
@@ -16,8 +16,10 @@
 package middleware
 
 import (
+	"context"
 	"net/http"
 
+	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/srv"
 )
 
@@ -26,6 +28,16 @@ func ValidateRequest(next http.Handler) http.Handler {
 		if !srv.ValidateRequest(writer, request) {
 			return
 		}
+		// Requests made for a client request have no longer than it does.
+		if budget, ok := common.RequestBudget(request.Header); ok {
+			if budget <= 0 {
+				srv.SimpleErrorResponse(writer, http.StatusRequestTimeout, "Client deadline exceeded")
+				return
+			}
+			ctx, cancel := context.WithTimeout(request.Context(), budget)
+			defer cancel()
+			request = request.WithContext(ctx)
+		}
 		next.ServeHTTP(writer, request)
 	}
 	return http.HandlerFunc(fn)
@@ -36,6 +36,7 @@ import (
 	"github.com/troubling/hummingbird/common/ring"
 	"github.com/troubling/hummingbird/common/srv"
 	"github.com/troubling/hummingbird/middleware"
+	"github.com/uber-go/tally"
 	"go.uber.org/zap"
 )
 
@@ -57,6 +58,8 @@ type AuditorDaemon struct {
 	reconCachePath    string
 	hashPathPrefix    string
 	hashPathSuffix    string
+	// metricsScope is where the auditors count what they do, if it's set.
+	metricsScope tally.Scope
 }
 
 // Auditor keeps track of general audit data.
@@ -70,6 +73,32 @@ type Auditor struct {
 	bytesProcessed, totalBytes    int64
 	quarantines, totalQuarantines int64
 	errors, totalErrors           int64
+	// progress is how far through each device's IndexDBs this pass has got,
+	// keyed by <device>/<policy dir>.
+	progress map[string]interface{}
+
+	passesMetric         tally.Counter
+	bytesProcessedMetric tally.Counter
+	quarantinesMetric    tally.Counter
+	errorsMetric         tally.Counter
+}
+
+func newAuditor(d *AuditorDaemon, auditorType, mode string, filesPerSecond int64) *Auditor {
+	metricsScope := d.metricsScope
+	if metricsScope == nil {
+		metricsScope = tally.NoopScope
+	}
+	name := strings.ToLower(auditorType)
+	return &Auditor{
+		AuditorDaemon:        d,
+		auditorType:          auditorType,
+		mode:                 mode,
+		filesPerSecond:       filesPerSecond,
+		passesMetric:         metricsScope.Counter(fmt.Sprintf("auditor_%s_passes", name)),
+		bytesProcessedMetric: metricsScope.Counter(fmt.Sprintf("auditor_%s_bytes_processed", name)),
+		quarantinesMetric:    metricsScope.Counter(fmt.Sprintf("auditor_%s_quarantines", name)),
+		errorsMetric:         metricsScope.Counter(fmt.Sprintf("auditor_%s_errors", name)),
+	}
 }
 
 func slowCopyMd5(file *os.File, bps int64) (int64, string, error) {
@@ -95,6 +124,15 @@ type IndexDBAuditor interface {
 	AuditItem(path string, item *IndexDBItem, md5BytesPerSec int64) (int64, error)
 }
 
+var idbAuditorFactories = map[string]IndexDBAuditor{}
+
+// RegisterIndexDBAuditor lets the auditor check policies of an engine type
+// not built into hummingbird, such as one loaded from a plugin, that keeps
+// its objects in an IndexDB named <engine type>.db.
+func RegisterIndexDBAuditor(engineName string, auditor IndexDBAuditor) {
+	idbAuditorFactories[engineName] = auditor
+}
+
 type ecAuditor struct{}
 
 func (ecAuditor) AuditItem(path string, item *IndexDBItem, md5BytesPerSec int64) (int64, error) {
@@ -206,11 +244,27 @@ func (repAuditor) AuditItem(path string, item *IndexDBItem, md5BytesPerSec int64
 	return 0, nil
 }
 
+// tierAuditor audits tiered policies the same as rep ones, except for items
+// whose contents have moved to the remote tier and have no local file.
+type tierAuditor struct{}
+
+func (tierAuditor) AuditItem(path string, item *IndexDBItem, md5BytesPerSec int64) (int64, error) {
+	if item.Tiered {
+		return 0, nil
+	}
+	return repAuditor{}.AuditItem(path, item, md5BytesPerSec)
+}
+
 func QuarantineItem(db *IndexDB, item *IndexDBItem) error {
 	itemPath, err := db.WholeObjectPath(item.Hash, item.Shard, item.Timestamp, item.Nursery)
 	if err != nil {
 		return err
 	}
+	// The metadata is kept with the quarantined file, so it has to be read
+	// before the row goes.
+	if err = db.LoadMetadata(item); err != nil {
+		return err
+	}
 	itemName := filepath.Base(itemPath)
 	objsDir := filepath.Dir(filepath.Dir(filepath.Dir(itemPath)))
 	driveDir := filepath.Dir(objsDir)
@@ -340,6 +394,18 @@ func (a *Auditor) isOverwritten(db *IndexDB, item *IndexDBItem) (bool, error) {
 	return false, nil
 }
 
+// hashProgress is roughly what percentage of the hash space lies before hsh.
+func hashProgress(hsh string) float64 {
+	if len(hsh) < 8 {
+		return 0
+	}
+	prefix, err := strconv.ParseUint(hsh[:8], 16, 32)
+	if err != nil {
+		return 0
+	}
+	return float64(prefix) * 100 / (1 << 32)
+}
+
 // auditDB.  Runs auditFunc on all objects in the given DB.
 func (a *Auditor) auditDB(devPath string, objRing ring.Ring, policy *conf.Policy) {
 	dbpath := filepath.Join(devPath, PolicyDir(policy.Index), fmt.Sprintf("%s.db", policy.Type))
@@ -349,6 +415,7 @@ func (a *Auditor) auditDB(devPath string, objRing ring.Ring, policy *conf.Policy
 	} else if err != nil {
 		a.errors++
 		a.totalErrors++
+		a.errorsMetric.Inc(1)
 		a.logger.Error("Couldn't open indexdb", zap.String("dbBasePath", dbpath), zap.Error(err))
 		return
 	}
@@ -375,15 +442,20 @@ func (a *Auditor) auditDB(devPath string, objRing ring.Ring, policy *conf.Policy
 		a.logger.Error("No auditor set policy", zap.String("policy-type", policy.Type), zap.Int("policy-index", policy.Index))
 		return
 	}
-	db, err := NewIndexDB(dbpath, path, temppath, ringPartPower, int(dbPartPower), subdirs, 0, zapLogger, a.idbAuditors[policy.Index])
+	db, err := NewIndexDB(dbpath, path, temppath, ringPartPower, int(dbPartPower), subdirs, 0, 0, zapLogger, a.idbAuditors[policy.Index])
 	if err != nil {
 		a.errors++
 		a.totalErrors++
+		a.errorsMetric.Inc(1)
 		a.logger.Error("Couldn't open indexdb", zap.String("dbBasePath", dbpath), zap.Error(err))
 		return
 	}
 	defer db.Close()
 
+	if a.progress == nil {
+		a.progress = map[string]interface{}{}
+	}
+	progressKey := filepath.Base(devPath) + "/" + PolicyDir(policy.Index)
 	marker := ""
 	for {
 		items, err := db.List("", "", marker, 1000)
@@ -392,14 +464,25 @@ func (a *Auditor) auditDB(devPath string, objRing ring.Ring, policy *conf.Policy
 			return
 		}
 		for _, item := range items {
+			if item.Deletion || (item.Expires != nil && *item.Expires <= time.Now().Unix()) {
+				// Nothing to check: tombstones have no contents, and expired
+				// objects are left for the replicator to reclaim.
+				continue
+			}
 			itemPath, err := db.WholeObjectPath(item.Hash, item.Shard, item.Timestamp, item.Nursery)
 			if err != nil {
 				a.logger.Error("Error getting indexdb path for hash",
 					zap.String("hash", item.Hash), zap.Error(err))
 				continue
 			}
+			if err = db.LoadMetadata(item); err != nil {
+				a.logger.Error("Error loading indexdb metadata for hash",
+					zap.String("hash", item.Hash), zap.Error(err))
+				continue
+			}
 			a.passes++
 			a.totalPasses++
+			a.passesMetric.Inc(1)
 			var bytesPerSecond int64
 			if a.auditorType != "ZBF" {
 				bytesPerSecond = a.bytesPerSecond
@@ -416,10 +499,12 @@ func (a *Auditor) auditDB(devPath string, objRing ring.Ring, policy *conf.Policy
 					}
 					a.quarantines++
 					a.totalQuarantines++
+					a.quarantinesMetric.Inc(1)
 				}
 			}
 			a.bytesProcessed += bytes
 			a.totalBytes += bytes
+			a.bytesProcessedMetric.Inc(bytes)
 			rateLimitSleep(a.passStart, a.totalPasses, a.filesPerSecond)
 			rateLimitSleep(a.passStart, a.totalBytes, a.bytesPerSecond)
 
@@ -428,9 +513,11 @@ func (a *Auditor) auditDB(devPath string, objRing ring.Ring, policy *conf.Policy
 			}
 		}
 		if len(items) == 0 {
+			a.progress[progressKey] = map[string]interface{}{"percent_complete": 100.0, "completed": true}
 			return
 		}
 		marker = items[len(items)-1].Hash
+		a.progress[progressKey] = map[string]interface{}{"percent_complete": hashProgress(marker), "completed": false}
 	}
 }
 
@@ -440,6 +527,7 @@ func (a *Auditor) auditSuffix(suffixDir string) {
 	if err != nil {
 		a.errors++
 		a.totalErrors++
+		a.errorsMetric.Inc(1)
 		a.logger.Error("Error reading suffix dir", zap.String("suffixDir", suffixDir), zap.Error(err))
 		return
 	}
@@ -452,6 +540,7 @@ func (a *Auditor) auditSuffix(suffixDir string) {
 		}
 		a.passes++
 		a.totalPasses++
+		a.passesMetric.Inc(1)
 		var bps int64
 		if a.auditorType != "ZBF" {
 			bps = a.bytesPerSecond
@@ -459,6 +548,7 @@ func (a *Auditor) auditSuffix(suffixDir string) {
 		bytesProcessed, err := auditHash(hashDir, bps)
 		a.bytesProcessed += bytesProcessed
 		a.totalBytes += bytesProcessed
+		a.bytesProcessedMetric.Inc(bytesProcessed)
 		rateLimitSleep(a.passStart, a.totalPasses, a.filesPerSecond)
 		rateLimitSleep(a.passStart, a.totalBytes, a.bytesPerSecond)
 		if err == expiredObject {
@@ -472,6 +562,7 @@ func (a *Auditor) auditSuffix(suffixDir string) {
 			InvalidateHash(hashDir)
 			a.quarantines++
 			a.totalQuarantines++
+			a.quarantinesMetric.Inc(1)
 		}
 	}
 }
@@ -482,6 +573,7 @@ func (a *Auditor) auditPartition(partitionDir string) {
 	if err != nil {
 		a.errors++
 		a.totalErrors++
+		a.errorsMetric.Inc(1)
 		a.logger.Error("Error reading partition dir ", zap.String("partitionDir", partitionDir), zap.Error(err))
 		return
 	}
@@ -519,6 +611,7 @@ func (a *Auditor) auditDevice(devPath string) {
 				if !os.IsNotExist(err) {
 					a.errors++
 					a.totalErrors++
+					a.errorsMetric.Inc(1)
 					a.logger.Error("Error reading objects dir", zap.String("objPath", objPath), zap.Error(err))
 				}
 				continue
@@ -567,12 +660,13 @@ func (a *Auditor) statsReport() {
 
 	middleware.DumpReconCache(a.reconCachePath, "object",
 		map[string]interface{}{"object_auditor_stats_" + a.auditorType: map[string]interface{}{
-			"errors":          a.errors,
-			"passes":          a.passes,
-			"quarantined":     a.quarantines,
-			"bytes_processed": a.bytesProcessed,
-			"start_time":      float64(a.passStart.UnixNano()) / float64(time.Second), //???
-			"audit_time":      audit,
+			"errors":           a.errors,
+			"passes":           a.passes,
+			"quarantined":      a.quarantines,
+			"bytes_processed":  a.bytesProcessed,
+			"start_time":       float64(a.passStart.UnixNano()) / float64(time.Second), //???
+			"audit_time":       audit,
+			"indexdb_progress": a.progress,
 		}})
 	a.passes = 0
 	a.quarantines = 0
@@ -588,6 +682,10 @@ func (a *Auditor) finalLog() {
 	brate := float64(a.totalBytes) / elapsed
 	audit := 0.0      // TODO maybe
 	audit_rate := 0.0 // TODO maybe
+	middleware.DumpReconCache(a.reconCachePath, "object",
+		map[string]interface{}{"object_auditor_stats_" + a.auditorType: map[string]interface{}{
+			"indexdb_progress": a.progress,
+		}})
 	a.logger.Info("Object Audit",
 		zap.String("Auditor type", a.auditorType),
 		zap.String("Mode", a.mode),
@@ -613,6 +711,7 @@ func (a *Auditor) run(c <-chan time.Time) {
 		a.totalBytes = 0
 		a.totalQuarantines = 0
 		a.totalErrors = 0
+		a.progress = map[string]interface{}{}
 		a.logger.Info("Begin object audit",
 			zap.String("mode", a.mode),
 			zap.String("auditorType", a.auditorType),
@@ -635,12 +734,12 @@ func (d *AuditorDaemon) Run() {
 	if d.zbFilesPerSecond > 0 {
 		wg.Add(1)
 		go func() {
-			zba := Auditor{AuditorDaemon: d, auditorType: "ZBF", mode: "once", filesPerSecond: d.zbFilesPerSecond}
+			zba := newAuditor(d, "ZBF", "once", d.zbFilesPerSecond)
 			zba.run(OneTimeChan())
 			wg.Done()
 		}()
 	}
-	reg := Auditor{AuditorDaemon: d, auditorType: "ALL", mode: "once", filesPerSecond: d.regFilesPerSecond}
+	reg := newAuditor(d, "ALL", "once", d.regFilesPerSecond)
 	reg.run(OneTimeChan())
 	wg.Wait()
 }
@@ -648,10 +747,10 @@ func (d *AuditorDaemon) Run() {
 // RunForever triggering audit passes every time AuditForeverInterval has passed.
 func (d *AuditorDaemon) RunForever() {
 	if d.zbFilesPerSecond > 0 {
-		zba := Auditor{AuditorDaemon: d, auditorType: "ZBF", mode: "forever", filesPerSecond: d.zbFilesPerSecond}
+		zba := newAuditor(d, "ZBF", "forever", d.zbFilesPerSecond)
 		go zba.run(time.Tick(AuditForeverInterval))
 	}
-	reg := Auditor{AuditorDaemon: d, auditorType: "ALL", mode: "forever", filesPerSecond: d.regFilesPerSecond}
+	reg := newAuditor(d, "ALL", "forever", d.regFilesPerSecond)
 	reg.run(time.Tick(AuditForeverInterval))
 }
 
@@ -665,6 +764,9 @@ func NewAuditorDaemon(serverconf conf.Config, flags *flag.FlagSet, cnf srv.Confi
 	if d.policies, err = cnf.GetPolicies(); err != nil {
 		return nil, err
 	}
+	if err = LoadEnginePlugins(serverconf.GetDefault("app:object-server", "engine_plugins", "")); err != nil {
+		return nil, err
+	}
 	d.idbAuditors = map[int]IndexDBAuditor{}
 	for _, policy := range d.policies {
 		switch policy.Type {
@@ -672,6 +774,12 @@ func NewAuditorDaemon(serverconf conf.Config, flags *flag.FlagSet, cnf srv.Confi
 			d.idbAuditors[policy.Index] = ecAuditor{}
 		case "rep":
 			d.idbAuditors[policy.Index] = repAuditor{}
+		case "tiered":
+			d.idbAuditors[policy.Index] = tierAuditor{}
+		default:
+			if auditor, ok := idbAuditorFactories[policy.Type]; ok {
+				d.idbAuditors[policy.Index] = auditor
+			}
 		}
 	}
 	d.hashPathPrefix, d.hashPathSuffix, err = cnf.GetHashPrefixAndSuffix()
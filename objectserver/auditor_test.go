@@ -236,7 +236,7 @@ func makeAuditor(t *testing.T, confLoader *srv.TestConfigLoader, settings ...str
 	require.Nil(t, err)
 	obs, logs = observer.New(zap.InfoLevel)
 	auditorDaemon.logger = zap.New(obs)
-	a := &Auditor{AuditorDaemon: auditorDaemon, filesPerSecond: 1}
+	a := newAuditor(auditorDaemon, "", "", 1)
 	a.idbAuditors = map[int]IndexDBAuditor{0: ecAuditor{}}
 	return a
 }
@@ -252,6 +252,29 @@ func TestFailsWithoutSection(t *testing.T) {
 	assert.True(t, strings.HasPrefix(err.Error(), "Unable to find object-auditor"))
 }
 
+type pluginAuditor struct{}
+
+func (pluginAuditor) AuditItem(path string, item *IndexDBItem, md5BytesPerSec int64) (int64, error) {
+	return 0, nil
+}
+
+func TestRegisteredIndexDBAuditor(t *testing.T) {
+	RegisterIndexDBAuditor("plugintest", pluginAuditor{})
+	confLoader := srv.NewTestConfigLoader(&test.FakeRing{})
+	confLoader.GetPoliciesFunc = func() (conf.PolicyList, error) {
+		return conf.PolicyList(map[int]*conf.Policy{
+			0: {Index: 0, Type: "hec", Name: "Policy-0"},
+			1: {Index: 1, Type: "plugintest", Name: "Policy-1"},
+			2: {Index: 2, Type: "unknown", Name: "Policy-2"},
+		}), nil
+	}
+	config, err := conf.StringConfig("[object-auditor]\n")
+	require.Nil(t, err)
+	auditorDaemon, err := NewAuditorDaemon(config, &flag.FlagSet{}, confLoader)
+	require.Nil(t, err)
+	require.Equal(t, map[int]IndexDBAuditor{0: ecAuditor{}, 1: pluginAuditor{}}, auditorDaemon.idbAuditors)
+}
+
 func TestAuditSuffixNotDir(t *testing.T) {
 	testRing := &test.FakeRing{}
 	confLoader := srv.NewTestConfigLoader(testRing)
@@ -535,7 +558,7 @@ func TestAuditDB(t *testing.T) {
 	policydir := filepath.Join(dir, "objects-2")
 	dbdir := filepath.Join(policydir, "hec.db")
 	hecdir := filepath.Join(policydir, "hec")
-	db, err := NewIndexDB(dbdir, hecdir, dir, 2, 1, 32, 0, zap.L(), fakeIndexDBAuditor{})
+	db, err := NewIndexDB(dbdir, hecdir, dir, 2, 1, 32, 0, 0, zap.L(), fakeIndexDBAuditor{})
 	assert.Nil(t, err)
 	body := "some shard content nonsense"
 	shardHash := "d3ac5112fe464b81184352ccba743001"
@@ -569,6 +592,15 @@ func TestAuditDB(t *testing.T) {
 	assert.Nil(t, err)
 	nurseryPath, err := db.WholeObjectPath(hash3, 0, timestamp, true)
 	assert.Nil(t, err)
+	// And a tombstone and an expired object, which have nothing to audit.
+	err = db.Commit(nil, "00000000000000000000000000000004", 0, timestamp, "DELETE", map[string]string{}, false, "")
+	assert.Nil(t, err)
+	hash5 := "00000000000000000000000000000005"
+	f, err = db.TempFile(hash5, 0, timestamp, int64(len(body)), false)
+	assert.Nil(t, err)
+	f.Write([]byte(body))
+	err = db.Commit(f, hash5, 0, timestamp, "PUT", map[string]string{"X-Delete-At": "12345"}, false, shardHash)
+	assert.Nil(t, err)
 
 	// Policy 2 is hec.
 	auditor.auditDB(dir, testRing, policies[2])
@@ -578,6 +610,13 @@ func TestAuditDB(t *testing.T) {
 	require.Equal(t, shardHash, fake.shards[0])
 	require.Equal(t, 1, len(fake.nurseryPaths))
 	require.Equal(t, nurseryPath, fake.nurseryPaths[0])
+	require.Equal(t, map[string]interface{}{"percent_complete": 100.0, "completed": true}, auditor.progress[filepath.Base(dir)+"/objects-2"])
+}
+
+func TestHashProgress(t *testing.T) {
+	require.Equal(t, 0.0, hashProgress("00000000000000000000000000000000"))
+	require.Equal(t, 50.0, hashProgress("80000000000000000000000000000000"))
+	require.Equal(t, 0.0, hashProgress("nothex"))
 }
 
 func TestAuditShardPasses(t *testing.T) {
@@ -696,7 +735,7 @@ func TestQuarantineShard(t *testing.T) {
 	policydir := filepath.Join(dir, "objects")
 	dbdir := filepath.Join(policydir, "hec.db")
 	hecdir := filepath.Join(policydir, "hec")
-	db, err := NewIndexDB(dbdir, hecdir, dir, 2, 1, 32, 0, zap.L(), fakeIndexDBAuditor{})
+	db, err := NewIndexDB(dbdir, hecdir, dir, 2, 1, 32, 0, 0, zap.L(), fakeIndexDBAuditor{})
 	timestamp := time.Now().UnixNano()
 	hash := "00000000000000000000000000000000"
 	body := "nonsense"
@@ -0,0 +1,340 @@
+package objectserver
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/fs"
+	"go.uber.org/zap"
+)
+
+// burninMaxErrors is how many error messages a device's report keeps; any
+// more are only counted.
+const burninMaxErrors = 10
+
+// BurninReport is the result of burning in one device.
+type BurninReport struct {
+	Device       string   `json:"device"`
+	Pass         bool     `json:"pass"`
+	BytesWritten int64    `json:"bytes_written"`
+	BytesRead    int64    `json:"bytes_read"`
+	Files        int64    `json:"files"`
+	Objects      int64    `json:"objects"`
+	WriteRate    float64  `json:"write_bytes_per_second"`
+	MaxLatency   float64  `json:"max_latency_seconds"`
+	ErrorCount   int64    `json:"error_count"`
+	Errors       []string `json:"errors,omitempty"`
+
+	lock sync.Mutex
+}
+
+func (br *BurninReport) fail(format string, args ...interface{}) {
+	br.lock.Lock()
+	defer br.lock.Unlock()
+	br.ErrorCount++
+	if len(br.Errors) < burninMaxErrors {
+		br.Errors = append(br.Errors, fmt.Sprintf(format, args...))
+	}
+}
+
+func (br *BurninReport) add(written, read, files, objects int64, latency time.Duration) {
+	br.lock.Lock()
+	defer br.lock.Unlock()
+	br.BytesWritten += written
+	br.BytesRead += read
+	br.Files += files
+	br.Objects += objects
+	if latency.Seconds() > br.MaxLatency {
+		br.MaxLatency = latency.Seconds()
+	}
+}
+
+// burnin exercises devices with writes of fixed patterns that are read back
+// and verified, alongside commits to a scratch IndexDB that are looked up
+// and checked, for long enough to shake out bad disks before a node joins
+// the ring. Everything it writes goes under the device's tmp directory and
+// is removed afterwards.
+type burnin struct {
+	driveRoot   string
+	size        int64
+	concurrency int
+	duration    time.Duration
+	checkMounts bool
+}
+
+// burninPatterns returns the contents to write, one buffer of size bytes per
+// pattern: all zeros, all ones, alternating bits and pseudo-random bytes.
+func burninPatterns(size int64, seed int64) [][]byte {
+	zeros := make([]byte, size)
+	ones := bytes.Repeat([]byte{0xff}, int(size))
+	alternating := bytes.Repeat([]byte{0x55, 0xaa}, int(size+1)/2)[:size]
+	random := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(random)
+	return [][]byte{zeros, ones, alternating, random}
+}
+
+// readUncached reads pth after dropping it from the page cache, so what's
+// read comes from the disk rather than memory.
+func readUncached(pth string) ([]byte, error) {
+	f, err := os.Open(pth)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err = f.Sync(); err != nil {
+		return nil, err
+	}
+	if err = fs.DropCache(f); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(f)
+}
+
+// writeVerify writes data to pth, syncs it, reads it back from the disk and
+// compares, then removes the file. It returns how long the write and sync
+// took.
+func (b *burnin) writeVerify(pth string, data []byte) (time.Duration, error) {
+	start := time.Now()
+	f, err := os.OpenFile(pth, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return 0, err
+	}
+	latency := time.Since(start)
+	defer os.Remove(pth)
+	read, err := readUncached(pth)
+	if err != nil {
+		return latency, err
+	}
+	if !bytes.Equal(read, data) {
+		return latency, fmt.Errorf("contents of %s don't match what was written", pth)
+	}
+	return latency, nil
+}
+
+// commitVerify commits data to idb as a new object, checks that a lookup
+// finds it with the right timestamp, metadata and contents, and then removes
+// it again.
+func (b *burnin) commitVerify(idb *IndexDB, name string, data []byte) error {
+	sum := md5.Sum([]byte(name))
+	hsh := hex.EncodeToString(sum[:])
+	now := time.Now()
+	timestamp := now.UnixNano()
+	etag := fmt.Sprintf("%x", md5.Sum(data))
+	atm, err := idb.TempFile(hsh, roShard, timestamp, int64(len(data)), false)
+	if err != nil {
+		return err
+	}
+	if atm == nil {
+		return fmt.Errorf("no temp file for new object %s", hsh)
+	}
+	defer atm.Abandon()
+	if _, err = atm.Write(data); err != nil {
+		return err
+	}
+	metadata := map[string]string{
+		"name":           "/burnin/" + name,
+		"X-Timestamp":    common.CanonicalTimestampFromTime(now),
+		"Content-Length": strconv.Itoa(len(data)),
+		"ETag":           etag,
+	}
+	if err = idb.Commit(atm, hsh, roShard, timestamp, "PUT", metadata, false, ""); err != nil {
+		return err
+	}
+	item, err := idb.Lookup(hsh, roShard, false)
+	if err != nil {
+		return err
+	}
+	if item == nil || item.Timestamp != timestamp {
+		return fmt.Errorf("committed object %s not found", hsh)
+	}
+	if err = idb.LoadMetadata(item); err != nil {
+		return err
+	}
+	var stored map[string]string
+	if err = json.Unmarshal(item.Metabytes, &stored); err != nil {
+		return fmt.Errorf("bad metadata for object %s: %v", hsh, err)
+	}
+	if stored["ETag"] != etag {
+		return fmt.Errorf("object %s has ETag %q, expected %q", hsh, stored["ETag"], etag)
+	}
+	read, err := readUncached(item.Path)
+	if err != nil {
+		return err
+	}
+	if fmt.Sprintf("%x", md5.Sum(read)) != etag {
+		return fmt.Errorf("contents of object %s don't match what was committed", hsh)
+	}
+	if _, err = idb.Remove(hsh, roShard, timestamp, false, item.Metahash); err != nil {
+		return err
+	}
+	if item, err = idb.Lookup(hsh, roShard, false); err != nil {
+		return err
+	} else if item != nil {
+		return fmt.Errorf("removed object %s still found", hsh)
+	}
+	return nil
+}
+
+// device burns in one device, returning its report.
+func (b *burnin) device(device string) *BurninReport {
+	report := &BurninReport{Device: device}
+	if b.checkMounts {
+		if mounted, err := fs.IsMount(filepath.Join(b.driveRoot, device)); err != nil || !mounted {
+			report.fail("device not mounted")
+			return report
+		}
+	}
+	dir := filepath.Join(b.driveRoot, device, "tmp", fmt.Sprintf("burnin-%d", time.Now().UnixNano()))
+	if err := os.MkdirAll(filepath.Join(dir, "files"), 0755); err != nil {
+		report.fail("creating burn-in directory: %v", err)
+		return report
+	}
+	defer os.RemoveAll(dir)
+	idb, err := NewIndexDB(filepath.Join(dir, "index.db"), filepath.Join(dir, "objects"), filepath.Join(dir, "tmp"), 10, 2, 32, 0, 0, zap.NewNop(), repAuditor{})
+	if err != nil {
+		report.fail("creating IndexDB: %v", err)
+		return report
+	}
+	defer idb.Close()
+	start := time.Now()
+	deadline := start.Add(b.duration)
+	wg := sync.WaitGroup{}
+	for w := 0; w < b.concurrency; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			patterns := burninPatterns(b.size, int64(w))
+			for i := 0; i == 0 || time.Now().Before(deadline); i++ {
+				data := patterns[i%len(patterns)]
+				latency, err := b.writeVerify(filepath.Join(dir, "files", fmt.Sprintf("%d-%d", w, i)), data)
+				if err != nil {
+					report.fail("file pattern %d: %v", i%len(patterns), err)
+				} else {
+					report.add(int64(len(data)), int64(len(data)), 1, 0, latency)
+				}
+				if err = b.commitVerify(idb, fmt.Sprintf("%s/%d/%d", device, w, i), data); err != nil {
+					report.fail("engine commit: %v", err)
+				} else {
+					report.add(int64(len(data)), int64(len(data)), 0, 1, 0)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if took := time.Since(start).Seconds(); took > 0 {
+		report.WriteRate = float64(report.BytesWritten) / took
+	}
+	report.Pass = report.ErrorCount == 0
+	return report
+}
+
+// run burns in all the devices at once, so they're loaded together as they
+// will be in service.
+func (b *burnin) run(devices []string) []*BurninReport {
+	reports := make([]*BurninReport, len(devices))
+	wg := sync.WaitGroup{}
+	for i, device := range devices {
+		wg.Add(1)
+		go func(i int, device string) {
+			defer wg.Done()
+			reports[i] = b.device(device)
+		}(i, device)
+	}
+	wg.Wait()
+	return reports
+}
+
+// Burnin runs the burn-in on a node's devices and prints a report, returning
+// whether every device passed.
+func Burnin(args []string) bool {
+	flags := flag.NewFlagSet("burnin", flag.ExitOnError)
+	driveRoot := flags.String("devices", "/srv/node", "Directory the devices are mounted under")
+	duration := flags.Duration("t", 10*time.Minute, "How long to exercise each device")
+	size := flags.Int64("size", 1<<20, "Size in bytes of each write")
+	concurrency := flags.Int("c", 4, "Concurrent writers per device")
+	checkMounts := flags.Bool("mount_check", true, "Fail devices that aren't mount points")
+	jsonOut := flags.Bool("json", false, "Output the report as JSON")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "USAGE: hummingbird burnin [ARGS] [device ...]\n")
+		fmt.Fprintf(os.Stderr, "  if no devices are given, every device under -devices is burned in\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *size <= 0 || *concurrency <= 0 {
+		flags.Usage()
+		return false
+	}
+	devices := flags.Args()
+	if len(devices) == 0 {
+		entries, err := ioutil.ReadDir(*driveRoot)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to list devices:", err)
+			return false
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				devices = append(devices, entry.Name())
+			}
+		}
+	}
+	if len(devices) == 0 {
+		fmt.Fprintln(os.Stderr, "No devices to burn in")
+		return false
+	}
+	sort.Strings(devices)
+	b := &burnin{driveRoot: *driveRoot, size: *size, concurrency: *concurrency, duration: *duration, checkMounts: *checkMounts}
+	reports := b.run(devices)
+	pass := true
+	for _, report := range reports {
+		pass = pass && report.Pass
+	}
+	if *jsonOut {
+		data, err := json.MarshalIndent(map[string]interface{}{"pass": pass, "devices": reports}, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error encoding report:", err)
+			return false
+		}
+		fmt.Println(string(data))
+		return pass
+	}
+	for _, report := range reports {
+		result := "PASS"
+		if !report.Pass {
+			result = "FAIL"
+		}
+		fmt.Printf("%s %s: wrote %d bytes (%.1f MB/s), read %d bytes, %d files, %d objects, max write latency %.3fs, %d errors\n",
+			result, report.Device, report.BytesWritten, report.WriteRate/1e6, report.BytesRead, report.Files, report.Objects,
+			report.MaxLatency, report.ErrorCount)
+		for _, msg := range report.Errors {
+			fmt.Printf("    %s\n", msg)
+		}
+	}
+	if pass {
+		fmt.Printf("Burn-in passed on %d devices\n", len(reports))
+	} else {
+		fmt.Printf("Burn-in FAILED\n")
+	}
+	return pass
+}
@@ -0,0 +1,44 @@
+package objectserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBurninPatterns(t *testing.T) {
+	patterns := burninPatterns(5, 1)
+	require.Equal(t, 4, len(patterns))
+	require.Equal(t, []byte{0, 0, 0, 0, 0}, patterns[0])
+	require.Equal(t, []byte{0xff, 0xff, 0xff, 0xff, 0xff}, patterns[1])
+	require.Equal(t, []byte{0x55, 0xaa, 0x55, 0xaa, 0x55}, patterns[2])
+	require.Equal(t, patterns[3], burninPatterns(5, 1)[3])
+}
+
+func TestBurninDevice(t *testing.T) {
+	driveRoot, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(driveRoot)
+	require.Nil(t, os.MkdirAll(filepath.Join(driveRoot, "sda"), 0755))
+	b := &burnin{driveRoot: driveRoot, size: 4096, concurrency: 2, duration: 50 * time.Millisecond}
+	reports := b.run([]string{"sda"})
+	require.Equal(t, 1, len(reports))
+	report := reports[0]
+	require.True(t, report.Pass, "%v", report.Errors)
+	require.True(t, report.Files > 0)
+	require.Equal(t, report.Files, report.Objects)
+	require.Equal(t, 2*4096*report.Files, report.BytesWritten)
+	// Nothing is left behind on the device.
+	entries, err := ioutil.ReadDir(filepath.Join(driveRoot, "sda", "tmp"))
+	require.Nil(t, err)
+	require.Equal(t, 0, len(entries))
+
+	b.checkMounts = true
+	report = b.device("sda")
+	require.False(t, report.Pass)
+	require.Equal(t, []string{"device not mounted"}, report.Errors)
+}
@@ -0,0 +1,394 @@
+package objectserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/srv"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+)
+
+// drainMarker is the file on a device that marks it as draining, which both
+// the object server and the replicator check, like lock_device.
+const drainMarker = "drain_device"
+
+// drainPassInterval is how long the replicator waits between passes over a
+// draining device once a pass has finished.
+var drainPassInterval = time.Minute
+
+func deviceDraining(driveRoot, device string) bool {
+	return fs.Exists(filepath.Join(driveRoot, device, drainMarker))
+}
+
+// DrainStatus reports a draining device's progress: each pass copies every
+// partition the device is a primary for to a handoff, and every one it holds
+// as a handoff to a primary, and once a pass has done so without any failures
+// the device is safe to remove.
+type DrainStatus struct {
+	Device           string    `json:"device"`
+	Draining         bool      `json:"draining"`
+	Started          time.Time `json:"started"`
+	Passes           int64     `json:"passes"`
+	PartitionsTotal  int64     `json:"partitions_total"`
+	PartitionsDone   int64     `json:"partitions_done"`
+	PartitionsFailed int64     `json:"partitions_failed"`
+	Safe             bool      `json:"safe"`
+}
+
+// priRepRecorder collects the result of a priority replication run on the
+// replicator's behalf, rather than for a client.
+type priRepRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (d *priRepRecorder) Header() http.Header {
+	return d.header
+}
+
+func (d *priRepRecorder) Write(b []byte) (int, error) {
+	if d.status == 0 {
+		d.status = http.StatusOK
+	}
+	return d.body.Write(b)
+}
+
+func (d *priRepRecorder) WriteHeader(status int) {
+	if d.status == 0 {
+		d.status = status
+	}
+}
+
+// ok reports whether the partition was replicated, or wasn't on the device
+// to begin with.
+func (d *priRepRecorder) ok() bool {
+	if d.status == http.StatusNotFound {
+		return true
+	}
+	if d.status/100 != 2 {
+		return false
+	}
+	var prr PriorityReplicationResult
+	return json.Unmarshal(d.body.Bytes(), &prr) == nil && prr.Success
+}
+
+// localPriorityReplicate runs job on the local replication device key,
+// returning whether it succeeded and the status it ended with.
+func (r *Replicator) localPriorityReplicate(key string, job *PriorityRepJob) (bool, int) {
+	r.runningDevicesLock.Lock()
+	rd, ok := r.runningDevices[key]
+	r.runningDevicesLock.Unlock()
+	if !ok {
+		return false, 0
+	}
+	resp := &priRepRecorder{header: http.Header{}}
+	rd.PriorityReplicate(resp, *job)
+	return resp.ok(), resp.status
+}
+
+// drainStatus returns a copy of the device's drain status, or nil if it
+// hasn't been drained since the replicator started.
+func (r *Replicator) drainStatus(device string) *DrainStatus {
+	r.drainsLock.Lock()
+	defer r.drainsLock.Unlock()
+	if status, ok := r.drains[device]; ok {
+		s := *status
+		return &s
+	}
+	return nil
+}
+
+func (r *Replicator) updateDrain(device string, update func(*DrainStatus)) {
+	r.drainsLock.Lock()
+	defer r.drainsLock.Unlock()
+	if status, ok := r.drains[device]; ok {
+		update(status)
+	}
+}
+
+// startDrain starts draining the device, unless that's already under way.
+func (r *Replicator) startDrain(device string) {
+	r.drainsLock.Lock()
+	defer r.drainsLock.Unlock()
+	if status, ok := r.drains[device]; ok && status.Draining {
+		return
+	}
+	r.drains[device] = &DrainStatus{Device: device, Draining: true, Started: time.Now()}
+	go r.drainDevice(device)
+}
+
+// drainDevice makes passes over the device for as long as it's marked as
+// draining.
+func (r *Replicator) drainDevice(device string) {
+	for deviceDraining(r.deviceRoot, device) {
+		r.drainPass(device)
+		time.Sleep(drainPassInterval)
+	}
+	r.updateDrain(device, func(s *DrainStatus) {
+		s.Draining = false
+		s.Safe = false
+	})
+}
+
+// devicePartitions lists the partitions the device has in the policy.
+func (r *Replicator) devicePartitions(device string, policy int) []uint64 {
+	dirs, err := filepath.Glob(filepath.Join(r.deviceRoot, device, PolicyDir(policy), "[0-9]*"))
+	if err != nil {
+		return nil
+	}
+	partitions := make([]uint64, 0, len(dirs))
+	for _, dir := range dirs {
+		if partition, err := strconv.ParseUint(filepath.Base(dir), 10, 64); err == nil {
+			partitions = append(partitions, partition)
+		}
+	}
+	return partitions
+}
+
+// getDrainHandoffJobs creates a job for each of partitions that dev holds as
+// a handoff, pushing it to the first of the partition's primaries off dev's
+// node, or to one on the node if they're all there.
+func getDrainHandoffJobs(theRing ring.Ring, dev *ring.Device, partitions []uint64, policy int) []*PriorityRepJob {
+	jobs := make([]*PriorityRepJob, 0)
+	for _, partition := range partitions {
+		var primary *ring.Device
+		handoff := true
+		for _, node := range theRing.GetNodes(partition) {
+			if node.Id == dev.Id {
+				handoff = false
+				break
+			}
+			if primary == nil || (primary.Ip == dev.Ip && node.Ip != dev.Ip) {
+				primary = node
+			}
+		}
+		if handoff && primary != nil {
+			jobs = append(jobs, &PriorityRepJob{Partition: partition, FromDevice: dev, ToDevice: primary, Policy: policy})
+		}
+	}
+	return jobs
+}
+
+// drainPass copies each of the device's primary partitions, in every policy,
+// to the partition's first handoff off this node, and each partition it
+// holds as a handoff to one of the partition's primaries.
+func (r *Replicator) drainPass(device string) {
+	type drainJob struct {
+		key string
+		job *PriorityRepJob
+	}
+	var jobs []drainJob
+	for policy, oring := range r.objectRings {
+		ringDevices, err := oring.LocalDevices(r.port)
+		if err != nil {
+			r.logger.Error("Error getting local devices from ring", zap.Int("policy", policy), zap.Error(err))
+			continue
+		}
+		for _, dev := range ringDevices {
+			if dev.Device != device {
+				continue
+			}
+			for _, job := range getPrewarmJobs(oring, dev.Ip, device, nil, policy) {
+				jobs = append(jobs, drainJob{key: deviceKeyId(device, policy), job: job})
+			}
+			for _, job := range getDrainHandoffJobs(oring, dev, r.devicePartitions(device, policy), policy) {
+				jobs = append(jobs, drainJob{key: deviceKeyId(device, policy), job: job})
+			}
+		}
+	}
+	r.updateDrain(device, func(s *DrainStatus) {
+		s.PartitionsTotal = int64(len(jobs))
+		s.PartitionsDone = 0
+		s.PartitionsFailed = 0
+	})
+	failed := int64(0)
+	for _, dj := range jobs {
+		if !deviceDraining(r.deviceRoot, device) {
+			return
+		}
+		if ok, status := r.localPriorityReplicate(dj.key, dj.job); ok {
+			r.updateDrain(device, func(s *DrainStatus) { s.PartitionsDone++ })
+		} else {
+			failed++
+			r.logger.Error("Error draining partition", zap.String("device", device), zap.Uint64("partition", dj.job.Partition),
+				zap.String("toDevice", dj.job.ToDevice.Device), zap.Int("status", status))
+			r.updateDrain(device, func(s *DrainStatus) { s.PartitionsFailed++ })
+		}
+	}
+	r.updateDrain(device, func(s *DrainStatus) {
+		s.Passes++
+		s.Safe = failed == 0
+	})
+	r.logger.Info("Drain pass complete", zap.String("device", device), zap.Int("partitions", len(jobs)), zap.Int64("failed", failed))
+}
+
+// drainHandler starts draining a device on PUT and stops on DELETE, and
+// reports the drain's progress.
+func (r *Replicator) drainHandler(writer http.ResponseWriter, request *http.Request) {
+	device := srv.GetVars(request)["device"]
+	marker := filepath.Join(r.deviceRoot, device, drainMarker)
+	switch request.Method {
+	case "PUT":
+		if r.checkMounts {
+			if mounted, err := fs.IsMount(filepath.Join(r.deviceRoot, device)); err != nil || !mounted {
+				srv.StandardResponse(writer, http.StatusInsufficientStorage)
+				return
+			}
+		}
+		if err := ioutil.WriteFile(marker, []byte(common.GetTimestamp()), 0644); err != nil {
+			r.logger.Error("Error marking device as draining", zap.String("device", device), zap.Error(err))
+			srv.StandardResponse(writer, http.StatusInternalServerError)
+			return
+		}
+		r.logger.Info("Draining device", zap.String("device", device))
+		r.startDrain(device)
+	case "DELETE":
+		if err := os.Remove(marker); err != nil && !os.IsNotExist(err) {
+			r.logger.Error("Error unmarking device as draining", zap.String("device", device), zap.Error(err))
+			srv.StandardResponse(writer, http.StatusInternalServerError)
+			return
+		}
+		r.logger.Info("Stopped draining device", zap.String("device", device))
+		r.updateDrain(device, func(s *DrainStatus) {
+			s.Draining = false
+			s.Safe = false
+		})
+	}
+	status := r.drainStatus(device)
+	if status == nil {
+		status = &DrainStatus{Device: device, Draining: deviceDraining(r.deviceRoot, device)}
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(data)
+}
+
+// DrainDevice takes an IP address and device name such as
+// []string{"172.24.0.1", "sda1"} and starts that device draining, stops it or
+// shows its progress.
+func DrainDevice(args []string, cnf srv.ConfigLoader) {
+	flags := flag.NewFlagSet("drain", flag.ExitOnError)
+	policyName := flags.String("P", "", "policy whose ring to find the device in")
+	ringLoc := flags.String("r", "", "Specify which ring file to use")
+	stop := flags.Bool("stop", false, "stop draining the device")
+	status := flags.Bool("status", false, "only show the device's drain progress")
+	certFile := flags.String("certfile", "", "Cert file to use for setting up https client")
+	keyFile := flags.String("keyfile", "", "Key file to use for setting up https client")
+	token := flags.String("token", "", "Admin token to send, for servers with admin_tokens set")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "USAGE: hummingbird drain [-stop | -status] [ip] [device]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if len(flags.Args()) != 2 {
+		flags.Usage()
+		return
+	}
+	policyIndex := 0
+	if *policyName != "" {
+		policies, err := conf.GetPolicies()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to load policies:", err)
+			return
+		}
+		p := policies.NameLookup(*policyName)
+		if p == nil {
+			fmt.Fprintf(os.Stderr, "Unknown policy named %q\n", *policyName)
+			return
+		}
+		policyIndex = p.Index
+	}
+	hashPathPrefix, hashPathSuffix, err := cnf.GetHashPrefixAndSuffix()
+	if err != nil {
+		fmt.Println("Unable to load hash path prefix and suffix:", err)
+		return
+	}
+	var objRing ring.Ring
+	if *ringLoc == "" {
+		objRing, err = ring.GetRing("object", hashPathPrefix, hashPathSuffix, policyIndex)
+	} else {
+		objRing, err = ring.LoadRing(*ringLoc, hashPathPrefix, hashPathSuffix)
+	}
+	if err != nil {
+		fmt.Println("Unable to load ring:", err)
+		return
+	}
+	var dev *ring.Device
+	for _, d := range objRing.AllDevices() {
+		if d != nil && (d.Ip == flags.Arg(0) || d.ReplicationIp == flags.Arg(0)) && d.Device == flags.Arg(1) {
+			dev = d
+			break
+		}
+	}
+	if dev == nil {
+		fmt.Printf("Device %s not found on %s in the ring\n", flags.Arg(1), flags.Arg(0))
+		return
+	}
+	transport := &http.Transport{}
+	if *certFile != "" && *keyFile != "" {
+		tlsConf, err := common.NewClientTLSConfig(*certFile, *keyFile)
+		if err != nil {
+			fmt.Println("Error getting TLS config:", err)
+			return
+		}
+		transport.TLSClientConfig = tlsConf
+		if err = http2.ConfigureTransport(transport); err != nil {
+			fmt.Println("Error setting up http2:", err)
+			return
+		}
+	}
+	client := &http.Client{Timeout: time.Minute, Transport: common.NewSigningTransport(transport, conf.GetBackendSigningKeys())}
+	method := "PUT"
+	if *stop {
+		method = "DELETE"
+	} else if *status {
+		method = "GET"
+	}
+	req, err := http.NewRequest(method, fmt.Sprintf("%s://%s:%d/drain/%s", dev.Scheme, dev.ReplicationIp, dev.ReplicationPort, dev.Device), nil)
+	if err != nil {
+		fmt.Println("Error creating request:", err)
+		return
+	}
+	if *token != "" {
+		req.Header.Set("X-Admin-Token", *token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Println("Error sending request:", err)
+		return
+	}
+	defer resp.Body.Close()
+	var ds DrainStatus
+	if data, err := ioutil.ReadAll(resp.Body); err != nil || resp.StatusCode != http.StatusOK || json.Unmarshal(data, &ds) != nil {
+		fmt.Printf("Bad response from %s: %d %s\n", dev.ReplicationIp, resp.StatusCode, data)
+		return
+	}
+	switch {
+	case !ds.Draining:
+		fmt.Printf("%s/%s is not draining\n", flags.Arg(0), ds.Device)
+	case ds.Safe:
+		fmt.Printf("%s/%s is drained and safe to remove (%d passes)\n", flags.Arg(0), ds.Device, ds.Passes)
+	default:
+		fmt.Printf("%s/%s is draining: pass %d, %d of %d partitions done, %d failed\n", flags.Arg(0), ds.Device,
+			ds.Passes+1, ds.PartitionsDone, ds.PartitionsTotal, ds.PartitionsFailed)
+	}
+}
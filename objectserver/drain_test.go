@@ -0,0 +1,100 @@
+package objectserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/common/test"
+)
+
+func TestPriRepRecorder(t *testing.T) {
+	resp := &priRepRecorder{header: http.Header{}}
+	resp.WriteHeader(404)
+	require.True(t, resp.ok())
+
+	resp = &priRepRecorder{header: http.Header{}}
+	resp.WriteHeader(500)
+	require.False(t, resp.ok())
+
+	resp = &priRepRecorder{header: http.Header{}}
+	resp.Write([]byte("    "))
+	resp.Write([]byte(`{"Success": false, "ErrorMsg": "nope"}`))
+	require.False(t, resp.ok())
+
+	resp = &priRepRecorder{header: http.Header{}}
+	resp.Write([]byte("    "))
+	resp.Write([]byte(`{"Success": true}`))
+	require.True(t, resp.ok())
+}
+
+func TestDrainHandler(t *testing.T) {
+	oldInterval := drainPassInterval
+	drainPassInterval = time.Millisecond
+	defer func() { drainPassInterval = oldInterval }()
+	deviceRoot, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(deviceRoot)
+	require.Nil(t, os.MkdirAll(filepath.Join(deviceRoot, "sda"), 0755))
+	r, _, err := newTestReplicator(srv.NewTestConfigLoader(&test.FakeRing{}), "check_mounts", "no")
+	require.Nil(t, err)
+	r.deviceRoot = deviceRoot
+	do := func(method string) *DrainStatus {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest(method, "/drain/sda", nil)
+		require.Nil(t, err)
+		r.drainHandler(w, srv.SetVars(req, map[string]string{"device": "sda"}))
+		require.Equal(t, 200, w.Code)
+		var status DrainStatus
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &status))
+		return &status
+	}
+
+	status := do("GET")
+	require.Equal(t, "sda", status.Device)
+	require.False(t, status.Draining)
+
+	status = do("PUT")
+	require.True(t, status.Draining)
+	require.True(t, fs.Exists(filepath.Join(deviceRoot, "sda", drainMarker)))
+	// The device has no partitions left, so the first pass finds it safe.
+	for i := 0; i < 100 && !do("GET").Safe; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	status = do("GET")
+	require.True(t, status.Draining)
+	require.True(t, status.Safe)
+	require.True(t, status.Passes > 0)
+
+	status = do("DELETE")
+	require.False(t, status.Draining)
+	require.False(t, status.Safe)
+	require.False(t, fs.Exists(filepath.Join(deviceRoot, "sda", drainMarker)))
+}
+
+func TestGetDrainHandoffJobs(t *testing.T) {
+	oring := &priFakeRing{
+		mapping: map[uint64][]int{
+			0: {1, 2},
+			1: {3, 4},
+		},
+	}
+	dev := &ring.Device{Id: 3, Device: "drive3", Ip: "127.0.0.1", Port: 3}
+	// Partition 1 is one of its own, and 2 has no primaries to push to.
+	jobs := getDrainHandoffJobs(oring, dev, []uint64{0, 1, 2}, 1)
+	require.Equal(t, 1, len(jobs))
+	require.EqualValues(t, 0, jobs[0].Partition)
+	require.Equal(t, 3, jobs[0].FromDevice.Id)
+	require.Equal(t, 1, jobs[0].ToDevice.Id)
+	require.Equal(t, 1, jobs[0].Policy)
+	require.False(t, jobs[0].Prewarm)
+}
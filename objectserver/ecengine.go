@@ -52,6 +52,7 @@ type ecEngine struct {
 	hashPathPrefix                 string
 	hashPathSuffix                 string
 	reserve                        int64
+	cacheSize                      int64
 	policy                         int
 	ring                           ring.Ring
 	idbs                           map[string]*IndexDB
@@ -73,6 +74,7 @@ type ecEngine struct {
 	nurseryNotifyStabilizeFailure  tally.Counter
 	nurseryNotifyStabilizeSuccess  tally.Counter
 	nurseryNotifyStabilizeSkips    tally.Counter
+	expireOnStabilize              bool
 }
 
 func (f *ecEngine) getDB(device string) (*IndexDB, error) {
@@ -86,13 +88,28 @@ func (f *ecEngine) getDB(device string) (*IndexDB, error) {
 	path := filepath.Join(f.driveRoot, device, PolicyDir(f.policy), "hec")
 	temppath := filepath.Join(f.driveRoot, device, "tmp")
 	ringPartPower := bits.Len64(f.ring.PartitionCount() - 1)
-	f.idbs[device], err = NewIndexDB(dbpath, path, temppath, ringPartPower, f.dbPartPower, f.numSubDirs, f.reserve, f.logger, ecAuditor{})
+	f.idbs[device], err = NewIndexDB(dbpath, path, temppath, ringPartPower, f.dbPartPower, f.numSubDirs, f.reserve, f.cacheSize, f.logger, ecAuditor{})
 	if err != nil {
 		return nil, err
 	}
 	return f.idbs[device], nil
 }
 
+var _ AsyncPendingObjectEngine = &ecEngine{}
+var _ ExpiringObjectEngine = &ecEngine{}
+
+func (f *ecEngine) AsyncPendingDB(device string) (*IndexDB, error) {
+	return f.getDB(device)
+}
+
+func (f *ecEngine) ExpireObjects(device string, limit int) (int, error) {
+	idb, err := f.getDB(device)
+	if err != nil {
+		return 0, err
+	}
+	return idb.ExpireObjects(limit)
+}
+
 // New returns an instance of ecObject with the given parameters. Metadata is read in and if needData is true, the file is opened.  AsyncWG is a waitgroup if the object spawns any async operations
 func (f *ecEngine) New(vars map[string]string, needData bool, asyncWG *sync.WaitGroup) (Object, error) {
 	hash := ObjHash(vars, f.hashPathPrefix, f.hashPathSuffix)
@@ -117,6 +134,9 @@ func (f *ecEngine) New(vars map[string]string, needData bool, asyncWG *sync.Wait
 	if idb, err := f.getDB(vars["device"]); err == nil {
 		obj.idb = idb
 		if item, err := idb.Lookup(hash, shardAny, false); err == nil && item != nil {
+			if err = idb.LoadMetadata(item); err != nil {
+				return nil, err
+			}
 			obj.IndexDBItem = *item
 			if err = json.Unmarshal(item.Metabytes, &obj.metadata); err != nil {
 				return nil, fmt.Errorf("Error parsing metadata: %v", err)
@@ -148,6 +168,25 @@ func (f *ecEngine) GetReplicationDevice(oring ring.Ring, dev *ring.Device, r *Re
 	return GetNurseryDevice(oring, dev, f.policy, r, f)
 }
 
+// Close closes all of the engine's open IndexDBs.
+func (f *ecEngine) Close() error {
+	f.idbm.Lock()
+	defer f.idbm.Unlock()
+	var firstErr error
+	for device, idb := range f.idbs {
+		if idb != nil {
+			if err := idb.Close(); err != nil {
+				f.logger.Error("error closing db", zap.String("device", device), zap.Error(err))
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+		delete(f.idbs, device)
+	}
+	return firstErr
+}
+
 func (f *ecEngine) ecShardGetHandler(writer http.ResponseWriter, request *http.Request) {
 	vars := srv.GetVars(request)
 	idb, err := f.getDB(vars["device"])
@@ -170,6 +209,10 @@ func (f *ecEngine) ecShardGetHandler(writer http.ResponseWriter, request *http.R
 			srv.StandardResponse(writer, http.StatusNotFound)
 			return
 		}
+		if err = idb.LoadMetadata(item); err != nil {
+			srv.StandardResponse(writer, http.StatusInternalServerError)
+			return
+		}
 		metadata := map[string]string{}
 		if err = json.Unmarshal(item.Metabytes, &metadata); err != nil {
 			srv.StandardResponse(writer, http.StatusBadRequest)
@@ -471,6 +514,10 @@ func (f *ecEngine) GetObjectsToReplicate(prirep PriorityRepJob, c chan ObjectSta
 			break
 		}
 		if sendItem {
+			if err = idb.LoadMetadata(item); err != nil {
+				f.logger.Error("error loading metadata", zap.String("ObjHash", item.Hash), zap.Error(err))
+				continue
+			}
 			obj := &ecObject{
 				IndexDBItem:  *item,
 				idb:          idb,
@@ -593,7 +640,9 @@ func (f *ecEngine) getObjectsToStabilize(device *ring.Device, c chan ObjectStabi
 	if err != nil {
 		return
 	}
-	idb.ExpireObjects()
+	if f.expireOnStabilize {
+		idb.ExpireObjects(0)
+	}
 
 	idbItems, err := idb.ListObjectsToStabilize()
 	if err != nil {
@@ -602,6 +651,10 @@ func (f *ecEngine) getObjectsToStabilize(device *ring.Device, c chan ObjectStabi
 	}
 	objs := []*ecObject{}
 	for _, item := range idbItems {
+		if err = idb.LoadMetadata(item); err != nil {
+			f.logger.Error("error loading metadata", zap.String("ObjHash", item.Hash), zap.Error(err))
+			continue
+		}
 		obj := &ecObject{
 			IndexDBItem:     *item,
 			idb:             idb,
@@ -687,13 +740,14 @@ func ecEngineConstructor(config conf.Config, policy *conf.Policy, flags *flag.Fl
 	logLevel.UnmarshalText([]byte(strings.ToLower(logLevelString)))
 	httpClient := &http.Client{
 		Timeout:   120 * time.Minute,
-		Transport: transport,
+		Transport: common.NewSigningTransport(transport, conf.GetBackendSigningKeys()),
 	}
 	engine := &ecEngine{
 		driveRoot:      driveRoot,
 		hashPathPrefix: hashPathPrefix,
 		hashPathSuffix: hashPathSuffix,
 		reserve:        reserve,
+		cacheSize:      config.GetInt("app:object-server", "indexdb_cache_size", 0),
 		policy:         policy.Index,
 		ring:           r,
 		idbs:           map[string]*IndexDB{},
@@ -701,6 +755,8 @@ func ecEngineConstructor(config conf.Config, policy *conf.Policy, flags *flag.Fl
 		dbPartPower:    int(dbPartPower),
 		numSubDirs:     subdirs,
 		client:         httpClient,
+
+		expireOnStabilize: !config.HasSection("object-expirer"),
 	}
 	if engine.logger, err = srv.SetupLogger("ecengine", &logLevel, flags); err != nil {
 		return nil, fmt.Errorf("Error setting up logger: %v", err)
@@ -104,6 +104,23 @@ func getTestEce(frDevs []*ring.Device) (*ecEngine, string, error) {
 	return engine, driveRoot, nil
 }
 
+func TestEcEngineClose(t *testing.T) {
+	engine, driveRoot, err := getTestEce(nil)
+	require.Nil(t, err)
+	defer os.RemoveAll(driveRoot)
+	os.MkdirAll(driveRoot, 0755)
+	_, err = engine.getDB("sda")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(engine.idbs))
+	require.Nil(t, engine.Close())
+	require.Equal(t, 0, len(engine.idbs))
+	// the engine should still be able to reopen its databases afterward
+	idb, err := engine.getDB("sda")
+	require.Nil(t, err)
+	require.NotNil(t, idb)
+	require.Nil(t, engine.Close())
+}
+
 func TestGetObjectsToReplicate(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		remoteItems := []*IndexDBItem{}
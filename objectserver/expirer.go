@@ -0,0 +1,318 @@
+package objectserver
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/middleware"
+	"go.uber.org/zap"
+)
+
+// expirerQueueClient is how the expirer lists the .expiring_objects account
+// and deletes the objects queued in it.
+type expirerQueueClient interface {
+	GetAccountRaw(ctx context.Context, account string, options map[string]string, headers http.Header) *http.Response
+	GetContainerRaw(ctx context.Context, account string, container string, options map[string]string, headers http.Header) *http.Response
+	DeleteContainer(ctx context.Context, account string, container string, headers http.Header) *http.Response
+	DeleteObject(ctx context.Context, account string, container string, obj string, headers http.Header) *http.Response
+}
+
+// expirer removes expired objects from the devices of policies whose engines
+// index objects by X-Delete-At, so they're found with a query of each
+// device's index.db rather than a listing of the .expiring_objects account.
+// With a queue client, it also deletes the objects of other policies as
+// they come due in the .expiring_objects account.
+type expirer struct {
+	r         *Replicator
+	interval  time.Duration
+	batchSize int
+	queue     expirerQueueClient
+	// divisor is the expiring_objects_container_divisor the object servers
+	// queue objects with.
+	divisor int64
+	// The queue's entries are shared out over processes expirers, this
+	// one taking those that hash to process. With no processes, they're
+	// shared out over the object servers in the rings; see share.
+	processes int
+	process   int
+}
+
+func newExpirer(r *Replicator, interval time.Duration, batchSize int) *expirer {
+	return &expirer{r: r, interval: interval, batchSize: batchSize}
+}
+
+// expireDevice removes the device's expired objects a batch at a time,
+// returning how many it removed.
+func (e *expirer) expireDevice(engine ExpiringObjectEngine, device string) int {
+	expired := 0
+	for {
+		n, err := engine.ExpireObjects(device, e.batchSize)
+		expired += n
+		if err != nil {
+			e.r.logger.Error("Error expiring objects", zap.String("device", device), zap.Error(err))
+			return expired
+		}
+		// Each database gives up at most batchSize objects, so fewer than
+		// that in all means none of them has any left.
+		if e.batchSize <= 0 || n < e.batchSize {
+			return expired
+		}
+	}
+}
+
+// run makes one pass over the local devices, reporting how long it took and
+// how many objects it expired to recon.
+func (e *expirer) run() {
+	start := time.Now()
+	expired := 0
+	for policy, oring := range e.r.objectRings {
+		engine, ok := e.r.objEngines[policy].(ExpiringObjectEngine)
+		if !ok {
+			continue
+		}
+		devices, err := oring.LocalDevices(e.r.port)
+		if err != nil {
+			e.r.logger.Error("Error getting local devices from ring", zap.Int("policy", policy), zap.Error(err))
+			continue
+		}
+		for _, dev := range devices {
+			if len(e.r.devices) > 0 && !e.r.devices[dev.Device] {
+				continue
+			}
+			if mounted, err := fs.IsMount(filepath.Join(e.r.deviceRoot, dev.Device)); e.r.checkMounts && (err != nil || !mounted) {
+				e.r.logger.Error("Not expiring objects on unmounted device", zap.String("device", dev.Device), zap.Error(err))
+				continue
+			}
+			expired += e.expireDevice(engine, dev.Device)
+		}
+	}
+	failures := 0
+	if e.queue != nil {
+		n, f := e.expireQueue(time.Now())
+		expired += n
+		failures += f
+	}
+	e.r.logger.Info("Expirer pass complete", zap.Int("expired", expired), zap.Int("failures", failures), zap.Duration("timeTook", time.Since(start)))
+	if err := middleware.DumpReconCache(e.r.reconCachePath, "object", map[string]interface{}{
+		"object_expiration_pass": time.Since(start).Seconds(),
+		"expired_last_pass":      expired,
+		"expirer_failures":       failures,
+	}); err != nil {
+		e.r.logger.Error("object-expirer saving recon data", zap.Error(err))
+	}
+}
+
+// runForever starts a pass every interval, or as soon as the last one
+// finishes if it took longer.
+func (e *expirer) runForever() {
+	for {
+		start := time.Now()
+		e.run()
+		if d := e.interval - time.Since(start); d > 0 {
+			time.Sleep(d)
+		}
+	}
+}
+
+// listNames returns the names in a JSON listing, with none for a 404.
+func listNames(resp *http.Response) ([]string, error) {
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, nil
+	}
+	if resp.StatusCode/100 != 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, fmt.Errorf("listing returned %d", resp.StatusCode)
+	}
+	var listing []struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&listing); err != nil {
+		return nil, err
+	}
+	names := make([]string, len(listing))
+	for i, item := range listing {
+		names[i] = item.Name
+	}
+	return names, nil
+}
+
+// share returns how many expirers the queue is shared out over and which of
+// them this one is. Unless processes is set, every object server in the
+// rings of the policies that queue their objects is taken to run one, in the
+// order of their replication addresses; this one has none if it isn't in
+// those rings.
+func (e *expirer) share() (int, int, error) {
+	if e.processes > 0 {
+		return e.processes, e.process, nil
+	}
+	nodes := map[string]bool{}
+	local := ""
+	for policy, oring := range e.r.objectRings {
+		if _, ok := e.r.objEngines[policy].(ExpiringObjectEngine); ok {
+			continue
+		}
+		for _, dev := range oring.AllDevices() {
+			if dev.Active() {
+				nodes[fmt.Sprintf("%s:%d", dev.ReplicationIp, dev.ReplicationPort)] = true
+			}
+		}
+		devs, err := oring.LocalDevices(e.r.port)
+		if err != nil {
+			return 0, 0, err
+		}
+		if len(devs) > 0 {
+			local = fmt.Sprintf("%s:%d", devs[0].ReplicationIp, devs[0].ReplicationPort)
+		}
+	}
+	if local == "" {
+		return 0, 0, fmt.Errorf("no local devices in the object rings")
+	}
+	sorted := make([]string, 0, len(nodes))
+	for node := range nodes {
+		sorted = append(sorted, node)
+	}
+	sort.Strings(sorted)
+	return len(sorted), sort.SearchStrings(sorted, local), nil
+}
+
+// ours reports whether the queue entry is the process of processes
+// expirers' to delete.
+func ours(name string, processes, process int) bool {
+	if processes <= 1 {
+		return true
+	}
+	sum := md5.Sum([]byte(name))
+	return int(binary.BigEndian.Uint32(sum[:4])%uint32(processes)) == process
+}
+
+// expireQueueEntry deletes the object the queue entry names, if it's still
+// due to be, then the entry itself, returning whether both were done.
+func (e *expirer) expireQueueEntry(container, name string) bool {
+	parts := strings.SplitN(name, "-", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	path := strings.SplitN(parts[1], "/", 3)
+	if len(path) != 3 {
+		return false
+	}
+	deleteAt, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return false
+	}
+	// Only the version that's due goes, and only if nothing newer has
+	// replaced it.
+	resp := e.queue.DeleteObject(context.Background(), path[0], path[1], path[2], http.Header{
+		"X-If-Delete-At": {strconv.FormatInt(deleteAt, 10)},
+		"X-Timestamp":    {common.CanonicalTimestamp(float64(deleteAt))},
+	})
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode/100 == 2, resp.StatusCode == http.StatusNotFound,
+		resp.StatusCode == http.StatusPreconditionFailed, resp.StatusCode == http.StatusConflict:
+	default:
+		e.r.logger.Debug("Error expiring object", zap.String("object", parts[1]), zap.Int("status", resp.StatusCode))
+		return false
+	}
+	return e.r.updateContainers(&asyncPending{
+		Method:    "DELETE",
+		Account:   deleteAtAccount,
+		Container: container,
+		Object:    name,
+		Headers:   map[string]string{"X-Timestamp": common.GetTimestamp(), "X-Backend-Storage-Policy-Index": "0"},
+	}, "object-expirer")
+}
+
+// expireQueueContainer works through the due entries of one of the
+// .expiring_objects containers, a batch at a time, taking the entries that
+// are the process of processes expirers'. It returns how many objects it
+// expired and how many it failed to.
+func (e *expirer) expireQueueContainer(container string, now time.Time, processes, process int) (int, int) {
+	expired, failures := 0, 0
+	marker := ""
+	for {
+		names, err := listNames(e.queue.GetContainerRaw(context.Background(), deleteAtAccount, container,
+			map[string]string{"format": "json", "marker": marker, "limit": strconv.Itoa(e.batchSize)}, http.Header{}))
+		if err != nil {
+			e.r.logger.Error("Error listing expiring objects", zap.String("container", container), zap.Error(err))
+			return expired, failures + 1
+		}
+		if len(names) == 0 {
+			return expired, failures
+		}
+		for _, name := range names {
+			if deleteAt, err := strconv.ParseInt(strings.SplitN(name, "-", 2)[0], 10, 64); err == nil && deleteAt > now.Unix() {
+				// The entries are in the order they come due.
+				return expired, failures
+			}
+			if !ours(name, processes, process) {
+				continue
+			}
+			if e.expireQueueEntry(container, name) {
+				expired++
+			} else {
+				failures++
+			}
+		}
+		marker = names[len(names)-1]
+	}
+}
+
+// expireQueue deletes the objects that have come due in the
+// .expiring_objects account. Failed entries are left to try again on the
+// next pass. It returns how many objects it expired and how many it failed
+// to.
+func (e *expirer) expireQueue(now time.Time) (int, int) {
+	expired, failures := 0, 0
+	processes, process, err := e.share()
+	if err != nil {
+		e.r.logger.Error("Error sharing out expiring objects", zap.Error(err))
+		return expired, failures + 1
+	}
+	marker := ""
+	for {
+		containers, err := listNames(e.queue.GetAccountRaw(context.Background(), deleteAtAccount,
+			map[string]string{"format": "json", "marker": marker}, http.Header{}))
+		if err != nil {
+			e.r.logger.Error("Error listing expiring objects containers", zap.Error(err))
+			return expired, failures + 1
+		}
+		if len(containers) == 0 {
+			return expired, failures
+		}
+		for _, container := range containers {
+			ts, err := strconv.ParseInt(container, 10, 64)
+			if err != nil {
+				continue
+			}
+			if ts > now.Unix() {
+				return expired, failures
+			}
+			n, f := e.expireQueueContainer(container, now, processes, process)
+			expired += n
+			failures += f
+			// Once nothing more can be queued in it, the container goes
+			// when it's empty; it refuses while it isn't.
+			if f == 0 && ts+e.divisor+100 < now.Unix() {
+				resp := e.queue.DeleteContainer(context.Background(), deleteAtAccount, container, http.Header{"X-Timestamp": {common.GetTimestamp()}})
+				resp.Body.Close()
+			}
+		}
+		marker = containers[len(containers)-1]
+	}
+}
@@ -0,0 +1,219 @@
+package objectserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/test"
+	"go.uber.org/zap"
+)
+
+type fakeExpiringEngine struct {
+	ObjectEngine
+	results []int
+	calls   []string
+	limits  []int
+}
+
+func (f *fakeExpiringEngine) ExpireObjects(device string, limit int) (int, error) {
+	f.calls = append(f.calls, device)
+	f.limits = append(f.limits, limit)
+	n := f.results[0]
+	f.results = f.results[1:]
+	return n, nil
+}
+
+func TestExpirerRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	engine := &fakeExpiringEngine{results: []int{2, 2, 1}}
+	r := &Replicator{
+		logger:         zap.NewNop(),
+		reconCachePath: dir,
+		objectRings: map[int]ring.Ring{
+			0: &test.FakeRing{MockDevices: []*ring.Device{{Device: "sda", ReplicationPort: 6000}}},
+			1: &test.FakeRing{MockDevices: []*ring.Device{{Device: "sdb", ReplicationPort: 6000}}},
+		},
+		objEngines: map[int]ObjectEngine{0: engine, 1: &fakeAsyncPendingEngine{}},
+		port:       6000,
+	}
+	e := newExpirer(r, time.Minute, 2)
+	e.run()
+	// Full batches are followed by another, until one comes up short; the
+	// policy whose engine can't expire objects is skipped.
+	require.Equal(t, []string{"sda", "sda", "sda"}, engine.calls)
+	require.Equal(t, []int{2, 2, 2}, engine.limits)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "object.recon"))
+	require.Nil(t, err)
+	var recon map[string]interface{}
+	require.Nil(t, json.Unmarshal(data, &recon))
+	require.Equal(t, float64(5), recon["expired_last_pass"])
+	require.NotNil(t, recon["object_expiration_pass"])
+}
+
+type fakeExpirerQueue struct {
+	containers map[string][]string
+	deleted    []string
+	headers    []http.Header
+	status     int
+}
+
+func fakeListing(names []string) *http.Response {
+	var listing []map[string]string
+	for _, name := range names {
+		listing = append(listing, map[string]string{"name": name})
+	}
+	body, _ := json.Marshal(listing)
+	return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(bytes.NewReader(body))}
+}
+
+// after is the part of the sorted names after the marker.
+func after(names []string, marker string) []string {
+	sort.Strings(names)
+	for i, name := range names {
+		if name > marker {
+			return names[i:]
+		}
+	}
+	return nil
+}
+
+func (f *fakeExpirerQueue) GetAccountRaw(ctx context.Context, account string, options map[string]string, headers http.Header) *http.Response {
+	var names []string
+	for name := range f.containers {
+		names = append(names, name)
+	}
+	return fakeListing(after(names, options["marker"]))
+}
+
+func (f *fakeExpirerQueue) GetContainerRaw(ctx context.Context, account, container string, options map[string]string, headers http.Header) *http.Response {
+	names := after(append([]string{}, f.containers[container]...), options["marker"])
+	if limit, err := strconv.Atoi(options["limit"]); err == nil && len(names) > limit {
+		names = names[:limit]
+	}
+	return fakeListing(names)
+}
+
+func (f *fakeExpirerQueue) DeleteContainer(ctx context.Context, account, container string, headers http.Header) *http.Response {
+	f.deleted = append(f.deleted, container)
+	return &http.Response{StatusCode: 204, Body: ioutil.NopCloser(bytes.NewReader(nil))}
+}
+
+func (f *fakeExpirerQueue) DeleteObject(ctx context.Context, account, container, obj string, headers http.Header) *http.Response {
+	f.deleted = append(f.deleted, account+"/"+container+"/"+obj)
+	f.headers = append(f.headers, headers)
+	return &http.Response{StatusCode: f.status, Body: ioutil.NopCloser(bytes.NewReader(nil))}
+}
+
+// expirerFakeRing is a ring of the object servers at devs, the first of
+// them local unless remote is set.
+type expirerFakeRing struct {
+	test.FakeRing
+	devs   []*ring.Device
+	remote bool
+}
+
+func (r *expirerFakeRing) AllDevices() []*ring.Device {
+	return r.devs
+}
+
+func (r *expirerFakeRing) LocalDevices(localPort int) ([]*ring.Device, error) {
+	if r.remote {
+		return nil, nil
+	}
+	return r.devs[:1], nil
+}
+
+func TestExpirerQueue(t *testing.T) {
+	var popped []string
+	var lock sync.Mutex
+	cs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		popped = append(popped, r.Method+" "+r.URL.Path)
+		lock.Unlock()
+		w.WriteHeader(204)
+	}))
+	defer cs.Close()
+	u, err := url.Parse(cs.URL)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.Nil(t, err)
+	dev := &ring.Device{Scheme: "http", Ip: u.Hostname(), Port: port, Device: "sda"}
+	r := &Replicator{
+		logger:        zap.NewNop(),
+		containerRing: &test.FakeRing{MockDevices: []*ring.Device{dev, dev, dev}},
+		client:        http.DefaultClient,
+		objectRings:   map[int]ring.Ring{0: &expirerFakeRing{devs: []*ring.Device{{ReplicationIp: "1.2.3.4", ReplicationPort: 6500}}}},
+	}
+	queue := &fakeExpirerQueue{status: 204, containers: map[string][]string{
+		"0000001000": {"0000001000-a/c/o1", "0000001001-a/c/o/2", "0000001500-a/c/later"},
+		"0000002000": {"0000002000-a/c/future"},
+	}}
+	e := newExpirer(r, time.Minute, 2)
+	e.queue = queue
+	e.divisor = 100
+	expired, failures := e.expireQueue(time.Unix(1300, 0))
+	require.Equal(t, 2, expired)
+	require.Equal(t, 0, failures)
+	// Objects go in the order they came due, until one that isn't, and only
+	// if they haven't been given a new X-Delete-At since.
+	require.Equal(t, []string{"a/c/o1", "a/c/o/2", "0000001000"}, queue.deleted)
+	require.Equal(t, "1000", queue.headers[0].Get("X-If-Delete-At"))
+	require.Equal(t, "0000001000.00000", queue.headers[0].Get("X-Timestamp"))
+	require.Equal(t, 6, len(popped))
+	require.Equal(t, "DELETE /sda/0/.expiring_objects/0000001000/0000001000-a/c/o1", popped[0])
+
+	// Failures are left for the next pass, and so is their container.
+	queue.deleted, popped = nil, nil
+	queue.status = 503
+	expired, failures = e.expireQueue(time.Unix(1300, 0))
+	require.Equal(t, 0, expired)
+	require.Equal(t, 2, failures)
+	require.Equal(t, []string{"a/c/o1", "a/c/o/2"}, queue.deleted)
+	require.Equal(t, 0, len(popped))
+
+	// Each of several expirers takes its share.
+	queue.status = 204
+	e.processes = 2
+	queue.deleted = nil
+	e.process = 0
+	first, _ := e.expireQueue(time.Unix(1300, 0))
+	e.process = 1
+	second, _ := e.expireQueue(time.Unix(1300, 0))
+	require.Equal(t, 2, first+second)
+
+	// By default, it's shared out over the object servers in the rings.
+	e.processes, e.process = 0, 0
+	nodes := []*ring.Device{{ReplicationIp: "1.2.3.5", ReplicationPort: 6500}, {ReplicationIp: "1.2.3.4", ReplicationPort: 6500}, {ReplicationIp: "1.2.3.5", ReplicationPort: 6500}}
+	r.objectRings[0] = &expirerFakeRing{devs: nodes}
+	processes, process, err := e.share()
+	require.Nil(t, err)
+	require.Equal(t, 2, processes)
+	require.Equal(t, 1, process)
+	queue.deleted = nil
+	first, _ = e.expireQueue(time.Unix(1300, 0))
+	r.objectRings[0] = &expirerFakeRing{devs: []*ring.Device{nodes[1], nodes[0]}}
+	second, _ = e.expireQueue(time.Unix(1300, 0))
+	require.Equal(t, 2, first+second)
+
+	// A node that isn't in the rings leaves the queue to those that are.
+	r.objectRings[0] = &expirerFakeRing{devs: nodes, remote: true}
+	_, failures = e.expireQueue(time.Unix(1300, 0))
+	require.Equal(t, 1, failures)
+}
@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -25,9 +26,21 @@ const (
 	shardNursery             = 0
 	numStabilizeObjects      = 100
 	maxStableObjectCacheSize = 1000000
+	// sidecarMetadataSize is the encoded metadata size above which an item's
+	// metadata is kept in the metadata_sidecar table rather than inline in
+	// its objects row, keeping the hot index small for huge metadata sets.
+	sidecarMetadataSize = 4096
+	// sidecarMarker is stored in the objects metadata column in place of
+	// metadata that lives in the metadata_sidecar table.
+	sidecarMarker = "sidecar"
+	// accessResolution is how stale an item's recorded last access may get
+	// before Touch updates it, so reads don't each turn into a write.
+	accessResolution = time.Hour
 )
 
-// IndexDBItem is a single item returned by List.
+// IndexDBItem is a single item returned by List. Its Metabytes is only the
+// sidecarMarker if its metadata is kept in the metadata_sidecar table, until
+// LoadMetadata reads it.
 type IndexDBItem struct {
 	Hash        string
 	Shard       int
@@ -40,6 +53,21 @@ type IndexDBItem struct {
 	ShardHash   string
 	Restabilize bool
 	Expires     *int64
+	Tiered      bool
+}
+
+// AsyncPending is a container update that couldn't be sent when its object
+// was written, queued in the IndexDB for the updater to retry.
+type AsyncPending struct {
+	Hash        string
+	Timestamp   int64 // the update's X-Timestamp, in UnixNano
+	Method      string
+	Account     string
+	Container   string
+	Object      string
+	Headers     map[string]string
+	Attempts    int
+	NextAttempt int64 // UnixNano
 }
 
 // IndexDB will track a set of objects.
@@ -69,6 +97,7 @@ type IndexDB struct {
 	subdirs       int
 	temppath      string
 	reserve       int64
+	cacheSize     int64
 	dbs           []*sql.DB
 	logger        srv.LowLevelLogger
 	auditor       IndexDBAuditor
@@ -80,8 +109,9 @@ type IndexDB struct {
 // the dbPartPower. The dbPartPower will define how many
 // databases are created (e.g. dbPartPower = 6 gives 64 databases). The
 // subdirs value will define how many subdirectories are created where object
-// content files are placed.
-func NewIndexDB(dbpath, filepath, temppath string, ringPartPower, dbPartPower, subdirs int, reserve int64, logger srv.LowLevelLogger, auditor IndexDBAuditor) (*IndexDB, error) {
+// content files are placed. The cacheSize is the page cache memory in bytes
+// shared by all of the databases; 0 gives each database SQLite's 4MiB.
+func NewIndexDB(dbpath, filepath, temppath string, ringPartPower, dbPartPower, subdirs int, reserve, cacheSize int64, logger srv.LowLevelLogger, auditor IndexDBAuditor) (*IndexDB, error) {
 	if ringPartPower <= dbPartPower {
 		return nil, fmt.Errorf("ringPartPower must be greater than dbPartPower: %d is not greater than %d", ringPartPower, dbPartPower)
 	}
@@ -98,6 +128,7 @@ func NewIndexDB(dbpath, filepath, temppath string, ringPartPower, dbPartPower, s
 		dbs:           make([]*sql.DB, 1<<uint(dbPartPower)),
 		logger:        logger,
 		reserve:       reserve,
+		cacheSize:     cacheSize,
 		auditor:       auditor,
 	}
 	err := os.MkdirAll(ot.dbpath, 0700)
@@ -140,13 +171,20 @@ func NewIndexDB(dbpath, filepath, temppath string, ringPartPower, dbPartPower, s
 
 func (ot *IndexDB) init(dbi int) error {
 	db := ot.dbs[dbi]
-	if _, err := db.Exec(`
+	// A negative cache_size is in KiB rather than pages.
+	cacheKiB := int64(4096)
+	if ot.cacheSize > 0 {
+		if cacheKiB = ot.cacheSize / 1024 / int64(len(ot.dbs)); cacheKiB < 1 {
+			cacheKiB = 1
+		}
+	}
+	if _, err := db.Exec(fmt.Sprintf(`
         PRAGMA synchronous = NORMAL;
-        PRAGMA cache_size = -4096;
+        PRAGMA cache_size = -%d;
         PRAGMA temp_store = MEMORY;
         PRAGMA journal_mode = WAL;
         PRAGMA busy_timeout = 25000;
-    `, nil); err != nil {
+    `, cacheKiB), nil); err != nil {
 		return err
 	}
 	tx, err := db.Begin()
@@ -166,27 +204,133 @@ func (ot *IndexDB) init(dbi int) error {
 			shardhash TEXT, -- NULLable because not every object is a shard
 			restabilize BOOLEAN NOT NULL,
 			expires INTEGER DEFAULT NULL,
+			accessed INTEGER DEFAULT NULL, -- NULL means never read; use timestamp
+			tiered BOOLEAN NOT NULL DEFAULT 0, -- contents live in a remote tier
+			storage_class TEXT DEFAULT NULL, -- X-Object-Storage-Class placement hint
 			CONSTRAINT ix_objects_hash_shard_timestamp PRIMARY KEY (hash, shard, timestamp, nursery)
 		) WITHOUT ROWID;
 	`)
 	if err != nil {
 		return err
 	}
+	if err = migrateObjectsColumns(tx); err != nil {
+		return err
+	}
 	if _, err = tx.Exec("CREATE INDEX IF NOT EXISTS ix_stabilize_items ON objects (nursery, restabilize, timestamp) WHERE nursery = 1 OR restabilize = 1"); err != nil {
 		return err
 	}
 	if _, err = tx.Exec("CREATE INDEX IF NOT EXISTS ix_object_expires ON objects(expires) WHERE expires IS NOT NULL"); err != nil {
 		return err
 	}
+	if _, err = tx.Exec("CREATE INDEX IF NOT EXISTS ix_object_accessed ON objects(COALESCE(accessed, timestamp)) WHERE nursery = 0 AND deletion = 0 AND tiered = 0"); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS metadata_sidecar (
+			hash TEXT NOT NULL,
+			shard INTEGER NOT NULL,
+			timestamp INTEGER NOT NULL,
+			nursery BOOLEAN NOT NULL,
+			metadata TEXT NOT NULL,
+			CONSTRAINT ix_metadata_sidecar_hash_shard_timestamp PRIMARY KEY (hash, shard, timestamp, nursery)
+		) WITHOUT ROWID;
+
+		CREATE TABLE IF NOT EXISTS async_pending (
+			hash TEXT NOT NULL,
+			timestamp INTEGER NOT NULL,
+			method TEXT NOT NULL,
+			account TEXT NOT NULL,
+			container TEXT NOT NULL,
+			obj TEXT NOT NULL,
+			headers TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			next_attempt INTEGER NOT NULL DEFAULT 0,
+			CONSTRAINT ix_async_pending_hash_timestamp PRIMARY KEY (hash, timestamp)
+		) WITHOUT ROWID;
+
+		CREATE INDEX IF NOT EXISTS ix_async_pending_next_attempt ON async_pending (next_attempt);
+
+		CREATE TRIGGER IF NOT EXISTS objects_sidecar_delete AFTER DELETE ON objects
+		WHEN OLD.metadata = 'sidecar'
+		BEGIN
+			DELETE FROM metadata_sidecar
+			WHERE hash = OLD.hash AND shard = OLD.shard AND timestamp = OLD.timestamp AND nursery = OLD.nursery;
+		END;
+
+		CREATE TRIGGER IF NOT EXISTS objects_sidecar_update AFTER UPDATE ON objects
+		WHEN OLD.metadata = 'sidecar'
+		BEGIN
+			UPDATE OR REPLACE metadata_sidecar
+			SET timestamp = NEW.timestamp, nursery = NEW.nursery
+			WHERE hash = OLD.hash AND shard = OLD.shard AND timestamp = OLD.timestamp AND nursery = OLD.nursery;
+			DELETE FROM metadata_sidecar
+			WHERE NEW.metadata IS NOT 'sidecar'
+				AND hash = NEW.hash AND shard = NEW.shard AND timestamp = NEW.timestamp AND nursery = NEW.nursery;
+		END;
+	`)
+	if err != nil {
+		return err
+	}
 	return tx.Commit()
 }
 
-// Close closes all the underlying databases for the IndexDB; you should
-// discard the IndexDB instance after this call.
-func (ot *IndexDB) Close() {
+// migrateObjectsColumns adds any columns missing from an objects table created
+// by an older version.
+func migrateObjectsColumns(tx *sql.Tx) error {
+	rows, err := tx.Query("PRAGMA table_info(objects)")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns := map[string]bool{}
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, ctype string
+		var dflt sql.NullString
+		if err = rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
+			return err
+		}
+		columns[name] = true
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	if !columns["accessed"] {
+		if _, err = tx.Exec("ALTER TABLE objects ADD COLUMN accessed INTEGER DEFAULT NULL"); err != nil {
+			return err
+		}
+	}
+	if !columns["tiered"] {
+		if _, err = tx.Exec("ALTER TABLE objects ADD COLUMN tiered BOOLEAN NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+	}
+	if !columns["storage_class"] {
+		if _, err = tx.Exec("ALTER TABLE objects ADD COLUMN storage_class TEXT DEFAULT NULL"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close checkpoints and closes all the underlying databases for the IndexDB;
+// you should discard the IndexDB instance after this call. The first error
+// encountered is returned, but every database will still be closed.
+func (ot *IndexDB) Close() error {
+	var firstErr error
 	for _, db := range ot.dbs {
-		db.Close()
+		if db == nil {
+			continue
+		}
+		if _, err := db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := db.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
+	return firstErr
 }
 
 // TempFile returns a temporary file to write to for eventually adding the
@@ -246,6 +390,7 @@ func (ot *IndexDB) Commit(f fs.AtomicFileWriter, hsh string, shard int, timestam
 	metabytes := []byte{}
 	metahash := ""
 	expires := (*string)(nil)
+	storageClass := (*string)(nil)
 
 	if len(metadata) > 0 {
 		metabytes, err = json.Marshal(metadata)
@@ -256,6 +401,9 @@ func (ot *IndexDB) Commit(f fs.AtomicFileWriter, hsh string, shard int, timestam
 		if xda, ok := metadata["X-Delete-At"]; ok {
 			expires = &xda
 		}
+		if sc, ok := metadata["X-Object-Storage-Class"]; ok {
+			storageClass = &sc
+		}
 	}
 
 	if f != nil {
@@ -311,6 +459,12 @@ func (ot *IndexDB) Commit(f fs.AtomicFileWriter, hsh string, shard int, timestam
 		if err = rows.Scan(&dbTimestamp, &dbMetahash, &dbMetadata, &dbShardHash); err != nil {
 			return err
 		}
+		rows.Close()
+		if string(dbMetadata) == sidecarMarker {
+			if dbMetadata, err = loadSidecarMetadata(tx, hsh, shard, dbTimestamp, nursery); err != nil {
+				return err
+			}
+		}
 		if f == nil && !deletion {
 			// We keep the original file's timestamp if just committing new metadata. (not the x-timestamp header)
 			timestamp = dbTimestamp
@@ -375,24 +529,38 @@ func (ot *IndexDB) Commit(f fs.AtomicFileWriter, hsh string, shard int, timestam
 	if err != nil {
 		return err
 	}
+	var dbMetabytes interface{} = metabytes
+	if len(metabytes) > sidecarMetadataSize {
+		dbMetabytes = sidecarMarker
+	}
 	restabilize := false
 	if dbWholeObjectPath == "" {
 		_, err = tx.Exec(`
-            INSERT INTO objects (hash, shard, timestamp, deletion, metahash, metadata, nursery, shardhash, restabilize, expires)
-            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-        `, hsh, shard, timestamp, deletion, metahash, metabytes, nursery, shardhash, restabilize, expires)
+            INSERT INTO objects (hash, shard, timestamp, deletion, metahash, metadata, nursery, shardhash, restabilize, expires, storage_class)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        `, hsh, shard, timestamp, deletion, metahash, dbMetabytes, nursery, shardhash, restabilize, expires, storageClass)
 	} else {
 		if !nursery && method == "POST" {
 			restabilize = true
 		}
+		// Only a metadata update keeps the existing contents, and with them
+		// any tier state and access time.
+		keepContents := f == nil && !deletion
 		_, err = tx.Exec(`
             UPDATE objects
-            SET timestamp = ?, deletion = ?, metahash = ?, metadata = ?, nursery = ?, shardhash = ?, restabilize = ?, expires = ?
+            SET timestamp = ?, deletion = ?, metahash = ?, metadata = ?, nursery = ?, shardhash = ?, restabilize = ?, expires = ?,
+                storage_class = ?, tiered = (tiered AND ?), accessed = CASE WHEN ? THEN accessed ELSE NULL END
             WHERE hash = ? AND shard = ? AND nursery = ?
-        `, timestamp, deletion, metahash, metabytes, nursery, shardhash, restabilize, expires, hsh, shard, nursery)
-		if err != nil {
-			return err
-		}
+        `, timestamp, deletion, metahash, dbMetabytes, nursery, shardhash, restabilize, expires, storageClass, keepContents, keepContents, hsh, shard, nursery)
+	}
+	if err == nil && len(metabytes) > sidecarMetadataSize {
+		_, err = tx.Exec(`
+            INSERT OR REPLACE INTO metadata_sidecar (hash, shard, timestamp, nursery, metadata)
+            VALUES (?, ?, ?, ?, ?)
+        `, hsh, shard, timestamp, nursery, metabytes)
+	}
+	if err != nil {
+		return err
 	}
 	if f != nil {
 		if err = f.Finalize(pth); err != nil {
@@ -403,7 +571,7 @@ func (ot *IndexDB) Commit(f fs.AtomicFileWriter, hsh string, shard int, timestam
 		err = tx.Commit()
 	}
 	if err == nil && dbWholeObjectPath != "" && (f != nil || deletion) && timestamp > dbTimestamp {
-		if err2 := os.Remove(dbWholeObjectPath); err2 != nil {
+		if err2 := os.Remove(dbWholeObjectPath); err2 != nil && !os.IsNotExist(err2) {
 			ot.logger.Error(
 				"error removing older file",
 				zap.Error(err2),
@@ -507,14 +675,14 @@ func (ot *IndexDB) Lookup(hsh string, shard int, justStable bool) (*IndexDBItem,
 	var rows *sql.Rows
 	if justStable {
 		rows, err = db.Query(`
-			SELECT timestamp, deletion, metahash, metadata, nursery, shard, shardhash, restabilize, expires
+			SELECT timestamp, deletion, metahash, metadata, nursery, shard, shardhash, restabilize, expires, tiered
 			FROM objects
 			WHERE hash = ? AND shard = ? AND nursery = 0
 			LIMIT 1
 		`, hsh, shard)
 	} else if shard == shardAny {
 		rows, err = db.Query(`
-			SELECT timestamp, deletion, metahash, metadata, nursery, shard, shardhash, restabilize, expires
+			SELECT timestamp, deletion, metahash, metadata, nursery, shard, shardhash, restabilize, expires, tiered
 			FROM objects
 			WHERE hash = ? AND metadata IS NOT NULL
 			ORDER BY nursery DESC, shard ASC
@@ -522,7 +690,7 @@ func (ot *IndexDB) Lookup(hsh string, shard int, justStable bool) (*IndexDBItem,
 		`, hsh)
 	} else {
 		rows, err = db.Query(`
-			SELECT timestamp, deletion, metahash, metadata, nursery, shard, shardhash, restabilize, expires
+			SELECT timestamp, deletion, metahash, metadata, nursery, shard, shardhash, restabilize, expires, tiered
 			FROM objects
 			WHERE hash = ? AND shard = ?
 			ORDER BY nursery DESC
@@ -538,20 +706,46 @@ func (ot *IndexDB) Lookup(hsh string, shard int, justStable bool) (*IndexDBItem,
 	}
 	item := &IndexDBItem{Hash: hsh}
 	if err = rows.Scan(&item.Timestamp, &item.Deletion, &item.Metahash,
-		&item.Metabytes, &item.Nursery, &item.Shard, &item.ShardHash, &item.Restabilize, &item.Expires); err != nil {
+		&item.Metabytes, &item.Nursery, &item.Shard, &item.ShardHash, &item.Restabilize, &item.Expires, &item.Tiered); err != nil {
 		return nil, err
 	}
+	rows.Close()
 	item.Path, err = ot.WholeObjectPath(item.Hash, item.Shard, item.Timestamp, item.Nursery)
 	return item, err
 }
 
+// LookupTimestamp is a Lookup of just the newest version's timestamp,
+// deletion flag and expiration, skipping its metadata and file path. It
+// returns nil if there is no such item.
+func (ot *IndexDB) LookupTimestamp(hsh string, shard int) (*IndexDBItem, error) {
+	hsh, _, dbPart, _, err := ValidateHash(hsh, ot.RingPartPower, ot.dbPartPower, ot.subdirs)
+	if err != nil {
+		return nil, err
+	}
+	item := &IndexDBItem{Hash: hsh, Shard: shard}
+	err = ot.dbs[dbPart].QueryRow(`
+		SELECT timestamp, deletion, nursery, expires
+		FROM objects
+		WHERE hash = ? AND shard = ?
+		ORDER BY nursery DESC
+		LIMIT 1
+	`, hsh, shard).Scan(&item.Timestamp, &item.Deletion, &item.Nursery, &item.Expires)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
 // ListObjectsToStabilize lists oldest objects in the nursery, it will be limited to numStabilizeObjects * # index.db's
 func (ot *IndexDB) ListObjectsToStabilize() ([]*IndexDBItem, error) {
 	listing := []*IndexDBItem{}
 	for _, db := range ot.dbs {
 		if err := func() error {
 			rows, err := db.Query(`
-				SELECT hash, shard, timestamp, deletion, metahash, metadata, nursery, restabilize, expires
+				SELECT hash, shard, timestamp, deletion, metahash, metadata, nursery, restabilize, expires, tiered
 				FROM objects
 				WHERE nursery = 1 OR restabilize = 1
                 ORDER BY timestamp LIMIT ?`, numStabilizeObjects)
@@ -562,7 +756,7 @@ func (ot *IndexDB) ListObjectsToStabilize() ([]*IndexDBItem, error) {
 			for rows.Next() {
 				item := &IndexDBItem{}
 				if err = rows.Scan(&item.Hash, &item.Shard, &item.Timestamp, &item.Deletion, &item.Metahash,
-					&item.Metabytes, &item.Nursery, &item.Restabilize, &item.Expires); err != nil {
+					&item.Metabytes, &item.Nursery, &item.Restabilize, &item.Expires, &item.Tiered); err != nil {
 					return err
 				}
 				item.Path, err = ot.WholeObjectPath(item.Hash, item.Shard, item.Timestamp, item.Nursery)
@@ -571,7 +765,10 @@ func (ot *IndexDB) ListObjectsToStabilize() ([]*IndexDBItem, error) {
 				}
 				listing = append(listing, item)
 			}
-			return rows.Err()
+			if err = rows.Err(); err != nil {
+				return err
+			}
+			return nil
 		}(); err != nil {
 			return listing, err
 		}
@@ -605,7 +802,7 @@ func (ot *IndexDB) List(startHash, stopHash, marker string, limit int) ([]*Index
 		var rows *sql.Rows
 		if limit > 0 {
 			rows, err = db.Query(`
-				SELECT hash, shard, timestamp, deletion, metahash, metadata, nursery, shardhash, restabilize, expires
+				SELECT hash, shard, timestamp, deletion, metahash, metadata, nursery, shardhash, restabilize, expires, tiered
 			FROM objects
 			WHERE hash BETWEEN ? AND ? AND hash > ?
 			ORDER BY hash
@@ -613,7 +810,7 @@ func (ot *IndexDB) List(startHash, stopHash, marker string, limit int) ([]*Index
 		    `, startHash, stopHash, marker, limit)
 		} else {
 			rows, err = db.Query(`
-				SELECT hash, shard, timestamp, deletion, metahash, metadata, nursery, shardhash, restabilize, expires
+				SELECT hash, shard, timestamp, deletion, metahash, metadata, nursery, shardhash, restabilize, expires, tiered
 			FROM objects
 			WHERE hash BETWEEN ? AND ? AND hash > ?
 			ORDER BY hash
@@ -626,7 +823,7 @@ func (ot *IndexDB) List(startHash, stopHash, marker string, limit int) ([]*Index
 		for rows.Next() {
 			item := &IndexDBItem{}
 			if err = rows.Scan(&item.Hash, &item.Shard, &item.Timestamp, &item.Deletion, &item.Metahash,
-				&item.Metabytes, &item.Nursery, &item.ShardHash, &item.Restabilize, &item.Expires); err != nil {
+				&item.Metabytes, &item.Nursery, &item.ShardHash, &item.Restabilize, &item.Expires, &item.Tiered); err != nil {
 				return listing, err
 			}
 			listing = append(listing, item)
@@ -634,30 +831,78 @@ func (ot *IndexDB) List(startHash, stopHash, marker string, limit int) ([]*Index
 		if err = rows.Err(); err != nil {
 			return listing, err
 		}
+		rows.Close()
 	}
 	return listing, nil
 }
 
-func (ot *IndexDB) ExpireObjects() error {
+// sidecarQuerier is satisfied by both *sql.DB and *sql.Tx.
+type sidecarQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// loadSidecarMetadata returns the metadata kept in the metadata_sidecar table
+// for the objects row identified by hsh, shard, timestamp, and nursery.
+func loadSidecarMetadata(q sidecarQuerier, hsh string, shard int, timestamp int64, nursery bool) ([]byte, error) {
+	var metabytes []byte
+	if err := q.QueryRow(`
+		SELECT metadata
+		FROM metadata_sidecar
+		WHERE hash = ? AND shard = ? AND timestamp = ? AND nursery = ?
+	`, hsh, shard, timestamp, nursery).Scan(&metabytes); err != nil {
+		return nil, fmt.Errorf("error loading sidecar metadata for %s: %v", hsh, err)
+	}
+	return metabytes, nil
+}
+
+// LoadMetadata replaces the item's Metabytes with its metadata from the
+// metadata_sidecar table if that's where it's kept. Lookup and the listings
+// leave it there, so only the callers that use the metadata pay to read it.
+func (ot *IndexDB) LoadMetadata(item *IndexDBItem) error {
+	if string(item.Metabytes) != sidecarMarker {
+		return nil
+	}
+	_, _, dbPart, _, err := ValidateHash(item.Hash, ot.RingPartPower, ot.dbPartPower, ot.subdirs)
+	if err != nil {
+		return err
+	}
+	metabytes, err := loadSidecarMetadata(ot.dbs[dbPart], item.Hash, item.Shard, item.Timestamp, item.Nursery)
+	if err != nil {
+		return err
+	}
+	item.Metabytes = metabytes
+	return nil
+}
+
+// ExpireObjects removes the rows and files of objects whose X-Delete-At has
+// passed, found through the index on expires, and returns how many it
+// removed. Each database gives up at most limit objects per call; a limit of
+// 0 removes them all.
+func (ot *IndexDB) ExpireObjects(limit int) (int, error) {
 	type result struct {
 		hash      string
 		timestamp int64
 		shard     int
 		nursery   bool
 	}
+	query := "SELECT hash, shard, timestamp, nursery FROM objects WHERE expires < ? ORDER BY expires"
+	if limit > 0 {
+		query += " LIMIT " + strconv.Itoa(limit)
+	}
+	expired := 0
 	for dbIndex, db := range ot.dbs {
-		rows, err := db.Query("SELECT hash, shard, timestamp, nursery FROM objects WHERE expires < ?", time.Now().Unix())
+		rows, err := db.Query(query, time.Now().Unix())
 		if err != nil {
 			ot.logger.Error("database error", zap.Error(err), zap.Int("db", dbIndex))
-			return err
+			return expired, err
 		}
-		defer rows.Close()
 		remove := []result{}
-		for i := 0; rows.Next(); i++ {
+		for rows.Next() {
 			var r result
 			if err = rows.Scan(&r.hash, &r.shard, &r.timestamp, &r.nursery); err != nil {
+				rows.Close()
 				ot.logger.Error("database error", zap.Error(err), zap.Int("db", dbIndex))
-				return err
+				return expired, err
 			}
 			if path, err := ot.WholeObjectPath(r.hash, r.shard, r.timestamp, r.nursery); err == nil {
 				if err := os.Remove(path); err == nil || os.IsNotExist(err) {
@@ -668,32 +913,34 @@ func (ot *IndexDB) ExpireObjects() error {
 			}
 		}
 		if err := rows.Err(); err != nil {
+			rows.Close()
 			ot.logger.Error("database error", zap.Error(err), zap.Int("db", dbIndex))
-			return err
+			return expired, err
 		}
 		rows.Close()
 
 		if len(remove) > 0 {
-			tx, err := db.Begin()
-			if err != nil {
-				ot.logger.Error("database error", zap.Error(err), zap.Int("db", dbIndex))
-				return err
-			}
-			defer tx.Rollback()
-			for _, r := range remove {
-				if _, err := tx.Exec("DELETE FROM objects WHERE hash=? AND shard=? AND timestamp=? AND nursery=?",
-					r.hash, r.shard, r.timestamp, r.nursery); err != nil {
-					ot.logger.Error("database error", zap.Error(err), zap.Int("db", dbIndex))
+			if err := func() error {
+				tx, err := db.Begin()
+				if err != nil {
 					return err
 				}
-			}
-			if err := tx.Commit(); err != nil {
+				defer tx.Rollback()
+				for _, r := range remove {
+					if _, err := tx.Exec("DELETE FROM objects WHERE hash=? AND shard=? AND timestamp=? AND nursery=?",
+						r.hash, r.shard, r.timestamp, r.nursery); err != nil {
+						return err
+					}
+				}
+				return tx.Commit()
+			}(); err != nil {
 				ot.logger.Error("database error", zap.Error(err), zap.Int("db", dbIndex))
-				return err
+				return expired, err
 			}
+			expired += len(remove)
 		}
 	}
-	return nil
+	return expired, nil
 }
 
 func ValidateHash(hsh string, ringPartPower, dbPartPower uint, subdirs int) (hshOut string, ringPart, dbPart, dirNm int, err error) {
@@ -715,12 +962,379 @@ func (ot *IndexDB) RingPartRange(ringPart int) (string, string) {
 	return fmt.Sprintf("%016x0000000000000000", start), fmt.Sprintf("%016xffffffffffffffff", stop)
 }
 
+// MaxPartitionTreeLevel is the deepest level PartitionTree will build; each
+// level splits its parent's hash range into 16 buckets.
+const MaxPartitionTreeLevel = 4
+
+// PartitionHash returns an aggregate hash of the stable items within the
+// ringPart. Two IndexDBs with the same partition hash hold the same stable
+// items for that partition, so replicators can cheaply skip partitions that
+// are already in sync without transferring full listings.
+//
+// The result is the XOR of the md5 of each item's hash, shard, timestamp,
+// deletion flag, and metahash, so it doesn't depend on row order; an empty
+// partition hashes to all zeros.
+func (ot *IndexDB) PartitionHash(ringPart int) (string, error) {
+	tree, err := ot.PartitionTree(ringPart, 0)
+	if err != nil {
+		return "", err
+	}
+	return tree[0][0], nil
+}
+
+// PartitionTree returns a merkle tree of the stable items within the
+// ringPart, from the root (level 0, equal to PartitionHash) down to the given
+// depth. Level l has 16^l nodes; node n covers the hash range returned by
+// PartitionTreeRange(ringPart, l, n), and its hash is the XOR of its
+// children's hashes.
+func (ot *IndexDB) PartitionTree(ringPart, depth int) ([][]string, error) {
+	if ringPart < 0 || ringPart >= 1<<ot.RingPartPower {
+		return nil, fmt.Errorf("invalid ring partition %d for part power %d", ringPart, ot.RingPartPower)
+	}
+	if depth < 0 || depth > MaxPartitionTreeLevel || int(ot.RingPartPower)+4*depth > 64 {
+		return nil, fmt.Errorf("invalid partition tree depth %d", depth)
+	}
+	startHash, stopHash := ot.RingPartRange(ringPart)
+	_, _, dbPart, _, err := ValidateHash(startHash, ot.RingPartPower, ot.dbPartPower, ot.subdirs)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := ot.dbs[dbPart].Query(`
+		SELECT hash, shard, timestamp, deletion, COALESCE(metahash, '')
+		FROM objects
+		WHERE hash BETWEEN ? AND ? AND nursery = 0
+	`, startHash, stopHash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	levels := make([][][md5.Size]byte, depth+1)
+	levels[depth] = make([][md5.Size]byte, 1<<uint(4*depth))
+	for rows.Next() {
+		var hsh, metahash string
+		var shard int
+		var timestamp int64
+		var deletion bool
+		if err = rows.Scan(&hsh, &shard, &timestamp, &deletion, &metahash); err != nil {
+			return nil, err
+		}
+		upper, err := strconv.ParseUint(hsh[:16], 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		leaf := &levels[depth][(upper<<ot.RingPartPower)>>(64-uint(4*depth))]
+		itemHash := md5.Sum([]byte(fmt.Sprintf("%s/%d/%d/%t/%s", hsh, shard, timestamp, deletion, metahash)))
+		for i := range leaf {
+			leaf[i] ^= itemHash[i]
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for l := depth - 1; l >= 0; l-- {
+		levels[l] = make([][md5.Size]byte, 1<<uint(4*l))
+		for n, child := range levels[l+1] {
+			for i := range child {
+				levels[l][n>>4][i] ^= child[i]
+			}
+		}
+	}
+	tree := make([][]string, depth+1)
+	for l, nodes := range levels {
+		tree[l] = make([]string, len(nodes))
+		for n, node := range nodes {
+			tree[l][n] = hex.EncodeToString(node[:])
+		}
+	}
+	return tree, nil
+}
+
+// PartitionTreeRange returns the first and last hashes covered by the given
+// node of a PartitionTree for the ringPart.
+func (ot *IndexDB) PartitionTreeRange(ringPart, level, node int) (string, string) {
+	width := uint64(1) << (64 - ot.RingPartPower - uint(4*level))
+	start := uint64(ringPart)<<(64-ot.RingPartPower) + uint64(node)*width
+	return fmt.Sprintf("%016x0000000000000000", start), fmt.Sprintf("%016xffffffffffffffff", start+width-1)
+}
+
+// Touch records that the stable hsh:shard at timestamp was just read, for
+// tiering by last access. Accesses within accessResolution of the recorded time
+// aren't written.
+func (ot *IndexDB) Touch(hsh string, shard int, timestamp int64) error {
+	hsh, _, dbPart, _, err := ValidateHash(hsh, ot.RingPartPower, ot.dbPartPower, ot.subdirs)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UnixNano()
+	_, err = ot.dbs[dbPart].Exec(`
+		UPDATE objects SET accessed = ?
+		WHERE hash = ? AND shard = ? AND timestamp = ? AND nursery = 0 AND COALESCE(accessed, timestamp) < ?
+	`, now, hsh, shard, timestamp, now-int64(accessResolution))
+	return err
+}
+
+// ListCold returns up to limit stable, local items that haven't been read (or
+// written, if never read) since before, a UnixNano time; least recently used
+// first within each database. Items uploaded with an X-Object-Storage-Class
+// of cold are listed ahead of the rest regardless of age, and those marked
+// hot are never listed.
+func (ot *IndexDB) ListCold(before int64, limit int) ([]*IndexDBItem, error) {
+	listing := []*IndexDBItem{}
+	for _, db := range ot.dbs {
+		if len(listing) >= limit {
+			break
+		}
+		if err := func() error {
+			rows, err := db.Query(`
+				SELECT hash, shard, timestamp, deletion, metahash, metadata, nursery, shardhash, restabilize, expires, tiered
+				FROM objects
+				WHERE nursery = 0 AND deletion = 0 AND tiered = 0 AND (storage_class IS 'cold' OR
+					(storage_class IS NOT 'hot' AND COALESCE(accessed, timestamp) < ?))
+				ORDER BY storage_class IS NOT 'cold', COALESCE(accessed, timestamp)
+				LIMIT ?
+			`, before, limit-len(listing))
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				item := &IndexDBItem{}
+				if err = rows.Scan(&item.Hash, &item.Shard, &item.Timestamp, &item.Deletion, &item.Metahash,
+					&item.Metabytes, &item.Nursery, &item.ShardHash, &item.Restabilize, &item.Expires, &item.Tiered); err != nil {
+					return err
+				}
+				if item.Path, err = ot.WholeObjectPath(item.Hash, item.Shard, item.Timestamp, item.Nursery); err != nil {
+					return err
+				}
+				listing = append(listing, item)
+			}
+			if err = rows.Err(); err != nil {
+				return err
+			}
+			return nil
+		}(); err != nil {
+			return listing, err
+		}
+	}
+	return listing, nil
+}
+
+// SetTiered marks the stable hsh:shard at timestamp as having its contents in
+// a remote tier and removes the local file, leaving the row as a stub. It
+// returns false without removing anything if that version is no longer
+// current or is already tiered.
+func (ot *IndexDB) SetTiered(hsh string, shard int, timestamp int64) (bool, error) {
+	hsh, _, dbPart, _, err := ValidateHash(hsh, ot.RingPartPower, ot.dbPartPower, ot.subdirs)
+	if err != nil {
+		return false, err
+	}
+	res, err := ot.dbs[dbPart].Exec(`
+		UPDATE objects SET tiered = 1
+		WHERE hash = ? AND shard = ? AND timestamp = ? AND nursery = 0 AND deletion = 0 AND tiered = 0
+	`, hsh, shard, timestamp)
+	if err != nil {
+		return false, err
+	}
+	if af, err := res.RowsAffected(); err != nil || af == 0 {
+		return false, err
+	}
+	pth, err := ot.WholeObjectPath(hsh, shard, timestamp, false)
+	if err != nil {
+		return true, err
+	}
+	if err = os.Remove(pth); err != nil && !os.IsNotExist(err) {
+		return true, err
+	}
+	return true, nil
+}
+
+// Rehydrate writes the contents of a tiered hsh:shard at timestamp, read from
+// r, back into place and marks it local again. The contents must match etag.
+func (ot *IndexDB) Rehydrate(hsh string, shard int, timestamp int64, r io.Reader, etag string) error {
+	hsh, _, dbPart, _, err := ValidateHash(hsh, ot.RingPartPower, ot.dbPartPower, ot.subdirs)
+	if err != nil {
+		return err
+	}
+	dir, err := ot.wholeObjectDir(hsh)
+	if err != nil {
+		return err
+	}
+	pth, err := ot.WholeObjectPath(hsh, shard, timestamp, false)
+	if err != nil {
+		return err
+	}
+	afw, err := fs.NewAtomicFileWriter(ot.temppath, dir)
+	if err != nil {
+		return err
+	}
+	defer afw.Abandon()
+	hash := md5.New()
+	if _, err = common.Copy(r, afw, hash); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != etag {
+		return fmt.Errorf("rehydrated contents of %s have etag %s, not %s", hsh, sum, etag)
+	}
+	if err = afw.Sync(); err != nil {
+		return err
+	}
+	tx, err := ot.dbs[dbPart].Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`
+		UPDATE objects SET tiered = 0
+		WHERE hash = ? AND shard = ? AND timestamp = ? AND nursery = 0 AND tiered = 1
+	`, hsh, shard, timestamp)
+	if err != nil {
+		return err
+	}
+	if af, err := res.RowsAffected(); err != nil {
+		return err
+	} else if af == 0 {
+		// Already rehydrated or replaced; nothing to put back.
+		return nil
+	}
+	if err = afw.Finalize(pth); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// TierStats returns the number of stable, undeleted items whose contents are
+// local and the number that are tiered.
+func (ot *IndexDB) TierStats() (local int64, tiered int64, err error) {
+	for _, db := range ot.dbs {
+		var l, t int64
+		if err = db.QueryRow(`
+			SELECT COALESCE(SUM(tiered = 0), 0), COALESCE(SUM(tiered = 1), 0)
+			FROM objects
+			WHERE nursery = 0 AND deletion = 0
+		`).Scan(&l, &t); err != nil {
+			return 0, 0, err
+		}
+		local += l
+		tiered += t
+	}
+	return local, tiered, nil
+}
+
+// SaveAsyncPending queues a container update, dropping any older ones for the
+// same object that it supersedes.
+func (ot *IndexDB) SaveAsyncPending(ap *AsyncPending) error {
+	hsh, _, dbPart, _, err := ValidateHash(ap.Hash, ot.RingPartPower, ot.dbPartPower, ot.subdirs)
+	if err != nil {
+		return err
+	}
+	headers, err := json.Marshal(ap.Headers)
+	if err != nil {
+		return err
+	}
+	tx, err := ot.dbs[dbPart].Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec("DELETE FROM async_pending WHERE hash = ? AND timestamp < ?", hsh, ap.Timestamp); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(`
+		INSERT OR IGNORE INTO async_pending (hash, timestamp, method, account, container, obj, headers, attempts, next_attempt)
+		SELECT ?, ?, ?, ?, ?, ?, ?, ?, ?
+		WHERE NOT EXISTS (SELECT 1 FROM async_pending WHERE hash = ? AND timestamp > ?)
+	`, hsh, ap.Timestamp, ap.Method, ap.Account, ap.Container, ap.Object, string(headers), ap.Attempts, ap.NextAttempt, hsh, ap.Timestamp); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ListAsyncPending returns queued container updates due to be tried by
+// before, a UnixNano time; up to limit from each database, those waiting
+// longest first.
+func (ot *IndexDB) ListAsyncPending(before int64, limit int) ([]*AsyncPending, error) {
+	listing := []*AsyncPending{}
+	for _, db := range ot.dbs {
+		if err := func() error {
+			rows, err := db.Query(`
+				SELECT hash, timestamp, method, account, container, obj, headers, attempts, next_attempt
+				FROM async_pending
+				WHERE next_attempt <= ?
+				ORDER BY next_attempt LIMIT ?
+			`, before, limit)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				ap := &AsyncPending{}
+				var headers []byte
+				if err = rows.Scan(&ap.Hash, &ap.Timestamp, &ap.Method, &ap.Account, &ap.Container, &ap.Object,
+					&headers, &ap.Attempts, &ap.NextAttempt); err != nil {
+					return err
+				}
+				if err = json.Unmarshal(headers, &ap.Headers); err != nil {
+					return fmt.Errorf("Error decoding async pending headers: %v", err)
+				}
+				if ap.Headers == nil {
+					ap.Headers = map[string]string{}
+				}
+				listing = append(listing, ap)
+			}
+			return rows.Err()
+		}(); err != nil {
+			return listing, err
+		}
+	}
+	return listing, nil
+}
+
+// RemoveAsyncPending drops a container update once it has been sent.
+func (ot *IndexDB) RemoveAsyncPending(hsh string, timestamp int64) error {
+	hsh, _, dbPart, _, err := ValidateHash(hsh, ot.RingPartPower, ot.dbPartPower, ot.subdirs)
+	if err != nil {
+		return err
+	}
+	_, err = ot.dbs[dbPart].Exec("DELETE FROM async_pending WHERE hash = ? AND timestamp = ?", hsh, timestamp)
+	return err
+}
+
+// RetryAsyncPending records a failed attempt at a container update, putting
+// off the next until nextAttempt, a UnixNano time.
+func (ot *IndexDB) RetryAsyncPending(hsh string, timestamp int64, nextAttempt int64) error {
+	hsh, _, dbPart, _, err := ValidateHash(hsh, ot.RingPartPower, ot.dbPartPower, ot.subdirs)
+	if err != nil {
+		return err
+	}
+	_, err = ot.dbs[dbPart].Exec(`
+		UPDATE async_pending SET attempts = attempts + 1, next_attempt = ?
+		WHERE hash = ? AND timestamp = ?
+	`, nextAttempt, hsh, timestamp)
+	return err
+}
+
+// AsyncPendingCount returns how many container updates are queued.
+func (ot *IndexDB) AsyncPendingCount() (int64, error) {
+	total := int64(0)
+	for _, db := range ot.dbs {
+		var count int64
+		if err := db.QueryRow("SELECT COUNT(*) FROM async_pending").Scan(&count); err != nil {
+			return 0, err
+		}
+		total += count
+	}
+	return total, nil
+}
+
 func (ot *IndexDB) StablePut(hsh string, shardIndex int, request *http.Request) error {
 	timestampTime, err := common.ParseDate(request.Header.Get("Meta-X-Timestamp"))
 	if err != nil {
 		return common.ErrBadRequest
 	}
 	timestamp := timestampTime.UnixNano()
+	if common.LooksTrue(request.Header.Get("X-Backend-Tiered")) {
+		return ot.StablePutTiered(hsh, shardIndex, timestamp, stableMetadata(request))
+	}
 	atm, err := ot.TempFile(hsh, shardIndex, timestamp, request.ContentLength, false)
 	if err != nil {
 		ot.logger.Error("could not make a tempfile", zap.String("hash", hsh), zap.Error(err))
@@ -731,18 +1345,7 @@ func (ot *IndexDB) StablePut(hsh string, shardIndex int, request *http.Request)
 		return common.ErrConflict
 	}
 	defer atm.Abandon()
-	metadata := make(map[string]string)
-	for key := range request.Header {
-		if strings.HasPrefix(key, "Meta-") {
-			if key == "Meta-Name" {
-				metadata["name"] = request.Header.Get(key)
-			} else if key == "Meta-Etag" {
-				metadata["ETag"] = request.Header.Get(key)
-			} else {
-				metadata[http.CanonicalHeaderKey(key[5:])] = request.Header.Get(key)
-			}
-		}
-	}
+	metadata := stableMetadata(request)
 	sHash := md5.New() // TODO: this is wasteful to calc this for whole objects
 	n, err := common.Copy(request.Body, atm, sHash)
 	if err == io.ErrUnexpectedEOF || (request.ContentLength >= 0 && n != request.ContentLength) {
@@ -760,6 +1363,12 @@ func (ot *IndexDB) StablePost(hsh string, shardIndex int, request *http.Request)
 		return common.ErrBadRequest
 	}
 	timestamp := timestampTime.UnixNano()
+	return ot.Commit(nil, hsh, shardIndex, timestamp, "POST", stableMetadata(request), false, "")
+}
+
+// stableMetadata returns the object metadata a replication request carries
+// in its Meta- headers.
+func stableMetadata(request *http.Request) map[string]string {
 	metadata := make(map[string]string)
 	for key := range request.Header {
 		if strings.HasPrefix(key, "Meta-") {
@@ -772,5 +1381,79 @@ func (ot *IndexDB) StablePost(hsh string, shardIndex int, request *http.Request)
 			}
 		}
 	}
-	return ot.Commit(nil, hsh, shardIndex, timestamp, "POST", metadata, false, "")
+	return metadata
+}
+
+// StablePutTiered records the stable hsh:shard at timestamp as a tiered stub,
+// for a replica whose contents are already in the remote tier. It returns
+// ErrConflict if a version at least as new is already there.
+func (ot *IndexDB) StablePutTiered(hsh string, shard int, timestamp int64, metadata map[string]string) error {
+	hsh, _, dbPart, _, err := ValidateHash(hsh, ot.RingPartPower, ot.dbPartPower, ot.subdirs)
+	if err != nil {
+		return err
+	}
+	metabytes, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("Error marshalling metadata: %v", err)
+	}
+	metahash := MetadataHash(metadata)
+	var expires, storageClass *string
+	if xda, ok := metadata["X-Delete-At"]; ok {
+		expires = &xda
+	}
+	if sc, ok := metadata["X-Object-Storage-Class"]; ok {
+		storageClass = &sc
+	}
+	var dbMetabytes interface{} = metabytes
+	if len(metabytes) > sidecarMetadataSize {
+		dbMetabytes = sidecarMarker
+	}
+	tx, err := ot.dbs[dbPart].Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var dbTimestamp int64
+	var dbDeletion, dbTiered bool
+	err = tx.QueryRow(`
+		SELECT timestamp, deletion, tiered FROM objects
+		WHERE hash = ? AND shard = ? AND nursery = 0
+	`, hsh, shard).Scan(&dbTimestamp, &dbDeletion, &dbTiered)
+	if err == sql.ErrNoRows {
+		_, err = tx.Exec(`
+			INSERT INTO objects (hash, shard, timestamp, deletion, metahash, metadata, nursery, shardhash, restabilize, expires, storage_class, tiered)
+			VALUES (?, ?, ?, 0, ?, ?, 0, '', 0, ?, ?, 1)
+		`, hsh, shard, timestamp, metahash, dbMetabytes, expires, storageClass)
+	} else if err != nil {
+		return err
+	} else if dbTimestamp >= timestamp {
+		return common.ErrConflict
+	} else {
+		_, err = tx.Exec(`
+			UPDATE objects
+			SET timestamp = ?, deletion = 0, metahash = ?, metadata = ?, shardhash = '', restabilize = 0, expires = ?,
+				storage_class = ?, tiered = 1, accessed = NULL
+			WHERE hash = ? AND shard = ? AND nursery = 0
+		`, timestamp, metahash, dbMetabytes, expires, storageClass, hsh, shard)
+	}
+	if err == nil && len(metabytes) > sidecarMetadataSize {
+		_, err = tx.Exec(`
+			INSERT OR REPLACE INTO metadata_sidecar (hash, shard, timestamp, nursery, metadata)
+			VALUES (?, ?, ?, 0, ?)
+		`, hsh, shard, timestamp, metabytes)
+	}
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	if dbTimestamp != 0 && !dbDeletion && !dbTiered {
+		if pth, err := ot.WholeObjectPath(hsh, shard, dbTimestamp, false); err == nil {
+			if err = os.Remove(pth); err != nil && !os.IsNotExist(err) {
+				ot.logger.Error("error removing older file", zap.Error(err), zap.String("path", pth))
+			}
+		}
+	}
+	return nil
 }
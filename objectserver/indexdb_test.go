@@ -3,10 +3,12 @@ package objectserver
 import (
 	"crypto/md5"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -31,7 +33,7 @@ func md5hash(data string) string {
 
 func newTestIndexDB(t *testing.T, pth string) *IndexDB {
 	t.Helper()
-	ot, err := NewIndexDB(pth, pth, pth, 2, 1, 1, 0, zap.L(), fakeIndexDBAuditor{})
+	ot, err := NewIndexDB(pth, pth, pth, 2, 1, 1, 0, 0, zap.L(), fakeIndexDBAuditor{})
 	errnil(t, err)
 	return ot
 }
@@ -44,6 +46,20 @@ func TestNewIndexDB_notExistsAndAlreadyExists(t *testing.T) {
 	ot = newTestIndexDB(t, pth)
 }
 
+func TestNewIndexDB_cacheSize(t *testing.T) {
+	pth, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(pth)
+	// 1MiB split between the 2 databases of dbPartPower 1.
+	ot, err := NewIndexDB(pth, pth, pth, 2, 1, 1, 0, 1<<20, zap.L(), fakeIndexDBAuditor{})
+	errnil(t, err)
+	defer ot.Close()
+	var cacheSize int
+	errnil(t, ot.dbs[1].QueryRow("PRAGMA cache_size").Scan(&cacheSize))
+	if cacheSize != -512 {
+		t.Fatalf("cache_size was %d, expected -512", cacheSize)
+	}
+}
+
 func TestIndexDB_Commit(t *testing.T) {
 	pth, _ := ioutil.TempDir("", "")
 	defer os.RemoveAll(pth)
@@ -204,6 +220,87 @@ func TestIndexDB_Lookup(t *testing.T) {
 	}
 }
 
+func TestIndexDB_LookupTimestamp(t *testing.T) {
+	pth, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(pth)
+	ot := newTestIndexDB(t, pth)
+	defer ot.Close()
+	hsh := md5hash("object1")
+	i, err := ot.LookupTimestamp(hsh, 0)
+	require.Nil(t, err)
+	require.Nil(t, i)
+	timestamp := time.Now().UnixNano()
+	f, err := ot.TempFile(hsh, 0, timestamp, 4, true)
+	require.Nil(t, err)
+	f.Write([]byte("test"))
+	require.Nil(t, ot.Commit(f, hsh, 0, timestamp, "PUT", map[string]string{"X-Delete-At": "12345"}, true, ""))
+	i, err = ot.LookupTimestamp(hsh, 0)
+	require.Nil(t, err)
+	require.Equal(t, timestamp, i.Timestamp)
+	require.False(t, i.Deletion)
+	require.Equal(t, int64(12345), *i.Expires)
+	require.Nil(t, i.Metabytes)
+	require.Equal(t, "", i.Path)
+	require.Nil(t, ot.Commit(nil, hsh, 0, timestamp+1, "DELETE", map[string]string{}, true, ""))
+	i, err = ot.LookupTimestamp(hsh, 0)
+	require.Nil(t, err)
+	require.Equal(t, timestamp+1, i.Timestamp)
+	require.True(t, i.Deletion)
+}
+
+func TestIndexDB_AsyncPending(t *testing.T) {
+	pth, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(pth)
+	ot := newTestIndexDB(t, pth)
+	defer ot.Close()
+	hsh := md5hash("object1")
+	require.Nil(t, ot.SaveAsyncPending(&AsyncPending{Hash: hsh, Timestamp: 100, Method: "PUT", Account: "a", Container: "c", Object: "o1",
+		Headers: map[string]string{"X-Size": "4"}}))
+	// A newer update supersedes it, and an older one is dropped.
+	require.Nil(t, ot.SaveAsyncPending(&AsyncPending{Hash: hsh, Timestamp: 200, Method: "DELETE", Account: "a", Container: "c", Object: "o1"}))
+	require.Nil(t, ot.SaveAsyncPending(&AsyncPending{Hash: hsh, Timestamp: 150, Method: "PUT", Account: "a", Container: "c", Object: "o1"}))
+	hsh2 := md5hash("object2")
+	require.Nil(t, ot.SaveAsyncPending(&AsyncPending{Hash: hsh2, Timestamp: 100, Method: "PUT", Account: "a", Container: "c", Object: "o2",
+		Headers: map[string]string{"X-Size": "4"}}))
+	count, err := ot.AsyncPendingCount()
+	require.Nil(t, err)
+	require.Equal(t, int64(2), count)
+
+	aps, err := ot.ListAsyncPending(0, 10)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(aps))
+	for _, ap := range aps {
+		if ap.Hash == hsh {
+			require.Equal(t, int64(200), ap.Timestamp)
+			require.Equal(t, "DELETE", ap.Method)
+		} else {
+			require.Equal(t, "o2", ap.Object)
+			require.Equal(t, map[string]string{"X-Size": "4"}, ap.Headers)
+		}
+	}
+
+	require.Nil(t, ot.RetryAsyncPending(hsh, 200, 1000))
+	aps, err = ot.ListAsyncPending(999, 10)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(aps))
+	require.Equal(t, hsh2, aps[0].Hash)
+	aps, err = ot.ListAsyncPending(1000, 10)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(aps))
+	for _, ap := range aps {
+		if ap.Hash == hsh {
+			require.Equal(t, 1, ap.Attempts)
+		} else {
+			require.Equal(t, 0, ap.Attempts)
+		}
+	}
+
+	require.Nil(t, ot.RemoveAsyncPending(hsh2, 100))
+	count, err = ot.AsyncPendingCount()
+	require.Nil(t, err)
+	require.Equal(t, int64(1), count)
+}
+
 func TestIndexDB_Lookup_withOverwrite(t *testing.T) {
 	pth, _ := ioutil.TempDir("", "")
 	defer os.RemoveAll(pth)
@@ -578,7 +675,7 @@ func TestIndexDB_ListDefaults(t *testing.T) {
 func TestIndexDB_RingPartRange(t *testing.T) {
 	pth, _ := ioutil.TempDir("", "")
 	defer os.RemoveAll(pth)
-	ot, err := NewIndexDB(pth, pth, pth, 4, 1, 1, 0, zap.L(), fakeIndexDBAuditor{})
+	ot, err := NewIndexDB(pth, pth, pth, 4, 1, 1, 0, 0, zap.L(), fakeIndexDBAuditor{})
 	errnil(t, err)
 	defer ot.Close()
 	startHash, stopHash := ot.RingPartRange(0)
@@ -602,7 +699,7 @@ func TestIndexDB_RingPartRange(t *testing.T) {
 	if stopHash != "ffffffffffffffffffffffffffffffff" {
 		t.Fatal(stopHash)
 	}
-	ot, err = NewIndexDB(pth, pth, pth, 8, 1, 1, 0, zap.L(), fakeIndexDBAuditor{})
+	ot, err = NewIndexDB(pth, pth, pth, 8, 1, 1, 0, 0, zap.L(), fakeIndexDBAuditor{})
 	errnil(t, err)
 	defer ot.Close()
 	startHash, stopHash = ot.RingPartRange(0)
@@ -655,9 +752,181 @@ func TestIndexDB_Expire(t *testing.T) {
 		t.Fatal(err)
 	}
 	path := i.Path
-	require.Nil(t, ot.ExpireObjects())
+	expired, err := ot.ExpireObjects(0)
+	require.Nil(t, err)
+	require.Equal(t, 1, expired)
 	i, err = ot.Lookup(hsh, 0, false)
 	require.Nil(t, i)
 	require.Nil(t, err)
 	require.False(t, fs.Exists(path))
 }
+
+func TestIndexDB_PartitionHash(t *testing.T) {
+	pth1, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(pth1)
+	pth2, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(pth2)
+	ot1 := newTestIndexDB(t, pth1)
+	defer ot1.Close()
+	ot2 := newTestIndexDB(t, pth2)
+	defer ot2.Close()
+	put := func(ot *IndexDB, hsh string, timestamp int64, nursery bool) {
+		body := "just testing"
+		f, err := ot.TempFile(hsh, 0, timestamp, int64(len(body)), nursery)
+		errnil(t, err)
+		f.Write([]byte(body))
+		errnil(t, ot.Commit(f, hsh, 0, timestamp, "PUT", map[string]string{"Content-Length": "12"}, nursery, ""))
+	}
+	partHashes := func(ot *IndexDB) []string {
+		hashes := []string{}
+		for part := 0; part < 1<<ot.RingPartPower; part++ {
+			h, err := ot.PartitionHash(part)
+			errnil(t, err)
+			hashes = append(hashes, h)
+		}
+		return hashes
+	}
+	empty := partHashes(ot1)
+	require.Equal(t, "00000000000000000000000000000000", empty[0])
+	timestamp := time.Now().UnixNano()
+	// Same stable objects committed in opposite orders should hash the same.
+	for i := 0; i < 16; i++ {
+		put(ot1, md5hash(fmt.Sprintf("object%d", i)), timestamp, false)
+	}
+	for i := 15; i >= 0; i-- {
+		put(ot2, md5hash(fmt.Sprintf("object%d", i)), timestamp, false)
+	}
+	require.Equal(t, partHashes(ot1), partHashes(ot2))
+	require.NotEqual(t, empty, partHashes(ot1))
+	// Nursery objects are not yet stable and should not affect the hash.
+	before := partHashes(ot1)
+	put(ot1, md5hash("nurseryobject"), timestamp, true)
+	require.Equal(t, before, partHashes(ot1))
+	// A newer version of one object should change exactly one partition.
+	hsh := md5hash("object3")
+	put(ot2, hsh, timestamp+1, false)
+	_, ringPart, _, _, err := ValidateHash(hsh, ot2.RingPartPower, ot2.dbPartPower, ot2.subdirs)
+	errnil(t, err)
+	after := partHashes(ot2)
+	for part := range after {
+		if part == ringPart {
+			require.NotEqual(t, before[part], after[part])
+		} else {
+			require.Equal(t, before[part], after[part])
+		}
+	}
+	_, err = ot1.PartitionHash(1 << ot1.RingPartPower)
+	require.NotNil(t, err)
+}
+
+func TestIndexDB_PartitionTree(t *testing.T) {
+	pth, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(pth)
+	ot := newTestIndexDB(t, pth)
+	defer ot.Close()
+	put := func(hsh string, timestamp int64) {
+		body := "just testing"
+		f, err := ot.TempFile(hsh, 0, timestamp, int64(len(body)), false)
+		errnil(t, err)
+		f.Write([]byte(body))
+		errnil(t, ot.Commit(f, hsh, 0, timestamp, "PUT", map[string]string{"Content-Length": "12"}, false, ""))
+	}
+	timestamp := time.Now().UnixNano()
+	for i := 0; i < 64; i++ {
+		put(md5hash(fmt.Sprintf("object%d", i)), timestamp)
+	}
+	hsh := md5hash("object3")
+	_, ringPart, _, _, err := ValidateHash(hsh, ot.RingPartPower, ot.dbPartPower, ot.subdirs)
+	errnil(t, err)
+	before, err := ot.PartitionTree(ringPart, 2)
+	errnil(t, err)
+	require.Equal(t, 3, len(before))
+	require.Equal(t, 1, len(before[0]))
+	require.Equal(t, 16, len(before[1]))
+	require.Equal(t, 256, len(before[2]))
+	partHash, err := ot.PartitionHash(ringPart)
+	errnil(t, err)
+	require.Equal(t, partHash, before[0][0])
+	// A newer version of one object should change exactly one node per level,
+	// and the changed leaf's range should cover that object.
+	put(hsh, timestamp+1)
+	after, err := ot.PartitionTree(ringPart, 2)
+	errnil(t, err)
+	for level := range after {
+		changed := []int{}
+		for n := range after[level] {
+			if after[level][n] != before[level][n] {
+				changed = append(changed, n)
+			}
+		}
+		require.Equal(t, 1, len(changed))
+		start, stop := ot.PartitionTreeRange(ringPart, level, changed[0])
+		require.True(t, start <= hsh && hsh <= stop)
+	}
+	_, err = ot.PartitionTree(ringPart, MaxPartitionTreeLevel+1)
+	require.NotNil(t, err)
+}
+
+func TestIndexDB_SidecarMetadata(t *testing.T) {
+	pth, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(pth)
+	ot := newTestIndexDB(t, pth)
+	defer ot.Close()
+	hsh := md5hash("object1")
+	_, _, dbPart, _, err := ValidateHash(hsh, ot.RingPartPower, ot.dbPartPower, ot.subdirs)
+	errnil(t, err)
+	db := ot.dbs[dbPart]
+	put := func(timestamp int64, metadata map[string]string, nursery bool) {
+		body := "just testing"
+		f, err := ot.TempFile(hsh, 0, timestamp, int64(len(body)), nursery)
+		errnil(t, err)
+		f.Write([]byte(body))
+		errnil(t, ot.Commit(f, hsh, 0, timestamp, "PUT", metadata, nursery, ""))
+	}
+	sidecars := func() int {
+		var count int
+		errnil(t, db.QueryRow("SELECT COUNT(*) FROM metadata_sidecar").Scan(&count))
+		return count
+	}
+	bigMetadata := map[string]string{"X-Object-Meta-Big": strings.Repeat("x", sidecarMetadataSize)}
+	timestamp := time.Now().UnixNano()
+	put(timestamp, bigMetadata, true)
+	var inline string
+	errnil(t, db.QueryRow("SELECT metadata FROM objects WHERE hash = ?", hsh).Scan(&inline))
+	require.Equal(t, sidecarMarker, inline)
+	require.Equal(t, 1, sidecars())
+	i, err := ot.Lookup(hsh, 0, false)
+	errnil(t, err)
+	require.Equal(t, sidecarMarker, string(i.Metabytes))
+	errnil(t, ot.LoadMetadata(i))
+	metadata := map[string]string{}
+	errnil(t, json.Unmarshal(i.Metabytes, &metadata))
+	require.Equal(t, bigMetadata, metadata)
+	// Stabilizing moves the sidecar along with its row.
+	errnil(t, ot.SetStabilized(hsh, 0, timestamp, true))
+	require.Equal(t, 1, sidecars())
+	items, err := ot.List("", "", "", 0)
+	errnil(t, err)
+	require.Equal(t, 1, len(items))
+	require.Equal(t, sidecarMarker, string(items[0].Metabytes))
+	errnil(t, ot.LoadMetadata(items[0]))
+	metadata = map[string]string{}
+	errnil(t, json.Unmarshal(items[0].Metabytes, &metadata))
+	require.Equal(t, bigMetadata, metadata)
+	// A newer object with small metadata goes back inline.
+	put(timestamp+1, map[string]string{"X-Object-Meta-Small": "x"}, false)
+	require.Equal(t, 0, sidecars())
+	i, err = ot.Lookup(hsh, 0, true)
+	errnil(t, err)
+	require.Equal(t, `{"X-Object-Meta-Small":"x"}`, string(i.Metabytes))
+	errnil(t, ot.LoadMetadata(i))
+	require.Equal(t, `{"X-Object-Meta-Small":"x"}`, string(i.Metabytes))
+	// Removing the row removes its sidecar.
+	put(timestamp+2, bigMetadata, false)
+	require.Equal(t, 1, sidecars())
+	i, err = ot.Lookup(hsh, 0, true)
+	errnil(t, err)
+	_, err = ot.Remove(hsh, 0, i.Timestamp, false, i.Metahash)
+	errnil(t, err)
+	require.Equal(t, 0, sidecars())
+}
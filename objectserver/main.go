@@ -18,6 +18,7 @@ package objectserver
 import (
 	"crypto/md5"
 	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -38,11 +39,11 @@ import (
 	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/conf"
 	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/ring"
 	"github.com/troubling/hummingbird/common/srv"
 	"github.com/troubling/hummingbird/common/tracing"
 	"github.com/troubling/hummingbird/middleware"
 	"github.com/uber-go/tally"
-	promreporter "github.com/uber-go/tally/prometheus"
 	"go.uber.org/zap"
 	"golang.org/x/net/http2"
 )
@@ -59,15 +60,36 @@ type ObjectServer struct {
 	logLevel           zap.AtomicLevel
 	diskInUse          *common.KeyedLimit
 	accountDiskInUse   *common.KeyedLimit
+	repDiskInUse       *common.KeyedLimit
+	diskByteLimit      *common.KeyedRateLimit
+	repByteLimit       *common.KeyedRateLimit
+	bufferSize         int64
+	bufferBudget       *common.ByteBudget
+	bufferPool         common.FreePool
+	adminAuth          *middleware.AdminAuth
+	signingKeys        [][]byte
 	expiringDivisor    int64
 	updateClient       common.HTTPClient
 	objEngines         map[int]ObjectEngine
+	policies           conf.PolicyList
 	updateTimeout      time.Duration
 	asyncWG            sync.WaitGroup // Used to wait on async goroutines
 	metricsCloser      io.Closer
 	traceCloser        io.Closer
 	tracer             opentracing.Tracer
 	updateClientCloser io.Closer
+
+	readRepair         bool
+	readRepairTimeout  time.Duration
+	readRepairMaxSize  int64
+	readRepairIPs      map[string]bool
+	readRepairPort     int
+	repairRings        map[int]ring.Ring
+	repairClient       *http.Client
+	readRepairs        tally.Counter
+	readRepairFailures tally.Counter
+	disableFile        string
+	readyChecks        []middleware.ReadyCheck
 }
 
 func (server *ObjectServer) Type() string {
@@ -80,6 +102,11 @@ func (server *ObjectServer) Background(flags *flag.FlagSet) chan struct{} {
 
 func (server *ObjectServer) Finalize() {
 	server.asyncWG.Wait()
+	for policy, engine := range server.objEngines {
+		if err := engine.Close(); err != nil {
+			server.logger.Error("Error closing object engine", zap.Int("policy", policy), zap.Error(err))
+		}
+	}
 	if server.metricsCloser != nil {
 		server.metricsCloser.Close()
 	}
@@ -103,6 +130,21 @@ func (server *ObjectServer) newObject(req *http.Request, vars map[string]string,
 	return engine.New(vars, needData, &server.asyncWG)
 }
 
+// policyReadOnly reports whether the request writes to a policy marked
+// read_only. Replication and read repair still write so the policy's copies
+// stay whole.
+func (server *ObjectServer) policyReadOnly(req *http.Request) bool {
+	policy, err := strconv.Atoi(req.Header.Get("X-Backend-Storage-Policy-Index"))
+	if err != nil {
+		policy = 0
+	}
+	if p := server.policies[policy]; p == nil || !p.ReadOnly {
+		return false
+	}
+	ua := req.Header.Get("User-Agent")
+	return ua != "nursery-stabilizer" && ua != "object-server-read-repair"
+}
+
 func resolveEtag(req *http.Request, metadata map[string]string) string {
 	etag := metadata["ETag"]
 	for _, ph := range strings.Split(req.Header.Get("X-Backend-Etag-Is-At"), ",") {
@@ -114,9 +156,46 @@ func resolveEtag(req *http.Request, metadata map[string]string) string {
 	return etag
 }
 
+// timestampOnlyHead answers a HEAD with X-Backend-Timestamp-Only set with
+// just the object's X-Backend-Timestamp, if its engine can look that up
+// cheaply. It returns false if the request needs a full HEAD instead.
+func (server *ObjectServer) timestampOnlyHead(writer http.ResponseWriter, request *http.Request, vars map[string]string) bool {
+	if request.Method != "HEAD" || !common.LooksTrue(request.Header.Get("X-Backend-Timestamp-Only")) {
+		return false
+	}
+	policy, err := strconv.Atoi(request.Header.Get("X-Backend-Storage-Policy-Index"))
+	if err != nil {
+		policy = 0
+	}
+	engine, ok := server.objEngines[policy].(TimestampOnlyObjectEngine)
+	if !ok {
+		return false
+	}
+	timestamp, exists, err := engine.TimestampOnly(vars)
+	if err != nil {
+		srv.GetLogger(request).Error("Unable to look up object timestamp.", zap.Error(err))
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return true
+	}
+	if timestamp != "" {
+		writer.Header().Set("X-Backend-Timestamp", timestamp)
+	}
+	writer.Header().Set("X-Backend-Timestamp-Only", "true")
+	if !exists {
+		srv.StandardResponse(writer, http.StatusNotFound)
+		return true
+	}
+	writer.Header().Set("Content-Length", "0")
+	writer.WriteHeader(http.StatusOK)
+	return true
+}
+
 func (server *ObjectServer) ObjGetHandler(writer http.ResponseWriter, request *http.Request) {
 	vars := srv.GetVars(request)
 	headers := writer.Header()
+	if server.timestampOnlyHead(writer, request, vars) {
+		return
+	}
 	obj, err := server.newObject(request, vars, request.Method == "GET")
 	if err != nil {
 		srv.GetLogger(request).Error("Unable to open object.", zap.Error(err))
@@ -227,6 +306,13 @@ func (server *ObjectServer) ObjGetHandler(writer http.ResponseWriter, request *h
 			return
 		}
 	}
+	var repairRing ring.Ring
+	if request.Method == "GET" && server.checkEtags && server.readRepair {
+		if repairRing = server.repairRing(request); repairRing != nil && obj.ContentLength() <= server.readRepairMaxSize {
+			server.verifiedGet(writer, request, vars, obj, metadata, repairRing)
+			return
+		}
+	}
 	writer.WriteHeader(http.StatusOK)
 	if request.Method == "GET" {
 		if server.checkEtags {
@@ -236,6 +322,9 @@ func (server *ObjectServer) ObjGetHandler(writer http.ResponseWriter, request *h
 				srv.GetLogger(request).Error("Error copying body", zap.Error(err))
 			} else if hex.EncodeToString(hash.Sum(nil)) != metadata["ETag"] {
 				obj.Quarantine()
+				if repairRing != nil {
+					server.repairInBackground(request, vars, metadata, obj.ContentLength(), repairRing)
+				}
 			}
 		} else {
 			_, err := obj.Copy(writer)
@@ -248,7 +337,22 @@ func (server *ObjectServer) ObjGetHandler(writer http.ResponseWriter, request *h
 	}
 }
 
+// retainedUntil returns the unix time an object can't be overwritten or
+// deleted until: the later of the retention stored with it and the one its
+// container has now, which the proxy sends as X-Backend-Retention-Until.
+func retainedUntil(stored string, request *http.Request) int64 {
+	until, _ := strconv.ParseInt(stored, 10, 64)
+	if u, err := strconv.ParseInt(request.Header.Get("X-Backend-Retention-Until"), 10, 64); err == nil && u > until {
+		until = u
+	}
+	return until
+}
+
 func (server *ObjectServer) ObjPutHandler(writer http.ResponseWriter, request *http.Request) {
+	if server.policyReadOnly(request) {
+		srv.StandardResponse(writer, http.StatusMethodNotAllowed)
+		return
+	}
 	vars := srv.GetVars(request)
 	outHeaders := writer.Header()
 
@@ -270,8 +374,15 @@ func (server *ObjectServer) ObjPutHandler(writer http.ResponseWriter, request *h
 		if deleteTime, err := common.ParseDate(deleteAt); err != nil || deleteTime.Before(time.Now()) {
 			http.Error(writer, "X-Delete-At in past", 400)
 			return
+		} else if until := retainedUntil(request.Header.Get("X-Object-Sysmeta-Retention-Until"), request); deleteTime.Unix() < until {
+			http.Error(writer, fmt.Sprintf("X-Delete-At before retention ends at %d", until), 400)
+			return
 		}
 	}
+	if sc := request.Header.Get("X-Object-Storage-Class"); sc != "" && !common.StorageClasses[sc] {
+		http.Error(writer, fmt.Sprintf("Invalid X-Object-Storage-Class %q", sc), http.StatusBadRequest)
+		return
+	}
 
 	obj, err := server.newObject(request, vars, false)
 	if err != nil {
@@ -281,12 +392,14 @@ func (server *ObjectServer) ObjPutHandler(writer http.ResponseWriter, request *h
 	}
 	defer obj.Close()
 
+	origDeleteAt := ""
 	if obj.Exists() {
 		if inm := request.Header.Get("If-None-Match"); inm == "*" {
 			srv.StandardResponse(writer, http.StatusPreconditionFailed)
 			return
 		}
 		metadata := obj.Metadata()
+		origDeleteAt = metadata["X-Delete-At"]
 		if requestTime, err := common.ParseDate(requestTimestamp); err == nil {
 			if lastModified, err := common.ParseDate(metadata["X-Timestamp"]); err == nil && !requestTime.After(lastModified) {
 				outHeaders.Set("X-Backend-Timestamp", metadata["X-Timestamp"])
@@ -294,6 +407,10 @@ func (server *ObjectServer) ObjPutHandler(writer http.ResponseWriter, request *h
 				return
 			}
 		}
+		if until := retainedUntil(metadata["X-Object-Sysmeta-Retention-Until"], request); until > time.Now().Unix() {
+			http.Error(writer, fmt.Sprintf("Object is retained until %d", until), http.StatusConflict)
+			return
+		}
 		if inm := request.Header.Get("If-None-Match"); inm != "*" && strings.Contains(inm, metadata["ETag"]) {
 			srv.StandardResponse(writer, http.StatusPreconditionFailed)
 			return
@@ -312,7 +429,12 @@ func (server *ObjectServer) ObjPutHandler(writer http.ResponseWriter, request *h
 	}
 
 	hash := md5.New()
-	totalSize, err := common.Copy(request.Body, tempFile, hash)
+	buf, ok := server.bufferPool.Get().([]byte)
+	if !ok {
+		buf = make([]byte, server.bufferSize)
+	}
+	totalSize, err := io.CopyBuffer(io.MultiWriter(tempFile, hash), request.Body, buf)
+	server.bufferPool.Put(buf)
 	if err == io.ErrUnexpectedEOF || (request.ContentLength >= 0 && totalSize != request.ContentLength) {
 		srv.StandardResponse(writer, 499)
 		return
@@ -335,10 +457,20 @@ func (server *ObjectServer) ObjPutHandler(writer http.ResponseWriter, request *h
 			metadata[key] = request.Header.Get(key)
 		}
 	}
-	requestEtag := strings.Trim(strings.ToLower(request.Header.Get("ETag")), "\"")
-	if requestEtag != "" && requestEtag != metadata["ETag"] {
-		http.Error(writer, "Unprocessable Entity", 422)
-		return
+	// The proxy sends sysmeta it only knows once the body has been streamed,
+	// like encrypted etags, as trailers.
+	for key := range request.Trailer {
+		if strings.HasPrefix(key, "X-Object-Sysmeta-") {
+			metadata[key] = request.Trailer.Get(key)
+		}
+	}
+	// Clients that can't know the digest before streaming may send it as a
+	// trailer on a chunked PUT, which is only available once the body is read.
+	for _, expected := range common.ExpectedEtags(request.Header, request.Trailer) {
+		if expected != metadata["ETag"] {
+			http.Error(writer, "Unprocessable Entity", 422)
+			return
+		}
 	}
 	outHeaders.Set("ETag", metadata["ETag"])
 
@@ -346,11 +478,18 @@ func (server *ObjectServer) ObjPutHandler(writer http.ResponseWriter, request *h
 		srv.ErrorResponse(writer, err)
 		return
 	}
+	if origDeleteAt != "" && origDeleteAt != request.Header.Get("X-Delete-At") {
+		server.updateDeleteAt("DELETE", origDeleteAt, request, vars, srv.GetLogger(request))
+	}
 	server.containerUpdates(writer, request, metadata, request.Header.Get("X-Delete-At"), vars, srv.GetLogger(request))
 	srv.StandardResponse(writer, http.StatusCreated)
 }
 
 func (server *ObjectServer) ObjPostHandler(writer http.ResponseWriter, request *http.Request) {
+	if server.policyReadOnly(request) {
+		srv.StandardResponse(writer, http.StatusMethodNotAllowed)
+		return
+	}
 	vars := srv.GetVars(request)
 
 	requestTimestamp, err := common.StandardizeTimestamp(request.Header.Get("X-Timestamp"))
@@ -392,6 +531,10 @@ func (server *ObjectServer) ObjPostHandler(writer http.ResponseWriter, request *
 		http.Error(writer, fmt.Sprintf("Content-Type may not be sent with object POST: %q", t), http.StatusConflict)
 		return
 	}
+	if t := request.Header.Get("X-Object-Storage-Class"); t != "" && t != origMetadata["X-Object-Storage-Class"] {
+		http.Error(writer, fmt.Sprintf("X-Object-Storage-Class may not be sent with object POST: %q", t), http.StatusConflict)
+		return
+	}
 
 	metadata := make(map[string]string)
 	if v, ok := origMetadata["X-Static-Large-Object"]; ok {
@@ -400,6 +543,9 @@ func (server *ObjectServer) ObjPostHandler(writer http.ResponseWriter, request *
 	if v, ok := origMetadata["Ec-Scheme"]; ok {
 		metadata["Ec-Scheme"] = v
 	}
+	if v, ok := origMetadata["X-Object-Storage-Class"]; ok {
+		metadata["X-Object-Storage-Class"] = v
+	}
 	copyHdrs := map[string]bool{"Content-Disposition": true, "Content-Encoding": true, "X-Delete-At": true, "X-Object-Manifest": true, "X-Static-Large-Object": true}
 	for _, v := range strings.Fields(request.Header.Get("X-Backend-Replication-Headers")) {
 		copyHdrs[v] = true
@@ -424,6 +570,10 @@ func (server *ObjectServer) ObjPostHandler(writer http.ResponseWriter, request *
 }
 
 func (server *ObjectServer) ObjDeleteHandler(writer http.ResponseWriter, request *http.Request) {
+	if server.policyReadOnly(request) {
+		srv.StandardResponse(writer, http.StatusMethodNotAllowed)
+		return
+	}
 	vars := srv.GetVars(request)
 	headers := writer.Header()
 	requestTimestamp, err := common.StandardizeTimestamp(request.Header.Get("X-Timestamp"))
@@ -476,6 +626,13 @@ func (server *ObjectServer) ObjDeleteHandler(writer http.ResponseWriter, request
 			srv.StandardResponse(writer, http.StatusConflict)
 			return
 		}
+		// The policy migration mover deletes objects it has copied, with
+		// their retention, to the new policy.
+		if until := retainedUntil(metadata["X-Object-Sysmeta-Retention-Until"], request); until > time.Now().Unix() &&
+			!common.LooksTrue(request.Header.Get("X-Backend-Retention-Moved")) {
+			http.Error(writer, fmt.Sprintf("Object is retained until %d", until), http.StatusConflict)
+			return
+		}
 	} else {
 		responseStatus = http.StatusNotFound
 	}
@@ -499,10 +656,13 @@ func (server *ObjectServer) ObjDeleteHandler(writer http.ResponseWriter, request
 }
 
 func (server *ObjectServer) HealthcheckHandler(writer http.ResponseWriter, request *http.Request) {
-	writer.Header().Set("Content-Length", "2")
-	writer.WriteHeader(http.StatusOK)
-	writer.Write([]byte("OK"))
-	return
+	middleware.HealthcheckHandler(server.disableFile)(writer, request)
+}
+
+// ReadyHandler reports whether the server's rings and devices are ready for
+// it to serve requests.
+func (server *ObjectServer) ReadyHandler(writer http.ResponseWriter, request *http.Request) {
+	middleware.ReadyHandler(server.disableFile, server.readyChecks...)(writer, request)
 }
 
 func (server *ObjectServer) ReconHandler(writer http.ResponseWriter, request *http.Request) {
@@ -527,6 +687,99 @@ func (server *ObjectServer) DiskUsageHandler(writer http.ResponseWriter, request
 	return
 }
 
+// DiskLimits are the object server's per device concurrency and byte rate
+// limits, which can be changed at runtime with a PUT to /disklimits. Changes
+// last until the server restarts.
+type DiskLimits struct {
+	DiskLimit                 int64 `json:"disk_limit"`
+	DiskTotalLimit            int64 `json:"disk_total_limit"`
+	ReplicationDiskLimit      int64 `json:"replication_disk_limit"`
+	ReplicationDiskTotalLimit int64 `json:"replication_disk_total_limit"`
+	DiskByteLimit             int64 `json:"disk_byte_limit"`
+	ReplicationDiskByteLimit  int64 `json:"replication_disk_byte_limit"`
+}
+
+func (server *ObjectServer) diskLimits() DiskLimits {
+	var limits DiskLimits
+	limits.DiskLimit, limits.DiskTotalLimit = server.diskInUse.Limits()
+	limits.ReplicationDiskLimit, limits.ReplicationDiskTotalLimit = server.repDiskInUse.Limits()
+	limits.DiskByteLimit = server.diskByteLimit.Rate()
+	limits.ReplicationDiskByteLimit = server.repByteLimit.Rate()
+	return limits
+}
+
+func (server *ObjectServer) DiskLimitsHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method == "PUT" {
+		// Fields left out of the request keep their current values.
+		limits := server.diskLimits()
+		if err := json.NewDecoder(request.Body).Decode(&limits); err != nil {
+			srv.SimpleErrorResponse(writer, http.StatusBadRequest, err.Error())
+			return
+		}
+		if limits.DiskLimit < 0 || limits.DiskTotalLimit < 0 || limits.ReplicationDiskLimit < 0 ||
+			limits.ReplicationDiskTotalLimit < 0 || limits.DiskByteLimit < 0 || limits.ReplicationDiskByteLimit < 0 {
+			srv.SimpleErrorResponse(writer, http.StatusBadRequest, "Limits cannot be negative")
+			return
+		}
+		server.diskInUse.SetLimits(limits.DiskLimit, limits.DiskTotalLimit)
+		server.repDiskInUse.SetLimits(limits.ReplicationDiskLimit, limits.ReplicationDiskTotalLimit)
+		server.diskByteLimit.SetRate(limits.DiskByteLimit)
+		server.repByteLimit.SetRate(limits.ReplicationDiskByteLimit)
+		server.logger.Info("Disk limits changed", zap.Any("limits", limits))
+	}
+	data, err := json.Marshal(server.diskLimits())
+	if err != nil {
+		srv.SimpleErrorResponse(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(data)
+}
+
+// throttledReadCloser and throttledWriter hold request and response bodies
+// to a device's byte rate limits.
+type throttledReadCloser struct {
+	io.ReadCloser
+	wait func(int)
+}
+
+func (t *throttledReadCloser) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	t.wait(n)
+	return n, err
+}
+
+type throttledWriter struct {
+	http.ResponseWriter
+	wait func(int)
+}
+
+func (t *throttledWriter) Write(b []byte) (int, error) {
+	t.wait(len(b))
+	return t.ResponseWriter.Write(b)
+}
+
+// byteLimitWait returns a func waiting out the byte rate limits that apply to
+// a request on the device, or nil if there are none.
+func (server *ObjectServer) byteLimitWait(device string, replication bool) func(int) {
+	var limits []*common.KeyedRateLimit
+	if server.diskByteLimit.Rate() > 0 {
+		limits = append(limits, server.diskByteLimit)
+	}
+	if replication && server.repByteLimit.Rate() > 0 {
+		limits = append(limits, server.repByteLimit)
+	}
+	if len(limits) == 0 {
+		return nil
+	}
+	return func(n int) {
+		for _, limit := range limits {
+			limit.Wait(device, n)
+		}
+	}
+}
+
 func (server *ObjectServer) LogRequest(next http.Handler) http.Handler {
 	return srv.LogRequest(server.logger, next)
 }
@@ -543,6 +796,12 @@ func (server *ObjectServer) AcquireDevice(next http.Handler) http.Handler {
 					return
 				}
 			}
+			// A draining device is being emptied, so it takes no new writes.
+			if (request.Method == "PUT" || request.Method == "POST" || request.Method == "DELETE") && deviceDraining(server.driveRoot, device) {
+				vars["Method"] = request.Method
+				srv.CustomErrorResponse(writer, 507, vars)
+				return
+			}
 
 			forceAcquire := request.Header.Get("X-Force-Acquire") == "true"
 			if concRequests := server.diskInUse.Acquire(device, forceAcquire); concRequests != 0 {
@@ -552,6 +811,32 @@ func (server *ObjectServer) AcquireDevice(next http.Handler) http.Handler {
 			}
 			defer server.diskInUse.Release(device)
 
+			replication := request.Header.Get("User-Agent") == "nursery-stabilizer"
+			if replication {
+				if concRequests := server.repDiskInUse.Acquire(device, forceAcquire); concRequests != 0 {
+					writer.Header().Set("X-Disk-Usage", strconv.FormatInt(concRequests, 10))
+					srv.StandardResponse(writer, 503)
+					return
+				}
+				defer server.repDiskInUse.Release(device)
+			}
+
+			if wait := server.byteLimitWait(device, replication); wait != nil {
+				request.Body = &throttledReadCloser{ReadCloser: request.Body, wait: wait}
+				writer = &throttledWriter{ResponseWriter: writer, wait: wait}
+			}
+
+			// Every PUT holds a buffer while it reads its body; refuse new ones
+			// rather than let them push the server past its budget. GETs copy
+			// straight from the file without one.
+			if request.Method == "PUT" {
+				if !server.bufferBudget.Acquire(server.bufferSize) {
+					srv.StandardResponse(writer, 503)
+					return
+				}
+				defer server.bufferBudget.Release(server.bufferSize)
+			}
+
 			if account, ok := vars["account"]; ok && account != "" {
 				limitKey := fmt.Sprintf("%s/%s", device, account)
 				if concRequests := server.accountDiskInUse.Acquire(limitKey, false); concRequests != 0 {
@@ -583,29 +868,33 @@ func (server *ObjectServer) updateDeviceLocks(seconds int64) {
 
 func (server *ObjectServer) GetHandler(config conf.Config, metricsPrefix string) http.Handler {
 	var metricsScope tally.Scope
-	metricsScope, server.metricsCloser = tally.NewRootScope(tally.ScopeOptions{
-		Prefix:         metricsPrefix,
-		Tags:           map[string]string{},
-		CachedReporter: promreporter.NewReporter(promreporter.Options{}),
-		Separator:      promreporter.DefaultSeparator,
-	}, time.Second)
+	metricsScope, server.metricsCloser = srv.NewMetricsScope(config, metricsPrefix)
+	server.readRepairs = metricsScope.Counter("read_repairs")
+	server.readRepairFailures = metricsScope.Counter("read_repair_failures")
 	commonHandlers := alice.New(
 		middleware.NewDebugResponses(config.GetBool("debug", "debug_x_source_code", false)),
 		server.LogRequest,
 		middleware.RecoverHandler,
 		middleware.ValidateRequest,
+		middleware.BackendSignature(server.signingKeys),
 		server.AcquireDevice,
 	)
 	router := srv.NewRouter()
 	router.Get("/metrics", prometheus.Handler())
 	router.Get("/loglevel", server.logLevel)
-	router.Put("/loglevel", server.logLevel)
+	router.Put("/loglevel", server.adminAuth.Require(middleware.AdminRoleLogLevel, server.logLevel))
 	router.Get("/healthcheck", commonHandlers.ThenFunc(server.HealthcheckHandler))
+	router.Get("/ready", commonHandlers.ThenFunc(server.ReadyHandler))
+	router.Head("/ready", commonHandlers.ThenFunc(server.ReadyHandler))
 	router.Get("/diskusage", commonHandlers.ThenFunc(server.DiskUsageHandler))
-	router.Put("/ring/*ring_path", commonHandlers.ThenFunc(middleware.RingHandler))
+	router.Get("/disklimits", commonHandlers.ThenFunc(server.DiskLimitsHandler))
+	router.Put("/disklimits", commonHandlers.Then(server.adminAuth.Require(middleware.AdminRoleLimits, http.HandlerFunc(server.DiskLimitsHandler))))
+	router.Put("/ring/*ring_path", commonHandlers.Then(server.adminAuth.Require(middleware.AdminRoleRing, http.HandlerFunc(middleware.RingHandler))))
 	router.Get("/recon/:method/:recon_type", commonHandlers.ThenFunc(server.ReconHandler))
 	router.Get("/recon/:method", commonHandlers.ThenFunc(server.ReconHandler))
-	router.Delete("/recon/:device/:method/:recon_type/*item_path", commonHandlers.ThenFunc(server.ReconHandler))
+	router.Get("/recon/:device/:method/:recon_type/*item_path", commonHandlers.Then(server.adminAuth.Require(middleware.AdminRoleQuarantine, http.HandlerFunc(server.ReconHandler))))
+	router.Put("/recon/:device/:method/:recon_type/*item_path", commonHandlers.Then(server.adminAuth.Require(middleware.AdminRoleQuarantine, http.HandlerFunc(server.ReconHandler))))
+	router.Delete("/recon/:device/:method/:recon_type/*item_path", commonHandlers.Then(server.adminAuth.Require(middleware.AdminRoleQuarantine, http.HandlerFunc(server.ReconHandler))))
 	router.Get("/:device/:partition/:account/:container/*obj", commonHandlers.ThenFunc(server.ObjGetHandler))
 	router.Head("/:device/:partition/:account/:container/*obj", commonHandlers.ThenFunc(server.ObjGetHandler))
 	router.Put("/:device/:partition/:account/:container/*obj", commonHandlers.ThenFunc(server.ObjPutHandler))
@@ -632,20 +921,25 @@ func NewServer(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader
 	var err error
 	server := &ObjectServer{driveRoot: "/srv/node", hashPathPrefix: "", hashPathSuffix: "",
 		allowedHeaders: map[string]bool{
-			"Content-Disposition":   true,
-			"Content-Encoding":      true,
-			"X-Delete-At":           true,
-			"X-Object-Manifest":     true,
-			"X-Static-Large-Object": true,
+			"Content-Disposition":    true,
+			"Content-Encoding":       true,
+			"X-Delete-At":            true,
+			"X-Object-Manifest":      true,
+			"X-Object-Storage-Class": true,
+			"X-Static-Large-Object":  true,
 		},
 	}
 	server.hashPathPrefix, server.hashPathSuffix, err = cnf.GetHashPrefixAndSuffix()
 	if err != nil {
 		return ipPort, nil, nil, err
 	}
+	server.signingKeys = conf.GetBackendSigningKeys()
 	if server.objEngines, err = buildEngines(serverconf, flags, cnf); err != nil {
 		return ipPort, nil, nil, err
 	}
+	if server.policies, err = cnf.GetPolicies(); err != nil {
+		return ipPort, nil, nil, err
+	}
 
 	server.driveRoot = serverconf.GetDefault("app:object-server", "devices", "/srv/node")
 	server.reconCachePath = serverconf.GetDefault("app:object-server", "recon_cache_path", "/var/cache/swift")
@@ -653,11 +947,53 @@ func NewServer(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader
 	server.checkEtags = serverconf.GetBool("app:object-server", "check_etags", false)
 	server.diskInUse = common.NewKeyedLimit(serverconf.GetLimit("app:object-server", "disk_limit", 25, 0))
 	server.accountDiskInUse = common.NewKeyedLimit(serverconf.GetLimit("app:object-server", "account_rate_limit", 0, 0))
+	server.repDiskInUse = common.NewKeyedLimit(serverconf.GetLimit("app:object-server", "replication_disk_limit", 0, 0))
+	server.diskByteLimit = common.NewKeyedRateLimit(serverconf.GetInt("app:object-server", "disk_byte_limit", 0))
+	server.repByteLimit = common.NewKeyedRateLimit(serverconf.GetInt("app:object-server", "replication_disk_byte_limit", 0))
+	server.readRepair = serverconf.GetBool("app:object-server", "read_repair", false)
+	server.readRepairTimeout = time.Duration(serverconf.GetFloat("app:object-server", "read_repair_timeout", 1.0) * float64(time.Second))
+	server.readRepairMaxSize = serverconf.GetInt("app:object-server", "read_repair_max_size", 64*1024*1024)
+	server.repairRings = map[int]ring.Ring{}
+	if server.readRepair {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return ipPort, nil, nil, err
+		}
+		server.readRepairIPs = map[string]bool{}
+		for _, addr := range addrs {
+			server.readRepairIPs[strings.Split(addr.String(), "/")[0]] = true
+		}
+		server.readRepairPort = int(serverconf.GetInt("app:object-server", "bind_port", common.DefaultObjectServerPort))
+		hashPathPrefix, hashPathSuffix, err := cnf.GetHashPrefixAndSuffix()
+		if err != nil {
+			return ipPort, nil, nil, err
+		}
+		for policy, engine := range server.objEngines {
+			// Erasure coded objects are rebuilt from their shards rather
+			// than copied whole from a peer.
+			if _, ok := engine.(*ecEngine); ok {
+				continue
+			}
+			if server.repairRings[policy], err = cnf.GetRing("object", hashPathPrefix, hashPathSuffix, policy); err != nil {
+				return ipPort, nil, nil, err
+			}
+		}
+	}
+	server.bufferSize = serverconf.GetInt("app:object-server", "request_buffer_size", 64*1024)
+	if server.bufferSize <= 0 {
+		return ipPort, nil, nil, fmt.Errorf("request_buffer_size must be positive, not %d", server.bufferSize)
+	}
+	server.bufferBudget = common.NewByteBudget(serverconf.GetInt("app:object-server", "max_buffered_bytes", 0))
+	server.bufferPool = common.NewFreePool(128)
 	server.expiringDivisor = serverconf.GetInt("app:object-server", "expiring_objects_container_divisor", 86400)
 	bindIP := serverconf.GetDefault("app:object-server", "bind_ip", "0.0.0.0")
 	bindPort := int(serverconf.GetInt("app:object-server", "bind_port", common.DefaultObjectServerPort))
 	certFile := serverconf.GetDefault("app:object-server", "cert_file", "")
 	keyFile := serverconf.GetDefault("app:object-server", "key_file", "")
+	caFile := serverconf.GetDefault("app:object-server", "ca_file", "")
+	if err := common.SetClusterCA(caFile); err != nil {
+		return ipPort, nil, nil, err
+	}
 	if allowedHeaders, ok := serverconf.Get("app:object-server", "allowed_headers"); ok {
 		headers := strings.Split(allowedHeaders, ",")
 		for i := range headers {
@@ -670,6 +1006,10 @@ func NewServer(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader
 	if server.logger, err = srv.SetupLogger("object-server", &server.logLevel, flags); err != nil {
 		return ipPort, nil, nil, fmt.Errorf("Error setting up logger: %v", err)
 	}
+	if server.adminAuth, err = middleware.NewAdminAuth(serverconf.GetDefault("app:object-server", "admin_tokens", ""),
+		serverconf.GetDefault("app:object-server", "admin_cert_roles", ""), server.logger); err != nil {
+		return ipPort, nil, nil, err
+	}
 	server.updateTimeout = time.Duration(serverconf.GetFloat("app:object-server", "container_update_timeout", 0.25) * float64(time.Second))
 	connTimeout := time.Duration(serverconf.GetFloat("app:object-server", "conn_timeout", 1.0) * float64(time.Second))
 	nodeTimeout := time.Duration(serverconf.GetFloat("app:object-server", "node_timeout", 10.0) * float64(time.Second))
@@ -690,11 +1030,13 @@ func NewServer(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader
 			return ipPort, nil, nil, fmt.Errorf("Error setting up http2: %v", err)
 		}
 	}
+	signed := common.NewSigningTransport(transport, server.signingKeys)
 	httpClient := &http.Client{
 		Timeout:   nodeTimeout,
-		Transport: transport,
+		Transport: signed,
 	}
 	server.updateClient = httpClient
+	server.repairClient = &http.Client{Transport: signed}
 	if serverconf.HasSection("tracing") {
 		server.tracer, server.traceCloser, err = tracing.Init("objectserver", server.logger, serverconf.GetSection("tracing"))
 		if err != nil {
@@ -717,6 +1059,21 @@ func NewServer(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader
 	if deviceLockUpdateSeconds > 0 {
 		go server.updateDeviceLocks(deviceLockUpdateSeconds)
 	}
-	ipPort = &srv.IpPort{Ip: bindIP, Port: bindPort, CertFile: certFile, KeyFile: keyFile}
+	server.disableFile = serverconf.GetDefault("app:object-server", "disable_path", "")
+	rings := map[string]func() (ring.Ring, error){}
+	for policy := range server.objEngines {
+		policy := policy
+		rings[fmt.Sprintf("object-%d", policy)] = func() (ring.Ring, error) {
+			return cnf.GetRing("object", server.hashPathPrefix, server.hashPathSuffix, policy)
+		}
+	}
+	server.readyChecks = []middleware.ReadyCheck{
+		middleware.RingCheck(bindPort, rings),
+		middleware.DevicesCheck(server.driveRoot, server.checkMounts),
+	}
+	ipPort = &srv.IpPort{Ip: bindIP, Port: bindPort, CertFile: certFile, KeyFile: keyFile, CAFile: caFile,
+		ClientCertOptional: !serverconf.GetBool("app:object-server", "require_client_cert", true),
+		HTTP2:              srv.NewHTTP2Config(serverconf.GetSection("app:object-server")),
+		UnixSocket:         serverconf.GetDefault("app:object-server", "bind_unix_socket", "")}
 	return ipPort, server, server.logger, nil
 }
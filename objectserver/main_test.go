@@ -17,6 +17,7 @@ package objectserver
 
 import (
 	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -199,6 +200,78 @@ func TestBasicPutDelete(t *testing.T) {
 	assert.Equal(t, 404, resp.StatusCode)
 }
 
+func TestDrainingDevice(t *testing.T) {
+	testRing := &test.FakeRing{}
+	confLoader := srv.NewTestConfigLoader(testRing)
+	ts, err := makeObjectServer(confLoader)
+	assert.Nil(t, err)
+	defer ts.Close()
+
+	put := func() int {
+		req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s:%d/sda/0/a/c/o", ts.host, ts.port), bytes.NewBuffer([]byte("SOME DATA")))
+		assert.Nil(t, err)
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Content-Length", "9")
+		req.Header.Set("X-Timestamp", common.GetTimestamp())
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, 201, put())
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(ts.root, "sda", drainMarker), nil, 0644))
+	assert.Equal(t, 507, put())
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("http://%s:%d/sda/0/a/c/o", ts.host, ts.port), nil)
+	assert.Nil(t, err)
+	req.Header.Set("X-Timestamp", common.GetTimestamp())
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, 507, resp.StatusCode)
+
+	// Reads are still served while the device drains.
+	resp, err = ts.Do("GET", "/sda/0/a/c/o", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestReadOnlyPolicy(t *testing.T) {
+	testRing := &test.FakeRing{}
+	confLoader := srv.NewTestConfigLoader(testRing)
+	confLoader.GetPoliciesFunc = func() (conf.PolicyList, error) {
+		return conf.PolicyList(map[int]*conf.Policy{0: {Index: 0, Type: "replication", Name: "gold", ReadOnly: true}}), nil
+	}
+	ts, err := makeObjectServer(confLoader)
+	assert.Nil(t, err)
+	defer ts.Close()
+
+	put := func(userAgent string) int {
+		req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s:%d/sda/0/a/c/o", ts.host, ts.port), bytes.NewBuffer([]byte("SOME DATA")))
+		assert.Nil(t, err)
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Content-Length", "9")
+		req.Header.Set("X-Timestamp", common.GetTimestamp())
+		req.Header.Set("User-Agent", userAgent)
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, 405, put("proxy-server"))
+	// Replication still writes to a read-only policy.
+	assert.Equal(t, 201, put("nursery-stabilizer"))
+	for _, method := range []string{"POST", "DELETE"} {
+		req, err := http.NewRequest(method, fmt.Sprintf("http://%s:%d/sda/0/a/c/o", ts.host, ts.port), nil)
+		assert.Nil(t, err)
+		req.Header.Set("X-Timestamp", common.GetTimestamp())
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		assert.Equal(t, 405, resp.StatusCode)
+	}
+	resp, err := ts.Do("GET", "/sda/0/a/c/o", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
 func TestBasicPutPostGet(t *testing.T) {
 	testRing := &test.FakeRing{}
 	confLoader := srv.NewTestConfigLoader(testRing)
@@ -260,6 +333,54 @@ func TestPostContentType(t *testing.T) {
 	assert.Equal(t, 409, resp.StatusCode)
 }
 
+func TestStorageClass(t *testing.T) {
+	testRing := &test.FakeRing{}
+	confLoader := srv.NewTestConfigLoader(testRing)
+	ts, err := makeObjectServer(confLoader)
+	assert.Nil(t, err)
+	defer ts.Close()
+
+	put := func(storageClass string) int {
+		req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s:%d/sda/0/a/c/o", ts.host, ts.port), bytes.NewBuffer([]byte("SOME DATA")))
+		assert.Nil(t, err)
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Content-Length", "9")
+		req.Header.Set("X-Timestamp", common.GetTimestamp())
+		req.Header.Set("X-Object-Storage-Class", storageClass)
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, 400, put("lukewarm"))
+	assert.Equal(t, 201, put("cold"))
+
+	resp, err := ts.Do("HEAD", "/sda/0/a/c/o", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "cold", resp.Header.Get("X-Object-Storage-Class"))
+
+	post := func(storageClass string) int {
+		req, err := http.NewRequest("POST", fmt.Sprintf("http://%s:%d/sda/0/a/c/o", ts.host, ts.port), nil)
+		assert.Nil(t, err)
+		req.Header.Set("X-Timestamp", common.GetTimestamp())
+		if storageClass != "" {
+			req.Header.Set("X-Object-Storage-Class", storageClass)
+		}
+		req.Header.Set("X-Object-Meta-Foo", "bar")
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, 409, post("hot"))
+	assert.Equal(t, 202, post(""))
+	resp, err = ts.Do("HEAD", "/sda/0/a/c/o", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "cold", resp.Header.Get("X-Object-Storage-Class"))
+	assert.Equal(t, "bar", resp.Header.Get("X-Object-Meta-Foo"))
+}
+
 func TestPostNotFound(t *testing.T) {
 	testRing := &test.FakeRing{}
 	confLoader := srv.NewTestConfigLoader(testRing)
@@ -387,6 +508,213 @@ func TestUppercaseEtag(t *testing.T) {
 	assert.Equal(t, "437bba8e0bf58337674f4539e75186ac", resp.Header.Get("Etag"))
 }
 
+func TestTrailerEtag(t *testing.T) {
+	testRing := &test.FakeRing{}
+	confLoader := srv.NewTestConfigLoader(testRing)
+	ts, err := makeObjectServer(confLoader)
+	assert.Nil(t, err)
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		trailer string
+		etag    string
+		status  int
+	}{
+		{"Etag", "11111111111111111111111111111111", 422},
+		{"Etag", "\"437BBA8E0BF58337674F4539E75186AC\"", 201},
+		{"Content-Md5", "lYnzNMb0mH/F3bjgrBwJaw==", 422},
+		{"Content-Md5", "not base64", 422},
+		{"Content-Md5", "Q3u6jgv1gzdnT0U551GGrA==", 201},
+	} {
+		req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s:%d/sda/0/a/c/o", ts.host, ts.port),
+			ioutil.NopCloser(bytes.NewBuffer([]byte("ABCDEFGHIJKLMNOPQRSTUVWXYZ"))))
+		assert.Nil(t, err)
+		req.ContentLength = -1
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("X-Timestamp", common.GetTimestamp())
+		req.Trailer = http.Header{tc.trailer: []string{tc.etag}}
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.status, resp.StatusCode)
+		if tc.status == 201 {
+			assert.Equal(t, "437bba8e0bf58337674f4539e75186ac", resp.Header.Get("Etag"))
+		}
+	}
+}
+
+func TestTrailerSysmeta(t *testing.T) {
+	testRing := &test.FakeRing{}
+	confLoader := srv.NewTestConfigLoader(testRing)
+	ts, err := makeObjectServer(confLoader)
+	require.Nil(t, err)
+	defer ts.Close()
+
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s:%d/sda/0/a/c/o", ts.host, ts.port),
+		ioutil.NopCloser(bytes.NewBuffer([]byte("ABCDEFGHIJKLMNOPQRSTUVWXYZ"))))
+	require.Nil(t, err)
+	req.ContentLength = -1
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Timestamp", common.GetTimestamp())
+	req.Trailer = http.Header{"X-Object-Sysmeta-Test": []string{"trailed"}, "X-Object-Meta-Test": []string{"ignored"}}
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	require.Equal(t, 201, resp.StatusCode)
+
+	resp, err = ts.Do("HEAD", "/sda/0/a/c/o", nil)
+	require.Nil(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+	require.Equal(t, "trailed", resp.Header.Get("X-Object-Sysmeta-Test"))
+	require.Equal(t, "", resp.Header.Get("X-Object-Meta-Test"))
+}
+
+func TestDiskLimitsHandler(t *testing.T) {
+	testRing := &test.FakeRing{}
+	confLoader := srv.NewTestConfigLoader(testRing)
+	ts, err := makeObjectServer(confLoader, "disk_limit", "5/0", "replication_disk_limit", "2/10")
+	require.Nil(t, err)
+	defer ts.Close()
+
+	resp, err := ts.Do("GET", "/disklimits", nil)
+	require.Nil(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+	var limits DiskLimits
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&limits))
+	require.Equal(t, DiskLimits{DiskLimit: 5, ReplicationDiskLimit: 2, ReplicationDiskTotalLimit: 10}, limits)
+
+	resp, err = ts.Do("PUT", "/disklimits", ioutil.NopCloser(strings.NewReader(`{"disk_limit": 8, "disk_byte_limit": 1000}`)))
+	require.Nil(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&limits))
+	require.Equal(t, DiskLimits{DiskLimit: 8, ReplicationDiskLimit: 2, ReplicationDiskTotalLimit: 10, DiskByteLimit: 1000}, limits)
+	perKey, _ := ts.objServer.diskInUse.Limits()
+	require.Equal(t, int64(8), perKey)
+	require.Equal(t, int64(1000), ts.objServer.diskByteLimit.Rate())
+
+	resp, err = ts.Do("PUT", "/disklimits", ioutil.NopCloser(strings.NewReader(`{"disk_limit": -1}`)))
+	require.Nil(t, err)
+	require.Equal(t, 400, resp.StatusCode)
+	resp, err = ts.Do("PUT", "/disklimits", ioutil.NopCloser(strings.NewReader(`{"disk_limit": `)))
+	require.Nil(t, err)
+	require.Equal(t, 400, resp.StatusCode)
+}
+
+func TestReplicationDiskLimits(t *testing.T) {
+	testRing := &test.FakeRing{}
+	confLoader := srv.NewTestConfigLoader(testRing)
+	ts, err := makeObjectServer(confLoader, "replication_disk_limit", "1/0", "replication_disk_byte_limit", "1000")
+	require.Nil(t, err)
+	defer ts.Close()
+
+	put := func(name string, size int, userAgent string) (*http.Response, time.Duration) {
+		req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s:%d/sda/0/a/c/%s", ts.host, ts.port, name),
+			bytes.NewReader(make([]byte, size)))
+		require.Nil(t, err)
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("X-Timestamp", common.GetTimestamp())
+		req.Header.Set("User-Agent", userAgent)
+		start := time.Now()
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		return resp, time.Since(start)
+	}
+	// Client traffic isn't held to the replication byte limit.
+	resp, took := put("o1", 1500, "test")
+	require.Equal(t, 201, resp.StatusCode)
+	require.True(t, took < 400*time.Millisecond)
+	resp, took = put("o2", 1500, "nursery-stabilizer")
+	require.Equal(t, 201, resp.StatusCode)
+	require.True(t, took >= 400*time.Millisecond)
+
+	require.Equal(t, int64(0), ts.objServer.repDiskInUse.Acquire("sda", false))
+	defer ts.objServer.repDiskInUse.Release("sda")
+	resp, _ = put("o3", 10, "nursery-stabilizer")
+	require.Equal(t, 503, resp.StatusCode)
+	resp, _ = put("o3", 10, "test")
+	require.Equal(t, 201, resp.StatusCode)
+}
+
+func TestBufferBudget(t *testing.T) {
+	testRing := &test.FakeRing{}
+	confLoader := srv.NewTestConfigLoader(testRing)
+	ts, err := makeObjectServer(confLoader, "request_buffer_size", "1024", "max_buffered_bytes", "2048")
+	require.Nil(t, err)
+	defer ts.Close()
+
+	put := func() *http.Response {
+		req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s:%d/sda/0/a/c/o", ts.host, ts.port),
+			bytes.NewReader(make([]byte, 5000)))
+		require.Nil(t, err)
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("X-Timestamp", common.GetTimestamp())
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		return resp
+	}
+	resp := put()
+	require.Equal(t, 201, resp.StatusCode)
+	inUse, _ := ts.objServer.bufferBudget.Usage()
+	require.Equal(t, int64(0), inUse)
+
+	require.True(t, ts.objServer.bufferBudget.Acquire(1500))
+	resp = put()
+	require.Equal(t, 503, resp.StatusCode)
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:%d/sda/0/a/c/o", ts.host, ts.port), nil)
+	require.Nil(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, 200, resp.StatusCode)
+	ts.objServer.bufferBudget.Release(1500)
+	resp = put()
+	require.Equal(t, 201, resp.StatusCode)
+}
+
+func TestTimestampOnlyHead(t *testing.T) {
+	testRing := &test.FakeRing{}
+	confLoader := srv.NewTestConfigLoader(testRing)
+	ts, err := makeObjectServer(confLoader)
+	require.Nil(t, err)
+	defer ts.Close()
+
+	head := func() *http.Response {
+		req, err := http.NewRequest("HEAD", fmt.Sprintf("http://%s:%d/sda/0/a/c/o", ts.host, ts.port), nil)
+		require.Nil(t, err)
+		req.Header.Set("X-Backend-Timestamp-Only", "true")
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	resp := head()
+	require.Equal(t, 404, resp.StatusCode)
+	require.Equal(t, "", resp.Header.Get("X-Backend-Timestamp"))
+	require.Equal(t, "true", resp.Header.Get("X-Backend-Timestamp-Only"))
+
+	timestamp := common.GetTimestamp()
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s:%d/sda/0/a/c/o", ts.host, ts.port), bytes.NewBufferString("SOME DATA"))
+	require.Nil(t, err)
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("X-Timestamp", timestamp)
+	resp, err = http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	require.Equal(t, 201, resp.StatusCode)
+	resp = head()
+	require.Equal(t, 200, resp.StatusCode)
+	require.Equal(t, timestamp, resp.Header.Get("X-Backend-Timestamp"))
+	require.Equal(t, "", resp.Header.Get("Etag"))
+
+	timestamp = common.GetTimestamp()
+	req, err = http.NewRequest("DELETE", fmt.Sprintf("http://%s:%d/sda/0/a/c/o", ts.host, ts.port), nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Timestamp", timestamp)
+	resp, err = http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	require.Equal(t, 204, resp.StatusCode)
+	resp = head()
+	require.Equal(t, 404, resp.StatusCode)
+	require.Equal(t, timestamp, resp.Header.Get("X-Backend-Timestamp"))
+}
+
 type shortReader struct{}
 
 func (s *shortReader) Read(p []byte) (n int, err error) {
@@ -587,6 +915,44 @@ func (s *slowReader) Close() error {
 	return nil
 }
 
+func TestRetention(t *testing.T) {
+	testRing := &test.FakeRing{}
+	confLoader := srv.NewTestConfigLoader(testRing)
+	ts, err := makeObjectServer(confLoader)
+	require.Nil(t, err)
+	defer ts.Close()
+
+	do := func(method string, headers map[string]string) *http.Response {
+		req, err := http.NewRequest(method, fmt.Sprintf("http://%s:%d/sda/0/a/c/o", ts.host, ts.port), bytes.NewBuffer([]byte("SOME DATA")))
+		require.Nil(t, err)
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("X-Timestamp", common.GetTimestamp())
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	until := strconv.FormatInt(time.Now().Unix()+3600, 10)
+	require.Equal(t, 400, do("PUT", map[string]string{"X-Object-Sysmeta-Retention-Until": until,
+		"X-Delete-At": strconv.FormatInt(time.Now().Unix()+60, 10)}).StatusCode)
+	require.Equal(t, 201, do("PUT", map[string]string{"X-Object-Sysmeta-Retention-Until": until}).StatusCode)
+	require.Equal(t, 409, do("PUT", nil).StatusCode)
+	require.Equal(t, 409, do("DELETE", nil).StatusCode)
+	require.Equal(t, 202, do("POST", map[string]string{"X-Object-Meta-Test": "post"}).StatusCode)
+	// The retention stays with the object through a POST.
+	require.Equal(t, 409, do("DELETE", nil).StatusCode)
+	require.Equal(t, 204, do("DELETE", map[string]string{"X-Backend-Retention-Moved": "true"}).StatusCode)
+
+	// Objects stored before their container's retention was set are
+	// protected by the one the proxy sends.
+	require.Equal(t, 201, do("PUT", nil).StatusCode)
+	require.Equal(t, 409, do("DELETE", map[string]string{"X-Backend-Retention-Until": until}).StatusCode)
+	require.Equal(t, 204, do("DELETE", nil).StatusCode)
+}
+
 func TestAcquireDevice(t *testing.T) {
 	testRing := &test.FakeRing{}
 	confLoader := srv.NewTestConfigLoader(testRing)
@@ -148,8 +148,35 @@ func (nrd *nurseryDevice) PriorityReplicate(w http.ResponseWriter, pri PriorityR
 	w.WriteHeader(http.StatusOK)
 	t := time.Now()
 	prr := PriorityReplicationResult{}
+	var stream *repStream
+	defer func() {
+		if stream != nil {
+			stream.Close()
+		}
+	}()
+	// Without stream replication, or once the destination refuses a stream,
+	// each object gets a request of its own.
+	streaming := nrd.r.streamReplication
 	for o := range objc {
-		if err := o.Replicate(pri); err != nil {
+		so, ok := o.(StreamingObjectStabilizer)
+		if ok && streaming && (stream == nil || stream.disconnected()) {
+			var err error
+			if stream, err = newRepStream(pri.ToDevice, pri.Policy, nrd.r.CertFile, nrd.r.KeyFile, nrd.r.rcTimeout); err != nil {
+				nrd.r.logger.Info("error starting replication stream; falling back to requests", zap.String("device", pri.ToDevice.Device), zap.Error(err))
+				streaming = false
+			} else {
+				stream.wait = nrd.r.throttleReplication
+			}
+		}
+		var err error
+		if ok && streaming {
+			err = so.ReplicateStream(stream, pri)
+		} else if to, ok := o.(ThrottledObjectStabilizer); ok {
+			err = to.ReplicateThrottled(pri, nrd.r.throttleReplication)
+		} else {
+			err = o.Replicate(pri)
+		}
+		if err != nil {
 			nrd.r.logger.Error("error prirep Replicate", zap.Error(err))
 			prr.ObjectsErrored++
 			nrd.UpdateStat("ObjectsReplicatedError", 1)
@@ -21,6 +21,8 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"plugin"
+	"strings"
 	"sync"
 
 	"github.com/troubling/hummingbird/common/conf"
@@ -84,9 +86,63 @@ type ObjectEngine interface {
 	// New creates a new instance of the Object, for interacting with a single object.
 	New(vars map[string]string, needData bool, asyncWG *sync.WaitGroup) (Object, error)
 	GetReplicationDevice(oring ring.Ring, dev *ring.Device, r *Replicator) (ReplicationDevice, error)
+	// Close releases any resources held by the engine, such as open database handles.
+	Close() error
 	// Replicator here needs to be something else- it mostly needs logger, updateStat thing, and certs. not whole object- maybe an interface that gives those things
 }
 
+// TimestampOnlyObjectEngine is an ObjectEngine that can look up an object's
+// newest timestamp without loading its metadata, which keeps the extra
+// requests X-Newest makes cheap.
+type TimestampOnlyObjectEngine interface {
+	ObjectEngine
+	// TimestampOnly returns the X-Timestamp of the object's newest version,
+	// or "" if there isn't one, and whether that version is live rather than
+	// a deletion or expired.
+	TimestampOnly(vars map[string]string) (timestamp string, exists bool, err error)
+}
+
+// AsyncPendingObjectEngine is an ObjectEngine that queues container updates
+// that couldn't be sent in its own IndexDBs, rather than as async_pending
+// files.
+type AsyncPendingObjectEngine interface {
+	ObjectEngine
+	// AsyncPendingDB returns the IndexDB to queue the device's updates in.
+	AsyncPendingDB(device string) (*IndexDB, error)
+}
+
+// ExpiringObjectEngine is an ObjectEngine that can find and remove its
+// expired objects on a device without a listing of them.
+type ExpiringObjectEngine interface {
+	ObjectEngine
+	// ExpireObjects removes up to limit of the device's expired objects from
+	// each of its databases and returns how many it removed.
+	ExpireObjects(device string, limit int) (int, error)
+}
+
+// StreamingObjectEngine is an ObjectEngine that can take whole objects sent
+// to it over a replication stream, many to a connection.
+type StreamingObjectEngine interface {
+	ObjectEngine
+	// StreamDB returns the IndexDB to save the device's streamed objects in.
+	StreamDB(device string) (*IndexDB, error)
+}
+
+// StreamingObjectStabilizer is an ObjectStabilizer that can be replicated
+// over a stream shared with other objects, rather than a request of its own.
+type StreamingObjectStabilizer interface {
+	ObjectStabilizer
+	ReplicateStream(*repStream, PriorityRepJob) error
+}
+
+// ThrottledObjectStabilizer is an ObjectStabilizer whose replication request
+// body can be held to the replicator's byte limit; wait is called with the
+// number of bytes of each read from it.
+type ThrottledObjectStabilizer interface {
+	ObjectStabilizer
+	ReplicateThrottled(PriorityRepJob, func(int)) error
+}
+
 type NurseryObjectEngine interface {
 	ObjectEngine
 	GetObjectsToStabilize(device *ring.Device) (c chan ObjectStabilizer, cancel chan struct{})
@@ -110,9 +166,9 @@ var engineFactories = []engineFactoryEntry{}
 
 // RegisterObjectEngine lets you tell hummingbird about a new object engine.
 func RegisterObjectEngine(name string, newEngine ObjectEngineConstructor) {
-	for _, e := range engineFactories {
-		if e.name == name {
-			e.constructor = newEngine
+	for i := range engineFactories {
+		if engineFactories[i].name == name {
+			engineFactories[i].constructor = newEngine
 			return
 		}
 	}
@@ -129,8 +185,29 @@ func FindEngine(name string) (ObjectEngineConstructor, error) {
 	return nil, errors.New("Not found")
 }
 
+// LoadEnginePlugins opens each Go plugin in the comma separated list of .so
+// files, as given by engine_plugins in [app:object-server]. A plugin registers
+// its engines by calling RegisterObjectEngine (and, for IndexDB based engines,
+// RegisterIndexDBAuditor) from its init function, so policies can then use
+// them by name. Plugins must be built with the same Go version and hummingbird
+// source as the server.
+func LoadEnginePlugins(paths string) error {
+	for _, path := range strings.Split(paths, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		if _, err := plugin.Open(path); err != nil {
+			return fmt.Errorf("Unable to load engine plugin %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
 func buildEngines(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader) (map[int]ObjectEngine, error) {
 	objEngines := make(map[int]ObjectEngine)
+	if err := LoadEnginePlugins(serverconf.GetDefault("app:object-server", "engine_plugins", "")); err != nil {
+		return objEngines, err
+	}
 	policies, err := cnf.GetPolicies()
 	if err != nil {
 		return objEngines, err
@@ -41,4 +41,21 @@ func TestObjectEngineRegistry(t *testing.T) {
 	fconstructor, err = FindEngine("hopefullynotfound")
 	require.Nil(t, fconstructor)
 	require.NotNil(t, err)
+
+	replaceErr := errors.New("Replaced")
+	RegisterObjectEngine("test", func(conf.Config, *conf.Policy, *flag.FlagSet) (ObjectEngine, error) {
+		return nil, replaceErr
+	})
+	fconstructor, err = FindEngine("test")
+	require.Nil(t, err)
+	_, err = fconstructor(conf.Config{}, nil, nil)
+	require.Equal(t, err, replaceErr)
+}
+
+func TestLoadEnginePlugins(t *testing.T) {
+	require.Nil(t, LoadEnginePlugins(""))
+	require.Nil(t, LoadEnginePlugins(" , "))
+	err := LoadEnginePlugins("/hopefully/not/an/engine.so")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "/hopefully/not/an/engine.so")
 }
@@ -281,7 +281,7 @@ func doMoveParts(args []string, cnf srv.ConfigLoader) int {
 	}
 	// TODO: Do we want to trace requests with this client?
 	client := &http.Client{Timeout: time.Hour,
-		Transport: transport,
+		Transport: common.NewSigningTransport(transport, conf.GetBackendSigningKeys()),
 	}
 	badParts := []uint64{}
 	for {
@@ -441,7 +441,7 @@ func RestoreDevice(args []string, cnf srv.ConfigLoader) {
 	// TODO: Do we want to trace requests with this client?
 	client := &http.Client{
 		Timeout:   time.Hour * 4,
-		Transport: transport,
+		Transport: common.NewSigningTransport(transport, conf.GetBackendSigningKeys()),
 	}
 	badParts := []uint64{}
 	for {
@@ -467,3 +467,144 @@ func RestoreDevice(args []string, cnf srv.ConfigLoader) {
 	}
 	fmt.Println("Done sending jobs.")
 }
+
+// getPrewarmJobs takes an ip address and an optional device name, and creates a list of jobs copying each of the
+// node's primary partitions to their first handoff not on that node.
+func getPrewarmJobs(theRing ring.Ring, ip string, devName string, overrideParts []uint64, policy int) []*PriorityRepJob {
+	onNode := func(dev *ring.Device) bool {
+		return dev.Ip == ip || dev.ReplicationIp == ip
+	}
+	jobs := make([]*PriorityRepJob, 0)
+	for i := uint64(0); true; i++ {
+		partition := i
+		if len(overrideParts) > 0 {
+			if int(partition) < len(overrideParts) {
+				partition = overrideParts[partition]
+			} else {
+				break
+			}
+		}
+		devs := theRing.GetNodes(partition)
+		if devs == nil {
+			break
+		}
+		var handoff *ring.Device
+		more := theRing.GetMoreNodes(partition)
+		for _, dev := range devs {
+			if !onNode(dev) || (devName != "" && dev.Device != devName) {
+				continue
+			}
+			if handoff == nil {
+				handoff = more.Next()
+				for handoff != nil && onNode(handoff) {
+					handoff = more.Next()
+				}
+				if handoff == nil {
+					fmt.Printf("Could not find handoff for partition: %d\n", partition)
+					break
+				}
+			}
+			jobs = append(jobs, &PriorityRepJob{
+				Partition:  partition,
+				FromDevice: dev,
+				ToDevice:   handoff,
+				Policy:     policy,
+				Prewarm:    true,
+			})
+		}
+	}
+	return jobs
+}
+
+// PrewarmDevice takes an IP address and optional device name such as []string{"172.24.0.1", "sda1"} and copies the
+// node's primary partitions to their handoffs, so the node can be taken down for maintenance without leaving those
+// partitions a replica short.
+func PrewarmDevice(args []string, cnf srv.ConfigLoader) {
+	flags := flag.NewFlagSet("prewarmdevice", flag.ExitOnError)
+	policyName := flags.String("P", "", "policy to use")
+	ringLoc := flags.String("r", "", "Specify which ring file to use")
+	conc := flags.Int("c", 2, "limit of per device concurrency priority repl calls")
+	certFile := flags.String("certfile", "", "Cert file to use for setting up https client")
+	keyFile := flags.String("keyfile", "", "Key file to use for setting up https client")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "USAGE: hummingbird prewarmdevice [ip] [device]\n")
+		fmt.Fprintf(os.Stderr, "  if device is omitted, every device on the node is prewarmed\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if len(flags.Args()) != 1 && len(flags.Args()) != 2 {
+		flags.Usage()
+		return
+	}
+	policyIndex := 0
+	if *policyName != "" {
+		policies, err := conf.GetPolicies()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to load policies:", err)
+			return
+		}
+		p := policies.NameLookup(*policyName)
+		if p == nil {
+			fmt.Fprintf(os.Stderr, "Unknown policy named %q\n", *policyName)
+			return
+		}
+		policyIndex = p.Index
+	}
+	hashPathPrefix, hashPathSuffix, err := cnf.GetHashPrefixAndSuffix()
+	if err != nil {
+		fmt.Println("Unable to load hash path prefix and suffix:", err)
+		return
+	}
+	var objRing ring.Ring
+	if *ringLoc == "" {
+		objRing, err = ring.GetRing("object", hashPathPrefix, hashPathSuffix, policyIndex)
+	} else {
+		objRing, err = ring.LoadRing(*ringLoc, hashPathPrefix, hashPathSuffix)
+	}
+	if err != nil {
+		fmt.Println("Unable to load ring:", err)
+		return
+	}
+	transport := &http.Transport{
+		MaxIdleConnsPerHost: 100,
+		MaxIdleConns:        0,
+	}
+	if *certFile != "" && *keyFile != "" {
+		tlsConf, err := common.NewClientTLSConfig(*certFile, *keyFile)
+		if err != nil {
+			fmt.Println("Error getting TLS config:", err)
+			return
+		}
+		transport.TLSClientConfig = tlsConf
+		if err = http2.ConfigureTransport(transport); err != nil {
+			fmt.Println("Error setting up http2:", err)
+			return
+		}
+	}
+	client := &http.Client{
+		Timeout:   time.Hour * 4,
+		Transport: common.NewSigningTransport(transport, conf.GetBackendSigningKeys()),
+	}
+	badParts := []uint64{}
+	for {
+		jobs := getPrewarmJobs(objRing, flags.Arg(0), flags.Arg(1), badParts, policyIndex)
+		lastRun := len(jobs)
+		fmt.Println("Job count:", len(jobs))
+		for i := len(jobs) - 1; i > 0; i-- { // shuffle jobs list
+			j := rand.Intn(i + 1)
+			jobs[j], jobs[i] = jobs[i], jobs[j]
+		}
+		badParts = doPriRepJobs(jobs, *conc, client, "PrewarmDevice")
+		if len(badParts) == 0 {
+			break
+		} else {
+			fmt.Printf("Finished run of partitions. retrying %d.\n", len(badParts))
+			if lastRun == len(badParts) {
+				time.Sleep(time.Minute * 5)
+			} else {
+				time.Sleep(time.Second * 5)
+			}
+		}
+	}
+	fmt.Println("Done sending jobs. The node's partitions are now also on their handoffs.")
+}
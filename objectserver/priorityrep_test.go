@@ -35,9 +35,23 @@ import (
 
 type priFakeRing struct {
 	mapping  map[uint64][]int
+	handoffs map[uint64][]int
 	fakeDevs []*ring.Device
 }
 
+type priFakeMoreNodes struct {
+	devs []*ring.Device
+}
+
+func (m *priFakeMoreNodes) Next() *ring.Device {
+	if len(m.devs) == 0 {
+		return nil
+	}
+	dev := m.devs[0]
+	m.devs = m.devs[1:]
+	return dev
+}
+
 func (p *priFakeRing) GetJobNodes(partition uint64, localDevice int) (response []*ring.Device, handoff bool) {
 	isaHandoff := false
 	if localDevice == 0 {
@@ -68,7 +82,13 @@ func (p *priFakeRing) AllDevices() (devs []*ring.Device) {
 	return devs
 }
 
-func (p *priFakeRing) GetMoreNodes(partition uint64) ring.MoreNodes { return nil }
+func (p *priFakeRing) GetMoreNodes(partition uint64) ring.MoreNodes {
+	more := &priFakeMoreNodes{}
+	for _, h := range p.handoffs[partition] {
+		more.devs = append(more.devs, &ring.Device{Id: h, Device: fmt.Sprintf("drive%d", h), Ip: fmt.Sprintf("127.0.1.%d", h), Port: h})
+	}
+	return more
+}
 
 func (p *priFakeRing) GetNodes(partition uint64) (response []*ring.Device) {
 	for _, p := range p.mapping[partition] {
@@ -165,6 +185,34 @@ func TestGetRestoreDeviceJobsAllPeers(t *testing.T) {
 	require.EqualValues(t, 4, len(jobs))
 }
 
+func TestGetPrewarmJobs(t *testing.T) {
+	t.Parallel()
+	ring := &priFakeRing{
+		mapping: map[uint64][]int{
+			0: {1, 2},
+			1: {3, 4},
+			2: {1, 5},
+		},
+		handoffs: map[uint64][]int{
+			0: {6, 7},
+			1: {8},
+		},
+	}
+	jobs := getPrewarmJobs(ring, "127.0.0.1", "drive1", []uint64{}, 2)
+	require.EqualValues(t, 1, len(jobs))
+	require.EqualValues(t, 0, jobs[0].Partition)
+	require.EqualValues(t, 1, jobs[0].FromDevice.Id)
+	require.EqualValues(t, 6, jobs[0].ToDevice.Id)
+	require.EqualValues(t, 2, jobs[0].Policy)
+	require.True(t, jobs[0].Prewarm)
+	jobs = getPrewarmJobs(ring, "127.0.0.1", "", []uint64{1}, 0)
+	require.EqualValues(t, 2, len(jobs))
+	require.EqualValues(t, 3, jobs[0].FromDevice.Id)
+	require.EqualValues(t, 4, jobs[1].FromDevice.Id)
+	require.EqualValues(t, 8, jobs[0].ToDevice.Id)
+	require.EqualValues(t, 8, jobs[1].ToDevice.Id)
+}
+
 func TestPriRepJobs(t *testing.T) {
 	t.Parallel()
 	handlerRan := false
@@ -0,0 +1,180 @@
+package objectserver
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/srv"
+	"go.uber.org/zap"
+)
+
+// repairRing returns the ring to find peer replicas in for a read repair of
+// the request's object, or nil if its policy doesn't support read repair.
+func (server *ObjectServer) repairRing(request *http.Request) ring.Ring {
+	policy, err := strconv.Atoi(request.Header.Get("X-Backend-Storage-Policy-Index"))
+	if err != nil {
+		policy = 0
+	}
+	return server.repairRings[policy]
+}
+
+// cancelBody is a response body that releases its request's context once
+// it's closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// verifiedGet checks the local copy's contents against its ETag before
+// serving them. A copy that doesn't match is quarantined and, if a peer
+// replica responds within the read repair timeout, the object is served from
+// there while its contents are saved as the new local copy; otherwise the GET
+// gets a 503 so the proxy moves on to another replica.
+func (server *ObjectServer) verifiedGet(writer http.ResponseWriter, request *http.Request, vars map[string]string, obj Object, metadata map[string]string, r ring.Ring) {
+	logger := srv.GetLogger(request)
+	hash := md5.New()
+	if _, err := obj.CopyRange(hash, 0, obj.ContentLength()); err != nil {
+		logger.Error("Error verifying body", zap.Error(err))
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	if hex.EncodeToString(hash.Sum(nil)) == metadata["ETag"] {
+		writer.WriteHeader(http.StatusOK)
+		if _, err := obj.CopyRange(writer, 0, obj.ContentLength()); err != nil {
+			logger.Error("Error copying body", zap.Error(err))
+		}
+		return
+	}
+	logger.Error("Quarantining object with bad ETag", zap.String("obj", obj.Repr()))
+	obj.Quarantine()
+	resp := server.fetchRepairCopy(request, vars, metadata, r)
+	if resp == nil {
+		server.readRepairFailures.Inc(1)
+		srv.StandardResponse(writer, http.StatusServiceUnavailable)
+		return
+	}
+	defer resp.Body.Close()
+	writer.WriteHeader(http.StatusOK)
+	server.saveRepairCopy(request, vars, metadata, obj.ContentLength(), resp, writer)
+}
+
+// repairInBackground replaces a local copy found to be bad while it was
+// being served, which is too late to serve the GET from a peer instead.
+func (server *ObjectServer) repairInBackground(request *http.Request, vars map[string]string, metadata map[string]string, size int64, r ring.Ring) {
+	server.asyncWG.Add(1)
+	go func() {
+		defer server.asyncWG.Done()
+		resp := server.fetchRepairCopy(request, vars, metadata, r)
+		if resp == nil {
+			server.readRepairFailures.Inc(1)
+			return
+		}
+		defer resp.Body.Close()
+		server.saveRepairCopy(request, vars, metadata, size, resp, ioutil.Discard)
+	}()
+}
+
+// saveRepairCopy copies a peer's response to the client and into a new
+// local copy, which is committed if its contents match the ETag.
+func (server *ObjectServer) saveRepairCopy(request *http.Request, vars map[string]string, metadata map[string]string, size int64, resp *http.Response, client io.Writer) {
+	logger := srv.GetLogger(request)
+	repaired, err := server.newObject(request, vars, false)
+	if err != nil {
+		logger.Error("Error getting obj for read repair", zap.Error(err))
+		common.Copy(resp.Body, client)
+		return
+	}
+	tempFile, err := repaired.SetData(size)
+	if err != nil {
+		logger.Error("Error making new file for read repair", zap.Error(err))
+		repaired.Close()
+		common.Copy(resp.Body, client)
+		return
+	}
+	hash := md5.New()
+	if _, err := common.Copy(resp.Body, client, tempFile, hash); err != nil {
+		logger.Error("Error copying read repair body", zap.Error(err))
+		repaired.Close()
+		return
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != metadata["ETag"] {
+		logger.Error("Read repair copy has bad ETag", zap.String("obj", repaired.Repr()))
+		repaired.Close()
+		return
+	}
+	server.asyncWG.Add(1)
+	go func() {
+		defer server.asyncWG.Done()
+		defer repaired.Close()
+		if err := repaired.Commit(metadata); err != nil {
+			logger.Error("Error committing read repair", zap.Error(err))
+			server.readRepairFailures.Inc(1)
+			return
+		}
+		server.readRepairs.Inc(1)
+	}()
+}
+
+// isLocalDevice reports whether dev is the device this request was already
+// served from.
+func (server *ObjectServer) isLocalDevice(dev *ring.Device, device string) bool {
+	return dev.Device == device && dev.Port == server.readRepairPort && server.readRepairIPs[dev.Ip]
+}
+
+// fetchRepairCopy starts a GET of the same version of the object from each
+// of its other primaries in turn, returning the first good response that
+// arrives within the read repair timeout.
+func (server *ObjectServer) fetchRepairCopy(request *http.Request, vars map[string]string, metadata map[string]string, r ring.Ring) *http.Response {
+	partition, err := strconv.ParseUint(vars["partition"], 10, 64)
+	if err != nil {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	deadline := time.AfterFunc(server.readRepairTimeout, cancel)
+	for _, dev := range r.GetNodes(partition) {
+		if server.isLocalDevice(dev, vars["device"]) {
+			continue
+		}
+		url := fmt.Sprintf("%s://%s:%d/%s/%d/%s/%s/%s", dev.Scheme, dev.Ip, dev.Port, dev.Device, partition,
+			common.Urlencode(vars["account"]), common.Urlencode(vars["container"]), common.Urlencode(vars["obj"]))
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			continue
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("X-Backend-Storage-Policy-Index", request.Header.Get("X-Backend-Storage-Policy-Index"))
+		req.Header.Set("User-Agent", "object-server-read-repair")
+		resp, err := server.repairClient.Do(req)
+		if err != nil {
+			srv.GetLogger(request).Debug("Error getting read repair copy", zap.String("url", url), zap.Error(err))
+			continue
+		}
+		if resp.StatusCode == http.StatusOK && resp.Header.Get("X-Backend-Timestamp") == metadata["X-Timestamp"] &&
+			strings.Trim(resp.Header.Get("Etag"), "\"") == metadata["ETag"] {
+			if deadline.Stop() {
+				resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+				return resp
+			}
+		}
+		resp.Body.Close()
+	}
+	deadline.Stop()
+	cancel()
+	return nil
+}
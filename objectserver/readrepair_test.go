@@ -0,0 +1,127 @@
+package objectserver
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/common/test"
+)
+
+func readRepairPut(t *testing.T, ts *TestServer, obj, timestamp, body string) {
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s:%d/sda/0/a/c/%s", ts.host, ts.port, obj), bytes.NewBufferString(body))
+	require.Nil(t, err)
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("X-Timestamp", timestamp)
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, 201, resp.StatusCode)
+}
+
+func readRepairGet(t *testing.T, ts *TestServer, obj string) (int, string) {
+	resp, err := ts.Do("GET", "/sda/0/a/c/"+obj, nil)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	return resp.StatusCode, string(body)
+}
+
+// corruptDataFiles overwrites the contents of every object under root with
+// as many bytes of garbage.
+func corruptDataFiles(t *testing.T, root string) {
+	corrupted := 0
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && strings.HasSuffix(path, ".data") {
+			require.Nil(t, ioutil.WriteFile(path, bytes.Repeat([]byte("X"), int(info.Size())), 0644))
+			corrupted++
+		}
+		return nil
+	})
+	require.True(t, corrupted > 0)
+}
+
+func TestReadRepair(t *testing.T) {
+	testRing := &test.FakeRing{}
+	confLoader := srv.NewTestConfigLoader(testRing)
+	peer, err := makeObjectServer(confLoader)
+	require.Nil(t, err)
+	ts, err := makeObjectServer(confLoader, "check_etags", "true", "read_repair", "true")
+	require.Nil(t, err)
+	defer ts.Close()
+	ts.objServer.readRepairPort = ts.port
+	testRing.MockDevices = []*ring.Device{
+		{Scheme: "http", Ip: ts.host, Port: ts.port, Device: "sda"},
+		{Scheme: "http", Ip: "127.0.0.1", Port: 1, Device: "sda"},
+		{Scheme: "http", Ip: peer.host, Port: peer.port, Device: "sda"},
+	}
+
+	timestamp := common.GetTimestamp()
+	readRepairPut(t, ts, "o", timestamp, "just testing")
+	readRepairPut(t, peer, "o", timestamp, "just testing")
+	status, body := readRepairGet(t, ts, "o")
+	require.Equal(t, 200, status)
+	require.Equal(t, "just testing", body)
+
+	corruptDataFiles(t, ts.root)
+	status, body = readRepairGet(t, ts, "o")
+	require.Equal(t, 200, status)
+	require.Equal(t, "just testing", body)
+	ts.objServer.asyncWG.Wait()
+
+	// The local copy was repaired, so the peer is no longer needed.
+	peer.Close()
+	status, body = readRepairGet(t, ts, "o")
+	require.Equal(t, 200, status)
+	require.Equal(t, "just testing", body)
+
+	corruptDataFiles(t, ts.root)
+	status, _ = readRepairGet(t, ts, "o")
+	require.Equal(t, 503, status)
+	status, _ = readRepairGet(t, ts, "o")
+	require.Equal(t, 404, status)
+}
+
+func TestReadRepairLargeObject(t *testing.T) {
+	testRing := &test.FakeRing{}
+	confLoader := srv.NewTestConfigLoader(testRing)
+	peer, err := makeObjectServer(confLoader)
+	require.Nil(t, err)
+	defer peer.Close()
+	ts, err := makeObjectServer(confLoader, "check_etags", "true", "read_repair", "true", "read_repair_max_size", "4")
+	require.Nil(t, err)
+	defer ts.Close()
+	ts.objServer.readRepairPort = ts.port
+	testRing.MockDevices = []*ring.Device{
+		{Scheme: "http", Ip: ts.host, Port: ts.port, Device: "sda"},
+		{Scheme: "http", Ip: peer.host, Port: peer.port, Device: "sda"},
+		{Scheme: "http", Ip: "127.0.0.1", Port: 1, Device: "sda"},
+	}
+	require.True(t, ts.objServer.isLocalDevice(testRing.MockDevices[0], "sda"))
+	require.False(t, ts.objServer.isLocalDevice(testRing.MockDevices[1], "sda"))
+
+	timestamp := common.GetTimestamp()
+	readRepairPut(t, ts, "o", timestamp, "just testing")
+	readRepairPut(t, peer, "o", timestamp, "just testing")
+
+	// Bigger objects are streamed without checking first, so the GET that
+	// finds the bad copy still serves it, but the copy is repaired after.
+	corruptDataFiles(t, ts.root)
+	status, body := readRepairGet(t, ts, "o")
+	require.Equal(t, 200, status)
+	require.Equal(t, "XXXXXXXXXXXX", body)
+	ts.objServer.asyncWG.Wait()
+	status, body = readRepairGet(t, ts, "o")
+	require.Equal(t, 200, status)
+	require.Equal(t, "just testing", body)
+}
@@ -0,0 +1,274 @@
+package objectserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/srv"
+	"go.uber.org/zap"
+)
+
+// rebalanceCheckInterval is how often the replicator looks for a new object
+// ring, and rebalanceRetryInterval how long it waits before trying moved
+// partitions that failed again.
+var (
+	rebalanceCheckInterval = time.Minute
+	rebalanceRetryInterval = 5 * time.Minute
+)
+
+// RebalanceStatus reports how far a local device has got pushing the
+// partitions a ring change moved off it to their new primaries.
+type RebalanceStatus struct {
+	Device           string    `json:"device"`
+	Policy           int       `json:"policy"`
+	RingMD5          string    `json:"ring_md5"`
+	Started          time.Time `json:"started"`
+	PartitionsTotal  int64     `json:"partitions_total"`
+	PartitionsDone   int64     `json:"partitions_done"`
+	PartitionsFailed int64     `json:"partitions_failed"`
+	BytesRemaining   int64     `json:"bytes_remaining_estimate"`
+	PercentComplete  float64   `json:"percent_complete"`
+	Complete         bool      `json:"complete"`
+}
+
+// ringSnapshot is a copy of an object ring as the replicator last saw it, to
+// compare the next version of the ring against.
+type ringSnapshot struct {
+	ring  ring.RingMD5
+	mtime time.Time
+}
+
+type rebalanceRun struct {
+	status    RebalanceStatus
+	partBytes int64
+	cancel    chan struct{}
+	// rd replicates for a device that's only local in the old ring, so it
+	// isn't one of the running devices; nil for the rest.
+	rd ReplicationDevice
+}
+
+func (r *Replicator) updateRebalance(run *rebalanceRun, update func(*RebalanceStatus)) {
+	r.rebalancesLock.Lock()
+	defer r.rebalancesLock.Unlock()
+	update(&run.status)
+	if run.status.PartitionsTotal > 0 {
+		run.status.PercentComplete = float64(100*run.status.PartitionsDone) / float64(run.status.PartitionsTotal)
+	} else {
+		run.status.PercentComplete = 100
+	}
+}
+
+// deviceUsedBytes returns how many bytes are in use on the device, or 0 if
+// that can't be found.
+func (r *Replicator) deviceUsedBytes(device string) int64 {
+	var fsinfo syscall.Statfs_t
+	if err := syscall.Statfs(filepath.Join(r.deviceRoot, device), &fsinfo); err != nil {
+		return 0
+	}
+	return int64(fsinfo.Bsize) * (int64(fsinfo.Blocks) - int64(fsinfo.Bfree))
+}
+
+// checkRings compares each object ring on disk with the version the
+// replicator last saw, starting a rebalance of the partitions that moved off
+// local devices whenever it has changed.
+func (r *Replicator) checkRings() {
+	for policy, oring := range r.objectRings {
+		rmd5, ok := oring.(ring.RingMD5)
+		if !ok {
+			continue
+		}
+		fi, err := os.Stat(rmd5.DiskPath())
+		if err != nil {
+			continue
+		}
+		snapshot := r.ringSnapshots[policy]
+		if snapshot != nil && !fi.ModTime().After(snapshot.mtime) {
+			continue
+		}
+		newRing, err := ring.LoadRingMD5(rmd5.DiskPath(), r.hashPathPrefix, r.hashPathSuffix)
+		if err != nil {
+			r.logger.Error("Error loading object ring", zap.Int("policy", policy), zap.Error(err))
+			continue
+		}
+		r.ringSnapshots[policy] = &ringSnapshot{ring: newRing, mtime: fi.ModTime()}
+		if snapshot != nil && snapshot.ring.MD5() != newRing.MD5() {
+			r.startRebalance(policy, snapshot.ring, newRing)
+		}
+	}
+}
+
+// startRebalance works out which partitions moved off local devices between
+// oldRing and newRing and starts each device pushing its moved partitions to
+// their new primaries, superseding any rebalance from an earlier change.
+// Devices that were local in oldRing are included even if newRing no longer
+// has them here, since what moved off them is still on them.
+func (r *Replicator) startRebalance(policy int, oldRing, newRing ring.RingMD5) {
+	localDevices, err := newRing.LocalDevices(r.port)
+	if err != nil {
+		r.logger.Error("Error getting local devices from ring", zap.Int("policy", policy), zap.Error(err))
+		return
+	}
+	oldLocalDevices, err := oldRing.LocalDevices(r.port)
+	if err != nil {
+		r.logger.Error("Error getting local devices from old ring", zap.Int("policy", policy), zap.Error(err))
+		return
+	}
+	local := map[string]bool{}
+	running := map[string]bool{}
+	for _, dev := range localDevices {
+		local[fmt.Sprintf("%s:%d/%s", dev.ReplicationIp, dev.ReplicationPort, dev.Device)] = true
+		running[dev.Device] = true
+	}
+	oldOnly := map[string]bool{}
+	for _, dev := range oldLocalDevices {
+		local[fmt.Sprintf("%s:%d/%s", dev.ReplicationIp, dev.ReplicationPort, dev.Device)] = true
+		if !running[dev.Device] && !oldOnly[dev.Device] {
+			oldOnly[dev.Device] = true
+			localDevices = append(localDevices, dev)
+		}
+	}
+	jobs := map[string][]*PriorityRepJob{}
+	for _, job := range getPartMoveJobs(oldRing, newRing, nil, policy) {
+		from := job.FromDevice
+		if local[fmt.Sprintf("%s:%d/%s", from.ReplicationIp, from.ReplicationPort, from.Device)] {
+			jobs[from.Device] = append(jobs[from.Device], job)
+		}
+	}
+	r.rebalancesLock.Lock()
+	defer r.rebalancesLock.Unlock()
+	for key, run := range r.rebalances {
+		if run.status.Policy == policy {
+			close(run.cancel)
+			delete(r.rebalances, key)
+		}
+	}
+	for _, dev := range localDevices {
+		run := &rebalanceRun{
+			status: RebalanceStatus{
+				Device:          dev.Device,
+				Policy:          policy,
+				RingMD5:         newRing.MD5(),
+				Started:         time.Now(),
+				PartitionsTotal: int64(len(jobs[dev.Device])),
+				PercentComplete: 100,
+				Complete:        len(jobs[dev.Device]) == 0,
+			},
+			cancel: make(chan struct{}),
+		}
+		if oldOnly[dev.Device] && len(jobs[dev.Device]) > 0 {
+			objEngine, ok := r.objEngines[policy]
+			if !ok {
+				r.logger.Error("Error finding engine for policy", zap.Int("policy", policy))
+				continue
+			}
+			if run.rd, err = objEngine.GetReplicationDevice(oldRing, dev, r); err != nil {
+				r.logger.Error("Error building replication device for rebalance", zap.String("device", dev.Device), zap.Int("policy", policy), zap.Error(err))
+				continue
+			}
+		}
+		if len(jobs[dev.Device]) > 0 {
+			// Partitions are assumed to be about the same size, so each is
+			// roughly an even share of what's on the device.
+			if parts := oldRing.AssignmentCount(jobs[dev.Device][0].FromDevice.Id); parts > 0 {
+				run.partBytes = r.deviceUsedBytes(dev.Device) / int64(parts)
+			}
+			run.status.BytesRemaining = run.partBytes * run.status.PartitionsTotal
+			run.status.PercentComplete = 0
+			go r.rebalanceDevice(deviceKeyId(dev.Device, policy), run, jobs[dev.Device])
+		}
+		r.rebalances[deviceKeyId(dev.Device, policy)] = run
+	}
+	r.logger.Info("Object ring changed; rebalancing moved partitions", zap.Int("policy", policy),
+		zap.String("oldMD5", oldRing.MD5()), zap.String("newMD5", newRing.MD5()), zap.Int("devices", len(jobs)))
+}
+
+// rebalanceDevice pushes each of the device's moved partitions to its new
+// primary, retrying any that fail until they've all gone or the rebalance is
+// superseded.
+func (r *Replicator) rebalanceDevice(key string, run *rebalanceRun, jobs []*PriorityRepJob) {
+	total := len(jobs)
+	for len(jobs) > 0 {
+		var failed []*PriorityRepJob
+		for _, job := range jobs {
+			select {
+			case <-run.cancel:
+				return
+			default:
+			}
+			if ok, status := r.rebalanceReplicate(key, run, job); ok {
+				r.updateRebalance(run, func(s *RebalanceStatus) {
+					s.PartitionsDone++
+					if s.BytesRemaining -= run.partBytes; s.BytesRemaining < 0 {
+						s.BytesRemaining = 0
+					}
+				})
+			} else {
+				r.logger.Error("Error rebalancing partition", zap.String("device", key), zap.Uint64("partition", job.Partition),
+					zap.String("toDevice", job.ToDevice.Device), zap.Int("status", status))
+				failed = append(failed, job)
+			}
+		}
+		r.updateRebalance(run, func(s *RebalanceStatus) { s.PartitionsFailed = int64(len(failed)) })
+		if jobs = failed; len(jobs) > 0 {
+			select {
+			case <-run.cancel:
+				return
+			case <-time.After(rebalanceRetryInterval):
+			}
+		}
+	}
+	r.updateRebalance(run, func(s *RebalanceStatus) {
+		s.Complete = true
+		s.BytesRemaining = 0
+	})
+	r.logger.Info("Rebalance complete", zap.String("device", key), zap.Int("partitions", total))
+}
+
+// rebalanceReplicate runs job on the device's replication device.
+func (r *Replicator) rebalanceReplicate(key string, run *rebalanceRun, job *PriorityRepJob) (bool, int) {
+	if run.rd == nil {
+		return r.localPriorityReplicate(key, job)
+	}
+	resp := &priRepRecorder{header: http.Header{}}
+	run.rd.PriorityReplicate(resp, *job)
+	return resp.ok(), resp.status
+}
+
+func (r *Replicator) runRebalanceChecks() {
+	for {
+		r.checkRings()
+		time.Sleep(rebalanceCheckInterval)
+	}
+}
+
+// rebalanceHandler reports the progress of the latest rebalance on each
+// local device.
+func (r *Replicator) rebalanceHandler(writer http.ResponseWriter, request *http.Request) {
+	r.rebalancesLock.Lock()
+	statuses := make([]RebalanceStatus, 0, len(r.rebalances))
+	for _, run := range r.rebalances {
+		statuses = append(statuses, run.status)
+	}
+	r.rebalancesLock.Unlock()
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Policy != statuses[j].Policy {
+			return statuses[i].Policy < statuses[j].Policy
+		}
+		return statuses[i].Device < statuses[j].Device
+	})
+	data, err := json.Marshal(statuses)
+	if err != nil {
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(data)
+}
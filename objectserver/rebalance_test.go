@@ -0,0 +1,143 @@
+package objectserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/common/test"
+)
+
+type rebalanceFakeRing struct {
+	*priFakeRing
+	md5   string
+	local []*ring.Device
+}
+
+func (f *rebalanceFakeRing) LocalDevices(localPort int) ([]*ring.Device, error) {
+	return f.local, nil
+}
+
+func (f *rebalanceFakeRing) MD5() string                          { return f.md5 }
+func (f *rebalanceFakeRing) DiskPath() string                     { return "" }
+func (f *rebalanceFakeRing) RingMatching(md5 string) ring.RingMD5 { return nil }
+func (f *rebalanceFakeRing) Reload() error                        { return nil }
+func (f *rebalanceFakeRing) AssignmentCount(devId int) int        { return 4 }
+
+func TestRebalance(t *testing.T) {
+	oldRetry := rebalanceRetryInterval
+	rebalanceRetryInterval = time.Millisecond
+	defer func() { rebalanceRetryInterval = oldRetry }()
+	r, _, err := newTestReplicator(srv.NewTestConfigLoader(&test.FakeRing{}), "check_mounts", "no")
+	require.Nil(t, err)
+	local := []*ring.Device{{Id: 1, Device: "drive1"}, {Id: 9, Device: "drive9"}}
+	oldRing := &rebalanceFakeRing{md5: "old", local: local, priFakeRing: &priFakeRing{
+		mapping: map[uint64][]int{0: {1, 2, 3}, 1: {1, 4, 5}, 2: {2, 3, 4}},
+	}}
+	newRing := &rebalanceFakeRing{md5: "new", local: local, priFakeRing: &priFakeRing{
+		mapping:  map[uint64][]int{0: {6, 2, 3}, 1: {7, 4, 5}, 2: {2, 3, 4}},
+		fakeDevs: []*ring.Device{{Id: 1, Device: "drive1", Ip: "127.0.0.1", Port: 1}},
+	}}
+
+	var lock sync.Mutex
+	var replicated []uint64
+	failedOnce := false
+	r.runningDevices = map[string]ReplicationDevice{
+		"drive1": &mockReplicationDevice{_PriorityReplicate: func(w http.ResponseWriter, pri PriorityRepJob) error {
+			lock.Lock()
+			defer lock.Unlock()
+			// The first try at partition 1 fails, so it's retried.
+			if pri.Partition == 1 && !failedOnce {
+				failedOnce = true
+				w.WriteHeader(500)
+				return nil
+			}
+			replicated = append(replicated, pri.Partition)
+			w.WriteHeader(200)
+			w.Write([]byte(`{"Success": true}`))
+			return nil
+		}},
+	}
+	r.startRebalance(0, oldRing, newRing)
+
+	get := func() []RebalanceStatus {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/rebalance", nil)
+		require.Nil(t, err)
+		r.rebalanceHandler(w, req)
+		require.Equal(t, 200, w.Code)
+		var statuses []RebalanceStatus
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &statuses))
+		return statuses
+	}
+	for i := 0; i < 100 && !get()[0].Complete; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	statuses := get()
+	require.Equal(t, 2, len(statuses))
+	require.Equal(t, "drive1", statuses[0].Device)
+	require.Equal(t, "new", statuses[0].RingMD5)
+	require.True(t, statuses[0].Complete)
+	require.Equal(t, int64(2), statuses[0].PartitionsTotal)
+	require.Equal(t, int64(2), statuses[0].PartitionsDone)
+	require.Equal(t, int64(0), statuses[0].PartitionsFailed)
+	require.Equal(t, int64(0), statuses[0].BytesRemaining)
+	require.Equal(t, float64(100), statuses[0].PercentComplete)
+	lock.Lock()
+	require.Equal(t, []uint64{0, 1}, replicated)
+	lock.Unlock()
+
+	// Nothing moved off drive9.
+	require.Equal(t, "drive9", statuses[1].Device)
+	require.True(t, statuses[1].Complete)
+	require.Equal(t, int64(0), statuses[1].PartitionsTotal)
+	require.Equal(t, float64(100), statuses[1].PercentComplete)
+}
+
+type rebalanceFakeEngine struct {
+	ObjectEngine
+	rd ReplicationDevice
+}
+
+func (f *rebalanceFakeEngine) GetReplicationDevice(oring ring.Ring, dev *ring.Device, r *Replicator) (ReplicationDevice, error) {
+	return f.rd, nil
+}
+
+func TestRebalanceOldRingDevice(t *testing.T) {
+	r, _, err := newTestReplicator(srv.NewTestConfigLoader(&test.FakeRing{}), "check_mounts", "no")
+	require.Nil(t, err)
+	// drive2 is still in the ring, but no longer counted as local.
+	oldRing := &rebalanceFakeRing{md5: "old", local: []*ring.Device{{Id: 1, Device: "drive1"}, {Id: 2, Device: "drive2"}}, priFakeRing: &priFakeRing{
+		mapping: map[uint64][]int{0: {1, 3, 4}, 1: {2, 3, 4}},
+	}}
+	newRing := &rebalanceFakeRing{md5: "new", local: []*ring.Device{{Id: 1, Device: "drive1"}}, priFakeRing: &priFakeRing{
+		mapping:  map[uint64][]int{0: {1, 3, 4}, 1: {8, 3, 4}},
+		fakeDevs: []*ring.Device{{Id: 1, Device: "drive1", Ip: "127.0.0.1", Port: 1}, {Id: 2, Device: "drive2", Ip: "127.0.0.1", Port: 2}},
+	}}
+	replicated := make(chan PriorityRepJob, 1)
+	r.objEngines[0] = &rebalanceFakeEngine{rd: &mockReplicationDevice{_PriorityReplicate: func(w http.ResponseWriter, pri PriorityRepJob) error {
+		replicated <- pri
+		w.WriteHeader(200)
+		w.Write([]byte(`{"Success": true}`))
+		return nil
+	}}}
+	r.startRebalance(0, oldRing, newRing)
+	select {
+	case pri := <-replicated:
+		require.Equal(t, uint64(1), pri.Partition)
+		require.Equal(t, "drive2", pri.FromDevice.Device)
+		require.Equal(t, 8, pri.ToDevice.Id)
+	case <-time.After(time.Second):
+		t.Fatal("partition 1 wasn't pushed off drive2")
+	}
+	r.rebalancesLock.Lock()
+	require.Equal(t, 2, len(r.rebalances))
+	require.Equal(t, int64(1), r.rebalances[deviceKeyId("drive2", 0)].status.PartitionsTotal)
+	r.rebalancesLock.Unlock()
+}
@@ -26,17 +26,31 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
 	"github.com/troubling/hummingbird/common/ring"
 )
 
 var RepUnmountedError = fmt.Errorf("Device unmounted")
+var RepBusyError = fmt.Errorf("Device busy")
 var repDialer = (&net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}).Dial
 
 const repConnBufferSize = 32768
 
+// Replication connections aren't made through an http.Client, so they're
+// signed here with keys loaded the first time one's made.
+var repSigningKeys = func() func() [][]byte {
+	var once sync.Once
+	var keys [][]byte
+	return func() [][]byte {
+		once.Do(func() { keys = conf.GetBackendSigningKeys() })
+		return keys
+	}
+}()
+
 type BeginReplicationRequest struct {
 	Device     string
 	Partition  string
@@ -174,7 +188,13 @@ func (r *repConn) Close() {
 
 func NewRepConn(dev *ring.Device, partition string, policy int, headers map[string]string, certFile, keyFile string, rcTimeout time.Duration) (RepConn, error) {
 	url := fmt.Sprintf("%s://%s:%d/%s/%s", dev.Scheme, dev.ReplicationIp, dev.ReplicationPort, dev.Device, partition)
-	req, err := http.NewRequest("REPCONN", url, nil)
+	return dialRepConn("REPCONN", url, dev, policy, headers, certFile, keyFile, rcTimeout)
+}
+
+// dialRepConn makes a method request to url on dev's replication server and
+// takes over its connection once the server accepts it.
+func dialRepConn(method, url string, dev *ring.Device, policy int, headers map[string]string, certFile, keyFile string, rcTimeout time.Duration) (RepConn, error) {
+	req, err := http.NewRequest(method, url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -184,6 +204,9 @@ func NewRepConn(dev *ring.Device, partition string, policy int, headers map[stri
 	for k, v := range headers {
 		req.Header.Set(k, v)
 	}
+	if keys := repSigningKeys(); len(keys) > 0 {
+		common.SignBackendRequest(req, keys[0])
+	}
 	conn, err := repDialer("tcp", req.URL.Host)
 	if err != nil {
 		return nil, err
@@ -201,6 +224,10 @@ func NewRepConn(dev *ring.Device, partition string, policy int, headers map[stri
 	if err != nil {
 		return nil, err
 	}
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		hc.Close()
+		return nil, RepBusyError
+	}
 	if resp.StatusCode/100 != 2 {
 		return nil, RepUnmountedError
 	}
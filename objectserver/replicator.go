@@ -56,6 +56,9 @@ type PriorityRepJob struct {
 	FromDevice *ring.Device `json:"from_device"`
 	ToDevice   *ring.Device `json:"to_device"`
 	Policy     int          `json:"policy"`
+	// Prewarm has the handoff hold the copies for FromDevice rather than
+	// removing them once the primaries have them; see prewarmHold.
+	Prewarm bool `json:"prewarm,omitempty"`
 }
 
 func deviceKeyId(dev string, policy int) string {
@@ -126,26 +129,43 @@ type Replicator struct {
 	clientTraceCloser   io.Closer
 	tracer              opentracing.Tracer
 	auditor             *AuditorDaemon
-
-	stats                   map[string]map[string]*DeviceStats
-	runningDevices          map[string]ReplicationDevice
-	updatingDevices         map[string]*updateDevice
-	runningDevicesLock      sync.Mutex
-	logger                  srv.LowLevelLogger
-	objectRings             map[int]ring.Ring
-	objEngines              map[int]ObjectEngine
-	containerRing           ring.Ring
-	replicateConcurrencySem chan struct{}
-	updateConcurrencySem    chan struct{}
-	nurseryConcurrencySem   chan struct{}
-	updateStat              chan statUpdate
-	onceDone                chan struct{}
-	onceWaiting             int64
-	client                  common.HTTPClient
-	incomingSemLock         sync.Mutex
-	incomingSem             map[string]chan struct{}
-	asyncWG                 sync.WaitGroup // Used to wait on async goroutines
-	rcTimeout               time.Duration
+	expirer             *expirer
+	adminAuth           *middleware.AdminAuth
+
+	stats                 map[string]map[string]*DeviceStats
+	runningDevices        map[string]ReplicationDevice
+	updatingDevices       map[string]*updateDevice
+	runningDevicesLock    sync.Mutex
+	logger                srv.LowLevelLogger
+	objectRings           map[int]ring.Ring
+	objEngines            map[int]ObjectEngine
+	containerRing         ring.Ring
+	deviceWorkers         int
+	replicateConcurrency  *concurrencyLimit
+	replicateByteLimit    *common.KeyedRateLimit
+	schedule              repSchedule
+	updateConcurrencySem  chan struct{}
+	nurseryConcurrencySem chan struct{}
+	updateStat            chan statUpdate
+	onceDone              chan struct{}
+	onceWaiting           int64
+	client                common.HTTPClient
+	backends              *common.BackendTransport
+	incomingSemLock       sync.Mutex
+	incomingSem           map[string]chan struct{}
+	asyncWG               sync.WaitGroup // Used to wait on async goroutines
+	rcTimeout             time.Duration
+	streamReplication     bool
+	streamByteLimit       int64
+	asyncRetryInterval    time.Duration
+	asyncMaxRetryInterval time.Duration
+	drainsLock            sync.Mutex
+	drains                map[string]*DrainStatus
+	hashPathPrefix        string
+	hashPathSuffix        string
+	ringSnapshots         map[int]*ringSnapshot
+	rebalancesLock        sync.Mutex
+	rebalances            map[string]*rebalanceRun
 }
 
 func (server *Replicator) Type() string {
@@ -162,13 +182,22 @@ func (server *Replicator) Background(flags *flag.FlagSet) chan struct{} {
 		go func() {
 			defer close(ch)
 			server.Run()
+			if server.expirer != nil {
+				server.expirer.run()
+			}
 		}()
 		return ch
 	}
 	go server.RunForever()
+	go server.runSchedule()
+	go server.runRebalanceChecks()
 	if server.auditor != nil {
+		server.auditor.metricsScope = server.metricsScope
 		go server.auditor.RunForever()
 	}
+	if server.expirer != nil {
+		go server.expirer.runForever()
+	}
 	return nil
 }
 
@@ -226,6 +255,7 @@ func (r *Replicator) verifyRunningDevices() {
 	r.runningDevicesLock.Lock()
 	defer r.runningDevicesLock.Unlock()
 	expectedDevices := make(map[string]bool)
+	frozenDevices := make(map[string]bool)
 	for policy, oring := range r.objectRings {
 		ringDevices, err := oring.LocalDevices(r.port)
 		if err != nil {
@@ -237,14 +267,17 @@ func (r *Replicator) verifyRunningDevices() {
 			r.logger.Error("Error finding engine for policy", zap.Int("policy", policy), zap.Error(err))
 			return
 		}
+		// a frozen policy's devices stop replicating, but keep their updaters
+		frozen := r.policies[policy] != nil && r.policies[policy].FreezeReplication
 		// look for devices that aren't running but should be
 		for _, dev := range ringDevices {
 			key := deviceKeyId(dev.Device, policy)
 			expectedDevices[key] = true
+			frozenDevices[key] = frozen
 			if len(r.devices) > 0 && !r.devices[dev.Device] {
 				continue
 			}
-			if _, ok := r.runningDevices[key]; !ok {
+			if _, ok := r.runningDevices[key]; !ok && !frozen {
 				if rd, err := objEngine.GetReplicationDevice(oring, dev, r); err == nil {
 					r.runningDevices[key] = rd
 					r.stats[rd.Type()][key] = &DeviceStats{
@@ -266,11 +299,15 @@ func (r *Replicator) verifyRunningDevices() {
 				r.addMetrics(r.stats["object-updater"][key], policy, dev.Device)
 				go r.updatingDevices[key].updateLoop()
 			}
+			// pick up drains that were under way when the replicator stopped
+			if deviceDraining(r.deviceRoot, dev.Device) {
+				r.startDrain(dev.Device)
+			}
 		}
 	}
 	// look for devices that are running but shouldn't be
 	for key, rd := range r.runningDevices {
-		if _, found := expectedDevices[key]; !found {
+		if _, found := expectedDevices[key]; !found || frozenDevices[key] {
 			rd.Cancel()
 			delete(r.runningDevices, key)
 		}
@@ -482,7 +519,9 @@ func NewReplicator(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLo
 	if !serverconf.HasSection("object-replicator") {
 		return ipPort, nil, nil, fmt.Errorf("Unable to find object-replicator config section")
 	}
-	concurrency := int(serverconf.GetInt("object-replicator", "concurrency", 1))
+	// concurrency caps how many partitions are replicated at once across all
+	// the node's devices, each of which runs device_workers of them at once.
+	concurrency := int(serverconf.GetInt("object-replicator", "concurrency", 0))
 	updaterConcurrency := int(serverconf.GetInt("object-updater", "concurrency", 2))
 	nurseryConcurrency := int(serverconf.GetInt("object-nursery", "concurrency", 2))
 
@@ -491,8 +530,13 @@ func NewReplicator(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLo
 	logLevel.UnmarshalText([]byte(strings.ToLower(logLevelString)))
 	certFile := serverconf.GetDefault("object-replicator", "cert_file", "")
 	keyFile := serverconf.GetDefault("object-replicator", "key_file", "")
+	caFile := serverconf.GetDefault("object-replicator", "ca_file", "")
+	if err := common.SetClusterCA(caFile); err != nil {
+		return ipPort, nil, nil, err
+	}
+	backendConfig := common.LoadBackendConfig(serverconf.GetSection("object-replicator"), common.DefaultBackendConfig)
 	transport := &http.Transport{
-		MaxIdleConnsPerHost: 100,
+		MaxIdleConnsPerHost: backendConfig.MaxIdleConnsPerNode,
 		MaxIdleConns:        0,
 	}
 	if certFile != "" && keyFile != "" {
@@ -505,9 +549,10 @@ func NewReplicator(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLo
 			return ipPort, nil, nil, fmt.Errorf("Error setting up http2: %v", err)
 		}
 	}
+	backends := common.NewBackendTransport(common.NewSigningTransport(transport, conf.GetBackendSigningKeys()), backendConfig)
 	httpClient := &http.Client{
 		Timeout:   time.Second * 60,
-		Transport: transport,
+		Transport: backends,
 	}
 	replicator := &Replicator{
 		reserve:             serverconf.GetInt("object-replicator", "fallocate_reserve", 0),
@@ -522,31 +567,47 @@ func NewReplicator(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLo
 		reclaimAge:          int64(serverconf.GetInt("object-replicator", "reclaim_age", int64(common.ONE_WEEK))),
 		incomingLimitPerDev: int64(serverconf.GetInt("object-replicator", "incoming_limit", 3)),
 
-		runningDevices:          make(map[string]ReplicationDevice),
-		updatingDevices:         make(map[string]*updateDevice),
-		objectRings:             make(map[int]ring.Ring),
-		replicateConcurrencySem: make(chan struct{}, concurrency),
-		updateConcurrencySem:    make(chan struct{}, updaterConcurrency),
-		nurseryConcurrencySem:   make(chan struct{}, nurseryConcurrency),
-		rcTimeout:               time.Duration(serverconf.GetInt("object-replicator", "replication_timeout_sec", 0)) * time.Second,
-		updateStat:              make(chan statUpdate),
-		devices:                 make(map[string]bool),
-		partitions:              make(map[string]bool),
-		onceDone:                make(chan struct{}),
-		client:                  httpClient,
-		incomingSem:             make(map[string]chan struct{}),
+		runningDevices:        make(map[string]ReplicationDevice),
+		updatingDevices:       make(map[string]*updateDevice),
+		objectRings:           make(map[int]ring.Ring),
+		deviceWorkers:         int(serverconf.GetInt("object-replicator", "device_workers", 1)),
+		updateConcurrencySem:  make(chan struct{}, updaterConcurrency),
+		nurseryConcurrencySem: make(chan struct{}, nurseryConcurrency),
+		rcTimeout:             time.Duration(serverconf.GetInt("object-replicator", "replication_timeout_sec", 0)) * time.Second,
+		streamReplication:     serverconf.GetBool("object-replicator", "stream_replication", false),
+		streamByteLimit:       serverconf.GetInt("object-replicator", "stream_byte_limit", 0),
+		asyncRetryInterval:    time.Duration(serverconf.GetFloat("object-updater", "retry_interval", 30) * float64(time.Second)),
+		asyncMaxRetryInterval: time.Duration(serverconf.GetFloat("object-updater", "max_retry_interval", 3600) * float64(time.Second)),
+		updateStat:            make(chan statUpdate),
+		devices:               make(map[string]bool),
+		partitions:            make(map[string]bool),
+		onceDone:              make(chan struct{}),
+		client:                httpClient,
+		backends:              backends,
+		incomingSem:           make(map[string]chan struct{}),
+		drains:                make(map[string]*DrainStatus),
+		ringSnapshots:         make(map[int]*ringSnapshot),
+		rebalances:            make(map[string]*rebalanceRun),
 		stats: map[string]map[string]*DeviceStats{
 			"object-replicator": {},
 			"object-updater":    {},
 			"object-nursery":    {},
 		},
 	}
+	byteLimit := serverconf.GetInt("object-replicator", "byte_limit", 0)
+	replicator.replicateConcurrency = newConcurrencyLimit(concurrency)
+	replicator.replicateByteLimit = common.NewKeyedRateLimit(byteLimit)
+	replicator.schedule = repSchedule{byteLimit: byteLimit, concurrency: concurrency}
+	if replicator.schedule.windows, err = parseRepSchedule(serverconf.GetDefault("object-replicator", "schedule", "")); err != nil {
+		return ipPort, nil, nil, fmt.Errorf("Invalid replication schedule: %v", err)
+	}
 	replicator.logLevel = logLevel
 
 	hashPathPrefix, hashPathSuffix, err := cnf.GetHashPrefixAndSuffix()
 	if err != nil {
 		return ipPort, nil, nil, fmt.Errorf("Unable to get hash prefix and suffix: %s", err)
 	}
+	replicator.hashPathPrefix, replicator.hashPathSuffix = hashPathPrefix, hashPathSuffix
 	if replicator.policies, err = cnf.GetPolicies(); err != nil {
 		return ipPort, nil, nil, err
 	}
@@ -564,6 +625,11 @@ func NewReplicator(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLo
 	if replicator.logger, err = srv.SetupLogger("object-replicator", &logLevel, flags); err != nil {
 		return ipPort, nil, nil, fmt.Errorf("Error setting up logger: %v", err)
 	}
+	replicator.applySchedule(time.Now())
+	if replicator.adminAuth, err = middleware.NewAdminAuth(serverconf.GetDefault("object-replicator", "admin_tokens", ""),
+		serverconf.GetDefault("object-replicator", "admin_cert_roles", ""), replicator.logger); err != nil {
+		return ipPort, nil, nil, err
+	}
 	if serverconf.HasSection("tracing") {
 		replicator.tracer, replicator.traceCloser, err = tracing.Init("object-replicator", replicator.logger, serverconf.GetSection("tracing"))
 		if err != nil {
@@ -604,9 +670,35 @@ func NewReplicator(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLo
 			replicator.quorumDelete = true
 		}
 	}
+	if serverconf.HasSection("object-expirer") {
+		replicator.expirer = newExpirer(replicator,
+			time.Duration(serverconf.GetFloat("object-expirer", "interval", 300)*float64(time.Second)),
+			int(serverconf.GetInt("object-expirer", "batch_size", 1000)))
+		// Policies whose engines don't expire objects themselves queue them
+		// in the .expiring_objects account instead.
+		for _, engine := range replicator.objEngines {
+			if _, ok := engine.(ExpiringObjectEngine); ok {
+				continue
+			}
+			pdc, err := client.NewProxyClient(replicator.policies, cnf, replicator.logger, certFile, keyFile, "", "", "", conf.Config{})
+			if err != nil {
+				return ipPort, nil, nil, fmt.Errorf("Could not make client: %v", err)
+			}
+			queue := pdc.NewRequestClient(nil, nil, replicator.logger)
+			queue.SetUserAgent("object-expirer")
+			replicator.expirer.queue = queue
+			replicator.expirer.divisor = serverconf.GetInt("app:object-server", "expiring_objects_container_divisor", 86400)
+			replicator.expirer.processes = int(serverconf.GetInt("object-expirer", "processes", 0))
+			replicator.expirer.process = int(serverconf.GetInt("object-expirer", "process", 0))
+			break
+		}
+	}
 	if serverconf.HasSection("object-auditor") {
 		replicator.auditor, err = NewAuditorDaemon(serverconf, flags, cnf)
 	}
-	ipPort = &srv.IpPort{Ip: replicator.bindIp, Port: replicator.port, CertFile: certFile, KeyFile: keyFile}
+	ipPort = &srv.IpPort{Ip: replicator.bindIp, Port: replicator.port, CertFile: certFile, KeyFile: keyFile, CAFile: caFile,
+		ClientCertOptional: !serverconf.GetBool("object-replicator", "require_client_cert", true),
+		HTTP2:              srv.NewHTTP2Config(serverconf.GetSection("object-replicator")),
+		UnixSocket:         serverconf.GetDefault("object-replicator", "bind_unix_socket", "")}
 	return ipPort, replicator, replicator.logger, err
 }
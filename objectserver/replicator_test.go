@@ -18,6 +18,7 @@ package objectserver
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -28,7 +29,9 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -65,7 +68,7 @@ func newTestReplicatorWithFlags(confLoader *srv.TestConfigLoader, settings []str
 	}
 	rep := replicator.(*Replicator)
 	rep.GetHandler(conf, fmt.Sprintf("test_object_replicator_%d", atomic.AddUint64(&testObjectReplicators, 1)))
-	rep.replicateConcurrencySem = make(chan struct{}, 1)
+	rep.replicateConcurrency = newConcurrencyLimit(1)
 	rep.updateConcurrencySem = make(chan struct{}, 1)
 	rep.updateStat = make(chan statUpdate, 100)
 	return rep, conf, nil
@@ -697,6 +700,106 @@ func TestReplicateAll(t *testing.T) {
 	require.False(t, fs.Exists(filename))
 }
 
+func TestReplicateAllPrewarmHold(t *testing.T) {
+	deviceRoot, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(deviceRoot)
+	nodes := []*ring.Device{{Id: 1, Device: "sda"}, {Id: 2, Device: "sdb"}, {Id: 3, Device: "sdc"}}
+	testRing := &test.FakeRing{MockDevices: nodes}
+	confLoader := srv.NewTestConfigLoader(testRing)
+	replicator, _, err := newTestReplicator(confLoader, "bind_port", "1234", "check_mounts", "no", "devices", deviceRoot)
+	require.Nil(t, err)
+	partition := "1"
+	partdir := filepath.Join(deviceRoot, "objects", partition)
+	filename := filepath.Join(partdir, "aaa", "00000000000000000000000000000000", "1472940619.68559")
+	require.Nil(t, os.MkdirAll(filepath.Dir(filename), 0777))
+	require.Nil(t, ioutil.WriteFile(filename, []byte("SOME DATA"), 0666))
+	require.Nil(t, writePrewarmHold(partdir, prewarmHold{Device: 2}))
+	away := false
+	rd := newPatchableReplicationDevice(testRing, replicator)
+	rd._beginReplication = func(dev *ring.Device, partition string, hashes bool, rChan chan beginReplicationResponse, headers map[string]string) {
+		if away && dev.Id == 2 {
+			rChan <- beginReplicationResponse{dev: dev, err: errors.New("connection refused")}
+			return
+		}
+		rChan <- beginReplicationResponse{dev: dev, hashes: make(map[string]string), conn: &mockRepConn{}}
+	}
+	rd._listObjFiles = func(objChan chan string, cancel chan struct{}, partdir string, needSuffix func(string) bool) {
+		if fs.Exists(filename) {
+			objChan <- filename
+		}
+		close(objChan)
+	}
+	rd._syncFile = func(objFile string, dst []*syncFileArg, handoff bool) (syncs int, insync int, err error) {
+		return 0, len(dst), nil
+	}
+	readHold := func() prewarmHold {
+		var hold prewarmHold
+		b, err := ioutil.ReadFile(filepath.Join(partdir, prewarmHoldFile))
+		require.Nil(t, err)
+		require.Nil(t, json.Unmarshal(b, &hold))
+		return hold
+	}
+
+	// Every primary has the copy, but the device hasn't gone down yet.
+	_, err = rd.replicateAll(replJob{partition, nodes, nil}, true)
+	require.Nil(t, err)
+	require.True(t, fs.Exists(filename))
+	require.False(t, readHold().Away)
+
+	// A priority replication to another device can't tell whether it's away.
+	_, err = rd.replicateAll(replJob{partition, nodes[:1], nil}, true)
+	require.Nil(t, err)
+	require.True(t, fs.Exists(filename))
+
+	away = true
+	_, err = rd.replicateAll(replJob{partition, nodes, nil}, true)
+	require.Nil(t, err)
+	require.True(t, fs.Exists(filename))
+	require.True(t, readHold().Away)
+
+	// It's back and synced, so the copy and the hold go.
+	away = false
+	_, err = rd.replicateAll(replJob{partition, nodes, nil}, true)
+	require.Nil(t, err)
+	require.False(t, fs.Exists(filename))
+	require.False(t, fs.Exists(filepath.Join(partdir, prewarmHoldFile)))
+
+	// An expired hold doesn't keep the copy.
+	require.Nil(t, os.MkdirAll(filepath.Dir(filename), 0777))
+	require.Nil(t, ioutil.WriteFile(filename, []byte("SOME DATA"), 0666))
+	require.Nil(t, writePrewarmHold(partdir, prewarmHold{Device: 2}))
+	oldTime := time.Now().Add(-prewarmHoldTime - time.Hour)
+	require.Nil(t, os.Chtimes(filepath.Join(partdir, prewarmHoldFile), oldTime, oldTime))
+	_, err = rd.replicateAll(replJob{partition, nodes, nil}, true)
+	require.Nil(t, err)
+	require.False(t, fs.Exists(filename))
+}
+
+func TestRepConnPrewarmHold(t *testing.T) {
+	deviceRoot, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(deviceRoot)
+	trs, err := makeReplicatorWebServer(srv.NewTestConfigLoader(&test.FakeRing{}))
+	require.Nil(t, err)
+	defer trs.Close()
+	trs.replicator.deviceRoot = deviceRoot
+	dev := &ring.Device{ReplicationIp: trs.host, ReplicationPort: trs.port, Device: "sda", Scheme: "http"}
+	rc, err := NewRepConn(dev, "1", 0, map[string]string{"X-Prewarm-Hold": "2"}, "", "", time.Minute)
+	require.Nil(t, err)
+	defer rc.Close()
+	require.Nil(t, rc.SendMessage(BeginReplicationRequest{Device: "sda", Partition: "1"}))
+	var brr BeginReplicationResponse
+	require.Nil(t, rc.RecvMessage(&brr))
+	require.Nil(t, rc.SendMessage(SyncFileRequest{Done: true}))
+
+	b, err := ioutil.ReadFile(filepath.Join(deviceRoot, "sda", "objects", "1", prewarmHoldFile))
+	require.Nil(t, err)
+	var hold prewarmHold
+	require.Nil(t, json.Unmarshal(b, &hold))
+	require.Equal(t, prewarmHold{Device: 2}, hold)
+}
+
 func TestCleanTemp(t *testing.T) {
 	deviceRoot, err := ioutil.TempDir("", "")
 	require.Nil(t, err)
@@ -739,6 +842,38 @@ func TestReplicate(t *testing.T) {
 	require.Equal(t, []string{"1", "2", "2", "3"}, calledWith)
 }
 
+func TestReplicateDeviceWorkers(t *testing.T) {
+	testRing := &test.FakeRing{}
+	confLoader := srv.NewTestConfigLoader(testRing)
+	replicator, _, err := newTestReplicator(confLoader, "bind_port", "1234", "check_mounts", "no", "device_workers", "3")
+	require.Nil(t, err)
+	require.Equal(t, 3, replicator.deviceWorkers)
+	rd := newPatchableReplicationDevice(testRing, replicator)
+	rd._listPartitions = func() ([]string, []string, error) {
+		return []string{"1", "2", "3", "4", "5", "6"}, nil, nil
+	}
+	var lock sync.Mutex
+	running, maxRunning := 0, 0
+	calledWith := []string{}
+	rd._replicatePartition = func(partition string) {
+		lock.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		calledWith = append(calledWith, partition)
+		lock.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		lock.Lock()
+		running--
+		lock.Unlock()
+	}
+	rd.Scan()
+	sort.Strings(calledWith)
+	require.Equal(t, []string{"1", "2", "3", "4", "5", "6"}, calledWith)
+	require.Equal(t, 3, maxRunning)
+}
+
 func TestCancelReplicate(t *testing.T) {
 	testRing := &test.FakeRing{}
 	confLoader := srv.NewTestConfigLoader(testRing)
@@ -938,6 +1073,43 @@ func TestVerifyDevices(t *testing.T) {
 	require.True(t, canceled)
 }
 
+func TestVerifyDevicesFrozenPolicy(t *testing.T) {
+	testRing := &test.FakeRing{MockLocalDevices: []*ring.Device{{Device: "sda"}}}
+	confLoader := srv.NewTestConfigLoader(testRing)
+	confLoader.GetPoliciesFunc = func() (conf.PolicyList, error) {
+		return conf.PolicyList(map[int]*conf.Policy{0: {Index: 0, Type: "replication", Name: "gold", Default: true, FreezeReplication: true}}), nil
+	}
+	canceled := false
+	replicator, _, err := newTestReplicator(confLoader, "bind_port", "1234", "check_mounts", "no")
+	require.Nil(t, err)
+	replicator.runningDevices = map[string]ReplicationDevice{
+		"sda": &mockReplicationDevice{
+			_Cancel: func() {
+				canceled = true
+			},
+		},
+	}
+	replicator.verifyRunningDevices()
+	require.True(t, canceled)
+	require.Equal(t, 0, len(replicator.runningDevices))
+	// The updater keeps going while replication is frozen.
+	require.Equal(t, 1, len(replicator.updatingDevices))
+	for _, ud := range replicator.updatingDevices {
+		ud.cancel()
+	}
+
+	w := httptest.NewRecorder()
+	job := &PriorityRepJob{
+		Partition:  0,
+		FromDevice: &ring.Device{Id: 1, Device: "sda"},
+		ToDevice:   &ring.Device{Id: 2, Device: "sdb"},
+	}
+	jsonned, _ := json.Marshal(job)
+	req, _ := http.NewRequest("POST", "/priorityrep", bytes.NewBuffer(jsonned))
+	replicator.priorityRepHandler(w, req)
+	require.EqualValues(t, 409, w.Code)
+}
+
 func TestReportStats(t *testing.T) {
 	testRing := &test.FakeRing{}
 	confLoader := srv.NewTestConfigLoader(testRing)
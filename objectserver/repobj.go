@@ -18,6 +18,7 @@ import (
 )
 
 var _ Object = &repObject{}
+var _ StreamingObjectStabilizer = &repObject{}
 
 type repObject struct {
 	IndexDBItem
@@ -311,20 +312,38 @@ func (ro *repObject) Stabilize(dev *ring.Device) error {
 }
 
 func (ro *repObject) Replicate(prirep PriorityRepJob) error {
+	return ro.ReplicateThrottled(prirep, nil)
+}
+
+func (ro *repObject) ReplicateThrottled(prirep PriorityRepJob, wait func(int)) error {
 	_, isHandoff := ro.ring.GetJobNodes(prirep.Partition, prirep.FromDevice.Id)
-	fp, err := os.Open(ro.Path)
-	if err != nil {
-		return err
+	// A tiered object's contents stay in the remote tier; only its stub is
+	// sent.
+	var body io.Reader = http.NoBody
+	if !ro.Tiered {
+		fp, err := os.Open(ro.Path)
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		body = fp
+		if wait != nil {
+			body = &throttledReadCloser{ReadCloser: fp, wait: wait}
+		}
 	}
-	defer fp.Close()
 	req, err := http.NewRequest("PUT",
 		fmt.Sprintf("%s://%s:%d/rep-obj/%s/%s",
 			prirep.ToDevice.Scheme, prirep.ToDevice.Ip, prirep.ToDevice.Port,
-			prirep.ToDevice.Device, ro.Hash), fp)
+			prirep.ToDevice.Device, ro.Hash), body)
 	if err != nil {
 		return err
 	}
-	req.ContentLength = ro.ContentLength()
+	if ro.Tiered {
+		req.ContentLength = 0
+		req.Header.Set("X-Backend-Tiered", "true")
+	} else {
+		req.ContentLength = ro.ContentLength()
+	}
 	req.Header.Set("X-Timestamp", ro.metadata["X-Timestamp"])
 	req.Header.Set("X-Backend-Storage-Policy-Index", strconv.Itoa(ro.policy))
 	req.Header.Set("X-Trans-Id", ro.txnId)
@@ -345,3 +364,24 @@ func (ro *repObject) Replicate(prirep PriorityRepJob) error {
 	}
 	return nil
 }
+
+// ReplicateStream is Replicate, sending the object over rs.
+func (ro *repObject) ReplicateStream(rs *repStream, prirep PriorityRepJob) error {
+	if ro.Tiered {
+		return ro.Replicate(prirep)
+	}
+	_, isHandoff := ro.ring.GetJobNodes(prirep.Partition, prirep.FromDevice.Id)
+	fp, err := os.Open(ro.Path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	if err = rs.send(ro.Hash, ro.Shard, ro.metadata, ro.ContentLength(), fp); err != nil {
+		return fmt.Errorf("error streaming obj %s: %v", ro.Hash, err)
+	}
+	if isHandoff {
+		_, err = ro.idb.Remove(ro.Hash, ro.Shard, ro.Timestamp, ro.Nursery, ro.Metahash)
+		return err
+	}
+	return nil
+}
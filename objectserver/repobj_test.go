@@ -341,3 +341,42 @@ func TestReplicateCanStabilizeFail(t *testing.T) {
 	require.NotNil(t, err)
 	require.Equal(t, int64(2), calls)
 }
+
+func TestReplicateThrottled(t *testing.T) {
+	fp, err := ioutil.TempFile("", "")
+	require.Nil(t, err)
+	defer os.Remove(fp.Name())
+	fp.Write([]byte("TESTING"))
+	fp.Close()
+	var received []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.Nil(t, err)
+	ro := &repObject{
+		IndexDBItem: IndexDBItem{
+			Hash: "00000011111122222233333344444455",
+			Path: fp.Name(),
+		},
+		client: http.DefaultClient,
+		ring:   &test.FakeRing{},
+		metadata: map[string]string{
+			"Content-Length": "7",
+			"X-Timestamp":    "1500000000.00000",
+			"name":           "/a/c/o",
+		},
+		policy: 1,
+	}
+	waited := 0
+	require.Nil(t, ro.ReplicateThrottled(PriorityRepJob{
+		FromDevice: &ring.Device{Id: 1},
+		ToDevice:   &ring.Device{Scheme: u.Scheme, Ip: u.Hostname(), Port: port, Device: "sda"},
+	}, func(n int) { waited += n }))
+	require.Equal(t, "TESTING", string(received))
+	require.Equal(t, 7, waited)
+}
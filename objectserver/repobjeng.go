@@ -28,6 +28,9 @@ import (
 
 const (
 	roShard = 0
+	// repTreeDepth is how many partition tree levels below the root replication
+	// compares before listing the differing leaf ranges.
+	repTreeDepth = 2
 )
 
 func init() {
@@ -85,15 +88,19 @@ func repEngineConstructor(config conf.Config, policy *conf.Policy, flags *flag.F
 		hashPathPrefix: hashPathPrefix,
 		hashPathSuffix: hashPathSuffix,
 		reserve:        config.GetInt("app:object-server", "fallocate_reserve", 0),
+		cacheSize:      config.GetInt("app:object-server", "indexdb_cache_size", 0),
 		policy:         policy.Index,
+		dbName:         "repng",
+		auditor:        repAuditor{},
 		ring:           rng,
 		idbs:           map[string]*IndexDB{},
 		dbPartPower:    int(dbPartPower),
 		numSubDirs:     subdirs,
 		client: &http.Client{
 			Timeout:   120 * time.Minute,
-			Transport: transport,
+			Transport: common.NewSigningTransport(transport, conf.GetBackendSigningKeys()),
 		},
+		expireOnStabilize: !config.HasSection("object-expirer"),
 	}
 	if re.logger, err = srv.SetupLogger("repobjengine", &logLevel, flags); err != nil {
 		return nil, fmt.Errorf("Error setting up logger: %v", err)
@@ -108,7 +115,10 @@ type repEngine struct {
 	hashPathPrefix string
 	hashPathSuffix string
 	reserve        int64
+	cacheSize      int64
 	policy         int
+	dbName         string
+	auditor        IndexDBAuditor
 	ring           ring.Ring
 	logger         srv.LowLevelLogger
 	idbs           map[string]*IndexDB
@@ -116,6 +126,9 @@ type repEngine struct {
 	dbPartPower    int
 	numSubDirs     int
 	client         *http.Client
+	// expireOnStabilize is set when no object-expirer is configured, so
+	// the stabilizer has to expire objects itself.
+	expireOnStabilize bool
 }
 
 func (re *repEngine) getDB(device string) (*IndexDB, error) {
@@ -125,11 +138,11 @@ func (re *repEngine) getDB(device string) (*IndexDB, error) {
 		return idb, nil
 	}
 	var err error
-	dbpath := filepath.Join(re.driveRoot, device, PolicyDir(re.policy), "repng.db")
-	path := filepath.Join(re.driveRoot, device, PolicyDir(re.policy), "repng")
+	dbpath := filepath.Join(re.driveRoot, device, PolicyDir(re.policy), re.dbName+".db")
+	path := filepath.Join(re.driveRoot, device, PolicyDir(re.policy), re.dbName)
 	temppath := filepath.Join(re.driveRoot, device, "tmp")
 	ringPartPower := bits.Len64(re.ring.PartitionCount() - 1)
-	re.idbs[device], err = NewIndexDB(dbpath, path, temppath, ringPartPower, re.dbPartPower, re.numSubDirs, re.reserve, re.logger, repAuditor{})
+	re.idbs[device], err = NewIndexDB(dbpath, path, temppath, ringPartPower, re.dbPartPower, re.numSubDirs, re.reserve, re.cacheSize, re.logger, re.auditor)
 	if err != nil {
 		return nil, err
 	}
@@ -154,11 +167,14 @@ func (re *repEngine) New(vars map[string]string, needData bool, asyncWG *sync.Wa
 	if idb, err := re.getDB(vars["device"]); err == nil {
 		obj.idb = idb
 		if item, err := idb.Lookup(hash, roShard, false); err == nil && item != nil {
+			if err = idb.LoadMetadata(item); err != nil {
+				return nil, err
+			}
 			obj.IndexDBItem = *item
 			if err = json.Unmarshal(item.Metabytes, &obj.metadata); err != nil {
 				return nil, fmt.Errorf("Error parsing metadata: %v", err)
 			}
-			if !item.Deletion {
+			if !item.Deletion && !item.Tiered {
 				if fi, err := os.Stat(item.Path); err != nil {
 					obj.Quarantine()
 					return nil, err
@@ -179,10 +195,64 @@ func (re *repEngine) New(vars map[string]string, needData bool, asyncWG *sync.Wa
 	}
 }
 
+var _ TimestampOnlyObjectEngine = &repEngine{}
+
+func (re *repEngine) TimestampOnly(vars map[string]string) (string, bool, error) {
+	idb, err := re.getDB(vars["device"])
+	if err != nil {
+		return "", false, err
+	}
+	item, err := idb.LookupTimestamp(ObjHash(vars, re.hashPathPrefix, re.hashPathSuffix), roShard)
+	if err != nil || item == nil {
+		return "", false, err
+	}
+	exists := !item.Deletion && (item.Expires == nil || *item.Expires > time.Now().Unix())
+	return common.CanonicalTimestamp(float64(item.Timestamp) / 1e9), exists, nil
+}
+
+var _ AsyncPendingObjectEngine = &repEngine{}
+var _ ExpiringObjectEngine = &repEngine{}
+var _ StreamingObjectEngine = &repEngine{}
+
+func (re *repEngine) AsyncPendingDB(device string) (*IndexDB, error) {
+	return re.getDB(device)
+}
+
+func (re *repEngine) StreamDB(device string) (*IndexDB, error) {
+	return re.getDB(device)
+}
+
+func (re *repEngine) ExpireObjects(device string, limit int) (int, error) {
+	idb, err := re.getDB(device)
+	if err != nil {
+		return 0, err
+	}
+	return idb.ExpireObjects(limit)
+}
+
 func (re *repEngine) GetReplicationDevice(oring ring.Ring, dev *ring.Device, r *Replicator) (ReplicationDevice, error) {
 	return GetNurseryDevice(oring, dev, re.policy, r, re)
 }
 
+// Close closes all of the engine's open IndexDBs.
+func (re *repEngine) Close() error {
+	re.dblock.Lock()
+	defer re.dblock.Unlock()
+	var firstErr error
+	for device, idb := range re.idbs {
+		if idb != nil {
+			if err := idb.Close(); err != nil {
+				re.logger.Error("error closing db", zap.String("device", device), zap.Error(err))
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+		delete(re.idbs, device)
+	}
+	return firstErr
+}
+
 func (re *repEngine) GetObjectsToReplicate(prirep PriorityRepJob, c chan ObjectStabilizer, cancel chan struct{}) {
 	defer close(c)
 	idb, err := re.getDB(prirep.FromDevice.Device)
@@ -190,30 +260,42 @@ func (re *repEngine) GetObjectsToReplicate(prirep PriorityRepJob, c chan ObjectS
 		re.logger.Error("error getting local db", zap.Error(err))
 		return
 	}
-	startHash, stopHash := idb.RingPartRange(int(prirep.Partition))
+	for _, hashRange := range re.partitionDiffRanges(idb, prirep) {
+		if !re.replicateRange(idb, prirep, hashRange[0], hashRange[1], c, cancel) {
+			return
+		}
+	}
+}
+
+// replicateRange sends the local items between startHash and stopHash that
+// the remote doesn't already have to c, returning false if cancelled.
+func (re *repEngine) replicateRange(idb *IndexDB, prirep PriorityRepJob, startHash, stopHash string, c chan ObjectStabilizer, cancel chan struct{}) bool {
 	items, err := idb.List(startHash, stopHash, "", 0)
 	if len(items) == 0 {
-		return
+		return true
 	}
-	url := fmt.Sprintf("%s://%s:%d/rep-partition/%s/%d", prirep.ToDevice.Scheme, prirep.ToDevice.Ip, prirep.ToDevice.Port, prirep.ToDevice.Device, prirep.Partition)
+	url := fmt.Sprintf("%s://%s:%d/rep-partition/%s/%d?start=%s&stop=%s", prirep.ToDevice.Scheme, prirep.ToDevice.Ip, prirep.ToDevice.Port, prirep.ToDevice.Device, prirep.Partition, startHash, stopHash)
 	req, err := http.NewRequest("GET", url, nil)
 	req.Header.Set("X-Backend-Storage-Policy-Index", strconv.Itoa(prirep.Policy))
 	req.Header.Set("User-Agent", "nursery-stabilizer")
 	resp, err := re.client.Do(req)
 
 	var remoteItems []*IndexDBItem
-	if err == nil && (resp.StatusCode/100 == 2 || resp.StatusCode == 404) {
-		if data, err := ioutil.ReadAll(resp.Body); err == nil {
-			if err = json.Unmarshal(data, &remoteItems); err != nil {
-				re.logger.Error("error unmarshaling partition list", zap.Error(err))
+	if err == nil {
+		defer resp.Body.Close()
+		if resp.StatusCode/100 == 2 || resp.StatusCode == 404 {
+			if data, err := ioutil.ReadAll(resp.Body); err == nil {
+				if err = json.Unmarshal(data, &remoteItems); err != nil {
+					re.logger.Error("error unmarshaling partition list", zap.Error(err))
+				}
+			} else {
+				re.logger.Error("error reading partition list", zap.Error(err))
 			}
-		} else {
-			re.logger.Error("error reading partition list", zap.Error(err))
 		}
 	}
 	if err != nil {
 		re.logger.Error("error getting local partition list", zap.Error(err))
-		return
+		return true
 	}
 	rii := 0
 	for _, item := range items {
@@ -238,6 +320,13 @@ func (re *repEngine) GetObjectsToReplicate(prirep PriorityRepJob, c chan ObjectS
 			rii++
 			break
 		}
+		if !sendItem {
+			continue
+		}
+		if err = idb.LoadMetadata(item); err != nil {
+			re.logger.Error("error loading metadata", zap.String("ObjHash", item.Hash), zap.Error(err))
+			continue
+		}
 		obj := &repObject{
 			IndexDBItem: *item,
 			reserve:     re.reserve,
@@ -255,14 +344,117 @@ func (re *repEngine) GetObjectsToReplicate(prirep PriorityRepJob, c chan ObjectS
 		if obj.Path, err = idb.WholeObjectPath(item.Hash, item.Shard, item.Timestamp, item.Nursery); err != nil {
 			continue // TODO: quarantine here too
 		}
-		if sendItem {
-			select {
-			case c <- obj:
-			case <-cancel:
-				return
+		select {
+		case c <- obj:
+		case <-cancel:
+			return false
+		}
+	}
+	return true
+}
+
+// partitionDiffRanges compares the local and remote merkle trees for the
+// job's partition a level at a time, only asking the remote for the children
+// of nodes that differ, and returns the hash ranges that are out of sync. An
+// in-sync partition returns no ranges. If the remote can't be compared at some
+// level, the differing ranges found so far are returned, which at worst is the
+// whole partition.
+func (re *repEngine) partitionDiffRanges(idb *IndexDB, prirep PriorityRepJob) [][2]string {
+	part := int(prirep.Partition)
+	depth := repTreeDepth
+	if int(idb.RingPartPower)+4*depth > 64 {
+		depth = (64 - int(idb.RingPartPower)) / 4
+	}
+	startHash, stopHash := idb.RingPartRange(part)
+	tree, err := idb.PartitionTree(part, depth)
+	if err != nil {
+		re.logger.Error("error getting local partition tree", zap.Error(err))
+		return [][2]string{{startHash, stopHash}}
+	}
+	remoteHash, err := re.remotePartitionHash(prirep)
+	if err != nil {
+		return [][2]string{{startHash, stopHash}}
+	}
+	if remoteHash == tree[0][0] {
+		return nil
+	}
+	diff := []int{0}
+	level := 0
+	for ; level < depth; level++ {
+		remoteNodes, err := re.remotePartitionTreeLevel(prirep, level+1, diff)
+		if err != nil {
+			break
+		}
+		var nextDiff []int
+		for _, parent := range diff {
+			for n := parent << 4; n < (parent+1)<<4; n++ {
+				if remoteNodes[n] != tree[level+1][n] {
+					nextDiff = append(nextDiff, n)
+				}
 			}
 		}
+		if len(nextDiff) == 0 {
+			// The remote changed between requests; let the next pass catch it.
+			return nil
+		}
+		diff = nextDiff
+	}
+	ranges := make([][2]string, 0, len(diff))
+	for _, n := range diff {
+		start, stop := idb.PartitionTreeRange(part, level, n)
+		ranges = append(ranges, [2]string{start, stop})
+	}
+	return ranges
+}
+
+// remotePartitionHash returns the remote's partition hash for the job.
+func (re *repEngine) remotePartitionHash(prirep PriorityRepJob) (string, error) {
+	url := fmt.Sprintf("%s://%s:%d/rep-partition-hash/%s/%d", prirep.ToDevice.Scheme, prirep.ToDevice.Ip, prirep.ToDevice.Port, prirep.ToDevice.Device, prirep.Partition)
+	data, err := re.getRemote(url, prirep.Policy)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// remotePartitionTreeLevel returns the remote's partition tree nodes at level
+// that are children of the given parents, keyed by node index.
+func (re *repEngine) remotePartitionTreeLevel(prirep PriorityRepJob, level int, parents []int) (map[int]string, error) {
+	nodes := make([]string, len(parents))
+	for i, parent := range parents {
+		nodes[i] = strconv.Itoa(parent)
+	}
+	url := fmt.Sprintf("%s://%s:%d/rep-partition-tree/%s/%d?level=%d&nodes=%s", prirep.ToDevice.Scheme, prirep.ToDevice.Ip, prirep.ToDevice.Port, prirep.ToDevice.Device, prirep.Partition, level, strings.Join(nodes, ","))
+	data, err := re.getRemote(url, prirep.Policy)
+	if err != nil {
+		return nil, err
 	}
+	remoteNodes := map[int]string{}
+	if err = json.Unmarshal(data, &remoteNodes); err != nil {
+		return nil, err
+	}
+	return remoteNodes, nil
+}
+
+// getRemote issues a replication GET to url, returning the body of a 2xx
+// response. The engine's client keeps its connections alive, so the requests
+// for each tree level reuse the same connection to the remote.
+func (re *repEngine) getRemote(url string, policy int) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Backend-Storage-Policy-Index", strconv.Itoa(policy))
+	req.Header.Set("User-Agent", "nursery-stabilizer")
+	resp, err := re.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("bad status %d from %s", resp.StatusCode, url)
+	}
+	return ioutil.ReadAll(resp.Body)
 }
 
 func (re *repEngine) GetObjectsToStabilize(device *ring.Device) (c chan ObjectStabilizer, cancel chan struct{}) {
@@ -278,7 +470,9 @@ func (re *repEngine) getObjectsToStabilize(device *ring.Device, c chan ObjectSta
 	if err != nil {
 		return
 	}
-	idb.ExpireObjects()
+	if re.expireOnStabilize {
+		idb.ExpireObjects(0)
+	}
 
 	idbItems, err := idb.ListObjectsToStabilize()
 	if err != nil {
@@ -288,6 +482,10 @@ func (re *repEngine) getObjectsToStabilize(device *ring.Device, c chan ObjectSta
 
 	//TODO: do we add the skip stuff here? stabilize is a lot easier here
 	for _, item := range idbItems {
+		if err = idb.LoadMetadata(item); err != nil {
+			re.logger.Error("error loading metadata", zap.String("ObjHash", item.Hash), zap.Error(err))
+			continue
+		}
 		obj := &repObject{
 			IndexDBItem: *item,
 			reserve:     re.reserve,
@@ -327,6 +525,12 @@ func (re *repEngine) listPartitionHandler(writer http.ResponseWriter, request *h
 		return
 	}
 	startHash, stopHash := idb.RingPartRange(part)
+	if start := strings.ToLower(request.FormValue("start")); start > startHash && start <= stopHash {
+		startHash = start
+	}
+	if stop := strings.ToLower(request.FormValue("stop")); stop != "" && stop >= startHash && stop < stopHash {
+		stopHash = stop
+	}
 	items, err := idb.List(startHash, stopHash, "", 0)
 	if err != nil {
 		re.logger.Error("error listing idb", zap.Error(err))
@@ -344,6 +548,78 @@ func (re *repEngine) listPartitionHandler(writer http.ResponseWriter, request *h
 	return
 }
 
+func (re *repEngine) partitionHashHandler(writer http.ResponseWriter, request *http.Request) {
+	vars := srv.GetVars(request)
+	idb, err := re.getDB(vars["device"])
+	if err != nil {
+		srv.StandardResponse(writer, http.StatusBadRequest)
+		return
+	}
+	part, err := strconv.Atoi(vars["partition"])
+	if err != nil {
+		srv.StandardResponse(writer, http.StatusBadRequest)
+		return
+	}
+	hash, err := idb.PartitionHash(part)
+	if err != nil {
+		re.logger.Error("error hashing idb partition", zap.Error(err))
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	writer.WriteHeader(http.StatusOK)
+	writer.Write([]byte(hash))
+}
+
+func (re *repEngine) partitionTreeHandler(writer http.ResponseWriter, request *http.Request) {
+	vars := srv.GetVars(request)
+	idb, err := re.getDB(vars["device"])
+	if err != nil {
+		srv.StandardResponse(writer, http.StatusBadRequest)
+		return
+	}
+	part, err := strconv.Atoi(vars["partition"])
+	if err != nil || part < 0 || part >= 1<<idb.RingPartPower {
+		srv.StandardResponse(writer, http.StatusBadRequest)
+		return
+	}
+	level, err := strconv.Atoi(request.FormValue("level"))
+	if err != nil || level < 1 || level > MaxPartitionTreeLevel {
+		srv.StandardResponse(writer, http.StatusBadRequest)
+		return
+	}
+	tree, err := idb.PartitionTree(part, level)
+	if err != nil {
+		re.logger.Error("error building idb partition tree", zap.Error(err))
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	nodes := map[int]string{}
+	if parents := request.FormValue("nodes"); parents == "" {
+		for n, hash := range tree[level] {
+			nodes[n] = hash
+		}
+	} else {
+		for _, p := range strings.Split(parents, ",") {
+			parent, err := strconv.Atoi(p)
+			if err != nil || parent < 0 || parent >= len(tree[level-1]) {
+				srv.StandardResponse(writer, http.StatusBadRequest)
+				return
+			}
+			for n := parent << 4; n < (parent+1)<<4; n++ {
+				nodes[n] = tree[level][n]
+			}
+		}
+	}
+	if data, err := json.Marshal(nodes); err == nil {
+		writer.WriteHeader(http.StatusOK)
+		writer.Write(data)
+		return
+	} else {
+		re.logger.Error("error marshaling idb partition tree", zap.Error(err))
+	}
+	srv.StandardResponse(writer, http.StatusInternalServerError)
+}
+
 func (re *repEngine) putStableObject(writer http.ResponseWriter, request *http.Request) {
 	vars := srv.GetVars(request)
 	idb, err := re.getDB(vars["device"])
@@ -404,6 +680,8 @@ func (re *repEngine) deleteStableObject(writer http.ResponseWriter, request *htt
 
 func (re *repEngine) RegisterHandlers(addRoute func(method, path string, handler http.HandlerFunc), metScope tally.Scope) {
 	addRoute("GET", "/rep-partition/:device/:partition", re.listPartitionHandler)
+	addRoute("GET", "/rep-partition-hash/:device/:partition", re.partitionHashHandler)
+	addRoute("GET", "/rep-partition-tree/:device/:partition", re.partitionTreeHandler)
 	addRoute("PUT", "/rep-obj/:device/:hash", re.putStableObject)
 	addRoute("POST", "/rep-obj/:device/:hash", re.postStableObject)
 	addRoute("DELETE", "/rep-obj/:device/:hash", re.deleteStableObject)
@@ -0,0 +1,254 @@
+package objectserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/common/test"
+)
+
+// newTestRepPeer serves a tiered engine's replication handlers, as the peer
+// another engine replicates to. Requests are passed to seen before they're
+// served.
+func newTestRepPeer(t *testing.T, seen func(*http.Request)) (*tierEngine, *ring.Device, func()) {
+	te, _, driveRoot := getTestTierEngine(t)
+	r, conf, err := newTestReplicator(srv.NewTestConfigLoader(&test.FakeRing{}))
+	require.Nil(t, err)
+	r.objEngines = map[int]ObjectEngine{0: te.repEngine}
+	handler := r.GetHandler(conf, fmt.Sprintf("hb_metrics_%d", atomic.AddInt32(&nonce, 1)))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if seen != nil {
+			seen(req)
+		}
+		handler.ServeHTTP(w, req)
+	}))
+	u, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.Nil(t, err)
+	dev := &ring.Device{Scheme: "http", Ip: u.Hostname(), Port: port, ReplicationIp: u.Hostname(), ReplicationPort: port, Device: "sda"}
+	return te, dev, func() {
+		ts.Close()
+		te.Close()
+		os.RemoveAll(driveRoot)
+	}
+}
+
+// putTestItem commits a stable item with the given contents at hsh as of
+// the X-Timestamp xts, returning the item's timestamp.
+func putTestItem(t *testing.T, idb *IndexDB, hsh string, xts string, body string) int64 {
+	ts, err := common.ParseDate(xts)
+	require.Nil(t, err)
+	timestamp := ts.UnixNano()
+	f, err := idb.TempFile(hsh, roShard, timestamp, int64(len(body)), false)
+	require.Nil(t, err)
+	f.Write([]byte(body))
+	require.Nil(t, idb.Commit(f, hsh, roShard, timestamp, "PUT", map[string]string{
+		"name":           "/a/c/" + hsh,
+		"X-Timestamp":    xts,
+		"Content-Length": strconv.Itoa(len(body)),
+		"ETag":           md5hash(body),
+	}, false, ""))
+	return timestamp
+}
+
+// replicateTestPartition replicates the partition from re to the peer and
+// returns the objects it sent.
+func replicateTestPartition(t *testing.T, re *repEngine, partition uint64, peer *ring.Device) []*repObject {
+	prirep := PriorityRepJob{Partition: partition, FromDevice: &ring.Device{Device: "sda"}, ToDevice: peer}
+	c := make(chan ObjectStabilizer)
+	go re.GetObjectsToReplicate(prirep, c, make(chan struct{}))
+	var sent []*repObject
+	for obj := range c {
+		require.Nil(t, obj.Replicate(prirep))
+		sent = append(sent, obj.(*repObject))
+	}
+	return sent
+}
+
+func testHashPartition(idb *IndexDB, hsh string) uint64 {
+	upper, _ := strconv.ParseUint(hsh[:16], 16, 64)
+	return upper >> (64 - idb.RingPartPower)
+}
+
+func TestReplicateTieredStub(t *testing.T) {
+	te, _, driveRoot := getTestTierEngine(t)
+	defer os.RemoveAll(driveRoot)
+	defer te.Close()
+	te.client = &http.Client{}
+	peer, peerDev, closePeer := newTestRepPeer(t, nil)
+	defer closePeer()
+
+	idb, err := te.getDB("sda")
+	require.Nil(t, err)
+	hsh := ObjHash(map[string]string{"account": "a", "container": "c", "obj": "o"}, te.hashPathPrefix, te.hashPathSuffix)
+	timestamp := putTestItem(t, idb, hsh, common.CanonicalTimestampFromTime(time.Now().Add(-2*time.Hour)), "just testing")
+	tiered, err := idb.SetTiered(hsh, roShard, timestamp)
+	require.Nil(t, err)
+	require.True(t, tiered)
+
+	// The peer lacks the stub, so it's sent without any contents.
+	partition := testHashPartition(idb, hsh)
+	sent := replicateTestPartition(t, te.repEngine, partition, peerDev)
+	require.Equal(t, 1, len(sent))
+	require.True(t, sent[0].Tiered)
+	peerDB, err := peer.getDB("sda")
+	require.Nil(t, err)
+	item, err := peerDB.Lookup(hsh, roShard, false)
+	require.Nil(t, err)
+	require.NotNil(t, item)
+	require.True(t, item.Tiered)
+	require.Equal(t, timestamp, item.Timestamp)
+	require.False(t, fs.Exists(item.Path))
+
+	// Both sides now hash the partition the same, so the next pass has
+	// nothing to do.
+	localTree, err := idb.PartitionTree(int(partition), repTreeDepth)
+	require.Nil(t, err)
+	peerTree, err := peerDB.PartitionTree(int(partition), repTreeDepth)
+	require.Nil(t, err)
+	require.Equal(t, localTree, peerTree)
+	require.Equal(t, 0, len(replicateTestPartition(t, te.repEngine, partition, peerDev)))
+
+	// A stub doesn't replace a newer version.
+	require.Equal(t, common.ErrConflict, peerDB.StablePutTiered(hsh, roShard, timestamp, map[string]string{}))
+}
+
+// testTreeHash returns a hash within the given node of the partition's tree
+// at repTreeDepth.
+func testTreeHash(idb *IndexDB, partition, node int) string {
+	start, _ := idb.PartitionTreeRange(partition, repTreeDepth, node)
+	return start[:31] + "1"
+}
+
+func TestReplicatePartitionTreeDiff(t *testing.T) {
+	te, _, driveRoot := getTestTierEngine(t)
+	defer os.RemoveAll(driveRoot)
+	defer te.Close()
+	te.client = &http.Client{}
+	var listings []url.Values
+	peer, peerDev, closePeer := newTestRepPeer(t, func(r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/rep-partition/") {
+			listings = append(listings, r.URL.Query())
+		}
+	})
+	defer closePeer()
+	idb, err := te.getDB("sda")
+	require.Nil(t, err)
+	peerDB, err := peer.getDB("sda")
+	require.Nil(t, err)
+
+	// Both have the items in nodes 17 and 51; only the local side has the
+	// one in node 50, which shares its parent with 51.
+	partition := 5
+	timestamp := common.GetTimestamp()
+	for _, node := range []int{17, 51} {
+		putTestItem(t, idb, testTreeHash(idb, partition, node), timestamp, "shared")
+		putTestItem(t, peerDB, testTreeHash(idb, partition, node), timestamp, "shared")
+	}
+	missing := testTreeHash(idb, partition, 50)
+	putTestItem(t, idb, missing, timestamp, "missing")
+
+	prirep := PriorityRepJob{Partition: uint64(partition), FromDevice: &ring.Device{Device: "sda"}, ToDevice: peerDev}
+	start, stop := idb.PartitionTreeRange(partition, repTreeDepth, 50)
+	require.Equal(t, [][2]string{{start, stop}}, te.partitionDiffRanges(idb, prirep))
+
+	sent := replicateTestPartition(t, te.repEngine, uint64(partition), peerDev)
+	require.Equal(t, 1, len(sent))
+	require.Equal(t, missing, sent[0].Hash)
+	require.Equal(t, 1, len(listings))
+	require.Equal(t, start, listings[0].Get("start"))
+	require.Equal(t, stop, listings[0].Get("stop"))
+
+	// In sync now, so nothing is listed or sent.
+	require.Equal(t, 0, len(te.partitionDiffRanges(idb, prirep)))
+	require.Equal(t, 0, len(replicateTestPartition(t, te.repEngine, uint64(partition), peerDev)))
+	require.Equal(t, 1, len(listings))
+}
+
+func TestRepPartitionHandlers(t *testing.T) {
+	peer, peerDev, closePeer := newTestRepPeer(t, nil)
+	defer closePeer()
+	peerDB, err := peer.getDB("sda")
+	require.Nil(t, err)
+	partition := 5
+	timestamp := common.GetTimestamp()
+	for _, node := range []int{17, 50, 51} {
+		putTestItem(t, peerDB, testTreeHash(peerDB, partition, node), timestamp, "testing")
+	}
+	get := func(path string) (int, []byte) {
+		resp, err := http.Get(fmt.Sprintf("http://%s:%d%s", peerDev.Ip, peerDev.Port, path))
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.Nil(t, err)
+		return resp.StatusCode, body
+	}
+
+	for _, path := range []string{
+		"/rep-partition-tree/sda/5",
+		"/rep-partition-tree/sda/5?level=0",
+		"/rep-partition-tree/sda/5?level=x",
+		fmt.Sprintf("/rep-partition-tree/sda/5?level=%d", MaxPartitionTreeLevel+1),
+		"/rep-partition-tree/sda/5?level=1&nodes=1",
+		"/rep-partition-tree/sda/5?level=2&nodes=16",
+		"/rep-partition-tree/sda/5?level=2&nodes=x",
+		"/rep-partition-tree/sda/-1?level=1",
+		"/rep-partition-tree/sda/64?level=1",
+		"/rep-partition-tree/sda/x?level=1",
+	} {
+		status, _ := get(path)
+		require.Equal(t, 400, status, path)
+	}
+
+	tree, err := peerDB.PartitionTree(partition, 2)
+	require.Nil(t, err)
+	status, body := get("/rep-partition-tree/sda/5?level=1")
+	require.Equal(t, 200, status)
+	nodes := map[int]string{}
+	require.Nil(t, json.Unmarshal(body, &nodes))
+	require.Equal(t, 16, len(nodes))
+	require.Equal(t, tree[1][3], nodes[3])
+	status, body = get("/rep-partition-tree/sda/5?level=2&nodes=3,1")
+	require.Equal(t, 200, status)
+	nodes = map[int]string{}
+	require.Nil(t, json.Unmarshal(body, &nodes))
+	require.Equal(t, 32, len(nodes))
+	require.Equal(t, tree[2][17], nodes[17])
+	require.Equal(t, tree[2][50], nodes[50])
+	_, ok := nodes[0]
+	require.False(t, ok)
+
+	list := func(query string) []string {
+		status, body := get("/rep-partition/sda/5" + query)
+		require.Equal(t, 200, status)
+		var items []*IndexDBItem
+		require.Nil(t, json.Unmarshal(body, &items))
+		var hashes []string
+		for _, item := range items {
+			hashes = append(hashes, item.Hash)
+		}
+		return hashes
+	}
+	require.Equal(t, 3, len(list("")))
+	start, stop := peerDB.PartitionTreeRange(partition, 2, 50)
+	require.Equal(t, []string{testTreeHash(peerDB, partition, 50)}, list("?start="+start+"&stop="+stop))
+	require.Equal(t, 2, len(list("?start="+start)))
+	// Bounds outside the partition are ignored.
+	require.Equal(t, 3, len(list("?start=0&stop=ffffffffffffffffffffffffffffffff")))
+}
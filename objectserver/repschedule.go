@@ -0,0 +1,202 @@
+package objectserver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// repScheduleInterval is how often the replicator checks whether it has moved
+// into another of its schedule's windows.
+var repScheduleInterval = time.Minute
+
+// concurrencyLimit is a counting semaphore whose limit can change while it's
+// in use. A limit of 0 means no limit.
+type concurrencyLimit struct {
+	lock  sync.Mutex
+	cond  *sync.Cond
+	limit int
+	inUse int
+}
+
+func newConcurrencyLimit(limit int) *concurrencyLimit {
+	c := &concurrencyLimit{limit: limit}
+	c.cond = sync.NewCond(&c.lock)
+	return c
+}
+
+func (c *concurrencyLimit) acquire() {
+	c.lock.Lock()
+	for c.limit > 0 && c.inUse >= c.limit {
+		c.cond.Wait()
+	}
+	c.inUse++
+	c.lock.Unlock()
+}
+
+func (c *concurrencyLimit) release() {
+	c.lock.Lock()
+	c.inUse--
+	c.lock.Unlock()
+	c.cond.Signal()
+}
+
+// setLimit changes the limit; holders over a lowered limit keep their slots
+// and no new ones are given out until enough are released.
+func (c *concurrencyLimit) setLimit(limit int) {
+	c.lock.Lock()
+	c.limit = limit
+	c.lock.Unlock()
+	c.cond.Broadcast()
+}
+
+// repWindow is a time of day, from start up to end minutes past midnight, in
+// which the replicator runs with different limits. A window whose end is
+// before its start runs past midnight.
+type repWindow struct {
+	spec        string
+	start, end  int
+	percent     int64
+	byteLimit   int64
+	concurrency int
+}
+
+func (w *repWindow) contains(minute int) bool {
+	if w.start <= w.end {
+		return minute >= w.start && minute < w.end
+	}
+	return minute >= w.start || minute < w.end
+}
+
+func parseTimeOfDay(s string) (int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil || hours < 0 || hours > 24 {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil || minutes < 0 || minutes > 59 || (hours == 24 && minutes != 0) {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return hours*60 + minutes, nil
+}
+
+// parseRepSchedule parses a schedule such as
+// "00:00-06:00 100%, 06:00-24:00 20%"; each window's limits are a percentage
+// of the configured byte_limit and concurrency, or byte_limit=N and
+// concurrency=N settings that replace them.
+func parseRepSchedule(schedule string) ([]*repWindow, error) {
+	var windows []*repWindow
+	for _, spec := range strings.Split(schedule, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		fields := strings.Fields(spec)
+		times := strings.Split(fields[0], "-")
+		if len(times) != 2 || len(fields) < 2 {
+			return nil, fmt.Errorf("invalid schedule window %q", spec)
+		}
+		w := &repWindow{spec: spec, percent: 100, byteLimit: -1, concurrency: -1}
+		var err error
+		if w.start, err = parseTimeOfDay(times[0]); err != nil {
+			return nil, err
+		}
+		if w.end, err = parseTimeOfDay(times[1]); err != nil {
+			return nil, err
+		}
+		for _, field := range fields[1:] {
+			if strings.HasSuffix(field, "%") {
+				if w.percent, err = strconv.ParseInt(strings.TrimSuffix(field, "%"), 10, 64); err != nil || w.percent < 1 {
+					return nil, fmt.Errorf("invalid percentage in schedule window %q", spec)
+				}
+			} else if strings.HasPrefix(field, "byte_limit=") {
+				if w.byteLimit, err = strconv.ParseInt(strings.TrimPrefix(field, "byte_limit="), 10, 64); err != nil || w.byteLimit < 0 {
+					return nil, fmt.Errorf("invalid byte_limit in schedule window %q", spec)
+				}
+			} else if strings.HasPrefix(field, "concurrency=") {
+				if w.concurrency, err = strconv.Atoi(strings.TrimPrefix(field, "concurrency=")); err != nil || w.concurrency < 0 {
+					return nil, fmt.Errorf("invalid concurrency in schedule window %q", spec)
+				}
+			} else {
+				return nil, fmt.Errorf("invalid setting %q in schedule window %q", field, spec)
+			}
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+// repSchedule sets the replicator's byte rate and partition concurrency from
+// the first of its windows that the time of day falls in, or to the
+// configured limits outside all of them.
+type repSchedule struct {
+	windows     []*repWindow
+	byteLimit   int64
+	concurrency int
+	current     *repWindow
+}
+
+// limits returns the byte rate and concurrency for the time t, and the
+// window they come from, if any.
+func (s *repSchedule) limits(t time.Time) (int64, int, *repWindow) {
+	minute := t.Hour()*60 + t.Minute()
+	for _, w := range s.windows {
+		if !w.contains(minute) {
+			continue
+		}
+		byteLimit := s.byteLimit * w.percent / 100
+		if w.byteLimit >= 0 {
+			byteLimit = w.byteLimit
+		}
+		concurrency := s.concurrency * int(w.percent) / 100
+		if s.concurrency > 0 && concurrency < 1 {
+			concurrency = 1
+		}
+		if w.concurrency >= 0 {
+			concurrency = w.concurrency
+		}
+		return byteLimit, concurrency, w
+	}
+	return s.byteLimit, s.concurrency, nil
+}
+
+// applySchedule updates the replicator's limits for the time t, logging
+// whenever that moves it into another window.
+func (r *Replicator) applySchedule(t time.Time) {
+	byteLimit, concurrency, w := r.schedule.limits(t)
+	r.replicateByteLimit.SetRate(byteLimit)
+	r.replicateConcurrency.setLimit(concurrency)
+	if w != r.schedule.current {
+		spec := "default"
+		if w != nil {
+			spec = w.spec
+		}
+		r.logger.Info("Replication schedule window changed", zap.String("window", spec),
+			zap.Int64("byteLimit", byteLimit), zap.Int("concurrency", concurrency))
+		r.schedule.current = w
+	}
+}
+
+func (r *Replicator) runSchedule() {
+	if len(r.schedule.windows) == 0 {
+		return
+	}
+	for {
+		time.Sleep(repScheduleInterval)
+		r.applySchedule(time.Now())
+	}
+}
+
+// throttleReplication waits until the replicator can send another n bytes
+// within its byte limit.
+func (r *Replicator) throttleReplication(n int) {
+	r.replicateByteLimit.Wait("", n)
+}
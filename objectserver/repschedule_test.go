@@ -0,0 +1,107 @@
+package objectserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+	"go.uber.org/zap"
+)
+
+func TestParseRepSchedule(t *testing.T) {
+	windows, err := parseRepSchedule("")
+	require.Nil(t, err)
+	require.Equal(t, 0, len(windows))
+
+	windows, err = parseRepSchedule("00:00-06:00 100%, 22:00-02:00 byte_limit=1000 concurrency=2, 06:00-24:00 20%")
+	require.Nil(t, err)
+	require.Equal(t, 3, len(windows))
+	require.Equal(t, 0, windows[0].start)
+	require.Equal(t, 360, windows[0].end)
+	require.Equal(t, int64(100), windows[0].percent)
+	require.Equal(t, int64(1000), windows[1].byteLimit)
+	require.Equal(t, 2, windows[1].concurrency)
+	require.Equal(t, 1440, windows[2].end)
+	require.Equal(t, int64(20), windows[2].percent)
+
+	for _, bad := range []string{"00:00-06:00", "00:00 100%", "0:00-25:00 100%", "00:00-06:60 100%", "00:00-06:00 0%", "00:00-06:00 fast", "00:00-06:00 concurrency=-1"} {
+		_, err = parseRepSchedule(bad)
+		require.NotNil(t, err, bad)
+	}
+}
+
+func TestRepScheduleLimits(t *testing.T) {
+	windows, err := parseRepSchedule("00:00-06:00 100%, 22:00-02:00 concurrency=8, 06:00-22:00 20%")
+	require.Nil(t, err)
+	s := &repSchedule{windows: windows, byteLimit: 1000000, concurrency: 4}
+	at := func(hour, minute int) time.Time {
+		return time.Date(2020, 1, 1, hour, minute, 0, 0, time.Local)
+	}
+
+	byteLimit, concurrency, w := s.limits(at(3, 0))
+	require.Equal(t, int64(1000000), byteLimit)
+	require.Equal(t, 4, concurrency)
+	require.Equal(t, windows[0], w)
+
+	byteLimit, concurrency, w = s.limits(at(12, 30))
+	require.Equal(t, int64(200000), byteLimit)
+	require.Equal(t, 1, concurrency)
+	require.Equal(t, windows[2], w)
+
+	// The window running past midnight covers 22:00 onwards; the first
+	// window still wins after midnight.
+	byteLimit, concurrency, w = s.limits(at(23, 0))
+	require.Equal(t, int64(1000000), byteLimit)
+	require.Equal(t, 8, concurrency)
+	require.Equal(t, windows[1], w)
+
+	s.windows = windows[:1]
+	byteLimit, concurrency, w = s.limits(at(12, 30))
+	require.Equal(t, int64(1000000), byteLimit)
+	require.Equal(t, 4, concurrency)
+	require.Nil(t, w)
+}
+
+func TestApplySchedule(t *testing.T) {
+	windows, err := parseRepSchedule("00:00-06:00 100%, 06:00-24:00 50%")
+	require.Nil(t, err)
+	r := &Replicator{
+		logger:               zap.NewNop(),
+		replicateConcurrency: newConcurrencyLimit(2),
+		replicateByteLimit:   common.NewKeyedRateLimit(1000),
+		schedule:             repSchedule{windows: windows, byteLimit: 1000, concurrency: 2},
+	}
+	r.applySchedule(time.Date(2020, 1, 1, 12, 0, 0, 0, time.Local))
+	require.Equal(t, int64(500), r.replicateByteLimit.Rate())
+	require.Equal(t, 1, r.replicateConcurrency.limit)
+	require.Equal(t, windows[1], r.schedule.current)
+	r.applySchedule(time.Date(2020, 1, 1, 1, 0, 0, 0, time.Local))
+	require.Equal(t, int64(1000), r.replicateByteLimit.Rate())
+	require.Equal(t, 2, r.replicateConcurrency.limit)
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	c := newConcurrencyLimit(1)
+	c.acquire()
+	acquired := make(chan struct{})
+	go func() {
+		c.acquire()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired past the limit")
+	case <-time.After(10 * time.Millisecond):
+	}
+	// Raising the limit lets the waiter through without a release.
+	c.setLimit(2)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("not acquired after raising the limit")
+	}
+	c.release()
+	c.release()
+	require.Equal(t, 0, c.inUse)
+}
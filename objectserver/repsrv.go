@@ -22,6 +22,7 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -36,8 +37,6 @@ import (
 	"github.com/troubling/hummingbird/common/ring"
 	"github.com/troubling/hummingbird/common/srv"
 	"github.com/troubling/hummingbird/middleware"
-	"github.com/uber-go/tally"
-	promreporter "github.com/uber-go/tally/prometheus"
 	"go.uber.org/zap"
 )
 
@@ -91,6 +90,12 @@ func (r *Replicator) priorityRepHandler(w http.ResponseWriter, req *http.Request
 		w.WriteHeader(400)
 		return
 	}
+	// Refuse outright rather than 404, which senders take to mean there's
+	// nothing to replicate.
+	if p := r.policies[pri.Policy]; p != nil && p.FreezeReplication {
+		w.WriteHeader(409)
+		return
+	}
 	if r.checkMounts {
 		if mounted, err := fs.IsMount(filepath.Join(r.deviceRoot, pri.FromDevice.Device)); err != nil || mounted == false {
 			w.WriteHeader(507)
@@ -200,6 +205,10 @@ func (r *Replicator) objRepConnHandler(writer http.ResponseWriter, request *http
 	if err != nil {
 		policy = 0
 	}
+	if deviceDraining(r.deviceRoot, vars["device"]) {
+		srv.StandardResponse(writer, http.StatusInsufficientStorage)
+		return
+	}
 
 	writer.WriteHeader(http.StatusOK)
 	if hijacker, ok := writer.(http.Hijacker); !ok {
@@ -227,6 +236,17 @@ func (r *Replicator) objRepConnHandler(writer http.ResponseWriter, request *http
 		}
 		defer r.incomingDone(brr.Device)
 	}
+	if holdFor := request.Header.Get("X-Prewarm-Hold"); holdFor != "" {
+		if devId, err := strconv.Atoi(holdFor); err == nil {
+			partdir := filepath.Join(r.deviceRoot, brr.Device, PolicyDir(policy), brr.Partition)
+			if err := os.MkdirAll(partdir, 0755); err == nil {
+				err = writePrewarmHold(partdir, prewarmHold{Device: devId})
+			}
+			if err != nil {
+				srv.GetLogger(request).Error("[ObjRepConnHandler] Error writing prewarm hold", zap.Error(err))
+			}
+		}
+	}
 	var hashes map[string]string
 	if brr.NeedHashes {
 		hashes, err = GetHashes(r.deviceRoot, brr.Device, brr.Partition, nil, r.reclaimAge, policy, srv.GetLogger(request))
@@ -321,12 +341,10 @@ func (r *Replicator) LogRequest(next http.Handler) http.Handler {
 }
 
 func (r *Replicator) GetHandler(config conf.Config, metricsPrefix string) http.Handler {
-	r.metricsScope, r.metricsCloser = tally.NewRootScope(tally.ScopeOptions{
-		Prefix:         metricsPrefix,
-		Tags:           map[string]string{},
-		CachedReporter: promreporter.NewReporter(promreporter.Options{}),
-		Separator:      promreporter.DefaultSeparator,
-	}, time.Second)
+	r.metricsScope, r.metricsCloser = srv.NewMetricsScope(config, metricsPrefix)
+	if r.backends != nil {
+		r.backends.SetMetricsScope(r.metricsScope)
+	}
 	commonHandlers := alice.New(
 		middleware.NewDebugResponses(config.GetBool("debug", "debug_x_source_code", false)),
 		r.LogRequest,
@@ -336,17 +354,24 @@ func (r *Replicator) GetHandler(config conf.Config, metricsPrefix string) http.H
 	router := srv.NewRouter()
 	router.Get("/metrics", prometheus.Handler())
 	router.Get("/loglevel", r.logLevel)
-	router.Put("/loglevel", r.logLevel)
+	router.Put("/loglevel", r.adminAuth.Require(middleware.AdminRoleLogLevel, r.logLevel))
 	router.Get("/healthcheck", commonHandlers.ThenFunc(r.HealthcheckHandler))
 	router.Get("/debug/pprof/:parm", http.DefaultServeMux)
 	router.Post("/debug/pprof/:parm", http.DefaultServeMux)
-	router.Post("/priorityrep", commonHandlers.ThenFunc(r.priorityRepHandler))
+	router.Post("/priorityrep", commonHandlers.Then(r.adminAuth.Require(middleware.AdminRoleReplication, http.HandlerFunc(r.priorityRepHandler))))
 	router.Post("/stabilize/:device/:partition/:account/:container/*obj", commonHandlers.ThenFunc(r.stabilizeHandler))
 	router.Get("/progress/:name", commonHandlers.ThenFunc(r.ProgressReportHandler))
+	router.Get("/drain/:device", commonHandlers.ThenFunc(r.drainHandler))
+	router.Get("/rebalance", commonHandlers.ThenFunc(r.rebalanceHandler))
+	router.Put("/drain/:device", commonHandlers.Then(r.adminAuth.Require(middleware.AdminRoleReplication, http.HandlerFunc(r.drainHandler))))
+	router.Delete("/drain/:device", commonHandlers.Then(r.adminAuth.Require(middleware.AdminRoleReplication, http.HandlerFunc(r.drainHandler))))
 	for _, policy := range r.policies {
 		router.HandlePolicy("REPCONN", "/:device/:partition", policy.Index, commonHandlers.ThenFunc(r.objRepConnHandler))
 		router.HandlePolicy("REPLICATE", "/:device/:partition/:suffixes", policy.Index, commonHandlers.ThenFunc(r.objReplicateHandler))
 		router.HandlePolicy("REPLICATE", "/:device/:partition", policy.Index, commonHandlers.ThenFunc(r.objReplicateHandler))
+		if _, ok := r.objEngines[policy.Index].(StreamingObjectEngine); ok {
+			router.HandlePolicy("REPSTREAM", "/:device", policy.Index, commonHandlers.ThenFunc(r.objRepStreamHandler))
+		}
 	}
 	router.Get("/debug/*_", http.DefaultServeMux)
 	for policy, objEngine := range r.objEngines {
@@ -0,0 +1,222 @@
+package objectserver
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/srv"
+	"go.uber.org/zap"
+)
+
+// StreamObjectRequest announces an object on a replication stream; unless
+// it's Done, the object's Size bytes follow once the receiver says to go
+// ahead.
+type StreamObjectRequest struct {
+	Hash     string
+	Shard    int
+	Metadata map[string]string
+	Size     int64
+	Done     bool
+}
+
+// StreamObjectResponse answers a StreamObjectRequest, once before the
+// object's contents are sent and, if they were, again once they're saved.
+type StreamObjectResponse struct {
+	GoAhead bool
+	Exists  bool
+	Success bool
+	Msg     string
+}
+
+// repStream sends objects over a single connection to a device's replication
+// server, one at a time: each object waits for the last to be saved, so a
+// slow receiver holds the sender back rather than piling up requests.
+type repStream struct {
+	rc RepConn
+	// wait, if set, is called with the size of each read of an object's
+	// contents before it's sent.
+	wait func(int)
+}
+
+func newRepStream(dev *ring.Device, policy int, certFile, keyFile string, rcTimeout time.Duration) (*repStream, error) {
+	url := fmt.Sprintf("%s://%s:%d/%s", dev.Scheme, dev.ReplicationIp, dev.ReplicationPort, dev.Device)
+	rc, err := dialRepConn("REPSTREAM", url, dev, policy, nil, certFile, keyFile, rcTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &repStream{rc: rc}, nil
+}
+
+// send replicates size bytes of body as hsh:shard with metadata. An object
+// the receiver already has, at that version or newer, isn't sent and counts
+// as success.
+func (rs *repStream) send(hsh string, shard int, metadata map[string]string, size int64, body io.Reader) error {
+	if err := rs.rc.SendMessage(StreamObjectRequest{Hash: hsh, Shard: shard, Metadata: metadata, Size: size}); err != nil {
+		return err
+	}
+	var resp StreamObjectResponse
+	if err := rs.rc.RecvMessage(&resp); err != nil {
+		return err
+	}
+	if resp.Exists {
+		return nil
+	}
+	if !resp.GoAhead {
+		return fmt.Errorf("refused: %s", resp.Msg)
+	}
+	if rs.wait != nil {
+		body = &throttledReadCloser{ReadCloser: ioutil.NopCloser(body), wait: rs.wait}
+	}
+	if _, err := common.CopyN(body, size, rs.rc); err != nil {
+		// The receiver is still waiting on the rest of the contents, so the
+		// stream can't be used for anything else.
+		rs.rc.Close()
+		return err
+	}
+	if err := rs.rc.Flush(); err != nil {
+		return err
+	}
+	if err := rs.rc.RecvMessage(&resp); err != nil {
+		return err
+	}
+	if !resp.Success {
+		return fmt.Errorf("not saved: %s", resp.Msg)
+	}
+	return nil
+}
+
+func (rs *repStream) disconnected() bool {
+	return rs.rc.Disconnected()
+}
+
+func (rs *repStream) Close() {
+	if !rs.rc.Disconnected() {
+		rs.rc.SendMessage(StreamObjectRequest{Done: true})
+	}
+	rs.rc.Close()
+}
+
+// receiveStreamedObject saves the object announced by sor into idb, reading
+// its contents from rc through wait. Errors returned leave the stream out of
+// step and end it; problems with the object alone are reported to the
+// sender instead.
+func receiveStreamedObject(idb *IndexDB, rc RepConn, sor *StreamObjectRequest, wait func(int)) error {
+	timestampTime, err := common.ParseDate(sor.Metadata["X-Timestamp"])
+	if err != nil {
+		return rc.SendMessage(StreamObjectResponse{Msg: "bad timestamp"})
+	}
+	timestamp := timestampTime.UnixNano()
+	atm, err := idb.TempFile(sor.Hash, sor.Shard, timestamp, sor.Size, false)
+	if err != nil {
+		return rc.SendMessage(StreamObjectResponse{Msg: err.Error()})
+	}
+	if atm == nil {
+		return rc.SendMessage(StreamObjectResponse{Exists: true, Msg: "exists"})
+	}
+	defer atm.Abandon()
+	if err = rc.SendMessage(StreamObjectResponse{GoAhead: true, Msg: "go ahead"}); err != nil {
+		return err
+	}
+	var body io.Reader = rc
+	if wait != nil {
+		body = &throttledReadCloser{ReadCloser: ioutil.NopCloser(rc), wait: wait}
+	}
+	sHash := md5.New()
+	if _, err = common.CopyN(body, sor.Size, atm, sHash); err != nil {
+		return err
+	}
+	if err = idb.Commit(atm, sor.Hash, sor.Shard, timestamp, "PUT", sor.Metadata, false, hex.EncodeToString(sHash.Sum(nil))); err != nil {
+		return rc.SendMessage(StreamObjectResponse{Msg: err.Error()})
+	}
+	return rc.SendMessage(StreamObjectResponse{Success: true, Msg: "saved"})
+}
+
+// objRepStreamHandler receives objects sent over a replication stream, each
+// connection taking one of the device's incoming replication slots and held
+// to stream_byte_limit bytes per second.
+func (r *Replicator) objRepStreamHandler(writer http.ResponseWriter, request *http.Request) {
+	vars := srv.GetVars(request)
+	logger := srv.GetLogger(request)
+	policy, err := strconv.Atoi(request.Header.Get("X-Backend-Storage-Policy-Index"))
+	if err != nil {
+		policy = 0
+	}
+	engine, ok := r.objEngines[policy].(StreamingObjectEngine)
+	if !ok {
+		srv.StandardResponse(writer, http.StatusBadRequest)
+		return
+	}
+	if r.checkMounts {
+		if mounted, err := fs.IsMount(filepath.Join(r.deviceRoot, vars["device"])); err != nil || !mounted {
+			srv.StandardResponse(writer, http.StatusInsufficientStorage)
+			return
+		}
+	}
+	if deviceDraining(r.deviceRoot, vars["device"]) {
+		srv.StandardResponse(writer, http.StatusInsufficientStorage)
+		return
+	}
+	idb, err := engine.StreamDB(vars["device"])
+	if err != nil {
+		logger.Error("[ObjRepStreamHandler] Error getting db", zap.String("device", vars["device"]), zap.Error(err))
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	if request.Header.Get("X-Force-Acquire") != "true" {
+		if !r.incomingBegin(vars["device"], replicateIncomingTimeout) {
+			logger.Error("[ObjRepStreamHandler] Timed out waiting for concurrency slot")
+			srv.StandardResponse(writer, http.StatusServiceUnavailable)
+			return
+		}
+		defer r.incomingDone(vars["device"])
+	}
+
+	var conn net.Conn
+	var rw *bufio.ReadWriter
+	writer.WriteHeader(http.StatusOK)
+	if hijacker, ok := writer.(http.Hijacker); !ok {
+		logger.Error("[ObjRepStreamHandler] Writer not a Hijacker")
+		return
+	} else if conn, rw, err = hijacker.Hijack(); err != nil {
+		logger.Error("[ObjRepStreamHandler] Hijack failed", zap.Error(err))
+		return
+	}
+	defer conn.Close()
+
+	rc := NewIncomingRepConn(rw, conn, r.rcTimeout)
+	var wait func(int)
+	if r.streamByteLimit > 0 {
+		limit := common.NewKeyedRateLimit(r.streamByteLimit)
+		wait = func(n int) { limit.Wait("", n) }
+	}
+	processed := int64(0)
+	startTime := time.Now()
+	for {
+		var sor StreamObjectRequest
+		if err := rc.RecvMessage(&sor); err != nil {
+			logger.Error("[ObjRepStreamHandler] Error receiving StreamObjectRequest", zap.Int64("processed", processed), zap.Error(err))
+			return
+		}
+		if sor.Done {
+			logger.Debug("[ObjRepStreamHandler] Stream done", zap.Int64("processed", processed), zap.Duration("timeTook", time.Since(startTime)))
+			return
+		}
+		if err := receiveStreamedObject(idb, rc, &sor, wait); err != nil {
+			logger.Error("[ObjRepStreamHandler] Error receiving object", zap.String("hash", sor.Hash), zap.Int64("processed", processed), zap.Error(err))
+			return
+		}
+		processed++
+	}
+}
@@ -0,0 +1,85 @@
+package objectserver
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/common/test"
+)
+
+func TestRepStream(t *testing.T) {
+	te, _, driveRoot := getTestTierEngine(t)
+	defer os.RemoveAll(driveRoot)
+	defer te.Close()
+	r, conf, err := newTestReplicator(srv.NewTestConfigLoader(&test.FakeRing{}), "stream_byte_limit", "1000000")
+	require.Nil(t, err)
+	r.objEngines = map[int]ObjectEngine{0: te.repEngine}
+	ts := httptest.NewServer(r.GetHandler(conf, fmt.Sprintf("hb_metrics_%d", atomic.AddInt32(&nonce, 1))))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.Nil(t, err)
+	dev := &ring.Device{Scheme: "http", ReplicationIp: u.Hostname(), ReplicationPort: port, Device: "sda"}
+
+	rs, err := newRepStream(dev, 0, "", "", 0)
+	require.Nil(t, err)
+	defer rs.Close()
+	idb, err := te.getDB("sda")
+	require.Nil(t, err)
+	send := func(obj, timestamp, body string) (string, error) {
+		hsh := ObjHash(map[string]string{"account": "a", "container": "c", "obj": obj}, te.hashPathPrefix, te.hashPathSuffix)
+		metadata := map[string]string{
+			"name":           "/a/c/" + obj,
+			"X-Timestamp":    timestamp,
+			"Content-Length": strconv.Itoa(len(body)),
+			"ETag":           md5hash(body),
+		}
+		return hsh, rs.send(hsh, roShard, metadata, int64(len(body)), bytes.NewBufferString(body))
+	}
+
+	older := common.CanonicalTimestampFromTime(time.Now().Add(-time.Hour))
+	timestamp := common.GetTimestamp()
+	hsh, err := send("o1", timestamp, "just testing")
+	require.Nil(t, err)
+	item, err := idb.Lookup(hsh, roShard, false)
+	require.Nil(t, err)
+	require.NotNil(t, item)
+	data, err := ioutil.ReadFile(item.Path)
+	require.Nil(t, err)
+	require.Equal(t, "just testing", string(data))
+
+	// The same or an older version is already there, so isn't sent again.
+	_, err = send("o1", timestamp, "something else")
+	require.Nil(t, err)
+	_, err = send("o1", older, "something else")
+	require.Nil(t, err)
+	data, err = ioutil.ReadFile(item.Path)
+	require.Nil(t, err)
+	require.Equal(t, "just testing", string(data))
+
+	// A bad object is refused without ending the stream.
+	_, err = send("o2", "not a timestamp", "just testing")
+	require.NotNil(t, err)
+	require.False(t, rs.disconnected())
+	hsh, err = send("o2", common.GetTimestamp(), "more testing")
+	require.Nil(t, err)
+	item, err = idb.Lookup(hsh, roShard, false)
+	require.Nil(t, err)
+	require.NotNil(t, item)
+	data, err = ioutil.ReadFile(item.Path)
+	require.Nil(t, err)
+	require.Equal(t, "more testing", string(data))
+}
@@ -80,6 +80,9 @@ func QuarantineHash(hashDir string) error {
 	if err := os.Rename(hashDir, destDir); err != nil {
 		return err
 	}
+	// Its modification time is shown as when it was quarantined.
+	now := time.Now()
+	os.Chtimes(destDir, now, now)
 	return nil
 }
 
@@ -154,6 +154,7 @@ func (rd *swiftDevice) listObjFiles(objChan chan string, cancel chan struct{}, p
 		return
 	}
 	if len(suffixDirs) == 0 {
+		os.Remove(filepath.Join(partdir, prewarmHoldFile))
 		os.Remove(filepath.Join(partdir, ".lock"))
 		os.Remove(filepath.Join(partdir, "hashes.pkl"))
 		os.Remove(filepath.Join(partdir, "hashes.invalid"))
@@ -255,6 +256,7 @@ func (rd *swiftDevice) syncFile(objFile string, dst []*syncFileArg, handoff bool
 	var totalRead int64
 	for length, err = fp.Read(scratch); err == nil; length, err = fp.Read(scratch) {
 		totalRead += int64(length)
+		rd.r.throttleReplication(length * len(wrs))
 		for index, sfa := range wrs {
 			if sfa == nil {
 				continue
@@ -326,6 +328,9 @@ func (rd *swiftDevice) PriorityReplicate(w http.ResponseWriter, pri PriorityRepJ
 	rjob := replJob{
 		partition: partition, nodes: []*ring.Device{pri.ToDevice},
 		headers: map[string]string{"X-Force-Acquire": "true"}}
+	if pri.Prewarm {
+		rjob.headers["X-Prewarm-Hold"] = strconv.Itoa(pri.FromDevice.Id)
+	}
 	var synced int64
 	var err error
 	w.WriteHeader(200)
@@ -492,6 +497,9 @@ func (rd *swiftDevice) replicateAll(rjob replJob, isHandoff bool) (int64, error)
 	if len(remoteConnections) == 0 {
 		return 0, fmt.Errorf("replicateAll could get no remote connections")
 	}
+	if isHandoff && rd.holdingPrewarm(path, rjob, remoteConnections) {
+		isHandoff = false
+	}
 
 	objChan := make(chan string, 100)
 	cancel := make(chan struct{})
@@ -534,6 +542,77 @@ func (rd *swiftDevice) replicateAll(rjob replJob, isHandoff bool) (int64, error)
 	return syncCount, nil
 }
 
+// prewarmHoldFile is kept in a handoff partition copied there by
+// prewarmdevice, naming the primary device the copies are held for.
+const prewarmHoldFile = "prewarm_hold"
+
+// prewarmHoldTime is how long a handoff holds prewarmed copies at most.
+const prewarmHoldTime = time.Hour * 24 * 7
+
+type prewarmHold struct {
+	Device int `json:"device"`
+	// Away is set once the device has been unreachable from the handoff.
+	Away bool `json:"away"`
+}
+
+func writePrewarmHold(partdir string, hold prewarmHold) error {
+	b, err := json.Marshal(hold)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(partdir, prewarmHoldFile), b, 0666)
+}
+
+// holdingPrewarm reports whether a handoff partition's copies are held for a
+// prewarmed device. They're held until that device has gone away and come
+// back, at which point this pass has just synced it, or until the device is
+// no longer a primary or the hold has expired.
+func (rd *swiftDevice) holdingPrewarm(partdir string, rjob replJob, conns map[int]RepConn) bool {
+	holdFile := filepath.Join(partdir, prewarmHoldFile)
+	fi, err := os.Stat(holdFile)
+	if err != nil {
+		return false
+	}
+	var hold prewarmHold
+	if b, err := ioutil.ReadFile(holdFile); err != nil || json.Unmarshal(b, &hold) != nil || time.Since(fi.ModTime()) > prewarmHoldTime {
+		os.Remove(holdFile)
+		return false
+	}
+	partition, err := strconv.ParseUint(rjob.partition, 10, 64)
+	if err != nil {
+		return true
+	}
+	primary := false
+	for _, dev := range rd.r.objectRings[rd.policy].GetNodes(partition) {
+		primary = primary || dev.Id == hold.Device
+	}
+	if !primary {
+		os.Remove(holdFile)
+		return false
+	}
+	pushed := false
+	for _, dev := range rjob.nodes {
+		pushed = pushed || dev.Id == hold.Device
+	}
+	if !pushed {
+		return true
+	}
+	if conns[hold.Device] == nil {
+		if !hold.Away {
+			hold.Away = true
+			if err := writePrewarmHold(partdir, hold); err != nil {
+				rd.r.logger.Error("Error updating prewarm hold", zap.String("partition", partdir), zap.Error(err))
+			}
+		}
+		return true
+	}
+	if hold.Away {
+		os.Remove(holdFile)
+		return false
+	}
+	return true
+}
+
 func (rd *swiftDevice) Key() string {
 	return deviceKeyId(rd.dev.Device, rd.policy)
 }
@@ -553,10 +632,8 @@ func (rd *swiftDevice) cleanTemp() {
 }
 
 func (rd *swiftDevice) replicatePartition(partition string) {
-	rd.r.replicateConcurrencySem <- struct{}{}
-	defer func() {
-		<-rd.r.replicateConcurrencySem
-	}()
+	rd.r.replicateConcurrency.acquire()
+	defer rd.r.replicateConcurrency.release()
 	partitioni, err := strconv.ParseUint(partition, 10, 64)
 	if err != nil {
 		return
@@ -634,27 +711,51 @@ func (rd *swiftDevice) Scan() {
 	}
 	rd.UpdateStat("PartitionsTotal", int64(len(allPartitionList)))
 
+	// Partitions are handed out in order to the device's workers, with a
+	// handoff slipped in every handoffToAllMod partitions.
+	workers := rd.r.deviceWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	partChan := make(chan string)
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for partition := range partChan {
+				rd.i.replicatePartition(partition)
+				time.Sleep(replicatePartSleepTime)
+			}
+		}()
+	}
+	canceled := false
+	send := func(partition string) bool {
+		select {
+		case <-rd.cancel:
+			rd.r.logger.Error("replicateDevice canceled for device", zap.String("Device", rd.dev.Device))
+			canceled = true
+			return false
+		case partChan <- partition:
+			return true
+		}
+	}
 	lastListing := time.Now()
 	handoffsForLog := len(handoffPartitions)
 	for i, partition := range allPartitionList {
 		rd.UpdateStat("checkin", 1)
-		select {
-		case <-rd.cancel:
-			{
-				rd.r.logger.Error("replicateDevice canceled for device", zap.String("Device", rd.dev.Device))
-				return
-			}
-		default:
+		if !send(partition) {
+			break
 		}
-		rd.i.replicatePartition(partition)
 		if j := common.StringInSliceIndex(partition, handoffPartitions); j >= 0 {
 			handoffPartitions = append(handoffPartitions[:j], handoffPartitions[j+1:]...)
 		}
-		time.Sleep(replicatePartSleepTime)
 		if i%handoffToAllMod == 0 && len(handoffPartitions) > 0 {
 			var p string
 			p, handoffPartitions = handoffPartitions[0], handoffPartitions[1:]
-			rd.i.replicatePartition(p)
+			if !send(p) {
+				break
+			}
 		}
 		if len(handoffPartitions) == 0 {
 			if handoffsForLog > 0 {
@@ -674,6 +775,11 @@ func (rd *swiftDevice) Scan() {
 			}
 		}
 	}
+	close(partChan)
+	wg.Wait()
+	if canceled {
+		return
+	}
 	rd.UpdateStat("FullReplicateCount", 1)
 }
 
@@ -898,6 +1004,24 @@ func (f *SwiftEngine) New(vars map[string]string, needData bool, asyncWG *sync.W
 	return sor, nil
 }
 
+var _ TimestampOnlyObjectEngine = &SwiftEngine{}
+
+// TimestampOnly takes the object's timestamp from the names of its files, so
+// it can't tell an expired object from a live one.
+func (f *SwiftEngine) TimestampOnly(vars map[string]string) (string, bool, error) {
+	dataFile, metaFile := ObjectFiles(ObjHashDir(vars, f.driveRoot, f.hashPathPrefix, f.hashPathSuffix, f.policy))
+	if dataFile == "" {
+		return "", false, nil
+	}
+	if strings.HasSuffix(dataFile, ".ts") {
+		return strings.TrimSuffix(filepath.Base(dataFile), ".ts"), false, nil
+	}
+	if metaFile != "" {
+		return strings.TrimSuffix(filepath.Base(metaFile), ".meta"), true, nil
+	}
+	return strings.TrimSuffix(filepath.Base(dataFile), ".data"), true, nil
+}
+
 func (f *SwiftEngine) GetReplicationDevice(oring ring.Ring, dev *ring.Device, r *Replicator) (ReplicationDevice, error) {
 	rd := &swiftDevice{
 		r:      r,
@@ -909,6 +1033,11 @@ func (f *SwiftEngine) GetReplicationDevice(oring ring.Ring, dev *ring.Device, r
 	return rd, nil
 }
 
+// Close is a no-op; the SwiftEngine keeps no long-lived handles open.
+func (f *SwiftEngine) Close() error {
+	return nil
+}
+
 var replicationDone = fmt.Errorf("Replication done")
 
 // SwiftEngineConstructor creates a SwiftEngine given the object server configs.
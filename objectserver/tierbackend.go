@@ -0,0 +1,116 @@
+package objectserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TierBackend is a remote store that the tiered engine moves the contents of
+// cold objects into.
+type TierBackend interface {
+	// Put stores size bytes read from body under key.
+	Put(key string, body io.Reader, size int64) error
+	// Get returns the contents stored under key.
+	Get(key string) (io.ReadCloser, error)
+}
+
+// tierKey returns the remote key for the contents of a stable item; it
+// mirrors the local file naming so every replica of a version shares a key.
+func tierKey(policy int, item *IndexDBItem) string {
+	return fmt.Sprintf("%d/%s.%02x.%019d", policy, item.Hash, item.Shard, item.Timestamp)
+}
+
+// s3TierBackend is a TierBackend speaking the S3 API with path style bucket
+// addressing, signed with AWS signature version 4.
+type s3TierBackend struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+var _ TierBackend = &s3TierBackend{}
+
+func (s *s3TierBackend) Put(key string, body io.Reader, size int64) error {
+	resp, err := s.do("PUT", key, body, size)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3TierBackend) Get(key string) (io.ReadCloser, error) {
+	resp, err := s.do("GET", key, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3TierBackend) do(method, key string, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, fmt.Sprintf("%s/%s/%s", strings.TrimRight(s.endpoint, "/"), s.bucket, key), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	s.sign(req, time.Now().UTC())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("tier %s of %s returned status %d", method, key, resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// sign adds AWS signature version 4 headers to req. The payload is left
+// unsigned so object contents can be streamed.
+func (s *s3TierBackend) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:UNSIGNED-PAYLOAD",
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	signingKey := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{date, s.region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(signingKey, stringToSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
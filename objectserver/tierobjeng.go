@@ -0,0 +1,299 @@
+package objectserver
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/uber-go/tally"
+)
+
+const (
+	defaultTierColdAge   = 30 * 24 * time.Hour
+	defaultTierInterval  = time.Hour
+	defaultTierBatchSize = 1000
+)
+
+func init() {
+	RegisterObjectEngine("tiered", tierEngineConstructor)
+}
+
+var _ ObjectEngineConstructor = tierEngineConstructor
+
+// tierEngineConstructor builds a tiered engine from the policy's config:
+//
+//	tier_endpoint    S3 API endpoint, e.g. https://s3.amazonaws.com (required)
+//	tier_bucket      bucket to store cold object contents in (required)
+//	tier_region      signing region; default us-east-1
+//	tier_access_key  S3 access key
+//	tier_secret_key  S3 secret key
+//	tier_cold_age    seconds since last access before an object is tiered; default 30 days
+//	tier_interval    seconds between tiering passes per device; default 1 hour
+//	tier_batch_size  most objects tiered per device per pass; default 1000
+func tierEngineConstructor(config conf.Config, policy *conf.Policy, flags *flag.FlagSet) (ObjectEngine, error) {
+	engine, err := repEngineConstructor(config, policy, flags)
+	if err != nil {
+		return nil, err
+	}
+	re := engine.(*repEngine)
+	re.dbName = "tiered"
+	re.auditor = tierAuditor{}
+	backend := &s3TierBackend{
+		endpoint:  policy.Config["tier_endpoint"],
+		bucket:    policy.Config["tier_bucket"],
+		region:    policy.Config["tier_region"],
+		accessKey: policy.Config["tier_access_key"],
+		secretKey: policy.Config["tier_secret_key"],
+		client:    &http.Client{Timeout: 120 * time.Minute},
+	}
+	if backend.endpoint == "" || backend.bucket == "" {
+		return nil, fmt.Errorf("tiered policy %d requires tier_endpoint and tier_bucket", policy.Index)
+	}
+	if backend.region == "" {
+		backend.region = "us-east-1"
+	}
+	te := &tierEngine{
+		repEngine: re,
+		backend:   backend,
+		bucket:    backend.bucket,
+		coldAge:   defaultTierColdAge,
+		interval:  defaultTierInterval,
+		batchSize: defaultTierBatchSize,
+	}
+	if v, err := strconv.Atoi(policy.Config["tier_cold_age"]); err == nil {
+		te.coldAge = time.Duration(v) * time.Second
+	}
+	if v, err := strconv.Atoi(policy.Config["tier_interval"]); err == nil {
+		te.interval = time.Duration(v) * time.Second
+	}
+	if v, err := strconv.Atoi(policy.Config["tier_batch_size"]); err == nil && v > 0 {
+		te.batchSize = v
+	}
+	te.rehydrationsMetric = tally.NoopScope.Counter("rehydrations")
+	te.rehydrationFailuresMetric = tally.NoopScope.Counter("rehydration_failures")
+	return te, nil
+}
+
+var _ ObjectEngine = &tierEngine{}
+var _ PolicyHandlerRegistrator = &tierEngine{}
+
+// tierEngine is a replicated engine that keeps recently used objects in its
+// IndexDB and moves the contents of objects that haven't been read for
+// coldAge to a remote TierBackend, leaving their rows behind as stubs. Reading
+// a tiered object fetches it back into place first.
+//
+// Remote copies are shared by every replica of an object version and are not
+// removed when that version is overwritten or deleted; use the bucket's
+// lifecycle rules to expire them.
+type tierEngine struct {
+	*repEngine
+	backend   TierBackend
+	bucket    string
+	coldAge   time.Duration
+	interval  time.Duration
+	batchSize int
+
+	rehydrationsMetric        tally.Counter
+	rehydrationFailuresMetric tally.Counter
+}
+
+func (te *tierEngine) New(vars map[string]string, needData bool, asyncWG *sync.WaitGroup) (Object, error) {
+	obj, err := te.repEngine.New(vars, needData, asyncWG)
+	if err != nil {
+		return nil, err
+	}
+	ro := obj.(*repObject)
+	if !needData || !ro.Exists() || ro.Nursery {
+		return obj, nil
+	}
+	if ro.Tiered {
+		if err := te.rehydrate(ro); err != nil {
+			te.rehydrationFailuresMetric.Inc(1)
+			return nil, err
+		}
+	}
+	if err := ro.idb.Touch(ro.Hash, ro.Shard, ro.Timestamp); err != nil {
+		te.logger.Error("error recording object access", zap.String("hash", ro.Hash), zap.Error(err))
+	}
+	return obj, nil
+}
+
+// rehydrate fetches a tiered object's contents back from the remote tier.
+func (te *tierEngine) rehydrate(ro *repObject) error {
+	body, err := te.backend.Get(tierKey(te.policy, &ro.IndexDBItem))
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if err = ro.idb.Rehydrate(ro.Hash, ro.Shard, ro.Timestamp, body, ro.metadata["ETag"]); err != nil {
+		return err
+	}
+	ro.Tiered = false
+	te.rehydrationsMetric.Inc(1)
+	return nil
+}
+
+// migrate copies a cold item's contents to the remote tier and then stubs out
+// the local copy.
+func (te *tierEngine) migrate(idb *IndexDB, item *IndexDBItem) (int64, error) {
+	fp, err := os.Open(item.Path)
+	if err != nil {
+		return 0, err
+	}
+	defer fp.Close()
+	fi, err := fp.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if err = te.backend.Put(tierKey(te.policy, item), fp, fi.Size()); err != nil {
+		return 0, err
+	}
+	_, err = idb.SetTiered(item.Hash, item.Shard, item.Timestamp)
+	return fi.Size(), err
+}
+
+func (te *tierEngine) GetReplicationDevice(oring ring.Ring, dev *ring.Device, r *Replicator) (ReplicationDevice, error) {
+	rd, err := GetNurseryDevice(oring, dev, te.policy, r, te)
+	if err != nil {
+		return nil, err
+	}
+	return &tierDevice{
+		nurseryDevice:               rd.(*nurseryDevice),
+		engine:                      te,
+		tierMigrationsMetric:        r.metricsScope.Counter(fmt.Sprintf("%d_%s_tier_migrations", te.policy, dev.Device)),
+		tierMigrationFailuresMetric: r.metricsScope.Counter(fmt.Sprintf("%d_%s_tier_migration_failures", te.policy, dev.Device)),
+	}, nil
+}
+
+// TierStats is the per device tiering config and state reported by the
+// tiered engine's /tier-stats handler.
+type TierStats struct {
+	Policy        int    `json:"policy"`
+	Bucket        string `json:"bucket"`
+	ColdAge       int64  `json:"cold_age"`
+	Interval      int64  `json:"interval"`
+	LocalObjects  int64  `json:"local_objects"`
+	TieredObjects int64  `json:"tiered_objects"`
+}
+
+func (te *tierEngine) tierStatsHandler(writer http.ResponseWriter, request *http.Request) {
+	vars := srv.GetVars(request)
+	idb, err := te.getDB(vars["device"])
+	if err != nil {
+		srv.StandardResponse(writer, http.StatusBadRequest)
+		return
+	}
+	stats := TierStats{
+		Policy:   te.policy,
+		Bucket:   te.bucket,
+		ColdAge:  int64(te.coldAge / time.Second),
+		Interval: int64(te.interval / time.Second),
+	}
+	if stats.LocalObjects, stats.TieredObjects, err = idb.TierStats(); err != nil {
+		te.logger.Error("error getting idb tier stats", zap.Error(err))
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	if data, err := json.Marshal(stats); err == nil {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusOK)
+		writer.Write(data)
+		return
+	} else {
+		te.logger.Error("error marshaling tier stats", zap.Error(err))
+	}
+	srv.StandardResponse(writer, http.StatusInternalServerError)
+}
+
+func (te *tierEngine) RegisterHandlers(addRoute func(method, path string, handler http.HandlerFunc), metScope tally.Scope) {
+	te.repEngine.RegisterHandlers(addRoute, metScope)
+	te.rehydrationsMetric = metScope.Counter(fmt.Sprintf("%d_tier_rehydrations", te.policy))
+	te.rehydrationFailuresMetric = metScope.Counter(fmt.Sprintf("%d_tier_rehydration_failures", te.policy))
+	addRoute("GET", "/tier-stats/:device", te.tierStatsHandler)
+}
+
+// tierDevice runs a device's nursery stabilization like a nurseryDevice and,
+// every tier interval, a pass moving its cold objects to the remote tier.
+type tierDevice struct {
+	*nurseryDevice
+	engine   *tierEngine
+	lastTier time.Time
+
+	tierMigrationsMetric        tally.Counter
+	tierMigrationFailuresMetric tally.Counter
+}
+
+func (td *tierDevice) Scan() {
+	td.nurseryDevice.Scan()
+	if time.Since(td.lastTier) >= td.engine.interval {
+		td.lastTier = time.Now()
+		td.tierPass()
+	}
+}
+
+func (td *tierDevice) ScanLoop() {
+	for {
+		select {
+		case <-td.canchan:
+			return
+		default:
+			st := time.Now()
+			td.Scan()
+			if time.Since(st) < time.Second {
+				time.Sleep(time.Second - time.Since(st))
+			}
+		}
+	}
+}
+
+func (td *tierDevice) tierPass() {
+	if mounted, err := fs.IsMount(filepath.Join(td.r.deviceRoot, td.dev.Device)); td.r.checkMounts && (err != nil || mounted != true) {
+		td.r.logger.Error("[tierDevice] Drive not mounted", zap.String("Device", td.dev.Device), zap.Error(err))
+		return
+	}
+	start := time.Now()
+	idb, err := td.engine.getDB(td.dev.Device)
+	if err != nil {
+		td.r.logger.Error("[tierDevice] error getting local db", zap.String("Device", td.dev.Device), zap.Error(err))
+		return
+	}
+	items, err := idb.ListCold(time.Now().Add(-td.engine.coldAge).UnixNano(), td.engine.batchSize)
+	if err != nil {
+		td.r.logger.Error("[tierDevice] error listing cold objects", zap.String("Device", td.dev.Device), zap.Error(err))
+		return
+	}
+	success, failed := 0, 0
+	for _, item := range items {
+		select {
+		case <-td.canchan:
+			return
+		default:
+		}
+		if size, err := td.engine.migrate(idb, item); err != nil {
+			td.r.logger.Debug("[tierDevice] error tiering object", zap.String("hash", item.Hash), zap.Error(err))
+			td.tierMigrationFailuresMetric.Inc(1)
+			td.UpdateStat("ObjectsTieredError", 1)
+			failed++
+		} else {
+			td.tierMigrationsMetric.Inc(1)
+			td.UpdateStat("ObjectsTieredSuccess", 1)
+			td.UpdateStat("ObjectsTieredBytes", size)
+			success++
+		}
+	}
+	td.r.logger.Info("[tierDevice] Pass complete.", zap.Int("count", len(items)),
+		zap.Int("success", success), zap.Int("failed", failed), zap.String("device", td.dev.Device),
+		zap.Duration("timeTook", time.Since(start)))
+}
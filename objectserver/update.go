@@ -24,6 +24,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -38,8 +39,8 @@ import (
 	"go.uber.org/zap"
 )
 
-/*This hash is used to represent a zero byte async file that is
-  created for an expiring object*/
+// This hash is used to represent a zero byte async file that is
+// created for an expiring object.
 const zeroByteHash = "d41d8cd98f00b204e9800998ecf8427e"
 const deleteAtAccount = ".expiring_objects"
 
@@ -85,7 +86,44 @@ func (server *ObjectServer) sendContainerUpdate(ctx context.Context, scheme, hos
 	return false
 }
 
+// saveAsyncToDB queues a container update in the IndexDB of the policy's
+// engine, returning false if the engine doesn't keep one.
+func (server *ObjectServer) saveAsyncToDB(method, account, container, obj, localDevice string, headers http.Header, logger srv.LowLevelLogger) bool {
+	policy, err := strconv.Atoi(headers.Get("X-Backend-Storage-Policy-Index"))
+	if err != nil {
+		policy = 0
+	}
+	engine, ok := server.objEngines[policy].(AsyncPendingObjectEngine)
+	if !ok {
+		return false
+	}
+	timestamp, err := common.ParseDate(headers.Get("X-Timestamp"))
+	if err == nil {
+		var idb *IndexDB
+		if idb, err = engine.AsyncPendingDB(localDevice); err == nil {
+			err = idb.SaveAsyncPending(&AsyncPending{
+				Hash:      server.hashPath(account, container, obj),
+				Timestamp: timestamp.UnixNano(),
+				Method:    method,
+				Account:   account,
+				Container: container,
+				Object:    obj,
+				Headers:   common.Headers2Map(headers),
+			})
+		}
+	}
+	if err != nil {
+		logger.Error("Error queueing obj async in index.db, saving to async_pending instead",
+			zap.String("objPath", fmt.Sprintf("%s/%s/%s", account, container, obj)), zap.Error(err))
+		return false
+	}
+	return true
+}
+
 func (server *ObjectServer) saveAsync(method, account, container, obj, localDevice string, headers http.Header, logger srv.LowLevelLogger) {
+	if server.saveAsyncToDB(method, account, container, obj, localDevice, headers, logger) {
+		return
+	}
 	hash := server.hashPath(account, container, obj)
 	asyncFile := filepath.Join(server.driveRoot, localDevice, "async_pending", hash[29:32], hash+"-"+headers.Get("X-Timestamp"))
 	tempDir := TempDirPath(server.driveRoot, localDevice)
@@ -126,13 +164,30 @@ func (server *ObjectServer) updateContainer(ctx context.Context, metadata map[st
 		"Referer":                        {common.GetDefault(request.Header, "Referer", "-")},
 		"User-Agent":                     {common.GetDefault(request.Header, "User-Agent", "-")},
 		"X-Trans-Id":                     {common.GetDefault(request.Header, "X-Trans-Id", "-")},
+		"X-Trace-Id":                     request.Header["X-Trace-Id"],
 		"X-Timestamp":                    request.Header["X-Timestamp"],
 		"X-Delete-At":                    request.Header["X-Delete-At"],
 	}
 	if request.Method != "DELETE" {
-		requestHeaders.Add("X-Content-Type", metadata["Content-Type"])
+		contentType, etag := metadata["Content-Type"], metadata["ETag"]
+		// Listings show what the proxy says to instead, if it said.
+		if v, ok := metadata["X-Object-Sysmeta-Container-Update-Override-Content-Type"]; ok {
+			contentType = v
+		}
+		if v, ok := metadata["X-Object-Sysmeta-Container-Update-Override-Etag"]; ok {
+			etag = v
+		}
+		// A symlink's listing says what it points to.
+		if target := metadata["X-Object-Sysmeta-Symlink-Target"]; target != "" {
+			targetAccount := metadata["X-Object-Sysmeta-Symlink-Target-Account"]
+			if targetAccount == "" {
+				targetAccount = vars["account"]
+			}
+			contentType = common.ContentTypeWithSymlinkPath(contentType, "/v1/"+targetAccount+"/"+target)
+		}
+		requestHeaders.Add("X-Content-Type", common.ContentTypeWithStorageClass(contentType, metadata["X-Object-Storage-Class"]))
 		requestHeaders.Add("X-Size", metadata["Content-Length"])
-		requestHeaders.Add("X-Etag", metadata["ETag"])
+		requestHeaders.Add("X-Etag", etag)
 	}
 	failures := 0
 	for index := range hosts {
@@ -148,9 +203,46 @@ func (server *ObjectServer) updateContainer(ctx context.Context, metadata map[st
 	}
 }
 
+// updateDeleteAt queues the PUT or DELETE of the object's entry in the
+// .expiring_objects account, which the object updater delivers. Engines that
+// expire objects themselves don't need the entries.
+func (server *ObjectServer) updateDeleteAt(method, deleteAtStr string, request *http.Request, vars map[string]string, logger srv.LowLevelLogger) {
+	policy, err := strconv.Atoi(request.Header.Get("X-Backend-Storage-Policy-Index"))
+	if err != nil {
+		policy = 0
+	}
+	if _, ok := server.objEngines[policy].(ExpiringObjectEngine); ok {
+		return
+	}
+	deleteAt, err := common.ParseDate(deleteAtStr)
+	if err != nil {
+		logger.Error("Invalid X-Delete-At", zap.String("deleteAt", deleteAtStr))
+		return
+	}
+	container := server.expirerContainer(deleteAt, vars["account"], vars["container"], vars["obj"])
+	obj := fmt.Sprintf("%010d-%s/%s/%s", deleteAt.Unix(), vars["account"], vars["container"], vars["obj"])
+	headers := http.Header{
+		"X-Backend-Storage-Policy-Index": {"0"},
+		"User-Agent":                     {common.GetDefault(request.Header, "User-Agent", "-")},
+		"X-Trans-Id":                     {common.GetDefault(request.Header, "X-Trans-Id", "-")},
+		"X-Trace-Id":                     request.Header["X-Trace-Id"],
+		"X-Timestamp":                    request.Header["X-Timestamp"],
+	}
+	if method == "PUT" {
+		headers.Set("X-Size", "0")
+		headers.Set("X-Content-Type", "text/plain")
+		headers.Set("X-Etag", zeroByteHash)
+	}
+	server.saveAsync(method, deleteAtAccount, container, obj, vars["device"], headers, logger)
+}
+
 func (server *ObjectServer) containerUpdates(writer http.ResponseWriter, request *http.Request, metadata map[string]string, deleteAt string, vars map[string]string, logger srv.LowLevelLogger) {
 	defer middleware.Recover(writer, request, "PANIC WHILE UPDATING CONTAINER LISTINGS")
 
+	if deleteAt != "" {
+		server.updateDeleteAt(request.Method, deleteAt, request, vars, logger)
+	}
+
 	done := make(chan struct{}, 1)
 	go func() {
 		ctx := tracing.CopySpanFromContext(request.Context())
@@ -20,6 +20,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
 	"path/filepath"
 	"testing"
 	"time"
@@ -68,11 +69,12 @@ func TestUpdateContainer(t *testing.T) {
 	server.hashPathSuffix = "changeme"
 
 	requestSent := false
+	wantType, wantEtag := "text/plain", "ffffffffffffffffffffffffffffffff"
 	cs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		require.Equal(t, "/sdb/1/a/c/o", r.URL.Path)
-		require.Equal(t, "text/plain", r.Header.Get("X-Content-Type"))
+		require.Equal(t, wantType, r.Header.Get("X-Content-Type"))
 		require.Equal(t, "30", r.Header.Get("X-Size"))
-		require.Equal(t, "ffffffffffffffffffffffffffffffff", r.Header.Get("X-Etag"))
+		require.Equal(t, wantEtag, r.Header.Get("X-Etag"))
 		requestSent = true
 	}))
 	defer cs.Close()
@@ -99,6 +101,35 @@ func TestUpdateContainer(t *testing.T) {
 	server.updateContainer(req.Context(), metadata, req, vars, dl)
 	require.True(t, requestSent)
 
+	// The proxy can override what goes in the listing.
+	requestSent = false
+	wantType, wantEtag = "overridden/type", "overridden-etag"
+	overridden := map[string]string{
+		"X-Object-Sysmeta-Container-Update-Override-Content-Type": "overridden/type",
+		"X-Object-Sysmeta-Container-Update-Override-Etag":         "overridden-etag",
+	}
+	for k, v := range metadata {
+		overridden[k] = v
+	}
+	server.updateContainer(req.Context(), overridden, req, vars, dl)
+	require.True(t, requestSent)
+
+	// A symlink's listing says what it points to.
+	requestSent = false
+	wantType, wantEtag = "application/symlink;symlink_path=%2Fv1%2Fa2%2Fc2%2Fo2", "ffffffffffffffffffffffffffffffff"
+	symlink := map[string]string{
+		"Content-Type":                            "application/symlink",
+		"X-Object-Sysmeta-Symlink-Target":         "c2/o2",
+		"X-Object-Sysmeta-Symlink-Target-Account": "a2",
+	}
+	for k, v := range metadata {
+		if _, ok := symlink[k]; !ok {
+			symlink[k] = v
+		}
+	}
+	server.updateContainer(req.Context(), symlink, req, vars, dl)
+	require.True(t, requestSent)
+
 	cs.Close()
 	server.updateContainer(req.Context(), metadata, req, vars, dl)
 	expectedFile := filepath.Join(ts.root, "sda", "async_pending", "099", "2f714cd91b0e5d803cde2012b01d7099-12345.6789")
@@ -114,6 +145,39 @@ func TestUpdateContainer(t *testing.T) {
 	require.Equal(t, asyncData["obj"], "o")
 }
 
+func TestUpdateContainerQueuesInIndexDB(t *testing.T) {
+	testRing := &test.FakeRing{}
+	confLoader := srv.NewTestConfigLoader(testRing)
+	ts, err := makeObjectServer(confLoader)
+	require.Nil(t, err)
+	server := ts.objServer
+	defer ts.Close()
+
+	req, err := http.NewRequest("PUT", "/I/dont/think/this/matters", nil)
+	require.Nil(t, err)
+	req.Header.Add("X-Container-Partition", "1")
+	req.Header.Add("X-Container-Host", "127.0.0.1:1")
+	req.Header.Add("X-Container-Device", "sdb")
+	req.Header.Add("X-Timestamp", "12345.6789")
+	req.Header.Add("X-Backend-Storage-Policy-Index", "2")
+	vars := map[string]string{"account": "a", "container": "c", "obj": "o", "device": "sda"}
+	req = srv.SetVars(req, vars)
+	metadata := map[string]string{"Content-Type": "text/plain", "Content-Length": "30", "ETag": "ffffffffffffffffffffffffffffffff"}
+	server.updateContainer(req.Context(), metadata, req, vars, zap.NewNop())
+
+	// Policy 2 is hec, which queues updates in its index.db.
+	require.False(t, fs.Exists(filepath.Join(ts.root, "sda", "async_pending")))
+	idb, err := server.objEngines[2].(AsyncPendingObjectEngine).AsyncPendingDB("sda")
+	require.Nil(t, err)
+	aps, err := idb.ListAsyncPending(time.Now().UnixNano(), 10)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(aps))
+	require.Equal(t, "PUT", aps[0].Method)
+	require.Equal(t, "o", aps[0].Object)
+	require.Equal(t, "30", aps[0].Headers["X-Size"])
+	require.Equal(t, int64(12345678900000), aps[0].Timestamp)
+}
+
 func TestUpdateContainerNoHeaders(t *testing.T) {
 	testRing := &test.FakeRing{}
 	confLoader := srv.NewTestConfigLoader(testRing)
@@ -150,3 +214,38 @@ func TestUpdateContainerNoHeaders(t *testing.T) {
 	expectedFile := filepath.Join(ts.root, "sda", "async_pending", "099", "2f714cd91b0e5d803cde2012b01d7099-12345.6789")
 	require.False(t, fs.Exists(expectedFile))
 }
+
+func TestUpdateDeleteAt(t *testing.T) {
+	testRing := &test.FakeRing{}
+	confLoader := srv.NewTestConfigLoader(testRing)
+	ts, err := makeObjectServer(confLoader)
+	require.Nil(t, err)
+	server := ts.objServer
+	defer ts.Close()
+
+	req, err := http.NewRequest("PUT", "/sda/0/a/c/o", nil)
+	require.Nil(t, err)
+	req.Header.Add("X-Timestamp", "12345.6789")
+	vars := map[string]string{"account": "a", "container": "c", "obj": "o", "device": "sda"}
+	server.updateDeleteAt("PUT", "1500000000", req, vars, zap.NewNop())
+
+	// Policy 0 uses the replication engine, which leaves expiring its
+	// objects to the .expiring_objects account.
+	container := server.expirerContainer(time.Unix(1500000000, 0), "a", "c", "o")
+	hash := server.hashPath(".expiring_objects", container, "1500000000-a/c/o")
+	data, err := ioutil.ReadFile(filepath.Join(ts.root, "sda", "async_pending", hash[29:32], hash+"-12345.6789"))
+	require.Nil(t, err)
+	a, err := pickle.PickleLoads(data)
+	require.Nil(t, err)
+	asyncData := a.(map[interface{}]interface{})
+	require.Equal(t, "PUT", asyncData["op"])
+	require.Equal(t, ".expiring_objects", asyncData["account"])
+	require.Equal(t, container, asyncData["container"])
+	require.Equal(t, "0", asyncData["headers"].(map[interface{}]interface{})["X-Size"])
+
+	// Policy 2 is hec, which expires its objects itself.
+	os.RemoveAll(filepath.Join(ts.root, "sda", "async_pending"))
+	req.Header.Set("X-Backend-Storage-Policy-Index", "2")
+	server.updateDeleteAt("PUT", "1500000000", req, vars, zap.NewNop())
+	require.False(t, fs.Exists(filepath.Join(ts.root, "sda", "async_pending")))
+}
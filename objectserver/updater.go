@@ -60,6 +60,14 @@ func (ud *updateDevice) updateStat(stat string, amount int64) {
 	ud.r.updateStat <- statUpdate{"object-updater", key, stat, amount}
 }
 
+// updateGauge sets one of the device's gauges, named like the replicator's
+// per device metrics.
+func (ud *updateDevice) updateGauge(name string, value float64) {
+	if ud.r.metricsScope != nil {
+		ud.r.metricsScope.Gauge(fmt.Sprintf("%d_%s_%s", ud.policy, ud.dev.Device, name)).Update(value)
+	}
+}
+
 func (ud *updateDevice) listAsyncs(c chan string, cancel chan struct{}) {
 	defer close(c)
 	suffixDirs, err := filepath.Glob(filepath.Join(ud.r.deviceRoot, ud.dev.Device, AsyncDir(ud.policy), "[a-f0-9][a-f0-9][a-f0-9]"))
@@ -86,20 +94,26 @@ func (ud *updateDevice) listAsyncs(c chan string, cancel chan struct{}) {
 }
 
 func (ud *updateDevice) updateContainers(ap *asyncPending) bool {
+	return ud.r.updateContainers(ap, fmt.Sprintf("object-updater %d", os.Getpid()))
+}
+
+// updateContainers sends the update to the container's primaries, returning
+// whether a quorum of them took it.
+func (r *Replicator) updateContainers(ap *asyncPending, userAgent string) bool {
 	successes := uint64(0)
-	part := ud.r.containerRing.GetPartition(ap.Account, ap.Container, "")
+	part := r.containerRing.GetPartition(ap.Account, ap.Container, "")
 	header := common.Map2Headers(ap.Headers)
-	header.Set("User-Agent", fmt.Sprintf("object-updater %d", os.Getpid()))
-	for _, node := range ud.r.containerRing.GetNodes(part) {
+	header.Set("User-Agent", userAgent)
+	for _, node := range r.containerRing.GetNodes(part) {
 		objUrl := fmt.Sprintf("%s://%s:%d/%s/%d/%s/%s/%s", node.Scheme, node.Ip, node.Port, node.Device, part,
 			common.Urlencode(ap.Account), common.Urlencode(ap.Container), common.Urlencode(ap.Object))
 		req, err := http.NewRequest(ap.Method, objUrl, nil)
 		if err != nil {
-			ud.r.logger.Error("updateContainers creating new request", zap.Error(err))
+			r.logger.Error("updateContainers creating new request", zap.Error(err))
 			continue
 		}
 		req.Header = header
-		resp, err := ud.r.client.Do(req)
+		resp, err := r.client.Do(req)
 		if err != nil {
 			continue
 		}
@@ -108,7 +122,7 @@ func (ud *updateDevice) updateContainers(ap *asyncPending) bool {
 			successes++
 		}
 	}
-	return successes >= (ud.r.containerRing.ReplicaCount()/2)+1
+	return successes >= (r.containerRing.ReplicaCount()/2)+1
 }
 
 func (ud *updateDevice) processAsync(async string) {
@@ -133,6 +147,79 @@ func (ud *updateDevice) processAsync(async string) {
 	}
 }
 
+// retryDelay is how long to put off the next try of an update that has
+// already failed attempts times, doubling with each failure.
+func (ud *updateDevice) retryDelay(attempts int) time.Duration {
+	delay := ud.r.asyncRetryInterval
+	for i := 0; i < attempts && delay < ud.r.asyncMaxRetryInterval; i++ {
+		delay *= 2
+	}
+	if delay > ud.r.asyncMaxRetryInterval {
+		delay = ud.r.asyncMaxRetryInterval
+	}
+	return delay
+}
+
+// asyncPendingDB returns the IndexDB the device's policy queues updates in,
+// or nil if it uses async_pending files.
+func (ud *updateDevice) asyncPendingDB() *IndexDB {
+	engine, ok := ud.r.objEngines[ud.policy].(AsyncPendingObjectEngine)
+	if !ok {
+		return nil
+	}
+	idb, err := engine.AsyncPendingDB(ud.dev.Device)
+	if err != nil {
+		ud.updateStat("Error", 1)
+		ud.r.logger.Error("opening index.db for async pendings", zap.String("device", ud.dev.Device), zap.Int("policy", ud.policy), zap.Error(err))
+		return nil
+	}
+	return idb
+}
+
+// updateFromDB sends the updates queued in idb that are due, backing off
+// those that fail. It returns false if the device was canceled.
+func (ud *updateDevice) updateFromDB(idb *IndexDB) bool {
+	for {
+		aps, err := idb.ListAsyncPending(time.Now().UnixNano(), 100)
+		if err != nil {
+			ud.updateStat("Error", 1)
+			ud.r.logger.Error("listing index.db async pendings", zap.String("device", ud.dev.Device), zap.Error(err))
+			return true
+		}
+		if len(aps) == 0 {
+			return true
+		}
+		for _, ap := range aps {
+			ud.updateStat("checkin", 1)
+			sent := func() bool {
+				ud.r.updateConcurrencySem <- struct{}{}
+				defer func() {
+					<-ud.r.updateConcurrencySem
+				}()
+				return ud.updateContainers(&asyncPending{Headers: ap.Headers, Object: ap.Object, Account: ap.Account,
+					Container: ap.Container, Method: ap.Method})
+			}()
+			if sent {
+				ud.updateStat("Success", 1)
+				err = idb.RemoveAsyncPending(ap.Hash, ap.Timestamp)
+			} else {
+				ud.updateStat("Failure", 1)
+				err = idb.RetryAsyncPending(ap.Hash, ap.Timestamp, time.Now().Add(ud.retryDelay(ap.Attempts)).UnixNano())
+			}
+			if err != nil {
+				ud.updateStat("Error", 1)
+				ud.r.logger.Error("updating index.db async pending", zap.String("device", ud.dev.Device), zap.Error(err))
+				return true
+			}
+			select {
+			case <-time.After(asyncPendingSleep):
+			case <-ud.canchan:
+				return false
+			}
+		}
+	}
+}
+
 func (ud *updateDevice) reconReportAsync() {
 	ud.reconLock.Lock()
 	if ud.reconRunning {
@@ -145,6 +232,26 @@ func (ud *updateDevice) reconReportAsync() {
 		ud.reconRunning = false
 		ud.reconLock.Unlock()
 	}()
+	if idb := ud.asyncPendingDB(); idb != nil {
+		cnt, err := idb.AsyncPendingCount()
+		if err != nil {
+			ud.r.logger.Error("object-updater counting index.db async pendings", zap.Error(err))
+			return
+		}
+		if err := middleware.DumpReconCache(ud.r.reconCachePath, "object",
+			map[string]interface{}{
+				fmt.Sprintf("async_pending_%s", deviceKeyId(ud.dev.Device, ud.policy)): cnt}); err != nil {
+			ud.r.logger.Error("object-updater saving recon data", zap.Error(err))
+		}
+		ud.updateGauge("async_pending", float64(cnt))
+		if local, tiered, err := idb.TierStats(); err != nil {
+			ud.r.logger.Error("object-updater counting index.db objects", zap.Error(err))
+		} else {
+			ud.updateGauge("indexdb_local_objects", float64(local))
+			ud.updateGauge("indexdb_tiered_objects", float64(tiered))
+		}
+		return
+	}
 	cnt := uint64(0)
 	suffixDirs, err := filepath.Glob(filepath.Join(ud.r.deviceRoot, ud.dev.Device, AsyncDir(ud.policy), "[a-f0-9][a-f0-9][a-f0-9]"))
 	if err != nil {
@@ -165,6 +272,7 @@ func (ud *updateDevice) reconReportAsync() {
 			fmt.Sprintf("async_pending_%s", ud.dev.Device): cnt}); err != nil {
 		ud.r.logger.Error("object-updater saving recon data", zap.Error(err))
 	}
+	ud.updateGauge("async_pending", float64(cnt))
 }
 
 func (ud *updateDevice) update() {
@@ -173,6 +281,9 @@ func (ud *updateDevice) update() {
 		ud.lastReconDump = time.Now()
 		go ud.reconReportAsync()
 	}
+	if idb := ud.asyncPendingDB(); idb != nil && !ud.updateFromDB(idb) {
+		return
+	}
 	c := make(chan string, 100)
 	cancel := make(chan struct{})
 	defer close(cancel)
@@ -23,7 +23,9 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/troubling/hummingbird/common/pickle"
@@ -101,3 +103,69 @@ func TestUpdaterProcessAsync(t *testing.T) {
 	require.True(t, requestedPaths["/sdb/0/a/c/o"])
 	require.True(t, requestedPaths["/sdc/0/a/c/o"])
 }
+
+type fakeAsyncPendingEngine struct {
+	ObjectEngine
+	idb *IndexDB
+}
+
+func (f *fakeAsyncPendingEngine) AsyncPendingDB(device string) (*IndexDB, error) {
+	return f.idb, nil
+}
+
+func TestUpdaterFromDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	idb := newTestIndexDB(t, dir)
+	defer idb.Close()
+	require.Nil(t, idb.SaveAsyncPending(&AsyncPending{Hash: md5hash("o1"), Timestamp: 1, Method: "PUT", Account: "a", Container: "c", Object: "o1",
+		Headers: map[string]string{"X-Size": "4"}}))
+	require.Nil(t, idb.SaveAsyncPending(&AsyncPending{Hash: md5hash("o2"), Timestamp: 1, Method: "PUT", Account: "a", Container: "c2", Object: "o2"}))
+
+	requestedPaths := make(map[string]bool)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestedPaths[r.URL.Path] = true
+		if strings.Contains(r.URL.Path, "/c2/") {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.Nil(t, err)
+	fakering := &test.FakeRing{
+		MockDevices: []*ring.Device{
+			{Ip: u.Hostname(), Port: port, Device: "sda", Scheme: "http"},
+			{Ip: u.Hostname(), Port: port, Device: "sdb", Scheme: "http"},
+			{Ip: u.Hostname(), Port: port, Device: "sdc", Scheme: "http"},
+		},
+	}
+	r := &Replicator{
+		updateStat:            make(chan statUpdate, 100),
+		client:                http.DefaultClient,
+		containerRing:         fakering,
+		updateConcurrencySem:  make(chan struct{}, 1),
+		objEngines:            map[int]ObjectEngine{1: &fakeAsyncPendingEngine{idb: idb}},
+		asyncRetryInterval:    time.Minute,
+		asyncMaxRetryInterval: time.Hour,
+	}
+	updater := newUpdateDevice(&ring.Device{Device: "sda"}, 1, r)
+	require.True(t, updater.updateFromDB(updater.asyncPendingDB()))
+	require.True(t, requestedPaths["/sda/0/a/c/o1"])
+	require.True(t, requestedPaths["/sdc/0/a/c2/o2"])
+
+	// The successful update is gone and the failed one waits to be retried.
+	aps, err := idb.ListAsyncPending(time.Now().Add(2*time.Minute).UnixNano(), 10)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(aps))
+	require.Equal(t, "o2", aps[0].Object)
+	require.Equal(t, 1, aps[0].Attempts)
+	require.True(t, aps[0].NextAttempt > time.Now().Add(59*time.Second).UnixNano())
+
+	require.Equal(t, time.Minute, updater.retryDelay(0))
+	require.Equal(t, 4*time.Minute, updater.retryDelay(2))
+	require.Equal(t, time.Hour, updater.retryDelay(10))
+	require.Equal(t, time.Hour, updater.retryDelay(1000))
+}
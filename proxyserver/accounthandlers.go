@@ -47,10 +47,9 @@ func (server *ProxyServer) AccountGetHandler(writer http.ResponseWriter, request
 		}
 	}
 	resp := ctx.C.GetAccountRaw(request.Context(), vars["account"], options, request.Header)
-	if resp.StatusCode == http.StatusNotFound && server.accountAutoCreate &&
-		resp.Header.Get("X-Backend-Delete-Timestamp") == "" {
+	if resp.StatusCode == http.StatusNotFound && resp.Header.Get("X-Backend-Delete-Timestamp") == "" &&
+		server.autoCreateAccount(ctx, request, vars["account"]) {
 		resp.Body.Close()
-		ctx.AutoCreateAccount(request.Context(), vars["account"], request.Header)
 		resp = ctx.C.GetAccountRaw(request.Context(), vars["account"], options, request.Header)
 	}
 	for k := range resp.Header {
@@ -77,10 +76,9 @@ func (server *ProxyServer) AccountHeadHandler(writer http.ResponseWriter, reques
 		}
 	}
 	resp := ctx.C.HeadAccount(request.Context(), vars["account"], request.Header)
-	if resp.StatusCode == http.StatusNotFound && server.accountAutoCreate &&
-		resp.Header.Get("X-Backend-Delete-Timestamp") == "" {
+	if resp.StatusCode == http.StatusNotFound && resp.Header.Get("X-Backend-Delete-Timestamp") == "" &&
+		server.autoCreateAccount(ctx, request, vars["account"]) {
 		resp.Body.Close()
-		ctx.AutoCreateAccount(request.Context(), vars["account"], request.Header)
 		resp = ctx.C.HeadAccount(request.Context(), vars["account"], request.Header)
 	}
 	for k := range resp.Header {
@@ -105,27 +103,18 @@ func (server *ProxyServer) AccountPostHandler(writer http.ResponseWriter, reques
 			return
 		}
 	}
-	if status, str := common.CheckMetadata(request, "Account"); status != http.StatusOK {
+	if status, str := ctx.Constraints().CheckMetadata(request, "Account"); status != http.StatusOK {
 		writer.Header().Set("Content-Type", "text/html; charset=UTF-8")
 		writer.WriteHeader(status)
 		writer.Write([]byte(fmt.Sprintf("<html><h1>%s</h1><p>%s</p></html>", http.StatusText(status), str)))
 		return
 	}
-	for k := range request.Header {
-		if common.OwnerHeaders[strings.ToLower(k)] && !ctx.StorageOwner {
-			request.Header.Del(k)
-		}
-		if strings.HasPrefix(strings.ToLower(k), "x-remove-account-meta-") {
-			request.Header.Del(k)
-			request.Header.Set(strings.Replace(strings.ToLower(k), "-remove", "", 1), "")
-		}
-	}
+	filterOwnerHeaders(request.Header, "account", ctx.StorageOwner)
 	defer ctx.InvalidateAccountInfo(request.Context(), vars["account"])
 	resp := ctx.C.PostAccount(request.Context(), vars["account"], request.Header)
-	if resp.StatusCode == http.StatusNotFound && server.accountAutoCreate &&
-		resp.Header.Get("X-Backend-Delete-Timestamp") == "" {
+	if resp.StatusCode == http.StatusNotFound && resp.Header.Get("X-Backend-Delete-Timestamp") == "" &&
+		server.autoCreateAccount(ctx, request, vars["account"]) {
 		resp.Body.Close()
-		ctx.AutoCreateAccount(request.Context(), vars["account"], request.Header)
 		resp = ctx.C.PostAccount(request.Context(), vars["account"], request.Header)
 	}
 	resp.Body.Close()
@@ -145,21 +134,13 @@ func (server *ProxyServer) AccountPutHandler(writer http.ResponseWriter, request
 			return
 		}
 	}
-	if status, str := common.CheckMetadata(request, "Account"); status != http.StatusOK {
+	if status, str := ctx.Constraints().CheckAccountPut(request, vars["account"]); status != http.StatusOK {
 		writer.Header().Set("Content-Type", "text/html; charset=UTF-8")
 		writer.WriteHeader(status)
 		writer.Write([]byte(fmt.Sprintf("<html><h1>%s</h1><p>%s</p></html>", http.StatusText(status), str)))
 		return
 	}
-	for k := range request.Header {
-		if common.OwnerHeaders[strings.ToLower(k)] && !ctx.StorageOwner {
-			request.Header.Del(k)
-		}
-		if strings.HasPrefix(strings.ToLower(k), "x-remove-account-meta-") {
-			request.Header.Del(k)
-			request.Header.Set(strings.Replace(strings.ToLower(k), "-remove", "", 1), "")
-		}
-	}
+	filterOwnerHeaders(request.Header, "account", ctx.StorageOwner)
 	defer ctx.InvalidateAccountInfo(request.Context(), vars["account"])
 	resp := ctx.C.PutAccount(request.Context(), vars["account"], request.Header)
 	resp.Body.Close()
@@ -184,3 +165,22 @@ func (server *ProxyServer) AccountDeleteHandler(writer http.ResponseWriter, requ
 	resp.Body.Close()
 	srv.StandardResponse(writer, resp.StatusCode)
 }
+
+// filterOwnerHeaders drops the headers only storage owners may set, unless
+// owner, after turning X-Remove-<targetType>-Meta-* headers into the empty
+// X-<targetType>-Meta-* ones they stand for, so they can't get around it.
+func filterOwnerHeaders(header http.Header, targetType string, owner bool) {
+	removePrefix := "x-remove-" + targetType + "-meta-"
+	for k := range header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, removePrefix) {
+			header.Del(k)
+			lk = strings.Replace(lk, "-remove", "", 1)
+			if !common.OwnerHeaders[lk] || owner {
+				header.Set(lk, "")
+			}
+		} else if common.OwnerHeaders[lk] && !owner {
+			header.Del(k)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package proxyserver
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterOwnerHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-Account-Meta-Temp-Url-Key", "key")
+	header.Set("X-Remove-Account-Meta-Temp-Url-Key-2", "x")
+	header.Set("X-Remove-Account-Meta-Color", "x")
+	header.Set("X-Account-Meta-Size", "big")
+	filterOwnerHeaders(header, "account", false)
+	require.Equal(t, http.Header{"X-Account-Meta-Color": {""}, "X-Account-Meta-Size": {"big"}}, header)
+
+	header = http.Header{}
+	header.Set("X-Container-Meta-Temp-Url-Key", "key")
+	header.Set("X-Remove-Container-Meta-Temp-Url-Key-2", "x")
+	filterOwnerHeaders(header, "container", true)
+	require.Equal(t, http.Header{"X-Container-Meta-Temp-Url-Key": {"key"}, "X-Container-Meta-Temp-Url-Key-2": {""}}, header)
+}
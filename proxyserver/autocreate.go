@@ -0,0 +1,83 @@
+package proxyserver
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/proxyserver/middleware"
+)
+
+// autoCreateOptions are the per-prefix settings for the accounts the proxy
+// creates, set like AUTH_default_storage_policy.
+var autoCreateOptions = map[string][]string{"default_storage_policy": {""}, "quota_bytes": {""}}
+
+// accountAutoCreator decides which accounts are created on first use, and
+// what they start out with.
+type accountAutoCreator struct {
+	prefixes []string
+	headers  map[string]http.Header
+}
+
+func newAccountAutoCreator(section conf.Section, policies conf.PolicyList) (*accountAutoCreator, error) {
+	var prefixes []string
+	var options map[string]map[string][]string
+	if _, ok := section.Get("reseller_prefix"); ok {
+		prefixes, options = conf.ReadResellerOptions(section, autoCreateOptions)
+	} else {
+		// Without a reseller_prefix, any account is created.
+		prefixes = []string{""}
+		options = map[string]map[string][]string{"": conf.ReadPrefixedOptions(section, "", autoCreateOptions)}
+		for k, v := range autoCreateOptions {
+			if _, ok := options[""][k]; !ok {
+				options[""][k] = v
+			}
+		}
+	}
+	a := &accountAutoCreator{prefixes: prefixes, headers: map[string]http.Header{}}
+	for _, prefix := range prefixes {
+		headers := http.Header{}
+		if name := strings.TrimSpace(options[prefix]["default_storage_policy"][0]); name != "" {
+			policy := policies.NameLookup(name)
+			if policy == nil {
+				return nil, fmt.Errorf("Unknown default_storage_policy %q for accounts with prefix %q", name, prefix)
+			}
+			headers.Set("X-Account-Sysmeta-Default-Storage-Policy", policy.Name)
+		}
+		if quota := strings.TrimSpace(options[prefix]["quota_bytes"][0]); quota != "" {
+			headers.Set("X-Account-Meta-Quota-Bytes", quota)
+		}
+		a.headers[prefix] = headers
+	}
+	return a, nil
+}
+
+// accountHeaders returns the headers the account is created with, and
+// whether it's created at all.
+func (a *accountAutoCreator) accountHeaders(account string) (http.Header, bool) {
+	match := -1
+	for i, prefix := range a.prefixes {
+		if strings.HasPrefix(account, prefix) && (match < 0 || len(prefix) > len(a.prefixes[match])) {
+			match = i
+		}
+	}
+	if match < 0 {
+		return nil, false
+	}
+	return a.headers[a.prefixes[match]], true
+}
+
+// autoCreateAccount creates the account, if the proxy creates it on first
+// use, returning whether it tried.
+func (server *ProxyServer) autoCreateAccount(ctx *middleware.ProxyContext, request *http.Request, account string) bool {
+	if server.accountAutoCreator == nil {
+		return false
+	}
+	defaults, ok := server.accountAutoCreator.accountHeaders(account)
+	if !ok {
+		return false
+	}
+	ctx.AutoCreateAccount(request.Context(), account, request.Header, defaults)
+	return true
+}
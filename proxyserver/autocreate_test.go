@@ -0,0 +1,39 @@
+package proxyserver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/conf"
+)
+
+func TestAccountAutoCreator(t *testing.T) {
+	config, err := conf.StringConfig("[app:proxy-server]\nreseller_prefix = AUTH, SERVICE\nAUTH_default_storage_policy = Gold\nSERVICE_quota_bytes = 1000\n")
+	require.Nil(t, err)
+	a, err := newAccountAutoCreator(config.GetSection("app:proxy-server"), staticPolicyList)
+	require.Nil(t, err)
+
+	headers, ok := a.accountHeaders("AUTH_test")
+	require.True(t, ok)
+	require.Equal(t, "gold", headers.Get("X-Account-Sysmeta-Default-Storage-Policy"))
+	require.Equal(t, "", headers.Get("X-Account-Meta-Quota-Bytes"))
+	headers, ok = a.accountHeaders("SERVICE_test")
+	require.True(t, ok)
+	require.Equal(t, "1000", headers.Get("X-Account-Meta-Quota-Bytes"))
+	_, ok = a.accountHeaders("OTHER_test")
+	require.False(t, ok)
+
+	// Without a reseller_prefix, any account is created.
+	config, err = conf.StringConfig("[app:proxy-server]\nquota_bytes = 5\n")
+	require.Nil(t, err)
+	a, err = newAccountAutoCreator(config.GetSection("app:proxy-server"), staticPolicyList)
+	require.Nil(t, err)
+	headers, ok = a.accountHeaders("OTHER_test")
+	require.True(t, ok)
+	require.Equal(t, "5", headers.Get("X-Account-Meta-Quota-Bytes"))
+
+	config, err = conf.StringConfig("[app:proxy-server]\ndefault_storage_policy = tin\n")
+	require.Nil(t, err)
+	_, err = newAccountAutoCreator(config.GetSection("app:proxy-server"), staticPolicyList)
+	require.NotNil(t, err)
+}
@@ -124,20 +124,15 @@ func (server *ProxyServer) ContainerPostHandler(writer http.ResponseWriter, requ
 			return
 		}
 	}
-	if status, str := common.CheckContainerPut(request, vars["container"]); status != http.StatusOK {
+	if status, str := ctx.Constraints().CheckContainerPut(request, vars["container"]); status != http.StatusOK {
 		writer.Header().Set("Content-Type", "text/html; charset=UTF-8")
 		writer.WriteHeader(status)
 		writer.Write([]byte(fmt.Sprintf("<html><h1>%s</h1><p>%s</p></html>", http.StatusText(status), str)))
 		return
 	}
-	for k := range request.Header {
-		if common.OwnerHeaders[strings.ToLower(k)] && !ctx.StorageOwner {
-			request.Header.Del(k)
-		}
-		if strings.HasPrefix(strings.ToLower(k), "x-remove-container-meta-") {
-			request.Header.Del(k)
-			request.Header.Set(strings.Replace(strings.ToLower(k), "-remove", "", 1), "")
-		}
+	filterOwnerHeaders(request.Header, "container", ctx.StorageOwner)
+	if len(ctx.RemoteUsers) > 0 {
+		request.Header.Set("X-Backend-Remote-User", strings.Join(ctx.RemoteUsers, ","))
 	}
 	resp := ctx.C.PostContainer(request.Context(), vars["account"], vars["container"], request.Header)
 	resp.Body.Close()
@@ -161,31 +156,26 @@ func (server *ProxyServer) ContainerPutHandler(writer http.ResponseWriter, reque
 			return
 		}
 	}
-	_, err := ctx.GetAccountInfo(request.Context(), vars["account"])
-	if err != nil {
-		if server.accountAutoCreate {
-			ctx.AutoCreateAccount(request.Context(), vars["account"], request.Header)
-			_, err = ctx.GetAccountInfo(request.Context(), vars["account"])
-		}
+	ai, err := ctx.GetAccountInfo(request.Context(), vars["account"])
+	if err != nil && server.autoCreateAccount(ctx, request, vars["account"]) {
+		ai, err = ctx.GetAccountInfo(request.Context(), vars["account"])
 	}
 	if err != nil {
 		srv.StandardResponse(writer, 404)
 		return
 	}
-	if status, str := common.CheckContainerPut(request, vars["container"]); status != http.StatusOK {
+	if request.Header.Get("X-Storage-Policy") == "" && ai.SysMetadata["Default-Storage-Policy"] != "" {
+		request.Header.Set("X-Storage-Policy", ai.SysMetadata["Default-Storage-Policy"])
+	}
+	if status, str := ctx.Constraints().CheckContainerPut(request, vars["container"]); status != http.StatusOK {
 		writer.Header().Set("Content-Type", "text/html; charset=UTF-8")
 		writer.WriteHeader(status)
 		writer.Write([]byte(fmt.Sprintf("<html><h1>%s</h1><p>%s</p></html>", http.StatusText(status), str)))
 		return
 	}
-	for k := range request.Header {
-		if common.OwnerHeaders[strings.ToLower(k)] && !ctx.StorageOwner {
-			request.Header.Del(k)
-		}
-		if strings.HasPrefix(strings.ToLower(k), "x-remove-container-meta-") {
-			request.Header.Del(k)
-			request.Header.Set(strings.Replace(strings.ToLower(k), "-remove", "", 1), "")
-		}
+	filterOwnerHeaders(request.Header, "container", ctx.StorageOwner)
+	if len(ctx.RemoteUsers) > 0 {
+		request.Header.Set("X-Backend-Remote-User", strings.Join(ctx.RemoteUsers, ","))
 	}
 	resp := ctx.C.PutContainer(request.Context(), vars["account"], vars["container"], request.Header)
 	resp.Body.Close()
@@ -264,7 +254,7 @@ func (server *ProxyServer) OptionsHandler(writer http.ResponseWriter, request *h
 		}
 	}
 	if ci, err := ctx.C.GetContainerInfo(request.Context(), vars["account"], vars["container"]); err == nil {
-		if common.IsOriginAllowed(ci.Metadata["Access-Control-Allow-Origin"], origin) {
+		if server.corsConfig.OriginAllowed(ci.Metadata["Access-Control-Allow-Origin"], origin) {
 			writer.Header().Set("Allow", methodString)
 			if ci.Metadata["Access-Control-Allow-Origin"] == "*" {
 				writer.Header().Set("Access-Control-Allow-Origin", "*")
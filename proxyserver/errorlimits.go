@@ -0,0 +1,25 @@
+package proxyserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/troubling/hummingbird/common/srv"
+	"go.uber.org/zap"
+)
+
+// ErrorLimitedHandler returns the backend nodes the proxy is skipping for
+// their errors, with when each will be tried again.
+func (server *ProxyServer) ErrorLimitedHandler(writer http.ResponseWriter, request *http.Request) {
+	body, err := json.Marshal(map[string]interface{}{"error_limited": server.proxyClient.ErrorLimitedNodes()})
+	if err != nil {
+		server.logger.Error("could not marshal error limited nodes", zap.Error(err))
+		srv.StandardResponse(writer, 500)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writer.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	writer.WriteHeader(200)
+	writer.Write(body)
+}
@@ -38,19 +38,23 @@ import (
 	"github.com/justinas/alice"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/uber-go/tally"
-	promreporter "github.com/uber-go/tally/prometheus"
 	"go.uber.org/zap"
 )
 
 type ProxyServer struct {
-	logger            srv.LowLevelLogger
-	logLevel          zap.AtomicLevel
-	mc                ring.MemcacheRing
-	accountAutoCreate bool
-	proxyClient       client.ProxyClient
-	metricsCloser     io.Closer
-	traceCloser       io.Closer
-	tracer            opentracing.Tracer
+	logger   srv.LowLevelLogger
+	logLevel zap.AtomicLevel
+	mc       ring.MemcacheRing
+	// accountAutoCreator is nil unless accounts are created on first use.
+	accountAutoCreator *accountAutoCreator
+	corsConfig         middleware.CorsConfig
+	proxyClient        client.ProxyClient
+	metricsCloser      io.Closer
+	traceCloser        io.Closer
+	tracer             opentracing.Tracer
+	// timelines is nil unless recent requests' timelines are kept.
+	timelines   *tracing.Timelines
+	constraints *common.Constraints
 }
 
 func (server *ProxyServer) Type() string {
@@ -74,12 +78,8 @@ func (server *ProxyServer) Finalize() {
 func (server *ProxyServer) GetHandler(config conf.Config, metricsPrefix string) http.Handler {
 	obfuscatedPrefix, _ := config.Get("app:proxy-server", "obfuscated_prefix")
 	var metricsScope tally.Scope
-	metricsScope, server.metricsCloser = tally.NewRootScope(tally.ScopeOptions{
-		Prefix:         metricsPrefix,
-		Tags:           map[string]string{},
-		CachedReporter: promreporter.NewReporter(promreporter.Options{}),
-		Separator:      promreporter.DefaultSeparator,
-	}, time.Second)
+	metricsScope, server.metricsCloser = srv.NewMetricsScope(config, metricsPrefix)
+	server.proxyClient.SetMetricsScope(metricsScope)
 	router := srv.NewRouter()
 	if obfuscatedPrefix != "" {
 		op := obfuscatedPrefix
@@ -91,6 +91,8 @@ func (server *ProxyServer) GetHandler(config conf.Config, metricsPrefix string)
 		router.Put(path.Join("/", op, "loglevel"), server.logLevel)
 		router.Get(path.Join("/", op, "debug/pprof/:parm"), http.DefaultServeMux)
 		router.Post(path.Join("/", op, "debug/pprof/:parm"), http.DefaultServeMux)
+		router.Get(path.Join("/", op, "traces/:traceId"), http.HandlerFunc(server.TraceHandler))
+		router.Get(path.Join("/", op, "errorlimited"), http.HandlerFunc(server.ErrorLimitedHandler))
 		router.Get(path.Join("/", op, "endpoints/v1/:account/:container/*obj"), http.HandlerFunc(server.EndpointsObjectGetHandler))
 		router.Get(path.Join("/", op, "endpoints/v1/:account/:container"), http.HandlerFunc(server.EndpointsContainerGetHandler))
 		router.Get(path.Join("/", op, "endpoints/v1/:account"), http.HandlerFunc(server.EndpointsAccountGetHandler))
@@ -148,11 +150,17 @@ func (server *ProxyServer) GetHandler(config conf.Config, metricsPrefix string)
 			{middleware.NewCatchError, "filter:catch_errors"},
 			{middleware.NewHealthcheck, "filter:healthcheck"},
 			{middleware.NewRequestLogger, "filter:proxy-logging"},
+			{middleware.NewCnameLookup, "filter:cname_lookup"},
+			{middleware.NewDomainRemap, "filter:domain_remap"},
 			{middleware.NewS3Auth, "filter:s3api"},
 			{middleware.NewCrossDomain, "filter:crossdomain"},
 			{middleware.NewCors, "filter:cors"}, // TODO: i dont want to have to have a seciton for this
 			{middleware.NewFormPost, "filter:formpost"},
 			{middleware.NewTempURL, "filter:tempurl"},
+			{middleware.NewContainerSync, "filter:container_sync"},
+			{middleware.NewResponseCache, "filter:response_cache"},
+			{middleware.NewAuditLog, "filter:audit_log"},
+			{middleware.NewOIDCAuth, "filter:oidcauth"},
 			{middleware.NewTempAuth, "filter:tempauth"},
 			{middleware.NewS3Api, "filter:s3api"},
 			{middleware.NewBulk, "filter:bulk"},
@@ -162,8 +170,12 @@ func (server *ProxyServer) GetHandler(config conf.Config, metricsPrefix string)
 			{middleware.NewCopyMiddleware, "filter:copy"},
 			{middleware.NewAccountQuota, "filter:account-quotas"},
 			{middleware.NewContainerQuota, "filter:container-quotas"},
+			{middleware.NewRetention, "filter:retention"},
 			{middleware.NewVersionedWrites, "filter:versioned_writes"},
+			{middleware.NewSymlink, "filter:symlink"},
 			{middleware.NewXlo, "filter:slo"},
+			{middleware.NewNotifications, "filter:notifications"},
+			{middleware.NewEncryption, "filter:encryption"},
 		}
 	} else {
 		middlewares = []struct {
@@ -173,11 +185,17 @@ func (server *ProxyServer) GetHandler(config conf.Config, metricsPrefix string)
 			{middleware.NewCatchError, "filter:catch_errors"},
 			{middleware.NewHealthcheck, "filter:healthcheck"},
 			{middleware.NewRequestLogger, "filter:proxy-logging"},
+			{middleware.NewCnameLookup, "filter:cname_lookup"},
+			{middleware.NewDomainRemap, "filter:domain_remap"},
 			{middleware.NewS3Auth, "filter:s3api"},
 			{middleware.NewCrossDomain, "filter:crossdomain"},
 			{middleware.NewCors, "filter:cors"},
 			{middleware.NewFormPost, "filter:formpost"},
 			{middleware.NewTempURL, "filter:tempurl"},
+			{middleware.NewContainerSync, "filter:container_sync"},
+			{middleware.NewResponseCache, "filter:response_cache"},
+			{middleware.NewAuditLog, "filter:audit_log"},
+			{middleware.NewOIDCAuth, "filter:oidcauth"},
 			{middleware.NewAuthToken, "filter:authtoken"},
 			{middleware.NewS3Api, "filter:s3api"},
 			{middleware.NewKeystoneAuth, "filter:keystoneauth"},
@@ -188,12 +206,22 @@ func (server *ProxyServer) GetHandler(config conf.Config, metricsPrefix string)
 			{middleware.NewCopyMiddleware, "filter:copy"},
 			{middleware.NewAccountQuota, "filter:account-quotas"},
 			{middleware.NewContainerQuota, "filter:container-quotas"},
+			{middleware.NewRetention, "filter:retention"},
 			{middleware.NewVersionedWrites, "filter:versioned_writes"},
+			{middleware.NewSymlink, "filter:symlink"},
 			{middleware.NewXlo, "filter:slo"},
+			{middleware.NewNotifications, "filter:notifications"},
+			{middleware.NewEncryption, "filter:encryption"},
 		}
 	}
-	pipeline := alice.New(globalmiddleware.ServerTracer(server.tracer), middleware.NewContext(config.GetBool("debug", "debug_x_source_code", false),
-		server.mc, server.logger, server.proxyClient))
+	// Compression goes ahead of the context middleware, which answers /info itself.
+	compression, err := middleware.NewCompression(config.GetSection("filter:compression"), metricsScope)
+	if err != nil {
+		panic("Unable to construct middleware")
+	}
+	pipeline := alice.New(globalmiddleware.ServerTracer(server.tracer), compression, middleware.NewContext(config.GetBool("debug", "debug_x_source_code", false),
+		server.mc, server.logger, server.proxyClient, server.timelines, server.constraints, middleware.NewInfoConfig(config.GetSection("app:proxy-server")),
+		time.Duration(config.GetFloat("app:proxy-server", "client_timeout", 0)*float64(time.Second))))
 	for _, m := range middlewares {
 		mid, err := m.construct(config.GetSection(m.section), metricsScope)
 		if err != nil {
@@ -218,6 +246,10 @@ func NewServer(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader
 	bindPort := int(serverconf.GetInt("DEFAULT", "bind_port", common.DefaultProxyServerPort))
 	certFile := serverconf.GetDefault("DEFAULT", "cert_file", "")
 	keyFile := serverconf.GetDefault("DEFAULT", "key_file", "")
+	caFile := serverconf.GetDefault("DEFAULT", "ca_file", "")
+	if err := common.SetClusterCA(caFile); err != nil {
+		return ipPort, nil, nil, err
+	}
 
 	readAff := serverconf.GetDefault("app:proxy-server", "read_affinity", "")
 	writeAff := serverconf.GetDefault("app:proxy-server", "write_affinity", "")
@@ -225,7 +257,6 @@ func NewServer(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader
 	logLevelString := serverconf.GetDefault("app:proxy-server", "log_level", "INFO")
 	server.logLevel = zap.NewAtomicLevel()
 	server.logLevel.UnmarshalText([]byte(strings.ToLower(logLevelString)))
-	server.accountAutoCreate = serverconf.GetBool("app:proxy-server", "account_autocreate", false)
 	if server.logger, err = srv.SetupLogger("proxy-server", &server.logLevel, flags); err != nil {
 		return ipPort, nil, nil, fmt.Errorf("Error setting up logger: %v", err)
 	}
@@ -240,6 +271,18 @@ func NewServer(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader
 	if err != nil {
 		return ipPort, nil, nil, err
 	}
+	if serverconf.GetBool("app:proxy-server", "account_autocreate", false) {
+		if server.accountAutoCreator, err = newAccountAutoCreator(serverconf.GetSection("app:proxy-server"), policies); err != nil {
+			return ipPort, nil, nil, err
+		}
+	}
+	if server.constraints, err = common.LoadConstraints(serverconf.GetSection("swift-constraints")); err != nil {
+		return ipPort, nil, nil, fmt.Errorf("Error loading swift-constraints: %v", err)
+	}
+	server.corsConfig = middleware.NewCorsConfig(serverconf.GetSection("filter:cors"))
+	if traces := serverconf.GetInt("app:proxy-server", "trace_timelines", 1000); traces > 0 {
+		server.timelines = tracing.NewTimelines(int(traces), int(serverconf.GetInt("app:proxy-server", "trace_timeline_events", 1000)))
+	}
 	server.proxyClient, err = client.NewProxyClient(
 		policies, cnf, server.logger, certFile, keyFile, readAff, writeAff, writeAffCount, serverconf)
 	if err != nil {
@@ -247,15 +290,37 @@ func NewServer(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader
 	}
 	info := map[string]interface{}{
 		"version":                  common.Version,
-		"strict_cors_mode":         true,
+		"strict_cors_mode":         server.corsConfig.Strict,
 		"policies":                 policies.GetPolicyInfo(),
-		"account_autocreate":       server.accountAutoCreate,
+		"account_autocreate":       server.accountAutoCreator != nil,
 		"allow_account_management": true,
 	}
-	for k, v := range common.DEFAULT_CONSTRAINTS {
+	for k, v := range server.constraints.Info() {
 		info[k] = v
 	}
 	middleware.RegisterInfo("swift", info)
-	ipPort = &srv.IpPort{Ip: bindIP, Port: int(bindPort), CertFile: certFile, KeyFile: keyFile}
+	middleware.RegisterAdminInfo("swift", map[string]interface{}{
+		"read_affinity":             readAff,
+		"write_affinity":            writeAff,
+		"write_affinity_node_count": writeAffCount,
+	})
+	prefix, suffix, err := cnf.GetHashPrefixAndSuffix()
+	if err != nil {
+		return ipPort, nil, nil, fmt.Errorf("Unable to get hash prefix and suffix: %v", err)
+	}
+	rings := map[string]func() (ring.Ring, error){
+		"account":   func() (ring.Ring, error) { return cnf.GetRing("account", prefix, suffix, 0) },
+		"container": func() (ring.Ring, error) { return cnf.GetRing("container", prefix, suffix, 0) },
+	}
+	for _, policy := range policies {
+		policy := policy
+		rings[fmt.Sprintf("object-%d", policy.Index)] = func() (ring.Ring, error) {
+			return cnf.GetRing("object", prefix, suffix, policy.Index)
+		}
+	}
+	middleware.RegisterReadyCheck(globalmiddleware.RingLoadedCheck(rings))
+	ipPort = &srv.IpPort{Ip: bindIP, Port: int(bindPort), CertFile: certFile, KeyFile: keyFile, CAFile: caFile,
+		HTTP2:      srv.NewHTTP2Config(serverconf.GetSection("app:proxy-server")),
+		UnixSocket: serverconf.GetDefault("app:proxy-server", "bind_unix_socket", "")}
 	return ipPort, server, server.logger, nil
 }
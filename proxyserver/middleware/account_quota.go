@@ -25,7 +25,7 @@ import (
 	"github.com/uber-go/tally"
 )
 
-func accountQuota(metric tally.Counter) func(http.Handler) http.Handler {
+func accountQuota(metric tally.Counter, headroom int64) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 			if !(request.Method == "PUT" || request.Method == "POST") {
@@ -76,15 +76,20 @@ func accountQuota(metric tally.Counter) func(http.Handler) http.Handler {
 				return
 			}
 
-			qBytes := ai.Metadata["Quota-Bytes"]
-			if qBytes != "" {
-				if quota, err := strconv.ParseInt(qBytes, 10, 64); err == nil {
-					newSize := ai.ObjectBytes + request.ContentLength
-					if quota < newSize {
-						srv.SimpleErrorResponse(writer, http.StatusRequestEntityTooLarge, "Upload exceeds quota.")
-						return
+			if quota, err := strconv.ParseInt(ai.Metadata["Quota-Bytes"], 10, 64); err == nil {
+				size := quotaUploadSize(request)
+				if newSize := ai.ObjectBytes + size; quota >= newSize && nearQuota(quota, newSize, headroom) {
+					// The cached info may be behind, so check again with the account server.
+					ctx.InvalidateAccountInfo(request.Context(), account)
+					if fresh, err := ctx.GetAccountInfo(request.Context(), account); err == nil {
+						ai = fresh
 					}
 				}
+				if quota < ai.ObjectBytes+size {
+					metric.Inc(1)
+					srv.SimpleErrorResponse(writer, http.StatusRequestEntityTooLarge, "Upload exceeds quota.")
+					return
+				}
 			}
 			next.ServeHTTP(writer, request)
 		})
@@ -93,5 +98,5 @@ func accountQuota(metric tally.Counter) func(http.Handler) http.Handler {
 
 func NewAccountQuota(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
 	RegisterInfo("account_quotas", map[string]interface{}{})
-	return accountQuota(metricsScope.Counter("account_quotas")), nil
+	return accountQuota(metricsScope.Counter("account_quotas"), config.GetInt("headroom", 10)), nil
 }
@@ -81,3 +81,34 @@ func TestBadAccountQuotaBytes(t *testing.T) {
 	require.Equal(t, 400, resp.StatusCode)
 	require.Equal(t, "Invalid bytes quota.", string(body))
 }
+
+func TestAccountQuotaBytesHeadroom(t *testing.T) {
+	h := passthroughAccountQuotaHandler()
+	f, err := client.NewProxyClient(staticPolicyList, srv.NewTestConfigLoader(&test.FakeRing{}),
+		nil, "", "", "", "", "", conf.Config{})
+	require.Nil(t, err)
+	c := &quotaHeadClient{
+		RequestClient: f.NewRequestClient(nil, map[string]*client.ContainerInfo{}, zap.NewNop()),
+		header: http.Header{
+			"X-Account-Container-Count":  {"1"},
+			"X-Account-Object-Count":     {"1"},
+			"X-Account-Bytes-Used":       {"98"},
+			"X-Account-Meta-Quota-Bytes": {"100"},
+		},
+	}
+	ctx := &ProxyContext{
+		Logger:                 zap.NewNop(),
+		C:                      c,
+		ProxyContextMiddleware: &ProxyContextMiddleware{Cache: &test.FakeMemcacheRing{}},
+		accountInfoCache: map[string]*AccountInfo{
+			"account/a": {Metadata: map[string]string{"Quota-Bytes": "100"}, ObjectBytes: 50},
+		},
+	}
+	req, err := http.NewRequest("PUT", "/v1/a/c/o", strings.NewReader(strings.Repeat("x", 45)))
+	require.Nil(t, err)
+	req = req.WithContext(context.WithValue(req.Context(), "proxycontext", ctx))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	require.Equal(t, 413, w.Code)
+	require.Equal(t, 1, c.heads)
+}
@@ -94,9 +94,11 @@ func ReferrerAllowed(referrer string, referrerACL []string) bool {
 	if len(referrerACL) > 0 {
 		rHost := "unknown"
 		if u, err := url.Parse(referrer); err == nil {
-			rHost = u.Hostname()
+			rHost = strings.ToLower(u.Hostname())
 		}
 		for _, mHost := range referrerACL {
+			// Host names aren't case sensitive.
+			mHost = strings.ToLower(mHost)
 			if strings.HasPrefix(mHost, "-") {
 				mHost = mHost[1:]
 				if mHost == rHost || (strings.HasPrefix(mHost, ".") && strings.HasSuffix(rHost, mHost)) {
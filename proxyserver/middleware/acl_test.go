@@ -128,6 +128,9 @@ func TestReferrerAllowed(t *testing.T) {
 		{"www.example.com", []string{".example.com"}, false},
 		{"../index.htm", []string{".example.com"}, false},
 		{"www.example.com", []string{"*"}, true},
+		{"http://WWW.Example.COM/index.html", []string{".example.com"}, true},
+		{"http://www.example.com/index.html", []string{"WWW.EXAMPLE.COM"}, true},
+		{"http://Thief.Example.com", []string{"*", "-thief.example.com"}, false},
 	}
 
 	for _, tt := range tests {
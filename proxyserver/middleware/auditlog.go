@@ -0,0 +1,228 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+)
+
+// auditRecord is the audit log's record of one request that changed, or
+// tried to change, an account, container or object.
+type auditRecord struct {
+	Time       string   `json:"time"`
+	TransId    string   `json:"trans_id"`
+	TraceId    string   `json:"trace_id,omitempty"`
+	Method     string   `json:"method"`
+	Account    string   `json:"account"`
+	Container  string   `json:"container,omitempty"`
+	Object     string   `json:"object,omitempty"`
+	Users      []string `json:"users,omitempty"`
+	RemoteAddr string   `json:"remote_addr"`
+	// Source is the middleware whose subrequest this was, or "" for the
+	// client's own requests.
+	Source   string `json:"source,omitempty"`
+	BytesIn  int    `json:"bytes_in"`
+	BytesOut int    `json:"bytes_out"`
+	Status   int    `json:"status"`
+}
+
+type auditLog struct {
+	next    http.Handler
+	methods map[string]bool
+	file    *auditLogFile
+	kafka   *auditLogKafka
+	records tally.Counter
+	errors  tally.Counter
+}
+
+func (a *auditLog) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	apiRequest, account, container, object := getPathParts(request)
+	if !apiRequest || account == "" || !a.methods[request.Method] {
+		a.next.ServeHTTP(writer, request)
+		return
+	}
+	w := &srv.WebWriter{ResponseWriter: writer, Status: 500}
+	reader := &srv.CountingReadCloser{ReadCloser: request.Body}
+	request.Body = reader
+	a.next.ServeHTTP(w, request)
+	ctx := GetProxyContext(request)
+	// the users are known once the auth middlewares, which come after this,
+	// have seen the request
+	line, err := json.Marshal(&auditRecord{
+		Time:       time.Now().UTC().Format(time.RFC3339Nano),
+		TransId:    ctx.TxId,
+		TraceId:    ctx.TraceId,
+		Method:     request.Method,
+		Account:    account,
+		Container:  container,
+		Object:     object,
+		Users:      ctx.RemoteUsers,
+		RemoteAddr: common.GetDefault(request.Header, "X-Forwarded-For", request.RemoteAddr),
+		Source:     ctx.Source,
+		BytesIn:    reader.ByteCount,
+		BytesOut:   w.ByteCount,
+		Status:     w.Status,
+	})
+	if err != nil {
+		a.errors.Inc(1)
+		ctx.Logger.Error("Error encoding audit record", zap.Error(err))
+		return
+	}
+	a.records.Inc(1)
+	if a.file != nil {
+		if err := a.file.write(line); err != nil {
+			a.errors.Inc(1)
+			ctx.Logger.Error("Error writing audit log", zap.String("path", a.file.path), zap.Error(err))
+		}
+	}
+	if a.kafka != nil && !a.kafka.send(line) {
+		a.errors.Inc(1)
+		ctx.Logger.Error("Audit log queue full, dropping record", zap.String("topic", a.kafka.topic))
+	}
+}
+
+// auditLogFile appends records to a file as JSON lines, opening it for each
+// write so the file can be rotated.
+type auditLogFile struct {
+	lock sync.Mutex
+	path string
+}
+
+func (f *auditLogFile) write(line []byte) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	fp, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = fp.Write(append(line, '\n')); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
+
+// auditLogKafka sends records in batches to a Kafka topic through a Kafka
+// REST proxy, keeping a batch to try again if it can't be sent.
+type auditLogKafka struct {
+	url           string
+	topic         string
+	client        *http.Client
+	batchSize     int
+	flushInterval time.Duration
+	records       chan []byte
+	errors        tally.Counter
+}
+
+func newAuditLogKafka(restURL, topic string, queueSize, batchSize int, flushInterval time.Duration, errors tally.Counter) *auditLogKafka {
+	k := &auditLogKafka{
+		url:           strings.TrimRight(restURL, "/") + "/topics/" + topic,
+		topic:         topic,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		records:       make(chan []byte, queueSize),
+		errors:        errors,
+	}
+	go k.run()
+	return k
+}
+
+// send queues the record, returning false if the queue is full.
+func (k *auditLogKafka) send(line []byte) bool {
+	select {
+	case k.records <- line:
+		return true
+	default:
+		return false
+	}
+}
+
+func (k *auditLogKafka) run() {
+	ticker := time.NewTicker(k.flushInterval)
+	defer ticker.Stop()
+	var batch [][]byte
+	for {
+		if len(batch) < k.batchSize {
+			select {
+			case line := <-k.records:
+				batch = append(batch, line)
+				if len(batch) < k.batchSize {
+					continue
+				}
+			case <-ticker.C:
+			}
+		} else {
+			// a full batch that couldn't be sent waits for the next try,
+			// leaving new records in the queue
+			<-ticker.C
+		}
+		if len(batch) > 0 && k.post(batch) {
+			batch = nil
+		}
+	}
+}
+
+func (k *auditLogKafka) post(batch [][]byte) bool {
+	var body bytes.Buffer
+	body.WriteString(`{"records":[`)
+	for i, line := range batch {
+		if i > 0 {
+			body.WriteByte(',')
+		}
+		body.WriteString(`{"value":`)
+		body.Write(line)
+		body.WriteByte('}')
+	}
+	body.WriteString(`]}`)
+	resp, err := k.client.Post(k.url, "application/vnd.kafka.json.v2+json", &body)
+	if err != nil {
+		k.errors.Inc(1)
+		return false
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		k.errors.Inc(1)
+		return false
+	}
+	return true
+}
+
+func NewAuditLog(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	if !config.GetBool("enabled", false) {
+		return func(next http.Handler) http.Handler { return next }, nil
+	}
+	methods := map[string]bool{}
+	for _, method := range strings.Fields(strings.Replace(config.GetDefault("methods", "PUT POST DELETE COPY"), ",", " ", -1)) {
+		methods[strings.ToUpper(method)] = true
+	}
+	records := metricsScope.Counter("audit_log_records")
+	errors := metricsScope.Counter("audit_log_errors")
+	var file *auditLogFile
+	if path := config.GetDefault("log_path", ""); path != "" {
+		file = &auditLogFile{path: path}
+	}
+	var kafka *auditLogKafka
+	if restURL := config.GetDefault("kafka_rest_url", ""); restURL != "" {
+		kafka = newAuditLogKafka(restURL, config.GetDefault("kafka_topic", "hummingbird-audit"),
+			int(config.GetInt("kafka_queue_size", 10000)), int(config.GetInt("kafka_batch_size", 100)),
+			time.Duration(config.GetFloat("kafka_flush_interval", 1)*float64(time.Second)), errors)
+	}
+	if file == nil && kafka == nil {
+		return nil, fmt.Errorf("Audit log needs a log_path or kafka_rest_url")
+	}
+	return func(next http.Handler) http.Handler {
+		return &auditLog{next: next, methods: methods, file: file, kafka: kafka, records: records, errors: errors}
+	}, nil
+}
@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"go.uber.org/zap"
+)
+
+// testAuditLog serves requests through an audit log in front of an auth
+// stand in, which accepts everyone as "tester".
+func testAuditLog(t *testing.T, config string) func(method, path, body string) int {
+	c, err := conf.StringConfig("[filter:audit_log]\nenabled = true\n" + config)
+	require.Nil(t, err)
+	mid, err := NewAuditLog(c.GetSection("filter:audit_log"), common.NewTestScope())
+	require.Nil(t, err)
+	handler := mid(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		GetProxyContext(r).RemoteUsers = []string{"tester"}
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(201)
+	}))
+	return func(method, path, body string) int {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		require.Nil(t, err)
+		ctx := &ProxyContext{Logger: zap.NewNop(), TxId: "tx1", TraceId: "trace1"}
+		req = req.WithContext(context.WithValue(req.Context(), "proxycontext", ctx))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+}
+
+func TestAuditLogFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	serve := testAuditLog(t, "log_path = "+path)
+
+	require.Equal(t, 201, serve("PUT", "/v1/a/c/o", "hello"))
+	require.Equal(t, 201, serve("GET", "/v1/a/c/o", ""))
+	require.Equal(t, 201, serve("DELETE", "/v1/a/c", ""))
+	data, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	// reads aren't changes, so aren't logged
+	require.Equal(t, 2, len(lines))
+	var record auditRecord
+	require.Nil(t, json.Unmarshal([]byte(lines[0]), &record))
+	require.Equal(t, "PUT", record.Method)
+	require.Equal(t, "a", record.Account)
+	require.Equal(t, "c", record.Container)
+	require.Equal(t, "o", record.Object)
+	require.Equal(t, []string{"tester"}, record.Users)
+	require.Equal(t, 5, record.BytesIn)
+	require.Equal(t, 201, record.Status)
+	require.Equal(t, "tx1", record.TransId)
+	require.Equal(t, "trace1", record.TraceId)
+	var deletion auditRecord
+	require.Nil(t, json.Unmarshal([]byte(lines[1]), &deletion))
+	require.Equal(t, "DELETE", deletion.Method)
+	require.Equal(t, "", deletion.Object)
+}
+
+func TestAuditLogKafka(t *testing.T) {
+	posted := make(chan []byte, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/topics/audit", r.URL.Path)
+		body, _ := ioutil.ReadAll(r.Body)
+		posted <- body
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+	serve := testAuditLog(t, "kafka_rest_url = "+ts.URL+"\nkafka_topic = audit\nkafka_batch_size = 2\n")
+	require.Equal(t, 201, serve("PUT", "/v1/a/c/o1", ""))
+	require.Equal(t, 201, serve("POST", "/v1/a/c/o2", ""))
+	select {
+	case body := <-posted:
+		var batch struct {
+			Records []struct {
+				Value auditRecord `json:"value"`
+			} `json:"records"`
+		}
+		require.Nil(t, json.Unmarshal(body, &batch))
+		require.Equal(t, 2, len(batch.Records))
+		require.Equal(t, "o1", batch.Records[0].Value.Object)
+		require.Equal(t, "POST", batch.Records[1].Value.Method)
+	case <-time.After(5 * time.Second):
+		t.Fatal("audit records weren't sent")
+	}
+}
+
+func TestAuditLogNeedsDestination(t *testing.T) {
+	c, err := conf.StringConfig("[filter:audit_log]\nenabled = true\n")
+	require.Nil(t, err)
+	_, err = NewAuditLog(c.GetSection("filter:audit_log"), common.NewTestScope())
+	require.NotNil(t, err)
+}
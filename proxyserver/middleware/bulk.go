@@ -18,7 +18,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/conf"
 	"github.com/uber-go/tally"
 	"go.uber.org/zap"
@@ -119,6 +118,7 @@ func (b *bulkPut) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 	if outputType == "xml" {
 		writer.Write([]byte(xml.Header))
 	}
+	bulkFlush(writer)
 	stopTheSpaces := make(chan struct{})
 	hasEmittedSpaces := make(chan bool)
 	go func() {
@@ -127,6 +127,7 @@ func (b *bulkPut) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 			select {
 			case <-time.After(b.yieldFrequency):
 				writer.Write([]byte("  "))
+				bulkFlush(writer)
 				spacesWereEmitted = true
 			case <-stopTheSpaces:
 				hasEmittedSpaces <- spacesWereEmitted
@@ -135,6 +136,7 @@ func (b *bulkPut) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 			}
 		}
 	}()
+	b.requestsMetric.Inc(1)
 	ctx := GetProxyContext(request)
 	numberFilesCreated := 0
 	failures := [][]string{}
@@ -162,7 +164,7 @@ func (b *bulkPut) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 			// We continue no matter what because the future object PUT can
 			// still succeed, such as when the container PUTs aren't authorized
 			// but the container already exists.
-			subreq, err := ctx.newSubrequest("PUT", containerPath, reader, request, "bulkput")
+			subreq, err := ctx.newSubrequest("PUT", containerPath, nil, request, "bulkput")
 			if err != nil {
 				failures = append(failures, []string{containerPath, httpStatusString(http.StatusInternalServerError)})
 			} else {
@@ -306,6 +308,7 @@ func (b *bulkDelete) ServeHTTP(writer http.ResponseWriter, request *http.Request
 	if outputType == "xml" {
 		writer.Write([]byte(xml.Header))
 	}
+	bulkFlush(writer)
 	stopTheSpaces := make(chan struct{})
 	hasEmittedSpaces := make(chan bool)
 	go func() {
@@ -314,6 +317,7 @@ func (b *bulkDelete) ServeHTTP(writer http.ResponseWriter, request *http.Request
 			select {
 			case <-time.After(b.yieldFrequency):
 				writer.Write([]byte("  "))
+				bulkFlush(writer)
 				spacesWereEmitted = true
 			case <-stopTheSpaces:
 				hasEmittedSpaces <- spacesWereEmitted
@@ -322,6 +326,7 @@ func (b *bulkDelete) ServeHTTP(writer http.ResponseWriter, request *http.Request
 			}
 		}
 	}()
+	b.requestsMetric.Inc(1)
 	ctx := GetProxyContext(request)
 	apiReq, account, _, _ := getPathSegments(request.URL.Path)
 	numberDeleted := 0
@@ -329,63 +334,40 @@ func (b *bulkDelete) ServeHTTP(writer http.ResponseWriter, request *http.Request
 	failures := [][]string{}
 	failureResponseType := http.StatusBadRequest
 	failureResponseBody := ""
+	// Everything to delete is read up front so that nothing is deleted when
+	// the request lists too many.
+	objectsToDelete := []string{}
 	containersToDelete := []string{}
+	tooMany := false
 	scanner := bufio.NewScanner(request.Body)
 	// "/c/o\n" *3 because everything could be url-encoded excepting the newline
-	maxLineLength := (common.MAX_CONTAINER_NAME_LENGTH+common.MAX_OBJECT_NAME_LENGTH+2)*3 + 1
+	maxLineLength := (ctx.Constraints().MaxContainerNameLength+ctx.Constraints().MaxObjectNameLength+2)*3 + 1
 	scanner.Buffer(make([]byte, maxLineLength), maxLineLength)
 	for scanner.Scan() {
-		if numberDeleted+numberNotFound+len(failures) > b.maxDeletesPerRequest {
-			break
+		subpath := scanner.Text()
+		if strings.TrimSpace(subpath) == "" {
+			continue
 		}
-		if len(failures) > b.maxFailedDeletes {
+		if len(objectsToDelete)+len(containersToDelete) >= b.maxDeletesPerRequest {
+			tooMany = true
 			break
 		}
-		subpath := scanner.Text()
 		u, err := url.Parse(subpath)
 		if err != nil {
 			failures = append(failures, []string{subpath, httpStatusString(http.StatusBadRequest)})
 			continue
 		}
-		subpath = u.Path
-		subpath = strings.TrimPrefix(subpath, "/")
+		subpath = strings.TrimPrefix(u.Path, "/")
 		parts := strings.SplitN(subpath, "/", 2)
-		switch len(parts) {
-		case 0:
+		if parts[0] == "" {
 			failures = append(failures, []string{subpath, httpStatusString(http.StatusBadRequest)})
-			continue
-		case 1:
+		} else if len(parts) == 1 || parts[1] == "" {
 			containersToDelete = append(containersToDelete, parts[0])
-			continue
-		}
-		subreq, err := ctx.newSubrequest("DELETE", "/"+path.Join(apiReq, account, subpath), nil, request, "bulkdelete")
-		if err != nil {
-			failures = append(failures, []string{subpath, httpStatusString(http.StatusInternalServerError)})
-			return
-		}
-		subrec := httptest.NewRecorder()
-		ctx.serveHTTPSubrequest(subrec, subreq)
-		subresp := subrec.Result()
-		subresp.Body.Close()
-		if subresp.StatusCode/100 == 5 {
-			failures = append(failures, []string{subpath, httpStatusString(subresp.StatusCode)})
-			failureResponseType = http.StatusBadGateway
-		} else if subresp.StatusCode == http.StatusNotFound {
-			numberNotFound++
-		} else if subresp.StatusCode/100 != 2 {
-			failures = append(failures, []string{subpath, httpStatusString(subresp.StatusCode)})
 		} else {
-			numberDeleted++
+			objectsToDelete = append(objectsToDelete, subpath)
 		}
 	}
-	for _, container := range containersToDelete {
-		if numberDeleted+numberNotFound+len(failures) > b.maxDeletesPerRequest {
-			break
-		}
-		if len(failures) > b.maxFailedDeletes {
-			break
-		}
-		subpath := "/" + container
+	deletePath := func(subpath string) {
 		subreq, err := ctx.newSubrequest("DELETE", "/"+path.Join(apiReq, account, subpath), nil, request, "bulkdelete")
 		if err != nil {
 			failures = append(failures, []string{subpath, httpStatusString(http.StatusInternalServerError)})
@@ -406,20 +388,31 @@ func (b *bulkDelete) ServeHTTP(writer http.ResponseWriter, request *http.Request
 			numberDeleted++
 		}
 	}
+	if !tooMany && scanner.Err() == nil {
+		// Objects go first so their containers are empty by the time they're deleted.
+		for _, subpath := range append(objectsToDelete, containersToDelete...) {
+			if len(failures) >= b.maxFailedDeletes {
+				failureResponseType = http.StatusBadRequest
+				failureResponseBody = "Max delete failures exceeded"
+				break
+			}
+			deletePath(subpath)
+		}
+	}
 	responseStatus := http.StatusOK
 	responseBody := ""
 	if err := scanner.Err(); err != nil {
 		responseStatus = http.StatusBadGateway
 		responseBody = fmt.Sprintf("Invalid bulk delete: %s", err)
+	} else if tooMany {
+		responseStatus = http.StatusRequestEntityTooLarge
+		responseBody = fmt.Sprintf("Maximum Bulk Deletes: %d per request", b.maxDeletesPerRequest)
 	} else if len(failures) > 0 {
 		responseStatus = failureResponseType
 		responseBody = failureResponseBody
 	} else if numberDeleted < 1 && numberNotFound < 1 {
 		responseStatus = http.StatusBadRequest
 		responseBody = "Invalid bulk delete."
-	} else if numberDeleted+numberNotFound+len(failures) > b.maxDeletesPerRequest {
-		responseStatus = http.StatusRequestEntityTooLarge
-		responseBody = fmt.Sprintf("Maximum Bulk Deletes: %d per request", b.maxDeletesPerRequest)
 	}
 	close(stopTheSpaces)
 	if <-hasEmittedSpaces {
@@ -537,6 +530,14 @@ func processBulkTarBz2(r io.Reader, f func(name string, header http.Header, read
 	return processBulkTar(bzip2.NewReader(r), f)
 }
 
+// bulkFlush sends what's been written so far on to the client, so the
+// whitespace that keeps a long bulk request alive isn't held back.
+func bulkFlush(writer http.ResponseWriter) {
+	if f, ok := writer.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func httpStatusString(status int) string {
 	return fmt.Sprintf("%d %s", status, http.StatusText(status))
 }
@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+)
+
+// lookupCNAME is replaced in tests so they don't need DNS.
+var lookupCNAME = func(ctx context.Context, host string) (string, error) {
+	return net.DefaultResolver.LookupCNAME(ctx, host)
+}
+
+type cnameLookup struct {
+	next           http.Handler
+	storageDomains []string
+	lookupDepth    int
+	cacheTime      int
+	requestsMetric tally.Counter
+}
+
+// resolve follows the domain's CNAME records, from the cache when it can,
+// until one is in a storage domain. It returns "" if none are within
+// lookupDepth lookups.
+func (c *cnameLookup) resolve(ctx context.Context, proxyCtx *ProxyContext, domain string) string {
+	key := "cname/" + domain
+	var found string
+	if err := proxyCtx.Cache.GetStructured(ctx, key, &found); err == nil && found != "" {
+		return found
+	}
+	current := domain
+	for i := 0; i < c.lookupDepth; i++ {
+		cname, err := lookupCNAME(ctx, current)
+		if err != nil {
+			proxyCtx.Logger.Debug("CNAME lookup failed", zap.String("domain", current), zap.Error(err))
+			return ""
+		}
+		cname = strings.ToLower(strings.TrimSuffix(cname, "."))
+		if cname == "" || cname == current {
+			return ""
+		}
+		if storageDomainOf(cname, c.storageDomains) != "" {
+			proxyCtx.Cache.Set(ctx, key, cname, c.cacheTime)
+			return cname
+		}
+		current = cname
+	}
+	return ""
+}
+
+func (c *cnameLookup) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	domain := requestDomain(request)
+	if domain == "" || net.ParseIP(domain) != nil || storageDomainOf(domain, c.storageDomains) != "" {
+		c.next.ServeHTTP(writer, request)
+		return
+	}
+	for _, sd := range c.storageDomains {
+		if domain == sd {
+			c.next.ServeHTTP(writer, request)
+			return
+		}
+	}
+	c.requestsMetric.Inc(1)
+	found := c.resolve(request.Context(), GetProxyContext(request), domain)
+	if found == "" {
+		srv.SimpleErrorResponse(writer, http.StatusBadRequest,
+			fmt.Sprintf("CNAME lookup failed to resolve %s to a storage domain", domain))
+		return
+	}
+	request.Host = found
+	c.next.ServeHTTP(writer, request)
+}
+
+// NewCnameLookup serves requests to domains that are CNAMEs for
+// <container>.<account>.<storage domain> as requests to that domain, for
+// domain_remap to pick up next.
+//
+//	enabled         default false
+//	storage_domain  comma separated; default example.com
+//	lookup_depth    how many CNAMEs to follow; default 1
+//	cache_time      seconds to cache what a domain resolves to; default 60
+func NewCnameLookup(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	if !config.GetBool("enabled", false) {
+		return func(next http.Handler) http.Handler { return next }, nil
+	}
+	lookupDepth := int(config.GetInt("lookup_depth", 1))
+	if lookupDepth < 1 {
+		return nil, fmt.Errorf("Invalid cname_lookup lookup_depth %d", lookupDepth)
+	}
+	storageDomains := loadStorageDomains(config)
+	cacheTime := int(config.GetInt("cache_time", 60))
+	RegisterInfo("cname_lookup", map[string]interface{}{"lookup_depth": lookupDepth})
+	requestsMetric := metricsScope.Counter("cname_lookup_requests")
+	return func(next http.Handler) http.Handler {
+		return &cnameLookup{
+			next:           next,
+			storageDomains: storageDomains,
+			lookupDepth:    lookupDepth,
+			cacheTime:      cacheTime,
+			requestsMetric: requestsMetric,
+		}
+	}, nil
+}
@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/test"
+	"go.uber.org/zap"
+)
+
+func TestCnameLookup(t *testing.T) {
+	cnames := map[string]string{
+		"www.vanity.com":   "alias.vanity.com.",
+		"alias.vanity.com": "c.AUTH_a.example.com.",
+		"direct.com":       "c.AUTH_b.example.com.",
+		"plain.com":        "plain.com.",
+	}
+	lookups := 0
+	oldLookup := lookupCNAME
+	lookupCNAME = func(ctx context.Context, host string) (string, error) {
+		lookups++
+		if cname, ok := cnames[host]; ok {
+			return cname, nil
+		}
+		return "", errors.New("no such host")
+	}
+	defer func() { lookupCNAME = oldLookup }()
+
+	serve := func(depth, host string) (int, string) {
+		config, err := conf.StringConfig("[filter:cname_lookup]\nenabled = true\nlookup_depth = " + depth + "\n")
+		require.Nil(t, err)
+		mid, err := NewCnameLookup(config.GetSection("filter:cname_lookup"), common.NewTestScope())
+		require.Nil(t, err)
+		seen := ""
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen = r.Host
+			w.WriteHeader(200)
+		})
+		req := httptest.NewRequest("GET", "/o", nil)
+		req.Host = host
+		ctx := &ProxyContext{
+			Logger:                 zap.NewNop(),
+			ProxyContextMiddleware: &ProxyContextMiddleware{Cache: &test.FakeMemcacheRing{}},
+		}
+		req = req.WithContext(context.WithValue(req.Context(), "proxycontext", ctx))
+		w := httptest.NewRecorder()
+		mid(next).ServeHTTP(w, req)
+		return w.Code, seen
+	}
+
+	code, host := serve("1", "direct.com:8080")
+	require.Equal(t, 200, code)
+	require.Equal(t, "c.auth_b.example.com", host)
+
+	// Two CNAMEs deep needs a lookup depth of 2.
+	code, _ = serve("1", "www.vanity.com")
+	require.Equal(t, 400, code)
+	code, host = serve("2", "www.vanity.com")
+	require.Equal(t, 200, code)
+	require.Equal(t, "c.auth_a.example.com", host)
+
+	code, _ = serve("2", "plain.com")
+	require.Equal(t, 400, code)
+	code, _ = serve("2", "unknown.com")
+	require.Equal(t, 400, code)
+
+	// Storage domains and addresses don't need a lookup.
+	lookups = 0
+	code, host = serve("1", "c.AUTH_a.example.com")
+	require.Equal(t, 200, code)
+	require.Equal(t, "c.AUTH_a.example.com", host)
+	code, _ = serve("1", "127.0.0.1:8080")
+	require.Equal(t, 200, code)
+	code, _ = serve("1", "example.com")
+	require.Equal(t, 200, code)
+	require.Equal(t, 0, lookups)
+
+	config, err := conf.StringConfig("[filter:cname_lookup]\nenabled = true\nlookup_depth = 0\n")
+	require.Nil(t, err)
+	_, err = NewCnameLookup(config.GetSection("filter:cname_lookup"), common.NewTestScope())
+	require.NotNil(t, err)
+}
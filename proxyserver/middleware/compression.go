@@ -0,0 +1,192 @@
+package middleware
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/uber-go/tally"
+)
+
+const defaultCompressionTypes = "application/json,application/xml,text/plain,text/xml"
+
+// compressWriter holds back the response until it knows whether it will be
+// compressed: responses that aren't a 200 of an allowed content type pass
+// straight through, as do those that end before reaching minSize bytes.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding     string
+	minSize      int
+	contentTypes map[string]bool
+	metric       tally.Counter
+	status       int
+	buf          []byte
+	pending      bool
+	compressor   io.WriteCloser
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	h := w.Header()
+	contentType := strings.TrimSpace(strings.SplitN(h.Get("Content-Type"), ";", 2)[0])
+	if status != http.StatusOK || h.Get("Content-Encoding") != "" || !w.contentTypes[strings.ToLower(contentType)] {
+		w.passThrough()
+		return
+	}
+	if cl, err := strconv.Atoi(h.Get("Content-Length")); err == nil && cl < w.minSize {
+		w.passThrough()
+		return
+	}
+	w.pending = true
+}
+
+func (w *compressWriter) passThrough() {
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+func (w *compressWriter) startCompression() error {
+	w.pending = false
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Del("Etag")
+	h.Set("Content-Encoding", w.encoding)
+	h.Add("Vary", "Accept-Encoding")
+	w.ResponseWriter.WriteHeader(w.status)
+	if w.encoding == "gzip" {
+		w.compressor = gzip.NewWriter(w.ResponseWriter)
+	} else {
+		w.compressor, _ = flate.NewWriter(w.ResponseWriter, flate.DefaultCompression)
+	}
+	w.metric.Inc(1)
+	_, err := w.compressor.Write(w.buf)
+	w.buf = nil
+	return err
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.compressor != nil {
+		return w.compressor.Write(b)
+	}
+	if !w.pending {
+		return w.ResponseWriter.Write(b)
+	}
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= w.minSize {
+		if err := w.startCompression(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush sends what's been written so far, starting compression if the
+// response is still being held back.
+func (w *compressWriter) Flush() {
+	if w.status == 0 {
+		return
+	}
+	if w.pending {
+		if err := w.startCompression(); err != nil {
+			return
+		}
+	}
+	if w.compressor != nil {
+		if f, ok := w.compressor.(interface {
+			Flush() error
+		}); ok {
+			f.Flush()
+		}
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// finish sends any response still held back, uncompressed if it never reached minSize.
+func (w *compressWriter) finish() {
+	if w.compressor != nil {
+		w.compressor.Close()
+		return
+	}
+	if w.pending {
+		w.pending = false
+		w.passThrough()
+		w.ResponseWriter.Write(w.buf)
+	}
+}
+
+// acceptedEncoding picks gzip or deflate from an Accept-Encoding header, preferring gzip.
+func acceptedEncoding(header string) string {
+	qvalues := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		q := 1.0
+		for _, param := range fields[1:] {
+			if param = strings.TrimSpace(param); strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		qvalues[strings.ToLower(strings.TrimSpace(fields[0]))] = q
+	}
+	if q, ok := qvalues["gzip"]; q > 0 || (!ok && qvalues["*"] > 0) {
+		return "gzip"
+	}
+	if qvalues["deflate"] > 0 {
+		return "deflate"
+	}
+	return ""
+}
+
+func compression(minSize int, contentTypes map[string]bool, metric tally.Counter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			if request.Method != "GET" {
+				next.ServeHTTP(writer, request)
+				return
+			}
+			if apiReq, account, _, object := getPathParts(request); request.URL.Path != "/info" && (!apiReq || account == "" || object != "") {
+				next.ServeHTTP(writer, request)
+				return
+			}
+			encoding := acceptedEncoding(request.Header.Get("Accept-Encoding"))
+			if encoding == "" {
+				next.ServeHTTP(writer, request)
+				return
+			}
+			cw := &compressWriter{ResponseWriter: writer, encoding: encoding, minSize: minSize, contentTypes: contentTypes, metric: metric}
+			defer cw.finish()
+			next.ServeHTTP(cw, request)
+		})
+	}
+}
+
+// NewCompression compresses account and container listings and /info
+// responses for clients sending Accept-Encoding: gzip or deflate.
+//
+//	enabled        default false
+//	min_size       responses smaller than this many bytes are left alone; default 1024
+//	content_types  comma separated content types to compress; default
+//	               application/json,application/xml,text/plain,text/xml
+func NewCompression(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	if !config.GetBool("enabled", false) {
+		return func(next http.Handler) http.Handler { return next }, nil
+	}
+	contentTypes := map[string]bool{}
+	for _, ct := range common.SliceFromCSV(config.GetDefault("content_types", defaultCompressionTypes)) {
+		contentTypes[strings.ToLower(ct)] = true
+	}
+	return compression(int(config.GetInt("min_size", 1024)), contentTypes, metricsScope.Counter("compressed_responses")), nil
+}
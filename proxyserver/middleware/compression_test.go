@@ -0,0 +1,138 @@
+package middleware
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+)
+
+func TestAcceptedEncoding(t *testing.T) {
+	for header, expected := range map[string]string{
+		"":                       "",
+		"gzip":                   "gzip",
+		"deflate":                "deflate",
+		"gzip, deflate":          "gzip",
+		"GZIP;q=0.5, deflate":    "gzip",
+		"gzip;q=0, deflate":      "deflate",
+		"gzip;q=0, deflate;q=0":  "",
+		"br":                     "",
+		"*":                      "gzip",
+		"gzip;q=0, *":            "",
+		"identity, deflate;q=.3": "deflate",
+	} {
+		require.Equal(t, expected, acceptedEncoding(header), header)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	listing := strings.Repeat(`{"name": "object", "bytes": 0},`, 100)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := listing
+		if r.URL.Query().Get("small") != "" {
+			body = "[]"
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if r.URL.Query().Get("type") != "" {
+			w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		}
+		if r.URL.Query().Get("stream") == "" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		}
+		w.WriteHeader(200)
+		for i := 0; i < len(body); i += 100 {
+			end := i + 100
+			if end > len(body) {
+				end = len(body)
+			}
+			w.Write([]byte(body[i:end]))
+		}
+	})
+	config, _ := conf.StringConfig("[filter:compression]\nenabled = true\nmin_size = 1000\n")
+	mid, err := NewCompression(config.GetSection("filter:compression"), common.NewTestScope())
+	require.Nil(t, err)
+	h := mid(next)
+	get := func(path, acceptEncoding string) *http.Response {
+		req, err := http.NewRequest("GET", path, nil)
+		require.Nil(t, err)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	resp := get("/v1/a/c?stream=1", "gzip")
+	require.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	require.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+	require.Equal(t, "", resp.Header.Get("Content-Length"))
+	gz, err := gzip.NewReader(resp.Body)
+	require.Nil(t, err)
+	body, err := ioutil.ReadAll(gz)
+	require.Nil(t, err)
+	require.Equal(t, listing, string(body))
+
+	resp = get("/v1/a", "deflate")
+	require.Equal(t, "deflate", resp.Header.Get("Content-Encoding"))
+	body, err = ioutil.ReadAll(flate.NewReader(resp.Body))
+	require.Nil(t, err)
+	require.Equal(t, listing, string(body))
+
+	resp = get("/info", "gzip")
+	require.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+
+	for _, path := range []string{"/v1/a/c/o", "/v1/a/c?stream=1&small=1", "/v1/a/c?small=1", "/v1/a/c?type=text/html", "/healthcheck"} {
+		resp = get(path, "gzip")
+		require.Equal(t, "", resp.Header.Get("Content-Encoding"), path)
+	}
+	// A streamed response that stays under min_size is sent uncompressed once it ends.
+	resp = get("/v1/a/c?stream=1&small=1", "gzip")
+	body, _ = ioutil.ReadAll(resp.Body)
+	require.Equal(t, "[]", string(body))
+	resp = get("/v1/a/c", "")
+	require.Equal(t, "", resp.Header.Get("Content-Encoding"))
+	body, _ = ioutil.ReadAll(resp.Body)
+	require.Equal(t, listing, string(body))
+}
+
+func TestCompressionDisabled(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(strings.Repeat("[]", 1000)))
+	})
+	mid, err := NewCompression(conf.Section{}, common.NewTestScope())
+	require.Nil(t, err)
+	req, err := http.NewRequest("GET", "/v1/a/c", nil)
+	require.Nil(t, err)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	mid(next).ServeHTTP(w, req)
+	require.Equal(t, "", w.Result().Header.Get("Content-Encoding"))
+}
+
+func TestCompressionFlush(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &compressWriter{ResponseWriter: rec, encoding: "gzip", minSize: 1000,
+		contentTypes: map[string]bool{"text/plain": true}, metric: common.NewTestScope().Counter("test")}
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(200)
+	w.Write([]byte("  "))
+	// Flushing a held back response starts it compressed rather than waiting for min_size.
+	w.Flush()
+	require.True(t, rec.Flushed)
+	require.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	w.Write([]byte("done"))
+	w.finish()
+	r, err := gzip.NewReader(rec.Body)
+	require.Nil(t, err)
+	body, err := ioutil.ReadAll(r)
+	require.Nil(t, err)
+	require.Equal(t, "  done", string(body))
+}
@@ -19,13 +19,30 @@ import (
 	"net/http"
 	"strconv"
 
+	"github.com/troubling/hummingbird/client"
 	"github.com/troubling/hummingbird/common/conf"
 	"github.com/troubling/hummingbird/common/srv"
 
 	"github.com/uber-go/tally"
 )
 
-func containerQuota(metric tally.Counter) func(http.Handler) http.Handler {
+// quotaUploadSize is how many bytes a PUT adds towards a quota; uploads of
+// unknown length count as nothing, so they're only refused once the quota is
+// already used up.
+func quotaUploadSize(request *http.Request) int64 {
+	if request.ContentLength > 0 {
+		return request.ContentLength
+	}
+	return 0
+}
+
+// nearQuota reports whether used is within headroom percent of quota, where
+// cached usage is too rough to go on.
+func nearQuota(quota, used, headroom int64) bool {
+	return used > quota-quota*headroom/100
+}
+
+func containerQuota(metric tally.Counter, headroom int64) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 			ctx := GetProxyContext(request)
@@ -56,26 +73,28 @@ func containerQuota(metric tally.Counter) func(http.Handler) http.Handler {
 					next.ServeHTTP(writer, request)
 					return
 				}
-				qBytes := ci.Metadata["Quota-Bytes"]
-				if qBytes != "" {
-					if quota, err := strconv.ParseInt(qBytes, 10, 64); err == nil {
-						newSize := ci.ObjectBytes + request.ContentLength
-						if quota < newSize {
-							srv.SimpleErrorResponse(writer, http.StatusRequestEntityTooLarge, "Upload exceeds quota.")
-							return
-						}
-					}
+				qBytes, bytesErr := strconv.ParseInt(ci.Metadata["Quota-Bytes"], 10, 64)
+				qCount, countErr := strconv.ParseInt(ci.Metadata["Quota-Count"], 10, 64)
+				size := quotaUploadSize(request)
+				overQuota := func(ci *client.ContainerInfo) bool {
+					return (bytesErr == nil && qBytes < ci.ObjectBytes+size) || (countErr == nil && qCount < ci.ObjectCount+1)
 				}
-				qCount := ci.Metadata["Quota-Count"]
-				if qCount != "" {
-					if quota, err := strconv.ParseInt(qCount, 10, 64); err == nil {
-						newCount := ci.ObjectCount + 1
-						if quota < newCount {
-							srv.SimpleErrorResponse(writer, http.StatusRequestEntityTooLarge, "Upload exceeds quota.")
-							return
+				if !overQuota(ci) && ((bytesErr == nil && nearQuota(qBytes, ci.ObjectBytes+size, headroom)) ||
+					(countErr == nil && nearQuota(qCount, ci.ObjectCount+1, headroom))) {
+					// The cached info may be behind, so check again with the container server.
+					resp := ctx.C.HeadContainer(request.Context(), account, container, nil)
+					resp.Body.Close()
+					if resp.StatusCode/100 == 2 {
+						if fresh, err := ctx.C.SetContainerInfo(request.Context(), account, container, resp); err == nil {
+							ci = fresh
 						}
 					}
 				}
+				if overQuota(ci) {
+					metric.Inc(1)
+					srv.SimpleErrorResponse(writer, http.StatusRequestEntityTooLarge, "Upload exceeds quota.")
+					return
+				}
 			}
 			next.ServeHTTP(writer, request)
 		})
@@ -84,5 +103,5 @@ func containerQuota(metric tally.Counter) func(http.Handler) http.Handler {
 
 func NewContainerQuota(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
 	RegisterInfo("container_quotas", map[string]interface{}{})
-	return containerQuota(metricsScope.Counter("container_quotas")), nil
+	return containerQuota(metricsScope.Counter("container_quotas"), config.GetInt("headroom", 10)), nil
 }
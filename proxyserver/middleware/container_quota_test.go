@@ -118,3 +118,68 @@ func TestBadQuotaCount(t *testing.T) {
 	require.Equal(t, 400, resp.StatusCode)
 	require.Equal(t, "Invalid count quota.", string(body))
 }
+
+// quotaHeadClient answers HEADs with fresh usage, counting how many it gets.
+type quotaHeadClient struct {
+	client.RequestClient
+	header http.Header
+	heads  int
+}
+
+func (c *quotaHeadClient) HeadContainer(ctx context.Context, account string, container string, headers http.Header) *http.Response {
+	c.heads++
+	return &http.Response{StatusCode: 204, Header: c.header, Body: ioutil.NopCloser(strings.NewReader(""))}
+}
+
+func (c *quotaHeadClient) HeadAccount(ctx context.Context, account string, headers http.Header) *http.Response {
+	c.heads++
+	return &http.Response{StatusCode: 204, Header: c.header, Body: ioutil.NopCloser(strings.NewReader(""))}
+}
+
+func TestQuotaBytesHeadroom(t *testing.T) {
+	h := passthroughQuotaHandler()
+	f, err := client.NewProxyClient(staticPolicyList, srv.NewTestConfigLoader(&test.FakeRing{}),
+		nil, "", "", "", "", "", conf.Config{})
+	require.Nil(t, err)
+	put := func(size int, freshBytes string) (int, int) {
+		c := &quotaHeadClient{
+			RequestClient: f.NewRequestClient(nil, map[string]*client.ContainerInfo{
+				"container/a/c": {
+					Metadata:    map[string]string{"Quota-Bytes": "100"},
+					ObjectBytes: 50,
+				},
+			}, zap.NewNop()),
+			header: http.Header{
+				"X-Container-Object-Count":       {"1"},
+				"X-Container-Bytes-Used":         {freshBytes},
+				"X-Backend-Storage-Policy-Index": {"0"},
+				"X-Container-Meta-Quota-Bytes":   {"100"},
+			},
+		}
+		ctx := &ProxyContext{Logger: zap.NewNop(), C: c}
+		req, err := http.NewRequest("PUT", "/v1/a/c/o", strings.NewReader(strings.Repeat("x", size)))
+		require.Nil(t, err)
+		req = req.WithContext(context.WithValue(req.Context(), "proxycontext", ctx))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code, c.heads
+	}
+
+	// Well inside the quota, the cached usage is enough.
+	code, heads := put(10, "50")
+	require.Equal(t, 200, code)
+	require.Equal(t, 0, heads)
+
+	// Close to the quota, the container is checked again.
+	code, heads = put(45, "80")
+	require.Equal(t, 413, code)
+	require.Equal(t, 1, heads)
+	code, heads = put(45, "50")
+	require.Equal(t, 200, code)
+	require.Equal(t, 1, heads)
+
+	// Already over on the cached usage doesn't need another look.
+	code, heads = put(60, "0")
+	require.Equal(t, 413, code)
+	require.Equal(t, 0, heads)
+}
@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/uber-go/tally"
+)
+
+var containerSyncMethods = map[string]bool{"HEAD": true, "PUT": true, "DELETE": true}
+
+// containerSync authorizes the requests another cluster's container sync
+// makes to a container, signed with a realm key and the container's
+// X-Container-Sync-Key. They keep their X-Timestamp, so a synced object has
+// the same timestamp in both clusters.
+func containerSync(realms conf.SyncRealmList, requestsMetric tally.Counter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			auth := request.Header.Get("X-Container-Sync-Auth")
+			if auth == "" {
+				next.ServeHTTP(writer, request)
+				return
+			}
+			request.Header.Del("X-Container-Sync-Auth")
+			requestsMetric.Inc(1)
+			ctx := GetProxyContext(request)
+			apiReq, account, container, obj := getPathParts(request)
+			fields := strings.Fields(auth)
+			if !apiReq || obj == "" || len(fields) != 3 || !containerSyncMethods[request.Method] {
+				srv.SimpleErrorResponse(writer, http.StatusUnauthorized, "Invalid X-Container-Sync-Auth.")
+				return
+			}
+			realm, ok := realms[fields[0]]
+			if !ok {
+				srv.SimpleErrorResponse(writer, http.StatusUnauthorized, "Unknown container sync realm.")
+				return
+			}
+			timestamp, err := common.StandardizeTimestamp(ctx.clientTimestamp)
+			if err != nil {
+				srv.SimpleErrorResponse(writer, http.StatusBadRequest, "Invalid X-Timestamp.")
+				return
+			}
+			ci, err := ctx.C.GetContainerInfo(request.Context(), account, container)
+			if err != nil || ci.SyncKey == "" ||
+				!realm.ValidSyncSignature(request.Method, request.URL.EscapedPath(), ctx.clientTimestamp, fields[1], ci.SyncKey, fields[2]) {
+				srv.SimpleErrorResponse(writer, http.StatusUnauthorized, "Invalid X-Container-Sync-Auth.")
+				return
+			}
+			request.Header.Set("X-Timestamp", timestamp)
+			ctx.RemoteUsers = []string{".container_sync"}
+			ctx.Authorize = func(r *http.Request) (bool, int) {
+				ar, a, c, _ := getPathParts(r)
+				if ar && a == account && c == container {
+					return true, http.StatusOK
+				}
+				return false, http.StatusUnauthorized
+			}
+			next.ServeHTTP(writer, request)
+		})
+	}
+}
+
+func NewContainerSync(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	realms, err := conf.GetSyncRealms()
+	if err != nil {
+		return nil, err
+	}
+	info := map[string]interface{}{}
+	for name, realm := range realms {
+		clusters := map[string]interface{}{}
+		for cluster := range realm.Clusters {
+			clusters[cluster] = map[string]interface{}{}
+		}
+		info[name] = map[string]interface{}{"clusters": clusters}
+	}
+	RegisterInfo("container_sync", map[string]interface{}{"realms": info})
+	return containerSync(realms, metricsScope.Counter("container_sync_requests")), nil
+}
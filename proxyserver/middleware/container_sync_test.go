@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/client"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/common/test"
+	"go.uber.org/zap"
+)
+
+var testSyncRealms = conf.SyncRealmList{"realm1": {Name: "realm1", Key1: "one", Key2: "two", Clusters: map[string]string{"east": "http://east/v1/"}}}
+
+// serveContainerSync sends the request through containerSync, with /a/c's
+// sync key set to syncKey, returning the response and the request the next
+// handler got.
+func serveContainerSync(t *testing.T, method, path, timestamp, auth, syncKey string) (*http.Response, *http.Request, *ProxyContext) {
+	f, err := client.NewProxyClient(staticPolicyList, srv.NewTestConfigLoader(&test.FakeRing{}),
+		nil, "", "", "", "", "", conf.Config{})
+	require.Nil(t, err)
+	ctx := &ProxyContext{
+		C: f.NewRequestClient(nil, map[string]*client.ContainerInfo{
+			"container/a/c": {SyncKey: syncKey, Metadata: map[string]string{}},
+		}, zap.NewNop()),
+		clientTimestamp: timestamp,
+	}
+	r := httptest.NewRequest(method, path, nil)
+	r.Header.Set("X-Container-Sync-Auth", auth)
+	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", ctx))
+	w := httptest.NewRecorder()
+	var served *http.Request
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		served = request
+		writer.WriteHeader(201)
+	})
+	containerSync(testSyncRealms, common.NewTestScope().Counter("test_container_sync"))(handler).ServeHTTP(w, r)
+	return w.Result(), served, ctx
+}
+
+func TestContainerSyncAuthorized(t *testing.T) {
+	timestamp := "1500000000.00001"
+	auth := testSyncRealms["realm1"].SyncAuth("PUT", "/v1/a/c/o%20o", timestamp, "nonce", "secret")
+	resp, served, ctx := serveContainerSync(t, "PUT", "/v1/a/c/o%20o", timestamp, auth, "secret")
+	require.Equal(t, 201, resp.StatusCode)
+	require.NotNil(t, served)
+	require.Equal(t, timestamp, served.Header.Get("X-Timestamp"))
+	require.Equal(t, "", served.Header.Get("X-Container-Sync-Auth"))
+	require.Equal(t, []string{".container_sync"}, ctx.RemoteUsers)
+	ok, _ := ctx.Authorize(httptest.NewRequest("PUT", "/v1/a/c/other", nil))
+	require.True(t, ok)
+	ok, _ = ctx.Authorize(httptest.NewRequest("PUT", "/v1/a/c2/o", nil))
+	require.False(t, ok)
+
+	// Signed with the realm's second key.
+	rotated := conf.SyncRealm{Name: "realm1", Key1: "two"}
+	resp, _, _ = serveContainerSync(t, "DELETE", "/v1/a/c/o", timestamp, rotated.SyncAuth("DELETE", "/v1/a/c/o", timestamp, "nonce", "secret"), "secret")
+	require.Equal(t, 201, resp.StatusCode)
+}
+
+func TestContainerSyncUnauthorized(t *testing.T) {
+	timestamp := "1500000000.00001"
+	auth := testSyncRealms["realm1"].SyncAuth("PUT", "/v1/a/c/o", timestamp, "nonce", "secret")
+	for _, tc := range []struct {
+		method, path, timestamp, auth, syncKey string
+		status                                 int
+	}{
+		{"PUT", "/v1/a/c/o", timestamp, auth, "other", 401},
+		{"PUT", "/v1/a/c/o", timestamp, auth, "", 401},
+		{"PUT", "/v1/a/c/o", "1500000000.00002", auth, "secret", 401},
+		{"PUT", "/v1/a/c/o2", timestamp, auth, "secret", 401},
+		{"POST", "/v1/a/c/o", timestamp, auth, "secret", 401},
+		{"PUT", "/v1/a/c", timestamp, auth, "secret", 401},
+		{"PUT", "/v1/a/c/o", timestamp, strings.Replace(auth, "realm1", "realm2", 1), "secret", 401},
+		{"PUT", "/v1/a/c/o", timestamp, "realm1 nonce", "secret", 401},
+		{"PUT", "/v1/a/c/o", "", auth, "secret", 400},
+	} {
+		resp, served, _ := serveContainerSync(t, tc.method, tc.path, tc.timestamp, tc.auth, tc.syncKey)
+		require.Equal(t, tc.status, resp.StatusCode, "%+v", tc)
+		require.Nil(t, served)
+	}
+}
+
+func TestContainerSyncPassUnsigned(t *testing.T) {
+	r := httptest.NewRequest("PUT", "/v1/a/c/o", nil)
+	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", &ProxyContext{}))
+	served := false
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		served = true
+	})
+	containerSync(testSyncRealms, common.NewTestScope().Counter("test_container_sync"))(handler).ServeHTTP(httptest.NewRecorder(), r)
+	require.True(t, served)
+	require.Nil(t, GetProxyContext(r).Authorize)
+}
@@ -17,7 +17,6 @@ package middleware
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
@@ -31,13 +30,15 @@ import (
 	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/ring"
 	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/common/tracing"
 	"go.uber.org/zap"
 )
 
 var (
-	serverInfo     = make(map[string]interface{})
-	sil            sync.Mutex
-	excludeHeaders = []string{
+	serverInfo      = make(map[string]interface{})
+	serverAdminInfo = make(map[string]interface{})
+	sil             sync.Mutex
+	excludeHeaders  = []string{
 		"X-Account-Sysmeta-",
 		"X-Container-Sysmeta-",
 		"X-Object-Sysmeta-",
@@ -52,11 +53,12 @@ func RegisterInfo(name string, data interface{}) {
 	serverInfo[name] = data
 }
 
-func serverInfoDump() ([]byte, error) {
+// RegisterAdminInfo adds a section to what /info only shows requests signed
+// with the admin_key, under "admin".
+func RegisterAdminInfo(name string, data interface{}) {
 	sil.Lock()
 	defer sil.Unlock()
-	data, err := json.Marshal(serverInfo)
-	return data, err
+	serverAdminInfo[name] = data
 }
 
 // Used to capture response from a subrequest
@@ -95,6 +97,21 @@ type ProxyContextMiddleware struct {
 	Cache              ring.MemcacheRing
 	proxyClientFactory client.ProxyClient
 	debugResponses     bool
+	// timelines keeps the recent traces' events, if they're kept.
+	timelines   *tracing.Timelines
+	constraints *common.Constraints
+	info        InfoConfig
+	// clientTimeout is how long each client request has before its backend
+	// requests are given up on, with 0 for no limit.
+	clientTimeout time.Duration
+}
+
+// Constraints returns the limits client requests are held to.
+func (m *ProxyContextMiddleware) Constraints() *common.Constraints {
+	if m == nil || m.constraints == nil {
+		return &common.DefaultConstraints
+	}
+	return m.constraints
 }
 
 type ProxyContext struct {
@@ -108,12 +125,21 @@ type ProxyContext struct {
 	subrequestCopy   subrequestCopy
 	Logger           *zap.Logger
 	TxId             string
+	TraceId          string
 	responseSent     time.Time
 	status           int
 	accountInfoCache map[string]*AccountInfo
-	depth            int
-	Source           string
-	S3Auth           *S3AuthInfo
+	// accountInfoLock guards accountInfoCache, which is shared with
+	// subrequests that may run at the same time.
+	accountInfoLock *sync.Mutex
+	depth           int
+	Source          string
+	S3Auth          *S3AuthInfo
+	// realmAccount names the realm in 401 responses.
+	realmAccount string
+	// clientTimestamp is the X-Timestamp the client sent, which only
+	// container sync requests get to keep.
+	clientTimestamp string
 }
 
 func GetProxyContext(r *http.Request) *ProxyContext {
@@ -162,10 +188,12 @@ func getPathSegments(requestPath string) (string, string, string, string) {
 
 func (pc *ProxyContext) GetAccountInfo(ctx context.Context, account string) (*AccountInfo, error) {
 	key := fmt.Sprintf("account/%s", account)
-	ai := pc.accountInfoCache[key]
+	ai := pc.cachedAccountInfo(key)
 	if ai == nil {
 		if err := pc.Cache.GetStructured(ctx, key, &ai); err != nil {
 			ai = nil
+		} else if ai != nil {
+			pc.cacheAccountInfo(key, ai)
 		}
 	}
 	if ai != nil && ai.StatusCode != 0 && ai.StatusCode/100 != 2 {
@@ -175,7 +203,9 @@ func (pc *ProxyContext) GetAccountInfo(ctx context.Context, account string) (*Ac
 		resp := pc.C.HeadAccount(ctx, account, nil)
 		resp.Body.Close()
 		if resp.StatusCode/100 != 2 {
-			pc.Cache.Set(ctx, key, &AccountInfo{StatusCode: resp.StatusCode}, 30)
+			ai = &AccountInfo{StatusCode: resp.StatusCode}
+			pc.cacheAccountInfo(key, ai)
+			pc.Cache.Set(ctx, key, ai, 30)
 			return nil, fmt.Errorf("%d error retrieving info for account %s", resp.StatusCode, account)
 		}
 		ai = &AccountInfo{
@@ -200,20 +230,72 @@ func (pc *ProxyContext) GetAccountInfo(ctx context.Context, account string) (*Ac
 				ai.SysMetadata[k[18:]] = resp.Header.Get(k)
 			}
 		}
+		pc.cacheAccountInfo(key, ai)
 		pc.Cache.Set(ctx, key, ai, 30)
 	}
 	return ai, nil
 }
 
+// cachedAccountInfo returns the account info already looked up for this
+// request, so middlewares after the first don't go back to memcache.
+func (pc *ProxyContext) cachedAccountInfo(key string) *AccountInfo {
+	if pc.accountInfoLock != nil {
+		pc.accountInfoLock.Lock()
+		defer pc.accountInfoLock.Unlock()
+	}
+	return pc.accountInfoCache[key]
+}
+
+func (pc *ProxyContext) cacheAccountInfo(key string, ai *AccountInfo) {
+	if pc.accountInfoLock != nil {
+		pc.accountInfoLock.Lock()
+		defer pc.accountInfoLock.Unlock()
+	}
+	if ai == nil {
+		delete(pc.accountInfoCache, key)
+	} else if pc.accountInfoCache != nil {
+		pc.accountInfoCache[key] = ai
+	}
+}
+
+// pathChanged is called with the request as it arrives, and again by
+// middleware that rewrites its path to another account.
+func (pc *ProxyContext) pathChanged(request *http.Request) {
+	apiRequest, account, container, _ := getPathParts(request)
+	pc.realmAccount = account
+	// we'll almost certainly need the AccountInfo and ContainerInfo for the current path, so pre-fetch them in parallel.
+	if apiRequest && account != "" {
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pc.GetAccountInfo(request.Context(), account)
+		}()
+		if container != "" {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				pc.C.GetContainerInfo(request.Context(), account, container)
+			}()
+		}
+		wg.Wait()
+	}
+}
+
 func (pc *ProxyContext) InvalidateAccountInfo(ctx context.Context, account string) {
 	key := fmt.Sprintf("account/%s", account)
-	delete(pc.accountInfoCache, key)
+	pc.cacheAccountInfo(key, nil)
 	pc.Cache.Delete(ctx, key)
 }
 
-func (pc *ProxyContext) AutoCreateAccount(ctx context.Context, account string, headers http.Header) {
+// AutoCreateAccount creates the account with the request's account sysmeta
+// and the defaults it's given.
+func (pc *ProxyContext) AutoCreateAccount(ctx context.Context, account string, headers http.Header, defaults http.Header) {
 	h := http.Header{"X-Timestamp": []string{common.GetTimestamp()},
 		"X-Trans-Id": []string{pc.TxId}}
+	for key := range defaults {
+		h.Set(key, defaults.Get(key))
+	}
 	for key := range headers {
 		if strings.HasPrefix(key, "X-Account-Sysmeta-") {
 			h[key] = []string{headers.Get(key)}
@@ -244,7 +326,9 @@ func (pc *ProxyContext) newSubrequest(method, urlStr string, body io.Reader, req
 		Logger:                 pc.Logger.With(zap.String("src", source)),
 		C:                      pc.C,
 		TxId:                   pc.TxId,
+		TraceId:                pc.TraceId,
 		accountInfoCache:       pc.accountInfoCache,
+		accountInfoLock:        pc.accountInfoLock,
 		status:                 500,
 		depth:                  pc.depth + 1,
 		Source:                 source,
@@ -258,6 +342,7 @@ func (pc *ProxyContext) newSubrequest(method, urlStr string, body io.Reader, req
 		subreq.Header.Set("Referer", v)
 	}
 	subreq.Header.Set("X-Trans-Id", subctx.TxId)
+	subreq.Header.Set(tracing.TraceIdHeader, subctx.TraceId)
 	subreq.Header.Set("X-Timestamp", common.GetTimestamp())
 	return subreq, nil
 }
@@ -279,34 +364,12 @@ func (m *ProxyContextMiddleware) ServeHTTP(writer http.ResponseWriter, request *
 		return
 	}
 
-	if request.URL.Path == "/info" {
-		if request.URL.Query().Get("swiftinfo_sig") != "" || request.URL.Query().Get("swiftinfo_expires") != "" {
-			writer.WriteHeader(403)
-			return
-		}
-		if request.Method == "GET" {
-			if data, err := serverInfoDump(); err != nil {
-				srv.StandardResponse(writer, 500)
-			} else {
-				writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
-				writer.WriteHeader(200)
-				writer.Write(data)
-			}
-			return
-		} else if request.Method == "OPTIONS" {
-			writer.Header().Set("Allow", "HEAD, GET, OPTIONS")
-			writer.WriteHeader(200)
-			return
-		} else if request.Method == "HEAD" {
-			if _, err := serverInfoDump(); err != nil {
-				srv.StandardResponse(writer, 500)
-			} else {
-				writer.WriteHeader(200)
-			}
-			return
-		}
+	if request.URL.Path == "/info" && (request.Method == "GET" || request.Method == "HEAD" || request.Method == "OPTIONS") {
+		m.serveInfo(writer, request)
+		return
 	}
 
+	clientTimestamp := request.Header.Get("X-Timestamp")
 	for k := range request.Header {
 		for _, ex := range excludeHeaders {
 			if strings.HasPrefix(k, ex) || k == "X-Timestamp" {
@@ -314,40 +377,43 @@ func (m *ProxyContextMiddleware) ServeHTTP(writer http.ResponseWriter, request *
 			}
 		}
 	}
+	// Trailers declared here are passed on to the object servers, so
+	// clients can't set sysmeta with them either.
+	for k := range request.Trailer {
+		for _, ex := range excludeHeaders {
+			if strings.HasPrefix(k, ex) {
+				delete(request.Trailer, k)
+			}
+		}
+	}
 
 	transId := common.GetTransactionId()
 	request.Header.Set("X-Trans-Id", transId)
 	writer.Header().Set("X-Trans-Id", transId)
 	writer.Header().Set("X-Openstack-Request-Id", transId)
+	// A client's own trace ID ties together several of its requests;
+	// otherwise the trace is just this request's.
+	traceId := request.Header.Get(tracing.TraceIdHeader)
+	if !tracing.ValidTraceId(traceId) {
+		traceId = transId
+	}
+	request.Header.Set(tracing.TraceIdHeader, traceId)
+	writer.Header().Set(tracing.TraceIdHeader, traceId)
 	request.Header.Set("X-Timestamp", common.GetTimestamp())
-	logr := m.log.With(zap.String("txn", transId))
+	logr := m.log.With(zap.String("txn", transId), zap.String("traceId", traceId))
 	pc := &ProxyContext{
 		ProxyContextMiddleware: m,
 		Authorize:              nil,
 		Logger:                 logr,
 		TxId:                   transId,
+		TraceId:                traceId,
 		status:                 500,
+		clientTimestamp:        clientTimestamp,
 		accountInfoCache:       make(map[string]*AccountInfo),
+		accountInfoLock:        &sync.Mutex{},
 		C:                      m.proxyClientFactory.NewRequestClient(m.Cache, make(map[string]*client.ContainerInfo), logr),
 	}
-	// we'll almost certainly need the AccountInfo and ContainerInfo for the current path, so pre-fetch them in parallel.
-	apiRequest, account, container, _ := getPathParts(request)
-	if apiRequest && account != "" {
-		wg := &sync.WaitGroup{}
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			pc.GetAccountInfo(request.Context(), account)
-		}()
-		if container != "" {
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				pc.C.GetContainerInfo(request.Context(), account, container)
-			}()
-		}
-		wg.Wait()
-	}
+	pc.pathChanged(request)
 	newWriter := srv.NewCustomWriter(writer, func(w http.ResponseWriter, status int) int {
 		// strip out any bad headers before calling real WriteHeader
 		for k := range w.Header() {
@@ -361,8 +427,8 @@ func (m *ProxyContextMiddleware) ServeHTTP(writer http.ResponseWriter, request *
 			}
 		}
 		if status == http.StatusUnauthorized && w.Header().Get("Www-Authenticate") == "" {
-			if account != "" {
-				w.Header().Set("Www-Authenticate", fmt.Sprintf("Swift realm=\"%s\"", common.Urlencode(account)))
+			if pc.realmAccount != "" {
+				w.Header().Set("Www-Authenticate", fmt.Sprintf("Swift realm=\"%s\"", common.Urlencode(pc.realmAccount)))
 			} else {
 				w.Header().Set("Www-Authenticate", "Swift realm=\"unknown\"")
 			}
@@ -377,11 +443,15 @@ func (m *ProxyContextMiddleware) ServeHTTP(writer http.ResponseWriter, request *
 		pc.status = status
 		return status
 	})
-	request = request.WithContext(context.WithValue(request.Context(), "proxycontext", pc))
+	ctx := tracing.ContextWithTraceId(request.Context(), traceId, m.timelines)
+	if m.clientTimeout > 0 {
+		ctx = common.WithClientDeadline(ctx, time.Now().Add(m.clientTimeout))
+	}
+	request = request.WithContext(context.WithValue(ctx, "proxycontext", pc))
 	m.next.ServeHTTP(newWriter, request)
 }
 
-func NewContext(debugResponses bool, mc ring.MemcacheRing, log srv.LowLevelLogger, proxyClientFactory client.ProxyClient) func(http.Handler) http.Handler {
+func NewContext(debugResponses bool, mc ring.MemcacheRing, log srv.LowLevelLogger, proxyClientFactory client.ProxyClient, timelines *tracing.Timelines, constraints *common.Constraints, info InfoConfig, clientTimeout time.Duration) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return &ProxyContextMiddleware{
 			Cache:              mc,
@@ -389,6 +459,10 @@ func NewContext(debugResponses bool, mc ring.MemcacheRing, log srv.LowLevelLogge
 			next:               next,
 			proxyClientFactory: proxyClientFactory,
 			debugResponses:     debugResponses,
+			timelines:          timelines,
+			constraints:        constraints,
+			info:               info,
+			clientTimeout:      clientTimeout,
 		}
 	}
 }
@@ -51,24 +51,31 @@ type copyMiddleware struct {
 	next http.Handler
 }
 
-func (cw *CopyWriter) getSrcAccountName(request *http.Request) string {
+func (cw *CopyWriter) getSrcAccountName(request *http.Request) (string, error) {
 	copyFromAccount := request.Header.Get("X-Copy-From-Account")
+	if copyFromAccount == "" {
+		return cw.accountName, nil
+	}
 	name, err := common.CheckNameFormat(request, copyFromAccount, "Account")
-	if err == nil {
-		return name
+	if err != nil {
+		return "", fmt.Errorf("Invalid X-Copy-From-Account: %s", err)
 	}
-	return cw.accountName
+	return name, nil
 }
 
-func (cw *CopyWriter) getDestAccountName(request *http.Request) string {
+func (cw *CopyWriter) getDestAccountName(request *http.Request) (string, error) {
 	destAccount := request.Header.Get("Destination-Account")
+	if destAccount == "" {
+		return cw.accountName, nil
+	}
 	name, err := common.CheckNameFormat(request, destAccount, "Account")
-	if err == nil {
-		request.Header.Set("X-Copy-From-Account", cw.accountName)
-		cw.accountName = name
-		request.Header.Del("Destination-Account")
+	if err != nil {
+		return "", fmt.Errorf("Invalid Destination-Account: %s", err)
 	}
-	return cw.accountName
+	request.Header.Set("X-Copy-From-Account", cw.accountName)
+	cw.accountName = name
+	request.Header.Del("Destination-Account")
+	return cw.accountName, nil
 }
 
 func getHeaderContainerObjectName(request *http.Request, header string) (string, string, error) {
@@ -84,7 +91,7 @@ func getHeaderContainerObjectName(request *http.Request, header string) (string,
 	if len(parts) != 3 {
 		return "", "", fmt.Errorf("Invalid %s", header)
 	}
-	name, name_err := common.CheckNameFormat(request, parts[1], "Account")
+	name, name_err := common.CheckNameFormat(request, parts[1], "Container")
 	if name_err != nil {
 		return "", "", fmt.Errorf("Invalid %s: %s", header, name_err)
 	}
@@ -120,7 +127,11 @@ func (c *copyMiddleware) handleCopy(writer *CopyWriter, request *http.Request) {
 		srv.StandardResponse(writer, 412)
 		return
 	}
-	destAccount := writer.getDestAccountName(request)
+	destAccount, err := writer.getDestAccountName(request)
+	if err != nil {
+		srv.SimpleErrorResponse(writer, 412, err.Error())
+		return
+	}
 	destContainer, destObject, err := getHeaderContainerObjectName(request, "Destination")
 	if err != nil {
 		srv.StandardResponse(writer, 412)
@@ -203,7 +214,11 @@ func (c *copyMiddleware) handlePut(writer *CopyWriter, request *http.Request) {
 		return
 	}
 
-	srcAccountName := writer.getSrcAccountName(request)
+	srcAccountName, err := writer.getSrcAccountName(request)
+	if err != nil {
+		srv.SimpleErrorResponse(writer, 412, err.Error())
+		return
+	}
 	srcContainer, srcObject, err := getHeaderContainerObjectName(request, "X-Copy-From")
 	if err != nil {
 		srv.StandardResponse(writer, 412)
@@ -274,6 +289,10 @@ func (c *copyMiddleware) handlePut(writer *CopyWriter, request *http.Request) {
 			values.Del("multipart-manifest")
 			request.Header.Set("X-Object-Manifest", srcHeader.Get("X-Object-Manifest"))
 		}
+	} else {
+		// The source was read through its manifest, so the copy is a plain
+		// object and the manifest's etag and size don't describe it.
+		RemoveItemsWithPrefix(request.Header, "X-Object-Sysmeta-Slo-")
 	}
 
 	request.URL.RawQuery = values.Encode()
@@ -300,6 +319,7 @@ func (c *copyMiddleware) handlePut(writer *CopyWriter, request *http.Request) {
 
 	request.Header.Del("X-Copy-From")
 	request.Header.Del("X-Copy-From-Account")
+	request.Header.Del("X-Fresh-Metadata")
 
 	// If the copy request does not explicitly override content-type,
 	// use the one present in the source object.
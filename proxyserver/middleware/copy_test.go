@@ -2,6 +2,7 @@ package middleware
 
 import (
 	"context"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -278,3 +279,114 @@ func TestPostAsCopy(t *testing.T) {
 	require.Equal(t, 202, rr.Code)
 	require.Equal(t, "stuff", rr.Body.String())
 }
+
+func serveCopy(t *testing.T, req *http.Request, funcs ...testHandlerFunc) *httptest.ResponseRecorder {
+	c, err := NewCopyMiddleware(conf.Section{}, common.NewTestScope())
+	require.Nil(t, err)
+	handler := c(NewPassthroughFunc(t, funcs...))
+	req = req.WithContext(context.WithValue(req.Context(), "proxycontext", NewFakeProxyContext(handler)))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestPutFreshMetadata(t *testing.T) {
+	get := func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Object-Meta-Color", "blue")
+		w.Header().Set("X-Object-Sysmeta-Foo", "SourceObjectSysmetaFoo")
+		w.Header().Set("Etag", "SourceObjectEtag")
+		w.Header().Set("Content-Type", "SourceObjectContentType")
+		w.WriteHeader(200)
+		w.Write([]byte("stuff"))
+	}
+	put := func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "", r.Header.Get("X-Object-Meta-Color"))
+		require.Equal(t, "large", r.Header.Get("X-Object-Meta-Size"))
+		require.Equal(t, "SourceObjectSysmetaFoo", r.Header.Get("X-Object-Sysmeta-Foo"))
+		require.Equal(t, "SourceObjectContentType", r.Header.Get("Content-Type"))
+		require.Equal(t, "", r.Header.Get("X-Fresh-Metadata"))
+		body, err := ioutil.ReadAll(r.Body)
+		require.Nil(t, err)
+		require.Equal(t, "stuff", string(body))
+		w.WriteHeader(201)
+	}
+	req, _ := http.NewRequest("PUT", "/v1/a/c/o2", nil)
+	req.Header.Set("X-Copy-From", "c/o")
+	req.Header.Set("X-Fresh-Metadata", "true")
+	req.Header.Set("X-Object-Meta-Size", "large")
+	rr := serveCopy(t, req, get, put)
+	require.Equal(t, 201, rr.Code)
+	require.Equal(t, "large", rr.Header().Get("X-Object-Meta-Size"))
+	require.Equal(t, "", rr.Header().Get("X-Object-Meta-Color"))
+}
+
+func TestPutCopyFromAccount(t *testing.T) {
+	get := func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1/a2/c/o", r.URL.Path)
+		w.WriteHeader(200)
+		w.Write([]byte("stuff"))
+	}
+	put := func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1/a/c/o2", r.URL.Path)
+		require.Equal(t, "", r.Header.Get("X-Copy-From-Account"))
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(201)
+	}
+	req, _ := http.NewRequest("PUT", "/v1/a/c/o2", nil)
+	req.Header.Set("X-Copy-From", "c/o")
+	req.Header.Set("X-Copy-From-Account", "a2")
+	rr := serveCopy(t, req, get, put)
+	require.Equal(t, 201, rr.Code)
+	require.Equal(t, "a2", rr.Header().Get("X-Copied-From-Account"))
+
+	req, _ = http.NewRequest("PUT", "/v1/a/c/o2", nil)
+	req.Header.Set("X-Copy-From", "c/o")
+	req.Header.Set("X-Copy-From-Account", "a/b")
+	require.Equal(t, 412, serveCopy(t, req).Code)
+
+	req, _ = http.NewRequest("COPY", "/v1/a/c/o", nil)
+	req.Header.Set("Destination", "c/o2")
+	req.Header.Set("Destination-Account", "a/b")
+	require.Equal(t, 412, serveCopy(t, req).Code)
+}
+
+func TestPutSloCopy(t *testing.T) {
+	sloGet := func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Static-Large-Object", "True")
+		w.Header().Set("X-Object-Sysmeta-Slo-Etag", "manifestetag")
+		w.Header().Set("X-Object-Sysmeta-Slo-Size", "5")
+		w.Header().Set("Etag", "\"manifestetag\"")
+		w.WriteHeader(200)
+		w.Write([]byte("stuff"))
+	}
+
+	// Copying the content makes a plain object.
+	put := func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "", r.URL.Query().Get("multipart-manifest"))
+		require.Equal(t, "", r.Header.Get("X-Static-Large-Object"))
+		require.Equal(t, "", r.Header.Get("X-Object-Sysmeta-Slo-Etag"))
+		require.Equal(t, "", r.Header.Get("X-Object-Sysmeta-Slo-Size"))
+		require.Equal(t, "", r.Header.Get("Etag"))
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(201)
+	}
+	req, _ := http.NewRequest("PUT", "/v1/a/c/o2", nil)
+	req.Header.Set("X-Copy-From", "c/o")
+	require.Equal(t, 201, serveCopy(t, req, sloGet, put).Code)
+
+	// Copying the manifest makes another manifest.
+	get := func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "get", r.URL.Query().Get("multipart-manifest"))
+		require.Equal(t, "raw", r.URL.Query().Get("format"))
+		sloGet(t, w, r)
+	}
+	put = func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "put", r.URL.Query().Get("multipart-manifest"))
+		require.Equal(t, "", r.Header.Get("Etag"))
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(201)
+	}
+	req, _ = http.NewRequest("PUT", "/v1/a/c/o2?multipart-manifest=get", nil)
+	req.Header.Set("X-Copy-From", "c/o")
+	require.Equal(t, 201, serveCopy(t, req, get, put).Code)
+}
@@ -26,17 +26,55 @@ import (
 	"github.com/uber-go/tally"
 )
 
+// CorsConfig is the cluster's CORS settings, from [filter:cors].
+type CorsConfig struct {
+	// Strict only gives actual requests CORS headers when the container
+	// allows their origin. Otherwise any origin gets them, leaving it to the
+	// preflight to keep others out.
+	Strict bool
+	// AllowOrigins are allowed for every container, along with the
+	// container's own Access-Control-Allow-Origin.
+	AllowOrigins []string
+	// ExposeHeaders are exposed for every container, along with the
+	// container's own Access-Control-Expose-Headers.
+	ExposeHeaders []string
+}
+
+func NewCorsConfig(config conf.Section) CorsConfig {
+	return CorsConfig{
+		Strict:        config.GetBool("strict_cors_mode", true),
+		AllowOrigins:  strings.Fields(strings.Replace(config.GetDefault("cors_allow_origin", ""), ",", " ", -1)),
+		ExposeHeaders: strings.Fields(strings.Replace(config.GetDefault("cors_expose_headers", ""), ",", " ", -1)),
+	}
+}
+
+// OriginAllowed reports whether the container, with its
+// Access-Control-Allow-Origin, or the cluster allows requests from origin.
+func (cc CorsConfig) OriginAllowed(containerOrigins, origin string) bool {
+	if common.IsOriginAllowed(containerOrigins, origin) {
+		return true
+	}
+	for _, o := range cc.AllowOrigins {
+		if o == origin {
+			return true
+		}
+	}
+	return false
+}
+
 type corsMiddleware struct {
-	next http.Handler
+	next   http.Handler
+	config CorsConfig
 }
 
 type cors struct {
 	origin string
 	ci     *client.ContainerInfo
+	config CorsConfig
 }
 
 func (c *cors) HandleCors(writer http.ResponseWriter, status int) int {
-	if c.origin == "" || !common.IsOriginAllowed(c.ci.Metadata["Access-Control-Allow-Origin"], c.origin) {
+	if c.origin == "" || (c.config.Strict && !c.config.OriginAllowed(c.ci.Metadata["Access-Control-Allow-Origin"], c.origin)) {
 		return status
 	}
 	if writer.Header().Get("Access-Control-Expose-Headers") == "" {
@@ -56,6 +94,7 @@ func (c *cors) HandleCors(writer http.ResponseWriter, status int) int {
 				corsExposeHeaders = append(corsExposeHeaders, h)
 			}
 		}
+		corsExposeHeaders = append(corsExposeHeaders, c.config.ExposeHeaders...)
 		writer.Header().Set(
 			"Access-Control-Expose-Headers", strings.ToLower(strings.Join(corsExposeHeaders, ", ")))
 	}
@@ -64,6 +103,7 @@ func (c *cors) HandleCors(writer http.ResponseWriter, status int) int {
 			writer.Header().Set("Access-Control-Allow-Origin", "*")
 		} else {
 			writer.Header().Set("Access-Control-Allow-Origin", c.origin)
+			writer.Header().Add("Vary", "Origin")
 		}
 	}
 	return status
@@ -82,7 +122,7 @@ func (cm *corsMiddleware) ServeHTTP(writer http.ResponseWriter, request *http.Re
 		return
 	}
 	if ci, err := ctx.C.GetContainerInfo(request.Context(), pathParts["account"], pathParts["container"]); err == nil {
-		cHandler := &cors{origin: origin, ci: ci}
+		cHandler := &cors{origin: origin, ci: ci, config: cm.config}
 		w := srv.NewCustomWriter(writer, cHandler.HandleCors)
 		cm.next.ServeHTTP(w, request)
 		return
@@ -91,9 +131,11 @@ func (cm *corsMiddleware) ServeHTTP(writer http.ResponseWriter, request *http.Re
 }
 
 func NewCors(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	corsConfig := NewCorsConfig(config)
 	return func(next http.Handler) http.Handler {
 		return &corsMiddleware{
-			next: next,
+			next:   next,
+			config: corsConfig,
 		}
 	}, nil
 }
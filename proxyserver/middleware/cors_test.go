@@ -22,6 +22,7 @@ import (
 
 	"github.com/stretchr/testify/require"
 	"github.com/troubling/hummingbird/client"
+	"github.com/troubling/hummingbird/common/conf"
 	"github.com/troubling/hummingbird/common/test"
 )
 
@@ -30,6 +31,7 @@ func TestHandleCorsStar(t *testing.T) {
 	fakeWriter := test.MockResponseWriter{SaveHeader: &theHeader}
 
 	c := &cors{
+		config: CorsConfig{Strict: true},
 		ci: &client.ContainerInfo{Metadata: map[string]string{
 			"Access-Control-Allow-Origin": "*"}}}
 
@@ -49,6 +51,7 @@ func TestHandleCorsSpec(t *testing.T) {
 
 	c := &cors{
 		origin: "hey.com",
+		config: CorsConfig{Strict: true},
 		ci: &client.ContainerInfo{Metadata: map[string]string{
 			"Access-Control-Allow-Origin":   "there.com",
 			"Access-Control-Expose-Headers": "a b"}}}
@@ -63,3 +66,45 @@ func TestHandleCorsSpec(t *testing.T) {
 	require.True(t, strings.Index(theHeader.Get("Access-Control-Expose-Headers"), "a, b") >= 0)
 	require.Equal(t, status, 200)
 }
+
+func TestHandleCorsPermissive(t *testing.T) {
+	theHeader := make(http.Header, 1)
+	fakeWriter := test.MockResponseWriter{SaveHeader: &theHeader}
+
+	c := &cors{
+		origin: "hey.com",
+		config: CorsConfig{Strict: true, AllowOrigins: []string{"cluster.com"}, ExposeHeaders: []string{"X-Foo"}},
+		ci: &client.ContainerInfo{Metadata: map[string]string{
+			"Access-Control-Allow-Origin": "there.com"}}}
+
+	c.HandleCors(fakeWriter, 200)
+	require.Equal(t, "", theHeader.Get("Access-Control-Allow-Origin"))
+
+	// The cluster's origins are allowed for every container.
+	c.origin = "cluster.com"
+	c.HandleCors(fakeWriter, 200)
+	require.Equal(t, "cluster.com", theHeader.Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "Origin", theHeader.Get("Vary"))
+	require.True(t, strings.Index(theHeader.Get("Access-Control-Expose-Headers"), "x-foo") >= 0)
+
+	// Outside strict mode, any origin gets the headers.
+	theHeader = make(http.Header, 1)
+	fakeWriter = test.MockResponseWriter{SaveHeader: &theHeader}
+	c.config.Strict = false
+	c.origin = "hey.com"
+	c.HandleCors(fakeWriter, 200)
+	require.Equal(t, "hey.com", theHeader.Get("Access-Control-Allow-Origin"))
+}
+
+func TestNewCorsConfig(t *testing.T) {
+	cc := NewCorsConfig(conf.Section{})
+	require.True(t, cc.Strict)
+	require.False(t, cc.OriginAllowed("there.com", "hey.com"))
+
+	config, err := conf.StringConfig("[filter:cors]\nstrict_cors_mode = false\ncors_allow_origin = https://a.com, https://b.com\n")
+	require.Nil(t, err)
+	cc = NewCorsConfig(config.GetSection("filter:cors"))
+	require.False(t, cc.Strict)
+	require.True(t, cc.OriginAllowed("", "https://b.com"))
+	require.False(t, cc.OriginAllowed("", "https://c.com"))
+}
@@ -0,0 +1,134 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/uber-go/tally"
+)
+
+// requestDomain returns the request's host without any port, lowercased.
+func requestDomain(request *http.Request) string {
+	host := request.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// storageDomainOf returns which of the storage domains the domain is a
+// subdomain of, if any.
+func storageDomainOf(domain string, storageDomains []string) string {
+	for _, sd := range storageDomains {
+		if strings.HasSuffix(domain, "."+sd) {
+			return sd
+		}
+	}
+	return ""
+}
+
+func loadStorageDomains(config conf.Section) []string {
+	var domains []string
+	for _, d := range common.SliceFromCSV(config.GetDefault("storage_domain", "example.com")) {
+		if d = strings.ToLower(strings.Trim(d, ".")); d != "" {
+			domains = append(domains, d)
+		}
+	}
+	return domains
+}
+
+type domainRemap struct {
+	next                  http.Handler
+	storageDomains        []string
+	pathRoot              string
+	resellerPrefixes      []string
+	defaultResellerPrefix string
+	requestsMetric        tally.Counter
+}
+
+// remapAccount turns the account part of a domain back into an account name,
+// which can't have had an underscore in DNS, or returns "" if it doesn't have
+// one of the known reseller prefixes.
+func (d *domainRemap) remapAccount(account string) string {
+	if !strings.Contains(account, "_") && strings.Contains(account, "-") {
+		account = strings.Replace(account, "-", "_", 1)
+	}
+	prefix := strings.SplitN(account, "_", 2)[0]
+	for _, p := range d.resellerPrefixes {
+		if strings.EqualFold(prefix, p) {
+			return p + account[len(prefix):]
+		}
+	}
+	if d.defaultResellerPrefix != "" {
+		return d.defaultResellerPrefix + "_" + account
+	}
+	return ""
+}
+
+func (d *domainRemap) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	domain := requestDomain(request)
+	sd := storageDomainOf(domain, d.storageDomains)
+	if sd == "" {
+		d.next.ServeHTTP(writer, request)
+		return
+	}
+	parts := strings.SplitN(strings.TrimSuffix(domain, "."+sd), ".", 2)
+	container, account := "", parts[0]
+	if len(parts) == 2 {
+		container, account = parts[0], parts[1]
+	}
+	if account = d.remapAccount(account); account == "" {
+		srv.SimpleErrorResponse(writer, http.StatusBadRequest, "Bad domain in host header")
+		return
+	}
+	d.requestsMetric.Inc(1)
+	path := "/" + d.pathRoot + "/" + account
+	if container != "" {
+		path += "/" + container
+	}
+	if request.URL.Path != "/" && request.URL.Path != "" {
+		path += "/" + strings.TrimPrefix(request.URL.Path, "/")
+	}
+	request.URL.Path = path
+	request.URL.RawPath = ""
+	// The context middleware only saw the path as it arrived.
+	if ctx := GetProxyContext(request); ctx != nil {
+		ctx.pathChanged(request)
+	}
+	d.next.ServeHTTP(writer, request)
+}
+
+// NewDomainRemap serves requests to <container>.<account>.<storage domain>
+// and <account>.<storage domain> as requests to the /v1 paths of that
+// container or account.
+//
+//	enabled                  default false
+//	storage_domain           comma separated domains to remap; default example.com
+//	path_root                default v1
+//	reseller_prefixes        comma separated; default AUTH
+//	default_reseller_prefix  prefix for accounts given without a known one; default none
+func NewDomainRemap(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	if !config.GetBool("enabled", false) {
+		return func(next http.Handler) http.Handler { return next }, nil
+	}
+	storageDomains := loadStorageDomains(config)
+	pathRoot := strings.Trim(config.GetDefault("path_root", "v1"), "/")
+	resellerPrefixes := common.SliceFromCSV(config.GetDefault("reseller_prefixes", "AUTH"))
+	defaultResellerPrefix := config.GetDefault("default_reseller_prefix", "")
+	RegisterInfo("domain_remap", map[string]interface{}{"default_reseller_prefix": defaultResellerPrefix})
+	requestsMetric := metricsScope.Counter("domain_remap_requests")
+	return func(next http.Handler) http.Handler {
+		return &domainRemap{
+			next:                  next,
+			storageDomains:        storageDomains,
+			pathRoot:              pathRoot,
+			resellerPrefixes:      resellerPrefixes,
+			defaultResellerPrefix: defaultResellerPrefix,
+			requestsMetric:        requestsMetric,
+		}
+	}, nil
+}
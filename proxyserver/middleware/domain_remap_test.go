@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/client"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/common/test"
+	"go.uber.org/zap"
+)
+
+func serveDomainRemap(t *testing.T, configString, host, path string) (int, string) {
+	config, err := conf.StringConfig(configString)
+	require.Nil(t, err)
+	mid, err := NewDomainRemap(config.GetSection("filter:domain_remap"), common.NewTestScope())
+	require.Nil(t, err)
+	seen := ""
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.URL.Path
+		w.WriteHeader(200)
+	})
+	req := httptest.NewRequest("GET", path, nil)
+	req.Host = host
+	w := httptest.NewRecorder()
+	mid(next).ServeHTTP(w, req)
+	return w.Code, seen
+}
+
+func TestDomainRemap(t *testing.T) {
+	config := "[filter:domain_remap]\nenabled = true\nstorage_domain = example.com, storage.test\n"
+	for _, tc := range []struct{ host, path, expected string }{
+		{"c.AUTH_a.example.com", "/o", "/v1/AUTH_a/c/o"},
+		{"c.auth-a.example.com:8080", "/dir/o", "/v1/AUTH_a/c/dir/o"},
+		{"AUTH_a.storage.test", "/", "/v1/AUTH_a"},
+		{"AUTH_a.example.com", "/c/o", "/v1/AUTH_a/c/o"},
+		// Other domains are left alone.
+		{"example.com", "/v1/AUTH_a/c/o", "/v1/AUTH_a/c/o"},
+		{"127.0.0.1:8080", "/v1/AUTH_a/c/o", "/v1/AUTH_a/c/o"},
+		{"c.AUTH_a.other.com", "/o", "/o"},
+	} {
+		code, path := serveDomainRemap(t, config, tc.host, tc.path)
+		require.Equal(t, 200, code, tc.host)
+		require.Equal(t, tc.expected, path, tc.host)
+	}
+
+	code, _ := serveDomainRemap(t, config, "c.nope_a.example.com", "/o")
+	require.Equal(t, 400, code)
+
+	code, path := serveDomainRemap(t, config+"default_reseller_prefix = AUTH\n", "c.a.example.com", "/o")
+	require.Equal(t, 200, code)
+	require.Equal(t, "/v1/AUTH_a/c/o", path)
+
+	// Nothing is remapped unless enabled.
+	code, path = serveDomainRemap(t, "[filter:domain_remap]\n", "c.AUTH_a.example.com", "/o")
+	require.Equal(t, 200, code)
+	require.Equal(t, "/o", path)
+}
+
+func TestDomainRemapBehindContext(t *testing.T) {
+	config, err := conf.StringConfig("[filter:domain_remap]\nenabled = true\n")
+	require.Nil(t, err)
+	mid, err := NewDomainRemap(config.GetSection("filter:domain_remap"), common.NewTestScope())
+	require.Nil(t, err)
+	f, err := client.NewProxyClient(staticPolicyList, srv.NewTestConfigLoader(&test.FakeRing{}),
+		nil, "", "", "", "", "", conf.Config{})
+	require.Nil(t, err)
+	mc := &test.FakeMemcacheRing{MockGetStructured: map[string][]byte{"account/AUTH_a": []byte(`{"StatusCode": 204}`)}}
+	var realm string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		realm = GetProxyContext(r).realmAccount
+		w.WriteHeader(401)
+	})
+	handler := NewContext(false, mc, zap.NewNop(), f, nil, nil, InfoConfig{Expose: true}, 0)(mid(next))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = "AUTH_a.example.com"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	require.Equal(t, 401, w.Code)
+	require.Equal(t, "AUTH_a", realm)
+	require.Equal(t, `Swift realm="AUTH_a"`, w.Header().Get("Www-Authenticate"))
+}
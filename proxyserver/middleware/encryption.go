@@ -0,0 +1,462 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/crypt"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+)
+
+var errEncryptedEtagMismatch = errors.New("etag does not match the object contents")
+
+// encryptReader encrypts a PUT body as it's read, checking its etag and
+// filling in the encrypted etag trailers at the end.
+type encryptReader struct {
+	io.ReadCloser
+	stream        cipher.Stream
+	hash          hash.Hash
+	expected      []string
+	clientTrailer http.Header
+	trailer       http.Header
+	objectKey     []byte
+	containerKey  []byte
+	etag          string
+	mismatch      bool
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	r.stream.XORKeyStream(p[:n], p[:n])
+	if err == io.EOF && r.etag == "" {
+		etag := hex.EncodeToString(r.hash.Sum(nil))
+		for _, expected := range append(r.expected, common.ExpectedEtags(r.clientTrailer)...) {
+			if expected != etag {
+				r.mismatch = true
+				return n, errEncryptedEtagMismatch
+			}
+		}
+		encrypted, cerr := crypt.EncryptValue(r.objectKey, []byte(etag))
+		if cerr != nil {
+			return n, cerr
+		}
+		listed, cerr := crypt.EncryptValue(r.containerKey, []byte(etag))
+		if cerr != nil {
+			return n, cerr
+		}
+		r.trailer.Set(crypt.EtagHeader, encrypted)
+		r.trailer.Set(crypt.EtagMacHeader, crypt.EtagMac(r.objectKey, etag))
+		r.trailer.Set(crypt.OverrideEtagHeader, listed)
+		r.etag = etag
+	}
+	return n, err
+}
+
+// decryptWriter decrypts an object's headers, and its body if there is one,
+// on the way out.
+type decryptWriter struct {
+	http.ResponseWriter
+	request     *http.Request
+	key         []byte
+	stream      cipher.Stream
+	buf         []byte
+	wroteHeader bool
+	discard     bool
+	metric      tally.Counter
+}
+
+func (w *decryptWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if err := w.decryptHeaders(status); err != nil {
+		GetProxyContext(w.request).Logger.Error("Error decrypting object", zap.String("path", w.request.URL.Path), zap.Error(err))
+		for _, k := range []string{"Content-Length", "Content-Range", "Content-Type", "Etag"} {
+			w.Header().Del(k)
+		}
+		w.discard = true
+		srv.StandardResponse(w.ResponseWriter, http.StatusInternalServerError)
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *decryptWriter) decryptHeaders(status int) error {
+	h := w.Header()
+	bodyKey, iv, err := crypt.DecryptHeaders(w.key, h)
+	if err != nil || bodyKey == nil {
+		return err
+	}
+	w.metric.Inc(1)
+	if w.request.Method != "GET" || (status != http.StatusOK && status != http.StatusPartialContent) {
+		return nil
+	}
+	var offset int64
+	if status == http.StatusPartialContent {
+		// Multiple ranges are split up by multirange before they get here.
+		contentRange := strings.TrimPrefix(h.Get("Content-Range"), "bytes ")
+		if offset, err = strconv.ParseInt(strings.SplitN(contentRange, "-", 2)[0], 10, 64); err != nil {
+			return fmt.Errorf("can't decrypt range %q", h.Get("Content-Range"))
+		}
+	}
+	w.stream, err = crypt.CtrStream(bodyKey, iv, offset)
+	return err
+}
+
+func (w *decryptWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.discard {
+		return len(b), nil
+	}
+	if w.stream == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	if cap(w.buf) < len(b) {
+		w.buf = make([]byte, len(b))
+	}
+	buf := w.buf[:len(b)]
+	w.stream.XORKeyStream(buf, b)
+	return w.ResponseWriter.Write(buf)
+}
+
+type encryption struct {
+	next              http.Handler
+	keys              *crypt.Keymaster
+	disableEncryption bool
+	encryptedMetric   tally.Counter
+	decryptedMetric   tally.Counter
+}
+
+func (e *encryption) encryptPut(writer http.ResponseWriter, request *http.Request, account, container, obj string) {
+	objectKey := e.keys.ObjectKey(account, container, obj)
+	containerKey := e.keys.ContainerKey(account, container)
+	for _, k := range crypt.Headers {
+		request.Header.Del(k)
+	}
+	// The proxy would pick a content type later, but it needs encrypting too.
+	contentType := request.Header.Get("Content-Type")
+	if contentType == "" || common.LooksTrue(request.Header.Get("X-Detect-Content-Type")) {
+		contentType = strings.Split(mime.TypeByExtension(filepath.Ext(obj)), ";")[0]
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		request.Header.Del("X-Detect-Content-Type")
+	}
+	if strings.Contains(contentType, "\x00") {
+		srv.SimpleErrorResponse(writer, http.StatusBadRequest, "Invalid Content-Type")
+		return
+	}
+	bodyKey, err := crypt.RandomBytes(32)
+	if err != nil {
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	iv, err := crypt.RandomBytes(aes.BlockSize)
+	if err != nil {
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	stream, err := crypt.CtrStream(bodyKey, iv, 0)
+	if err != nil {
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	wrappedKey, err := crypt.EncryptValue(objectKey, bodyKey)
+	if err != nil {
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	meta, err := json.Marshal(crypt.BodyMeta{Cipher: crypt.Cipher, IV: hex.EncodeToString(iv), BodyKey: wrappedKey})
+	if err != nil {
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	encryptedType, err := crypt.EncryptValue(objectKey, []byte(contentType))
+	if err != nil {
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	// The container server reads a manifest's total size out of its listed
+	// content type, so that part is left in plaintext.
+	listedTypeSuffix := ""
+	plainType, sloSize, err := common.ParseContentTypeForSlo(contentType, -1)
+	if err == nil && sloSize >= 0 {
+		listedTypeSuffix = fmt.Sprintf(";swift_bytes=%d", sloSize)
+	} else {
+		plainType = contentType
+	}
+	listedType, err := crypt.EncryptValue(containerKey, []byte(plainType))
+	if err != nil {
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	listedType += listedTypeSuffix
+	request.Header.Set("Content-Type", encryptedType)
+	request.Header.Set(crypt.BodyMetaHeader, string(meta))
+	request.Header.Set(crypt.OverrideContentTypeHeader, listedType)
+	// The object servers only see ciphertext, so the client's etag is
+	// checked here instead.
+	expected := common.ExpectedEtags(request.Header)
+	request.Header.Del("Etag")
+	request.Header.Del("Content-Md5")
+	reader := &encryptReader{
+		ReadCloser:    request.Body,
+		stream:        stream,
+		hash:          md5.New(),
+		expected:      expected,
+		clientTrailer: request.Trailer,
+		trailer:       http.Header{crypt.EtagHeader: nil, crypt.EtagMacHeader: nil, crypt.OverrideEtagHeader: nil},
+		objectKey:     objectKey,
+		containerKey:  containerKey,
+	}
+	request.Body = reader
+	request.Trailer = reader.trailer
+	cw := NewCaptureWriter()
+	e.next.ServeHTTP(cw, request)
+	if reader.mismatch {
+		srv.StandardResponse(writer, http.StatusUnprocessableEntity)
+		return
+	}
+	e.encryptedMetric.Inc(1)
+	for k, v := range cw.header {
+		writer.Header()[k] = v
+	}
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if cw.status/100 == 2 && reader.etag != "" {
+		writer.Header().Set("Etag", reader.etag)
+	}
+	writer.WriteHeader(cw.status)
+	writer.Write(cw.body)
+}
+
+func (e *encryption) decryptObject(writer http.ResponseWriter, request *http.Request, account, container, obj string) {
+	key := e.keys.ObjectKey(account, container, obj)
+	for _, name := range []string{"If-Match", "If-None-Match"} {
+		v := request.Header.Get(name)
+		var macs []string
+		for etag := range common.ParseIfMatch(v) {
+			if etag != "*" {
+				macs = append(macs, "\""+crypt.EtagMac(key, etag)+"\"")
+			}
+		}
+		if len(macs) > 0 {
+			request.Header.Set(name, v+", "+strings.Join(macs, ", "))
+		}
+	}
+	// Ours goes first, so an etag only some objects have, like an SLO's,
+	// still wins on those.
+	etagIsAt := crypt.EtagMacHeader
+	if v := request.Header.Get("X-Backend-Etag-Is-At"); v != "" {
+		etagIsAt += "," + v
+	}
+	request.Header.Set("X-Backend-Etag-Is-At", etagIsAt)
+	e.next.ServeHTTP(&decryptWriter{ResponseWriter: writer, request: request, key: key, metric: e.decryptedMetric}, request)
+}
+
+// postObject lets a POST repeat an encrypted object's content type. Object
+// servers refuse a POST whose Content-Type differs from what's stored, and
+// the plain value never matches the encrypted one, so a matching value is
+// swapped for the stored one; anything else is left for the object servers
+// to refuse.
+func (e *encryption) postObject(writer http.ResponseWriter, request *http.Request, account, container, obj string) {
+	contentType := request.Header.Get("Content-Type")
+	if contentType == "" {
+		e.next.ServeHTTP(writer, request)
+		return
+	}
+	head, err := http.NewRequest("HEAD", request.URL.String(), nil)
+	if err != nil {
+		srv.StandardResponse(writer, http.StatusBadRequest)
+		return
+	}
+	head = head.WithContext(request.Context())
+	cw := NewCaptureWriter()
+	e.next.ServeHTTP(cw, head)
+	if stored := cw.header.Get("Content-Type"); cw.status/100 == 2 && strings.HasPrefix(stored, crypt.EncryptedValuePrefix) {
+		plain, err := crypt.DecryptValue(e.keys.ObjectKey(account, container, obj), stored)
+		if err == nil && string(plain) == contentType {
+			request.Header.Set("Content-Type", stored)
+		}
+	}
+	e.next.ServeHTTP(writer, request)
+}
+
+func decryptJSONListing(key, body []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var records []map[string]interface{}
+	if err := decoder.Decode(&records); err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		for _, field := range []string{"hash", "content_type"} {
+			if v, ok := record[field].(string); ok && strings.HasPrefix(v, crypt.EncryptedValuePrefix) {
+				plain, err := crypt.DecryptValue(key, v)
+				if err != nil {
+					return nil, err
+				}
+				record[field] = string(plain)
+			}
+		}
+	}
+	buf := &bytes.Buffer{}
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(records); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decryptXMLListing(key, body []byte) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	buf := &bytes.Buffer{}
+	encoder := xml.NewEncoder(buf)
+	field := ""
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			field = t.Name.Local
+		case xml.EndElement:
+			field = ""
+		case xml.CharData:
+			if (field == "hash" || field == "content_type") && strings.HasPrefix(string(t), crypt.EncryptedValuePrefix) {
+				plain, err := crypt.DecryptValue(key, string(t))
+				if err != nil {
+					return nil, err
+				}
+				token = xml.CharData(plain)
+			}
+		}
+		if err := encoder.EncodeToken(token); err != nil {
+			return nil, err
+		}
+	}
+	if err := encoder.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decryptListing decrypts the etags and content types of encrypted objects
+// in JSON and XML container listings; plain listings only have names.
+func (e *encryption) decryptListing(writer http.ResponseWriter, request *http.Request, account, container string) {
+	cw := NewCaptureWriter()
+	e.next.ServeHTTP(cw, request)
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	body := cw.body
+	if cw.status == http.StatusOK {
+		key := e.keys.ContainerKey(account, container)
+		var err error
+		contentType := cw.header.Get("Content-Type")
+		if strings.HasPrefix(contentType, "application/json") {
+			body, err = decryptJSONListing(key, body)
+		} else if strings.HasPrefix(contentType, "application/xml") || strings.HasPrefix(contentType, "text/xml") {
+			body, err = decryptXMLListing(key, body)
+		}
+		if err != nil {
+			GetProxyContext(request).Logger.Error("Error decrypting container listing", zap.String("path", request.URL.Path), zap.Error(err))
+			srv.StandardResponse(writer, http.StatusInternalServerError)
+			return
+		}
+		cw.header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	for k, v := range cw.header {
+		writer.Header()[k] = v
+	}
+	writer.WriteHeader(cw.status)
+	writer.Write(body)
+}
+
+func (e *encryption) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	apiReq, account, container, obj := getPathParts(request)
+	if !apiReq || container == "" {
+		e.next.ServeHTTP(writer, request)
+		return
+	}
+	if obj == "" {
+		if request.Method == "GET" {
+			e.decryptListing(writer, request, account, container)
+			return
+		}
+		e.next.ServeHTTP(writer, request)
+		return
+	}
+	switch request.Method {
+	case "PUT":
+		if !e.disableEncryption {
+			e.encryptPut(writer, request, account, container, obj)
+			return
+		}
+	case "POST":
+		e.postObject(writer, request, account, container, obj)
+		return
+	case "GET", "HEAD":
+		e.decryptObject(writer, request, account, container, obj)
+		return
+	}
+	e.next.ServeHTTP(writer, request)
+}
+
+// NewEncryption encrypts object bodies, etags and content types before they
+// reach the object servers, along with the etags and content types in
+// container listings, and decrypts them again on the way out. Keys are
+// derived per object and container from a root secret the keymaster loads.
+//
+//	enabled                 default false
+//	disable_encryption      only decrypt, for objects encrypted before; default false
+//	key_source              config, barbican or kmip; default config
+//	encryption_root_secret  base64 encoded, at least 32 bytes, for key_source config
+func NewEncryption(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	if !config.GetBool("enabled", false) {
+		return func(next http.Handler) http.Handler { return next }, nil
+	}
+	keys, err := crypt.NewKeymaster(config)
+	if err != nil {
+		return nil, err
+	}
+	disableEncryption := config.GetBool("disable_encryption", false)
+	encryptedMetric := metricsScope.Counter("encryption_encrypted_requests")
+	decryptedMetric := metricsScope.Counter("encryption_decrypted_requests")
+	return func(next http.Handler) http.Handler {
+		return &encryption{
+			next:              next,
+			keys:              keys,
+			disableEncryption: disableEncryption,
+			encryptedMetric:   encryptedMetric,
+			decryptedMetric:   decryptedMetric,
+		}
+	}, nil
+}
@@ -0,0 +1,351 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/crypt"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+)
+
+var testRootSecret = base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+
+type fakeStoredObject struct {
+	header http.Header
+	body   []byte
+}
+
+// fakeObjectStore stands in for the proxy and object servers behind the
+// encryption middleware, storing whatever it's sent.
+type fakeObjectStore struct {
+	objects map[string]*fakeStoredObject
+}
+
+func (f *fakeObjectStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, _, _, obj := getPathParts(r)
+	if obj == "" {
+		f.list(w, r)
+		return
+	}
+	switch r.Method {
+	case "PUT":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(503)
+			return
+		}
+		sum := md5.Sum(body)
+		header := http.Header{"Content-Type": {r.Header.Get("Content-Type")}, "Etag": {hex.EncodeToString(sum[:])}}
+		for _, h := range []http.Header{r.Header, r.Trailer} {
+			for k := range h {
+				if strings.HasPrefix(k, "X-Object-Sysmeta-") {
+					header.Set(k, h.Get(k))
+				}
+			}
+		}
+		f.objects[r.URL.Path] = &fakeStoredObject{header: header, body: body}
+		w.Header().Set("Etag", hex.EncodeToString(sum[:]))
+		w.WriteHeader(201)
+	case "GET", "HEAD":
+		o := f.objects[r.URL.Path]
+		if o == nil {
+			w.WriteHeader(404)
+			return
+		}
+		etag := o.header.Get("Etag")
+		for _, at := range strings.Split(r.Header.Get("X-Backend-Etag-Is-At"), ",") {
+			if v := o.header.Get(at); at != "" && v != "" {
+				etag = v
+			}
+		}
+		for k := range o.header {
+			w.Header().Set(k, o.header.Get(k))
+		}
+		w.Header().Set("Etag", "\""+etag+"\"")
+		if ifMatch := common.ParseIfMatch(r.Header.Get("If-Match")); len(ifMatch) > 0 && !ifMatch[etag] {
+			w.WriteHeader(412)
+			return
+		}
+		if common.ParseIfMatch(r.Header.Get("If-None-Match"))[etag] {
+			w.WriteHeader(304)
+			return
+		}
+		body, status := o.body, 200
+		if rng := r.Header.Get("Range"); rng != "" {
+			ranges, err := common.ParseRange(rng, int64(len(body)))
+			if err != nil || len(ranges) != 1 {
+				w.WriteHeader(416)
+				return
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", ranges[0].Start, ranges[0].End-1, len(body)))
+			body, status = body[ranges[0].Start:ranges[0].End], 206
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(status)
+		if r.Method == "GET" {
+			w.Write(body)
+		}
+	case "POST":
+		o := f.objects[r.URL.Path]
+		if o == nil {
+			w.WriteHeader(404)
+			return
+		}
+		if t := r.Header.Get("Content-Type"); t != "" && t != o.header.Get("Content-Type") {
+			w.WriteHeader(409)
+			return
+		}
+		for k := range r.Header {
+			if strings.HasPrefix(k, "X-Object-Meta-") {
+				o.header.Set(k, r.Header.Get(k))
+			}
+		}
+		w.WriteHeader(202)
+	}
+}
+
+func (f *fakeObjectStore) list(w http.ResponseWriter, r *http.Request) {
+	var records []map[string]interface{}
+	for path, o := range f.objects {
+		record := map[string]interface{}{"name": path[strings.LastIndex(path, "/")+1:], "bytes": len(o.body),
+			"hash": o.header.Get("Etag"), "content_type": o.header.Get("Content-Type")}
+		if v := o.header.Get(crypt.OverrideEtagHeader); v != "" {
+			record["hash"] = v
+		}
+		if v := o.header.Get(crypt.OverrideContentTypeHeader); v != "" {
+			record["content_type"] = v
+		}
+		// The container server takes a manifest's size out of its content type.
+		contentType, size, _ := common.ParseContentTypeForSlo(record["content_type"].(string), int64(len(o.body)))
+		record["content_type"], record["bytes"] = contentType, size
+		records = append(records, record)
+	}
+	if r.URL.Query().Get("format") == "xml" {
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.WriteHeader(200)
+		fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<container name=\"c\">")
+		for _, record := range records {
+			fmt.Fprintf(w, "<object><name>%s</name><hash>%s</hash><bytes>%d</bytes><content_type>%s</content_type></object>",
+				record["name"], record["hash"], record["bytes"], record["content_type"])
+		}
+		fmt.Fprintf(w, "</container>")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(records)
+}
+
+func newTestEncryption(t *testing.T, settings string) (http.Handler, *fakeObjectStore) {
+	config, err := conf.StringConfig("[filter:encryption]\nenabled = true\nencryption_root_secret = " + testRootSecret + "\n" + settings)
+	require.Nil(t, err)
+	mid, err := NewEncryption(config.GetSection("filter:encryption"), tally.NewTestScope("", nil))
+	require.Nil(t, err)
+	store := &fakeObjectStore{objects: map[string]*fakeStoredObject{}}
+	return mid(store), store
+}
+
+func serveEncryption(handler http.Handler, method, path string, body []byte, headers map[string]string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, bytes.NewBuffer(body))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	req = req.WithContext(context.WithValue(req.Context(), "proxycontext", &ProxyContext{Logger: zap.NewNop()}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	handler, store := newTestEncryption(t, "")
+	body := bytes.Repeat([]byte("some secret contents "), 10)
+	sum := md5.Sum(body)
+	etag := hex.EncodeToString(sum[:])
+	w := serveEncryption(handler, "PUT", "/v1/a/c/o", body, map[string]string{"Content-Type": "text/secret", "Etag": etag})
+	require.Equal(t, 201, w.Code)
+	require.Equal(t, etag, w.Header().Get("Etag"))
+
+	stored := store.objects["/v1/a/c/o"]
+	require.NotNil(t, stored)
+	require.Equal(t, len(body), len(stored.body))
+	require.NotEqual(t, body, stored.body)
+	require.True(t, strings.HasPrefix(stored.header.Get("Content-Type"), crypt.EncryptedValuePrefix))
+	require.NotEqual(t, etag, stored.header.Get("Etag"))
+	for _, h := range crypt.Headers {
+		require.NotEqual(t, "", stored.header.Get(h), h)
+		require.NotContains(t, stored.header.Get(h), etag, h)
+		require.NotContains(t, stored.header.Get(h), "text/secret", h)
+	}
+
+	w = serveEncryption(handler, "GET", "/v1/a/c/o", nil, nil)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, body, w.Body.Bytes())
+	require.Equal(t, "text/secret", w.Header().Get("Content-Type"))
+	require.Equal(t, "\""+etag+"\"", w.Header().Get("Etag"))
+	for _, h := range crypt.Headers {
+		require.Equal(t, "", w.Header().Get(h), h)
+	}
+
+	w = serveEncryption(handler, "HEAD", "/v1/a/c/o", nil, nil)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "text/secret", w.Header().Get("Content-Type"))
+	require.Equal(t, "\""+etag+"\"", w.Header().Get("Etag"))
+	require.Equal(t, 0, w.Body.Len())
+
+	w = serveEncryption(handler, "GET", "/v1/a/c/o", nil, map[string]string{"Range": "bytes=37-120"})
+	require.Equal(t, 206, w.Code)
+	require.Equal(t, body[37:121], w.Body.Bytes())
+
+	// Conditional requests work against the plaintext etag.
+	w = serveEncryption(handler, "GET", "/v1/a/c/o", nil, map[string]string{"If-None-Match": "\"" + etag + "\""})
+	require.Equal(t, 304, w.Code)
+	w = serveEncryption(handler, "GET", "/v1/a/c/o", nil, map[string]string{"If-Match": etag})
+	require.Equal(t, 200, w.Code)
+	w = serveEncryption(handler, "HEAD", "/v1/a/c/o", nil, map[string]string{"If-Match": "\"ffffffffffffffffffffffffffffffff\""})
+	require.Equal(t, 412, w.Code)
+
+	// The same object under another name gets different keys.
+	w = serveEncryption(handler, "PUT", "/v1/a/c/o2", body, map[string]string{"Content-Type": "text/secret"})
+	require.Equal(t, 201, w.Code)
+	require.Equal(t, etag, w.Header().Get("Etag"))
+	require.NotEqual(t, stored.body, store.objects["/v1/a/c/o2"].body)
+}
+
+func TestEncryptionPutEtagMismatch(t *testing.T) {
+	handler, store := newTestEncryption(t, "")
+	w := serveEncryption(handler, "PUT", "/v1/a/c/o", []byte("contents"), map[string]string{"Etag": "ffffffffffffffffffffffffffffffff"})
+	require.Equal(t, 422, w.Code)
+	require.Nil(t, store.objects["/v1/a/c/o"])
+
+	// No content type gets one from the name, which is encrypted too.
+	w = serveEncryption(handler, "PUT", "/v1/a/c/o.html", []byte("contents"), nil)
+	require.Equal(t, 201, w.Code)
+	w = serveEncryption(handler, "HEAD", "/v1/a/c/o.html", nil, nil)
+	require.Equal(t, "text/html", w.Header().Get("Content-Type"))
+}
+
+func TestEncryptionListing(t *testing.T) {
+	handler, store := newTestEncryption(t, "")
+	w := serveEncryption(handler, "PUT", "/v1/a/c/o", []byte("contents"), map[string]string{"Content-Type": "text/secret"})
+	require.Equal(t, 201, w.Code)
+	store.objects["/v1/a/c/plain"] = &fakeStoredObject{
+		header: http.Header{"Content-Type": {"text/plain"}, "Etag": {"ffffffffffffffffffffffffffffffff"}}, body: []byte("old")}
+	sum := md5.Sum([]byte("contents"))
+	etag := hex.EncodeToString(sum[:])
+
+	w = serveEncryption(handler, "GET", "/v1/a/c?format=json", nil, nil)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, strconv.Itoa(w.Body.Len()), w.Header().Get("Content-Length"))
+	var records []map[string]interface{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &records))
+	require.Equal(t, 2, len(records))
+	for _, record := range records {
+		if record["name"] == "o" {
+			require.Equal(t, etag, record["hash"])
+			require.Equal(t, "text/secret", record["content_type"])
+			require.Equal(t, float64(8), record["bytes"])
+		} else {
+			require.Equal(t, "ffffffffffffffffffffffffffffffff", record["hash"])
+			require.Equal(t, "text/plain", record["content_type"])
+		}
+	}
+
+	w = serveEncryption(handler, "GET", "/v1/a/c?format=xml", nil, nil)
+	require.Equal(t, 200, w.Code)
+	require.Contains(t, w.Body.String(), "<hash>"+etag+"</hash>")
+	require.Contains(t, w.Body.String(), "<content_type>text/secret</content_type>")
+	require.Contains(t, w.Body.String(), "<content_type>text/plain</content_type>")
+	require.NotContains(t, w.Body.String(), crypt.EncryptedValuePrefix)
+}
+
+func TestEncryptionListingManifestSize(t *testing.T) {
+	handler, store := newTestEncryption(t, "")
+	w := serveEncryption(handler, "PUT", "/v1/a/c/manifest", []byte("[]"), map[string]string{"Content-Type": "text/secret;swift_bytes=1000"})
+	require.Equal(t, 201, w.Code)
+	listed := store.objects["/v1/a/c/manifest"].header.Get(crypt.OverrideContentTypeHeader)
+	require.True(t, strings.HasPrefix(listed, crypt.EncryptedValuePrefix))
+	require.True(t, strings.HasSuffix(listed, ";swift_bytes=1000"))
+	require.NotContains(t, listed, "secret")
+
+	w = serveEncryption(handler, "GET", "/v1/a/c?format=json", nil, nil)
+	require.Equal(t, 200, w.Code)
+	var records []map[string]interface{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &records))
+	require.Equal(t, 1, len(records))
+	require.Equal(t, "text/secret", records[0]["content_type"])
+	require.Equal(t, float64(1000), records[0]["bytes"])
+
+	w = serveEncryption(handler, "HEAD", "/v1/a/c/manifest", nil, nil)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "text/secret;swift_bytes=1000", w.Header().Get("Content-Type"))
+}
+
+func TestEncryptionUnencryptedObjects(t *testing.T) {
+	handler, store := newTestEncryption(t, "disable_encryption = true")
+	w := serveEncryption(handler, "PUT", "/v1/a/c/o", []byte("contents"), map[string]string{"Content-Type": "text/plain"})
+	require.Equal(t, 201, w.Code)
+	require.Equal(t, []byte("contents"), store.objects["/v1/a/c/o"].body)
+	require.Equal(t, "text/plain", store.objects["/v1/a/c/o"].header.Get("Content-Type"))
+	w = serveEncryption(handler, "GET", "/v1/a/c/o", nil, nil)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "contents", w.Body.String())
+	require.Equal(t, "text/plain", w.Header().Get("Content-Type"))
+
+	// Objects encrypted before are still decrypted.
+	encrypting, encryptedStore := newTestEncryption(t, "")
+	w = serveEncryption(encrypting, "PUT", "/v1/a/c/encrypted", []byte("secret"), nil)
+	require.Equal(t, 201, w.Code)
+	store.objects["/v1/a/c/encrypted"] = encryptedStore.objects["/v1/a/c/encrypted"]
+	w = serveEncryption(handler, "GET", "/v1/a/c/encrypted", nil, nil)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "secret", w.Body.String())
+
+	// Another root secret can't read them.
+	otherSecret := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("x"), 32))
+	other, otherStore := newTestEncryption(t, "encryption_root_secret = "+otherSecret)
+	otherStore.objects["/v1/a/c/encrypted"] = encryptedStore.objects["/v1/a/c/encrypted"]
+	w = serveEncryption(other, "GET", "/v1/a/c/encrypted", nil, nil)
+	require.NotEqual(t, "secret", w.Body.String())
+}
+
+func TestEncryptionDisabled(t *testing.T) {
+	mid, err := NewEncryption(conf.Section{}, tally.NewTestScope("", nil))
+	require.Nil(t, err)
+	store := &fakeObjectStore{objects: map[string]*fakeStoredObject{}}
+	w := serveEncryption(mid(store), "PUT", "/v1/a/c/o", []byte("contents"), map[string]string{"Content-Type": "text/plain"})
+	require.Equal(t, 201, w.Code)
+	require.Equal(t, []byte("contents"), store.objects["/v1/a/c/o"].body)
+}
+
+func TestEncryptionPostContentType(t *testing.T) {
+	handler, store := newTestEncryption(t, "")
+	w := serveEncryption(handler, "PUT", "/v1/a/c/o", []byte("stuff"), map[string]string{"Content-Type": "text/plain"})
+	require.Equal(t, 201, w.Code)
+
+	w = serveEncryption(handler, "POST", "/v1/a/c/o", nil, map[string]string{"Content-Type": "text/html"})
+	require.Equal(t, 409, w.Code)
+	w = serveEncryption(handler, "POST", "/v1/a/c/o", nil, map[string]string{"Content-Type": "text/plain", "X-Object-Meta-Color": "blue"})
+	require.Equal(t, 202, w.Code)
+	require.Equal(t, "blue", store.objects["/v1/a/c/o"].header.Get("X-Object-Meta-Color"))
+	w = serveEncryption(handler, "POST", "/v1/a/c/o", nil, map[string]string{"X-Object-Meta-Color": "red"})
+	require.Equal(t, 202, w.Code)
+
+	w = serveEncryption(handler, "HEAD", "/v1/a/c/o", nil, nil)
+	require.Equal(t, "text/plain", w.Header().Get("Content-Type"))
+	require.Equal(t, "red", w.Header().Get("X-Object-Meta-Color"))
+}
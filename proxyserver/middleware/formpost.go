@@ -18,8 +18,6 @@ package middleware
 import (
 	"context"
 	"crypto/hmac"
-	"crypto/sha1"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"html"
@@ -66,37 +64,31 @@ func (o *fpLimitReader) Read(p []byte) (int, error) {
 	return i, err
 }
 
-func authenticateFormpost(ctx context.Context, proxyCtx *ProxyContext, account, container, path string, attrs map[string]string) int {
+func authenticateFormpost(ctx context.Context, proxyCtx *ProxyContext, account, container, path string, attrs map[string]string, allowedDigests map[string]bool) int {
 	if expires, err := common.ParseDate(attrs["expires"]); err != nil {
 		return FP_ERROR
 	} else if time.Now().After(expires) {
 		return FP_EXPIRED
 	}
 
-	sigb, err := hex.DecodeString(attrs["signature"])
+	digest, sigb, err := parseTempURLSig(attrs["signature"])
 	if err != nil || len(sigb) == 0 {
 		return FP_ERROR
 	}
+	if !allowedDigests[digest] {
+		return FP_INVALID
+	}
 
-	checkhmac := func(key []byte) bool {
-		mac := hmac.New(sha1.New, key)
+	switch tempURLKeyScope(ctx, proxyCtx, account, container, func(key []byte) bool {
+		mac := hmac.New(tempURLDigests[digest], key)
 		fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", path, attrs["redirect"],
 			attrs["max_file_size"], attrs["max_file_count"], attrs["expires"])
 		return hmac.Equal(sigb, mac.Sum(nil))
-	}
-
-	if ai, err := proxyCtx.GetAccountInfo(ctx, account); err == nil {
-		if key, ok := ai.Metadata["Temp-Url-Key"]; ok && checkhmac([]byte(key)) {
-			return FP_SCOPE_ACCOUNT
-		} else if key, ok := ai.Metadata["Temp-Url-Key-2"]; ok && checkhmac([]byte(key)) {
-			return FP_SCOPE_ACCOUNT
-		} else if ci, err := proxyCtx.C.GetContainerInfo(ctx, account, container); err == nil {
-			if key, ok := ci.Metadata["Temp-Url-Key"]; ok && checkhmac([]byte(key)) {
-				return FP_SCOPE_CONTAINER
-			} else if key, ok := ci.Metadata["Temp-Url-Key-2"]; ok && checkhmac([]byte(key)) {
-				return FP_SCOPE_CONTAINER
-			}
-		}
+	}) {
+	case SCOPE_ACCOUNT:
+		return FP_SCOPE_ACCOUNT
+	case SCOPE_CONTAINER:
+		return FP_SCOPE_CONTAINER
 	}
 	return FP_INVALID
 }
@@ -139,7 +131,7 @@ func formpostAuthorizer(scope int, account, container string) func(r *http.Reque
 	}
 }
 
-func formpost(formpostRequestsMetric tally.Counter) func(http.Handler) http.Handler {
+func formpost(formpostRequestsMetric tally.Counter, allowedDigests map[string]bool) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 			if request.Method != "POST" {
@@ -164,6 +156,7 @@ func formpost(formpostRequestsMetric tally.Counter) func(http.Handler) http.Hand
 				next.ServeHTTP(writer, request)
 				return
 			}
+			formpostRequestsMetric.Inc(1)
 
 			validated := false
 			attrs := map[string]string{
@@ -203,7 +196,7 @@ func formpost(formpostRequestsMetric tally.Counter) func(http.Handler) http.Hand
 							formpostRespond(writer, 400, "max_file_size not valid", attrs["redirect"])
 							return
 						}
-						scope := authenticateFormpost(request.Context(), ctx, account, container, request.URL.Path, attrs)
+						scope := authenticateFormpost(request.Context(), ctx, account, container, request.URL.Path, attrs, allowedDigests)
 						switch scope {
 						case FP_EXPIRED:
 							formpostRespond(writer, 401, "Form Expired", attrs["redirect"])
@@ -265,6 +258,10 @@ func formpost(formpostRequestsMetric tally.Counter) func(http.Handler) http.Hand
 }
 
 func NewFormPost(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
-	RegisterInfo("formpost", map[string]interface{}{})
-	return formpost(metricsScope.Counter("formpost_requests")), nil
+	allowedDigests, digestNames, err := loadAllowedDigests(config)
+	if err != nil {
+		return nil, err
+	}
+	RegisterInfo("formpost", map[string]interface{}{"allowed_digests": digestNames})
+	return formpost(metricsScope.Counter("formpost_requests"), allowedDigests), nil
 }
@@ -20,8 +20,11 @@ import (
 	"context"
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"mime/multipart"
 	"net/http"
@@ -62,13 +65,18 @@ func makeFormpostRequest(t *testing.T, body, boundary string, next http.Handler)
 		},
 	}
 	newr = newr.WithContext(context.WithValue(newr.Context(), "proxycontext", ctx))
-	formpost(common.NewTestScope().Counter("test_formpost"))(next).ServeHTTP(neww, newr)
+	formpost(common.NewTestScope().Counter("test_formpost"), testTempURLDigests)(next).ServeHTTP(neww, newr)
 	return neww
 }
 
 func formPostBody(key, boundary, redirect string, maxFileSize, maxFileCount int, expires time.Time) string {
+	return formPostBodySigned(key, boundary, redirect, maxFileSize, maxFileCount, expires, sha1.New, hex.EncodeToString)
+}
+
+func formPostBodySigned(key, boundary, redirect string, maxFileSize, maxFileCount int, expires time.Time,
+	newHash func() hash.Hash, encode func([]byte) string) string {
 	exp := strconv.FormatInt(expires.Unix(), 10)
-	mac := hmac.New(sha1.New, []byte(key))
+	mac := hmac.New(newHash, []byte(key))
 	fmt.Fprintf(mac, "%s\n%s\n%d\n%d\n%s", "/v1/AUTH_test/container", redirect,
 		maxFileSize, maxFileCount, exp)
 	sig := mac.Sum(nil)
@@ -83,7 +91,7 @@ func formPostBody(key, boundary, redirect string, maxFileSize, maxFileCount int,
 	w.WriteField("max_file_size", strconv.Itoa(maxFileSize))
 	w.WriteField("max_file_count", strconv.Itoa(maxFileCount))
 	w.WriteField("expires", exp)
-	w.WriteField("signature", hex.EncodeToString(sig))
+	w.WriteField("signature", encode(sig))
 
 	ff, _ := w.CreateFormFile("file1", "testfile1.txt")
 	io.WriteString(ff, "Test File\nOne\n")
@@ -114,6 +122,38 @@ func TestFormPost(t *testing.T) {
 	require.Equal(t, 2, len(puts))
 }
 
+func TestFormPostSha512(t *testing.T) {
+	puts := []string{}
+	next := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method == "PUT" {
+			puts = append(puts, request.URL.Path)
+			writer.WriteHeader(201)
+		}
+	})
+	boundary := "168072824752491622650073"
+	body := formPostBodySigned("mykey", boundary, "", 1024, 10, time.Now().Add(time.Minute), sha512.New,
+		func(sig []byte) string { return "sha512:" + base64.URLEncoding.EncodeToString(sig) })
+	neww := makeFormpostRequest(t, body, boundary, next)
+	require.Equal(t, 201, neww.Code)
+	require.Equal(t, []string{"/v1/AUTH_test/container/testfile1.txt", "/v1/AUTH_test/container/testfile2.txt"}, puts)
+}
+
+func TestFormPostMaxFileCount(t *testing.T) {
+	puts := 0
+	next := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method == "PUT" {
+			puts++
+			writer.WriteHeader(201)
+		}
+	})
+	boundary := "168072824752491622650073"
+	body := formPostBody("mykey", boundary, "", 1024, 1, time.Now().Add(time.Minute))
+	neww := makeFormpostRequest(t, body, boundary, next)
+	require.Equal(t, 400, neww.Code)
+	require.Contains(t, neww.Body.String(), "max file count exceeded")
+	require.Equal(t, 1, puts)
+}
+
 func TestExpiredFormPost(t *testing.T) {
 	next := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
 	boundary := "168072824752491622650073"
@@ -187,30 +227,34 @@ func TestAuthenticateFormpost(t *testing.T) {
 	}
 
 	require.Equal(t, FP_ERROR,
-		authenticateFormpost(context.Background(), pc, "a", "c", "/v1/a/c", map[string]string{"expires": "X"}))
+		authenticateFormpost(context.Background(), pc, "a", "c", "/v1/a/c", map[string]string{"expires": "X"}, testTempURLDigests))
 	require.Equal(t, FP_EXPIRED,
-		authenticateFormpost(context.Background(), pc, "a", "c", "/v1/a/c", map[string]string{"expires": "12345"}))
+		authenticateFormpost(context.Background(), pc, "a", "c", "/v1/a/c", map[string]string{"expires": "12345"}, testTempURLDigests))
 	require.Equal(t, FP_ERROR,
-		authenticateFormpost(context.Background(), pc, "a", "c", "/v1/a/c", map[string]string{"expires": "9999999999", "signature": "X"}))
+		authenticateFormpost(context.Background(), pc, "a", "c", "/v1/a/c", map[string]string{"expires": "9999999999", "signature": "X"}, testTempURLDigests))
 
 	// account key 1
 	require.Equal(t, FP_SCOPE_ACCOUNT,
 		authenticateFormpost(context.Background(), pc, "a", "c", "/v1/a/c", map[string]string{"expires": "9999999999",
-			"signature": "1d4cb17a0d70b32f7987fe49b1990020bab52ae6"}))
+			"signature": "1d4cb17a0d70b32f7987fe49b1990020bab52ae6"}, testTempURLDigests))
 	// account key 2
 	require.Equal(t, FP_SCOPE_ACCOUNT,
 		authenticateFormpost(context.Background(), pc, "a", "c", "/v1/a/c", map[string]string{"expires": "9999999999",
-			"signature": "9749158451be0383af1ec6d8e10f09a2d0d5f2b1"}))
+			"signature": "9749158451be0383af1ec6d8e10f09a2d0d5f2b1"}, testTempURLDigests))
 	// container key 1
 	require.Equal(t, FP_SCOPE_CONTAINER,
 		authenticateFormpost(context.Background(), pc, "a", "c", "/v1/a/c", map[string]string{"expires": "9999999999",
-			"signature": "3320ff06b119d287a1c8d18d4356cd91e8518fe7"}))
+			"signature": "3320ff06b119d287a1c8d18d4356cd91e8518fe7"}, testTempURLDigests))
 	// container key 2
 	require.Equal(t, FP_SCOPE_CONTAINER,
 		authenticateFormpost(context.Background(), pc, "a", "c", "/v1/a/c", map[string]string{"expires": "9999999999",
-			"signature": "a3c3dd56ad65f5b87eeb384f9e0406c79511b556"}))
+			"signature": "a3c3dd56ad65f5b87eeb384f9e0406c79511b556"}, testTempURLDigests))
 	// invalid key
 	require.Equal(t, FP_INVALID,
 		authenticateFormpost(context.Background(), pc, "a", "c", "/v1/a/c", map[string]string{"expires": "9999999999",
-			"signature": "1111111111111111111111111111111111111111"}))
+			"signature": "1111111111111111111111111111111111111111"}, testTempURLDigests))
+	// sha1 signatures aren't accepted once the digest is disallowed.
+	require.Equal(t, FP_INVALID,
+		authenticateFormpost(context.Background(), pc, "a", "c", "/v1/a/c", map[string]string{"expires": "9999999999",
+			"signature": "1d4cb17a0d70b32f7987fe49b1990020bab52ae6"}, map[string]bool{"sha256": true}))
 }
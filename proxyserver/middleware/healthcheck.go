@@ -17,19 +17,42 @@ package middleware
 
 import (
 	"net/http"
+	"sync"
 
 	"github.com/troubling/hummingbird/common/conf"
+	globalmiddleware "github.com/troubling/hummingbird/middleware"
 	"github.com/uber-go/tally"
 )
 
+var readyChecks = map[string]globalmiddleware.ReadyCheck{}
+var readyChecksLock sync.Mutex
+
+// RegisterReadyCheck adds a check to what /ready reports, replacing any with
+// the same name.
+func RegisterReadyCheck(check globalmiddleware.ReadyCheck) {
+	readyChecksLock.Lock()
+	defer readyChecksLock.Unlock()
+	readyChecks[check.Name] = check
+}
+
 func NewHealthcheck(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	disableFile := config.GetDefault("disable_path", "")
+	healthcheck := globalmiddleware.HealthcheckHandler(disableFile)
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(
 			func(writer http.ResponseWriter, request *http.Request) {
 				if request.URL.Path == "/healthcheck" && request.Method == "GET" {
-					writer.Header().Set("Content-Length", "2")
-					writer.WriteHeader(http.StatusOK)
-					writer.Write([]byte("OK"))
+					healthcheck(writer, request)
+					return
+				}
+				if request.URL.Path == "/ready" && (request.Method == "GET" || request.Method == "HEAD") {
+					readyChecksLock.Lock()
+					checks := []globalmiddleware.ReadyCheck{}
+					for _, check := range readyChecks {
+						checks = append(checks, check)
+					}
+					readyChecksLock.Unlock()
+					globalmiddleware.ReadyHandler(disableFile, checks...)(writer, request)
 					return
 				}
 				next.ServeHTTP(writer, request)
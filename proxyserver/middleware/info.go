@@ -0,0 +1,119 @@
+package middleware
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/srv"
+)
+
+// InfoConfig is what the proxy's /info shows, and to whom.
+type InfoConfig struct {
+	Expose bool
+	// AdminKey signs requests for the admin section; it's off when empty.
+	AdminKey string
+	// DisallowedSections are left out of /info; a section's key can be
+	// named as "section.key".
+	DisallowedSections []string
+}
+
+func NewInfoConfig(config conf.Section) InfoConfig {
+	return InfoConfig{
+		Expose:             config.GetBool("expose_info", true),
+		AdminKey:           config.GetDefault("admin_key", ""),
+		DisallowedSections: common.SliceFromCSV(config.GetDefault("disallowed_sections", "")),
+	}
+}
+
+// serverInfoDump returns the registered info, without the disallowed
+// sections, and with the admin section if admin is set.
+func serverInfoDump(admin bool, disallowedSections []string) ([]byte, error) {
+	sil.Lock()
+	defer sil.Unlock()
+	info := make(map[string]interface{}, len(serverInfo))
+	for name, data := range serverInfo {
+		info[name] = data
+	}
+	for _, section := range disallowedSections {
+		parts := strings.Split(section, ".")
+		// Sections are copied on the way down so the registered info is left as it was.
+		m := info
+		for _, part := range parts[:len(parts)-1] {
+			sub, ok := m[part].(map[string]interface{})
+			if !ok {
+				m = nil
+				break
+			}
+			subCopy := make(map[string]interface{}, len(sub))
+			for k, v := range sub {
+				subCopy[k] = v
+			}
+			m[part] = subCopy
+			m = subCopy
+		}
+		if m != nil {
+			delete(m, parts[len(parts)-1])
+		}
+	}
+	if admin {
+		adminInfo := map[string]interface{}{"disallowed_sections": disallowedSections}
+		for name, data := range serverAdminInfo {
+			adminInfo[name] = data
+		}
+		info["admin"] = adminInfo
+	}
+	return json.Marshal(info)
+}
+
+// serveInfo answers /info. Requests with a swiftinfo_sig, an HMAC-SHA1 of
+// "GET\n<swiftinfo_expires>\n/info" with the admin_key, also get the admin
+// section.
+func (m *ProxyContextMiddleware) serveInfo(writer http.ResponseWriter, request *http.Request) {
+	if !m.info.Expose {
+		srv.StandardResponse(writer, http.StatusForbidden)
+		return
+	}
+	if request.Method == "OPTIONS" {
+		writer.Header().Set("Allow", "HEAD, GET, OPTIONS")
+		writer.WriteHeader(200)
+		return
+	}
+	admin := false
+	sig, expires := request.URL.Query().Get("swiftinfo_sig"), request.URL.Query().Get("swiftinfo_expires")
+	if sig != "" || expires != "" {
+		if m.info.AdminKey == "" {
+			srv.StandardResponse(writer, http.StatusForbidden)
+			return
+		}
+		expiresUnix, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil || time.Unix(expiresUnix, 0).Before(time.Now()) {
+			srv.StandardResponse(writer, http.StatusUnauthorized)
+			return
+		}
+		sigBytes, err := hex.DecodeString(sig)
+		if err != nil || !checkhmac(sha1.New, []byte(m.info.AdminKey), sigBytes, request.Method, "/info", "", time.Unix(expiresUnix, 0)) {
+			srv.StandardResponse(writer, http.StatusUnauthorized)
+			return
+		}
+		admin = true
+	}
+	data, err := serverInfoDump(admin, m.info.DisallowedSections)
+	if err != nil {
+		srv.StandardResponse(writer, 500)
+		return
+	}
+	if request.Method == "HEAD" {
+		writer.WriteHeader(200)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	writer.WriteHeader(200)
+	writer.Write(data)
+}
@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/test"
+	"go.uber.org/zap"
+)
+
+func infoSig(key string, expires int64) string {
+	mac := hmac.New(sha1.New, []byte(key))
+	fmt.Fprintf(mac, "GET\n%d\n/info", expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestInfo(t *testing.T) {
+	RegisterInfo("infotest", map[string]interface{}{"shown": 1, "hidden": 2})
+	RegisterInfo("infotest_hidden", map[string]interface{}{})
+	RegisterAdminInfo("infotest", map[string]interface{}{"secret": 3})
+	next := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(500)
+	})
+	get := func(info InfoConfig, method, query string) (int, map[string]interface{}) {
+		h := NewContext(false, &test.FakeMemcacheRing{}, zap.NewNop(), nil, nil, nil, info, 0)(next)
+		req, err := http.NewRequest(method, "/info"+query, nil)
+		require.Nil(t, err)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		body := map[string]interface{}{}
+		if w.Code == 200 && method == "GET" {
+			require.Nil(t, json.Unmarshal(w.Body.Bytes(), &body))
+		}
+		return w.Code, body
+	}
+	info := InfoConfig{Expose: true, AdminKey: "sekrit", DisallowedSections: []string{"infotest.hidden", "infotest_hidden"}}
+
+	status, body := get(info, "GET", "")
+	require.Equal(t, 200, status)
+	require.Equal(t, map[string]interface{}{"shown": float64(1)}, body["infotest"])
+	require.NotContains(t, body, "infotest_hidden")
+	require.NotContains(t, body, "admin")
+
+	expires := time.Now().Unix() + 60
+	status, body = get(info, "GET", fmt.Sprintf("?swiftinfo_sig=%s&swiftinfo_expires=%d", infoSig("sekrit", expires), expires))
+	require.Equal(t, 200, status)
+	require.Equal(t, map[string]interface{}{"shown": float64(1)}, body["infotest"])
+	admin := body["admin"].(map[string]interface{})
+	require.Equal(t, map[string]interface{}{"secret": float64(3)}, admin["infotest"])
+	require.Equal(t, []interface{}{"infotest.hidden", "infotest_hidden"}, admin["disallowed_sections"])
+	status, _ = get(info, "HEAD", fmt.Sprintf("?swiftinfo_sig=%s&swiftinfo_expires=%d", infoSig("sekrit", expires), expires))
+	require.Equal(t, 200, status)
+
+	status, _ = get(info, "GET", fmt.Sprintf("?swiftinfo_sig=%s&swiftinfo_expires=%d", infoSig("wrong", expires), expires))
+	require.Equal(t, 401, status)
+	status, _ = get(info, "GET", fmt.Sprintf("?swiftinfo_sig=%s&swiftinfo_expires=%d", infoSig("sekrit", expires-120), expires-120))
+	require.Equal(t, 401, status)
+	info.AdminKey = ""
+	status, _ = get(info, "GET", fmt.Sprintf("?swiftinfo_sig=%s&swiftinfo_expires=%d", infoSig("", expires), expires))
+	require.Equal(t, 403, status)
+
+	// The registered info is untouched by the sections left out.
+	status, body = get(InfoConfig{Expose: true}, "GET", "")
+	require.Equal(t, 200, status)
+	require.Equal(t, map[string]interface{}{"shown": float64(1), "hidden": float64(2)}, body["infotest"])
+
+	status, _ = get(InfoConfig{}, "GET", "")
+	require.Equal(t, 403, status)
+}
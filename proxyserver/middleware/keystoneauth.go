@@ -30,6 +30,7 @@ type keystoneAuth struct {
 	resellerPrefixes  []string
 	accountRules      map[string]map[string][]string
 	resellerAdminRole string
+	systemReaderRoles []string
 	defaultDomainID   string
 	next              http.Handler
 }
@@ -181,6 +182,12 @@ func (ka *keystoneAuth) authorize(r *http.Request) (bool, int) {
 		return true, http.StatusOK
 	}
 
+	readOnly := r.Method == "GET" || r.Method == "HEAD"
+	if readOnly && hasAnyRole(ka.systemReaderRoles, userRoles) {
+		ctx.Logger.Debug("User has system reader authorization", zap.String("userid", userID))
+		return true, http.StatusOK
+	}
+
 	if pathParts["container"] == "" && pathParts["object"] == "" &&
 		r.Method == "DELETE" {
 		ctx.Logger.Debug("User is not allowed to delete its own account",
@@ -207,22 +214,9 @@ func (ka *keystoneAuth) authorize(r *http.Request) (bool, int) {
 		return false, s
 	}
 	accountPrefix, _ := ka.getAccountPrefix(pathParts["account"])
-	operatorRoles := ka.accountRules[accountPrefix]["operator_roles"]
-	haveOperatorRole := false
-	for _, or := range operatorRoles {
-		if common.StringInSlice(or, userRoles) {
-			haveOperatorRole = true
-			break
-		}
-	}
+	haveOperatorRole := hasAnyRole(ka.accountRules[accountPrefix]["operator_roles"], userRoles)
 	serviceRoles := ka.accountRules[accountPrefix]["service_roles"]
-	haveServiceRole := false
-	for _, or := range serviceRoles {
-		if common.StringInSlice(or, userServiceRoles) {
-			haveServiceRole = true
-			break
-		}
-	}
+	haveServiceRole := hasAnyRole(serviceRoles, userServiceRoles)
 	/* Copying this truth table from swift.
 	   # Compare roles from tokens against the configuration options:
 	   #
@@ -245,6 +239,11 @@ func (ka *keystoneAuth) authorize(r *http.Request) (bool, int) {
 		ctx.StorageOwner = true
 		return true, http.StatusOK
 	}
+	// Project readers can read everything in their own project's account,
+	// but not change it.
+	if readOnly && hasAnyRole(ka.accountRules[accountPrefix]["project_reader_roles"], userRoles) {
+		return true, http.StatusOK
+	}
 	if !isAuthorized && authErr == nil {
 		return false, s
 	}
@@ -260,6 +259,16 @@ func (ka *keystoneAuth) authorize(r *http.Request) (bool, int) {
 	return false, s
 }
 
+// hasAnyRole reports whether any of the user's roles is one of roles.
+func hasAnyRole(roles, userRoles []string) bool {
+	for _, role := range roles {
+		if common.StringInSlice(role, userRoles) {
+			return true
+		}
+	}
+	return false
+}
+
 func (ka *keystoneAuth) getAccountPrefix(account string) (string, bool) {
 	// Empty prefix matches everything, so try to match others first
 	for _, prefix := range ka.resellerPrefixes {
@@ -344,14 +353,19 @@ func extractIdentity(r *http.Request) map[string]string {
 
 func NewKeystoneAuth(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
 	defaultRules := map[string][]string{"operator_roles": {"admin", "swiftoperator"},
-		"service_roles": {}}
+		"service_roles": {}, "project_reader_roles": {"swiftprojectreader"}}
 	resellerPrefixes, accountRules := conf.ReadResellerOptions(config, defaultRules)
+	systemReaderRoles := []string{}
+	for _, role := range common.SliceFromCSV(config.GetDefault("system_reader_roles", "SwiftSystemReader")) {
+		systemReaderRoles = append(systemReaderRoles, strings.ToLower(role))
+	}
 	return func(next http.Handler) http.Handler {
 		return &keystoneAuth{
 			next:              next,
 			resellerPrefixes:  resellerPrefixes,
 			accountRules:      accountRules,
 			resellerAdminRole: strings.ToLower(config.GetDefault("reseller_admin_role", "ResellerAdmin")),
+			systemReaderRoles: systemReaderRoles,
 			defaultDomainID:   config.GetDefault("default_domain_id", "default"),
 		}
 	}, nil
@@ -0,0 +1,118 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"go.uber.org/zap"
+)
+
+func newTestKeystoneAuth(t *testing.T, configString string) *keystoneAuth {
+	config, err := conf.StringConfig("[filter:keystoneauth]\n" + configString)
+	require.Nil(t, err)
+	mid, err := NewKeystoneAuth(config.GetSection("filter:keystoneauth"), common.NewTestScope())
+	require.Nil(t, err)
+	return mid(http.NotFoundHandler()).(*keystoneAuth)
+}
+
+func keystoneRequest(method, path, project, user, roles, acl string) (*http.Request, *ProxyContext) {
+	r, _ := http.NewRequest(method, path, nil)
+	r.Header.Set("X-Identity-Status", "Confirmed")
+	r.Header.Set("X-Project-Id", project)
+	r.Header.Set("X-Project-Name", project+"name")
+	r.Header.Set("X-User-Id", user)
+	r.Header.Set("X-User-Name", user+"name")
+	r.Header.Set("X-Roles", roles)
+	ctx := &ProxyContext{
+		Logger:      zap.NewNop(),
+		ACL:         acl,
+		RemoteUsers: []string{project + "name"},
+		accountInfoCache: map[string]*AccountInfo{
+			"account/AUTH_p1": {SysMetadata: map[string]string{}},
+			"account/AUTH_p2": {SysMetadata: map[string]string{}},
+		},
+	}
+	return r.WithContext(context.WithValue(r.Context(), "proxycontext", ctx)), ctx
+}
+
+func TestKeystoneAuthOperator(t *testing.T) {
+	ka := newTestKeystoneAuth(t, "operator_roles = SwiftOperator\n")
+	r, ctx := keystoneRequest("PUT", "/v1/AUTH_p1/c/o", "p1", "u1", "member,SwiftOperator", "")
+	ok, _ := ka.authorize(r)
+	require.True(t, ok)
+	require.True(t, ctx.StorageOwner)
+
+	// Operators of one project can't touch another's account.
+	r, ctx = keystoneRequest("PUT", "/v1/AUTH_p2/c/o", "p1", "u1", "SwiftOperator", "")
+	ok, status := ka.authorize(r)
+	require.False(t, ok)
+	require.Equal(t, 403, status)
+	require.False(t, ctx.StorageOwner)
+
+	r, _ = keystoneRequest("PUT", "/v1/AUTH_p1/c/o", "p1", "u1", "member", "")
+	ok, _ = ka.authorize(r)
+	require.False(t, ok)
+}
+
+func TestKeystoneAuthReaders(t *testing.T) {
+	ka := newTestKeystoneAuth(t, "")
+	for _, method := range []string{"GET", "HEAD"} {
+		r, ctx := keystoneRequest(method, "/v1/AUTH_p1/c/o", "p1", "u1", "SwiftProjectReader", "")
+		ok, _ := ka.authorize(r)
+		require.True(t, ok, method)
+		require.False(t, ctx.StorageOwner)
+	}
+	r, _ := keystoneRequest("PUT", "/v1/AUTH_p1/c/o", "p1", "u1", "SwiftProjectReader", "")
+	ok, _ := ka.authorize(r)
+	require.False(t, ok)
+	// Project readers only read their own project.
+	r, _ = keystoneRequest("GET", "/v1/AUTH_p2/c/o", "p1", "u1", "SwiftProjectReader", "")
+	ok, _ = ka.authorize(r)
+	require.False(t, ok)
+
+	// System readers read every project.
+	r, ctx := keystoneRequest("GET", "/v1/AUTH_p2/c", "p1", "u1", "swiftsystemreader", "")
+	ok, _ = ka.authorize(r)
+	require.True(t, ok)
+	require.False(t, ctx.StorageOwner)
+	r, _ = keystoneRequest("DELETE", "/v1/AUTH_p2/c/o", "p1", "u1", "SwiftSystemReader", "")
+	ok, _ = ka.authorize(r)
+	require.False(t, ok)
+
+	ka = newTestKeystoneAuth(t, "system_reader_roles = auditor\n")
+	r, _ = keystoneRequest("GET", "/v1/AUTH_p2/c", "p1", "u1", "SwiftSystemReader", "")
+	ok, _ = ka.authorize(r)
+	require.False(t, ok)
+	r, _ = keystoneRequest("GET", "/v1/AUTH_p2/c", "p1", "u1", "Auditor", "")
+	ok, _ = ka.authorize(r)
+	require.True(t, ok)
+}
+
+func TestKeystoneAuthCrossTenantACL(t *testing.T) {
+	ka := newTestKeystoneAuth(t, "")
+	r, _ := keystoneRequest("GET", "/v1/AUTH_p2/c/o", "p1", "u1", "member", "p1:u1")
+	ok, _ := ka.authorize(r)
+	require.True(t, ok)
+	r, _ = keystoneRequest("GET", "/v1/AUTH_p2/c/o", "p1", "u1", "member", "p1:*")
+	ok, _ = ka.authorize(r)
+	require.True(t, ok)
+	// Names work too while the projects are in the default domain.
+	r, _ = keystoneRequest("GET", "/v1/AUTH_p2/c/o", "p1", "u1", "member", "p1name:u1name")
+	ok, _ = ka.authorize(r)
+	require.True(t, ok)
+	r, _ = keystoneRequest("GET", "/v1/AUTH_p2/c/o", "p1", "u1", "member", "p1:u2")
+	ok, _ = ka.authorize(r)
+	require.False(t, ok)
+}
+
+func TestKeystoneAuthResellerAdmin(t *testing.T) {
+	ka := newTestKeystoneAuth(t, "")
+	r, ctx := keystoneRequest("DELETE", "/v1/AUTH_p2", "p1", "u1", "ResellerAdmin", "")
+	ok, _ := ka.authorize(r)
+	require.True(t, ok)
+	require.True(t, ctx.ResellerRequest)
+}
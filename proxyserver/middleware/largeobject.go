@@ -25,10 +25,12 @@ import (
 	"io/ioutil"
 	"mime"
 	"net/http"
+	"net/url"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 
 	"go.uber.org/zap"
 
@@ -183,6 +185,10 @@ type xloMiddleware struct {
 	sloGetRequestsMetric    tally.Counter
 	sloPutRequestsMetric    tally.Counter
 	sloDeleteRequestsMetric tally.Counter
+	// headConcurrency is how many segments a manifest PUT HEADs at once,
+	// and headRate how many it HEADs per second; 0 is unlimited.
+	headConcurrency int
+	headRate        int64
 }
 
 func (xlo *xloMiddleware) feedOutSegments(sw *xloIdentifyWriter, request *http.Request, manifest []segItem, reqRange common.HttpRange, status int) {
@@ -278,7 +284,7 @@ func (xlo *xloMiddleware) buildSloManifest(request *http.Request, manPath string
 
 func (xlo *xloMiddleware) buildDloManifest(sw *xloIdentifyWriter, request *http.Request, account string, container string, prefix string) (manifest []segItem, status int, err error) {
 	ctx := GetProxyContext(request)
-	newReq, err := ctx.newSubrequest("GET", fmt.Sprintf("/v1/%s/%s?format=json&prefix=%s", account, container, prefix), http.NoBody, request, "slo")
+	newReq, err := ctx.newSubrequest("GET", fmt.Sprintf("/v1/%s/%s?format=json&prefix=%s", common.Urlencode(account), common.Urlencode(container), url.QueryEscape(prefix)), http.NoBody, request, "slo")
 	if err != nil {
 		return manifest, 500, err
 	}
@@ -359,14 +365,13 @@ func (xlo *xloMiddleware) byteFeeder(sw *xloIdentifyWriter, request *http.Reques
 	status := http.StatusOK
 	if reqRangeStr != "" {
 		if ranges, err := common.ParseRange(reqRangeStr, xloContentLength); err == nil {
-			xloContentLength = 0
 			if len(ranges) > 1 {
 				sw.ResponseWriter.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", xloContentLength))
 				srv.SimpleErrorResponse(sw.ResponseWriter, http.StatusRequestedRangeNotSatisfiable, "invalid multi range")
 				return
 			} else if len(ranges) == 1 {
 				reqRange = ranges[0]
-				sw.Header().Set("Content-Range", fmt.Sprintf("%d-%d/%s", reqRange.Start, reqRange.End, xloContentLengthStr))
+				sw.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", reqRange.Start, reqRange.End-1, xloContentLength))
 				status = http.StatusPartialContent
 			}
 		} else {
@@ -378,6 +383,10 @@ func (xlo *xloMiddleware) byteFeeder(sw *xloIdentifyWriter, request *http.Reques
 	sw.Header().Set("Content-Length", strconv.FormatInt(reqRange.End-reqRange.Start, 10))
 	sw.Header().Set("Content-Type", sw.Header().Get("Content-Type"))
 	sw.Header().Set("Etag", fmt.Sprintf("\"%s\"", xloEtag))
+	if request.Method == "HEAD" {
+		sw.ResponseWriter.WriteHeader(status)
+		return
+	}
 	xlo.feedOutSegments(sw, request, manifest, reqRange, status)
 }
 
@@ -520,10 +529,9 @@ func (xlo *xloMiddleware) handleSloPut(writer http.ResponseWriter, request *http
 		return
 	}
 	var toPutManifest []segItem
-	i := 0
 	totalSize := int64(0)
 	sloEtag := md5.New()
-	ctx := GetProxyContext(request)
+	segPaths := make([]string, 0, len(manifest))
 	for _, spm := range manifest {
 		spmContainer, spmObject, err := splitSegPath(spm.Path)
 		if err != nil {
@@ -534,15 +542,16 @@ func (xlo *xloMiddleware) handleSloPut(writer http.ResponseWriter, request *http
 			errs = append(errs, fmt.Sprintf("manifest cannot reference itself: %s", spm.Path))
 			break
 		}
-
-		newPath := fmt.Sprintf("/v1/%s/%s/%s", pathMap["account"], spmContainer, spmObject)
-		newReq, err := ctx.newSubrequest("HEAD", newPath, http.NoBody, request, "slo")
-		if err != nil {
-			ctx.Logger.Error("Couldn't create http.Request", zap.Error(err))
-			return
-		}
-		pw := NewCaptureWriter()
-		ctx.serveHTTPSubrequest(pw, newReq)
+		segPaths = append(segPaths, fmt.Sprintf("/v1/%s/%s/%s", pathMap["account"], spmContainer, spmObject))
+	}
+	if len(errs) > 0 {
+		srv.SimpleErrorResponse(writer, 400, strings.Join(errs, "\n"))
+		return
+	}
+	heads := xlo.headSegments(request, segPaths)
+	for i, spm := range manifest {
+		newPath := segPaths[i]
+		pw := heads[i]
 		if pw.status != 200 {
 			errs = append(errs, fmt.Sprintf("%d %s response on segment: %s", pw.status, http.StatusText(pw.status), newPath))
 			continue
@@ -629,6 +638,44 @@ func (xlo *xloMiddleware) handleSloPut(writer http.ResponseWriter, request *http
 	return
 }
 
+// headSegments HEADs each of the segments a manifest PUT lists, as many at
+// once and as fast as the middleware is configured to allow, returning the
+// responses in the manifest's order.
+func (xlo *xloMiddleware) headSegments(request *http.Request, paths []string) []*captureWriter {
+	ctx := GetProxyContext(request)
+	limit := common.NewKeyedRateLimit(xlo.headRate)
+	heads := make([]*captureWriter, len(paths))
+	indexes := make(chan int)
+	workers := xlo.headConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(paths); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				limit.Wait("", 1)
+				heads[i] = NewCaptureWriter()
+				newReq, err := ctx.newSubrequest("HEAD", paths[i], http.NoBody, request, "slo")
+				if err != nil {
+					ctx.Logger.Error("Couldn't create http.Request", zap.Error(err))
+					heads[i].WriteHeader(http.StatusInternalServerError)
+					continue
+				}
+				ctx.serveHTTPSubrequest(heads[i], newReq)
+			}
+		}()
+	}
+	for i := range paths {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return heads
+}
+
 func segmentIsSlo(request *http.Request, path string) bool {
 	ctx := GetProxyContext(request)
 	newReq, err := ctx.newSubrequest("HEAD", path, http.NoBody, request, "slo")
@@ -760,6 +807,8 @@ func NewXlo(config conf.Section, metricsScope tally.Scope) (func(http.Handler) h
 	sloGetRequestsMetric := metricsScope.Counter("slo_GET_requests")
 	sloPutRequestsMetric := metricsScope.Counter("slo_PUT_requests")
 	sloDeleteRequestsMetric := metricsScope.Counter("slo_DELETE_requests")
+	headConcurrency := int(config.GetInt("concurrency", 2))
+	headRate := config.GetInt("segment_head_rate", 0)
 	return func(next http.Handler) http.Handler {
 		return &xloMiddleware{
 			next:                    next,
@@ -767,6 +816,8 @@ func NewXlo(config conf.Section, metricsScope tally.Scope) (func(http.Handler) h
 			sloGetRequestsMetric:    sloGetRequestsMetric,
 			sloPutRequestsMetric:    sloPutRequestsMetric,
 			sloDeleteRequestsMetric: sloDeleteRequestsMetric,
+			headConcurrency:         headConcurrency,
+			headRate:                headRate,
 		}
 	}, nil
 }
@@ -18,12 +18,17 @@ package middleware
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/troubling/hummingbird/common"
@@ -50,6 +55,7 @@ func newTestXLOMiddleware(next http.Handler) *xloMiddleware {
 		sloGetRequestsMetric:    testScope.Counter("test_largeobject_slo_get"),
 		sloPutRequestsMetric:    testScope.Counter("test_largeobject_slo_put"),
 		sloDeleteRequestsMetric: testScope.Counter("test_largeobject_slo_delete"),
+		headConcurrency:         1,
 	}
 }
 
@@ -374,6 +380,85 @@ func TestPutSlo(t *testing.T) {
 	require.Equal(t, "/v1/a/hat/c", heads[2])
 }
 
+func testSegmentHeads(t *testing.T, sm *xloMiddleware, segments int, delay time.Duration) (int, []segItem) {
+	var lock sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	var putManifest []segItem
+	next := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method == "PUT" {
+			require.Nil(t, json.NewDecoder(request.Body).Decode(&putManifest))
+			writer.WriteHeader(201)
+			return
+		}
+		lock.Lock()
+		if inFlight++; inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		lock.Unlock()
+		time.Sleep(delay)
+		lock.Lock()
+		inFlight--
+		lock.Unlock()
+		writer.Header().Set("Content-Length", "3")
+		writer.Header().Set("Etag", "\"202cb962ac59075b964b07152d234b70\"")
+		writer.WriteHeader(200)
+	})
+	sm.next = next
+	var paths []string
+	for i := 0; i < segments; i++ {
+		paths = append(paths, fmt.Sprintf(`{"path":"/hat/seg%02d"}`, i))
+	}
+	body := "[" + strings.Join(paths, ",") + "]"
+	req, err := http.NewRequest("PUT", "/v1/a/c/o?multipart-manifest=put", bytes.NewBuffer([]byte(body)))
+	require.Nil(t, err)
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	req = req.WithContext(context.WithValue(req.Context(), "proxycontext", NewFakeProxyContext(next)))
+	w := httptest.NewRecorder()
+	sm.ServeHTTP(w, req)
+	require.Equal(t, 201, w.Code)
+	return maxInFlight, putManifest
+}
+
+func TestPutSloConcurrentHeads(t *testing.T) {
+	sm := newTestXLOMiddleware(nil)
+	sm.headConcurrency = 3
+	maxInFlight, manifest := testSegmentHeads(t, sm, 9, 20*time.Millisecond)
+	require.True(t, maxInFlight > 1 && maxInFlight <= 3, "max in flight %d", maxInFlight)
+	// The manifest keeps its order however the HEADs come back.
+	require.Equal(t, 9, len(manifest))
+	for i, seg := range manifest {
+		require.Equal(t, fmt.Sprintf("/hat/seg%02d", i), seg.Name)
+	}
+}
+
+func TestPutSloHeadRate(t *testing.T) {
+	sm := newTestXLOMiddleware(nil)
+	sm.headConcurrency = 4
+	sm.headRate = 10
+	start := time.Now()
+	// The first second's worth go straight away and the other 3 wait.
+	_, manifest := testSegmentHeads(t, sm, 13, 0)
+	require.Equal(t, 13, len(manifest))
+	require.True(t, time.Since(start) >= 250*time.Millisecond, "took %s", time.Since(start))
+}
+
+func TestPutSloIndexErrors(t *testing.T) {
+	next := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Length", "3")
+		writer.WriteHeader(200)
+	})
+	sm := newTestXLOMiddleware(next)
+	body := `[{"path":"/hat/a"},{"path":"/hat/b","range":"5-9"}]`
+	req, err := http.NewRequest("PUT", "/v1/a/c/o?multipart-manifest=put", bytes.NewBuffer([]byte(body)))
+	require.Nil(t, err)
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	req = req.WithContext(context.WithValue(req.Context(), "proxycontext", NewFakeProxyContext(next)))
+	w := httptest.NewRecorder()
+	sm.ServeHTTP(w, req)
+	require.Equal(t, 400, w.Code)
+	require.Equal(t, "Index 1: invalid range", w.Body.String())
+}
+
 func TestDeleteSlo(t *testing.T) {
 	var paths []string
 	next := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
@@ -478,3 +563,81 @@ func TestGetDlo(t *testing.T) {
 	require.Equal(t, resp.Header.Get("Content-Type"), "app/html")
 	require.Equal(t, "123456789", string(body))
 }
+
+// dloTestHandler serves a DLO manifest at /v1/a/c/o whose segments are
+// listed under prefix in the hat container, honoring ranged segment GETs.
+func dloTestHandler(t *testing.T, prefix string, segmentGets *int) http.HandlerFunc {
+	segments := map[string]string{"/v1/a/hat/dlo-a": "123", "/v1/a/hat/dlo-b": "456", "/v1/a/hat/dlo-c": "789"}
+	return func(writer http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/v1/a/c/o":
+			writer.Header().Set("X-Object-Manifest", "hat/"+prefix)
+			writer.Header().Set("Content-Type", "app/html")
+			writer.Header().Set("Content-Length", "0")
+			writer.WriteHeader(200)
+		case "/v1/a/hat":
+			require.Equal(t, prefix, request.URL.Query().Get("prefix"))
+			writer.Header().Set("Content-Type", "application/json")
+			writer.WriteHeader(200)
+			writer.Write([]byte(simpleDloManifest))
+		default:
+			body, ok := segments[request.URL.Path]
+			require.True(t, ok, request.URL.Path)
+			*segmentGets++
+			ranges, err := common.ParseRange(request.Header.Get("Range"), int64(len(body)))
+			require.Nil(t, err)
+			require.Equal(t, 1, len(ranges))
+			writer.WriteHeader(206)
+			writer.Write([]byte(body[ranges[0].Start:ranges[0].End]))
+		}
+	}
+}
+
+func TestGetDloRange(t *testing.T) {
+	etag := fmt.Sprintf("\"%x\"", md5.Sum([]byte("202cb962ac59075b964b07152d234b70250cf8b51c773f3f8dc8b4be867a9a0268053af2923e00204c3ca7c6a3150cf7")))
+	for _, tc := range []struct {
+		rng, body, contentRange string
+		status                  int
+	}{
+		{"", "123456789", "", 200},
+		{"bytes=2-6", "34567", "bytes 2-6/9", 206},
+		{"bytes=3-5", "456", "bytes 3-5/9", 206},
+		{"bytes=-4", "6789", "bytes 5-8/9", 206},
+		{"bytes=7-", "89", "bytes 7-8/9", 206},
+		{"bytes=20-30", "", "bytes */9", 416},
+	} {
+		segmentGets := 0
+		next := dloTestHandler(t, "dlo-", &segmentGets)
+		sm := newTestXLOMiddleware(next)
+		req, err := http.NewRequest("GET", "/v1/a/c/o", nil)
+		require.Nil(t, err)
+		if tc.rng != "" {
+			req.Header.Set("Range", tc.rng)
+		}
+		req = req.WithContext(context.WithValue(req.Context(), "proxycontext", NewFakeProxyContext(next)))
+		w := httptest.NewRecorder()
+		sm.ServeHTTP(w, req)
+		require.Equal(t, tc.status, w.Code, tc.rng)
+		require.Equal(t, tc.contentRange, w.Header().Get("Content-Range"), tc.rng)
+		if tc.status/100 == 2 {
+			require.Equal(t, tc.body, w.Body.String(), tc.rng)
+			require.Equal(t, strconv.Itoa(len(tc.body)), w.Header().Get("Content-Length"), tc.rng)
+			require.Equal(t, etag, w.Header().Get("Etag"), tc.rng)
+		}
+	}
+}
+
+func TestHeadDlo(t *testing.T) {
+	segmentGets := 0
+	// The prefix needs escaping in the listing request.
+	next := dloTestHandler(t, "dlo- &x", &segmentGets)
+	sm := newTestXLOMiddleware(next)
+	req, err := http.NewRequest("HEAD", "/v1/a/c/o", nil)
+	require.Nil(t, err)
+	req = req.WithContext(context.WithValue(req.Context(), "proxycontext", NewFakeProxyContext(next)))
+	w := httptest.NewRecorder()
+	sm.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "9", w.Header().Get("Content-Length"))
+	require.Equal(t, 0, segmentGets)
+}
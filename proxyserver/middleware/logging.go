@@ -16,17 +16,16 @@
 package middleware
 
 import (
-	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/troubling/hummingbird/common/conf"
 	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/common/tracing"
 	"github.com/uber-go/tally"
 )
 
 func NewRequestLogger(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
-	requestsMetric := metricsScope.Counter("requests")
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 			start := time.Now()
@@ -36,10 +35,10 @@ func NewRequestLogger(config conf.Section, metricsScope tally.Scope) (func(http.
 			next.ServeHTTP(newWriter, request)
 			ctx := GetProxyContext(request)
 			srv.LogRequestLine(ctx.Logger, request, start, newWriter, newReader)
+			tracing.Record(request.Context(), tracing.Event{Start: start, Duration: time.Since(start).Seconds(), Server: "proxy",
+				Source: ctx.Source, Method: request.Method, Path: request.URL.Path, Status: newWriter.Status})
 			if ctx.Source == "" {
-				requestsMetric.Inc(1)
-				metricsScope.Counter(request.Method + "_requests").Inc(1)
-				metricsScope.Counter(fmt.Sprintf("%d_responses", newWriter.Status)).Inc(1)
+				srv.RecordRequest(metricsScope, request.Method, newWriter.Status, time.Since(start))
 			}
 		})
 	}, nil
@@ -0,0 +1,478 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+)
+
+// A container's X-Container-Notify-Url says where to publish events for its
+// objects, and its X-Container-Notify-Events which of them. They're kept in
+// sysmeta, so only the account's owners see where events go.
+const (
+	notifyUrlHeader    = "X-Container-Notify-Url"
+	notifyEventsHeader = "X-Container-Notify-Events"
+	notifyUrlMeta      = "Notify-Url"
+	notifyEventsMeta   = "Notify-Events"
+)
+
+// notifyPrivateNets are the ranges webhooks can't go to without
+// webhook_hosts, along with loopback, link-local and multicast addresses, so
+// account owners can't have the proxy reach the cluster's own network.
+var notifyPrivateNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+var errNotifyAddressRefused = errors.New("Notification webhook address not allowed")
+
+func notifyAddressAllowed(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range notifyPrivateNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// notifyDialContext dials only addresses notifyAddressAllowed allows, checking
+// what the host resolves to as it's dialed so DNS can't be used to get
+// around it.
+func notifyDialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	err = errNotifyAddressRefused
+	for _, a := range addrs {
+		if !notifyAddressAllowed(a.IP) {
+			continue
+		}
+		var conn net.Conn
+		if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(a.IP.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// notifyNoRedirects keeps webhooks from being sent on somewhere
+// checkDestination wouldn't have allowed.
+func notifyNoRedirects(req *http.Request, via []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+// NotificationEvent is what's published when an object is created or deleted.
+type NotificationEvent struct {
+	Event       string `json:"event"`
+	Time        string `json:"time"`
+	Account     string `json:"account"`
+	Container   string `json:"container"`
+	Object      string `json:"object"`
+	Etag        string `json:"etag,omitempty"`
+	Bytes       int    `json:"bytes,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	TransId     string `json:"trans_id"`
+}
+
+// queuedNotification is an event waiting in the queue directory to be
+// delivered.
+type queuedNotification struct {
+	Destination string            `json:"destination"`
+	Event       NotificationEvent `json:"event"`
+	Queued      int64             `json:"queued"`
+	Attempts    int               `json:"attempts"`
+}
+
+var notifyEvents = map[string]string{"PUT": "create", "DELETE": "delete"}
+
+var notifyEventNames = map[string]string{"create": "ObjectCreated", "delete": "ObjectRemoved"}
+
+type notifier struct {
+	queueDir      string
+	kafkaRestUrl  string
+	amqpApiUrl    string
+	amqpVhost     string
+	webhookHosts  map[string]bool
+	retryInterval time.Duration
+	maxAge        time.Duration
+	client        *http.Client
+	// webhookClient is for the account owners' webhooks, limited to
+	// webhookHosts or, without those, to public addresses.
+	webhookClient *http.Client
+	wake          chan struct{}
+	seq           uint64
+	queued        tally.Counter
+	sent          tally.Counter
+	failures      tally.Counter
+	expired       tally.Counter
+}
+
+// checkDestination returns why a container's notification URL can't be used,
+// or "" if it can.
+func (n *notifier) checkDestination(destination string) string {
+	u, err := url.Parse(destination)
+	if err != nil || u.Host == "" {
+		return "Invalid notification URL"
+	}
+	switch u.Scheme {
+	case "http", "https":
+		if len(n.webhookHosts) > 0 && !n.webhookHosts[u.Hostname()] {
+			return "Notification webhook host not allowed"
+		}
+		if ip := net.ParseIP(u.Hostname()); len(n.webhookHosts) == 0 && ip != nil && !notifyAddressAllowed(ip) {
+			return errNotifyAddressRefused.Error()
+		}
+	case "kafka":
+		if n.kafkaRestUrl == "" {
+			return "Kafka notifications are not available"
+		}
+	case "amqp":
+		if n.amqpApiUrl == "" {
+			return "AMQP notifications are not available"
+		}
+	default:
+		return "Unknown notification URL scheme"
+	}
+	return ""
+}
+
+// enqueue writes the event to the queue directory, syncing it to disk so it
+// survives until it's delivered.
+func (n *notifier) enqueue(destination string, event NotificationEvent) error {
+	now := time.Now()
+	name := fmt.Sprintf("%019d-%d-%d.json", now.UnixNano(), os.Getpid(), atomic.AddUint64(&n.seq, 1))
+	if err := n.write(name, &queuedNotification{Destination: destination, Event: event, Queued: now.Unix()}); err != nil {
+		return err
+	}
+	n.queued.Inc(1)
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (n *notifier) write(name string, qn *queuedNotification) error {
+	data, err := json.Marshal(qn)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(n.queueDir, ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(n.queueDir, name))
+}
+
+func (n *notifier) run() {
+	ticker := time.NewTicker(n.retryInterval)
+	defer ticker.Stop()
+	for {
+		n.deliverQueued()
+		select {
+		case <-n.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliverQueued tries to deliver every queued event, oldest first. Once a
+// destination fails, its later events wait for the next try so they're
+// delivered in order.
+func (n *notifier) deliverQueued() {
+	names, err := filepath.Glob(filepath.Join(n.queueDir, "*.json"))
+	if err != nil {
+		return
+	}
+	sort.Strings(names)
+	failed := map[string]bool{}
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		var qn queuedNotification
+		if err := json.Unmarshal(data, &qn); err != nil {
+			os.Remove(name)
+			continue
+		}
+		if failed[qn.Destination] {
+			continue
+		}
+		if err := n.deliver(qn.Destination, &qn.Event); err == nil {
+			n.sent.Inc(1)
+			os.Remove(name)
+			continue
+		}
+		n.failures.Inc(1)
+		failed[qn.Destination] = true
+		if n.maxAge > 0 && time.Since(time.Unix(qn.Queued, 0)) > n.maxAge {
+			n.expired.Inc(1)
+			os.Remove(name)
+			continue
+		}
+		qn.Attempts++
+		n.write(filepath.Base(name), &qn)
+	}
+}
+
+func (n *notifier) deliver(destination string, event *NotificationEvent) error {
+	u, err := url.Parse(destination)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	var target string
+	var body []byte
+	contentType := "application/json"
+	c := n.client
+	switch u.Scheme {
+	case "http", "https":
+		if msg := n.checkDestination(destination); msg != "" {
+			return errors.New(msg)
+		}
+		target, body, c = destination, payload, n.webhookClient
+	case "kafka":
+		target = strings.TrimRight(n.kafkaRestUrl, "/") + "/topics/" + url.PathEscape(u.Host)
+		contentType = "application/vnd.kafka.json.v2+json"
+		body, err = json.Marshal(map[string]interface{}{"records": []interface{}{map[string]interface{}{
+			"key":   event.Account + "/" + event.Container + "/" + event.Object,
+			"value": json.RawMessage(payload),
+		}}})
+	case "amqp":
+		// amqp://<exchange>/<routing key>, published through the RabbitMQ
+		// management API
+		target = fmt.Sprintf("%s/api/exchanges/%s/%s/publish", strings.TrimRight(n.amqpApiUrl, "/"),
+			url.PathEscape(n.amqpVhost), url.PathEscape(u.Host))
+		body, err = json.Marshal(map[string]interface{}{
+			"properties":       map[string]interface{}{"delivery_mode": 2, "content_type": "application/json"},
+			"routing_key":      strings.TrimPrefix(u.Path, "/"),
+			"payload":          string(payload),
+			"payload_encoding": "string",
+		})
+	default:
+		return fmt.Errorf("Unknown notification URL scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return err
+	}
+	resp, err := c.Post(target, contentType, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Notification refused with status %d", resp.StatusCode)
+	}
+	if u.Scheme == "amqp" {
+		// RabbitMQ accepts messages no queue is bound to, and drops them
+		var published struct {
+			Routed bool `json:"routed"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&published); err != nil || !published.Routed {
+			return fmt.Errorf("Notification not routed to a queue")
+		}
+	}
+	return nil
+}
+
+// notifyWriter queues the request's event before the client is told it
+// succeeded.
+type notifyWriter struct {
+	http.ResponseWriter
+	n           *notifier
+	ctx         *ProxyContext
+	destination string
+	event       NotificationEvent
+	reader      *srv.CountingReadCloser
+	wroteHeader bool
+}
+
+func (w *notifyWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if status/100 == 2 {
+		w.event.Time = time.Now().UTC().Format(time.RFC3339Nano)
+		if w.event.Event == notifyEventNames["create"] {
+			w.event.Etag = strings.Trim(w.Header().Get("Etag"), "\"")
+			w.event.Bytes = w.reader.ByteCount
+		}
+		if err := w.n.enqueue(w.destination, w.event); err != nil {
+			w.n.failures.Inc(1)
+			w.ctx.Logger.Error("Error queueing notification", zap.String("queueDir", w.n.queueDir), zap.Error(err))
+			srv.SimpleErrorResponse(w.ResponseWriter, 503, "Unable to queue notification")
+			return
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *notifyWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(200)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// notifyContainerWriter shows a container's notification settings, the URL
+// only to its account's owners.
+type notifyContainerWriter struct {
+	http.ResponseWriter
+	ctx *ProxyContext
+}
+
+func (w *notifyContainerWriter) WriteHeader(status int) {
+	if destination := w.Header().Get("X-Container-Sysmeta-" + notifyUrlMeta); destination != "" && w.ctx.StorageOwner {
+		w.Header().Set(notifyUrlHeader, destination)
+	}
+	if events := w.Header().Get("X-Container-Sysmeta-" + notifyEventsMeta); events != "" {
+		w.Header().Set(notifyEventsHeader, events)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (n *notifier) handle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		apiRequest, account, container, object := getPathParts(request)
+		ctx := GetProxyContext(request)
+		if !apiRequest || container == "" || ctx == nil {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		if object == "" {
+			if request.Method == "PUT" || request.Method == "POST" {
+				if destinations, ok := request.Header[notifyUrlHeader]; ok {
+					if destinations[0] != "" {
+						if msg := n.checkDestination(destinations[0]); msg != "" {
+							srv.SimpleErrorResponse(writer, 400, msg)
+							return
+						}
+					}
+					request.Header.Set("X-Container-Sysmeta-"+notifyUrlMeta, destinations[0])
+					request.Header.Del(notifyUrlHeader)
+				}
+				if events, ok := request.Header[notifyEventsHeader]; ok {
+					request.Header.Set("X-Container-Sysmeta-"+notifyEventsMeta, events[0])
+					request.Header.Del(notifyEventsHeader)
+				}
+			}
+			next.ServeHTTP(&notifyContainerWriter{ResponseWriter: writer, ctx: ctx}, request)
+			return
+		}
+		eventType, ok := notifyEvents[request.Method]
+		if !ok {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		ci, err := ctx.C.GetContainerInfo(request.Context(), account, container)
+		if err != nil || ci.SysMetadata[notifyUrlMeta] == "" || n.checkDestination(ci.SysMetadata[notifyUrlMeta]) != "" {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		if events := ci.SysMetadata[notifyEventsMeta]; events != "" && !common.StringInSlice(eventType, strings.Fields(strings.Replace(events, ",", " ", -1))) {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		reader := &srv.CountingReadCloser{ReadCloser: request.Body}
+		request.Body = reader
+		next.ServeHTTP(&notifyWriter{
+			ResponseWriter: writer,
+			n:              n,
+			ctx:            ctx,
+			destination:    ci.SysMetadata[notifyUrlMeta],
+			reader:         reader,
+			event: NotificationEvent{
+				Event:       notifyEventNames[eventType],
+				Account:     account,
+				Container:   container,
+				Object:      object,
+				ContentType: request.Header.Get("Content-Type"),
+				TransId:     ctx.TxId,
+			},
+		}, request)
+	})
+}
+
+func NewNotifications(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	if !config.GetBool("enabled", false) {
+		return func(next http.Handler) http.Handler { return next }, nil
+	}
+	n := &notifier{
+		queueDir:      config.GetDefault("queue_dir", "/var/cache/swift/notifications"),
+		kafkaRestUrl:  config.GetDefault("kafka_rest_url", ""),
+		amqpApiUrl:    config.GetDefault("amqp_api_url", ""),
+		amqpVhost:     config.GetDefault("amqp_vhost", "/"),
+		webhookHosts:  map[string]bool{},
+		retryInterval: time.Duration(config.GetFloat("retry_interval", 30) * float64(time.Second)),
+		maxAge:        time.Duration(config.GetInt("max_age", 604800)) * time.Second,
+		client:        &http.Client{Timeout: 10 * time.Second, CheckRedirect: notifyNoRedirects},
+		wake:          make(chan struct{}, 1),
+		queued:        metricsScope.Counter("notifications_queued"),
+		sent:          metricsScope.Counter("notifications_sent"),
+		failures:      metricsScope.Counter("notifications_failures"),
+		expired:       metricsScope.Counter("notifications_expired"),
+	}
+	for _, host := range strings.Fields(strings.Replace(config.GetDefault("webhook_hosts", ""), ",", " ", -1)) {
+		n.webhookHosts[host] = true
+	}
+	n.webhookClient = n.client
+	if len(n.webhookHosts) == 0 {
+		n.webhookClient = &http.Client{
+			Timeout:       10 * time.Second,
+			CheckRedirect: notifyNoRedirects,
+			Transport:     &http.Transport{DialContext: notifyDialContext, TLSHandshakeTimeout: 10 * time.Second},
+		}
+	}
+	if err := os.MkdirAll(n.queueDir, 0700); err != nil {
+		return nil, fmt.Errorf("Unable to create notification queue_dir %q: %v", n.queueDir, err)
+	}
+	go n.run()
+	return n.handle, nil
+}
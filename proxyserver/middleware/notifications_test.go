@@ -0,0 +1,244 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/client"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/common/test"
+	"go.uber.org/zap"
+)
+
+// testNotifications serves requests through the notifications middleware to
+// a handler that accepts everything, for container c whose sysmeta is meta.
+func testNotifications(t *testing.T, config string, meta map[string]string) (func(method, path string, headers map[string]string) int, string) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	c, err := conf.StringConfig("[filter:notifications]\nenabled = true\nretry_interval = 0.05\nqueue_dir = " + dir + "\n" + config)
+	require.Nil(t, err)
+	mid, err := NewNotifications(c.GetSection("filter:notifications"), common.NewTestScope())
+	require.Nil(t, err)
+	handler := mid(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		for k, v := range r.Header {
+			if strings.HasPrefix(k, "X-Container-Sysmeta-") {
+				w.Header()[k] = v
+			}
+		}
+		w.Header().Set("Etag", "\"abc\"")
+		if r.Method == "DELETE" {
+			w.WriteHeader(204)
+		} else {
+			w.WriteHeader(201)
+		}
+	}))
+	f, err := client.NewProxyClient(staticPolicyList, srv.NewTestConfigLoader(&test.FakeRing{}),
+		nil, "", "", "", "", "", conf.Config{})
+	require.Nil(t, err)
+	return func(method, path string, headers map[string]string) int {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString("hello"))
+		require.Nil(t, err)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		req = req.WithContext(context.WithValue(req.Context(), "proxycontext", &ProxyContext{
+			Logger: zap.NewNop(),
+			TxId:   "tx1",
+			C:      f.NewRequestClient(nil, map[string]*client.ContainerInfo{"container/a/c": {SysMetadata: meta}}, zap.NewNop()),
+		}))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}, dir
+}
+
+func TestNotificationsWebhook(t *testing.T) {
+	var lock sync.Mutex
+	var events []NotificationEvent
+	fail := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		// the first try fails, so delivery depends on the retry queue
+		if fail {
+			fail = false
+			w.WriteHeader(500)
+			return
+		}
+		var event NotificationEvent
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&event))
+		events = append(events, event)
+	}))
+	defer ts.Close()
+	serve, dir := testNotifications(t, "webhook_hosts = 127.0.0.1\n", map[string]string{"Notify-Url": ts.URL + "/hook"})
+	defer os.RemoveAll(dir)
+
+	require.Equal(t, 201, serve("PUT", "/v1/a/c/o1", nil))
+	require.Equal(t, 204, serve("DELETE", "/v1/a/c/o2", nil))
+	for i := 0; i < 100; i++ {
+		lock.Lock()
+		n := len(events)
+		lock.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	require.Equal(t, 2, len(events))
+	// events to a destination keep their order when one has to be retried
+	require.Equal(t, "ObjectCreated", events[0].Event)
+	require.Equal(t, "o1", events[0].Object)
+	require.Equal(t, "abc", events[0].Etag)
+	require.Equal(t, 5, events[0].Bytes)
+	require.Equal(t, "ObjectRemoved", events[1].Event)
+	require.Equal(t, "o2", events[1].Object)
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	require.Nil(t, err)
+	require.Equal(t, 0, len(names))
+}
+
+func TestNotificationsEvents(t *testing.T) {
+	serve, dir := testNotifications(t, "webhook_hosts = 127.0.0.1\n", map[string]string{"Notify-Url": "http://127.0.0.1:1/hook", "Notify-Events": "delete"})
+	defer os.RemoveAll(dir)
+	require.Equal(t, 201, serve("PUT", "/v1/a/c/o", nil))
+	require.Equal(t, 204, serve("DELETE", "/v1/a/c/o", nil))
+	// only the delete is queued, and stays queued while it can't be delivered
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(names))
+	data, err := ioutil.ReadFile(names[0])
+	require.Nil(t, err)
+	var qn queuedNotification
+	require.Nil(t, json.Unmarshal(data, &qn))
+	require.Equal(t, "ObjectRemoved", qn.Event.Event)
+}
+
+func TestNotificationsCheckDestination(t *testing.T) {
+	serve, dir := testNotifications(t, "webhook_hosts = hooks.example.com\n", map[string]string{})
+	defer os.RemoveAll(dir)
+	require.Equal(t, 201, serve("POST", "/v1/a/c", map[string]string{"X-Container-Notify-Url": "https://hooks.example.com/x"}))
+	require.Equal(t, 400, serve("POST", "/v1/a/c", map[string]string{"X-Container-Notify-Url": "http://169.254.169.254/"}))
+	require.Equal(t, 400, serve("PUT", "/v1/a/c", map[string]string{"X-Container-Notify-Url": "kafka://topic"}))
+	require.Equal(t, 400, serve("PUT", "/v1/a/c", map[string]string{"X-Container-Notify-Url": "ftp://host/"}))
+
+	serve, dir = testNotifications(t, "", map[string]string{})
+	defer os.RemoveAll(dir)
+	require.Equal(t, 201, serve("POST", "/v1/a/c", map[string]string{"X-Container-Notify-Url": "https://hooks.example.com/x"}))
+	for _, u := range []string{"http://169.254.169.254/", "http://127.0.0.1:6000/", "http://10.1.2.3/", "http://[::1]/", "http://[fe80::1]/"} {
+		require.Equal(t, 400, serve("POST", "/v1/a/c", map[string]string{"X-Container-Notify-Url": u}), u)
+	}
+}
+
+func TestNotificationsSysmeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	c, err := conf.StringConfig("[filter:notifications]\nenabled = true\nqueue_dir = " + dir + "\n")
+	require.Nil(t, err)
+	mid, err := NewNotifications(c.GetSection("filter:notifications"), common.NewTestScope())
+	require.Nil(t, err)
+	var got http.Header
+	handler := mid(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+		w.Header().Set("X-Container-Sysmeta-Notify-Url", "https://hooks.example.com/x")
+		w.Header().Set("X-Container-Sysmeta-Notify-Events", "create")
+		w.WriteHeader(204)
+	}))
+	serve := func(method string, owner bool, headers map[string]string) http.Header {
+		req := httptest.NewRequest(method, "/v1/a/c", nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		req = req.WithContext(context.WithValue(req.Context(), "proxycontext", &ProxyContext{Logger: zap.NewNop(), StorageOwner: owner}))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Header()
+	}
+	serve("POST", true, map[string]string{"X-Container-Notify-Url": "https://hooks.example.com/x", "X-Container-Notify-Events": "create"})
+	require.Equal(t, "https://hooks.example.com/x", got.Get("X-Container-Sysmeta-Notify-Url"))
+	require.Equal(t, "create", got.Get("X-Container-Sysmeta-Notify-Events"))
+	require.Equal(t, "", got.Get("X-Container-Notify-Url"))
+	serve("POST", true, map[string]string{"X-Container-Notify-Url": ""})
+	_, ok := got["X-Container-Sysmeta-Notify-Url"]
+	require.True(t, ok)
+	require.Equal(t, "", got.Get("X-Container-Sysmeta-Notify-Url"))
+
+	h := serve("HEAD", true, nil)
+	require.Equal(t, "https://hooks.example.com/x", h.Get("X-Container-Notify-Url"))
+	require.Equal(t, "create", h.Get("X-Container-Notify-Events"))
+	h = serve("HEAD", false, nil)
+	require.Equal(t, "", h.Get("X-Container-Notify-Url"))
+	require.Equal(t, "create", h.Get("X-Container-Notify-Events"))
+}
+
+func TestNotificationsWebhookRefused(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Redirect(w, r, "http://169.254.169.254/", http.StatusFound)
+	}))
+	defer ts.Close()
+	event := &NotificationEvent{Event: "ObjectCreated", Account: "a", Container: "c", Object: "o"}
+	// Without webhook_hosts, the proxy's own network is off limits, even
+	// through a hostname.
+	n := &notifier{webhookClient: &http.Client{CheckRedirect: notifyNoRedirects, Transport: &http.Transport{DialContext: notifyDialContext}}}
+	require.NotNil(t, n.deliver(strings.Replace(ts.URL, "127.0.0.1", "localhost", 1), event))
+	require.Equal(t, 0, requests)
+	// With it, redirects aren't followed.
+	n = &notifier{webhookHosts: map[string]bool{"127.0.0.1": true}, webhookClient: &http.Client{CheckRedirect: notifyNoRedirects}}
+	err := n.deliver(ts.URL, event)
+	require.NotNil(t, err)
+	require.Equal(t, "Notification refused with status 302", err.Error())
+	require.Equal(t, 1, requests)
+}
+
+func TestNotificationsKafkaAndAmqp(t *testing.T) {
+	n := &notifier{client: http.DefaultClient, amqpVhost: "/"}
+	var got *http.Request
+	var body []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = ioutil.ReadAll(r.Body)
+		if r.URL.Path != "/topics/objects" {
+			w.Write([]byte(`{"routed": true}`))
+		}
+	}))
+	defer ts.Close()
+	n.kafkaRestUrl = ts.URL
+	n.amqpApiUrl = ts.URL
+	event := &NotificationEvent{Event: "ObjectCreated", Account: "a", Container: "c", Object: "o"}
+
+	require.Nil(t, n.deliver("kafka://objects", event))
+	require.Equal(t, "/topics/objects", got.URL.Path)
+	var records struct {
+		Records []struct {
+			Key   string            `json:"key"`
+			Value NotificationEvent `json:"value"`
+		} `json:"records"`
+	}
+	require.Nil(t, json.Unmarshal(body, &records))
+	require.Equal(t, "a/c/o", records.Records[0].Key)
+	require.Equal(t, "o", records.Records[0].Value.Object)
+
+	require.Nil(t, n.deliver("amqp://events/objects.created", event))
+	require.Equal(t, "/api/exchanges/%2F/events/publish", got.URL.EscapedPath())
+	var publish map[string]interface{}
+	require.Nil(t, json.Unmarshal(body, &publish))
+	require.Equal(t, "objects.created", publish["routing_key"])
+}
@@ -0,0 +1,479 @@
+package middleware
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+)
+
+// oidcMinRefresh is how soon the signing keys can be fetched again for a
+// token signed with a key that wasn't in them, which may have just been
+// rotated in.
+const oidcMinRefresh = 10 * time.Second
+
+var oidcHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+var oidcCurves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521(),
+}
+
+var oidcClaimRef = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// oidcIdentity is what a validated token's claims say about who sent it.
+type oidcIdentity struct {
+	Account     string
+	User        string
+	Roles       []string
+	cachedUntil time.Time
+}
+
+type oidcAuth struct {
+	next              http.Handler
+	client            *http.Client
+	issuer            string
+	audience          string
+	accountFormat     string
+	userClaim         string
+	rolesClaim        string
+	operatorRoles     []string
+	readerRoles       []string
+	resellerAdminRole string
+	leeway            time.Duration
+	jwksCacheTime     time.Duration
+	tokenCacheTime    time.Duration
+	maxCachedTokens   int
+	validations       tally.Counter
+	failures          tally.Counter
+
+	lock        sync.Mutex
+	jwksURI     string
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+	tokens      map[string]*oidcIdentity
+}
+
+func bearerToken(request *http.Request) string {
+	auth := request.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+func (o *oidcAuth) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	ctx := GetProxyContext(request)
+	token := bearerToken(request)
+	if ctx == nil || ctx.Authorize != nil || token == "" {
+		o.next.ServeHTTP(writer, request)
+		return
+	}
+	id, err := o.identity(request.Context(), token)
+	if err != nil {
+		o.failures.Inc(1)
+		ctx.Logger.Debug("Invalid bearer token", zap.Error(err))
+		ctx.Authorize = func(r *http.Request) (bool, int) {
+			return false, http.StatusUnauthorized
+		}
+	} else {
+		ctx.RemoteUsers = append([]string{id.User}, id.Roles...)
+		ctx.Authorize = func(r *http.Request) (bool, int) {
+			return o.authorize(r, id)
+		}
+	}
+	o.next.ServeHTTP(writer, request)
+}
+
+func (o *oidcAuth) authorize(r *http.Request, id *oidcIdentity) (bool, int) {
+	pathParts, err := common.ParseProxyPath(r.URL.Path)
+	if err != nil {
+		return false, http.StatusNotFound
+	}
+	if r.Method == "OPTIONS" {
+		return true, http.StatusOK
+	}
+	ctx := GetProxyContext(r)
+	if ctx == nil {
+		return false, http.StatusUnauthorized
+	}
+	if o.resellerAdminRole != "" && common.StringInSlice(o.resellerAdminRole, id.Roles) {
+		ctx.StorageOwner = true
+		return true, http.StatusOK
+	}
+	if id.Account != "" && pathParts["account"] == id.Account {
+		// Owners can't PUT or DELETE their own account.
+		if hasAnyRole(o.operatorRoles, id.Roles) && (pathParts["container"] != "" || (r.Method != "PUT" && r.Method != "DELETE")) {
+			ctx.StorageOwner = true
+			return true, http.StatusOK
+		}
+		if (r.Method == "GET" || r.Method == "HEAD") && hasAnyRole(o.readerRoles, id.Roles) {
+			return true, http.StatusOK
+		}
+	}
+	referrers, roles := ParseACL(ctx.ACL)
+	if auth, _ := AuthorizeUnconfirmedIdentity(r, pathParts["object"], referrers, roles); auth {
+		return true, http.StatusOK
+	}
+	for _, ru := range ctx.RemoteUsers {
+		if common.StringInSlice(ru, roles) {
+			return true, http.StatusOK
+		}
+	}
+	return false, http.StatusForbidden
+}
+
+// identity returns who token says sent it, from the cache if it's been
+// validated within tokenCacheTime.
+func (o *oidcAuth) identity(ctx context.Context, token string) (*oidcIdentity, error) {
+	now := time.Now()
+	o.lock.Lock()
+	id := o.tokens[token]
+	o.lock.Unlock()
+	if id != nil && now.Before(id.cachedUntil) {
+		return id, nil
+	}
+	claims, err := o.validate(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	o.validations.Inc(1)
+	if id, err = o.mapClaims(claims); err != nil {
+		return nil, err
+	}
+	id.cachedUntil = now.Add(o.tokenCacheTime)
+	if exp, ok := claims["exp"].(float64); ok && time.Unix(int64(exp), 0).Before(id.cachedUntil) {
+		id.cachedUntil = time.Unix(int64(exp), 0)
+	}
+	o.lock.Lock()
+	if len(o.tokens) >= o.maxCachedTokens {
+		for t, cached := range o.tokens {
+			if !now.Before(cached.cachedUntil) {
+				delete(o.tokens, t)
+			}
+		}
+		if len(o.tokens) >= o.maxCachedTokens {
+			o.tokens = map[string]*oidcIdentity{}
+		}
+	}
+	o.tokens[token] = id
+	o.lock.Unlock()
+	return id, nil
+}
+
+// validate checks token's signature against the issuer's keys, and that its
+// claims are for this audience and current, and returns the claims.
+func (o *oidcAuth) validate(ctx context.Context, token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("token isn't a JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid token header: %v", err)
+	}
+	hash, ok := oidcHashes[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported token alg %q", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid token signature: %v", err)
+	}
+	key, err := o.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	digest := h.Sum(nil)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(header.Alg, "RS") || rsa.VerifyPKCS1v15(k, hash, digest, sig) != nil {
+			return nil, errors.New("bad token signature")
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(header.Alg, "ES") || len(sig) != 2*size ||
+			!ecdsa.Verify(k, digest, new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])) {
+			return nil, errors.New("bad token signature")
+		}
+	default:
+		return nil, errors.New("bad token signature")
+	}
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid token claims: %v", err)
+	}
+	if iss, _ := claims["iss"].(string); iss != o.issuer {
+		return nil, fmt.Errorf("token issued by %q", iss)
+	}
+	if o.audience != "" && !oidcAudienceMatches(claims["aud"], o.audience) {
+		return nil, fmt.Errorf("token not for audience %q", o.audience)
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(o.leeway)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(o.leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token not valid yet")
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func oidcAudienceMatches(aud interface{}, audience string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == audience
+	case []interface{}:
+		for _, v := range a {
+			if s, ok := v.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// oidcClaim returns the claim at path, with dots between the names of
+// nested claims, like realm_access.roles.
+func oidcClaim(claims map[string]interface{}, path string) interface{} {
+	var v interface{} = claims
+	for _, name := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[name]
+	}
+	return v
+}
+
+// mapClaims works out the token's user, account and roles from its claims,
+// as the config says to.
+func (o *oidcAuth) mapClaims(claims map[string]interface{}) (*oidcIdentity, error) {
+	id := &oidcIdentity{}
+	if id.User, _ = oidcClaim(claims, o.userClaim).(string); id.User == "" {
+		return nil, fmt.Errorf("token has no %s claim", o.userClaim)
+	}
+	complete := true
+	account := oidcClaimRef.ReplaceAllStringFunc(o.accountFormat, func(ref string) string {
+		s, _ := oidcClaim(claims, ref[1:len(ref)-1]).(string)
+		if s == "" {
+			complete = false
+		}
+		return s
+	})
+	if complete {
+		id.Account = account
+	}
+	switch roles := oidcClaim(claims, o.rolesClaim).(type) {
+	case []interface{}:
+		for _, role := range roles {
+			if s, ok := role.(string); ok {
+				id.Roles = append(id.Roles, strings.ToLower(s))
+			}
+		}
+	case string:
+		for _, role := range strings.Fields(strings.Replace(roles, ",", " ", -1)) {
+			id.Roles = append(id.Roles, strings.ToLower(role))
+		}
+	}
+	return id, nil
+}
+
+// key returns the issuer's signing key with the given id, fetching them
+// again once they're older than jwksCacheTime, or for an id that isn't
+// among them.
+func (o *oidcAuth) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	o.lock.Lock()
+	key, ok := findOIDCKey(o.keys, kid)
+	age := time.Since(o.keysFetched)
+	o.lock.Unlock()
+	if ok && age < o.jwksCacheTime {
+		return key, nil
+	} else if !ok && o.keys != nil && age < oidcMinRefresh {
+		return nil, fmt.Errorf("no signing key %q", kid)
+	}
+	keys, err := o.fetchKeys(ctx)
+	if err != nil {
+		if ok {
+			// Better to keep using the keys we have than fail every request
+			// while the issuer can't be reached.
+			return key, nil
+		}
+		return nil, err
+	}
+	o.lock.Lock()
+	o.keys = keys
+	o.keysFetched = time.Now()
+	o.lock.Unlock()
+	if key, ok = findOIDCKey(keys, kid); !ok {
+		return nil, fmt.Errorf("no signing key %q", kid)
+	}
+	return key, nil
+}
+
+// findOIDCKey finds the key with the given id, or the only key if the
+// token didn't say which.
+func findOIDCKey(keys map[string]crypto.PublicKey, kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, true
+		}
+	}
+	key, ok := keys[kid]
+	return key, ok
+}
+
+func (o *oidcAuth) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := o.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("GET %s: %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (o *oidcAuth) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	o.lock.Lock()
+	jwksURI := o.jwksURI
+	o.lock.Unlock()
+	if jwksURI == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := o.getJSON(ctx, strings.TrimSuffix(o.issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, err
+		} else if discovery.JWKSURI == "" {
+			return nil, errors.New("issuer's openid-configuration has no jwks_uri")
+		}
+		jwksURI = discovery.JWKSURI
+		o.lock.Lock()
+		o.jwksURI = jwksURI
+		o.lock.Unlock()
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := o.getJSON(ctx, jwksURI, &jwks); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil || len(e) > 4 {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			curve, ok := oidcCurves[k.Crv]
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if !ok || errX != nil || errY != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	return keys, nil
+}
+
+func NewOIDCAuth(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	if !config.GetBool("enabled", false) {
+		return func(next http.Handler) http.Handler { return next }, nil
+	}
+	issuer := config.GetDefault("issuer", "")
+	if issuer == "" {
+		return nil, errors.New("oidcauth needs an issuer")
+	}
+	var operatorRoles, readerRoles []string
+	for _, role := range strings.Split(strings.ToLower(config.GetDefault("operator_roles", "admin, swiftoperator")), ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			operatorRoles = append(operatorRoles, role)
+		}
+	}
+	for _, role := range strings.Split(strings.ToLower(config.GetDefault("reader_roles", "")), ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			readerRoles = append(readerRoles, role)
+		}
+	}
+	validations := metricsScope.Counter("oidc_validations")
+	failures := metricsScope.Counter("oidc_failures")
+	return func(next http.Handler) http.Handler {
+		return &oidcAuth{
+			next:              next,
+			client:            &http.Client{Timeout: 5 * time.Second},
+			issuer:            issuer,
+			audience:          config.GetDefault("audience", ""),
+			accountFormat:     config.GetDefault("account_format", "AUTH_{sub}"),
+			userClaim:         config.GetDefault("user_claim", "sub"),
+			rolesClaim:        config.GetDefault("roles_claim", "roles"),
+			operatorRoles:     operatorRoles,
+			readerRoles:       readerRoles,
+			resellerAdminRole: strings.ToLower(config.GetDefault("reseller_admin_role", "")),
+			leeway:            time.Duration(config.GetFloat("leeway", 60) * float64(time.Second)),
+			jwksCacheTime:     time.Duration(config.GetFloat("jwks_cache_time", 3600) * float64(time.Second)),
+			tokenCacheTime:    time.Duration(config.GetFloat("token_cache_time", 300) * float64(time.Second)),
+			maxCachedTokens:   int(config.GetInt("max_cached_tokens", 10000)),
+			validations:       validations,
+			failures:          failures,
+			jwksURI:           config.GetDefault("jwks_uri", ""),
+			tokens:            map[string]*oidcIdentity{},
+		}
+	}, nil
+}
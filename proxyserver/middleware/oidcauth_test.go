@@ -0,0 +1,148 @@
+package middleware
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+)
+
+func signTestJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	require.Nil(t, err)
+	payload, err := json.Marshal(claims)
+	require.Nil(t, err)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		require.Nil(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		require.Nil(t, err)
+		sig = make([]byte, 64)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(sig[32-len(rb):], rb)
+		copy(sig[64-len(sb):], sb)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOIDCAuth(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	jwksFetches := 0
+	var issuer string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": issuer, "jwks_uri": issuer + "/keys"})
+		case "/keys":
+			jwksFetches++
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+				{"kty": "RSA", "kid": "rsa1", "use": "sig",
+					"n": base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+					"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes())},
+				{"kty": "EC", "kid": "ec1", "crv": "P-256",
+					"x": base64.RawURLEncoding.EncodeToString(ecKey.X.Bytes()),
+					"y": base64.RawURLEncoding.EncodeToString(ecKey.Y.Bytes())},
+			}})
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer ts.Close()
+	issuer = ts.URL
+
+	config, err := conf.StringConfig("[filter:oidcauth]\nenabled = true\nissuer = " + issuer +
+		"\naudience = hummingbird\naccount_format = AUTH_{tenant}\nroles_claim = realm_access.roles\nreader_roles = reader\n")
+	require.Nil(t, err)
+	passthrough := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	mid, err := NewOIDCAuth(config.GetSection("filter:oidcauth"), common.NewTestScope())
+	require.Nil(t, err)
+	handler := mid(passthrough)
+	authorize := func(method, path, token, acl string) (bool, int, *ProxyContext) {
+		fakeContext := NewFakeProxyContext(passthrough)
+		req := httptest.NewRequest(method, path, nil)
+		req = req.WithContext(context.WithValue(req.Context(), "proxycontext", fakeContext))
+		req.Header.Set("Authorization", "Bearer "+token)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		require.NotNil(t, fakeContext.Authorize)
+		fakeContext.ACL = acl
+		ok, status := fakeContext.Authorize(req)
+		return ok, status, fakeContext
+	}
+	claims := func(roles ...string) map[string]interface{} {
+		return map[string]interface{}{"iss": issuer, "aud": []string{"hummingbird", "other"}, "sub": "alice", "tenant": "acme",
+			"exp": time.Now().Add(time.Hour).Unix(), "realm_access": map[string]interface{}{"roles": roles}}
+	}
+
+	token := signTestJWT(t, "RS256", "rsa1", rsaKey, claims("Admin"))
+	ok, _, ctx := authorize("PUT", "/v1/AUTH_acme/c", token, "")
+	require.True(t, ok)
+	require.True(t, ctx.StorageOwner)
+	require.Equal(t, []string{"alice", "admin"}, ctx.RemoteUsers)
+	ok, status, _ := authorize("GET", "/v1/AUTH_other/c", token, "")
+	require.False(t, ok)
+	require.Equal(t, 403, status)
+	ok, _, _ = authorize("GET", "/v1/AUTH_other/c", token, "alice")
+	require.True(t, ok)
+	// Owners can't delete their own account.
+	ok, _, _ = authorize("DELETE", "/v1/AUTH_acme", token, "")
+	require.False(t, ok)
+	// Validated tokens are cached, and so are the keys.
+	require.Equal(t, 1, jwksFetches)
+
+	token = signTestJWT(t, "ES256", "ec1", ecKey, claims("reader"))
+	ok, _, ctx = authorize("GET", "/v1/AUTH_acme/c/o", token, "")
+	require.True(t, ok)
+	require.False(t, ctx.StorageOwner)
+	ok, _, _ = authorize("PUT", "/v1/AUTH_acme/c/o", token, "")
+	require.False(t, ok)
+
+	bad := claims("admin")
+	bad["exp"] = time.Now().Add(-time.Hour).Unix()
+	ok, status, _ = authorize("GET", "/v1/AUTH_acme/c", signTestJWT(t, "RS256", "rsa1", rsaKey, bad), "")
+	require.False(t, ok)
+	require.Equal(t, 401, status)
+	bad = claims("admin")
+	bad["aud"] = "other"
+	ok, _, _ = authorize("GET", "/v1/AUTH_acme/c", signTestJWT(t, "RS256", "rsa1", rsaKey, bad), "")
+	require.False(t, ok)
+	bad = claims("admin")
+	bad["iss"] = "https://evil.example.com"
+	ok, _, _ = authorize("GET", "/v1/AUTH_acme/c", signTestJWT(t, "RS256", "rsa1", rsaKey, bad), "")
+	require.False(t, ok)
+	// Signed with the wrong key, or claiming a different alg.
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	ok, _, _ = authorize("GET", "/v1/AUTH_acme/c", signTestJWT(t, "RS256", "rsa1", otherKey, claims("admin")), "")
+	require.False(t, ok)
+	ok, _, _ = authorize("GET", "/v1/AUTH_acme/c", signTestJWT(t, "ES256", "rsa1", ecKey, claims("admin")), "")
+	require.False(t, ok)
+
+	// Requests without a bearer token are left to the other auth middleware.
+	fakeContext := NewFakeProxyContext(passthrough)
+	req := httptest.NewRequest("GET", "/v1/AUTH_acme/c", nil)
+	req = req.WithContext(context.WithValue(req.Context(), "proxycontext", fakeContext))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	require.Nil(t, fakeContext.Authorize)
+}
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/troubling/hummingbird/common"
@@ -31,7 +32,6 @@ import (
 )
 
 const rateBuffer = int64(5 * time.Second)
-const maxSleep = int64(60 * time.Second)
 const nsPerSecond = int64(1000000000)
 
 var writeMethods = map[string]bool{"PUT": true, "DELETE": true, "POST": true}
@@ -45,6 +45,9 @@ var writeMethods = map[string]bool{"PUT": true, "DELETE": true, "POST": true}
 type ratelimiter struct {
 	accountLimit   int64
 	containerLimit int64
+	maxSleep       int64
+	whitelist      map[string]bool
+	blacklist      map[string]bool
 	next           http.Handler
 }
 
@@ -101,6 +104,15 @@ func (r *ratelimiter) ServeHTTP(writer http.ResponseWriter, request *http.Reques
 			"ratelimit/%s/%s", pathParts["account"], pathParts["container"])
 		limit = r.containerLimit
 	}
+	if r.blacklist[pathParts["account"]] {
+		sleep(time.Second)
+		srv.StandardResponse(writer, 497)
+		return
+	}
+	if r.whitelist[pathParts["account"]] {
+		r.next.ServeHTTP(writer, request)
+		return
+	}
 	ai, err := ctx.GetAccountInfo(request.Context(), pathParts["account"])
 	if err != nil {
 		ctx.Logger.Debug("Error ratelimiter getting account info", zap.Error(err))
@@ -125,9 +137,11 @@ func (r *ratelimiter) ServeHTTP(writer http.ResponseWriter, request *http.Reques
 	if limit > 0 {
 		sleepTime, err := r.getSleepTime(request.Context(), ctx.Cache, ratekey, limit)
 		if err == nil {
-			if sleepTime > maxSleep {
-				sleep(time.Second)
-				srv.StandardResponse(writer, 498)
+			if sleepTime > r.maxSleep {
+				// This request won't be served, so give back its place.
+				ctx.Cache.Decr(request.Context(), ratekey, nsPerSecond/limit, 3600)
+				writer.Header().Set("Retry-After", strconv.FormatInt((sleepTime-r.maxSleep+nsPerSecond-1)/nsPerSecond, 10))
+				srv.SimpleErrorResponse(writer, http.StatusTooManyRequests, "Slow down.")
 				return
 			}
 			sleep(time.Duration(sleepTime))
@@ -138,15 +152,32 @@ func (r *ratelimiter) ServeHTTP(writer http.ResponseWriter, request *http.Reques
 	r.next.ServeHTTP(writer, request)
 }
 
+// accountSet reads a comma-separated list of accounts.
+func accountSet(list string) map[string]bool {
+	accounts := map[string]bool{}
+	for _, account := range strings.Split(list, ",") {
+		if account = strings.TrimSpace(account); account != "" {
+			accounts[account] = true
+		}
+	}
+	return accounts
+}
+
 func NewRatelimiter(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
 
 	accLimit := int64(config.GetInt("account_db_max_writes_per_sec", 0))
 	contLimit := int64(config.GetInt("container_db_max_writes_per_sec", 0))
-	RegisterInfo("ratelimit", map[string]interface{}{"account_ratelimit": accLimit, "container_ratelimits": [][]int64{{contLimit}}, "max_sleep_time_seconds": float64(60.0)})
+	maxSleepSeconds := config.GetFloat("max_sleep_time_seconds", 60)
+	whitelist := accountSet(config.GetDefault("account_whitelist", ""))
+	blacklist := accountSet(config.GetDefault("account_blacklist", ""))
+	RegisterInfo("ratelimit", map[string]interface{}{"account_ratelimit": accLimit, "container_ratelimits": [][]int64{{contLimit}}, "max_sleep_time_seconds": maxSleepSeconds})
 	return func(next http.Handler) http.Handler {
 		return &ratelimiter{
 			accountLimit:   accLimit,
 			containerLimit: contLimit,
+			maxSleep:       int64(maxSleepSeconds * float64(time.Second)),
+			whitelist:      whitelist,
+			blacklist:      blacklist,
 			next:           next,
 		}
 	}, nil
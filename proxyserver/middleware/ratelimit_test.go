@@ -18,11 +18,16 @@ package middleware
 import (
 	"context"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
 	"github.com/troubling/hummingbird/common/test"
+	"go.uber.org/zap"
 )
 
 var now = 10 * nsPerSecond
@@ -76,15 +81,21 @@ func TestGetSleepTime(t *testing.T) {
 	assert.Equal(t, fakeMr.MockSetValues[0], now+nsPerSecond/1000)
 }
 
-/*
-TODO:
-need to figure out a decent way to put the FakeMemcacheRing
-into the request's context
-
-func TestServeHTTP(t *testing.T) {
-	fakeMr := test.FakeMemcacheRing{MockIncrResults: []int64{now + 2000}}
+func serveRatelimit(rt *ratelimiter, mc *test.FakeMemcacheRing, sysmeta map[string]string, method, path string) *http.Response {
+	ctx := &ProxyContext{
+		ProxyContextMiddleware: &ProxyContextMiddleware{Cache: mc},
+		Logger:                 zap.NewNop(),
+		accountInfoCache:       map[string]*AccountInfo{"account/a": {SysMetadata: sysmeta}},
+	}
+	rt.next = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(204) })
+	req := httptest.NewRequest(method, path, nil)
+	req = req.WithContext(context.WithValue(req.Context(), "proxycontext", ctx))
+	w := httptest.NewRecorder()
+	rt.ServeHTTP(w, req)
+	return w.Result()
+}
 
-	rt := ratelimiter{accountLimit: 10, containerLimit: 100, mc: &fakeMr}
+func TestRatelimitServeHTTP(t *testing.T) {
 	oldSleep := sleep
 	oldNowNano := nowNano
 	defer func() {
@@ -94,34 +105,52 @@ func TestServeHTTP(t *testing.T) {
 	s := sleeper{}
 	sleep = s.fakeSleep
 	nowNano = fakeNowNano
-	fakeWriter := test.MockResponseWriter{}
-	rt.next = FakeHandler{}
-
-	req, _ := http.NewRequest("GET", "/v/a/co", nil)
-	rt.ServeHTTP(fakeWriter, req)
-	assert.Equal(t, len(s.SleepVals), 0)
-	assert.Equal(t, len(fakeMr.MockIncrKeys), 0)
-
-	req, _ = http.NewRequest("PUT", "/v/a/c", nil)
-	rt.ServeHTTP(fakeWriter, req)
-	assert.Equal(t, len(s.SleepVals), 1)
-
-	rt.accountLimit = 0
-	rt.ServeHTTP(fakeWriter, req)
-	assert.Equal(t, len(s.SleepVals), 1)
-
-	req, _ = http.NewRequest("PUT", "/v/a/c/o", nil)
-	rt.ServeHTTP(fakeWriter, req)
-	assert.Equal(t, len(s.SleepVals), 2)
-
-	assert.Equal(t, fakeMr.MockIncrKeys[0], "ratelimit/a")
-	assert.Equal(t, fakeMr.MockIncrKeys[1], "ratelimit/a/c")
-
-	fakeMr = test.FakeMemcacheRing{MockIncrResults: []int64{now + 2000 + MaxSleep}}
-	rt.mc = &fakeMr
-	req, _ = http.NewRequest("PUT", "/v/a/c/o", nil)
-	rt.ServeHTTP(fakeWriter, req)
-	assert.Equal(t, len(s.SleepVals), 3)
-	assert.Equal(t, s.SleepVals[len(s.SleepVals)-1], time.Second)
+	rt := &ratelimiter{accountLimit: 10, containerLimit: 100, maxSleep: int64(60 * time.Second),
+		whitelist: map[string]bool{}, blacklist: map[string]bool{}}
+
+	mc := &test.FakeMemcacheRing{MockIncrResults: []int64{now + 2000}}
+	require.Equal(t, 204, serveRatelimit(rt, mc, nil, "GET", "/v1/a/c").StatusCode)
+	require.Equal(t, 0, len(mc.MockIncrKeys))
+
+	require.Equal(t, 204, serveRatelimit(rt, mc, nil, "PUT", "/v1/a/c").StatusCode)
+	require.Equal(t, []string{"ratelimit/a"}, mc.MockIncrKeys)
+	require.Equal(t, []time.Duration{2000}, s.SleepVals)
+
+	mc = &test.FakeMemcacheRing{MockIncrResults: []int64{now + 2000}}
+	require.Equal(t, 204, serveRatelimit(rt, mc, nil, "PUT", "/v1/a/c/o").StatusCode)
+	require.Equal(t, []string{"ratelimit/a/c"}, mc.MockIncrKeys)
+
+	// Too far behind to wait, so the client's told when to come back.
+	mc = &test.FakeMemcacheRing{MockIncrResults: []int64{now + int64(90*time.Second)}}
+	resp := serveRatelimit(rt, mc, nil, "PUT", "/v1/a/c/o")
+	require.Equal(t, 429, resp.StatusCode)
+	require.Equal(t, "30", resp.Header.Get("Retry-After"))
+	require.Equal(t, 2, len(s.SleepVals))
+
+	// The account's own limit replaces the configured ones.
+	mc = &test.FakeMemcacheRing{MockIncrResults: []int64{now}}
+	require.Equal(t, 204, serveRatelimit(rt, mc, map[string]string{"Global-Write-Ratelimit": "5"}, "PUT", "/v1/a/c/o").StatusCode)
+	require.Equal(t, []string{"ratelimit/global/a"}, mc.MockIncrKeys)
+
+	mc = &test.FakeMemcacheRing{}
+	require.Equal(t, 204, serveRatelimit(rt, mc, map[string]string{"Global-Write-Ratelimit": "WHITELIST"}, "PUT", "/v1/a/c/o").StatusCode)
+	require.Equal(t, 497, serveRatelimit(rt, mc, map[string]string{"Global-Write-Ratelimit": "BLACKLIST"}, "PUT", "/v1/a/c/o").StatusCode)
+	require.Equal(t, 0, len(mc.MockIncrKeys))
+
+	rt.whitelist["a"] = true
+	require.Equal(t, 204, serveRatelimit(rt, mc, nil, "PUT", "/v1/a/c/o").StatusCode)
+	require.Equal(t, 0, len(mc.MockIncrKeys))
+	rt.blacklist["a"] = true
+	require.Equal(t, 497, serveRatelimit(rt, mc, nil, "PUT", "/v1/a/c/o").StatusCode)
+}
+
+func TestNewRatelimiter(t *testing.T) {
+	config, err := conf.StringConfig("[filter:ratelimit]\naccount_whitelist = a, b\naccount_blacklist = c\nmax_sleep_time_seconds = 2.5\n")
+	require.Nil(t, err)
+	rl, err := NewRatelimiter(config.GetSection("filter:ratelimit"), common.NewTestScope())
+	require.Nil(t, err)
+	rt := rl(nil).(*ratelimiter)
+	require.Equal(t, map[string]bool{"a": true, "b": true}, rt.whitelist)
+	require.Equal(t, map[string]bool{"c": true}, rt.blacklist)
+	require.Equal(t, int64(2500*time.Millisecond), rt.maxSleep)
 }
-*/
@@ -0,0 +1,297 @@
+package middleware
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/uber-go/tally"
+)
+
+// responseCacheListingParams are the query parameters a cached container
+// listing may have. Requests with any others aren't cached.
+var responseCacheListingParams = map[string]bool{"format": true, "prefix": true, "delimiter": true, "marker": true,
+	"end_marker": true, "limit": true, "reverse": true, "path": true}
+
+// responseCacheSkipHeaders are set for each request by the proxy, so they
+// aren't kept with a cached response.
+var responseCacheSkipHeaders = map[string]bool{"X-Trans-Id": true, "X-Openstack-Request-Id": true, "X-Trace-Id": true, "Date": true, "Set-Cookie": true}
+
+type cachedResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+// responseCacheStore is where cached responses, and the generations that
+// invalidate them, are kept.
+type responseCacheStore interface {
+	get(ctx context.Context, key string) ([]byte, bool)
+	set(ctx context.Context, key string, value []byte, ttl time.Duration)
+}
+
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// lruStore is an in-process responseCacheStore holding up to maxSize bytes,
+// dropping the least recently used entries to make room.
+type lruStore struct {
+	lock    sync.Mutex
+	maxSize int
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func newLRUStore(maxSize int) *lruStore {
+	return &lruStore{maxSize: maxSize, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (s *lruStore) remove(e *list.Element) {
+	entry := s.order.Remove(e).(*lruEntry)
+	delete(s.entries, entry.key)
+	s.size -= len(entry.key) + len(entry.value)
+}
+
+func (s *lruStore) get(ctx context.Context, key string) ([]byte, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*lruEntry)
+	if time.Now().After(entry.expires) {
+		s.remove(e)
+		return nil, false
+	}
+	s.order.MoveToFront(e)
+	return entry.value, true
+}
+
+func (s *lruStore) set(ctx context.Context, key string, value []byte, ttl time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if e, ok := s.entries[key]; ok {
+		s.remove(e)
+	}
+	if len(key)+len(value) > s.maxSize {
+		return
+	}
+	s.entries[key] = s.order.PushFront(&lruEntry{key: key, value: value, expires: time.Now().Add(ttl)})
+	s.size += len(key) + len(value)
+	for s.size > s.maxSize {
+		s.remove(s.order.Back())
+	}
+}
+
+// memcacheStore keeps the cache in the proxies' memcache, so they share it.
+type memcacheStore struct {
+	mc ring.MemcacheRing
+}
+
+func (s memcacheStore) get(ctx context.Context, key string) ([]byte, bool) {
+	var value []byte
+	if err := s.mc.GetStructured(ctx, key, &value); err != nil || value == nil {
+		return nil, false
+	}
+	return value, true
+}
+
+func (s memcacheStore) set(ctx context.Context, key string, value []byte, ttl time.Duration) {
+	s.mc.Set(ctx, key, value, int((ttl+time.Second-1)/time.Second))
+}
+
+// responseCacheWriter passes a response on while keeping a copy of it, as
+// long as it stays under max bytes.
+type responseCacheWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+	max    int
+	tooBig bool
+}
+
+func (w *responseCacheWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseCacheWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.tooBig {
+		if w.body.Len()+len(b) > w.max {
+			w.tooBig = true
+			w.body.Reset()
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+type responseCache struct {
+	next http.Handler
+	// lru is the in-process store; without it, responses are kept in
+	// memcache.
+	lru           *lruStore
+	ttl           time.Duration
+	maxObjectSize int
+	hits          tally.Counter
+	misses        tally.Counter
+	invalidations tally.Counter
+}
+
+// responseCacheAuthHeaders are the headers a request can authenticate with;
+// requests with any of them aren't anonymous, so aren't cached.
+var responseCacheAuthHeaders = []string{"X-Auth-Token", "X-Storage-Token", "X-Service-Token", "Authorization"}
+
+// cacheable reports whether the request could be answered the same for
+// anyone, so its response can be cached.
+func (rc *responseCache) cacheable(request *http.Request, container, obj string) bool {
+	for _, h := range responseCacheAuthHeaders {
+		if request.Header.Get(h) != "" {
+			return false
+		}
+	}
+	if request.Method != "GET" || container == "" || request.Header.Get("Range") != "" ||
+		request.Header.Get("If-Match") != "" || request.Header.Get("If-None-Match") != "" ||
+		request.Header.Get("If-Modified-Since") != "" || request.Header.Get("If-Unmodified-Since") != "" ||
+		request.Header.Get("X-Newest") != "" {
+		return false
+	}
+	for k := range request.URL.Query() {
+		if obj != "" || !responseCacheListingParams[k] {
+			return false
+		}
+	}
+	return true
+}
+
+// generation is the container's cache generation, which changes whenever
+// the container or one of its objects is written through a proxy sharing
+// the store.
+func (rc *responseCache) generation(ctx context.Context, store responseCacheStore, account, container string) string {
+	gen, _ := store.get(ctx, fmt.Sprintf("respcache/gen/%s/%s", account, container))
+	return string(gen)
+}
+
+func (rc *responseCache) invalidate(ctx context.Context, store responseCacheStore, account, container string) {
+	rc.invalidations.Inc(1)
+	// Outlasting the responses cached under an older generation means they
+	// can't come back when it expires.
+	store.set(ctx, fmt.Sprintf("respcache/gen/%s/%s", account, container), []byte(strconv.FormatInt(time.Now().UnixNano(), 10)), 2*rc.ttl)
+}
+
+func (rc *responseCache) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	apiReq, account, container, obj := getPathParts(request)
+	if !apiReq || container == "" {
+		rc.next.ServeHTTP(writer, request)
+		return
+	}
+	ctx := request.Context()
+	var store responseCacheStore
+	if rc.lru != nil {
+		store = rc.lru
+	} else {
+		store = memcacheStore{mc: GetProxyContext(request).Cache}
+	}
+	if request.Method == "PUT" || request.Method == "POST" || request.Method == "DELETE" || request.Method == "COPY" {
+		rc.next.ServeHTTP(writer, request)
+		rc.invalidate(ctx, store, account, container)
+		return
+	}
+	if !rc.cacheable(request, container, obj) {
+		rc.next.ServeHTTP(writer, request)
+		return
+	}
+	// Referrer ACLs can make the answer depend on the Referer, and CORS on
+	// the Origin.
+	key := fmt.Sprintf("respcache/%s/%s?%s&accept=%s&referer=%s&origin=%s", rc.generation(ctx, store, account, container),
+		request.URL.EscapedPath(), request.URL.RawQuery, request.Header.Get("Accept"), request.Header.Get("Referer"),
+		request.Header.Get("Origin"))
+	if value, ok := store.get(ctx, key); ok {
+		var cached cachedResponse
+		if err := json.Unmarshal(value, &cached); err == nil {
+			rc.hits.Inc(1)
+			for k, v := range cached.Header {
+				writer.Header()[k] = v
+			}
+			writer.Header().Set("Content-Length", strconv.Itoa(len(cached.Body)))
+			writer.WriteHeader(cached.Status)
+			writer.Write(cached.Body)
+			return
+		}
+	}
+	rc.misses.Inc(1)
+	w := &responseCacheWriter{ResponseWriter: writer, max: rc.maxObjectSize}
+	rc.next.ServeHTTP(w, request)
+	if w.status != http.StatusOK || w.tooBig {
+		return
+	}
+	// Only keep what was served to an anonymous request; an auth middleware
+	// further on may have found an identity some other way.
+	if pc := GetProxyContext(request); pc != nil && (len(pc.RemoteUsers) > 0 || pc.StorageOwner) {
+		return
+	}
+	cacheControl := strings.ToLower(writer.Header().Get("Cache-Control"))
+	if strings.Contains(cacheControl, "private") || strings.Contains(cacheControl, "no-store") || strings.Contains(cacheControl, "no-cache") {
+		return
+	}
+	if cl := writer.Header().Get("Content-Length"); cl != "" && cl != strconv.Itoa(w.body.Len()) {
+		return
+	}
+	cached := cachedResponse{Status: w.status, Header: http.Header{}, Body: w.body.Bytes()}
+	for k, v := range writer.Header() {
+		if !responseCacheSkipHeaders[k] {
+			cached.Header[k] = v
+		}
+	}
+	if value, err := json.Marshal(cached); err == nil {
+		store.set(ctx, key, value, rc.ttl)
+	}
+}
+
+func NewResponseCache(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	if !config.GetBool("enabled", false) {
+		return func(next http.Handler) http.Handler { return next }, nil
+	}
+	var lru *lruStore
+	switch backend := config.GetDefault("backend", "memory"); backend {
+	case "memory":
+		lru = newLRUStore(int(config.GetInt("max_size", 64*1024*1024)))
+	case "memcache":
+	default:
+		return nil, fmt.Errorf("Unknown response cache backend %q", backend)
+	}
+	ttl := time.Duration(config.GetFloat("ttl", 60) * float64(time.Second))
+	maxObjectSize := int(config.GetInt("max_object_size", 64*1024))
+	hits := metricsScope.Counter("response_cache_hits")
+	misses := metricsScope.Counter("response_cache_misses")
+	invalidations := metricsScope.Counter("response_cache_invalidations")
+	return func(next http.Handler) http.Handler {
+		return &responseCache{
+			next:          next,
+			lru:           lru,
+			ttl:           ttl,
+			maxObjectSize: maxObjectSize,
+			hits:          hits,
+			misses:        misses,
+			invalidations: invalidations,
+		}
+	}, nil
+}
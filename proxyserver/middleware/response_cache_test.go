@@ -0,0 +1,176 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/test"
+)
+
+// responseCacheMemcache keeps what's set in it.
+type responseCacheMemcache struct {
+	*test.FakeMemcacheRing
+	values map[string][]byte
+}
+
+func (mc *responseCacheMemcache) Set(ctx context.Context, key string, value interface{}, timeout int) error {
+	mc.values[key], _ = json.Marshal(value)
+	return nil
+}
+
+func (mc *responseCacheMemcache) GetStructured(ctx context.Context, key string, val interface{}) error {
+	if v, ok := mc.values[key]; ok {
+		return json.Unmarshal(v, val)
+	}
+	return errors.New("cache miss")
+}
+
+// testResponseCache serves requests through a response cache in front of a
+// handler that counts its requests and answers GETs with their count.
+func testResponseCache(t *testing.T, config string) (func(method, path string, headers map[string]string) *http.Response, *int) {
+	c, err := conf.StringConfig("[filter:response_cache]\nenabled = true\n" + config)
+	require.Nil(t, err)
+	rc, err := NewResponseCache(c.GetSection("filter:response_cache"), common.NewTestScope())
+	require.Nil(t, err)
+	served := 0
+	handler := rc(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served++
+		switch r.URL.Path {
+		case "/v1/a/c/private":
+			w.Header().Set("Cache-Control", "private")
+		case "/v1/a/c/missing":
+			w.WriteHeader(404)
+			return
+		case "/v1/a/c/big":
+			w.Write(make([]byte, 100))
+			return
+		case "/v1/a/c/authed":
+			GetProxyContext(r).RemoteUsers = []string{"test:tester"}
+		}
+		w.Header().Set("X-Trans-Id", fmt.Sprintf("tx%d", served))
+		w.Header().Set("X-Object-Meta-Color", "blue")
+		if r.Method == "GET" {
+			w.Write([]byte(fmt.Sprintf("response %d", served)))
+		}
+	}))
+	mc := &responseCacheMemcache{FakeMemcacheRing: &test.FakeMemcacheRing{}, values: map[string][]byte{}}
+	return func(method, path string, headers map[string]string) *http.Response {
+		pc := &ProxyContext{ProxyContextMiddleware: &ProxyContextMiddleware{Cache: mc}}
+		req := httptest.NewRequest(method, path, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		req = req.WithContext(context.WithValue(req.Context(), "proxycontext", pc))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Result()
+	}, &served
+}
+
+func responseCacheBody(t *testing.T, resp *http.Response) string {
+	body, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	return string(body)
+}
+
+func TestResponseCache(t *testing.T) {
+	do, served := testResponseCache(t, "")
+	resp := do("GET", "/v1/a/c/o", nil)
+	require.Equal(t, "response 1", responseCacheBody(t, resp))
+	resp = do("GET", "/v1/a/c/o", nil)
+	require.Equal(t, 200, resp.StatusCode)
+	require.Equal(t, "response 1", responseCacheBody(t, resp))
+	require.Equal(t, "blue", resp.Header.Get("X-Object-Meta-Color"))
+	require.Equal(t, "", resp.Header.Get("X-Trans-Id"))
+	require.Equal(t, 1, *served)
+
+	// Listings are cached by their query and format.
+	require.Equal(t, "response 2", responseCacheBody(t, do("GET", "/v1/a/c?prefix=x", nil)))
+	require.Equal(t, "response 3", responseCacheBody(t, do("GET", "/v1/a/c?prefix=x", map[string]string{"Accept": "application/json"})))
+	require.Equal(t, "response 2", responseCacheBody(t, do("GET", "/v1/a/c?prefix=x", nil)))
+	require.Equal(t, "response 4", responseCacheBody(t, do("GET", "/v1/a/c?prefix=y", nil)))
+	// As are objects by the Origin, as CORS headers vary by it.
+	require.Equal(t, "response 5", responseCacheBody(t, do("GET", "/v1/a/c/o", map[string]string{"Origin": "http://example.com"})))
+	require.Equal(t, "response 1", responseCacheBody(t, do("GET", "/v1/a/c/o", nil)))
+
+	// Writing to the container invalidates its listings and objects.
+	do("PUT", "/v1/a/c/o2", nil)
+	require.Equal(t, "response 7", responseCacheBody(t, do("GET", "/v1/a/c/o", nil)))
+	require.Equal(t, "response 8", responseCacheBody(t, do("GET", "/v1/a/c?prefix=x", nil)))
+	require.Equal(t, "response 7", responseCacheBody(t, do("GET", "/v1/a/c/o", nil)))
+	// Other containers keep theirs.
+	require.Equal(t, "response 9", responseCacheBody(t, do("GET", "/v1/a/c2/o", nil)))
+	do("POST", "/v1/a/c", nil)
+	require.Equal(t, "response 9", responseCacheBody(t, do("GET", "/v1/a/c2/o", nil)))
+	require.Equal(t, "response 11", responseCacheBody(t, do("GET", "/v1/a/c/o", nil)))
+}
+
+func TestResponseCacheUncacheable(t *testing.T) {
+	do, served := testResponseCache(t, "max_object_size = 50\n")
+	for _, tc := range []struct {
+		path    string
+		headers map[string]string
+	}{
+		{"/v1/a/c/o", map[string]string{"X-Auth-Token": "t"}},
+		{"/v1/a/c/o", map[string]string{"X-Storage-Token": "t"}},
+		{"/v1/a/c/o", map[string]string{"X-Service-Token": "t"}},
+		{"/v1/a/c/o", map[string]string{"Authorization": "AWS a:b"}},
+		{"/v1/a/c/authed", nil},
+		{"/v1/a/c/o", map[string]string{"Range": "bytes=0-1"}},
+		{"/v1/a/c/o", map[string]string{"If-None-Match": "x"}},
+		{"/v1/a/c/o?temp_url_sig=x", nil},
+		{"/v1/a/c?something=else", nil},
+		{"/v1/a", nil},
+		{"/v1/a/c/private", nil},
+		{"/v1/a/c/missing", nil},
+		{"/v1/a/c/big", nil},
+	} {
+		before := *served
+		do("GET", tc.path, tc.headers)
+		do("GET", tc.path, tc.headers)
+		require.Equal(t, before+2, *served, "%+v", tc)
+	}
+}
+
+func TestResponseCacheMemcache(t *testing.T) {
+	do, served := testResponseCache(t, "backend = memcache\n")
+	require.Equal(t, "response 1", responseCacheBody(t, do("GET", "/v1/a/c/o", nil)))
+	require.Equal(t, "response 1", responseCacheBody(t, do("GET", "/v1/a/c/o", nil)))
+	require.Equal(t, 1, *served)
+	do("DELETE", "/v1/a/c/o", nil)
+	require.Equal(t, "response 3", responseCacheBody(t, do("GET", "/v1/a/c/o", nil)))
+}
+
+func TestLRUStore(t *testing.T) {
+	s := newLRUStore(10)
+	ctx := context.Background()
+	s.set(ctx, "a", []byte("1234"), time.Minute)
+	s.set(ctx, "b", []byte("1234"), time.Minute)
+	_, ok := s.get(ctx, "a")
+	require.True(t, ok)
+	// b is the least recently used, so it makes room for c.
+	s.set(ctx, "c", []byte("1234"), time.Minute)
+	_, ok = s.get(ctx, "b")
+	require.False(t, ok)
+	_, ok = s.get(ctx, "a")
+	require.True(t, ok)
+	s.set(ctx, "d", []byte("0123456789"), time.Minute)
+	_, ok = s.get(ctx, "d")
+	require.False(t, ok)
+	require.Equal(t, 10, s.size)
+
+	s.set(ctx, "a", []byte("1"), -time.Second)
+	_, ok = s.get(ctx, "a")
+	require.False(t, ok)
+	require.Equal(t, 5, s.size)
+}
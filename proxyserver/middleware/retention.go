@@ -0,0 +1,85 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/troubling/hummingbird/client"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/srv"
+
+	"github.com/uber-go/tally"
+)
+
+// retentionUntil returns the unix time a container's objects are retained
+// until, or 0 if they aren't.
+func retentionUntil(ci *client.ContainerInfo) int64 {
+	until, _ := strconv.ParseInt(ci.Metadata["Retention-Until"], 10, 64)
+	return until
+}
+
+// retention write-protects the objects in containers with an
+// X-Container-Meta-Retention-Until in the future. Objects can't be deleted,
+// and new ones are stored with the retention so the object servers refuse to
+// overwrite or delete them until it has passed, and the retention itself
+// can't be shortened or removed in the meantime. Objects from before the
+// retention was set are only protected here, since they don't have it stored.
+func retention(metric tally.Counter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			ctx := GetProxyContext(request)
+			_, account, container, obj := getPathParts(request)
+			if container == "" {
+				next.ServeHTTP(writer, request)
+				return
+			}
+
+			if obj == "" && (request.Method == "PUT" || request.Method == "POST") {
+				value, set := request.Header["X-Container-Meta-Retention-Until"]
+				_, removed := request.Header["X-Remove-Container-Meta-Retention-Until"]
+				if !set && !removed {
+					next.ServeHTTP(writer, request)
+					return
+				}
+				var newUntil int64
+				if set && value[0] != "" {
+					var err error
+					if newUntil, err = strconv.ParseInt(value[0], 10, 64); err != nil {
+						srv.SimpleErrorResponse(writer, http.StatusBadRequest, "Invalid X-Container-Meta-Retention-Until.")
+						return
+					}
+				}
+				if ci, err := ctx.C.GetContainerInfo(request.Context(), account, container); err == nil {
+					if until := retentionUntil(ci); until > time.Now().Unix() && (removed || newUntil < until) {
+						metric.Inc(1)
+						srv.SimpleErrorResponse(writer, http.StatusConflict, fmt.Sprintf("Retention until %d can't be shortened.", until))
+						return
+					}
+				}
+			} else if obj != "" && (request.Method == "PUT" || request.Method == "DELETE") {
+				ci, err := ctx.C.GetContainerInfo(request.Context(), account, container)
+				if err != nil {
+					next.ServeHTTP(writer, request)
+					return
+				}
+				if until := retentionUntil(ci); until > time.Now().Unix() {
+					if request.Method == "DELETE" {
+						metric.Inc(1)
+						srv.SimpleErrorResponse(writer, http.StatusConflict, fmt.Sprintf("Object is retained until %d.", until))
+						return
+					}
+					request.Header.Set("X-Backend-Retention-Until", strconv.FormatInt(until, 10))
+					request.Header.Set("X-Object-Sysmeta-Retention-Until", strconv.FormatInt(until, 10))
+				}
+			}
+			next.ServeHTTP(writer, request)
+		})
+	}
+}
+
+func NewRetention(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	RegisterInfo("retention", map[string]interface{}{})
+	return retention(metricsScope.Counter("retention_refused")), nil
+}
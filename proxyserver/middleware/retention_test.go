@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/client"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/common/test"
+
+	"go.uber.org/zap"
+)
+
+func retentionTestRequest(t *testing.T, method, path string, header http.Header, until int64) (*http.Response, string, *http.Request) {
+	var nextReq *http.Request
+	next := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		nextReq = request
+		writer.WriteHeader(200)
+	})
+	mid, err := NewRetention(conf.Section{}, common.NewTestScope())
+	require.Nil(t, err)
+	f, err := client.NewProxyClient(staticPolicyList, srv.NewTestConfigLoader(&test.FakeRing{}),
+		nil, "", "", "", "", "", conf.Config{})
+	require.Nil(t, err)
+	ctx := &ProxyContext{
+		Logger: zap.NewNop(),
+		C: f.NewRequestClient(nil, map[string]*client.ContainerInfo{
+			"container/a/c": {
+				Metadata: map[string]string{"Retention-Until": strconv.FormatInt(until, 10)},
+			},
+		}, zap.NewNop()),
+	}
+	req, err := http.NewRequest(method, path, nil)
+	require.Nil(t, err)
+	for key, value := range header {
+		req.Header[key] = value
+	}
+	req = req.WithContext(context.WithValue(req.Context(), "proxycontext", ctx))
+	w := httptest.NewRecorder()
+	mid(next).ServeHTTP(w, req)
+	resp := w.Result()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp, string(body), nextReq
+}
+
+func TestRetentionObjects(t *testing.T) {
+	until := time.Now().Unix() + 3600
+	resp, body, _ := retentionTestRequest(t, "DELETE", "/v1/a/c/o", nil, until)
+	require.Equal(t, 409, resp.StatusCode)
+	require.Equal(t, "Object is retained until "+strconv.FormatInt(until, 10)+".", body)
+
+	resp, _, next := retentionTestRequest(t, "PUT", "/v1/a/c/o", nil, until)
+	require.Equal(t, 200, resp.StatusCode)
+	require.Equal(t, strconv.FormatInt(until, 10), next.Header.Get("X-Backend-Retention-Until"))
+	require.Equal(t, strconv.FormatInt(until, 10), next.Header.Get("X-Object-Sysmeta-Retention-Until"))
+
+	// Once the retention has passed the objects are like any others.
+	resp, _, _ = retentionTestRequest(t, "DELETE", "/v1/a/c/o", nil, time.Now().Unix()-1)
+	require.Equal(t, 200, resp.StatusCode)
+	resp, _, next = retentionTestRequest(t, "PUT", "/v1/a/c/o", nil, time.Now().Unix()-1)
+	require.Equal(t, 200, resp.StatusCode)
+	require.Equal(t, "", next.Header.Get("X-Object-Sysmeta-Retention-Until"))
+}
+
+func TestRetentionContainerMetadata(t *testing.T) {
+	until := time.Now().Unix() + 3600
+	resp, body, _ := retentionTestRequest(t, "POST", "/v1/a/c", http.Header{"X-Container-Meta-Retention-Until": {"soon"}}, until)
+	require.Equal(t, 400, resp.StatusCode)
+	require.Equal(t, "Invalid X-Container-Meta-Retention-Until.", body)
+
+	resp, _, _ = retentionTestRequest(t, "POST", "/v1/a/c", http.Header{"X-Container-Meta-Retention-Until": {strconv.FormatInt(until+60, 10)}}, until)
+	require.Equal(t, 200, resp.StatusCode)
+
+	resp, _, _ = retentionTestRequest(t, "POST", "/v1/a/c", http.Header{"X-Container-Meta-Retention-Until": {strconv.FormatInt(until-60, 10)}}, until)
+	require.Equal(t, 409, resp.StatusCode)
+	resp, _, _ = retentionTestRequest(t, "POST", "/v1/a/c", http.Header{"X-Container-Meta-Retention-Until": {""}}, until)
+	require.Equal(t, 409, resp.StatusCode)
+	resp, _, _ = retentionTestRequest(t, "POST", "/v1/a/c", http.Header{"X-Remove-Container-Meta-Retention-Until": {"x"}}, until)
+	require.Equal(t, 409, resp.StatusCode)
+
+	resp, _, _ = retentionTestRequest(t, "POST", "/v1/a/c", http.Header{"X-Remove-Container-Meta-Retention-Until": {"x"}}, time.Now().Unix()-1)
+	require.Equal(t, 200, resp.StatusCode)
+}
@@ -36,6 +36,17 @@
 //  connection.get_all_buckets()
 //
 //  If you are using keystone auth, substitue the key and access key returned from keystone
+//
+//  Requests can be signed with signature V2 or V4, including V4 presigned
+//  URLs, so newer tools such as boto3 and the aws cli work too:
+//
+//  import boto3
+//  s3 = boto3.client('s3', endpoint_url='http://127.0.0.1:8080',
+//    aws_access_key_id='test:tester', aws_secret_access_key='testing')
+//  s3.list_buckets()
+//
+//  V4 requests must be path style, and aws-chunked uploads, as sent with
+//  STREAMING-AWS4-HMAC-SHA256-PAYLOAD, aren't supported.
 
 package middleware
 
@@ -19,14 +19,32 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/srv"
 	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+)
+
+const (
+	s3V4Algorithm     = "AWS4-HMAC-SHA256"
+	s3V4DateFormat    = "20060102T150405Z"
+	s3V4MaxSkew       = 15 * time.Minute
+	s3V4MaxExpires    = 7 * 24 * time.Hour
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3StreamingPrefix = "STREAMING-"
 )
 
 type S3AuthInfo struct {
@@ -34,6 +52,9 @@ type S3AuthInfo struct {
 	Signature    string
 	StringToSign string
 	Account      string
+	// Scope is the date/region/service/aws4_request credential scope of a
+	// signature V4 request, and empty for V2.
+	Scope string
 }
 
 var S3Subresources = map[string]bool{
@@ -65,6 +86,9 @@ var S3Subresources = map[string]bool{
 }
 
 func (s *S3AuthInfo) validateSignature(secret []byte) bool {
+	if s.Scope != "" {
+		return s.validateSignatureV4(secret)
+	}
 	// S3 Auth signature V2 Validation
 	mac := hmac.New(sha1.New, secret)
 	mac.Write([]byte(s.StringToSign))
@@ -77,6 +101,208 @@ func (s *S3AuthInfo) validateSignature(secret []byte) bool {
 	return hmac.Equal(sig1, sig2)
 }
 
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func (s *S3AuthInfo) validateSignatureV4(secret []byte) bool {
+	scope := strings.Split(s.Scope, "/")
+	if len(scope) != 4 {
+		return false
+	}
+	key := []byte("AWS4" + string(secret))
+	for _, part := range scope {
+		key = hmacSHA256(key, part)
+	}
+	sig2, err := hex.DecodeString(s.Signature)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(hmacSHA256(key, s.StringToSign), sig2)
+}
+
+// s3V4Request is what a signature V4 request says about how it was signed,
+// from its Authorization header or, for a presigned URL, its query string.
+type s3V4Request struct {
+	key           string
+	scope         string
+	signature     string
+	signedHeaders string
+	amzDate       string
+	date          time.Time
+	expires       time.Duration
+	payloadHash   string
+	presigned     bool
+}
+
+func isS3V4Request(request *http.Request) bool {
+	return strings.HasPrefix(request.Header.Get("Authorization"), s3V4Algorithm+" ") ||
+		request.URL.Query().Get("X-Amz-Algorithm") != ""
+}
+
+func parseS3V4Request(request *http.Request) (*s3V4Request, error) {
+	v4 := &s3V4Request{}
+	var credential string
+	query := request.URL.Query()
+	if query.Get("X-Amz-Algorithm") != "" {
+		if query.Get("X-Amz-Algorithm") != s3V4Algorithm {
+			return nil, errors.New("unsupported signing algorithm")
+		}
+		v4.presigned = true
+		credential = query.Get("X-Amz-Credential")
+		v4.signedHeaders = query.Get("X-Amz-SignedHeaders")
+		v4.signature = query.Get("X-Amz-Signature")
+		v4.amzDate = query.Get("X-Amz-Date")
+		v4.payloadHash = s3UnsignedPayload
+		seconds, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || seconds < 1 || time.Duration(seconds)*time.Second > s3V4MaxExpires {
+			return nil, errors.New("invalid X-Amz-Expires")
+		}
+		v4.expires = time.Duration(seconds) * time.Second
+	} else {
+		for _, field := range strings.Split(strings.TrimPrefix(request.Header.Get("Authorization"), s3V4Algorithm+" "), ",") {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) != 2 {
+				return nil, errors.New("malformed Authorization header")
+			}
+			switch kv[0] {
+			case "Credential":
+				credential = kv[1]
+			case "SignedHeaders":
+				v4.signedHeaders = kv[1]
+			case "Signature":
+				v4.signature = kv[1]
+			}
+		}
+		v4.amzDate = request.Header.Get("X-Amz-Date")
+		if v4.amzDate == "" {
+			if date, err := http.ParseTime(request.Header.Get("Date")); err == nil {
+				v4.amzDate = date.UTC().Format(s3V4DateFormat)
+			}
+		}
+		if v4.payloadHash = request.Header.Get("X-Amz-Content-Sha256"); v4.payloadHash == "" {
+			return nil, errors.New("missing X-Amz-Content-Sha256")
+		}
+	}
+	if v4.signature == "" || v4.signedHeaders == "" {
+		return nil, errors.New("missing signature")
+	}
+	var err error
+	if v4.date, err = time.Parse(s3V4DateFormat, v4.amzDate); err != nil {
+		return nil, errors.New("invalid request date")
+	}
+	// The access key is everything before the four parts of the scope.
+	parts := strings.Split(credential, "/")
+	if len(parts) < 5 || parts[len(parts)-1] != "aws4_request" || parts[len(parts)-4] != v4.amzDate[:8] {
+		return nil, errors.New("invalid credential")
+	}
+	v4.key = strings.Join(parts[:len(parts)-4], "/")
+	v4.scope = strings.Join(parts[len(parts)-4:], "/")
+	return v4, nil
+}
+
+// valid reports whether the request is within its signature's time limits.
+func (v4 *s3V4Request) valid(now time.Time) bool {
+	if v4.date.Sub(now) > s3V4MaxSkew {
+		return false
+	}
+	if v4.presigned {
+		return now.Before(v4.date.Add(v4.expires))
+	}
+	return now.Sub(v4.date) <= s3V4MaxSkew
+}
+
+// s3URIEncode encodes everything but the characters AWS leaves unreserved.
+func s3URIEncode(s string, encodeSlash bool) string {
+	var buf bytes.Buffer
+	for _, b := range []byte(s) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' || (b == '/' && !encodeSlash) {
+			buf.WriteByte(b)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
+
+func (v4 *s3V4Request) stringToSign(request *http.Request) string {
+	var buf bytes.Buffer
+	buf.WriteString(request.Method)
+	buf.WriteString("\n")
+	uri := s3URIEncode(request.URL.Path, false)
+	if uri == "" {
+		uri = "/"
+	}
+	buf.WriteString(uri)
+	buf.WriteString("\n")
+
+	type param struct{ key, value string }
+	var params []param
+	for k, vs := range request.URL.Query() {
+		if v4.presigned && k == "X-Amz-Signature" {
+			continue
+		}
+		for _, v := range vs {
+			params = append(params, param{s3URIEncode(k, true), s3URIEncode(v, true)})
+		}
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i].key != params[j].key {
+			return params[i].key < params[j].key
+		}
+		return params[i].value < params[j].value
+	})
+	for i, p := range params {
+		if i > 0 {
+			buf.WriteString("&")
+		}
+		buf.WriteString(p.key + "=" + p.value)
+	}
+	buf.WriteString("\n")
+
+	for _, name := range strings.Split(v4.signedHeaders, ";") {
+		var values []string
+		if name == "host" {
+			values = []string{request.Host}
+		} else {
+			values = request.Header[http.CanonicalHeaderKey(name)]
+		}
+		for i, v := range values {
+			values[i] = strings.Join(strings.Fields(v), " ")
+		}
+		buf.WriteString(name + ":" + strings.Join(values, ",") + "\n")
+	}
+	buf.WriteString("\n")
+	buf.WriteString(v4.signedHeaders)
+	buf.WriteString("\n")
+	buf.WriteString(v4.payloadHash)
+
+	canonicalHash := sha256.Sum256(buf.Bytes())
+	return strings.Join([]string{s3V4Algorithm, v4.amzDate, v4.scope, hex.EncodeToString(canonicalHash[:])}, "\n")
+}
+
+var errS3ContentSHA256Mismatch = errors.New("X-Amz-Content-Sha256 does not match the request body")
+
+// s3PayloadReader fails the read that reaches the end of the body if the
+// body didn't have the SHA256 the request was signed with.
+type s3PayloadReader struct {
+	io.ReadCloser
+	hash     hash.Hash
+	expected string
+}
+
+func (r *s3PayloadReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(r.hash.Sum(nil)) != r.expected {
+		return n, errS3ContentSHA256Mismatch
+	}
+	return n, err
+}
+
 type s3AuthHandler struct {
 	next           http.Handler
 	ctx            *ProxyContext
@@ -85,6 +311,14 @@ type s3AuthHandler struct {
 
 func (s *s3AuthHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 	ctx := GetProxyContext(request)
+	if isS3V4Request(request) {
+		if ctx.S3Auth == nil {
+			s.serveV4(writer, request)
+		} else {
+			s.next.ServeHTTP(writer, request)
+		}
+		return
+	}
 	// Check if this is an S3 request
 	var key, signature string
 	authStr := request.Header.Get("Authorization")
@@ -171,8 +405,38 @@ func (s *s3AuthHandler) ServeHTTP(writer http.ResponseWriter, request *http.Requ
 		Signature:    signature,
 	}
 
-	// TODO: Handle V4 signature validation
+	s.next.ServeHTTP(writer, request)
+}
 
+// serveV4 sets up validation of a signature V4 request, which the auth
+// middleware completes once it has the secret for the access key.
+func (s *s3AuthHandler) serveV4(writer http.ResponseWriter, request *http.Request) {
+	ctx := GetProxyContext(request)
+	writer = newS3ResponseWriterWrapper(writer, request)
+	v4, err := parseS3V4Request(request)
+	if err != nil {
+		ctx.Logger.Debug("Invalid S3 V4 request", zap.Error(err))
+		srv.StandardResponse(writer, http.StatusForbidden)
+		return
+	}
+	if !v4.valid(time.Now()) {
+		srv.StandardResponse(writer, http.StatusForbidden)
+		return
+	}
+	if strings.HasPrefix(v4.payloadHash, s3StreamingPrefix) {
+		// aws-chunked bodies sign each chunk as well
+		srv.StandardResponse(writer, http.StatusNotImplemented)
+		return
+	}
+	if v4.payloadHash != s3UnsignedPayload && request.Body != nil {
+		request.Body = &s3PayloadReader{ReadCloser: request.Body, hash: sha256.New(), expected: strings.ToLower(v4.payloadHash)}
+	}
+	ctx.S3Auth = &S3AuthInfo{
+		StringToSign: v4.stringToSign(request),
+		Key:          v4.key,
+		Signature:    v4.signature,
+		Scope:        v4.scope,
+	}
 	s.next.ServeHTTP(writer, request)
 }
 
@@ -0,0 +1,245 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+)
+
+const (
+	symlinkTargetHeader               = "X-Symlink-Target"
+	symlinkTargetAccountHeader        = "X-Symlink-Target-Account"
+	symlinkTargetEtagHeader           = "X-Symlink-Target-Etag"
+	symlinkTargetBytesHeader          = "X-Symlink-Target-Bytes"
+	symlinkSysmetaTarget              = "X-Object-Sysmeta-Symlink-Target"
+	symlinkSysmetaTargetAccount       = "X-Object-Sysmeta-Symlink-Target-Account"
+	symlinkSysmetaTargetEtag          = "X-Object-Sysmeta-Symlink-Target-Etag"
+	symlinkSysmetaTargetBytes         = "X-Object-Sysmeta-Symlink-Target-Bytes"
+	symlinkContentType                = "application/symlink"
+	symlinkDefaultSymloopMax    int64 = 2
+)
+
+type symlink struct {
+	next       http.Handler
+	symloopMax int
+}
+
+// symlinkWriter holds a response back until it knows whether it's for a
+// symlink. A symlink's response is dropped, so its target's can be sent in
+// its place.
+type symlinkWriter struct {
+	http.ResponseWriter
+	header http.Header
+	status int
+	// etag is the Etag a static symlink's target must still have.
+	etag    string
+	linked  bool
+	discard bool
+}
+
+func newSymlinkWriter(w http.ResponseWriter, etag string) *symlinkWriter {
+	return &symlinkWriter{ResponseWriter: w, header: http.Header{}, etag: etag}
+}
+
+func (w *symlinkWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *symlinkWriter) WriteHeader(status int) {
+	w.status = status
+	if status/100 == 2 && w.header.Get(symlinkSysmetaTarget) != "" {
+		w.linked = true
+		w.discard = true
+		return
+	}
+	if status/100 == 2 && w.etag != "" && strings.Trim(w.header.Get("Etag"), "\"") != w.etag {
+		w.discard = true
+		srv.SimpleErrorResponse(w.ResponseWriter, http.StatusConflict, fmt.Sprintf("Object Etag %q does not match X-Symlink-Target-Etag header %q", w.header.Get("Etag"), w.etag))
+		return
+	}
+	for k, v := range w.header {
+		w.ResponseWriter.Header()[k] = v
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *symlinkWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.discard {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// exposeSymlink gives a symlink's own response the client headers for its
+// target.
+func exposeSymlink(writer http.ResponseWriter, status int) int {
+	for sysmeta, header := range map[string]string{
+		symlinkSysmetaTarget:        symlinkTargetHeader,
+		symlinkSysmetaTargetAccount: symlinkTargetAccountHeader,
+		symlinkSysmetaTargetEtag:    symlinkTargetEtagHeader,
+		symlinkSysmetaTargetBytes:   symlinkTargetBytesHeader,
+	} {
+		if v := writer.Header().Get(sysmeta); v != "" {
+			writer.Header().Set(header, v)
+		}
+	}
+	return status
+}
+
+// follow serves the request, and then the requests for the targets of any
+// symlinks it comes to, until it gets to an object that isn't a symlink.
+func (s *symlink) follow(writer http.ResponseWriter, request *http.Request, account string) {
+	ctx := GetProxyContext(request)
+	sw := newSymlinkWriter(writer, "")
+	s.next.ServeHTTP(sw, request)
+	for hops := 0; sw.linked; hops++ {
+		if hops >= s.symloopMax {
+			srv.SimpleErrorResponse(writer, http.StatusConflict, "Too many levels of symbolic links")
+			return
+		}
+		if a := sw.header.Get(symlinkSysmetaTargetAccount); a != "" {
+			account = a
+		}
+		path := fmt.Sprintf("/v1/%s/%s", account, sw.header.Get(symlinkSysmetaTarget))
+		subreq, err := ctx.newSubrequest(request.Method, common.Urlencode(path), http.NoBody, request, "SYM")
+		if err != nil {
+			ctx.Logger.Error("symlink target subrequest error", zap.String("path", path), zap.Error(err))
+			srv.StandardResponse(writer, http.StatusInternalServerError)
+			return
+		}
+		CopyItemsExclude(subreq.Header, request.Header, []string{"X-Timestamp", "X-Trans-Id"})
+		writer.Header().Set("Content-Location", path)
+		sw = newSymlinkWriter(writer, sw.header.Get(symlinkSysmetaTargetEtag))
+		ctx.serveHTTPSubrequest(sw, subreq)
+	}
+}
+
+// checkTarget makes sure a static symlink's target exists with the Etag it's
+// given, and returns its size.
+func (s *symlink) checkTarget(writer http.ResponseWriter, request *http.Request, path, etag string) (string, bool) {
+	ctx := GetProxyContext(request)
+	subreq, err := ctx.newSubrequest("HEAD", common.Urlencode(path), http.NoBody, request, "SYM")
+	if err != nil {
+		ctx.Logger.Error("symlink target HEAD error", zap.String("path", path), zap.Error(err))
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return "", false
+	}
+	CopyItemsExclude(subreq.Header, request.Header, []string{"X-Timestamp", "X-Trans-Id", "Content-Length", "Content-Type",
+		"Etag", symlinkTargetHeader, symlinkTargetAccountHeader, symlinkTargetEtagHeader})
+	w := httptest.NewRecorder()
+	ctx.serveHTTPSubrequest(w, subreq)
+	switch {
+	case w.Code == http.StatusNotFound:
+		srv.SimpleErrorResponse(writer, http.StatusConflict, fmt.Sprintf("X-Symlink-Target %s does not exist", path))
+		return "", false
+	case w.Code/100 != 2:
+		srv.StandardResponse(writer, w.Code)
+		return "", false
+	case w.Header().Get(symlinkSysmetaTarget) != "":
+		srv.SimpleErrorResponse(writer, http.StatusConflict, "X-Symlink-Target-Etag headers do not match a symlink")
+		return "", false
+	case strings.Trim(w.Header().Get("Etag"), "\"") != etag:
+		srv.SimpleErrorResponse(writer, http.StatusConflict, fmt.Sprintf("Object Etag %q does not match X-Symlink-Target-Etag header %q", w.Header().Get("Etag"), etag))
+		return "", false
+	}
+	return w.Header().Get("Content-Length"), true
+}
+
+func (s *symlink) handlePut(writer http.ResponseWriter, request *http.Request, account string) {
+	target := request.Header.Get(symlinkTargetHeader)
+	if target == "" {
+		if request.Header.Get(symlinkTargetAccountHeader) != "" || request.Header.Get(symlinkTargetEtagHeader) != "" {
+			srv.SimpleErrorResponse(writer, http.StatusBadRequest, "X-Symlink-Target-Account and X-Symlink-Target-Etag require X-Symlink-Target")
+			return
+		}
+		s.next.ServeHTTP(writer, request)
+		return
+	}
+	if request.ContentLength != 0 {
+		srv.SimpleErrorResponse(writer, http.StatusBadRequest, "Symlink requests require a zero byte body")
+		return
+	}
+	target, err := url.PathUnescape(target)
+	parts := strings.SplitN(target, "/", 2)
+	if err != nil || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		srv.SimpleErrorResponse(writer, http.StatusPreconditionFailed, "X-Symlink-Target header must be of the form <container name>/<object name>")
+		return
+	}
+	targetAccount := request.Header.Get(symlinkTargetAccountHeader)
+	if targetAccount != "" {
+		if targetAccount, err = url.PathUnescape(targetAccount); err != nil || strings.Contains(targetAccount, "/") {
+			srv.SimpleErrorResponse(writer, http.StatusPreconditionFailed, "Account name cannot contain slashes")
+			return
+		}
+		request.Header.Set(symlinkSysmetaTargetAccount, targetAccount)
+	} else {
+		targetAccount = account
+	}
+	if etag := strings.Trim(request.Header.Get(symlinkTargetEtagHeader), "\""); etag != "" {
+		size, ok := s.checkTarget(writer, request, fmt.Sprintf("/v1/%s/%s", targetAccount, target), etag)
+		if !ok {
+			return
+		}
+		request.Header.Set(symlinkSysmetaTargetEtag, etag)
+		request.Header.Set(symlinkSysmetaTargetBytes, size)
+	}
+	request.Header.Set(symlinkSysmetaTarget, target)
+	request.Header.Del(symlinkTargetHeader)
+	request.Header.Del(symlinkTargetAccountHeader)
+	request.Header.Del(symlinkTargetEtagHeader)
+	if request.Header.Get("Content-Type") == "" {
+		request.Header.Set("Content-Type", symlinkContentType)
+	}
+	s.next.ServeHTTP(writer, request)
+}
+
+func (s *symlink) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	apiReq, account, _, object := getPathParts(request)
+	if !apiReq || object == "" || GetProxyContext(request).Source == "SYM" {
+		s.next.ServeHTTP(writer, request)
+		return
+	}
+	switch request.Method {
+	case "GET", "HEAD":
+		if request.URL.Query().Get("symlink") == "get" {
+			s.next.ServeHTTP(srv.NewCustomWriter(writer, exposeSymlink), request)
+			return
+		}
+		s.follow(writer, request, account)
+	case "PUT":
+		s.handlePut(writer, request, account)
+	case "POST":
+		if request.Header.Get(symlinkTargetHeader) != "" {
+			srv.SimpleErrorResponse(writer, http.StatusBadRequest, "A PUT request is required to set a symlink target")
+			return
+		}
+		s.next.ServeHTTP(writer, request)
+	default:
+		s.next.ServeHTTP(writer, request)
+	}
+}
+
+func NewSymlink(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	if !config.GetBool("enabled", true) {
+		return func(next http.Handler) http.Handler { return next }, nil
+	}
+	symloopMax := int(config.GetInt("symloop_max", symlinkDefaultSymloopMax))
+	if symloopMax < 1 {
+		return nil, fmt.Errorf("symloop_max must be at least 1")
+	}
+	RegisterInfo("symlink", map[string]interface{}{"symloop_max": symloopMax, "static_links": true})
+	return func(next http.Handler) http.Handler {
+		return &symlink{next: next, symloopMax: symloopMax}
+	}, nil
+}
@@ -0,0 +1,157 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/client"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/common/test"
+	"go.uber.org/zap"
+)
+
+type symlinkBackendObject struct {
+	header http.Header
+	body   string
+}
+
+// symlinkBackend stands in for the rest of the proxy, keeping objects and
+// their sysmeta in memory.
+type symlinkBackend struct {
+	lock    sync.Mutex
+	objects map[string]symlinkBackendObject
+}
+
+func (b *symlinkBackend) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch request.Method {
+	case "GET", "HEAD":
+		obj, ok := b.objects[request.URL.Path]
+		if !ok {
+			writer.WriteHeader(404)
+			return
+		}
+		for k, v := range obj.header {
+			writer.Header()[k] = v
+		}
+		writer.WriteHeader(200)
+		if request.Method == "GET" {
+			writer.Write([]byte(obj.body))
+		}
+	case "PUT":
+		body, _ := ioutil.ReadAll(request.Body)
+		header := http.Header{}
+		for k, v := range request.Header {
+			if strings.HasPrefix(k, "X-Object-Sysmeta-") || k == "Content-Type" {
+				header[k] = v
+			}
+		}
+		header.Set("Etag", fmt.Sprintf("%x", md5.Sum(body)))
+		header.Set("Content-Length", fmt.Sprintf("%d", len(body)))
+		b.objects[request.URL.Path] = symlinkBackendObject{header: header, body: string(body)}
+		writer.WriteHeader(201)
+	default:
+		writer.WriteHeader(405)
+	}
+}
+
+func newSymlinkRequest(t *testing.T, handler http.Handler, method, path string, body []byte) *http.Request {
+	f, err := client.NewProxyClient(staticPolicyList, srv.NewTestConfigLoader(&test.FakeRing{}),
+		nil, "", "", "", "", "", conf.Config{})
+	require.Nil(t, err)
+	req, err := http.NewRequest(method, path, bytes.NewBuffer(body))
+	require.Nil(t, err)
+	ctx := &ProxyContext{
+		ProxyContextMiddleware: &ProxyContextMiddleware{next: handler},
+		Logger:                 zap.NewNop(),
+		C:                      f.NewRequestClient(nil, map[string]*client.ContainerInfo{}, zap.NewNop()),
+	}
+	return req.WithContext(context.WithValue(req.Context(), "proxycontext", ctx))
+}
+
+func TestSymlink(t *testing.T) {
+	backend := &symlinkBackend{objects: map[string]symlinkBackendObject{}}
+	mid, err := NewSymlink(conf.Section{}, common.NewTestScope())
+	require.Nil(t, err)
+	handler := mid(backend)
+	serve := func(method, path string, body []byte, headers map[string]string) *httptest.ResponseRecorder {
+		req := newSymlinkRequest(t, handler, method, path, body)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	require.Equal(t, 201, serve("PUT", "/v1/b/c/target", []byte("contents"), nil).Code)
+	require.Equal(t, 400, serve("PUT", "/v1/a/c/link", []byte("body"), map[string]string{"X-Symlink-Target": "c/target"}).Code)
+	require.Equal(t, 412, serve("PUT", "/v1/a/c/link", nil, map[string]string{"X-Symlink-Target": "target"}).Code)
+	require.Equal(t, 201, serve("PUT", "/v1/a/c/link", nil, map[string]string{"X-Symlink-Target": "c/target", "X-Symlink-Target-Account": "b"}).Code)
+	require.Equal(t, symlinkContentType, backend.objects["/v1/a/c/link"].header.Get("Content-Type"))
+
+	// Reads go through to the target, in the other account.
+	w := serve("GET", "/v1/a/c/link", nil, nil)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "contents", w.Body.String())
+	require.Equal(t, "/v1/b/c/target", w.Header().Get("Content-Location"))
+
+	// The link itself can be read too.
+	w = serve("HEAD", "/v1/a/c/link?symlink=get", nil, nil)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "c/target", w.Header().Get("X-Symlink-Target"))
+	require.Equal(t, "b", w.Header().Get("X-Symlink-Target-Account"))
+
+	// A link to a link is followed, but not beyond symloop_max.
+	require.Equal(t, 201, serve("PUT", "/v1/a/c/link2", nil, map[string]string{"X-Symlink-Target": "c/link"}).Code)
+	w = serve("GET", "/v1/a/c/link2", nil, nil)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "contents", w.Body.String())
+	require.Equal(t, 201, serve("PUT", "/v1/a/c/link3", nil, map[string]string{"X-Symlink-Target": "c/link2"}).Code)
+	require.Equal(t, 409, serve("GET", "/v1/a/c/link3", nil, nil).Code)
+
+	require.Equal(t, 400, serve("POST", "/v1/a/c/link", nil, map[string]string{"X-Symlink-Target": "c/other"}).Code)
+	require.Equal(t, 201, serve("PUT", "/v1/a/c/dangling", nil, map[string]string{"X-Symlink-Target": "c/missing"}).Code)
+	require.Equal(t, 404, serve("GET", "/v1/a/c/dangling", nil, nil).Code)
+}
+
+func TestStaticSymlink(t *testing.T) {
+	backend := &symlinkBackend{objects: map[string]symlinkBackendObject{}}
+	mid, err := NewSymlink(conf.Section{}, common.NewTestScope())
+	require.Nil(t, err)
+	handler := mid(backend)
+	serve := func(method, path string, body []byte, headers map[string]string) *httptest.ResponseRecorder {
+		req := newSymlinkRequest(t, handler, method, path, body)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	etag := fmt.Sprintf("%x", md5.Sum([]byte("contents")))
+	require.Equal(t, 201, serve("PUT", "/v1/a/c/target", []byte("contents"), nil).Code)
+	require.Equal(t, 409, serve("PUT", "/v1/a/c/missing", nil, map[string]string{"X-Symlink-Target": "c/nothing", "X-Symlink-Target-Etag": etag}).Code)
+	require.Equal(t, 409, serve("PUT", "/v1/a/c/link", nil, map[string]string{"X-Symlink-Target": "c/target", "X-Symlink-Target-Etag": "wrong"}).Code)
+	require.Equal(t, 201, serve("PUT", "/v1/a/c/link", nil, map[string]string{"X-Symlink-Target": "c/target", "X-Symlink-Target-Etag": etag}).Code)
+	require.Equal(t, "8", backend.objects["/v1/a/c/link"].header.Get(symlinkSysmetaTargetBytes))
+	w := serve("GET", "/v1/a/c/link", nil, nil)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "contents", w.Body.String())
+
+	// Once the target changes, the link no longer reads it.
+	require.Equal(t, 201, serve("PUT", "/v1/a/c/target", []byte("changed"), nil).Code)
+	require.Equal(t, 409, serve("GET", "/v1/a/c/link", nil, nil).Code)
+}
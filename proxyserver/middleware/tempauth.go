@@ -44,25 +44,44 @@ type tempAuth struct {
 	resellers    []string
 	reseller     string
 	accountRules map[string]map[string][]string
+	userStore    *tempAuthUserStore
 	next         http.Handler
 }
 
-func (ta *tempAuth) getUser(account, user, key string) *testUser {
-	for _, tu := range ta.testUsers {
-		if tu.Account == account && tu.Username == user && tu.Password == key {
-			return &tu
+// lookupUser returns the stored user, if there is one, or else the one in
+// the config, or nil if it's in neither.
+func (ta *tempAuth) lookupUser(ctx context.Context, proxyCtx *ProxyContext, account, user string) (*testUser, error) {
+	if ta.userStore != nil {
+		tu, err := ta.userStore.get(ctx, proxyCtx, account, user)
+		if err != nil || tu != nil {
+			if tu != nil {
+				tu.AccountID = ta.reseller + account
+			}
+			return tu, err
 		}
 	}
-	return nil
-}
-
-func (ta *tempAuth) getUserPassword(account, user string) string {
 	for _, tu := range ta.testUsers {
 		if tu.Account == account && tu.Username == user {
-			return tu.Password
+			return &tu, nil
 		}
 	}
-	return ""
+	return nil, nil
+}
+
+func (ta *tempAuth) getUser(ctx context.Context, proxyCtx *ProxyContext, account, user, key string) (*testUser, error) {
+	tu, err := ta.lookupUser(ctx, proxyCtx, account, user)
+	if err != nil || tu == nil || tu.Password != key {
+		return nil, err
+	}
+	return tu, nil
+}
+
+func (ta *tempAuth) getUserPassword(ctx context.Context, proxyCtx *ProxyContext, account, user string) (string, error) {
+	tu, err := ta.lookupUser(ctx, proxyCtx, account, user)
+	if err != nil || tu == nil {
+		return "", err
+	}
+	return tu.Password, nil
 }
 
 type cachedAuth struct {
@@ -91,12 +110,12 @@ func (ta *tempAuth) getUserGroups(tu *testUser) []string {
 	return groups
 }
 
-func (ta *tempAuth) getToken(ctx context.Context, proxyCtx *ProxyContext, user, account, password string) (*testUser, string) {
+func (ta *tempAuth) getToken(ctx context.Context, proxyCtx *ProxyContext, user, account, password string) (*testUser, string, error) {
 	var prevToken string
 	var token string
-	tUser := ta.getUser(account, user, password)
-	if tUser == nil {
-		return nil, ""
+	tUser, err := ta.getUser(ctx, proxyCtx, account, user, password)
+	if err != nil || tUser == nil {
+		return nil, "", err
 	}
 	userGroups := ta.getUserGroups(tUser)
 	if err := proxyCtx.Cache.GetStructured(ctx, "authuser:"+user, &prevToken); err == nil {
@@ -121,10 +140,10 @@ func (ta *tempAuth) getToken(ctx context.Context, proxyCtx *ProxyContext, user,
 		proxyCtx.Cache.Set(ctx, "auth:"+token, &cachedAuth{Expires: now + 86400, Groups: userGroups}, 86400)
 		if err := proxyCtx.Cache.Set(ctx, "authuser:"+user, &token, 86400); err != nil {
 			proxyCtx.Logger.Debug("Error setting tempauth token", zap.Error(err))
-			return tUser, ""
+			return tUser, "", nil
 		}
 	}
-	return tUser, token
+	return tUser, token, nil
 }
 
 func (ta *tempAuth) handleGetToken(writer http.ResponseWriter, request *http.Request) {
@@ -152,8 +171,12 @@ func (ta *tempAuth) handleGetToken(writer http.ResponseWriter, request *http.Req
 		srv.StandardResponse(writer, 500)
 		return
 	}
-	tUser, token := ta.getToken(request.Context(), ctx, user, account, password)
-	if tUser == nil {
+	tUser, token, err := ta.getToken(request.Context(), ctx, user, account, password)
+	if err != nil {
+		ctx.Logger.Error("Error looking up tempauth user", zap.Error(err))
+		srv.StandardResponse(writer, 500)
+		return
+	} else if tUser == nil {
 		srv.StandardResponse(writer, 401)
 		return
 	} else if token == "" {
@@ -202,7 +225,12 @@ func (ta *tempAuth) ServeHTTP(writer http.ResponseWriter, request *http.Request)
 		} else {
 			account := parts[0]
 			user := parts[1]
-			secret := ta.getUserPassword(account, user)
+			secret, err := ta.getUserPassword(request.Context(), ctx, account, user)
+			if err != nil {
+				ctx.Logger.Error("Error looking up tempauth user", zap.Error(err))
+				srv.StandardResponse(writer, 500)
+				return
+			}
 			isValid := ctx.S3Auth.validateSignature([]byte(secret))
 			if !isValid {
 				SignatureDoesNotMatchResponse(writer, request)
@@ -212,7 +240,7 @@ func (ta *tempAuth) ServeHTTP(writer http.ResponseWriter, request *http.Request)
 				// Get a token for this user to be used with the rest of the request
 				request.Header.Set("X-Auth-User", key)
 				request.Header.Set("X-Auth-Key", secret)
-				_, token := ta.getToken(request.Context(), ctx, user, account, secret)
+				_, token, _ := ta.getToken(request.Context(), ctx, user, account, secret)
 				request.Header.Set("X-Auth-Token", token)
 			}
 		}
@@ -220,6 +248,9 @@ func (ta *tempAuth) ServeHTTP(writer http.ResponseWriter, request *http.Request)
 	if request.URL.Path == "/auth/v1.0" {
 		ta.handleGetToken(writer, request)
 		return
+	} else if request.URL.Path == "/auth/users" || strings.HasPrefix(request.URL.Path, "/auth/users/") {
+		ta.handleUsers(writer, request)
+		return
 	} else if ctx.S3Auth != nil || strings.HasPrefix(request.URL.Path, "/v1") || strings.HasPrefix(request.URL.Path, "/V1") {
 		token := request.Header.Get("X-Auth-Token")
 		if token == "" {
@@ -238,7 +269,10 @@ func (ta *tempAuth) ServeHTTP(writer http.ResponseWriter, request *http.Request)
 				account = pathParts["account"]
 			}
 			if token != "" && strings.HasPrefix(token, ta.reseller) {
-				if curReseller, ok := ta.getReseller(account); ok && curReseller == ta.reseller {
+				// Tokens carry the first prefix, but are good for accounts
+				// under any of them, so that a service's prefix can have its
+				// require_group met by the groups of an X-Service-Token.
+				if _, ok := ta.getReseller(account); ok {
 					var ca cachedAuth
 					if err := ctx.Cache.GetStructured(request.Context(), "auth:"+token, &ca); err != nil {
 						s := http.StatusServiceUnavailable
@@ -249,7 +283,7 @@ func (ta *tempAuth) ServeHTTP(writer http.ResponseWriter, request *http.Request)
 							return false, s
 						}
 					} else {
-						if st := request.Header.Get("X-Service-Token"); st != "" {
+						if st := request.Header.Get("X-Service-Token"); st != "" && strings.HasPrefix(st, ta.reseller) {
 							var caSt cachedAuth
 							if err := ctx.Cache.GetStructured(request.Context(), "auth:"+st, &caSt); err == nil {
 								for _, g := range caSt.Groups {
@@ -260,8 +294,6 @@ func (ta *tempAuth) ServeHTTP(writer http.ResponseWriter, request *http.Request)
 						ctx.RemoteUsers = ca.Groups
 						ctx.Authorize = ta.authorize
 					}
-				} else if ok {
-					ctx.Authorize = ta.authorize
 				}
 			} else {
 				if _, ok := ta.getReseller(account); ok {
@@ -366,6 +398,14 @@ func NewTempAuth(config conf.Section, metricsScope tally.Scope) (func(http.Handl
 
 		users = append(users, testUser{account, user, valparts[0], groups, url, accountID})
 	}
+	var userStore *tempAuthUserStore
+	if account := config.GetDefault("user_account", ""); account != "" {
+		// Accounts starting with a dot can't be reached through the proxy.
+		if !strings.HasPrefix(account, ".") {
+			return nil, fmt.Errorf("tempauth user_account %q must start with a dot", account)
+		}
+		userStore = &tempAuthUserStore{account: account}
+	}
 	RegisterInfo("tempauth", map[string]interface{}{"account_acls": false})
 	return func(next http.Handler) http.Handler {
 		return &tempAuth{
@@ -374,6 +414,7 @@ func NewTempAuth(config conf.Section, metricsScope tally.Scope) (func(http.Handl
 			resellers:    resellerPrefixes,
 			reseller:     reseller,
 			accountRules: accountRules,
+			userStore:    userStore,
 		}
 	}, nil
 }
@@ -19,6 +19,7 @@ import (
 	"context"
 	"encoding/json"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
@@ -278,6 +279,42 @@ func TestAuthorizeAcl(t *testing.T) {
 	require.Equal(t, 403, st)
 }
 
+func TestAuthorizeAclSemantics(t *testing.T) {
+	passthrough := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	ta := &tempAuth{
+		reseller:  "AUTH_",
+		resellers: []string{"AUTH_"},
+		next:      passthrough,
+	}
+	authorize := func(method, path, acl, referer string, remoteUsers ...string) int {
+		fakeContext := NewFakeProxyContext(passthrough)
+		fakeContext.RemoteUsers = remoteUsers
+		fakeContext.ACL = acl
+		req, _ := http.NewRequest(method, path, nil)
+		if referer != "" {
+			req.Header.Set("Referer", referer)
+		}
+		req = req.WithContext(context.WithValue(req.Context(), "proxycontext", fakeContext))
+		_, st := ta.authorize(req)
+		return st
+	}
+	// Another account's users need to be in the ACL, by user or by group.
+	require.Equal(t, 403, authorize("PUT", "/v1/AUTH_test/c/o", "", "", "test2", "test2:tester"))
+	require.Equal(t, 200, authorize("PUT", "/v1/AUTH_test/c/o", "test2:tester", "", "test2", "test2:tester"))
+	require.Equal(t, 200, authorize("DELETE", "/v1/AUTH_test/c/o", "other,test2", "", "test2", "test2:tester"))
+	require.Equal(t, 403, authorize("PUT", "/v1/AUTH_test/c/o", "test2:other", "", "test2", "test2:tester"))
+	// Users in a container's read ACL can list it without .rlistings.
+	require.Equal(t, 200, authorize("GET", "/v1/AUTH_test/c", "test2", "", "test2", "test2:tester"))
+
+	// Referrer entries let anyone read, without a token.
+	require.Equal(t, 200, authorize("GET", "/v1/AUTH_test/c/o", ".r:.example.com", "http://www.example.com/page"))
+	require.Equal(t, 401, authorize("GET", "/v1/AUTH_test/c/o", ".r:.example.com", "http://www.other.com/page"))
+	require.Equal(t, 401, authorize("GET", "/v1/AUTH_test/c/o", ".r:*,.r:-bad.example.com", "http://bad.example.com/"))
+	require.Equal(t, 401, authorize("GET", "/v1/AUTH_test/c", ".r:*", ""))
+	require.Equal(t, 200, authorize("GET", "/v1/AUTH_test/c", ".r:*,.rlistings", ""))
+	require.Equal(t, 200, authorize("HEAD", "/v1/AUTH_test/c", ".r:*,.rlistings", ""))
+}
+
 func TestServeHTTP(t *testing.T) {
 	theHeader := make(http.Header, 1)
 	fakeWriter := test.MockResponseWriter{SaveHeader: &theHeader, StatusMap: map[string]int{"a": 12}}
@@ -341,3 +378,47 @@ func TestServeHTTP(t *testing.T) {
 	require.False(t, ctx.Authorize == nil)
 	require.Equal(t, "hat", fakeContext.RemoteUsers[0])
 }
+
+func TestServeHTTPServiceToken(t *testing.T) {
+	passthrough := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	fakeMr := &test.FakeMemcacheRing{}
+	userAuth, _ := json.Marshal(cachedAuth{Groups: []string{"test", "test:tester", "AUTH_test", "SERVICE_test"}, Expires: time.Now().Unix() + 100})
+	serviceAuth, _ := json.Marshal(cachedAuth{Groups: []string{"service", "service:backup", ".service"}, Expires: time.Now().Unix() + 100})
+	fakeMr.MockGetStructured = map[string][]byte{"auth:AUTH_user": userAuth, "auth:AUTH_service": serviceAuth}
+	ta := &tempAuth{
+		reseller:     "AUTH_",
+		resellers:    []string{"AUTH_", "SERVICE_"},
+		next:         passthrough,
+		accountRules: map[string]map[string][]string{"AUTH_": {"require_group": {}}, "SERVICE_": {"require_group": {".service"}}},
+	}
+	authorize := func(path, serviceToken string) (bool, bool) {
+		fakeContext := NewFakeProxyContext(passthrough)
+		fakeContext.Cache = fakeMr
+		req, err := http.NewRequest("GET", path, nil)
+		require.Nil(t, err)
+		req = req.WithContext(context.WithValue(req.Context(), "proxycontext", fakeContext))
+		req.Header.Set("X-Auth-Token", "AUTH_user")
+		if serviceToken != "" {
+			req.Header.Set("X-Service-Token", serviceToken)
+		}
+		ta.ServeHTTP(httptest.NewRecorder(), req)
+		require.NotNil(t, fakeContext.Authorize)
+		ok, _ := fakeContext.Authorize(req)
+		return ok, fakeContext.StorageOwner
+	}
+
+	ok, owner := authorize("/v1/AUTH_test", "")
+	require.True(t, ok)
+	require.True(t, owner)
+	// The service's prefix needs both the user's token and the service's.
+	ok, _ = authorize("/v1/SERVICE_test", "")
+	require.False(t, ok)
+	ok, _ = authorize("/v1/SERVICE_test", "AUTH_nosuchtoken")
+	require.False(t, ok)
+	ok, owner = authorize("/v1/SERVICE_test", "AUTH_service")
+	require.True(t, ok)
+	require.True(t, owner)
+	// And the service's token doesn't get it into other users' accounts.
+	ok, _ = authorize("/v1/SERVICE_other", "AUTH_service")
+	require.False(t, ok)
+}
@@ -0,0 +1,289 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/srv"
+	"go.uber.org/zap"
+)
+
+// tempAuthUserContainer is the container of the user account that holds the
+// users, one object each, named <account>:<user>.
+const tempAuthUserContainer = "users"
+
+// tempAuthUserCacheTime is how long a user, or that there isn't one, is
+// cached for; changes made through any proxy drop it from the cache.
+const tempAuthUserCacheTime = 300
+
+// tempAuthUserStore keeps the tempauth users added through its admin
+// requests as objects in a reserved account, so every proxy sees the same
+// users, and they last across restarts without being in the config.
+type tempAuthUserStore struct {
+	account string
+}
+
+// tempAuthStoredUser is a user's object. It's also cached with an empty key
+// when there's no such user, as a user can't be given one.
+type tempAuthStoredUser struct {
+	Key    string   `json:"key"`
+	Groups []string `json:"groups"`
+}
+
+func (u *tempAuthUserStore) cacheKey(account, user string) string {
+	return "tempauthuser:" + account + ":" + user
+}
+
+// get returns the user, or nil if there's no such user.
+func (u *tempAuthUserStore) get(ctx context.Context, proxyCtx *ProxyContext, account, user string) (*testUser, error) {
+	var su tempAuthStoredUser
+	if err := proxyCtx.Cache.GetStructured(ctx, u.cacheKey(account, user), &su); err != nil {
+		resp := proxyCtx.C.GetObject(ctx, u.account, tempAuthUserContainer, account+":"+user, http.Header{})
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			su = tempAuthStoredUser{}
+		} else if resp.StatusCode/100 != 2 {
+			return nil, fmt.Errorf("status %d getting tempauth user %s:%s", resp.StatusCode, account, user)
+		} else if err := json.Unmarshal(body, &su); err != nil {
+			return nil, err
+		}
+		proxyCtx.Cache.Set(ctx, u.cacheKey(account, user), &su, tempAuthUserCacheTime)
+	}
+	if su.Key == "" {
+		return nil, nil
+	}
+	return &testUser{Account: account, Username: user, Password: su.Key, Roles: su.Groups}, nil
+}
+
+// put adds the user, or replaces its key and groups if it's already there,
+// creating the user account and container the first time.
+func (u *tempAuthUserStore) put(ctx context.Context, proxyCtx *ProxyContext, tu *testUser) error {
+	groups := tu.Roles
+	if groups == nil {
+		groups = []string{}
+	}
+	body, err := json.Marshal(&tempAuthStoredUser{Key: tu.Password, Groups: groups})
+	if err != nil {
+		return err
+	}
+	putUser := func() *http.Response {
+		return proxyCtx.C.PutObject(ctx, u.account, tempAuthUserContainer, tu.Account+":"+tu.Username, http.Header{
+			"X-Timestamp":    {common.GetTimestamp()},
+			"Content-Type":   {"application/json"},
+			"Content-Length": {strconv.Itoa(len(body))},
+		}, bytes.NewReader(body))
+	}
+	resp := putUser()
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		if resp = proxyCtx.C.PutAccount(ctx, u.account, http.Header{"X-Timestamp": {common.GetTimestamp()}}); resp.StatusCode/100 != 2 {
+			resp.Body.Close()
+			return fmt.Errorf("status %d creating tempauth user account %s", resp.StatusCode, u.account)
+		}
+		resp.Body.Close()
+		if resp = proxyCtx.C.PutContainer(ctx, u.account, tempAuthUserContainer, http.Header{"X-Timestamp": {common.GetTimestamp()}}); resp.StatusCode/100 != 2 {
+			resp.Body.Close()
+			return fmt.Errorf("status %d creating tempauth user container %s/%s", resp.StatusCode, u.account, tempAuthUserContainer)
+		}
+		resp.Body.Close()
+		resp = putUser()
+		resp.Body.Close()
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %d saving tempauth user %s:%s", resp.StatusCode, tu.Account, tu.Username)
+	}
+	proxyCtx.Cache.Delete(ctx, u.cacheKey(tu.Account, tu.Username))
+	return nil
+}
+
+// delete removes the user, and reports whether there was one.
+func (u *tempAuthUserStore) delete(ctx context.Context, proxyCtx *ProxyContext, account, user string) (bool, error) {
+	resp := proxyCtx.C.DeleteObject(ctx, u.account, tempAuthUserContainer, account+":"+user, http.Header{"X-Timestamp": {common.GetTimestamp()}})
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	} else if resp.StatusCode/100 != 2 {
+		return false, fmt.Errorf("status %d deleting tempauth user %s:%s", resp.StatusCode, account, user)
+	}
+	proxyCtx.Cache.Delete(ctx, u.cacheKey(account, user))
+	return true, nil
+}
+
+func (u *tempAuthUserStore) list(ctx context.Context, proxyCtx *ProxyContext) ([]testUser, error) {
+	var users []testUser
+	marker := ""
+	for {
+		resp := proxyCtx.C.GetContainerRaw(ctx, u.account, tempAuthUserContainer, map[string]string{"format": "json", "marker": marker}, http.Header{})
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			return users, nil
+		} else if resp.StatusCode/100 != 2 {
+			return nil, fmt.Errorf("status %d listing tempauth users", resp.StatusCode)
+		}
+		var objects []struct {
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal(body, &objects); err != nil {
+			return nil, err
+		}
+		if len(objects) == 0 {
+			return users, nil
+		}
+		for _, o := range objects {
+			parts := strings.SplitN(o.Name, ":", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			tu, err := u.get(ctx, proxyCtx, parts[0], parts[1])
+			if err != nil {
+				return nil, err
+			}
+			if tu != nil {
+				users = append(users, *tu)
+			}
+		}
+		marker = objects[len(objects)-1].Name
+	}
+}
+
+// tempAuthUserInfo is how a user is listed by GET /auth/users, which
+// doesn't give out keys.
+type tempAuthUserInfo struct {
+	Account string   `json:"account"`
+	User    string   `json:"user"`
+	Groups  []string `json:"groups"`
+	Source  string   `json:"source"`
+}
+
+// handleUsers serves the requests that manage the stored users, for tokens of
+// .reseller_admin users: GET /auth/users lists the users, PUT
+// /auth/users/<account>/<user> adds one or replaces its key and groups, and
+// DELETE removes one.
+func (ta *tempAuth) handleUsers(writer http.ResponseWriter, request *http.Request) {
+	ctx := GetProxyContext(request)
+	if ta.userStore == nil {
+		srv.StandardResponse(writer, http.StatusNotFound)
+		return
+	}
+	token := request.Header.Get("X-Auth-Token")
+	if token == "" {
+		srv.StandardResponse(writer, http.StatusUnauthorized)
+		return
+	}
+	var ca cachedAuth
+	if err := ctx.Cache.GetStructured(request.Context(), "auth:"+token, &ca); err == ring.CacheMiss {
+		srv.StandardResponse(writer, http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		srv.StandardResponse(writer, http.StatusServiceUnavailable)
+		return
+	}
+	ctx.RemoteUsers = ca.Groups
+	if !common.StringInSlice(".reseller_admin", ca.Groups) {
+		srv.StandardResponse(writer, http.StatusForbidden)
+		return
+	}
+	path := strings.TrimSuffix(strings.TrimPrefix(request.URL.Path, "/auth/users"), "/")
+	if path == "" {
+		if request.Method != "GET" && request.Method != "HEAD" {
+			srv.StandardResponse(writer, http.StatusMethodNotAllowed)
+			return
+		}
+		ta.listUsers(writer, request)
+		return
+	}
+	parts := strings.Split(path, "/")
+	if len(parts) != 3 || parts[1] == "" || parts[2] == "" || strings.Contains(parts[1], ":") || strings.Contains(parts[2], ":") {
+		srv.SimpleErrorResponse(writer, http.StatusBadRequest, "Users are /auth/users/<account>/<user>, without colons")
+		return
+	}
+	account, user := parts[1], parts[2]
+	switch request.Method {
+	case "PUT":
+		key := request.Header.Get("X-Auth-User-Key")
+		if key == "" {
+			srv.SimpleErrorResponse(writer, http.StatusBadRequest, "X-Auth-User-Key is required")
+			return
+		}
+		groups := strings.Fields(strings.Replace(request.Header.Get("X-Auth-User-Groups"), ",", " ", -1))
+		if err := ta.userStore.put(request.Context(), ctx, &testUser{Account: account, Username: user, Password: key, Roles: groups}); err != nil {
+			ctx.Logger.Error("Error saving tempauth user", zap.Error(err))
+			srv.StandardResponse(writer, http.StatusInternalServerError)
+			return
+		}
+		ta.forgetToken(request.Context(), ctx, user)
+		srv.StandardResponse(writer, http.StatusCreated)
+	case "DELETE":
+		found, err := ta.userStore.delete(request.Context(), ctx, account, user)
+		if err != nil {
+			ctx.Logger.Error("Error deleting tempauth user", zap.Error(err))
+			srv.StandardResponse(writer, http.StatusInternalServerError)
+			return
+		} else if !found {
+			srv.StandardResponse(writer, http.StatusNotFound)
+			return
+		}
+		ta.forgetToken(request.Context(), ctx, user)
+		srv.StandardResponse(writer, http.StatusNoContent)
+	default:
+		srv.StandardResponse(writer, http.StatusMethodNotAllowed)
+	}
+}
+
+func (ta *tempAuth) listUsers(writer http.ResponseWriter, request *http.Request) {
+	ctx := GetProxyContext(request)
+	dbUsers, err := ta.userStore.list(request.Context(), ctx)
+	if err != nil {
+		ctx.Logger.Error("Error listing tempauth users", zap.Error(err))
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	users := []tempAuthUserInfo{}
+	inDB := map[string]bool{}
+	for _, tu := range dbUsers {
+		inDB[tu.Account+":"+tu.Username] = true
+		users = append(users, tempAuthUserInfo{Account: tu.Account, User: tu.Username, Groups: tu.Roles, Source: "stored"})
+	}
+	// Stored users take the place of those in the config.
+	for _, tu := range ta.testUsers {
+		if !inDB[tu.Account+":"+tu.Username] {
+			users = append(users, tempAuthUserInfo{Account: tu.Account, User: tu.Username, Groups: tu.Roles, Source: "config"})
+		}
+	}
+	body, err := json.Marshal(users)
+	if err != nil {
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writer.WriteHeader(http.StatusOK)
+	if request.Method == "GET" {
+		writer.Write(body)
+	}
+}
+
+// forgetToken drops the user's cached token, so one handed out before its
+// key or groups changed, or it was deleted, stops working.
+func (ta *tempAuth) forgetToken(ctx context.Context, proxyCtx *ProxyContext, user string) {
+	var token string
+	if err := proxyCtx.Cache.GetStructured(ctx, "authuser:"+user, &token); err == nil && token != "" {
+		proxyCtx.Cache.Delete(ctx, "auth:"+token)
+	}
+	proxyCtx.Cache.Delete(ctx, "authuser:"+user)
+}
@@ -0,0 +1,166 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/client"
+	"github.com/troubling/hummingbird/common/test"
+	"github.com/troubling/nectar/nectarutil"
+)
+
+// tempAuthUserClient keeps the objects of a single container, which it only
+// has once the account and container are put.
+type tempAuthUserClient struct {
+	client.RequestClient
+	account   bool
+	container bool
+	objects   map[string]string
+}
+
+func (c *tempAuthUserClient) PutAccount(ctx context.Context, account string, headers http.Header) *http.Response {
+	c.account = true
+	return nectarutil.ResponseStub(201, "")
+}
+
+func (c *tempAuthUserClient) PutContainer(ctx context.Context, account string, container string, headers http.Header) *http.Response {
+	if !c.account {
+		return nectarutil.ResponseStub(404, "")
+	}
+	c.container = true
+	return nectarutil.ResponseStub(201, "")
+}
+
+func (c *tempAuthUserClient) PutObject(ctx context.Context, account string, container string, obj string, headers http.Header, src io.Reader) *http.Response {
+	if !c.container {
+		return nectarutil.ResponseStub(404, "")
+	}
+	body, _ := ioutil.ReadAll(src)
+	c.objects[obj] = string(body)
+	return nectarutil.ResponseStub(201, "")
+}
+
+func (c *tempAuthUserClient) GetObject(ctx context.Context, account string, container string, obj string, headers http.Header) *http.Response {
+	if body, ok := c.objects[obj]; ok {
+		return nectarutil.ResponseStub(200, body)
+	}
+	return nectarutil.ResponseStub(404, "")
+}
+
+func (c *tempAuthUserClient) DeleteObject(ctx context.Context, account string, container string, obj string, headers http.Header) *http.Response {
+	if _, ok := c.objects[obj]; !ok {
+		return nectarutil.ResponseStub(404, "")
+	}
+	delete(c.objects, obj)
+	return nectarutil.ResponseStub(204, "")
+}
+
+func (c *tempAuthUserClient) GetContainerRaw(ctx context.Context, account string, container string, options map[string]string, headers http.Header) *http.Response {
+	if !c.container {
+		return nectarutil.ResponseStub(404, "")
+	}
+	names := []string{}
+	for name := range c.objects {
+		if name > options["marker"] {
+			names = append(names, `{"name":"`+name+`"}`)
+		}
+	}
+	sort.Strings(names)
+	return nectarutil.ResponseStub(200, "["+strings.Join(names, ",")+"]")
+}
+
+// tempAuthUserMemcache keeps what's set in it until it's deleted.
+type tempAuthUserMemcache struct {
+	*responseCacheMemcache
+}
+
+func (mc *tempAuthUserMemcache) Delete(ctx context.Context, key string) error {
+	delete(mc.values, key)
+	return nil
+}
+
+func TestTempAuthUsers(t *testing.T) {
+	store := &tempAuthUserClient{objects: map[string]string{}}
+	passthrough := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	fakeMr := &tempAuthUserMemcache{&responseCacheMemcache{FakeMemcacheRing: &test.FakeMemcacheRing{}}}
+	adminAuth, _ := json.Marshal(cachedAuth{Groups: []string{".reseller_admin"}, Expires: time.Now().Unix() + 100})
+	userAuth, _ := json.Marshal(cachedAuth{Groups: []string{"test", "test:tester"}, Expires: time.Now().Unix() + 100})
+	fakeMr.values = map[string][]byte{"auth:AUTH_admin": adminAuth, "auth:AUTH_user": userAuth}
+	ta := &tempAuth{
+		reseller:  "AUTH_",
+		resellers: []string{"AUTH_"},
+		next:      passthrough,
+		testUsers: []testUser{{Account: "test", Username: "tester", Password: "testing", AccountID: "AUTH_test"}},
+		userStore: &tempAuthUserStore{account: ".tempauth"},
+	}
+	serve := func(method, path, token string, headers map[string]string) *httptest.ResponseRecorder {
+		fakeContext := NewFakeProxyContext(passthrough)
+		fakeContext.Cache = fakeMr
+		fakeContext.C = store
+		req := httptest.NewRequest(method, path, nil)
+		req = req.WithContext(context.WithValue(req.Context(), "proxycontext", fakeContext))
+		req.Header.Set("X-Auth-Token", token)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		ta.ServeHTTP(w, req)
+		return w
+	}
+	proxyCtx := NewFakeProxyContext(passthrough)
+	proxyCtx.Cache = fakeMr
+	proxyCtx.C = store
+
+	require.Equal(t, 403, serve("PUT", "/auth/users/test/backup", "AUTH_user", map[string]string{"X-Auth-User-Key": "secret"}).Code)
+	require.Equal(t, 400, serve("PUT", "/auth/users/test/backup", "AUTH_admin", nil).Code)
+	require.Equal(t, 400, serve("PUT", "/auth/users/test:backup", "AUTH_admin", map[string]string{"X-Auth-User-Key": "secret"}).Code)
+	require.Equal(t, 201, serve("PUT", "/auth/users/test/backup", "AUTH_admin", map[string]string{"X-Auth-User-Key": "secret", "X-Auth-User-Groups": ".admin, backups"}).Code)
+	tu, err := ta.getUser(context.Background(), proxyCtx, "test", "backup", "secret")
+	require.Nil(t, err)
+	require.Equal(t, []string{".admin", "backups"}, tu.Roles)
+	require.Equal(t, "AUTH_test", tu.AccountID)
+
+	// Rotating a key stops the old one working, without a restart, even
+	// though the user was cached.
+	require.Equal(t, 201, serve("PUT", "/auth/users/test/backup", "AUTH_admin", map[string]string{"X-Auth-User-Key": "newsecret"}).Code)
+	tu, err = ta.getUser(context.Background(), proxyCtx, "test", "backup", "secret")
+	require.Nil(t, err)
+	require.Nil(t, tu)
+	tu, err = ta.getUser(context.Background(), proxyCtx, "test", "backup", "newsecret")
+	require.Nil(t, err)
+	require.NotNil(t, tu)
+
+	w := serve("GET", "/auth/users", "AUTH_admin", nil)
+	require.Equal(t, 200, w.Code)
+	var users []tempAuthUserInfo
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &users))
+	require.Equal(t, []tempAuthUserInfo{
+		{Account: "test", User: "backup", Groups: []string{}, Source: "stored"},
+		{Account: "test", User: "tester", Source: "config"},
+	}, users)
+
+	require.Equal(t, 204, serve("DELETE", "/auth/users/test/backup", "AUTH_admin", nil).Code)
+	require.Equal(t, 404, serve("DELETE", "/auth/users/test/backup", "AUTH_admin", nil).Code)
+	tu, err = ta.getUser(context.Background(), proxyCtx, "test", "backup", "newsecret")
+	require.Nil(t, err)
+	require.Nil(t, tu)
+	tu, err = ta.getUser(context.Background(), proxyCtx, "test", "tester", "testing")
+	require.Nil(t, err)
+	require.NotNil(t, tu)
+
+	// A cached user is used without asking the store.
+	cached, _ := json.Marshal(tempAuthStoredUser{Key: "cachedkey"})
+	fakeMr.values["tempauthuser:test:cached"] = cached
+	tu, err = ta.getUser(context.Background(), proxyCtx, "test", "cached", "cachedkey")
+	require.Nil(t, err)
+	require.NotNil(t, tu)
+}
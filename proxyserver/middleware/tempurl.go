@@ -16,10 +16,16 @@
 package middleware
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"hash"
+	"net"
 	"net/http"
 	"path/filepath"
 	"strings"
@@ -74,30 +80,135 @@ func (w *tuWriter) WriteHeader(status int) {
 	w.ResponseWriter.WriteHeader(status)
 }
 
-func checkhmac(key, sig []byte, method, path string, expires time.Time) bool {
-	if method == "HEAD" {
-		for _, meth := range []string{"HEAD", "GET", "POST", "PUT"} {
-			mac := hmac.New(sha1.New, key)
-			fmt.Fprintf(mac, "%s\n%d\n%s", meth, expires.Unix(), path)
-			if hmac.Equal(sig, mac.Sum(nil)) {
+// tempURLDigests are the digests a signature may use, named as they are in
+// the allowed_digests setting and the "<digest>:<base64>" signature form.
+var tempURLDigests = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// parseTempURLSig decodes a signature that's either hex, with the digest
+// given by its length, or "<digest>:<base64>". The digest is empty for hex
+// of any other length.
+func parseTempURLSig(sig string) (string, []byte, error) {
+	if i := strings.Index(sig, ":"); i >= 0 {
+		digest := sig[:i]
+		b64 := strings.NewReplacer("-", "+", "_", "/").Replace(strings.TrimRight(sig[i+1:], "="))
+		sigb, err := base64.RawStdEncoding.DecodeString(b64)
+		if err != nil {
+			return "", nil, err
+		}
+		return digest, sigb, nil
+	}
+	sigb, err := hex.DecodeString(sig)
+	if err != nil {
+		return "", nil, err
+	}
+	switch len(sigb) {
+	case sha1.Size:
+		return "sha1", sigb, nil
+	case sha256.Size:
+		return "sha256", sigb, nil
+	case sha512.Size:
+		return "sha512", sigb, nil
+	}
+	return "", sigb, nil
+}
+
+// tempURLIPAllowed reports whether the client's address is within ipRange,
+// which is a single address or a CIDR.
+func tempURLIPAllowed(ipRange, remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if _, network, err := net.ParseCIDR(ipRange); err == nil {
+		return network.Contains(ip)
+	}
+	return ip.Equal(net.ParseIP(ipRange))
+}
+
+// tempURLKeyScope returns SCOPE_ACCOUNT if valid accepts one of the account's
+// temp url keys, SCOPE_CONTAINER if it accepts one of the container's, and
+// SCOPE_INVALID otherwise.
+func tempURLKeyScope(ctx context.Context, proxyCtx *ProxyContext, account, container string, valid func(key []byte) bool) int {
+	matches := func(metadata map[string]string) bool {
+		for _, name := range []string{"Temp-Url-Key", "Temp-Url-Key-2"} {
+			if key, ok := metadata[name]; ok && valid([]byte(key)) {
 				return true
 			}
 		}
 		return false
-	} else {
-		mac := hmac.New(sha1.New, key)
-		fmt.Fprintf(mac, "%s\n%d\n%s", method, expires.Unix(), path)
-		return hmac.Equal(sig, mac.Sum(nil))
 	}
+	if ai, err := proxyCtx.GetAccountInfo(ctx, account); err == nil {
+		if matches(ai.Metadata) {
+			return SCOPE_ACCOUNT
+		} else if ci, err := proxyCtx.C.GetContainerInfo(ctx, account, container); err == nil && matches(ci.Metadata) {
+			return SCOPE_CONTAINER
+		}
+	}
+	return SCOPE_INVALID
+}
+
+// tempURLKeyTooShort returns the header of an account or container write
+// that sets a temp url key shorter than minKeyLength, if there is one.
+// Setting a key empty removes it, so that's always allowed.
+func tempURLKeyTooShort(request *http.Request, minKeyLength int) string {
+	if minKeyLength <= 0 || (request.Method != "PUT" && request.Method != "POST") {
+		return ""
+	}
+	apiReq, account, container, obj := getPathParts(request)
+	if !apiReq || account == "" || obj != "" {
+		return ""
+	}
+	targetType := "Account"
+	if container != "" {
+		targetType = "Container"
+	}
+	for _, name := range []string{"Temp-Url-Key", "Temp-Url-Key-2"} {
+		header := fmt.Sprintf("X-%s-Meta-%s", targetType, name)
+		if key := request.Header.Get(header); key != "" && len(key) < minKeyLength {
+			return header
+		}
+	}
+	return ""
 }
 
-func tempurl(requestsMetric tally.Counter) func(http.Handler) http.Handler {
+func checkhmac(newHash func() hash.Hash, key, sig []byte, method, path, ipRange string, expires time.Time) bool {
+	prefix := ""
+	if ipRange != "" {
+		prefix = fmt.Sprintf("ip=%s\n", ipRange)
+	}
+	methods := []string{method}
+	if method == "HEAD" {
+		methods = []string{"HEAD", "GET", "POST", "PUT"}
+	}
+	for _, meth := range methods {
+		mac := hmac.New(newHash, key)
+		fmt.Fprintf(mac, "%s%s\n%d\n%s", prefix, meth, expires.Unix(), path)
+		if hmac.Equal(sig, mac.Sum(nil)) {
+			return true
+		}
+	}
+	return false
+}
+
+func tempurl(requestsMetric tally.Counter, allowedDigests map[string]bool, minKeyLength int) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 			if request.Method == "OPTIONS" {
 				next.ServeHTTP(writer, request)
 				return
 			}
+			if header := tempURLKeyTooShort(request, minKeyLength); header != "" {
+				srv.SimpleErrorResponse(writer, http.StatusBadRequest, fmt.Sprintf("%s must be at least %d characters", header, minKeyLength))
+				return
+			}
 			ctx := GetProxyContext(request)
 			if ctx.Authorize != nil {
 				next.ServeHTTP(writer, request)
@@ -124,12 +235,18 @@ func tempurl(requestsMetric tally.Counter) func(http.Handler) http.Handler {
 				return
 			}
 
-			sigb, err := hex.DecodeString(sig)
+			digest, sigb, err := parseTempURLSig(sig)
 			if err != nil {
 				srv.StandardResponse(writer, 401)
 				return
 			}
 
+			ipRange := q.Get("temp_url_ip_range")
+			if ipRange != "" && !tempURLIPAllowed(ipRange, request.RemoteAddr) {
+				srv.StandardResponse(writer, 401)
+				return
+			}
+
 			apiReq, account, container, obj := getPathParts(request)
 			if !apiReq || account == "" || container == "" {
 				srv.StandardResponse(writer, 401)
@@ -141,6 +258,11 @@ func tempurl(requestsMetric tally.Counter) func(http.Handler) http.Handler {
 				return
 			}
 
+			if !allowedDigests[digest] {
+				srv.StandardResponse(writer, 401)
+				return
+			}
+
 			path := ""
 			if _, hasPrefix := q["temp_url_prefix"]; hasPrefix {
 				prefix := q.Get("temp_url_prefix")
@@ -153,20 +275,9 @@ func tempurl(requestsMetric tally.Counter) func(http.Handler) http.Handler {
 				path = fmt.Sprintf("/v1/%s/%s/%s", account, container, obj)
 			}
 
-			scope := SCOPE_INVALID
-			if ai, err := ctx.GetAccountInfo(request.Context(), account); err == nil {
-				if key, ok := ai.Metadata["Temp-Url-Key"]; ok && checkhmac([]byte(key), sigb, request.Method, path, expires) {
-					scope = SCOPE_ACCOUNT
-				} else if key, ok := ai.Metadata["Temp-Url-Key-2"]; ok && checkhmac([]byte(key), sigb, request.Method, path, expires) {
-					scope = SCOPE_ACCOUNT
-				} else if ci, err := ctx.C.GetContainerInfo(request.Context(), account, container); err == nil {
-					if key, ok := ci.Metadata["Temp-Url-Key"]; ok && checkhmac([]byte(key), sigb, request.Method, path, expires) {
-						scope = SCOPE_CONTAINER
-					} else if key, ok := ci.Metadata["Temp-Url-Key-2"]; ok && checkhmac([]byte(key), sigb, request.Method, path, expires) {
-						scope = SCOPE_CONTAINER
-					}
-				}
-			}
+			scope := tempURLKeyScope(request.Context(), ctx, account, container, func(key []byte) bool {
+				return checkhmac(tempURLDigests[digest], key, sigb, request.Method, path, ipRange, expires)
+			})
 			if scope == SCOPE_INVALID {
 				srv.StandardResponse(writer, 401)
 				return
@@ -195,13 +306,36 @@ func tempurl(requestsMetric tally.Counter) func(http.Handler) http.Handler {
 	}
 }
 
+// loadAllowedDigests reads the allowed_digests setting that tempurl and
+// formpost signatures are checked against.
+func loadAllowedDigests(config conf.Section) (map[string]bool, []string, error) {
+	allowedDigests := map[string]bool{}
+	var digestNames []string
+	for _, digest := range strings.Fields(config.GetDefault("allowed_digests", "sha1 sha256 sha512")) {
+		if _, ok := tempURLDigests[digest]; !ok {
+			return nil, nil, fmt.Errorf("Invalid digest %q in allowed_digests", digest)
+		}
+		allowedDigests[digest] = true
+		digestNames = append(digestNames, digest)
+	}
+	if len(allowedDigests) == 0 {
+		return nil, nil, fmt.Errorf("No allowed_digests configured")
+	}
+	return allowedDigests, digestNames, nil
+}
+
 func NewTempURL(config conf.Section, metricsScope tally.Scope) (func(http.Handler) http.Handler, error) {
+	allowedDigests, digestNames, err := loadAllowedDigests(config)
+	if err != nil {
+		return nil, err
+	}
 	RegisterInfo("tempurl", map[string]interface{}{
+		"allowed_digests":         digestNames,
 		"methods":                 []string{"GET", "HEAD", "PUT", "POST", "DELETE"},
 		"incoming_remove_headers": []string{"x-timestamp"},
 		"incoming_allow_headers":  []string{},
 		"outgoing_remove_headers": []string{"x-object-meta-*"}, "outgoing_allow_headers": []string{"x-object-meta-public-*"},
 	})
 	requestsMetric := metricsScope.Counter("tempurl_requests")
-	return tempurl(requestsMetric), nil
+	return tempurl(requestsMetric, allowedDigests, int(config.GetInt("min_key_length", 0))), nil
 }
@@ -17,7 +17,14 @@ package middleware
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
 	"encoding/hex"
+	"fmt"
+	"hash"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -32,6 +39,14 @@ import (
 	"go.uber.org/zap"
 )
 
+var testTempURLDigests = map[string]bool{"sha1": true, "sha256": true, "sha512": true}
+
+func tempURLSig(newHash func() hash.Hash, key, body string) []byte {
+	mac := hmac.New(newHash, []byte(key))
+	mac.Write([]byte(body))
+	return mac.Sum(nil)
+}
+
 func TestDispositionFormat(t *testing.T) {
 	require.Equal(t, "inline; filename=\"a.txt\"; filename*=UTF-8''a.txt", dispositionFormat("inline", "a.txt"))
 	require.Equal(t, "attachment; filename=\"%25.txt\"; filename*=UTF-8''%25.txt", dispositionFormat("attachment", "%.txt"))
@@ -54,20 +69,20 @@ func TestCheckHmac(t *testing.T) {
 	// test cases generated by example python code
 	sig, err := hex.DecodeString("6deb0c7da21f396f1368681dc0bd57df0d1c4369")
 	require.Nil(t, err)
-	require.True(t, checkhmac([]byte("mykey"), sig, "GET",
-		"/v1/AUTH_account/container/object", time.Unix(1493709631, 0).In(time.UTC)))
+	require.True(t, checkhmac(sha1.New, []byte("mykey"), sig, "GET",
+		"/v1/AUTH_account/container/object", "", time.Unix(1493709631, 0).In(time.UTC)))
 
 	// sig is actually for a POST, but make sure we can HEAD with it.
 	sig, err = hex.DecodeString("1ad2301fcc4e525ee0167298c0fbb426e90fb3b1")
 	require.Nil(t, err)
-	require.True(t, checkhmac([]byte("mykey"), sig, "HEAD",
-		"/v1/AUTH_account/container/object", time.Unix(1493709631, 0).In(time.UTC)))
+	require.True(t, checkhmac(sha1.New, []byte("mykey"), sig, "HEAD",
+		"/v1/AUTH_account/container/object", "", time.Unix(1493709631, 0).In(time.UTC)))
 
 	// sig is actually for a POST, but make sure we can HEAD with it.
 	sig, err = hex.DecodeString("1111111111111111111111111111111111111111")
 	require.Nil(t, err)
-	require.False(t, checkhmac([]byte("mykey"), sig, "HEAD",
-		"/v1/AUTH_account/container/object", time.Unix(1493709631, 0).In(time.UTC)))
+	require.False(t, checkhmac(sha1.New, []byte("mykey"), sig, "HEAD",
+		"/v1/AUTH_account/container/object", "", time.Unix(1493709631, 0).In(time.UTC)))
 }
 
 func TestTuWriter(t *testing.T) {
@@ -105,7 +120,7 @@ func TestTempurlMiddlewarePassOptions(t *testing.T) {
 		require.Equal(t, r, request)
 		served = true
 	})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(common.NewTestScope().Counter("test_tempurl"), testTempURLDigests, 0)(handler)
 	mid.ServeHTTP(w, r)
 	require.True(t, served)
 }
@@ -125,7 +140,7 @@ func TestTempurlMiddlewarePassAlreadyAuthorized(t *testing.T) {
 		require.Equal(t, r, request)
 		served = true
 	})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(common.NewTestScope().Counter("test_tempurl"), testTempURLDigests, 0)(handler)
 	mid.ServeHTTP(w, r)
 	require.True(t, served)
 }
@@ -140,7 +155,7 @@ func TestTempurlMiddlewarePassNoQuery(t *testing.T) {
 		require.Equal(t, r, request)
 		served = true
 	})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(common.NewTestScope().Counter("test_tempurl"), testTempURLDigests, 0)(handler)
 	mid.ServeHTTP(w, r)
 	require.True(t, served)
 }
@@ -150,7 +165,7 @@ func TestTempurlMiddleware401OnlySig(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", &ProxyContext{}))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(common.NewTestScope().Counter("test_tempurl"), testTempURLDigests, 0)(handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 401, w.Result().StatusCode)
 }
@@ -160,7 +175,7 @@ func TestTempurlMiddleware401Expired(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", &ProxyContext{}))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(common.NewTestScope().Counter("test_tempurl"), testTempURLDigests, 0)(handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 401, w.Result().StatusCode)
 }
@@ -170,7 +185,7 @@ func TestTempurlMiddleware401BadSig(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", &ProxyContext{}))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(common.NewTestScope().Counter("test_tempurl"), testTempURLDigests, 0)(handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 401, w.Result().StatusCode)
 }
@@ -180,7 +195,7 @@ func TestTempurlMiddleware401NoContainer(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", &ProxyContext{}))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(common.NewTestScope().Counter("test_tempurl"), testTempURLDigests, 0)(handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 401, w.Result().StatusCode)
 }
@@ -191,7 +206,7 @@ func TestTempurlMiddleware400PuttingManifest(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", &ProxyContext{}))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(common.NewTestScope().Counter("test_tempurl"), testTempURLDigests, 0)(handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 400, w.Result().StatusCode)
 }
@@ -212,7 +227,7 @@ func TestTempurlMiddleware401NoKeys(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", ctx))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(common.NewTestScope().Counter("test_tempurl"), testTempURLDigests, 0)(handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 401, w.Result().StatusCode)
 }
@@ -233,7 +248,7 @@ func TestTempurlMiddleware401WrongKeys(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", ctx))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(common.NewTestScope().Counter("test_tempurl"), testTempURLDigests, 0)(handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 401, w.Result().StatusCode)
 }
@@ -265,7 +280,7 @@ func TestTempurlMiddlewareContainerKey(t *testing.T) {
 		require.True(t, ok)
 		writer.WriteHeader(200)
 	})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(common.NewTestScope().Counter("test_tempurl"), testTempURLDigests, 0)(handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 200, w.Result().StatusCode)
 }
@@ -291,7 +306,7 @@ func TestTempurlMiddlewarePath(t *testing.T) {
 		require.True(t, ok)
 		writer.WriteHeader(200)
 	})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(common.NewTestScope().Counter("test_tempurl"), testTempURLDigests, 0)(handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 200, w.Result().StatusCode)
 }
@@ -324,7 +339,138 @@ func TestTempurlMiddlewareAccountKey(t *testing.T) {
 		require.False(t, ok)
 		writer.WriteHeader(200)
 	})
-	mid := tempurl(common.NewTestScope().Counter("test_tempurl"))(handler)
+	mid := tempurl(common.NewTestScope().Counter("test_tempurl"), testTempURLDigests, 0)(handler)
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 200, w.Result().StatusCode)
 }
+
+func TestParseTempURLSig(t *testing.T) {
+	sig := tempURLSig(sha256.New, "mykey", "GET\n9999999999\n/v1/a/c/o")
+	digest, sigb, err := parseTempURLSig(hex.EncodeToString(sig))
+	require.Nil(t, err)
+	require.Equal(t, "sha256", digest)
+	require.Equal(t, sig, sigb)
+
+	sig = tempURLSig(sha512.New, "mykey", "GET\n9999999999\n/v1/a/c/o")
+	digest, sigb, err = parseTempURLSig("sha512:" + base64.URLEncoding.EncodeToString(sig))
+	require.Nil(t, err)
+	require.Equal(t, "sha512", digest)
+	require.Equal(t, sig, sigb)
+	digest, sigb, err = parseTempURLSig("sha512:" + base64.RawStdEncoding.EncodeToString(sig))
+	require.Nil(t, err)
+	require.Equal(t, sig, sigb)
+
+	digest, _, err = parseTempURLSig("abcd")
+	require.Nil(t, err)
+	require.Equal(t, "", digest)
+	_, _, err = parseTempURLSig("xyz")
+	require.NotNil(t, err)
+	_, _, err = parseTempURLSig("sha256:!!!")
+	require.NotNil(t, err)
+}
+
+func TestTempURLIPAllowed(t *testing.T) {
+	require.True(t, tempURLIPAllowed("10.0.0.1", "10.0.0.1:1234"))
+	require.False(t, tempURLIPAllowed("10.0.0.1", "10.0.0.2:1234"))
+	require.True(t, tempURLIPAllowed("10.0.0.0/24", "10.0.0.200:1234"))
+	require.False(t, tempURLIPAllowed("10.0.0.0/24", "10.0.1.1:1234"))
+	require.True(t, tempURLIPAllowed("fd00::/8", "[fd00::1]:1234"))
+	require.False(t, tempURLIPAllowed("garbage", "10.0.0.1:1234"))
+}
+
+func serveTempURL(r *http.Request, allowedDigests map[string]bool) int {
+	f, _ := client.NewProxyClient(staticPolicyList, srv.NewTestConfigLoader(&test.FakeRing{}),
+		nil, "", "", "", "", "", conf.Config{})
+	ctx := &ProxyContext{
+		C: f.NewRequestClient(nil, map[string]*client.ContainerInfo{
+			"container/a/c": {Metadata: map[string]string{"Temp-Url-Key": "mykey"}},
+		}, zap.NewNop()),
+		accountInfoCache: map[string]*AccountInfo{"account/a": {Metadata: map[string]string{}}},
+	}
+	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", ctx))
+	w := httptest.NewRecorder()
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if ok, _ := GetProxyContext(request).Authorize(request); !ok {
+			writer.WriteHeader(401)
+			return
+		}
+		writer.WriteHeader(200)
+	})
+	tempurl(common.NewTestScope().Counter("test_tempurl"), allowedDigests, 0)(handler).ServeHTTP(w, r)
+	return w.Result().StatusCode
+}
+
+func TestTempurlMiddlewareDigests(t *testing.T) {
+	sha256Sig := hex.EncodeToString(tempURLSig(sha256.New, "mykey", "PUT\n9999999999\n/v1/a/c/o"))
+	r := httptest.NewRequest("PUT", "/v1/a/c/o?temp_url_sig="+sha256Sig+"&temp_url_expires=9999999999", nil)
+	require.Equal(t, 200, serveTempURL(r, testTempURLDigests))
+
+	sha512Sig := "sha512:" + base64.URLEncoding.EncodeToString(tempURLSig(sha512.New, "mykey", "DELETE\n9999999999\n/v1/a/c/o"))
+	r = httptest.NewRequest("DELETE", "/v1/a/c/o?temp_url_sig="+sha512Sig+"&temp_url_expires=9999999999", nil)
+	require.Equal(t, 200, serveTempURL(r, testTempURLDigests))
+
+	// Digests that aren't allowed are refused even with a good signature.
+	r = httptest.NewRequest("PUT", "/v1/a/c/o?temp_url_sig="+sha256Sig+"&temp_url_expires=9999999999", nil)
+	require.Equal(t, 401, serveTempURL(r, map[string]bool{"sha512": true}))
+}
+
+func TestTempurlMiddlewareIPRange(t *testing.T) {
+	body := fmt.Sprintf("ip=%s\nGET\n9999999999\n/v1/a/c/o", "192.0.2.0/24")
+	sig := hex.EncodeToString(tempURLSig(sha256.New, "mykey", body))
+	url := "/v1/a/c/o?temp_url_sig=" + sig + "&temp_url_expires=9999999999&temp_url_ip_range=192.0.2.0/24"
+	r := httptest.NewRequest("GET", url, nil)
+	r.RemoteAddr = "192.0.2.10:5000"
+	require.Equal(t, 200, serveTempURL(r, testTempURLDigests))
+
+	r = httptest.NewRequest("GET", url, nil)
+	r.RemoteAddr = "198.51.100.1:5000"
+	require.Equal(t, 401, serveTempURL(r, testTempURLDigests))
+
+	// The range is part of what's signed, so it can't be widened.
+	r = httptest.NewRequest("GET", "/v1/a/c/o?temp_url_sig="+sig+"&temp_url_expires=9999999999&temp_url_ip_range=0.0.0.0/0", nil)
+	r.RemoteAddr = "192.0.2.10:5000"
+	require.Equal(t, 401, serveTempURL(r, testTempURLDigests))
+
+	// Nor dropped.
+	r = httptest.NewRequest("GET", "/v1/a/c/o?temp_url_sig="+sig+"&temp_url_expires=9999999999", nil)
+	r.RemoteAddr = "192.0.2.10:5000"
+	require.Equal(t, 401, serveTempURL(r, testTempURLDigests))
+}
+
+func TestTempurlMiddlewarePrefixSha256(t *testing.T) {
+	sig := hex.EncodeToString(tempURLSig(sha256.New, "mykey", "GET\n9999999999\nprefix:/v1/a/c/pre"))
+	r := httptest.NewRequest("GET", "/v1/a/c/prefixed?temp_url_sig="+sig+"&temp_url_expires=9999999999&temp_url_prefix=pre", nil)
+	require.Equal(t, 200, serveTempURL(r, testTempURLDigests))
+	r = httptest.NewRequest("GET", "/v1/a/c/other?temp_url_sig="+sig+"&temp_url_expires=9999999999&temp_url_prefix=pre", nil)
+	require.Equal(t, 401, serveTempURL(r, testTempURLDigests))
+}
+
+func TestNewTempURLDigests(t *testing.T) {
+	_, err := NewTempURL(conf.Section{}, common.NewTestScope())
+	require.Nil(t, err)
+	config, err := conf.StringConfig("[filter:tempurl]\nallowed_digests = sha256 md5\n")
+	require.Nil(t, err)
+	_, err = NewTempURL(config.GetSection("filter:tempurl"), common.NewTestScope())
+	require.NotNil(t, err)
+}
+
+func TestTempurlMiddlewareMinKeyLength(t *testing.T) {
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(204)
+	})
+	mid := tempurl(common.NewTestScope().Counter("test_tempurl"), testTempURLDigests, 16)(handler)
+	serve := func(method, path, header, key string) int {
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set(header, key)
+		r = r.WithContext(context.WithValue(r.Context(), "proxycontext", &ProxyContext{}))
+		w := httptest.NewRecorder()
+		mid.ServeHTTP(w, r)
+		return w.Result().StatusCode
+	}
+	require.Equal(t, 400, serve("POST", "/v1/a", "X-Account-Meta-Temp-Url-Key", "short"))
+	require.Equal(t, 400, serve("PUT", "/v1/a/c", "X-Container-Meta-Temp-Url-Key-2", "short"))
+	require.Equal(t, 204, serve("POST", "/v1/a", "X-Account-Meta-Temp-Url-Key-2", "0123456789abcdef"))
+	// Removing a key, or setting other metadata, is fine.
+	require.Equal(t, 204, serve("POST", "/v1/a/c", "X-Container-Meta-Temp-Url-Key", ""))
+	require.Equal(t, 204, serve("POST", "/v1/a/c/o", "X-Object-Meta-Temp-Url-Key", "short"))
+}
@@ -222,9 +222,20 @@ func (v *versionedWrites) putVersionedObj(writer http.ResponseWriter, req *http.
 
 func okAuthFunc(r *http.Request) (bool, int) { return true, http.StatusOK }
 
+// conditionalHeaders are the client's preconditions on its own request; they
+// mustn't be applied to the GETs made of the versions being copied.
+var conditionalHeaders = []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "Range"}
+
+func (v *versionedWrites) getObject(request *http.Request, path string) (io.ReadCloser, http.Header, int) {
+	getRequest := request.WithContext(request.Context())
+	getRequest.Header = make(http.Header)
+	CopyItemsExclude(getRequest.Header, request.Header, conditionalHeaders)
+	return PipedGet(common.Urlencode(path), getRequest, "VW", okAuthFunc)
+}
+
 func (v *versionedWrites) copyObject(writer http.ResponseWriter, request *http.Request, dest string, src string) bool {
 	ctx := GetProxyContext(request)
-	srcBody, srcHeader, srcStatus := PipedGet(common.Urlencode(src), request, "VW", okAuthFunc)
+	srcBody, srcHeader, srcStatus := v.getObject(request, src)
 	if srcBody != nil {
 		defer srcBody.Close()
 	}
@@ -258,7 +269,7 @@ func (v *versionedWrites) copyCurrent(writer http.ResponseWriter, request *http.
 		}
 	}
 
-	srcBody, srcHeader, srcStatus := PipedGet(common.Urlencode(request.URL.Path), request, "VW", okAuthFunc)
+	srcBody, srcHeader, srcStatus := v.getObject(request, request.URL.Path)
 	if srcBody != nil {
 		defer srcBody.Close()
 	}
@@ -25,12 +25,15 @@ import (
 	"net/http/httptest"
 	"regexp"
 	//"strconv"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 
 	"github.com/troubling/hummingbird/client"
+	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/conf"
 	"github.com/troubling/hummingbird/common/srv"
 	"github.com/troubling/hummingbird/common/test"
@@ -413,3 +416,168 @@ func TestDisabled(t *testing.T) {
 	require.Equal(t, 412, resp3.StatusCode)
 	require.Equal(t, "Versioned Writes is disabled", string(body3))
 }
+
+type versionedBackendObject struct {
+	timestamp   string
+	contentType string
+	body        string
+}
+
+// versionedBackend stands in for the rest of the proxy, keeping objects in
+// memory and remembering every version of /v1/a/c/o it has been sent.
+type versionedBackend struct {
+	lock      sync.Mutex
+	writes    int
+	objects   map[string]versionedBackendObject
+	histories map[string]string
+}
+
+func newVersionedBackend() *versionedBackend {
+	return &versionedBackend{objects: map[string]versionedBackendObject{}, histories: map[string]string{}}
+}
+
+func (b *versionedBackend) put(path, contentType, body string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.writes++
+	ts, _ := common.StandardizeTimestamp(fmt.Sprintf("%d.00000", 1000+b.writes))
+	b.objects[path] = versionedBackendObject{timestamp: ts, contentType: contentType, body: body}
+	if path == "/v1/a/c/o" {
+		b.histories[ts] = body
+	}
+}
+
+func (b *versionedBackend) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	b.lock.Lock()
+	obj, ok := b.objects[request.URL.Path]
+	b.lock.Unlock()
+	switch request.Method {
+	case "GET", "HEAD":
+		if !ok {
+			writer.WriteHeader(404)
+			return
+		}
+		if request.Header.Get("If-None-Match") == "*" {
+			writer.WriteHeader(304)
+			return
+		}
+		writer.Header().Set("X-Timestamp", obj.timestamp)
+		writer.Header().Set("Content-Type", obj.contentType)
+		writer.WriteHeader(200)
+		if request.Method == "GET" {
+			writer.Write([]byte(obj.body))
+		}
+	case "PUT":
+		body, _ := ioutil.ReadAll(request.Body)
+		if ok && request.Header.Get("If-None-Match") == "*" {
+			writer.WriteHeader(412)
+			return
+		}
+		b.put(request.URL.Path, request.Header.Get("Content-Type"), string(body))
+		writer.WriteHeader(201)
+	default:
+		writer.WriteHeader(405)
+	}
+}
+
+func newVersionedRequest(t *testing.T, handler http.Handler, method, path, body string) *http.Request {
+	f, err := client.NewProxyClient(staticPolicyList, srv.NewTestConfigLoader(&test.FakeRing{}),
+		nil, "", "", "", "", "", conf.Config{})
+	require.Nil(t, err)
+	req, err := http.NewRequest(method, path, bytes.NewBuffer([]byte(body)))
+	require.Nil(t, err)
+	ctx := &ProxyContext{
+		ProxyContextMiddleware: &ProxyContextMiddleware{
+			next: handler,
+		},
+		Logger: zap.NewNop(),
+		C: f.NewRequestClient(nil, map[string]*client.ContainerInfo{
+			"container/a/c": {
+				SysMetadata: map[string]string{
+					"Versions-Location": "c_v",
+				},
+			},
+			"container/a/c_v": {},
+		}, zap.NewNop()),
+	}
+	return req.WithContext(context.WithValue(req.Context(), "proxycontext", ctx))
+}
+
+func TestObjectCopyVersioned(t *testing.T) {
+	backend := newVersionedBackend()
+	backend.put("/v1/a/c/o", "text/plain", "old contents")
+	backend.put("/v1/a/c/src", "text/plain", "copied contents")
+	oldTimestamp := backend.objects["/v1/a/c/o"].timestamp
+	c, err := NewCopyMiddleware(conf.Section{}, common.NewTestScope())
+	require.Nil(t, err)
+	handler := c(&versionedWrites{next: backend, enabled: true})
+
+	req := newVersionedRequest(t, handler, "COPY", "/v1/a/c/src", "")
+	req.Header.Set("Destination", "c/o")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	require.Equal(t, 201, w.Code)
+
+	// The version being copied over is kept, under the timestamp it was
+	// written at, and the copy replaces it.
+	archived, ok := backend.objects["/v1/a/c_v/001o/"+oldTimestamp]
+	require.True(t, ok)
+	require.Equal(t, "old contents", archived.body)
+	require.Equal(t, "text/plain", archived.contentType)
+	require.Equal(t, "copied contents", backend.objects["/v1/a/c/o"].body)
+	require.Equal(t, "copied contents", backend.objects["/v1/a/c/src"].body)
+}
+
+func TestObjectPutConditionalVersioned(t *testing.T) {
+	backend := newVersionedBackend()
+	backend.put("/v1/a/c/o", "text/plain", "old contents")
+	vw := &versionedWrites{next: backend, enabled: true}
+
+	// The client's precondition applies to its PUT, not to the GET of the
+	// version being kept.
+	req := newVersionedRequest(t, vw, "PUT", "/v1/a/c/o", "new contents")
+	req.Header.Set("If-None-Match", "*")
+	w := httptest.NewRecorder()
+	vw.ServeHTTP(w, req)
+	require.Equal(t, 412, w.Code)
+	require.Equal(t, "old contents", backend.objects["/v1/a/c/o"].body)
+}
+
+func TestObjectPutConcurrentVersioned(t *testing.T) {
+	backend := newVersionedBackend()
+	backend.put("/v1/a/c/o", "text/plain", "original")
+	originalTimestamp := backend.objects["/v1/a/c/o"].timestamp
+	vw := &versionedWrites{next: backend, enabled: true}
+
+	var wg sync.WaitGroup
+	codes := make([]int, 10)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := newVersionedRequest(t, vw, "PUT", "/v1/a/c/o", fmt.Sprintf("version %d", i))
+			w := httptest.NewRecorder()
+			vw.ServeHTTP(w, req)
+			codes[i] = w.Code
+		}(i)
+	}
+	wg.Wait()
+	for i, code := range codes {
+		require.Equal(t, 201, code, "PUT %d", i)
+	}
+
+	// However the overwrites interleave, each archived copy holds the
+	// version its name says it does, and the original is never lost.
+	archives := 0
+	for path, obj := range backend.objects {
+		if !strings.HasPrefix(path, "/v1/a/c_v/001o/") {
+			continue
+		}
+		archives++
+		ts := strings.TrimPrefix(path, "/v1/a/c_v/001o/")
+		require.Equal(t, backend.histories[ts], obj.body, path)
+	}
+	require.True(t, archives >= 1 && archives <= len(codes))
+	require.Equal(t, "original", backend.objects["/v1/a/c_v/001o/"+originalTimestamp].body)
+	require.Regexp(t, `^version \d$`, backend.objects["/v1/a/c/o"].body)
+}
@@ -16,6 +16,11 @@
 package proxyserver
 
 import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
 	"mime"
 	"net/http"
 	"path/filepath"
@@ -179,7 +184,7 @@ func (server *ProxyServer) ObjectPostHandler(writer http.ResponseWriter, request
 			return
 		}
 	}
-	if status, str := common.CheckObjPost(request, vars["obj"]); status != http.StatusOK {
+	if status, str := ctx.Constraints().CheckObjPost(request, vars["obj"]); status != http.StatusOK {
 		writer.Header().Set("Content-Type", "text/plain")
 		writer.WriteHeader(status)
 		writer.Write([]byte(str))
@@ -235,17 +240,60 @@ func (server *ProxyServer) ObjectPutHandler(writer http.ResponseWriter, request
 		}
 		request.Header.Set("Content-Type", contentType)
 	}
-	if status, str := common.CheckObjPut(request, vars["obj"]); status != http.StatusOK {
+	if status, str := ctx.Constraints().CheckObjPut(request, vars["obj"]); status != http.StatusOK {
 		writer.Header().Set("Content-Type", "text/plain")
 		writer.WriteHeader(status)
 		writer.Write([]byte(str))
 		return
 	}
-	resp := ctx.C.PutObject(request.Context(), vars["account"], vars["container"], vars["obj"], request.Header, request.Body)
+	var body io.Reader = request.Body
+	var etagReader *trailerEtagReader
+	if len(request.Trailer) > 0 {
+		etagReader = &trailerEtagReader{Reader: request.Body, trailer: request.Trailer, hash: md5.New()}
+		body = etagReader
+	}
+	resp := ctx.C.PutObject(request.Context(), vars["account"], vars["container"], vars["obj"], request.Header, body)
 	resp.Body.Close()
+	if etagReader != nil && etagReader.mismatch {
+		srv.StandardResponse(writer, http.StatusUnprocessableEntity)
+		return
+	}
 	writer.Header().Set("Etag", resp.Header.Get("Etag"))
 	if modified, err := common.ParseDate(request.Header.Get("X-Timestamp")); err == nil {
 		writer.Header().Set("Last-Modified", common.FormatLastModified(modified))
 	}
 	srv.StandardResponse(writer, resp.StatusCode)
 }
+
+var errTrailerEtagMismatch = errors.New("checksum trailer does not match the object contents")
+
+// trailerEtagReader checks a chunked PUT body against the ETag or Content-MD5
+// the client sent as a trailer, failing the final read instead of returning io.EOF if they
+// don't match so the object servers never see a complete upload.
+type trailerEtagReader struct {
+	io.Reader
+	trailer  http.Header
+	hash     hash.Hash
+	mismatch bool
+}
+
+func (r *trailerEtagReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF {
+		etag := hex.EncodeToString(r.hash.Sum(nil))
+		for _, expected := range common.ExpectedEtags(r.trailer) {
+			if expected != etag {
+				r.mismatch = true
+				return n, errTrailerEtagMismatch
+			}
+		}
+	}
+	return n, err
+}
+
+// Trailer is so the trailers go on to the object servers too, which is how
+// anything that only knows some metadata once the body is read can send it.
+func (r *trailerEtagReader) Trailer() http.Header {
+	return r.trailer
+}
@@ -0,0 +1,41 @@
+package proxyserver
+
+import (
+	"crypto/md5"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/client"
+)
+
+func TestTrailerEtagReader(t *testing.T) {
+	trailer := http.Header{"Etag": []string{`"9589f334c6f4987fc5ddb8e0ac1c096b"`}}
+	r := &trailerEtagReader{Reader: strings.NewReader("just testing"), trailer: trailer, hash: md5.New()}
+	data, err := ioutil.ReadAll(r)
+	require.Nil(t, err)
+	require.Equal(t, "just testing", string(data))
+	require.False(t, r.mismatch)
+	// The trailers are passed on to the object servers.
+	var body io.Reader = r
+	tr, ok := body.(client.TrailerReader)
+	require.True(t, ok)
+	require.Equal(t, trailer, tr.Trailer())
+
+	r = &trailerEtagReader{Reader: strings.NewReader("just testinG"), trailer: trailer, hash: md5.New()}
+	_, err = ioutil.ReadAll(r)
+	require.Equal(t, errTrailerEtagMismatch, err)
+	require.True(t, r.mismatch)
+
+	r = &trailerEtagReader{Reader: strings.NewReader("just testinG"), trailer: http.Header{"Content-Md5": []string{"lYnzNMb0mH/F3bjgrBwJaw=="}}, hash: md5.New()}
+	_, err = ioutil.ReadAll(r)
+	require.Equal(t, errTrailerEtagMismatch, err)
+
+	// No trailer value arrived, so there's nothing to check against.
+	r = &trailerEtagReader{Reader: strings.NewReader("just testinG"), trailer: http.Header{"Etag": nil}, hash: md5.New()}
+	_, err = ioutil.ReadAll(r)
+	require.Nil(t, err)
+}
@@ -0,0 +1,36 @@
+package proxyserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/troubling/hummingbird/common/srv"
+	"go.uber.org/zap"
+)
+
+// TraceHandler returns the timeline of a recent trace: the requests the proxy
+// got for it, and those it sent to backend servers, in the order they
+// started, and how many more there were than it keeps.
+func (server *ProxyServer) TraceHandler(writer http.ResponseWriter, request *http.Request) {
+	if server.timelines == nil {
+		srv.SimpleErrorResponse(writer, 404, "Request timelines aren't kept")
+		return
+	}
+	traceId := srv.GetVars(request)["traceId"]
+	events, dropped := server.timelines.Get(traceId)
+	if len(events) == 0 {
+		srv.StandardResponse(writer, 404)
+		return
+	}
+	body, err := json.Marshal(map[string]interface{}{"trace_id": traceId, "events": events, "dropped_events": dropped})
+	if err != nil {
+		server.logger.Error("could not marshal trace", zap.String("traceId", traceId), zap.Error(err))
+		srv.StandardResponse(writer, 500)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writer.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	writer.WriteHeader(200)
+	writer.Write(body)
+}
@@ -0,0 +1,332 @@
+package tools
+
+// In /etc/hummingbird/andrewd-server.conf:
+// [capacity-planner]
+// initial_delay = 1                # seconds to wait between servers for the first pass
+// pass_time_target = 86400         # seconds to try to make subsequent passes take
+// threshold = 5                    # percentage points a device's fill can be off its ring's average before its weight is adjusted
+// max_weight_change = 0.05         # most a pass will change a device's weight by, as a fraction of it
+// apply = false                    # whether approving a proposal through andrewd's /capacity/<id>/approve applies it
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+)
+
+// capacityChange is the weight change proposed for one of a ring's devices.
+type capacityChange struct {
+	DeviceID int64
+	Ip       string
+	Port     int
+	Device   string
+	// Fill is the percentage of the device's disk that was used.
+	Fill float64
+	From float64
+	To   float64
+}
+
+func (c *capacityChange) String() string {
+	return fmt.Sprintf("%s id:%d %.1f%% full, weight %.2f to %.2f", deviceId(c.Ip, c.Port, c.Device), c.DeviceID, c.Fill, c.From, c.To)
+}
+
+var errCapacityProposalStale = errors.New("none of the proposal's devices still have the weights it was planned from")
+
+// planWeightChanges proposes weights for the devices whose disks are more
+// than threshold percentage points fuller or emptier than the ring's devices
+// are overall, each moved at most maxChange of its weight toward what would
+// even them out. Devices without usage, or whose disks aren't mounted, are
+// left out of it.
+func planWeightChanges(devs []*ring.RingBuilderDevice, usage map[string]topologyDiskUsage, threshold, maxChange float64) []*capacityChange {
+	var used, size int64
+	var reporting []*ring.RingBuilderDevice
+	for _, dev := range devs {
+		if dev == nil || dev.Weight <= 0 {
+			continue
+		}
+		u, ok := usage[deviceId(dev.Ip, int(dev.Port), dev.Device)]
+		if !ok || !u.Mounted || u.Size <= 0 {
+			continue
+		}
+		used += u.Used
+		size += u.Size
+		reporting = append(reporting, dev)
+	}
+	if len(reporting) < 2 {
+		return nil
+	}
+	average := float64(used) / float64(size)
+	var changes []*capacityChange
+	for _, dev := range reporting {
+		u := usage[deviceId(dev.Ip, int(dev.Port), dev.Device)]
+		fill := float64(u.Used) / float64(u.Size)
+		if math.Abs(fill-average)*100 <= threshold {
+			continue
+		}
+		factor := 1 + maxChange
+		if fill > 0 {
+			factor = math.Max(math.Min(average/fill, 1+maxChange), 1-maxChange)
+		}
+		to := math.Floor(dev.Weight*factor*100+0.5) / 100
+		if to == dev.Weight || to <= 0 {
+			continue
+		}
+		changes = append(changes, &capacityChange{
+			DeviceID: dev.Id,
+			Ip:       dev.Ip,
+			Port:     int(dev.Port),
+			Device:   dev.Device,
+			Fill:     fill * 100,
+			From:     dev.Weight,
+			To:       to,
+		})
+	}
+	return changes
+}
+
+// simulateWeightChanges sets the weights on the builder and rebalances it,
+// returning how many partition copies would move and the balance after. The
+// builder is left changed, so it shouldn't be saved afterward.
+func simulateWeightChanges(builder *ring.RingBuilder, changes []*capacityChange) (int, float64, error) {
+	for _, c := range changes {
+		if err := builder.SetDevWeight(c.DeviceID, c.To); err != nil {
+			return 0, 0, err
+		}
+	}
+	moves, balance, _, err := builder.Rebalance()
+	if err != nil {
+		return 0, 0, err
+	}
+	return moves, balance, builder.Validate()
+}
+
+type capacityPlanner struct {
+	aa *AutoAdmin
+	// delay between each server; adjusted each pass to try to make passes last passTimeTarget
+	delay           time.Duration
+	passTimeTarget  time.Duration
+	threshold       float64
+	maxChange       float64
+	passesMetric    tally.Timer
+	errorsMetric    tally.Counter
+	proposalsMetric tally.Counter
+}
+
+func newCapacityPlanner(aa *AutoAdmin) *capacityPlanner {
+	cp := &capacityPlanner{
+		aa:              aa,
+		delay:           time.Duration(aa.serverconf.GetInt("capacity-planner", "initial_delay", 1)) * time.Second,
+		passTimeTarget:  time.Duration(aa.serverconf.GetInt("capacity-planner", "pass_time_target", 86400)) * time.Second,
+		threshold:       aa.serverconf.GetFloat("capacity-planner", "threshold", 5),
+		maxChange:       aa.serverconf.GetFloat("capacity-planner", "max_weight_change", 0.05),
+		passesMetric:    aa.metricsScope.Timer("capacity_planner_passes"),
+		errorsMetric:    aa.metricsScope.Counter("capacity_planner_errors"),
+		proposalsMetric: aa.metricsScope.Counter("capacity_planner_proposals"),
+	}
+	if cp.delay < 0 {
+		cp.delay = time.Second
+	}
+	if cp.passTimeTarget < 0 {
+		cp.passTimeTarget = time.Second
+	}
+	if cp.maxChange <= 0 || cp.maxChange >= 1 {
+		cp.maxChange = 0.05
+	}
+	return cp
+}
+
+func (cp *capacityPlanner) runForever() {
+	for {
+		sleepFor := cp.runOnce()
+		if sleepFor < 0 {
+			break
+		}
+		time.Sleep(sleepFor)
+	}
+}
+
+type capacityRing struct {
+	typ     string
+	policy  int
+	builder *ring.RingBuilder
+}
+
+func (cp *capacityPlanner) runOnce() time.Duration {
+	defer cp.passesMetric.Start().Stop()
+	start := time.Now()
+	logger := cp.aa.logger.With(zap.String("process", "capacity planner"))
+	logger.Debug("starting pass")
+	if err := cp.aa.db.startProcessPass("capacity planner", "", 0); err != nil {
+		logger.Error("startProcessPass", zap.Error(err))
+	}
+	var rings []*capacityRing
+	for _, typ := range []string{"account", "container", "object"} {
+		policies := []int{0}
+		if typ == "object" {
+			policies = nil
+			for _, policy := range cp.aa.policies {
+				policies = append(policies, policy.Index)
+			}
+		}
+		for _, policy := range policies {
+			builder, _, err := ring.GetRingBuilder(typ, policy)
+			if err != nil {
+				logger.Error("could not load builder", zap.String("type", typ), zap.Int("policy", policy), zap.Error(err))
+				cp.errorsMetric.Inc(1)
+				continue
+			}
+			rings = append(rings, &capacityRing{typ: typ, policy: policy, builder: builder})
+		}
+	}
+	servers := map[string]*ipPort{}
+	for _, r := range rings {
+		for _, dev := range r.builder.Devs {
+			if dev != nil && dev.Weight > 0 {
+				servers[serverId(dev.Ip, int(dev.Port))] = &ipPort{scheme: dev.Scheme, ip: dev.Ip, port: int(dev.Port)}
+			}
+		}
+	}
+	var ids []string
+	for id := range servers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	usage := map[string]topologyDiskUsage{}
+	var delays, errors, proposals int
+	for _, id := range ids {
+		delays++
+		time.Sleep(cp.delay)
+		server := servers[id]
+		data, err := queryHostRecon(cp.aa.client, server, "diskusage")
+		var disks []topologyDiskUsage
+		if err == nil {
+			err = json.Unmarshal(data, &disks)
+		}
+		if err != nil {
+			logger.Error("could not get disk usage", zap.String("server", id), zap.Error(err))
+			errors++
+			cp.errorsMetric.Inc(1)
+		}
+		for _, disk := range disks {
+			usage[deviceId(server.ip, server.port, disk.Device)] = disk
+		}
+		if err := cp.aa.db.progressProcessPass("capacity planner", "", 0, fmt.Sprintf("%d of %d servers, %d errors", delays, len(ids), errors)); err != nil {
+			logger.Error("progressProcessPass", zap.Error(err))
+		}
+	}
+	for _, r := range rings {
+		if cp.planRing(logger.With(zap.String("type", r.typ), zap.Int("policy", r.policy)), r, usage) {
+			proposals++
+		}
+	}
+	if delays > 0 {
+		cp.delay = cp.passTimeTarget / time.Duration(delays)
+	}
+	sleepFor := time.Until(start.Add(cp.passTimeTarget))
+	if sleepFor < 0 {
+		sleepFor = 0
+	}
+	logger.Debug("pass complete", zap.Int("errors", errors), zap.Int("proposals", proposals), zap.String("next delay", cp.delay.String()), zap.String("sleep for", sleepFor.String()))
+	if err := cp.aa.db.progressProcessPass("capacity planner", "", 0, fmt.Sprintf("%d of %d servers, %d errors, %d proposals", delays, len(ids), errors, proposals)); err != nil {
+		logger.Error("progressProcessPass", zap.Error(err))
+	}
+	if err := cp.aa.db.completeProcessPass("capacity planner", "", 0); err != nil {
+		logger.Error("completeProcessPass", zap.Error(err))
+	}
+	return sleepFor
+}
+
+// planRing replaces the ring's pending proposal with one from the current
+// fill levels, returning whether it proposed anything. Rings still within
+// min_part_hours of their last rebalance are left alone, as their data is
+// likely still moving and their fill levels aren't settled.
+func (cp *capacityPlanner) planRing(logger *zap.Logger, r *capacityRing, usage map[string]topologyDiskUsage) bool {
+	if left := r.builder.MinPartSecondsLeft(); left > 0 {
+		logger.Debug("rebalanced too recently to plan", zap.Int("seconds left", left))
+		return false
+	}
+	if err := cp.aa.db.supersedeCapacityProposals(r.typ, r.policy); err != nil {
+		logger.Error("could not supersede pending proposals", zap.Error(err))
+		cp.errorsMetric.Inc(1)
+		return false
+	}
+	changes := planWeightChanges(r.builder.Devs, usage, cp.threshold, cp.maxChange)
+	if len(changes) == 0 {
+		return false
+	}
+	moves, balance, err := simulateWeightChanges(r.builder, changes)
+	if err != nil {
+		logger.Error("could not simulate the weight changes", zap.Error(err))
+		cp.errorsMetric.Inc(1)
+		return false
+	}
+	id, err := cp.aa.db.addCapacityProposal(&capacityProposal{Type: r.typ, Policy: r.policy, Changes: changes, Moves: moves, Balance: balance})
+	if err != nil {
+		logger.Error("could not record proposal", zap.Error(err))
+		cp.errorsMetric.Inc(1)
+		return false
+	}
+	cp.proposalsMetric.Inc(1)
+	logger.Info("proposed weight changes", zap.Int64("proposal", id), zap.Int("devices", len(changes)), zap.Int("partition moves", moves), zap.Float64("balance", balance))
+	return true
+}
+
+// applyCapacityProposal sets the proposal's weights in the builder and
+// rebalances, returning what it did; the ring monitor then queues the moves.
+// Devices whose weights have changed since it was planned are skipped, and
+// if that's all of them the proposal is superseded and
+// errCapacityProposalStale returned.
+func (aa *AutoAdmin) applyCapacityProposal(builderPath string, p *capacityProposal) (string, error) {
+	lock, err := ring.LockBuilderPath(builderPath)
+	if err != nil {
+		return "", err
+	}
+	defer lock.Close()
+	builder, err := ring.NewRingBuilderFromFile(builderPath, false)
+	if err != nil {
+		return "", err
+	}
+	var applied int
+	var skipped []string
+	for _, c := range p.Changes {
+		var dev *ring.RingBuilderDevice
+		if c.DeviceID >= 0 && c.DeviceID < int64(len(builder.Devs)) {
+			dev = builder.Devs[c.DeviceID]
+		}
+		if dev == nil || dev.Ip != c.Ip || int(dev.Port) != c.Port || dev.Device != c.Device || math.Abs(dev.Weight-c.From) > 0.005 {
+			skipped = append(skipped, fmt.Sprintf("%s id:%d", deviceId(c.Ip, c.Port, c.Device), c.DeviceID))
+			continue
+		}
+		if err := builder.SetDevWeight(c.DeviceID, c.To); err != nil {
+			skipped = append(skipped, fmt.Sprintf("%s id:%d", deviceId(c.Ip, c.Port, c.Device), c.DeviceID))
+			continue
+		}
+		applied++
+		aa.db.addRingLog(p.Type, p.Policy, fmt.Sprintf("capacity proposal %d set weight of device %s id:%d on server %s:%d from %.2f to %.2f", p.ID, c.Device, c.DeviceID, c.Ip, c.Port, c.From, c.To))
+	}
+	if applied == 0 {
+		aa.db.closeCapacityProposal(p.ID, "superseded", errCapacityProposalStale.Error())
+		return "", errCapacityProposalStale
+	}
+	if err = builder.Save(builderPath); err != nil {
+		return "", err
+	}
+	detail := fmt.Sprintf("set %d weights and rebalanced", applied)
+	if _, _, _, err = ring.Rebalance(builderPath, false, false, true); err != nil {
+		detail = fmt.Sprintf("set %d weights but couldn't rebalance: %s", applied, err)
+	} else {
+		aa.db.addRingLog(p.Type, p.Policy, fmt.Sprintf("rebalanced for capacity proposal %d", p.ID))
+	}
+	if len(skipped) > 0 {
+		detail += fmt.Sprintf("; skipped %s as their weights changed since it was planned", strings.Join(skipped, ", "))
+	}
+	return detail, nil
+}
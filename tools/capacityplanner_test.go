@@ -0,0 +1,173 @@
+package tools
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/middleware"
+	"go.uber.org/zap"
+)
+
+func TestPlanWeightChanges(t *testing.T) {
+	devs := []*ring.RingBuilderDevice{
+		{Id: 0, Ip: "1.2.3.4", Port: 6000, Device: "sda", Weight: 100},
+		{Id: 1, Ip: "1.2.3.4", Port: 6000, Device: "sdb", Weight: 100},
+		{Id: 2, Ip: "1.2.3.5", Port: 6000, Device: "sda", Weight: 100},
+		{Id: 3, Ip: "1.2.3.5", Port: 6000, Device: "sdb", Weight: 100},
+		nil,
+		{Id: 5, Ip: "1.2.3.5", Port: 6000, Device: "sdc", Weight: 0},
+		{Id: 6, Ip: "1.2.3.6", Port: 6000, Device: "sda", Weight: 100},
+	}
+	usage := map[string]topologyDiskUsage{
+		"1.2.3.4:6000/sda": {Device: "sda", Mounted: true, Size: 1000, Used: 700},
+		"1.2.3.4:6000/sdb": {Device: "sdb", Mounted: true, Size: 1000, Used: 490},
+		"1.2.3.5:6000/sda": {Device: "sda", Mounted: true, Size: 1000, Used: 510},
+		"1.2.3.5:6000/sdb": {Device: "sdb", Mounted: true, Size: 1000, Used: 300},
+		"1.2.3.5:6000/sdc": {Device: "sdc", Mounted: true, Size: 1000, Used: 0},
+		"1.2.3.6:6000/sda": {Device: "sda", Mounted: false},
+	}
+	changes := planWeightChanges(devs, usage, 5, 0.1)
+	require.Equal(t, []*capacityChange{
+		{DeviceID: 0, Ip: "1.2.3.4", Port: 6000, Device: "sda", Fill: 70, From: 100, To: 90},
+		{DeviceID: 3, Ip: "1.2.3.5", Port: 6000, Device: "sdb", Fill: 30, From: 100, To: 110},
+	}, changes)
+	changes = planWeightChanges(devs, usage, 5, 0.5)
+	require.Equal(t, 71.43, changes[0].To)
+	require.Empty(t, planWeightChanges(devs, usage, 25, 0.1))
+	require.Empty(t, planWeightChanges(devs[:1], usage, 5, 0.1))
+}
+
+func testCapacityBuilder(t *testing.T, dir string) string {
+	builderPath := filepath.Join(dir, "object.builder")
+	require.Nil(t, ring.CreateRing(builderPath, 6, 3, 0, false))
+	for i, device := range []string{"sda", "sdb", "sdc", "sdd"} {
+		_, err := ring.AddDevice(builderPath, -1, 1, int64(i), "http", "1.2.3.4", 6000, "1.2.3.4", 6000, device, 100, false)
+		require.Nil(t, err)
+	}
+	_, _, _, err := ring.Rebalance(builderPath, false, false, true)
+	require.Nil(t, err)
+	return builderPath
+}
+
+func TestSimulateAndApplyCapacityProposal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	builderPath := testCapacityBuilder(t, dir)
+	changes := []*capacityChange{
+		{DeviceID: 0, Ip: "1.2.3.4", Port: 6000, Device: "sda", Fill: 70, From: 100, To: 90},
+		{DeviceID: 3, Ip: "1.2.3.4", Port: 6000, Device: "sdd", Fill: 30, From: 100, To: 110},
+	}
+	builder, err := ring.NewRingBuilderFromFile(builderPath, false)
+	require.Nil(t, err)
+	moves, _, err := simulateWeightChanges(builder, changes)
+	require.Nil(t, err)
+	require.True(t, moves > 0)
+	builder, err = ring.NewRingBuilderFromFile(builderPath, false)
+	require.Nil(t, err)
+	require.Equal(t, 100.0, builder.Devs[0].Weight)
+
+	db, err := newDB(nil, dbTestName("TestSimulateAndApplyCapacityProposal"))
+	require.Nil(t, err)
+	a := &AutoAdmin{db: db}
+	p := &capacityProposal{Type: "object", Policy: 0, Changes: append(changes, &capacityChange{DeviceID: 1, Ip: "1.2.3.4", Port: 6000, Device: "sdb", From: 50, To: 55}), Moves: moves}
+	p.ID, err = db.addCapacityProposal(p)
+	require.Nil(t, err)
+	detail, err := a.applyCapacityProposal(builderPath, p)
+	require.Nil(t, err)
+	require.Equal(t, "set 2 weights and rebalanced; skipped 1.2.3.4:6000/sdb id:1 as their weights changed since it was planned", detail)
+	builder, err = ring.NewRingBuilderFromFile(builderPath, false)
+	require.Nil(t, err)
+	require.Equal(t, 90.0, builder.Devs[0].Weight)
+	require.Equal(t, 110.0, builder.Devs[3].Weight)
+	_, err = os.Stat(filepath.Join(dir, "object.ring.gz"))
+	require.Nil(t, err)
+	logs, err := db.ringLogs("object", 0)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(logs))
+
+	_, err = a.applyCapacityProposal(builderPath, p)
+	require.Equal(t, errCapacityProposalStale, err)
+	p, err = db.capacityProposal(p.ID)
+	require.Nil(t, err)
+	require.Equal(t, "superseded", p.State)
+	require.Equal(t, 3, len(p.Changes))
+}
+
+func TestCapacityProposalHandlers(t *testing.T) {
+	db, err := newDB(nil, dbTestName("TestCapacityProposalHandlers"))
+	require.Nil(t, err)
+	a := &AutoAdmin{db: db}
+	change := &capacityChange{DeviceID: 0, Ip: "1.2.3.4", Port: 6000, Device: "sda", Fill: 70, From: 100, To: 95}
+	first, err := db.addCapacityProposal(&capacityProposal{Type: "object", Policy: 1, Changes: []*capacityChange{change}, Moves: 12, Balance: 0.5})
+	require.Nil(t, err)
+	require.Nil(t, db.supersedeCapacityProposals("object", 1))
+	id, err := db.addCapacityProposal(&capacityProposal{Type: "object", Policy: 1, Changes: []*capacityChange{change}, Moves: 10, Balance: 0.4})
+	require.Nil(t, err)
+
+	w := httptest.NewRecorder()
+	a.CapacityProposalsHandler(w, httptest.NewRequest("GET", "/capacity", nil))
+	require.Equal(t, 200, w.Code)
+	require.True(t, strings.Contains(w.Body.String(), `"Moves":10`))
+	require.False(t, strings.Contains(w.Body.String(), `"Moves":12`))
+
+	do := func(action string, id int64) int {
+		w := httptest.NewRecorder()
+		idStr := strconv.FormatInt(id, 10)
+		r := srv.SetVars(httptest.NewRequest("PUT", "/capacity/"+idStr+"/"+action, nil), map[string]string{"id": idStr})
+		if action == "approve" {
+			a.ApproveCapacityProposalHandler(w, r)
+		} else {
+			a.RejectCapacityProposalHandler(w, r)
+		}
+		return w.Code
+	}
+	require.Equal(t, 409, do("approve", id))
+	require.Equal(t, 404, do("reject", first))
+	require.Equal(t, 204, do("reject", id))
+	require.Equal(t, 404, do("reject", id))
+
+	w = httptest.NewRecorder()
+	a.CapacityProposalsHandler(w, httptest.NewRequest("GET", "/capacity", nil))
+	require.Equal(t, "[]", w.Body.String())
+	proposals, err := db.capacityProposals(true)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(proposals))
+	require.Equal(t, "superseded", proposals[0].State)
+	require.Equal(t, "rejected", proposals[1].State)
+	require.Equal(t, []*capacityChange{change}, proposals[1].Changes)
+}
+
+func TestCapacityProposalRoutesNeedRole(t *testing.T) {
+	db, err := newDB(nil, dbTestName("TestCapacityProposalRoutesNeedRole"))
+	require.Nil(t, err)
+	adminAuth, err := middleware.NewAdminAuth("planner:capacity, fixer:workitems", "", zap.NewNop())
+	require.Nil(t, err)
+	a := &AutoAdmin{db: db, adminAuth: adminAuth, logger: zap.NewNop()}
+	ts := httptest.NewServer(a.GetHandler(conf.Config{}, "test_andrewd_capacity"))
+	defer ts.Close()
+	do := func(path, token string) int {
+		req, err := http.NewRequest("PUT", ts.URL+path, nil)
+		require.Nil(t, err)
+		req.Header.Set("X-Admin-Token", token)
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, 403, do("/capacity/1/reject", "fixer"))
+	require.Equal(t, 403, do("/capacity/1/approve", ""))
+	require.Equal(t, 404, do("/capacity/1/reject", "planner"))
+	require.Equal(t, 403, do("/workitems/1/resolve", "planner"))
+	require.Equal(t, 404, do("/workitems/1/resolve", "fixer"))
+}
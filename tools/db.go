@@ -2,6 +2,7 @@ package tools
 
 import (
 	"database/sql"
+	"encoding/json"
 	"os"
 	"path/filepath"
 	"time"
@@ -134,6 +135,48 @@ func newDB(serverconf *conf.Config, memoryDBID string) (*dbInstance, error) {
         );
 
         CREATE INDEX IF NOT EXISTS ix_ring_log_rtype_policy_create_date ON ring_log (rtype, policy, create_date);
+
+        -- the outcome of the last complete dispersion scan of each ring
+        CREATE TABLE IF NOT EXISTS dispersion_result (
+            complete_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            rtype TEXT NOT NULL,            -- account, container, object
+            policy INTEGER NOT NULL,        -- only used with object
+            partitions INTEGER NOT NULL,    -- how many partitions were scanned
+            intact INTEGER NOT NULL         -- how many of those had all their copies found
+        );
+
+        -- things andrewd did that an operator needs to follow up on, like
+        -- replacing a disk it took out of the rings for failing
+        CREATE TABLE IF NOT EXISTS work_item (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            create_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            update_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            kind TEXT NOT NULL,         -- disk failure, ...
+            ip TEXT NOT NULL,
+            port INTEGER NOT NULL,
+            device TEXT NOT NULL,
+            detail TEXT NOT NULL,       -- what was wrong and what was done about it
+            resolved INTEGER NOT NULL DEFAULT 0
+        );
+
+        CREATE INDEX IF NOT EXISTS ix_work_item_resolved ON work_item (resolved);
+
+        -- weight changes the capacity planner proposed to even out how full
+        -- a ring's devices are
+        CREATE TABLE IF NOT EXISTS capacity_proposal (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            create_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            update_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            rtype TEXT NOT NULL,        -- account, container, object
+            policy INTEGER NOT NULL,    -- only used with object
+            changes TEXT NOT NULL,      -- JSON list of the devices' weight changes
+            moves INTEGER NOT NULL,     -- partition copies the simulated rebalance moved
+            balance REAL NOT NULL,      -- balance after the simulated rebalance
+            state TEXT NOT NULL DEFAULT 'pending', -- pending, applied, rejected, superseded
+            detail TEXT NOT NULL DEFAULT ''        -- what happened when it was applied
+        );
+
+        CREATE INDEX IF NOT EXISTS ix_capacity_proposal_state ON capacity_proposal (state);
     `)
 	if err != nil {
 		return nil, err
@@ -762,3 +805,254 @@ func (db *dbInstance) addRingLog(typ string, policy int, reason string) error {
     `, typ, policy, reason)
 	return err
 }
+
+type dispersionResult struct {
+	Time       time.Time
+	Partitions int
+	Intact     int
+}
+
+// IntactPercent is the percentage of the ring's partitions that had all
+// their copies found.
+func (r *dispersionResult) IntactPercent() float64 {
+	if r.Partitions == 0 {
+		return 100
+	}
+	return float64(r.Intact) * 100 / float64(r.Partitions)
+}
+
+func (db *dbInstance) setDispersionResult(typ string, policy int, partitions, intact int) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec(`
+        DELETE FROM dispersion_result
+        WHERE rtype = ? AND policy = ?
+    `, typ, policy); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(`
+        INSERT INTO dispersion_result
+        (complete_date, rtype, policy, partitions, intact)
+        VALUES (?, ?, ?, ?, ?)
+    `, time.Now(), typ, policy, partitions, intact); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// dispersionResult returns the outcome of the ring's last complete
+// dispersion scan, or nil if there hasn't been one.
+func (db *dbInstance) dispersionResult(typ string, policy int) (*dispersionResult, error) {
+	rows, err := db.db.Query(`
+        SELECT complete_date, partitions, intact
+        FROM dispersion_result
+        WHERE rtype = ? AND policy = ?
+    `, typ, policy)
+	if rows != nil {
+		defer rows.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	result := &dispersionResult{}
+	if err = rows.Scan(&result.Time, &result.Partitions, &result.Intact); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+type workItem struct {
+	ID       int64
+	Created  time.Time
+	Updated  time.Time
+	Kind     string
+	Ip       string
+	Port     int
+	Device   string
+	Detail   string
+	Resolved bool
+}
+
+func (db *dbInstance) addWorkItem(kind, ip string, port int, device, detail string) (int64, error) {
+	result, err := db.db.Exec(`
+        INSERT INTO work_item
+        (kind, ip, port, device, detail)
+        VALUES (?, ?, ?, ?, ?)
+    `, kind, ip, port, device, detail)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// openWorkItem returns the unresolved work item of the kind for the device,
+// or nil if there isn't one.
+func (db *dbInstance) openWorkItem(kind, ip string, port int, device string) (*workItem, error) {
+	items, err := db.queryWorkItems(`
+        WHERE kind = ? AND ip = ? AND port = ? AND device = ? AND resolved = 0
+    `, kind, ip, port, device)
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+	return items[0], nil
+}
+
+// workItems returns the unresolved work items, or all of them if
+// includeResolved, oldest first.
+func (db *dbInstance) workItems(includeResolved bool) ([]*workItem, error) {
+	if includeResolved {
+		return db.queryWorkItems("")
+	}
+	return db.queryWorkItems("WHERE resolved = 0")
+}
+
+func (db *dbInstance) queryWorkItems(where string, args ...interface{}) ([]*workItem, error) {
+	rows, err := db.db.Query(`
+        SELECT id, create_date, update_date, kind, ip, port, device, detail, resolved
+        FROM work_item
+        `+where+`
+        ORDER BY id
+    `, args...)
+	if rows != nil {
+		defer rows.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	var items []*workItem
+	for rows.Next() {
+		item := &workItem{}
+		var resolved int
+		if err = rows.Scan(&item.ID, &item.Created, &item.Updated, &item.Kind, &item.Ip, &item.Port, &item.Device, &item.Detail, &resolved); err != nil {
+			return items, err
+		}
+		item.Resolved = resolved != 0
+		items = append(items, item)
+	}
+	err = rows.Err()
+	return items, err
+}
+
+// resolveWorkItem marks the work item resolved, returning false if there's
+// no unresolved work item with that id.
+func (db *dbInstance) resolveWorkItem(id int64) (bool, error) {
+	result, err := db.db.Exec(`
+        UPDATE work_item
+        SET resolved = 1, update_date = ?
+        WHERE id = ? AND resolved = 0
+    `, time.Now(), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+type capacityProposal struct {
+	ID      int64
+	Created time.Time
+	Updated time.Time
+	Type    string
+	Policy  int
+	Changes []*capacityChange
+	Moves   int
+	Balance float64
+	State   string
+	Detail  string
+}
+
+func (db *dbInstance) addCapacityProposal(p *capacityProposal) (int64, error) {
+	changes, err := json.Marshal(p.Changes)
+	if err != nil {
+		return 0, err
+	}
+	result, err := db.db.Exec(`
+        INSERT INTO capacity_proposal
+        (rtype, policy, changes, moves, balance)
+        VALUES (?, ?, ?, ?, ?)
+    `, p.Type, p.Policy, string(changes), p.Moves, p.Balance)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// capacityProposal returns the proposal with the id, or nil if there isn't
+// one.
+func (db *dbInstance) capacityProposal(id int64) (*capacityProposal, error) {
+	proposals, err := db.queryCapacityProposals("WHERE id = ?", id)
+	if err != nil || len(proposals) == 0 {
+		return nil, err
+	}
+	return proposals[0], nil
+}
+
+// capacityProposals returns the pending proposals, or all of them if
+// includeClosed, oldest first.
+func (db *dbInstance) capacityProposals(includeClosed bool) ([]*capacityProposal, error) {
+	if includeClosed {
+		return db.queryCapacityProposals("")
+	}
+	return db.queryCapacityProposals("WHERE state = 'pending'")
+}
+
+func (db *dbInstance) queryCapacityProposals(where string, args ...interface{}) ([]*capacityProposal, error) {
+	rows, err := db.db.Query(`
+        SELECT id, create_date, update_date, rtype, policy, changes, moves, balance, state, detail
+        FROM capacity_proposal
+        `+where+`
+        ORDER BY id
+    `, args...)
+	if rows != nil {
+		defer rows.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	var proposals []*capacityProposal
+	for rows.Next() {
+		p := &capacityProposal{}
+		var changes string
+		if err = rows.Scan(&p.ID, &p.Created, &p.Updated, &p.Type, &p.Policy, &changes, &p.Moves, &p.Balance, &p.State, &p.Detail); err != nil {
+			return proposals, err
+		}
+		if err = json.Unmarshal([]byte(changes), &p.Changes); err != nil {
+			return proposals, err
+		}
+		proposals = append(proposals, p)
+	}
+	err = rows.Err()
+	return proposals, err
+}
+
+// closeCapacityProposal moves a pending proposal to the state, returning
+// false if there's no pending proposal with that id.
+func (db *dbInstance) closeCapacityProposal(id int64, state, detail string) (bool, error) {
+	result, err := db.db.Exec(`
+        UPDATE capacity_proposal
+        SET state = ?, detail = ?, update_date = ?
+        WHERE id = ? AND state = 'pending'
+    `, state, detail, time.Now(), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// supersedeCapacityProposals closes the ring's pending proposals, as a new
+// pass has planned from fresher fill levels.
+func (db *dbInstance) supersedeCapacityProposals(typ string, policy int) error {
+	_, err := db.db.Exec(`
+        UPDATE capacity_proposal
+        SET state = 'superseded', update_date = ?
+        WHERE rtype = ? AND policy = ? AND state = 'pending'
+    `, time.Now(), typ, policy)
+	return err
+}
@@ -0,0 +1,503 @@
+package tools
+
+// In /etc/hummingbird/andrewd-server.conf:
+// [disk-failure-monitor]
+// initial_delay = 1                # seconds to wait between servers for the first pass
+// pass_time_target = 600           # seconds to try to make subsequent passes take
+// error_limit = 10                 # kernel I/O errors since boot at which a disk counts as failing
+// check_command =                  # if set, run as "<check_command> <ip> <port> <device>" instead of asking recon;
+//                                  # exit 0 if the device is healthy, 1 with the reason on stdout if it's failing
+// check_timeout = 60               # seconds check_command gets for each device before it's killed
+// failing_passes = 3               # passes in a row a device has to be failing before it's drained
+// max_drains_per_pass = 1          # most failing devices to drain in a pass; 0 for no limit
+// max_open_failures = 2            # no more devices are drained while this many disk failure work items are open; 0 for no limit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
+)
+
+type diskFailureServer struct {
+	scheme  string
+	ip      string
+	port    int
+	devices []string
+}
+
+// diskChecker is how the disk failure monitor tells whether a server's
+// devices are failing.
+type diskChecker interface {
+	// failingDevices returns the server's failing devices, with why each is
+	// failing.
+	failingDevices(server *diskFailureServer) (map[string]string, error)
+}
+
+// reconDiskChecker counts a device as failing once the kernel has seen
+// errorLimit I/O errors on its disk, as the server's /recon/driveerrors says.
+type reconDiskChecker struct {
+	client     common.HTTPClient
+	errorLimit int64
+}
+
+func (c *reconDiskChecker) failingDevices(server *diskFailureServer) (map[string]string, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s://%s:%d/recon/driveerrors", server.scheme, server.ip, server.port), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Andrewd")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		// Servers from before driveerrors have nothing to say.
+		return nil, nil
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%d getting drive errors: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var counts map[string]int64
+	if err := json.Unmarshal(body, &counts); err != nil {
+		return nil, fmt.Errorf("%s - %q", err, string(body))
+	}
+	failing := map[string]string{}
+	for _, device := range server.devices {
+		if count, ok := counts[device]; ok && count >= c.errorLimit {
+			failing[device] = fmt.Sprintf("the kernel has seen %d I/O errors on its disk", count)
+		}
+	}
+	return failing, nil
+}
+
+// commandDiskChecker runs a command of the operator's for each device, for
+// checks like SMART that need tools andrewd doesn't have.
+type commandDiskChecker struct {
+	command string
+	timeout time.Duration
+}
+
+func (c *commandDiskChecker) failingDevices(server *diskFailureServer) (map[string]string, error) {
+	failing := map[string]string{}
+	var errs []string
+	for _, device := range server.devices {
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		out, err := c.run(ctx, server.ip, strconv.Itoa(server.port), device)
+		timedOut := ctx.Err() == context.DeadlineExceeded
+		cancel()
+		if timedOut {
+			errs = append(errs, fmt.Sprintf("%s: timed out after %s", device, c.timeout))
+			continue
+		}
+		if err == nil {
+			continue
+		}
+		if ee, ok := err.(*exec.ExitError); ok && ee.Sys().(syscall.WaitStatus).ExitStatus() == 1 {
+			if reason := strings.TrimSpace(string(out)); reason != "" {
+				failing[device] = reason
+			} else {
+				failing[device] = "the check command says it's failing"
+			}
+			continue
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", device, err))
+	}
+	if len(errs) > 0 {
+		return failing, fmt.Errorf("check command failed for %s", strings.Join(errs, ", "))
+	}
+	return failing, nil
+}
+
+// run runs the command in its own process group, all of which is killed once
+// ctx is done, so anything it started can't keep it running past its deadline.
+func (c *commandDiskChecker) run(ctx context.Context, args ...string) ([]byte, error) {
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.command, args...)
+	cmd.Stdout = &out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+	err := cmd.Wait()
+	return out.Bytes(), err
+}
+
+type diskFailureMonitor struct {
+	aa *AutoAdmin
+	// delay between each server; adjusted each pass to try to make passes last passTimeTarget
+	delay                  time.Duration
+	passTimeTarget         time.Duration
+	checker                diskChecker
+	failingPasses          int
+	maxDrainsPerPass       int
+	maxOpenFailures        int
+	failingCounts          map[string]int // passes in a row each device has been failing, by deviceId
+	drains                 int            // devices drained so far this pass
+	passesMetric           tally.Timer
+	checksMetric           tally.Counter
+	errorsMetric           tally.Counter
+	failuresMetric         tally.Counter
+	partitionsQueuedMetric tally.Counter
+}
+
+func newDiskFailureMonitor(aa *AutoAdmin) *diskFailureMonitor {
+	dfm := &diskFailureMonitor{
+		aa:                     aa,
+		delay:                  time.Duration(aa.serverconf.GetInt("disk-failure-monitor", "initial_delay", 1)) * time.Second,
+		passTimeTarget:         time.Duration(aa.serverconf.GetInt("disk-failure-monitor", "pass_time_target", 600)) * time.Second,
+		failingPasses:          int(aa.serverconf.GetInt("disk-failure-monitor", "failing_passes", 3)),
+		maxDrainsPerPass:       int(aa.serverconf.GetInt("disk-failure-monitor", "max_drains_per_pass", 1)),
+		maxOpenFailures:        int(aa.serverconf.GetInt("disk-failure-monitor", "max_open_failures", 2)),
+		failingCounts:          map[string]int{},
+		passesMetric:           aa.metricsScope.Timer("disk_failure_passes"),
+		checksMetric:           aa.metricsScope.Counter("disk_failure_checks"),
+		errorsMetric:           aa.metricsScope.Counter("disk_failure_errors"),
+		failuresMetric:         aa.metricsScope.Counter("disk_failure_devices"),
+		partitionsQueuedMetric: aa.metricsScope.Counter("disk_failure_partitions_queued"),
+	}
+	if command := aa.serverconf.GetDefault("disk-failure-monitor", "check_command", ""); command != "" {
+		dfm.checker = &commandDiskChecker{command: command, timeout: time.Duration(aa.serverconf.GetInt("disk-failure-monitor", "check_timeout", 60)) * time.Second}
+	} else {
+		dfm.checker = &reconDiskChecker{client: aa.client, errorLimit: aa.serverconf.GetInt("disk-failure-monitor", "error_limit", 10)}
+	}
+	if dfm.delay < 0 {
+		dfm.delay = time.Second
+	}
+	if dfm.passTimeTarget < 0 {
+		dfm.passTimeTarget = time.Second
+	}
+	return dfm
+}
+
+func (dfm *diskFailureMonitor) runForever() {
+	for {
+		sleepFor := dfm.runOnce()
+		if sleepFor < 0 {
+			break
+		}
+		time.Sleep(sleepFor)
+	}
+}
+
+func (dfm *diskFailureMonitor) runOnce() time.Duration {
+	defer dfm.passesMetric.Start().Stop()
+	start := time.Now()
+	logger := dfm.aa.logger.With(zap.String("process", "disk failure monitor"))
+	logger.Debug("starting pass")
+	if err := dfm.aa.db.startProcessPass("disk failure monitor", "", 0); err != nil {
+		logger.Error("startProcessPass", zap.Error(err))
+	}
+	var delays, errors, failures int
+	dfm.drains = 0
+	servers := dfm.servers(logger)
+	for _, server := range servers {
+		delays++
+		dfm.checksMetric.Inc(1)
+		time.Sleep(dfm.delay)
+		serverLogger := logger.With(zap.String("server", serverId(server.ip, server.port)))
+		failing, err := dfm.checker.failingDevices(server)
+		if err != nil {
+			serverLogger.Error("could not check devices", zap.Error(err))
+			errors++
+			dfm.errorsMetric.Inc(1)
+		}
+		dfm.countFailing(server, failing, err)
+		var devices []string
+		for device := range failing {
+			devices = append(devices, device)
+		}
+		sort.Strings(devices)
+		for _, device := range devices {
+			deviceLogger := serverLogger.With(zap.String("device", device))
+			if passes := dfm.failingCounts[deviceId(server.ip, server.port, device)]; passes < dfm.failingPasses {
+				deviceLogger.Info("device is failing; waiting to see it fail again", zap.String("reason", failing[device]), zap.Int("passes", passes))
+				continue
+			}
+			if dfm.deviceFailed(deviceLogger, server, device, failing[device]) {
+				failures++
+			}
+		}
+		if err := dfm.aa.db.progressProcessPass("disk failure monitor", "", 0, fmt.Sprintf("%d of %d servers, %d errors, %d failed devices", delays, len(servers), errors, failures)); err != nil {
+			logger.Error("progressProcessPass", zap.Error(err))
+		}
+	}
+	if delays > 0 {
+		dfm.delay = dfm.passTimeTarget / time.Duration(delays)
+	}
+	sleepFor := time.Until(start.Add(dfm.passTimeTarget))
+	if sleepFor < 0 {
+		sleepFor = 0
+	}
+	logger.Debug("pass complete", zap.Int("errors", errors), zap.Int("failed devices", failures), zap.String("next delay", dfm.delay.String()), zap.String("sleep for", sleepFor.String()))
+	if err := dfm.aa.db.progressProcessPass("disk failure monitor", "", 0, fmt.Sprintf("%d of %d servers, %d errors, %d failed devices", delays, len(servers), errors, failures)); err != nil {
+		logger.Error("progressProcessPass", zap.Error(err))
+	}
+	if err := dfm.aa.db.completeProcessPass("disk failure monitor", "", 0); err != nil {
+		logger.Error("completeProcessPass", zap.Error(err))
+	}
+	return sleepFor
+}
+
+// countFailing keeps count of how many passes in a row each of the server's
+// devices has been failing. A check that failed leaves the counts of the
+// devices it didn't find failing as they were.
+func (dfm *diskFailureMonitor) countFailing(server *diskFailureServer, failing map[string]string, checkErr error) {
+	for _, device := range server.devices {
+		id := deviceId(server.ip, server.port, device)
+		if _, ok := failing[device]; ok {
+			dfm.failingCounts[id]++
+		} else if checkErr == nil {
+			delete(dfm.failingCounts, id)
+		}
+	}
+}
+
+// mayDrain reports whether another failing device can be drained now. Only
+// so many are drained a pass, and none while too many are already waiting
+// for their disks to be replaced, so a check gone wrong can't drain the
+// cluster.
+func (dfm *diskFailureMonitor) mayDrain(logger *zap.Logger) bool {
+	if dfm.maxDrainsPerPass > 0 && dfm.drains >= dfm.maxDrainsPerPass {
+		logger.Info("device is failing, but this pass has drained as many devices as it may")
+		return false
+	}
+	if dfm.maxOpenFailures > 0 {
+		items, err := dfm.aa.db.workItems(false)
+		if err != nil {
+			logger.Error("could not count open work items", zap.Error(err))
+			return false
+		}
+		open := 0
+		for _, item := range items {
+			if item.Kind == "disk failure" {
+				open++
+			}
+		}
+		if open >= dfm.maxOpenFailures {
+			logger.Warn("device is failing, but too many disk failure work items are open to drain another", zap.Int("open", open))
+			return false
+		}
+	}
+	return true
+}
+
+// servers returns the servers with devices that still have weight in any of
+// the rings; devices already at zero weight have nothing left to move off.
+func (dfm *diskFailureMonitor) servers(logger *zap.Logger) []*diskFailureServer {
+	serverMap := map[string]*diskFailureServer{}
+	devices := map[string]bool{}
+	add := func(ryng ring.Ring) {
+		for _, dev := range ryng.AllDevices() {
+			if dev == nil || dev.Weight <= 0 {
+				continue
+			}
+			id := serverId(dev.Ip, dev.Port)
+			server := serverMap[id]
+			if server == nil {
+				server = &diskFailureServer{scheme: dev.Scheme, ip: dev.Ip, port: dev.Port}
+				serverMap[id] = server
+			}
+			if !devices[deviceId(dev.Ip, dev.Port, dev.Device)] {
+				devices[deviceId(dev.Ip, dev.Port, dev.Device)] = true
+				server.devices = append(server.devices, dev.Device)
+			}
+		}
+	}
+	prefix, suffix := getAffixes()
+	for _, typ := range []string{"account", "container", "object"} {
+		policies := []int{0}
+		if typ == "object" {
+			policies = nil
+			for _, policy := range dfm.aa.policies {
+				policies = append(policies, policy.Index)
+			}
+		}
+		for _, policy := range policies {
+			ryng, err := ring.GetRing(typ, prefix, suffix, policy)
+			if err != nil {
+				logger.Error("could not load ring", zap.String("type", typ), zap.Int("policy", policy), zap.Error(err))
+				continue
+			}
+			add(ryng)
+		}
+	}
+	var ids []string
+	for id := range serverMap {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	servers := make([]*diskFailureServer, 0, len(ids))
+	for _, id := range ids {
+		servers = append(servers, serverMap[id])
+	}
+	return servers
+}
+
+// deviceFailed takes the failing device's weight away in every ring, queues
+// its partitions to be copied to their new homes from the other replicas,
+// and opens a work item for the operator to replace the disk. It returns
+// false if the device already had one open, or can't be drained yet.
+func (dfm *diskFailureMonitor) deviceFailed(logger *zap.Logger, server *diskFailureServer, device, reason string) bool {
+	if item, err := dfm.aa.db.openWorkItem("disk failure", server.ip, server.port, device); err != nil {
+		logger.Error("could not check for an open work item", zap.Error(err))
+		return false
+	} else if item != nil {
+		logger.Debug("already has an open work item", zap.Int64("work item", item.ID))
+		return false
+	}
+	if !dfm.mayDrain(logger) {
+		return false
+	}
+	dfm.drains++
+	logger.Info("device is failing", zap.String("reason", reason))
+	dfm.failuresMetric.Inc(1)
+	var actions []string
+	for _, typ := range []string{"account", "container", "object"} {
+		if typ == "object" {
+			for _, policy := range dfm.aa.policies {
+				actions = append(actions, dfm.drainFromBuilder(logger, server.ip, server.port, device, typ, policy.Index)...)
+			}
+		} else {
+			actions = append(actions, dfm.drainFromBuilder(logger, server.ip, server.port, device, typ, 0)...)
+		}
+	}
+	if len(actions) == 0 {
+		actions = append(actions, "its weight couldn't be changed in any ring")
+	}
+	detail := fmt.Sprintf("%s; %s; replace the disk, then resolve this work item", reason, strings.Join(actions, "; "))
+	if _, err := dfm.aa.db.addWorkItem("disk failure", server.ip, server.port, device, detail); err != nil {
+		logger.Error("could not add work item", zap.String("detail", detail), zap.Error(err))
+	}
+	return true
+}
+
+// drainFromBuilder sets the device's weight to zero in the ring and
+// rebalances, returning what it did. Partition copies that moved off the
+// device are queued to be copied from whichever other replica can, rather
+// than from the failing disk the ring monitor would otherwise use.
+func (dfm *diskFailureMonitor) drainFromBuilder(logger *zap.Logger, ip string, port int, device, typ string, policy int) []string {
+	ringName := typ
+	if typ == "object" && policy != 0 {
+		ringName = fmt.Sprintf("object-%d", policy)
+	}
+	logger = logger.With(zap.String("type", typ), zap.Int("policy", policy))
+	prefix, suffix := getAffixes()
+	previousRing, err := ring.GetRingMD5(typ, prefix, suffix, policy)
+	if err != nil {
+		logger.Error("Could not load ring", zap.Error(err))
+		return nil
+	}
+	ringBuilder, ringBuilderFilePath, err := ring.GetRingBuilder(typ, policy)
+	if err != nil {
+		logger.Error("Could not find builder", zap.Error(err))
+		return nil
+	}
+	ringBuilderLock, err := ring.LockBuilderPath(ringBuilderFilePath)
+	if err != nil {
+		logger.Error("Could not lock builder path", zap.String("ring builder file path", ringBuilderFilePath), zap.Error(err))
+		return nil
+	}
+	defer ringBuilderLock.Close()
+	ringBuilder, ringBuilderFilePath, err = ring.GetRingBuilder(typ, policy)
+	if err != nil {
+		logger.Error("Could not find builder after lock", zap.Error(err))
+		return nil
+	}
+	drained := map[int]bool{}
+	for _, dev := range ringBuilder.SearchDevs(-1, -1, ip, int64(port), "", -1, device, -1, "", "") {
+		if dev.Weight <= 0 {
+			continue
+		}
+		if err := ringBuilder.SetDevWeight(dev.Id, 0); err != nil {
+			logger.Error("Could not set weight", zap.Int64("id", dev.Id), zap.Error(err))
+			continue
+		}
+		drained[int(dev.Id)] = true
+		dfm.aa.db.addRingLog(typ, policy, fmt.Sprintf("set weight of failing device %s id:%d on server %s:%d to 0", dev.Device, dev.Id, ip, port))
+	}
+	if len(drained) == 0 {
+		return nil
+	}
+	actions := []string{fmt.Sprintf("weight set to 0 in the %s ring", ringName)}
+	if err = ringBuilder.Save(ringBuilderFilePath); err != nil {
+		logger.Error("Error while saving builder", zap.String("path", ringBuilderFilePath), zap.Error(err))
+		return []string{fmt.Sprintf("couldn't save the %s builder with its weight set to 0: %s", ringName, err)}
+	}
+	if _, _, _, err = ring.Rebalance(ringBuilderFilePath, false, false, true); err != nil {
+		logger.Error("Error while rebalancing", zap.String("path", ringBuilderFilePath), zap.Error(err))
+		return append(actions, fmt.Sprintf("couldn't rebalance the %s ring: %s", ringName, err))
+	}
+	dfm.aa.db.addRingLog(typ, policy, fmt.Sprintf("rebalanced due to failing device %s on %s:%d", device, ip, port))
+	currentRing, err := ring.GetRingMD5(typ, prefix, suffix, policy)
+	if err != nil {
+		logger.Error("could not load rebalanced ring", zap.Error(err))
+		return append(actions, "the ring monitor will queue its partitions' moves")
+	}
+	if currentRing.PartitionCount() != previousRing.PartitionCount() || currentRing.ReplicaCount() != previousRing.ReplicaCount() {
+		return append(actions, "the ring monitor will queue its partitions' moves")
+	}
+	// Only queue the moves if the ring monitor has seen the previous ring;
+	// otherwise it has other changes to queue and will queue these along
+	// with them.
+	previousMD5, _, err := dfm.aa.db.ringHash(typ, policy)
+	if err != nil || previousMD5 != previousRing.MD5() {
+		return append(actions, "the ring monitor will queue its partitions' moves")
+	}
+	var queued int
+	for partition := uint64(0); partition < currentRing.PartitionCount(); partition++ {
+		previousDevs := previousRing.GetNodes(partition)
+		currentDevs := currentRing.GetNodes(partition)
+		for replica := range currentDevs {
+			if previousDevs[replica].Id == currentDevs[replica].Id {
+				continue
+			}
+			// Moves that aren't off the failing device are queued as the ring
+			// monitor would have.
+			reason, fromDeviceID := "ring change", previousDevs[replica].Id
+			if drained[fromDeviceID] {
+				reason, fromDeviceID = "disk failure", -1
+			}
+			if err := dfm.aa.db.queuePartitionReplication(typ, policy, partition, reason, fromDeviceID, currentDevs[replica].Id); err != nil {
+				logger.Error("could not queue partition move; leaving it to the ring monitor", zap.Uint64("partition", partition), zap.Error(err))
+				return append(actions, "the ring monitor will queue its partitions' moves")
+			}
+			if reason == "disk failure" {
+				queued++
+				dfm.partitionsQueuedMetric.Inc(1)
+			}
+		}
+	}
+	if err := dfm.aa.db.setRingHash(typ, policy, currentRing.MD5(), time.Now().Add(randomDuration(time.Minute*30, time.Hour))); err != nil {
+		logger.Error("could not record the new ring hash", zap.Error(err))
+	}
+	dfm.aa.fastRingScan <- struct{}{}
+	return append(actions, fmt.Sprintf("%d partition copies queued to move off it in the %s ring", queued, ringName))
+}
@@ -0,0 +1,143 @@
+package tools
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/srv"
+	"go.uber.org/zap"
+)
+
+func TestReconDiskChecker(t *testing.T) {
+	status := 200
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/recon/driveerrors", r.URL.Path)
+		w.WriteHeader(status)
+		w.Write([]byte(`{"sda": 0, "sdb": 12, "sdc": 3}`))
+	}))
+	defer ts.Close()
+	host, portStr, err := net.SplitHostPort(strings.TrimPrefix(ts.URL, "http://"))
+	require.Nil(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.Nil(t, err)
+	c := &reconDiskChecker{client: http.DefaultClient, errorLimit: 10}
+	server := &diskFailureServer{scheme: "http", ip: host, port: port, devices: []string{"sda", "sdb", "sdd"}}
+	failing, err := c.failingDevices(server)
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{"sdb": "the kernel has seen 12 I/O errors on its disk"}, failing)
+	status = 404
+	failing, err = c.failingDevices(server)
+	require.Nil(t, err)
+	require.Empty(t, failing)
+	status = 500
+	_, err = c.failingDevices(server)
+	require.NotNil(t, err)
+}
+
+func TestCommandDiskChecker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "check")
+	require.Nil(t, ioutil.WriteFile(script, []byte(`#!/bin/sh
+case "$3" in
+bad) echo "SMART says reallocated sectors"; exit 1 ;;
+quiet) exit 1 ;;
+broken) exit 2 ;;
+slow) sleep 5; exit 1 ;;
+esac
+`), 0755))
+	c := &commandDiskChecker{command: script, timeout: time.Second}
+	failing, err := c.failingDevices(&diskFailureServer{ip: "1.2.3.4", port: 6000, devices: []string{"good", "bad", "quiet", "broken"}})
+	require.NotNil(t, err)
+	require.True(t, strings.Contains(err.Error(), "broken"))
+	require.Equal(t, map[string]string{"bad": "SMART says reallocated sectors", "quiet": "the check command says it's failing"}, failing)
+
+	start := time.Now()
+	failing, err = c.failingDevices(&diskFailureServer{ip: "1.2.3.4", port: 6000, devices: []string{"slow"}})
+	require.NotNil(t, err)
+	require.True(t, strings.Contains(err.Error(), "slow: timed out"))
+	require.Empty(t, failing)
+	require.True(t, time.Since(start) < 4*time.Second)
+}
+
+func TestDiskFailureLimits(t *testing.T) {
+	db, err := newDB(nil, dbTestName("TestDiskFailureLimits"))
+	require.Nil(t, err)
+	dfm := &diskFailureMonitor{aa: &AutoAdmin{db: db}, failingCounts: map[string]int{}, maxDrainsPerPass: 2, maxOpenFailures: 2}
+	server := &diskFailureServer{ip: "1.2.3.4", port: 6000, devices: []string{"sda", "sdb"}}
+	dfm.countFailing(server, map[string]string{"sda": "bad", "sdb": "bad"}, nil)
+	dfm.countFailing(server, map[string]string{"sda": "bad"}, nil)
+	require.Equal(t, map[string]int{"1.2.3.4:6000/sda": 2}, dfm.failingCounts)
+	// A check that didn't work doesn't count as the device being healthy.
+	dfm.countFailing(server, nil, errors.New("no answer"))
+	require.Equal(t, map[string]int{"1.2.3.4:6000/sda": 2}, dfm.failingCounts)
+
+	logger := zap.NewNop()
+	require.True(t, dfm.mayDrain(logger))
+	dfm.drains = 2
+	require.False(t, dfm.mayDrain(logger))
+	dfm.drains = 0
+	_, err = db.addWorkItem("disk failure", "1.2.3.4", 6000, "sdc", "it broke")
+	require.Nil(t, err)
+	_, err = db.addWorkItem("something else", "1.2.3.4", 6000, "sdc", "it's fine")
+	require.Nil(t, err)
+	require.True(t, dfm.mayDrain(logger))
+	_, err = db.addWorkItem("disk failure", "1.2.3.4", 6000, "sdd", "it broke too")
+	require.Nil(t, err)
+	require.False(t, dfm.mayDrain(logger))
+	dfm.maxOpenFailures = 0
+	require.True(t, dfm.mayDrain(logger))
+}
+
+func TestWorkItems(t *testing.T) {
+	db, err := newDB(nil, dbTestName("TestWorkItems"))
+	require.Nil(t, err)
+	a := &AutoAdmin{db: db}
+	id, err := db.addWorkItem("disk failure", "1.2.3.4", 6000, "sda", "it broke")
+	require.Nil(t, err)
+	item, err := db.openWorkItem("disk failure", "1.2.3.4", 6000, "sda")
+	require.Nil(t, err)
+	require.Equal(t, id, item.ID)
+	require.Equal(t, "it broke", item.Detail)
+	item, err = db.openWorkItem("disk failure", "1.2.3.4", 6000, "sdb")
+	require.Nil(t, err)
+	require.Nil(t, item)
+
+	w := httptest.NewRecorder()
+	a.WorkItemsHandler(w, httptest.NewRequest("GET", "/workitems", nil))
+	require.Equal(t, 200, w.Code)
+	require.True(t, strings.Contains(w.Body.String(), `"Detail":"it broke"`))
+
+	resolve := func(id string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("PUT", "/workitems/"+id+"/resolve", nil)
+		r = srv.SetVars(r, map[string]string{"id": id})
+		a.ResolveWorkItemHandler(w, r)
+		return w.Code
+	}
+	require.Equal(t, 204, resolve(strconv.FormatInt(id, 10)))
+	require.Equal(t, 404, resolve(strconv.FormatInt(id, 10)))
+	require.Equal(t, 400, resolve("x"))
+	items, err := db.workItems(false)
+	require.Nil(t, err)
+	require.Empty(t, items)
+	items, err = db.workItems(true)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(items))
+	require.True(t, items[0].Resolved)
+
+	w = httptest.NewRecorder()
+	a.WorkItemsHandler(w, httptest.NewRequest("GET", "/workitems", nil))
+	require.Equal(t, "[]", w.Body.String())
+}
@@ -11,10 +11,52 @@ import (
 
 	"github.com/troubling/hummingbird/common/conf"
 	"github.com/troubling/hummingbird/common/ring"
+	"github.com/uber-go/tally"
+	"go.uber.org/zap"
 )
 
 var partitionListCap = 4
 
+// partitionDamage collects the partitions a dispersion scan found a copy
+// missing from, or couldn't check a copy of.
+type partitionDamage struct {
+	lock       sync.Mutex
+	partitions map[uint64]bool
+}
+
+func (d *partitionDamage) add(partition uint64) {
+	d.lock.Lock()
+	if d.partitions == nil {
+		d.partitions = map[uint64]bool{}
+	}
+	d.partitions[partition] = true
+	d.lock.Unlock()
+}
+
+func (d *partitionDamage) count() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return len(d.partitions)
+}
+
+// recordDispersionResult stores how many of the ring's partitions a
+// dispersion scan found all the copies of, and logs an error if that's below
+// alertThreshold percent. Partitions the scan didn't get to, because a
+// listing failed part way, count as not intact.
+func recordDispersionResult(aa *AutoAdmin, logger *zap.Logger, typ string, policy int, partitions uint64, scanned int, damage *partitionDamage, alertThreshold float64, gauge tally.Gauge) {
+	result := &dispersionResult{Partitions: int(partitions), Intact: scanned - damage.count()}
+	if scanned < result.Partitions {
+		logger.Error("dispersion scan incomplete", zap.Int("partitions", result.Partitions), zap.Int("scanned", scanned))
+	}
+	gauge.Update(result.IntactPercent())
+	if err := aa.db.setDispersionResult(typ, policy, result.Partitions, result.Intact); err != nil {
+		logger.Error("setDispersionResult", zap.Error(err))
+	}
+	if result.IntactPercent() < alertThreshold {
+		logger.Error("dispersion below alert threshold", zap.Float64("intact percent", result.IntactPercent()), zap.Float64("alert threshold", alertThreshold), zap.Int("partitions", result.Partitions), zap.Int("intact", result.Intact))
+	}
+}
+
 type dispersionReport struct {
 	Name            string
 	Time            time.Time
@@ -61,6 +103,16 @@ type innerDispersionReport struct {
 	ReplicaCount    int
 	Partitions      map[int][]*dispersionMissing
 	ScanFailures    map[int][]*scanFailure
+	// Result is how many partitions had all their copies in the last
+	// complete scan, nil if there hasn't been one.
+	Result         *dispersionResult
+	AlertThreshold float64
+}
+
+// belowThreshold reports whether the last complete scan found fewer of the
+// partitions intact than AlertThreshold percent.
+func (r *innerDispersionReport) belowThreshold() bool {
+	return r.Result != nil && r.Result.IntactPercent() < r.AlertThreshold
 }
 
 type scanFailure struct {
@@ -88,6 +140,12 @@ func (r *innerDispersionReport) String() string {
 		s += fmt.Sprintf("    Last dispersion scan ran from %s to %s (%s ago for %s).\n", r.Start.Format("2006-01-02 15:04"), r.Complete.Format("2006-01-02 15:04"), time.Since(r.Complete).Truncate(time.Second), r.Complete.Sub(r.Start).Truncate(time.Second))
 	}
 	s += fmt.Sprintf("    There are %d partitions configured for %d copies.\n", r.TotalPartitions, r.ReplicaCount)
+	if r.Result != nil {
+		s += fmt.Sprintf("    %.2f%% of partitions had all their copies at %s (%d of %d checked).\n", r.Result.IntactPercent(), r.Result.Time.Format("2006-01-02 15:04"), r.Result.Intact, r.Result.Partitions)
+		if r.belowThreshold() {
+			s += fmt.Sprintf("    !! That's below the alert threshold of %.2f%%.\n", r.AlertThreshold)
+		}
+	}
 	if !r.Start.IsZero() && len(r.Partitions) == 0 {
 		s += "    All partition copies were in place when last checked.\n"
 	} else {
@@ -228,6 +286,12 @@ func getDispersionReport(flags *flag.FlagSet) *dispersionReport {
 	}
 	ring, _ := getRing("", "container", 0)
 	report.ContainerReport = &innerDispersionReport{TotalPartitions: int(ring.PartitionCount()), ReplicaCount: int(ring.ReplicaCount()), Partitions: map[int][]*dispersionMissing{}, ScanFailures: map[int][]*scanFailure{}}
+	report.ContainerReport.AlertThreshold = serverconf.GetFloat("dispersion-scan-containers", "alert_threshold", 99)
+	if report.ContainerReport.Result, err = db.dispersionResult("container", 0); err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	} else if report.ContainerReport.belowThreshold() {
+		report.Pass = false
+	}
 	var progress string
 	report.ContainerReport.Start, _, progress, report.ContainerReport.Complete, err = db.processPass("dispersion scan", "container", 0)
 	if err != nil {
@@ -269,6 +333,12 @@ func getDispersionReport(flags *flag.FlagSet) *dispersionReport {
 			}
 			ring, _ := getRing("", "object", policy.Index)
 			objectReport := &innerDispersionReport{TotalPartitions: int(ring.PartitionCount()), ReplicaCount: int(ring.ReplicaCount()), Partitions: map[int][]*dispersionMissing{}, ScanFailures: map[int][]*scanFailure{}}
+			objectReport.AlertThreshold = serverconf.GetFloat("dispersion-scan-objects", "alert_threshold", 99)
+			if objectReport.Result, err = db.dispersionResult("object", policy.Index); err != nil {
+				report.Errors = append(report.Errors, err.Error())
+			} else if objectReport.belowThreshold() {
+				report.Pass = false
+			}
 			var progress string
 			objectReport.Start, _, progress, objectReport.Complete, err = db.processPass("dispersion scan", "object", policy.Index)
 			if err != nil {
@@ -94,6 +94,7 @@ type testDispersionClient struct {
 	objPuts   int
 	contCalls int
 	objCalls  int
+	objInit   bool
 }
 
 func (c *testDispersionClient) SetUserAgent(v string) {
@@ -178,7 +179,7 @@ func (c *testDispersionClient) GetObject(ctx context.Context, account string, co
 }
 
 func (c *testDispersionClient) HeadObject(ctx context.Context, account string, container string, obj string, headers http.Header) *http.Response {
-	if obj == "object-init" {
+	if obj == "object-init" && !c.objInit {
 		return nectarutil.ResponseStub(404, "")
 	}
 	return nectarutil.ResponseStub(200, "")
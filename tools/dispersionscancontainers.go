@@ -5,6 +5,7 @@ package tools
 // initial_delay = 0        # seconds to wait between requests for the first pass
 // pass_time_target = 3600  # seconds to try to make subsequent passes take
 // report_interval = 600    # seconds between progress reports
+// alert_threshold = 99     # percent of partitions with all copies found below which to log an error
 
 import (
 	"context"
@@ -34,10 +35,12 @@ type dispersionScanContainers struct {
 	delay          time.Duration
 	passTimeTarget time.Duration
 	reportInterval time.Duration
+	alertThreshold float64
 	passesMetric   tally.Timer
 	foundMetric    tally.Counter
 	notFoundMetric tally.Counter
 	erroredMetric  tally.Counter
+	intactMetric   tally.Gauge
 }
 
 func newDispersionScanContainers(aa *AutoAdmin) *dispersionScanContainers {
@@ -46,10 +49,12 @@ func newDispersionScanContainers(aa *AutoAdmin) *dispersionScanContainers {
 		delay:          time.Duration(aa.serverconf.GetInt("dispersion-scan-containers", "initial_delay", 0)) * time.Second,
 		passTimeTarget: time.Duration(aa.serverconf.GetInt("dispersion-scan-containers", "pass_time_target", secondsInADay)) * time.Second,
 		reportInterval: time.Duration(aa.serverconf.GetInt("dispersion-scan-containers", "report_interval", 600)) * time.Second,
+		alertThreshold: aa.serverconf.GetFloat("dispersion-scan-containers", "alert_threshold", 99),
 		passesMetric:   aa.metricsScope.Timer("disp_scan_cont_passes"),
 		foundMetric:    aa.metricsScope.Counter("disp_scan_cont_found"),
 		notFoundMetric: aa.metricsScope.Counter("disp_scan_cont_notfound"),
 		erroredMetric:  aa.metricsScope.Counter("disp_scan_cont_errored"),
+		intactMetric:   aa.metricsScope.Gauge("disp_scan_cont_intact_percent"),
 	}
 	if dsc.delay < 0 {
 		dsc.delay = time.Second
@@ -77,6 +82,7 @@ type dispersionScanContainersContext struct {
 	found    int64
 	notFound int64
 	errored  int64
+	damage   partitionDamage
 }
 
 func (dsc *dispersionScanContainers) runOnce() time.Duration {
@@ -186,7 +192,10 @@ func (dsc *dispersionScanContainers) runOnce() time.Duration {
 	close(cancel)
 	ctx.wg.Wait()
 	<-progressDone
-	dsc.delay = dsc.passTimeTarget / time.Duration(delays)
+	recordDispersionResult(dsc.aa, logger, "container", 0, ctx.ring.PartitionCount(), int(delays), &ctx.damage, dsc.alertThreshold, dsc.intactMetric)
+	if delays > 0 {
+		dsc.delay = dsc.passTimeTarget / time.Duration(delays)
+	}
 	sleepFor := time.Until(start.Add(dsc.passTimeTarget))
 	if sleepFor < 0 {
 		sleepFor = 0
@@ -208,6 +217,7 @@ func (dsc *dispersionScanContainers) handleChecks(ctx *dispersionScanContainersC
 		if err != nil {
 			atomic.AddInt64(&ctx.errored, 1)
 			dsc.erroredMetric.Inc(1)
+			ctx.damage.add(check.partition)
 			ctx.logger.Error("http.NewRequest(HEAD, url, nil) // likely programming error", zap.String("url", url), zap.Error(err))
 			if err = dsc.aa.db.recordDispersionScanFailure("container", 0, check.partition, service, check.deviceID); err != nil {
 				ctx.logger.Error("recordDispersionScanFailure", zap.Uint64("partition", check.partition), zap.String("service", service), zap.Int("deviceID", check.deviceID), zap.Error(err))
@@ -220,6 +230,7 @@ func (dsc *dispersionScanContainers) handleChecks(ctx *dispersionScanContainersC
 		if err != nil {
 			atomic.AddInt64(&ctx.errored, 1)
 			dsc.erroredMetric.Inc(1)
+			ctx.damage.add(check.partition)
 			if err = dsc.aa.db.recordDispersionScanFailure("container", 0, check.partition, service, -1); err != nil {
 				ctx.logger.Error("recordDispersionScanFailure", zap.Uint64("partition", check.partition), zap.String("service", service), zap.Error(err))
 			}
@@ -230,6 +241,7 @@ func (dsc *dispersionScanContainers) handleChecks(ctx *dispersionScanContainersC
 		if resp.StatusCode == 404 {
 			atomic.AddInt64(&ctx.notFound, 1)
 			dsc.notFoundMetric.Inc(1)
+			ctx.damage.add(check.partition)
 			if err = dsc.aa.db.queuePartitionReplication("container", 0, check.partition, "dispersion", -1, check.deviceID); err != nil {
 				ctx.logger.Error("queuePartitionReplication", zap.Uint64("partition", check.partition), zap.Int("deviceID", check.deviceID), zap.Error(err))
 			}
@@ -238,6 +250,7 @@ func (dsc *dispersionScanContainers) handleChecks(ctx *dispersionScanContainersC
 		if resp.StatusCode/100 != 2 {
 			atomic.AddInt64(&ctx.errored, 1)
 			dsc.erroredMetric.Inc(1)
+			ctx.damage.add(check.partition)
 			if err = dsc.aa.db.recordDispersionScanFailure("container", 0, check.partition, "", check.deviceID); err != nil {
 				ctx.logger.Error("recordDispersionScanFailure", zap.Uint64("partition", check.partition), zap.Int("deviceID", check.deviceID), zap.Error(err))
 			}
@@ -5,6 +5,7 @@ package tools
 // initial_delay = 0        # seconds to wait between requests for the first pass
 // pass_time_target = 3600  # seconds to try to make subsequent passes take
 // report_interval = 600    # seconds between progress reports
+// alert_threshold = 99     # percent of a policy's partitions with all copies found below which to log an error
 
 import (
 	"context"
@@ -47,11 +48,13 @@ type dispersionScanObjects struct {
 	reportInterval  time.Duration
 	prefix          string
 	suffix          string
+	alertThreshold  float64
 	passesMetric    tally.Timer
 	passesMetrics   map[int]tally.Timer
 	foundMetrics    map[int]tally.Counter
 	notFoundMetrics map[int]tally.Counter
 	erroredMetrics  map[int]tally.Counter
+	intactMetrics   map[int]tally.Gauge
 }
 
 func newDispersionScanObjects(aa *AutoAdmin) *dispersionScanObjects {
@@ -60,11 +63,13 @@ func newDispersionScanObjects(aa *AutoAdmin) *dispersionScanObjects {
 		delay:           time.Duration(aa.serverconf.GetInt("dispersion-scan-objects", "initial_delay", 0)) * time.Second,
 		passTimeTarget:  time.Duration(aa.serverconf.GetInt("dispersion-scan-objects", "pass_time_target", secondsInADay)) * time.Second,
 		reportInterval:  time.Duration(aa.serverconf.GetInt("dispersion-scan-objects", "report_interval", 600)) * time.Second,
+		alertThreshold:  aa.serverconf.GetFloat("dispersion-scan-objects", "alert_threshold", 99),
 		passesMetric:    aa.metricsScope.Timer("disp_scan_obj_passes"),
 		passesMetrics:   map[int]tally.Timer{},
 		foundMetrics:    map[int]tally.Counter{},
 		notFoundMetrics: map[int]tally.Counter{},
 		erroredMetrics:  map[int]tally.Counter{},
+		intactMetrics:   map[int]tally.Gauge{},
 	}
 	if dso.delay < 0 {
 		dso.delay = time.Second
@@ -126,6 +131,7 @@ type dispersionScanObjectsContext struct {
 	found     int64
 	notFound  int64
 	errored   int64
+	damage    partitionDamage
 }
 
 func (dso *dispersionScanObjects) scanDispersionObjects(logger *zap.Logger, policy *conf.Policy) int {
@@ -134,6 +140,7 @@ func (dso *dispersionScanObjects) scanDispersionObjects(logger *zap.Logger, poli
 		dso.foundMetrics[policy.Index] = dso.aa.metricsScope.Counter(fmt.Sprintf("disp_scan_obj_%d_found", policy.Index))
 		dso.notFoundMetrics[policy.Index] = dso.aa.metricsScope.Counter(fmt.Sprintf("disp_scan_obj_%d_notfound", policy.Index))
 		dso.erroredMetrics[policy.Index] = dso.aa.metricsScope.Counter(fmt.Sprintf("disp_scan_obj_%d_errored", policy.Index))
+		dso.intactMetrics[policy.Index] = dso.aa.metricsScope.Gauge(fmt.Sprintf("disp_scan_obj_%d_intact_percent", policy.Index))
 	}
 	defer dso.passesMetrics[policy.Index].Start().Stop()
 	start := time.Now()
@@ -269,6 +276,7 @@ func (dso *dispersionScanObjects) scanDispersionObjects(logger *zap.Logger, poli
 	close(cancel)
 	ctx.wg.Wait()
 	<-progressDone
+	recordDispersionResult(dso.aa, logger, "object", policy.Index, ctx.ring.PartitionCount(), int(delays), &ctx.damage, dso.alertThreshold, dso.intactMetrics[policy.Index])
 	logger.Debug("policy pass complete", zap.Int64("found", ctx.found), zap.Int64("not found", ctx.notFound), zap.Int64("errored", ctx.errored))
 	if err := dso.aa.db.progressProcessPass("dispersion scan", "object", policy.Index, fmt.Sprintf("%d of %d partitions, %d not found, %d errored", delays, ctx.ring.PartitionCount(), ctx.notFound, ctx.errored)); err != nil {
 		logger.Error("progressProcessPass", zap.Error(err))
@@ -293,6 +301,7 @@ func (dso *dispersionScanObjects) handleChecks(ctx *dispersionScanObjectsContext
 		if err != nil {
 			atomic.AddInt64(&ctx.errored, 1)
 			dso.erroredMetrics[ctx.policy].Inc(1)
+			ctx.damage.add(check.partition)
 			ctx.logger.Error("http.NewRequest(GET, url, nil) // likely programming error", zap.String("url", url), zap.Error(err))
 			if err = dso.aa.db.recordDispersionScanFailure("object", ctx.policy, check.partition, service, check.deviceID); err != nil {
 				ctx.logger.Error("recordDispersionScanFailure", zap.Int("policy", ctx.policy), zap.Uint64("partition", check.partition), zap.String("service", service), zap.Int("deviceID", check.deviceID), zap.Error(err))
@@ -306,6 +315,7 @@ func (dso *dispersionScanObjects) handleChecks(ctx *dispersionScanObjectsContext
 		if err != nil {
 			atomic.AddInt64(&ctx.errored, 1)
 			dso.erroredMetrics[ctx.policy].Inc(1)
+			ctx.damage.add(check.partition)
 			ctx.logger.Debug("Do", zap.String("url", url), zap.Error(err))
 			if err = dso.aa.db.recordDispersionScanFailure("object", ctx.policy, check.partition, service, -1); err != nil {
 				ctx.logger.Error("recordDispersionScanFailure", zap.Int("policy", ctx.policy), zap.Uint64("partition", check.partition), zap.String("service", service), zap.Error(err))
@@ -317,6 +327,7 @@ func (dso *dispersionScanObjects) handleChecks(ctx *dispersionScanObjectsContext
 		if resp.StatusCode == 404 {
 			atomic.AddInt64(&ctx.notFound, 1)
 			dso.notFoundMetrics[ctx.policy].Inc(1)
+			ctx.damage.add(check.partition)
 			if err = dso.aa.db.queuePartitionReplication("object", ctx.policy, check.partition, "dispersion", -1, check.deviceID); err != nil {
 				ctx.logger.Error("queuePartitionReplication", zap.Uint64("partition", check.partition), zap.Int("deviceID", check.deviceID), zap.Error(err))
 			}
@@ -325,6 +336,7 @@ func (dso *dispersionScanObjects) handleChecks(ctx *dispersionScanObjectsContext
 		if resp.StatusCode/100 != 2 {
 			atomic.AddInt64(&ctx.errored, 1)
 			dso.erroredMetrics[ctx.policy].Inc(1)
+			ctx.damage.add(check.partition)
 			ctx.logger.Debug("StatusCode", zap.String("url", url), zap.Int("status code", resp.StatusCode))
 			if err = dso.aa.db.recordDispersionScanFailure("object", ctx.policy, check.partition, "", check.deviceID); err != nil {
 				ctx.logger.Error("recordDispersionScanFailure", zap.Int("policy", ctx.policy), zap.Uint64("partition", check.partition), zap.Int("deviceID", check.deviceID), zap.Error(err))
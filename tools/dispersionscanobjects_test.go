@@ -0,0 +1,61 @@
+package tools
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/ring"
+	"go.uber.org/zap"
+)
+
+func TestScanDispersionObjects(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/sdb/") {
+			w.WriteHeader(404)
+		}
+	}))
+	defer ts.Close()
+	host, portStr, err := net.SplitHostPort(strings.TrimPrefix(ts.URL, "http://"))
+	require.Nil(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.Nil(t, err)
+	devs := []*ring.Device{{Id: 0, Scheme: "http", Ip: host, Port: port, Device: "sda"}, {Id: 1, Scheme: "http", Ip: host, Port: port, Device: "sdb"}}
+	c := &testDispersionClient{objRing: &FakeRing{Devs: devs, nodeCalls: 1}, objCalls: 1, objInit: true}
+	db, err := newDB(nil, dbTestName("TestScanDispersionObjects"))
+	require.Nil(t, err)
+	p := &conf.Policy{Name: "hat"}
+	dso := newDispersionScanObjects(&AutoAdmin{logger: zap.NewNop(), hClient: c, client: http.DefaultClient, policies: conf.PolicyList{p.Index: p}, db: db, metricsScope: common.NewTestScope()})
+	require.Equal(t, 1, dso.scanDispersionObjects(zap.NewNop(), p))
+	result, err := db.dispersionResult("object", 0)
+	require.Nil(t, err)
+	require.Equal(t, 4, result.Partitions)
+	require.Equal(t, 0, result.Intact)
+	require.Equal(t, 0.0, result.IntactPercent())
+	qrs, err := db.queuedReplications("object", 0, "dispersion")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(qrs))
+	require.Equal(t, 1, qrs[0].toDeviceID)
+
+	recordDispersionResult(dso.aa, zap.NewNop(), "object", 0, 4, 2, &partitionDamage{}, 99, common.NewTestScope().Gauge("intact"))
+	result, err = db.dispersionResult("object", 0)
+	require.Nil(t, err)
+	require.Equal(t, 50.0, result.IntactPercent())
+
+	require.Nil(t, db.setDispersionResult("object", 0, 200, 199))
+	result, err = db.dispersionResult("object", 0)
+	require.Nil(t, err)
+	require.Equal(t, 99.5, result.IntactPercent())
+	report := &innerDispersionReport{Result: result, AlertThreshold: 99}
+	require.False(t, report.belowThreshold())
+	report.AlertThreshold = 99.9
+	require.True(t, report.belowThreshold())
+	require.True(t, strings.Contains(report.String(), "99.50% of partitions had all their copies"))
+	require.True(t, strings.Contains(report.String(), "!! That's below the alert threshold of 99.90%"))
+}
@@ -0,0 +1,279 @@
+package tools
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/troubling/hummingbird/client/direct"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/srv"
+)
+
+// Headers that differ from response to response, whatever the replica has.
+var ignoredInfoHeaders = map[string]bool{
+	"Connection":        true,
+	"Date":              true,
+	"Keep-Alive":        true,
+	"Transfer-Encoding": true,
+	"X-Trans-Id":        true,
+}
+
+// parseItemURL splits a path like AUTH_test/c/o or /v1/AUTH_test/c/o, or a
+// URL to one, into the account, container and object it names.
+func parseItemURL(arg string) (string, string, string) {
+	if u, err := url.Parse(arg); err == nil && u.Scheme != "" && u.Host != "" {
+		arg = u.Path
+	}
+	arg = strings.TrimPrefix(strings.TrimPrefix(arg, "/"), "v1/")
+	return parseArg0(arg)
+}
+
+// replicaInfo is what one of an item's nodes said about it.
+type replicaInfo struct {
+	Device  *ring.Device
+	Headers http.Header
+	Err     error
+}
+
+func (r *replicaInfo) id() string {
+	return deviceId(r.Device.Ip, r.Device.Port, r.Device.Device)
+}
+
+// getReplicaInfo calls head for all of devs at once, returning what each
+// said in the same order as devs.
+func getReplicaInfo(ctx context.Context, devs []*ring.Device, head func(ctx context.Context, dev *ring.Device) (http.Header, error)) []*replicaInfo {
+	replicas := make([]*replicaInfo, len(devs))
+	byDev := make(map[*ring.Device]*replicaInfo, len(devs))
+	for i, dev := range devs {
+		replicas[i] = &replicaInfo{Device: dev}
+		byDev[dev] = replicas[i]
+	}
+	results := direct.Each(ctx, devs, func(ctx context.Context, dev *ring.Device) error {
+		var err error
+		byDev[dev].Headers, err = head(ctx, dev)
+		return err
+	})
+	for _, result := range results {
+		byDev[result.Device].Err = result.Err
+	}
+	return replicas
+}
+
+func infoHeaderKeys(replicas []*replicaInfo) []string {
+	seen := map[string]bool{}
+	var keys []string
+	for _, r := range replicas {
+		for k := range r.Headers {
+			if !ignoredInfoHeaders[k] && !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// replicaInconsistencies returns how the replicas disagree: nodes missing
+// an item others have, nodes that couldn't be asked, and headers, like
+// timestamps, etags and metadata, that aren't the same on all of them.
+func replicaInconsistencies(replicas []*replicaInfo) []string {
+	var problems []string
+	var found []*replicaInfo
+	for _, r := range replicas {
+		if r.Err == nil {
+			found = append(found, r)
+		}
+	}
+	for _, r := range replicas {
+		if r.Err == nil {
+			continue
+		}
+		if !direct.IsNotFound(r.Err) {
+			problems = append(problems, fmt.Sprintf("%s couldn't be checked: %v", r.id(), r.Err))
+		} else if len(found) > 0 {
+			problems = append(problems, fmt.Sprintf("%s doesn't have it", r.id()))
+		}
+	}
+	for _, k := range infoHeaderKeys(found) {
+		byValue := map[string][]string{}
+		var values []string
+		for _, r := range found {
+			v := r.Headers.Get(k)
+			if _, ok := byValue[v]; !ok {
+				values = append(values, v)
+			}
+			byValue[v] = append(byValue[v], r.id())
+		}
+		if len(values) < 2 {
+			continue
+		}
+		sort.Strings(values)
+		var parts []string
+		for _, v := range values {
+			shown := v
+			if shown == "" {
+				shown = "(none)"
+			}
+			parts = append(parts, fmt.Sprintf("%s on %s", shown, strings.Join(byValue[v], ", ")))
+		}
+		problems = append(problems, fmt.Sprintf("%s differs: %s", k, strings.Join(parts, "; ")))
+	}
+	return problems
+}
+
+// printReplicaInfo prints what each replica said and how they disagree,
+// returning whether they all agree.
+func printReplicaInfo(replicas []*replicaInfo) bool {
+	for _, r := range replicas {
+		fmt.Printf("\nReplica %s\n", r.id())
+		if direct.IsNotFound(r.Err) {
+			fmt.Printf("  Not found\n")
+			continue
+		} else if r.Err != nil {
+			fmt.Printf("  Error: %v\n", r.Err)
+			continue
+		}
+		for _, k := range infoHeaderKeys([]*replicaInfo{r}) {
+			v := r.Headers.Get(k)
+			if strings.HasSuffix(k, "Timestamp") {
+				if t, err := common.ParseDate(v); err == nil {
+					v = fmt.Sprintf("%s (%s)", t.Format(time.RFC3339), v)
+				}
+			}
+			fmt.Printf("  %s: %s\n", k, v)
+		}
+	}
+	problems := replicaInconsistencies(replicas)
+	fmt.Println()
+	if len(problems) == 0 {
+		for _, r := range replicas {
+			if r.Err == nil {
+				fmt.Println("All replicas agree")
+				return true
+			}
+		}
+		fmt.Println("Not found on any replica")
+		return true
+	}
+	fmt.Println("Replicas disagree:")
+	for _, p := range problems {
+		fmt.Printf("!! %s\n", p)
+	}
+	return false
+}
+
+func newInfoClient(flags *flag.FlagSet) *direct.Client {
+	certFile := flags.Lookup("certfile").Value.(flag.Getter).Get().(string)
+	keyFile := flags.Lookup("keyfile").Value.(flag.Getter).Get().(string)
+	c, err := direct.NewClient(certFile, keyFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return c
+}
+
+func printInfoTarget(account, container, object string, partition uint64) {
+	fmt.Printf("Account  \t%v\n", account)
+	if container != "" {
+		fmt.Printf("Container\t%v\n", container)
+	}
+	if object != "" {
+		fmt.Printf("Object   \t%v\n", object)
+	}
+	fmt.Printf("Partition\t%v\n", partition)
+	fmt.Printf("Hash     \t%v\n", getPathHash(account, container, object))
+}
+
+// containerPolicy asks the container's nodes which policy its objects are
+// in, returning -1 if none of them know.
+func containerPolicy(ctx context.Context, c *direct.Client, account, container string) int {
+	r, _ := getRing("", "container", 0)
+	partition, devs := direct.ContainerNodes(r, account, container)
+	for _, replica := range getReplicaInfo(ctx, devs, func(ctx context.Context, dev *ring.Device) (http.Header, error) {
+		return c.HeadContainer(ctx, dev, partition, account, container, nil)
+	}) {
+		if replica.Err == nil {
+			if index, err := strconv.Atoi(replica.Headers.Get("X-Backend-Storage-Policy-Index")); err == nil {
+				return index
+			}
+		}
+	}
+	return -1
+}
+
+// objectPolicy returns the policy named by the -P flag, or else the one the
+// container says its objects are in.
+func objectPolicy(ctx context.Context, flags *flag.FlagSet, c *direct.Client, policies conf.PolicyList, account, container string) *conf.Policy {
+	if policyName := flags.Lookup("P").Value.(flag.Getter).Get().(string); policyName != "" {
+		return policyByName(policyName, policies)
+	} else if index := containerPolicy(ctx, c, account, container); index >= 0 && policies[index] != nil {
+		return policies[index]
+	}
+	fmt.Println("Couldn't get the container's policy, using the default")
+	return policyByName("", policies)
+}
+
+// objectReplicaInfo is oinfo for an object in the cluster rather than a file
+// on this machine.
+func objectReplicaInfo(flags *flag.FlagSet, policies conf.PolicyList, account, container, object string) bool {
+	ctx := context.Background()
+	c := newInfoClient(flags)
+	policy := objectPolicy(ctx, flags, c, policies, account, container)
+	r, _ := getRing("", "object", policy.Index)
+	partition, devs := direct.ObjectNodes(r, account, container, object)
+	printInfoTarget(account, container, object, partition)
+	fmt.Printf("Policy   \t%v (%d)\n", policy.Name, policy.Index)
+	return printReplicaInfo(getReplicaInfo(ctx, devs, func(ctx context.Context, dev *ring.Device) (http.Header, error) {
+		return c.HeadObject(ctx, dev, partition, policy.Index, account, container, object, nil)
+	}))
+}
+
+// ContainerInfo shows what each of a container's nodes has for it, and
+// where they disagree.
+func ContainerInfo(flags *flag.FlagSet, cnf srv.ConfigLoader) {
+	account, container, object := parseItemURL(flags.Arg(0))
+	if account == "" || container == "" || object != "" {
+		fmt.Println("Expected a container's path, like AUTH_test/cont")
+		os.Exit(1)
+	}
+	c := newInfoClient(flags)
+	r, _ := getRing("", "container", 0)
+	partition, devs := direct.ContainerNodes(r, account, container)
+	printInfoTarget(account, container, "", partition)
+	if !printReplicaInfo(getReplicaInfo(context.Background(), devs, func(ctx context.Context, dev *ring.Device) (http.Header, error) {
+		return c.HeadContainer(ctx, dev, partition, account, container, nil)
+	})) {
+		os.Exit(1)
+	}
+}
+
+// AccountInfo shows what each of an account's nodes has for it, and where
+// they disagree.
+func AccountInfo(flags *flag.FlagSet, cnf srv.ConfigLoader) {
+	account, container, _ := parseItemURL(flags.Arg(0))
+	if account == "" || container != "" {
+		fmt.Println("Expected an account's path, like AUTH_test")
+		os.Exit(1)
+	}
+	c := newInfoClient(flags)
+	r, _ := getRing("", "account", 0)
+	partition, devs := direct.AccountNodes(r, account)
+	printInfoTarget(account, "", "", partition)
+	if !printReplicaInfo(getReplicaInfo(context.Background(), devs, func(ctx context.Context, dev *ring.Device) (http.Header, error) {
+		return c.HeadAccount(ctx, dev, partition, account, nil)
+	})) {
+		os.Exit(1)
+	}
+}
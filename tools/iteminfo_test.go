@@ -0,0 +1,74 @@
+package tools
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/client/direct"
+	"github.com/troubling/hummingbird/common/ring"
+)
+
+func TestParseItemURL(t *testing.T) {
+	for _, arg := range []string{"AUTH_test/c/o/p", "/v1/AUTH_test/c/o/p", "https://proxy:8080/v1/AUTH_test/c/o/p"} {
+		a, c, o := parseItemURL(arg)
+		require.Equal(t, "AUTH_test", a)
+		require.Equal(t, "c", c)
+		require.Equal(t, "o/p", o)
+	}
+	a, c, o := parseItemURL("http://proxy/v1/AUTH_test/the%20container")
+	require.Equal(t, "AUTH_test", a)
+	require.Equal(t, "the container", c)
+	require.Equal(t, "", o)
+}
+
+func TestReplicaInfo(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sda/1/a/c/o", "/sdb/1/a/c/o":
+			w.Header().Set("X-Timestamp", "1500000000.00000")
+			w.Header().Set("Etag", "d41d8cd98f00b204e9800998ecf8427e")
+			w.Header().Set("X-Object-Meta-Color", "blue")
+		case "/sdc/1/a/c/o":
+			w.Header().Set("X-Timestamp", "1400000000.00000")
+			w.Header().Set("Etag", "d41d8cd98f00b204e9800998ecf8427e")
+		default:
+			w.WriteHeader(404)
+			return
+		}
+		w.Header().Set("Date", r.URL.Path)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.Nil(t, err)
+	var devs []*ring.Device
+	for _, name := range []string{"sda", "sdb", "sdc", "sdd"} {
+		devs = append(devs, &ring.Device{Scheme: "http", Ip: u.Hostname(), Port: port, Device: name})
+	}
+	c := &direct.Client{HTTPClient: http.DefaultClient}
+	head := func(ctx context.Context, dev *ring.Device) (http.Header, error) {
+		return c.HeadObject(ctx, dev, 1, 0, "a", "c", "o", nil)
+	}
+
+	replicas := getReplicaInfo(context.Background(), devs[:2], head)
+	require.Equal(t, "sda", replicas[0].Device.Device)
+	require.Equal(t, "blue", replicas[0].Headers.Get("X-Object-Meta-Color"))
+	require.Equal(t, 0, len(replicaInconsistencies(replicas)))
+
+	replicas = getReplicaInfo(context.Background(), devs, head)
+	id := func(dev string) string { return deviceId(u.Hostname(), port, dev) }
+	require.Equal(t, []string{
+		id("sdd") + " doesn't have it",
+		"X-Object-Meta-Color differs: (none) on " + id("sdc") + "; blue on " + id("sda") + ", " + id("sdb"),
+		"X-Timestamp differs: 1400000000.00000 on " + id("sdc") + "; 1500000000.00000 on " + id("sda") + ", " + id("sdb"),
+	}, replicaInconsistencies(replicas))
+
+	// Nodes not having something isn't a disagreement if none of them do.
+	require.Equal(t, 0, len(replicaInconsistencies(getReplicaInfo(context.Background(), devs[3:], head))))
+}
@@ -29,6 +29,7 @@ import (
 	"context"
 	"crypto/md5"
 	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -58,7 +59,6 @@ import (
 	"github.com/troubling/hummingbird/middleware"
 	"github.com/troubling/hummingbird/objectserver"
 	"github.com/uber-go/tally"
-	promreporter "github.com/uber-go/tally/prometheus"
 	"go.uber.org/zap"
 )
 
@@ -508,13 +508,18 @@ func ObjectInfo(flags *flag.FlagSet, cnf srv.ConfigLoader) {
 		fmt.Println("Unable to load policies:", err)
 		os.Exit(1)
 	}
-	namedPolicy := policyByName(policyName, policies)
-
 	stat, statErr := os.Stat(object)
 	if statErr != nil {
+		if account, container, obj := parseItemURL(object); account != "" && container != "" && obj != "" {
+			if !objectReplicaInfo(flags, policies, account, container, obj) {
+				os.Exit(1)
+			}
+			return
+		}
 		fmt.Printf("Error statting file: %v\n", statErr)
 		os.Exit(1)
 	}
+	namedPolicy := policyByName(policyName, policies)
 
 	fullPath, pathErr := filepath.Abs(object)
 	if pathErr != nil {
@@ -616,6 +621,7 @@ type AutoAdmin struct {
 	runningForever    bool
 	db                *dbInstance
 	fastRingScan      chan struct{}
+	adminAuth         *middleware.AdminAuth
 }
 
 func (server *AutoAdmin) Type() string {
@@ -641,12 +647,7 @@ func (server *AutoAdmin) Background(flags *flag.FlagSet) chan struct{} {
 
 func (server *AutoAdmin) GetHandler(config conf.Config, metricsPrefix string) http.Handler {
 	var metricsScope tally.Scope
-	metricsScope, server.metricsCloser = tally.NewRootScope(tally.ScopeOptions{
-		Prefix:         metricsPrefix,
-		Tags:           map[string]string{},
-		CachedReporter: promreporter.NewReporter(promreporter.Options{}),
-		Separator:      promreporter.DefaultSeparator,
-	}, time.Second)
+	metricsScope, server.metricsCloser = srv.NewMetricsScope(config, metricsPrefix)
 	commonHandlers := alice.New(
 		middleware.NewDebugResponses(config.GetBool("debug", "debug_x_source_code", false)),
 		server.LogRequest,
@@ -658,6 +659,14 @@ func (server *AutoAdmin) GetHandler(config conf.Config, metricsPrefix string) ht
 	router.Get("/loglevel", server.logLevel)
 	router.Put("/loglevel", server.logLevel)
 	router.Get("/healthcheck", commonHandlers.ThenFunc(server.HealthcheckHandler))
+	router.Get("/workitems", commonHandlers.ThenFunc(server.WorkItemsHandler))
+	router.Put("/workitems/:id/resolve", commonHandlers.Then(server.adminAuth.Require(middleware.AdminRoleWorkItems, http.HandlerFunc(server.ResolveWorkItemHandler))))
+	router.Post("/workitems/:id/resolve", commonHandlers.Then(server.adminAuth.Require(middleware.AdminRoleWorkItems, http.HandlerFunc(server.ResolveWorkItemHandler))))
+	router.Get("/capacity", commonHandlers.ThenFunc(server.CapacityProposalsHandler))
+	router.Put("/capacity/:id/approve", commonHandlers.Then(server.adminAuth.Require(middleware.AdminRoleCapacity, http.HandlerFunc(server.ApproveCapacityProposalHandler))))
+	router.Post("/capacity/:id/approve", commonHandlers.Then(server.adminAuth.Require(middleware.AdminRoleCapacity, http.HandlerFunc(server.ApproveCapacityProposalHandler))))
+	router.Put("/capacity/:id/reject", commonHandlers.Then(server.adminAuth.Require(middleware.AdminRoleCapacity, http.HandlerFunc(server.RejectCapacityProposalHandler))))
+	router.Post("/capacity/:id/reject", commonHandlers.Then(server.adminAuth.Require(middleware.AdminRoleCapacity, http.HandlerFunc(server.RejectCapacityProposalHandler))))
 	router.Get("/debug/pprof/:parm", http.DefaultServeMux)
 	router.Post("/debug/pprof/:parm", http.DefaultServeMux)
 	return alice.New(middleware.Metrics(metricsScope)).Then(router)
@@ -681,6 +690,135 @@ func (server *AutoAdmin) HealthcheckHandler(writer http.ResponseWriter, request
 	writer.Write([]byte("OK"))
 }
 
+// WorkItemsHandler lists the open work items as JSON, or all of them with
+// ?all=true.
+func (server *AutoAdmin) WorkItemsHandler(writer http.ResponseWriter, request *http.Request) {
+	items, err := server.db.workItems(common.LooksTrue(request.URL.Query().Get("all")))
+	if err != nil {
+		srv.SimpleErrorResponse(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if items == nil {
+		items = []*workItem{}
+	}
+	server.jsonResponse(writer, items)
+}
+
+// ResolveWorkItemHandler marks a work item resolved, once the operator has
+// dealt with it.
+func (server *AutoAdmin) ResolveWorkItemHandler(writer http.ResponseWriter, request *http.Request) {
+	id, err := strconv.ParseInt(srv.GetVars(request)["id"], 10, 64)
+	if err != nil {
+		srv.SimpleErrorResponse(writer, http.StatusBadRequest, "Invalid work item id")
+		return
+	}
+	resolved, err := server.db.resolveWorkItem(id)
+	if err != nil {
+		srv.SimpleErrorResponse(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !resolved {
+		srv.SimpleErrorResponse(writer, http.StatusNotFound, "No open work item with that id")
+		return
+	}
+	srv.StandardResponse(writer, http.StatusNoContent)
+}
+
+// CapacityProposalsHandler lists the capacity planner's pending proposals as
+// JSON, or all of them with ?all=true.
+func (server *AutoAdmin) CapacityProposalsHandler(writer http.ResponseWriter, request *http.Request) {
+	proposals, err := server.db.capacityProposals(common.LooksTrue(request.URL.Query().Get("all")))
+	if err != nil {
+		srv.SimpleErrorResponse(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if proposals == nil {
+		proposals = []*capacityProposal{}
+	}
+	server.jsonResponse(writer, proposals)
+}
+
+// ApproveCapacityProposalHandler applies a pending capacity proposal, if the
+// capacity planner is set to apply them, and returns it as JSON.
+func (server *AutoAdmin) ApproveCapacityProposalHandler(writer http.ResponseWriter, request *http.Request) {
+	if !server.serverconf.GetBool("capacity-planner", "apply", false) {
+		srv.SimpleErrorResponse(writer, http.StatusConflict, "The capacity planner isn't set to apply proposals")
+		return
+	}
+	p := server.pendingCapacityProposal(writer, request)
+	if p == nil {
+		return
+	}
+	_, builderPath, err := ring.GetRingBuilder(p.Type, p.Policy)
+	if err != nil {
+		srv.SimpleErrorResponse(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+	detail, err := server.applyCapacityProposal(builderPath, p)
+	if err == errCapacityProposalStale {
+		srv.SimpleErrorResponse(writer, http.StatusConflict, err.Error())
+		return
+	} else if err != nil {
+		srv.SimpleErrorResponse(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if _, err = server.db.closeCapacityProposal(p.ID, "applied", detail); err != nil {
+		srv.SimpleErrorResponse(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+	p.State, p.Detail = "applied", detail
+	server.jsonResponse(writer, p)
+}
+
+// RejectCapacityProposalHandler closes a pending capacity proposal without
+// applying it.
+func (server *AutoAdmin) RejectCapacityProposalHandler(writer http.ResponseWriter, request *http.Request) {
+	p := server.pendingCapacityProposal(writer, request)
+	if p == nil {
+		return
+	}
+	if closed, err := server.db.closeCapacityProposal(p.ID, "rejected", ""); err != nil {
+		srv.SimpleErrorResponse(writer, http.StatusInternalServerError, err.Error())
+		return
+	} else if !closed {
+		srv.SimpleErrorResponse(writer, http.StatusNotFound, "No pending capacity proposal with that id")
+		return
+	}
+	srv.StandardResponse(writer, http.StatusNoContent)
+}
+
+// pendingCapacityProposal returns the pending proposal the request's id
+// names, or writes an error response and returns nil.
+func (server *AutoAdmin) pendingCapacityProposal(writer http.ResponseWriter, request *http.Request) *capacityProposal {
+	id, err := strconv.ParseInt(srv.GetVars(request)["id"], 10, 64)
+	if err != nil {
+		srv.SimpleErrorResponse(writer, http.StatusBadRequest, "Invalid capacity proposal id")
+		return nil
+	}
+	p, err := server.db.capacityProposal(id)
+	if err != nil {
+		srv.SimpleErrorResponse(writer, http.StatusInternalServerError, err.Error())
+		return nil
+	}
+	if p == nil || p.State != "pending" {
+		srv.SimpleErrorResponse(writer, http.StatusNotFound, "No pending capacity proposal with that id")
+		return nil
+	}
+	return p
+}
+
+func (server *AutoAdmin) jsonResponse(writer http.ResponseWriter, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		srv.SimpleErrorResponse(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(body)
+}
+
 func (server *AutoAdmin) LogRequest(next http.Handler) http.Handler {
 	return srv.LogRequest(server.logger, next)
 }
@@ -697,6 +835,8 @@ func (a *AutoAdmin) RunForever() {
 	go newQuarantineHistory(a).runForever()
 	go newQuarantineRepair(a).runForever()
 	go newUnmountedMonitor(a).runForever()
+	go newDiskFailureMonitor(a).runForever()
+	go newCapacityPlanner(a).runForever()
 	go newReplication(a).runForever()
 	go newRingMonitor(a).runForever()
 	go newRingScan(a).runForever()
@@ -721,6 +861,10 @@ func NewAdmin(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader)
 	port := int(serverconf.GetInt("andrewd", "bind_port", common.DefaultAndrewdPort))
 	certFile := serverconf.GetDefault("andrewd", "cert_file", "")
 	keyFile := serverconf.GetDefault("andrewd", "key_file", "")
+	caFile := serverconf.GetDefault("andrewd", "ca_file", "")
+	if err := common.SetClusterCA(caFile); err != nil {
+		return ipPort, nil, nil, err
+	}
 	pdc, pdcerr := client.NewProxyClient(policies, srv.DefaultConfigLoader{}, logger, certFile, keyFile, "", "", "", serverconf)
 	if pdcerr != nil {
 		return ipPort, nil, nil, fmt.Errorf("Could not make client: %v", pdcerr)
@@ -747,7 +891,7 @@ func NewAdmin(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader)
 		}
 	}
 	httpClient := &http.Client{
-		Transport: transport,
+		Transport: common.NewSigningTransport(transport, conf.GetBackendSigningKeys()),
 		Timeout:   10 * time.Second,
 	}
 	a := &AutoAdmin{
@@ -764,6 +908,10 @@ func NewAdmin(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader)
 		fastRingScan: make(chan struct{}, 32), // 32 just "because"; gives some room for a bunch of ring changes to get queued up before blocking.
 	}
 	a.hClient.SetUserAgent("Andrewd")
+	if a.adminAuth, err = middleware.NewAdminAuth(serverconf.GetDefault("andrewd", "admin_tokens", ""),
+		serverconf.GetDefault("andrewd", "admin_cert_roles", ""), logger); err != nil {
+		return ipPort, nil, nil, err
+	}
 	a.db, err = newDB(&serverconf, "")
 	if err != nil {
 		return ipPort, nil, nil, err
@@ -782,14 +930,12 @@ func NewAdmin(serverconf conf.Config, flags *flag.FlagSet, cnf srv.ConfigLoader)
 		}
 	}
 
-	a.metricsScope, a.metricsCloser = tally.NewRootScope(tally.ScopeOptions{
-		Prefix:         "hb_andrewd",
-		Tags:           map[string]string{},
-		CachedReporter: promreporter.NewReporter(promreporter.Options{}),
-		Separator:      promreporter.DefaultSeparator,
-	}, time.Second)
+	a.metricsScope, a.metricsCloser = srv.NewMetricsScope(serverconf, "hb_andrewd")
 
-	ipPort = &srv.IpPort{Ip: ip, Port: port, CertFile: certFile, KeyFile: keyFile}
+	ipPort = &srv.IpPort{Ip: ip, Port: port, CertFile: certFile, KeyFile: keyFile, CAFile: caFile,
+		ClientCertOptional: !serverconf.GetBool("andrewd", "require_client_cert", true),
+		HTTP2:              srv.NewHTTP2Config(serverconf.GetSection("andrewd")),
+		UnixSocket:         serverconf.GetDefault("andrewd", "bind_unix_socket", "")}
 	resp := a.hClient.PutAccount(
 		context.Background(),
 		AdminAccount,
@@ -0,0 +1,363 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/troubling/hummingbird/client"
+	"github.com/troubling/hummingbird/client/direct"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/srv"
+	"go.uber.org/zap"
+)
+
+const (
+	policyMigrationHeader      = "X-Container-Sysmeta-Policy-Migration"
+	policyMigrationMovedHeader = "X-Container-Sysmeta-Policy-Migration-Moved"
+)
+
+// policyMigrationCopyHeaders are the object headers, besides its metadata
+// and sysmeta, that the mover copies to the new policy.
+var policyMigrationCopyHeaders = []string{
+	"Content-Disposition", "Content-Encoding", "Content-Length", "Content-Type", "Etag", "X-Delete-At",
+	"X-Object-Manifest", "X-Object-Storage-Class", "X-Static-Large-Object", "X-Timestamp",
+}
+
+// policyMigrator moves the objects in a container to another storage policy.
+type policyMigrator struct {
+	c         client.RequestClient
+	account   string
+	container string
+	// pageSize is how many objects are moved between updates of the progress
+	// in the container's metadata.
+	pageSize int
+	// replicaPolicies returns the policy each of the container's replicas
+	// is in, or -1 for those that couldn't be asked.
+	replicaPolicies func(ctx context.Context) []int
+}
+
+type policyMigrationStatus struct {
+	policy int
+	// target is the policy being moved to, or -1 if there's no migration.
+	target      int
+	moved       int64
+	objectCount int64
+}
+
+func (m *policyMigrator) status(ctx context.Context) (*policyMigrationStatus, error) {
+	resp := m.c.HeadContainer(ctx, m.account, m.container, nil)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("HEAD of container gave status %d", resp.StatusCode)
+	}
+	s := &policyMigrationStatus{target: -1}
+	var err error
+	if s.policy, err = strconv.Atoi(resp.Header.Get("X-Backend-Storage-Policy-Index")); err != nil {
+		return nil, fmt.Errorf("bad X-Backend-Storage-Policy-Index %q", resp.Header.Get("X-Backend-Storage-Policy-Index"))
+	}
+	if target := resp.Header.Get(policyMigrationHeader); target != "" {
+		if s.target, err = strconv.Atoi(target); err != nil {
+			return nil, fmt.Errorf("bad %s %q", policyMigrationHeader, target)
+		}
+	}
+	s.moved, _ = strconv.ParseInt(resp.Header.Get(policyMigrationMovedHeader), 10, 64)
+	s.objectCount, _ = strconv.ParseInt(resp.Header.Get("X-Container-Object-Count"), 10, 64)
+	return s, nil
+}
+
+func (m *policyMigrator) post(ctx context.Context, headers http.Header) error {
+	headers.Set("X-Timestamp", common.GetTimestamp())
+	resp := m.c.PostContainer(ctx, m.account, m.container, headers)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("POST to container gave status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// start begins the dual-write window, after which the proxies write new
+// objects to the target policy.
+func (m *policyMigrator) start(ctx context.Context, target int) error {
+	return m.post(ctx, http.Header{policyMigrationHeader: {strconv.Itoa(target)}, policyMigrationMovedHeader: {"0"}})
+}
+
+// list returns up to limit object names after marker that are still in the
+// policy being moved from.
+func (m *policyMigrator) list(ctx context.Context, s *policyMigrationStatus, marker string, limit int) ([]string, error) {
+	resp := m.c.GetContainerRaw(ctx, m.account, m.container,
+		map[string]string{"format": "json", "marker": marker, "limit": strconv.Itoa(limit)},
+		http.Header{"X-Backend-Storage-Policy-Index": {strconv.Itoa(s.policy)}})
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("listing container gave status %d", resp.StatusCode)
+	}
+	var listing []struct {
+		Name string `json:"name"`
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(resp.Body).Decode(&listing); err != nil {
+			return nil, err
+		}
+	}
+	names := make([]string, len(listing))
+	for i, obj := range listing {
+		names[i] = obj.Name
+	}
+	return names, nil
+}
+
+// moveObject copies an object to the new policy, keeping its timestamp, and
+// then deletes it from the old one.
+func (m *policyMigrator) moveObject(ctx context.Context, s *policyMigrationStatus, name string) error {
+	fromPolicy := strconv.Itoa(s.policy)
+	resp := m.c.GetObject(ctx, m.account, m.container, name, http.Header{"X-Backend-Storage-Policy-Index": {fromPolicy}})
+	if resp.StatusCode == http.StatusNotFound {
+		// It was deleted or overwritten since it was listed.
+		resp.Body.Close()
+		return nil
+	} else if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		return fmt.Errorf("GET gave status %d", resp.StatusCode)
+	}
+	headers := http.Header{"X-Backend-Storage-Policy-Index": {strconv.Itoa(s.target)}}
+	for key := range resp.Header {
+		if strings.HasPrefix(key, "X-Object-Meta-") || strings.HasPrefix(key, "X-Object-Sysmeta-") {
+			headers.Set(key, resp.Header.Get(key))
+		}
+	}
+	for _, key := range policyMigrationCopyHeaders {
+		if value := resp.Header.Get(key); value != "" {
+			headers.Set(key, value)
+		}
+	}
+	putResp := m.c.PutObject(ctx, m.account, m.container, name, headers, resp.Body)
+	io.Copy(ioutil.Discard, putResp.Body)
+	putResp.Body.Close()
+	resp.Body.Close()
+	// A conflict means the new policy already has this or a newer version.
+	if putResp.StatusCode/100 != 2 && putResp.StatusCode != http.StatusConflict {
+		return fmt.Errorf("PUT gave status %d", putResp.StatusCode)
+	}
+	// The copy keeps the object's retention, so the old one can go even if it's retained.
+	delResp := m.c.DeleteObject(ctx, m.account, m.container, name,
+		http.Header{"X-Backend-Storage-Policy-Index": {fromPolicy}, "X-Timestamp": {common.GetTimestamp()}, "X-Backend-Retention-Moved": {"true"}})
+	delResp.Body.Close()
+	if delResp.StatusCode/100 != 2 && delResp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("DELETE gave status %d", delResp.StatusCode)
+	}
+	return nil
+}
+
+// move moves every object still in the old policy, recording its progress in
+// the container's metadata after each page. It returns how many objects
+// couldn't be moved.
+func (m *policyMigrator) move(ctx context.Context, s *policyMigrationStatus, out io.Writer) (int, error) {
+	// Object requests only reach the policy they name once the client sees the migration.
+	ci, err := m.c.GetContainerInfo(ctx, m.account, m.container)
+	if err != nil {
+		return 0, err
+	}
+	if ci.SysMetadata["Policy-Migration"] != strconv.Itoa(s.target) {
+		return 0, fmt.Errorf("container info doesn't show the migration to policy %d", s.target)
+	}
+	failed := 0
+	marker := ""
+	for {
+		names, err := m.list(ctx, s, marker, m.pageSize)
+		if err != nil {
+			return failed, err
+		}
+		if len(names) == 0 {
+			return failed, nil
+		}
+		for _, name := range names {
+			if err := m.moveObject(ctx, s, name); err != nil {
+				fmt.Fprintf(out, "Unable to move %s: %v\n", name, err)
+				failed++
+				continue
+			}
+			s.moved++
+		}
+		marker = names[len(names)-1]
+		if err := m.post(ctx, http.Header{policyMigrationMovedHeader: {strconv.FormatInt(s.moved, 10)}}); err != nil {
+			return failed, err
+		}
+	}
+}
+
+// cutover makes the new policy the container's, once no objects are left in
+// the old one. The container's policy isn't replicated between its replicas,
+// so the migration is only closed once every one of them is in the new
+// policy; until then running the cutover again retries them.
+func (m *policyMigrator) cutover(ctx context.Context, s *policyMigrationStatus) error {
+	// A replica already cut over by an earlier try answers with the new policy.
+	if s.policy != s.target {
+		names, err := m.list(ctx, s, "", 1)
+		if err != nil {
+			return err
+		}
+		if len(names) > 0 {
+			return fmt.Errorf("objects are still in the old policy, such as %q; move them before the cutover", names[0])
+		}
+	}
+	if err := m.post(ctx, http.Header{"X-Backend-Policy-Cutover": {strconv.Itoa(s.target)}}); err != nil {
+		return err
+	}
+	policies := m.replicaPolicies(ctx)
+	lagging := 0
+	for _, policy := range policies {
+		if policy != s.target {
+			lagging++
+		}
+	}
+	if lagging > 0 {
+		return fmt.Errorf("%d of %d replicas aren't in the new policy yet; run the cutover again once they're all up", lagging, len(policies))
+	}
+	return m.post(ctx, http.Header{policyMigrationHeader: {""}, policyMigrationMovedHeader: {""}})
+}
+
+// containerReplicaPolicies asks each of the container's nodes which policy
+// it's in.
+func containerReplicaPolicies(c *direct.Client, r ring.Ring, account, container string) func(ctx context.Context) []int {
+	return func(ctx context.Context) []int {
+		partition, devs := direct.ContainerNodes(r, account, container)
+		replicas := getReplicaInfo(ctx, devs, func(ctx context.Context, dev *ring.Device) (http.Header, error) {
+			return c.HeadContainer(ctx, dev, partition, account, container, nil)
+		})
+		policies := make([]int, len(replicas))
+		for i, replica := range replicas {
+			policies[i] = -1
+			if replica.Err == nil {
+				if index, err := strconv.Atoi(replica.Headers.Get("X-Backend-Storage-Policy-Index")); err == nil {
+					policies[i] = index
+				}
+			}
+		}
+		return policies
+	}
+}
+
+func policyName(policies conf.PolicyList, index int) string {
+	if p := policies[index]; p != nil {
+		return fmt.Sprintf("%s (%d)", p.Name, index)
+	}
+	return strconv.Itoa(index)
+}
+
+// PolicyMigrate moves a container's objects to another storage policy. Given
+// a policy it starts the migration and moves the objects, or without one
+// carries on with a migration already started; -status shows its progress
+// and -cutover finishes it. It returns false if anything failed.
+func PolicyMigrate(args []string, cnf srv.ConfigLoader) bool {
+	flags := flag.NewFlagSet("policymigrate", flag.ExitOnError)
+	status := flags.Bool("status", false, "only show the migration's progress")
+	cutover := flags.Bool("cutover", false, "make the new policy the container's, once every object has been moved")
+	pageSize := flags.Int("page", 1000, "how many objects to move between progress updates")
+	certFile := flags.String("certfile", "", "Cert file to use for setting up https client")
+	keyFile := flags.String("keyfile", "", "Key file to use for setting up https client")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "USAGE: hummingbird policymigrate [-status | -cutover] <account> <container> [<policy>]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if len(flags.Args()) < 2 || len(flags.Args()) > 3 || *pageSize < 1 {
+		flags.Usage()
+		return false
+	}
+	policies, err := cnf.GetPolicies()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to load policies:", err)
+		return false
+	}
+	pdc, err := client.NewProxyClient(policies, cnf, zap.NewNop(), *certFile, *keyFile, "", "", "", conf.Config{})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not make client:", err)
+		return false
+	}
+	dc, err := direct.NewClient(*certFile, *keyFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not make client:", err)
+		return false
+	}
+	containerRing, _ := getRing("", "container", 0)
+	// The cache is only for container info, so each object request doesn't
+	// need a HEAD of the container; it's filled after the migration starts.
+	m := &policyMigrator{
+		c:               pdc.NewRequestClient(nil, map[string]*client.ContainerInfo{}, zap.NewNop()),
+		account:         flags.Arg(0),
+		container:       flags.Arg(1),
+		pageSize:        *pageSize,
+		replicaPolicies: containerReplicaPolicies(dc, containerRing, flags.Arg(0), flags.Arg(1)),
+	}
+	ctx := context.Background()
+	s, err := m.status(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to get the container's status:", err)
+		return false
+	}
+	if *status {
+		if s.target < 0 {
+			fmt.Printf("%s/%s is in policy %s and isn't being migrated\n", m.account, m.container, policyName(policies, s.policy))
+		} else if s.policy == s.target {
+			fmt.Printf("%s/%s is being cut over to policy %s, which hasn't reached every replica\n", m.account, m.container, policyName(policies, s.target))
+		} else {
+			fmt.Printf("%s/%s is being migrated from policy %s to %s: %d of %d objects moved\n", m.account, m.container,
+				policyName(policies, s.policy), policyName(policies, s.target), s.moved, s.objectCount)
+		}
+		return true
+	}
+	if *cutover {
+		if s.target < 0 {
+			fmt.Fprintf(os.Stderr, "%s/%s isn't being migrated\n", m.account, m.container)
+			return false
+		}
+		if err := m.cutover(ctx, s); err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to cut over:", err)
+			return false
+		}
+		fmt.Printf("%s/%s is now in policy %s\n", m.account, m.container, policyName(policies, s.target))
+		return true
+	}
+	if flags.Arg(2) != "" {
+		p := policies.NameLookup(flags.Arg(2))
+		if p == nil {
+			fmt.Fprintf(os.Stderr, "Unknown policy named %q\n", flags.Arg(2))
+			return false
+		}
+		if s.target >= 0 && s.target != p.Index {
+			fmt.Fprintf(os.Stderr, "%s/%s is already being migrated to policy %s\n", m.account, m.container, policyName(policies, s.target))
+			return false
+		}
+		if s.target < 0 {
+			if p.Index == s.policy {
+				fmt.Fprintf(os.Stderr, "%s/%s is already in policy %s\n", m.account, m.container, policyName(policies, s.policy))
+				return false
+			}
+			if err := m.start(ctx, p.Index); err != nil {
+				fmt.Fprintln(os.Stderr, "Unable to start the migration:", err)
+				return false
+			}
+			s.target = p.Index
+		}
+	} else if s.target < 0 {
+		fmt.Fprintf(os.Stderr, "%s/%s isn't being migrated; give the policy to move it to\n", m.account, m.container)
+		return false
+	}
+	failed, err := m.move(ctx, s, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to move objects:", err)
+		return false
+	}
+	fmt.Printf("%d objects moved to policy %s, %d failed\n", s.moved, policyName(policies, s.target), failed)
+	return failed == 0
+}
@@ -0,0 +1,161 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/client"
+	"github.com/troubling/nectar/nectarutil"
+)
+
+// testMigrationClient keeps a container's objects by policy and its
+// metadata, and answers just the requests the policy migrator makes.
+type testMigrationClient struct {
+	client.RequestClient
+	policy   int
+	metadata map[string]string
+	objects  map[int]map[string]string
+}
+
+func (c *testMigrationClient) HeadContainer(ctx context.Context, account string, container string, headers http.Header) *http.Response {
+	resp := nectarutil.ResponseStub(204, "")
+	resp.Header.Set("X-Backend-Storage-Policy-Index", strconv.Itoa(c.policy))
+	for k, v := range c.metadata {
+		resp.Header.Set(k, v)
+	}
+	resp.Header.Set("X-Container-Object-Count", strconv.Itoa(len(c.objects[0])+len(c.objects[1])))
+	return resp
+}
+
+func (c *testMigrationClient) PostContainer(ctx context.Context, account string, container string, headers http.Header) *http.Response {
+	for k := range headers {
+		if k == "X-Timestamp" {
+			continue
+		} else if k == "X-Backend-Policy-Cutover" {
+			c.policy, _ = strconv.Atoi(headers.Get(k))
+		} else if headers.Get(k) == "" {
+			delete(c.metadata, k)
+		} else {
+			c.metadata[k] = headers.Get(k)
+		}
+	}
+	return nectarutil.ResponseStub(204, "")
+}
+
+func (c *testMigrationClient) GetContainerInfo(ctx context.Context, account string, container string) (*client.ContainerInfo, error) {
+	return &client.ContainerInfo{StoragePolicyIndex: c.policy, SysMetadata: map[string]string{"Policy-Migration": c.metadata[policyMigrationHeader]}}, nil
+}
+
+func (c *testMigrationClient) GetContainerRaw(ctx context.Context, account string, container string, options map[string]string, headers http.Header) *http.Response {
+	policy, _ := strconv.Atoi(headers.Get("X-Backend-Storage-Policy-Index"))
+	limit, _ := strconv.Atoi(options["limit"])
+	names := []string{}
+	for name := range c.objects[policy] {
+		if name > options["marker"] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if len(names) > limit {
+		names = names[:limit]
+	}
+	listing := []map[string]string{}
+	for _, name := range names {
+		listing = append(listing, map[string]string{"name": name})
+	}
+	body, _ := json.Marshal(listing)
+	return nectarutil.ResponseStub(200, string(body))
+}
+
+func (c *testMigrationClient) GetObject(ctx context.Context, account string, container string, obj string, headers http.Header) *http.Response {
+	policy, _ := strconv.Atoi(headers.Get("X-Backend-Storage-Policy-Index"))
+	body, ok := c.objects[policy][obj]
+	if !ok {
+		return nectarutil.ResponseStub(404, "")
+	}
+	resp := nectarutil.ResponseStub(200, body)
+	resp.Header.Set("X-Timestamp", "1500000000.00000")
+	resp.Header.Set("X-Object-Meta-Color", "blue")
+	resp.Header.Set("Last-Modified", "yesterday")
+	return resp
+}
+
+func (c *testMigrationClient) PutObject(ctx context.Context, account string, container string, obj string, headers http.Header, src io.Reader) *http.Response {
+	if headers.Get("X-Timestamp") != "1500000000.00000" || headers.Get("X-Object-Meta-Color") != "blue" || headers.Get("Last-Modified") != "" {
+		return nectarutil.ResponseStub(400, "")
+	}
+	if obj == "bad" {
+		return nectarutil.ResponseStub(503, "")
+	}
+	policy, _ := strconv.Atoi(headers.Get("X-Backend-Storage-Policy-Index"))
+	body, _ := ioutil.ReadAll(src)
+	c.objects[policy][obj] = string(body)
+	return nectarutil.ResponseStub(201, "")
+}
+
+func (c *testMigrationClient) DeleteObject(ctx context.Context, account string, container string, obj string, headers http.Header) *http.Response {
+	policy, _ := strconv.Atoi(headers.Get("X-Backend-Storage-Policy-Index"))
+	delete(c.objects[policy], obj)
+	return nectarutil.ResponseStub(204, "")
+}
+
+func TestPolicyMigrator(t *testing.T) {
+	c := &testMigrationClient{metadata: map[string]string{}, objects: map[int]map[string]string{
+		0: {"o1": "one", "o2": "two", "o3": "three", "bad": "four"},
+		1: {},
+	}}
+	// The third replica is down until it's let in.
+	replicaUp := false
+	m := &policyMigrator{c: c, account: "a", container: "c", pageSize: 2, replicaPolicies: func(ctx context.Context) []int {
+		if replicaUp {
+			return []int{c.policy, c.policy, c.policy}
+		}
+		return []int{c.policy, c.policy, -1}
+	}}
+	ctx := context.Background()
+	s, err := m.status(ctx)
+	require.Nil(t, err)
+	require.Equal(t, -1, s.target)
+
+	require.Nil(t, m.start(ctx, 1))
+	s, err = m.status(ctx)
+	require.Nil(t, err)
+	require.Equal(t, 0, s.policy)
+	require.Equal(t, 1, s.target)
+
+	out := &bytes.Buffer{}
+	failed, err := m.move(ctx, s, out)
+	require.Nil(t, err)
+	require.Equal(t, 1, failed)
+	require.Contains(t, out.String(), "Unable to move bad: PUT gave status 503")
+	require.Equal(t, map[string]string{"o1": "one", "o2": "two", "o3": "three"}, c.objects[1])
+	require.Equal(t, map[string]string{"bad": "four"}, c.objects[0])
+	require.Equal(t, "3", c.metadata[policyMigrationMovedHeader])
+
+	// The cutover waits until every object is moved.
+	require.NotNil(t, m.cutover(ctx, s))
+	require.Equal(t, 0, c.policy)
+	delete(c.objects[0], "bad")
+	// The migration stays open until every replica is in the new policy.
+	require.NotNil(t, m.cutover(ctx, s))
+	require.Equal(t, 1, c.policy)
+	require.Equal(t, "1", c.metadata[policyMigrationHeader])
+	s, err = m.status(ctx)
+	require.Nil(t, err)
+	require.Equal(t, 1, s.policy)
+	require.Equal(t, 1, s.target)
+	replicaUp = true
+	require.Nil(t, m.cutover(ctx, s))
+	require.Equal(t, map[string]string{}, c.metadata)
+	s, err = m.status(ctx)
+	require.Nil(t, err)
+	require.Equal(t, -1, s.target)
+}
@@ -0,0 +1,365 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/troubling/hummingbird/client/direct"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/srv"
+)
+
+// quarantinedItem is an item quarantined on one of the cluster's devices.
+type quarantinedItem struct {
+	Scheme string
+	Ip     string
+	Port   int
+	Device string
+	// Type is accounts, containers, objects or objects-<policy index>.
+	Type         string
+	NameOnDevice string
+	NameInURL    string
+	Time         time.Time
+}
+
+// id names the item the way the quarantine command's arguments do.
+func (q *quarantinedItem) id() string {
+	return fmt.Sprintf("%s:%d/%s/%s/%s", q.Ip, q.Port, q.Device, q.Type, q.NameOnDevice)
+}
+
+func (q *quarantinedItem) device() *ring.Device {
+	return &ring.Device{Scheme: q.Scheme, Ip: q.Ip, Port: q.Port, Device: q.Device}
+}
+
+// quarantineRing returns the ring the recon type's items belong to, and for
+// objects the index of their policy.
+func quarantineRing(reconType string) (ring.Ring, int, error) {
+	prefix, suffix := getAffixes()
+	switch {
+	case reconType == "accounts":
+		r, err := ring.GetRing("account", prefix, suffix, 0)
+		return r, 0, err
+	case reconType == "containers":
+		r, err := ring.GetRing("container", prefix, suffix, 0)
+		return r, 0, err
+	case reconType == "objects":
+		r, err := ring.GetRing("object", prefix, suffix, 0)
+		return r, 0, err
+	case strings.HasPrefix(reconType, "objects-"):
+		if policy, err := strconv.Atoi(reconType[len("objects-"):]); err == nil {
+			r, err := ring.GetRing("object", prefix, suffix, policy)
+			return r, policy, err
+		}
+	}
+	return nil, 0, fmt.Errorf("unknown type %q", reconType)
+}
+
+func quarantineReconTypes(policies conf.PolicyList) []string {
+	reconTypes := []string{"accounts", "containers"}
+	for _, policy := range policies {
+		if policy.Index == 0 {
+			reconTypes = append(reconTypes, "objects")
+		} else {
+			reconTypes = append(reconTypes, fmt.Sprintf("objects-%d", policy.Index))
+		}
+	}
+	return reconTypes
+}
+
+// listQuarantined asks the servers in the rings what's quarantined on their
+// devices. Each type of item is only taken from the servers in its own
+// ring, so servers sharing devices don't list them twice.
+func listQuarantined(client common.HTTPClient, reconTypes []string, getRing func(string) (ring.Ring, int, error)) ([]*quarantinedItem, []string) {
+	var items []*quarantinedItem
+	var errors []string
+	details := map[string]map[string]map[string][]*quarantineDetailItem{}
+	for _, reconType := range reconTypes {
+		r, _, err := getRing(reconType)
+		if err != nil {
+			errors = append(errors, err.Error())
+			continue
+		}
+		listed := map[string]bool{}
+		for _, dev := range r.AllDevices() {
+			id := serverId(dev.Ip, dev.Port)
+			if !dev.Active() || listed[id] {
+				continue
+			}
+			listed[id] = true
+			detail, ok := details[id]
+			if !ok {
+				data, err := queryHostRecon(client, &ipPort{ip: dev.Ip, port: dev.Port, scheme: dev.Scheme}, "quarantineddetail")
+				if err == nil {
+					err = json.Unmarshal(data, &detail)
+				}
+				if err != nil {
+					errors = append(errors, fmt.Sprintf("%s: %s", id, err))
+				}
+				// Kept even if nil, so a server that failed isn't asked again.
+				details[id] = detail
+			}
+			for device, entries := range detail[reconType] {
+				for _, entry := range entries {
+					items = append(items, &quarantinedItem{
+						Scheme:       dev.Scheme,
+						Ip:           dev.Ip,
+						Port:         dev.Port,
+						Device:       device,
+						Type:         reconType,
+						NameOnDevice: entry.NameOnDevice,
+						NameInURL:    entry.NameInURL,
+						Time:         entry.Time,
+					})
+				}
+			}
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if !items[i].Time.Equal(items[j].Time) {
+			return items[i].Time.Before(items[j].Time)
+		}
+		return items[i].id() < items[j].id()
+	})
+	return items, errors
+}
+
+// parseQuarantinedItem reads an item named ip:port/device/type/name, as
+// listed, checking the device is in the type's ring.
+func parseQuarantinedItem(arg string, getRing func(string) (ring.Ring, int, error)) (*quarantinedItem, ring.Ring, int, error) {
+	parts := strings.SplitN(arg, "/", 4)
+	if len(parts) != 4 || parts[1] == "" || parts[2] == "" || parts[3] == "" {
+		return nil, nil, 0, fmt.Errorf("expected an item like ip:port/device/type/name, as list shows them, not %q", arg)
+	}
+	host, portStr, err := net.SplitHostPort(parts[0])
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("invalid port in %q", arg)
+	}
+	r, policy, err := getRing(parts[2])
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	for _, dev := range r.AllDevices() {
+		if dev.Active() && dev.Ip == host && dev.Port == port && dev.Device == parts[1] {
+			item := &quarantinedItem{Scheme: dev.Scheme, Ip: host, Port: port, Device: dev.Device, Type: parts[2], NameOnDevice: parts[3]}
+			return item, r, policy, nil
+		}
+	}
+	return nil, nil, 0, fmt.Errorf("%s/%s isn't in the ring for %s", parts[0], parts[1], parts[2])
+}
+
+// copyQuarantined puts the quarantined copy of an object on dev, with the
+// timestamp and metadata it was stored with. The Etag goes with it, so the
+// receiving server rejects it if it isn't intact.
+func copyQuarantined(ctx context.Context, c *direct.Client, headers http.Header, item *quarantinedItem, dev *ring.Device, partition uint64, policy int, account, container, object string) error {
+	resp, err := c.GetQuarantined(ctx, item.device(), item.Type, item.NameOnDevice, headers)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("X-Timestamp") == "" {
+		return fmt.Errorf("the quarantined copy has no X-Timestamp")
+	}
+	putHeaders := http.Header{}
+	for k, v := range resp.Header {
+		if !repairSkippedHeaders[k] && !strings.HasPrefix(k, "X-Backend-") {
+			putHeaders[k] = v
+		}
+	}
+	putHeaders.Set("X-Timestamp", resp.Header.Get("X-Timestamp"))
+	putHeaders.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	_, err = c.PutObject(ctx, dev, partition, policy, account, container, object, putHeaders, resp.Body)
+	return err
+}
+
+// restoreQuarantined puts a quarantined item back. An object is copied to
+// its primaries and then moved to the quarantine history; a database is
+// moved back into its partition on the device it was quarantined on. It
+// returns what it did.
+func restoreQuarantined(ctx context.Context, c *direct.Client, headers http.Header, item *quarantinedItem, r ring.Ring, policy *conf.Policy) ([]string, error) {
+	var log []string
+	if item.Type == "accounts" || item.Type == "containers" {
+		hash := strings.SplitN(item.NameOnDevice, "-", 2)[0]
+		if len(hash) != 32 {
+			return log, fmt.Errorf("couldn't get the hash from %q", item.NameOnDevice)
+		}
+		partition, err := r.PartitionForHash(hash)
+		if err != nil {
+			return log, err
+		}
+		if err = c.RestoreQuarantined(ctx, item.device(), item.Type, item.NameOnDevice, partition, headers); err != nil {
+			return log, err
+		}
+		return append(log, fmt.Sprintf("Moved it back into partition %d on %s; replication will bring it up to date", partition, deviceId(item.Ip, item.Port, item.Device))), nil
+	}
+	if policy != nil && policy.Type == "hec" {
+		return log, fmt.Errorf("policy %s is erasure coded; andrewd's quarantine repair reconstructs its fragments instead", policy.Name)
+	}
+	resp, err := c.GetQuarantined(ctx, item.device(), item.Type, item.NameOnDevice, headers)
+	if err != nil {
+		return log, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	account, container, object := parseItemURL(resp.Header.Get("X-Backend-Quarantined-Name"))
+	if object == "" {
+		return log, fmt.Errorf("couldn't tell which object it is from %q", resp.Header.Get("X-Backend-Quarantined-Name"))
+	}
+	policyIndex := 0
+	if policy != nil {
+		policyIndex = policy.Index
+	}
+	partition, primaries := direct.ObjectNodes(r, account, container, object)
+	ok := true
+	for _, dev := range primaries {
+		id := deviceId(dev.Ip, dev.Port, dev.Device)
+		err := copyQuarantined(ctx, c, headers, item, dev, partition, policyIndex, account, container, object)
+		if se, isStatus := err.(*direct.StatusError); isStatus && se.StatusCode == http.StatusConflict {
+			log = append(log, fmt.Sprintf("%s already has it or a newer version", id))
+		} else if err != nil {
+			log = append(log, fmt.Sprintf("Couldn't put it on %s: %v", id, err))
+			ok = false
+		} else {
+			log = append(log, fmt.Sprintf("Put it on %s", id))
+		}
+	}
+	if !ok {
+		return log, fmt.Errorf("not all the primaries have it, so it was left in quarantine")
+	}
+	if err := c.RemoveQuarantined(ctx, item.device(), item.Type, item.NameOnDevice, headers); err != nil {
+		return log, err
+	}
+	return append(log, "Moved the quarantined copy to the quarantine history"), nil
+}
+
+// downloadQuarantined saves a quarantined item to outFile, returning the
+// metadata it was stored with.
+func downloadQuarantined(ctx context.Context, c *direct.Client, headers http.Header, item *quarantinedItem, outFile string) (http.Header, int64, error) {
+	resp, err := c.GetQuarantined(ctx, item.device(), item.Type, item.NameOnDevice, headers)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	f, err := os.Create(outFile)
+	if err != nil {
+		return nil, 0, err
+	}
+	n, err := io.Copy(f, resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return resp.Header, n, err
+}
+
+func printQuarantined(items []*quarantinedItem, errors []string) {
+	for _, item := range items {
+		name := item.NameInURL
+		if name == "" {
+			name = "(name unknown)"
+		}
+		fmt.Printf("%s %s %s\n", item.Time.Format("2006-01-02 15:04:05"), item.id(), name)
+	}
+	fmt.Printf("\n%d quarantined item[s]. Servers only list the first 100 on each device.\n", len(items))
+	fmt.Println("Why an item was quarantined is in the logs of the server that did it, from around its time.")
+	for _, e := range errors {
+		fmt.Printf("!! %s\n", e)
+	}
+}
+
+// Quarantine lists what's quarantined across the cluster, downloads items
+// for inspection, and restores or purges them.
+func Quarantine(flags *flag.FlagSet, cnf srv.ConfigLoader) bool {
+	policies, err := cnf.GetPolicies()
+	if err != nil {
+		fmt.Println("Unable to load policies:", err)
+		return false
+	}
+	c := newInfoClient(flags)
+	headers := http.Header{}
+	if token := flags.Lookup("token").Value.(flag.Getter).Get().(string); token != "" {
+		headers.Set("X-Admin-Token", token)
+	}
+	ctx := context.Background()
+	cmd := flags.Arg(0)
+	if cmd == "list" {
+		items, errors := listQuarantined(c.HTTPClient, quarantineReconTypes(policies), quarantineRing)
+		if flags.Lookup("json").Value.(flag.Getter).Get().(bool) {
+			data, err := json.MarshalIndent(map[string]interface{}{"Items": items, "Errors": errors}, "", "    ")
+			if err != nil {
+				fmt.Println(err)
+				return false
+			}
+			fmt.Println(string(data))
+		} else {
+			printQuarantined(items, errors)
+		}
+		return len(errors) == 0
+	}
+	if cmd != "get" && cmd != "restore" && cmd != "purge" {
+		flags.Usage()
+		return false
+	}
+	item, r, policyIndex, err := parseQuarantinedItem(flags.Arg(1), quarantineRing)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	switch cmd {
+	case "get":
+		outFile := flags.Lookup("o").Value.(flag.Getter).Get().(string)
+		if outFile == "" {
+			outFile = item.NameOnDevice
+			if item.Type == "accounts" || item.Type == "containers" {
+				outFile += ".db"
+			}
+		}
+		header, n, err := downloadQuarantined(ctx, c, headers, item, outFile)
+		if err != nil {
+			fmt.Println(err)
+			return false
+		}
+		var keys []string
+		for k := range header {
+			if !ignoredInfoHeaders[k] {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Printf("%s: %s\n", k, header.Get(k))
+		}
+		fmt.Printf("\nWrote %d bytes to %s\n", n, outFile)
+	case "restore":
+		log, err := restoreQuarantined(ctx, c, headers, item, r, policies[policyIndex])
+		for _, line := range log {
+			fmt.Println(line)
+		}
+		if err != nil {
+			fmt.Printf("!! %s\n", err)
+			return false
+		}
+	case "purge":
+		if err := c.RemoveQuarantined(ctx, item.device(), item.Type, item.NameOnDevice, headers); err != nil {
+			fmt.Println(err)
+			return false
+		}
+		fmt.Printf("Moved %s to the quarantine history, which andrewd purges after a while\n", item.id())
+	}
+	return true
+}
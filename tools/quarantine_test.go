@@ -0,0 +1,155 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/client/direct"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/ring"
+)
+
+func testServerDevice(t *testing.T, ts *httptest.Server, device string) *ring.Device {
+	host, portStr, err := net.SplitHostPort(strings.TrimPrefix(ts.URL, "http://"))
+	require.Nil(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.Nil(t, err)
+	return &ring.Device{Scheme: "http", Ip: host, Port: port, Device: device}
+}
+
+func TestListQuarantined(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/recon/quarantineddetail", r.URL.Path)
+		requests++
+		w.Write([]byte(`{
+			"accounts": {"sda": [{"NameOnDevice": "a-1", "NameInURL": "/AUTH_test", "Time": "2018-01-02T00:00:00Z"}]},
+			"objects-1": {"sdb": [{"NameOnDevice": "o-1", "NameInURL": "/AUTH_test/c/o", "Time": "2018-01-01T00:00:00Z"}]},
+			"objects-2": {"sdb": [{"NameOnDevice": "o-2", "Time": "2018-01-03T00:00:00Z"}]}
+		}`))
+	}))
+	defer ts.Close()
+	dev := testServerDevice(t, ts, "sda")
+	down := &ring.Device{Scheme: "http", Ip: "127.0.0.1", Port: 1, Device: "sdz"}
+	getRing := func(reconType string) (ring.Ring, int, error) {
+		switch reconType {
+		case "accounts", "objects-1":
+			return &FakeRing{Devs: []*ring.Device{dev, dev, down}}, 1, nil
+		case "containers":
+			return &FakeRing{Devs: []*ring.Device{dev}}, 0, nil
+		}
+		return nil, 0, fmt.Errorf("no ring for %s", reconType)
+	}
+	items, errors := listQuarantined(http.DefaultClient, []string{"accounts", "containers", "objects-1", "objects-3"}, getRing)
+	require.Equal(t, 1, requests)
+	require.Equal(t, 2, len(errors))
+	require.True(t, strings.HasPrefix(errors[0], "127.0.0.1:1: "))
+	require.Equal(t, "no ring for objects-3", errors[1])
+	require.Equal(t, 2, len(items))
+	node := fmt.Sprintf("%s:%d", dev.Ip, dev.Port)
+	require.Equal(t, node+"/sdb/objects-1/o-1", items[0].id())
+	require.Equal(t, "/AUTH_test/c/o", items[0].NameInURL)
+	require.Equal(t, node+"/sda/accounts/a-1", items[1].id())
+	require.True(t, items[1].Time.Equal(time.Date(2018, 1, 2, 0, 0, 0, 0, time.UTC)))
+
+	item, _, policy, err := parseQuarantinedItem(node+"/sda/objects-1/o-1", getRing)
+	require.Nil(t, err)
+	require.Equal(t, 1, policy)
+	require.Equal(t, &quarantinedItem{Scheme: "http", Ip: dev.Ip, Port: dev.Port, Device: "sda", Type: "objects-1", NameOnDevice: "o-1"}, item)
+	_, _, _, err = parseQuarantinedItem(node+"/sdc/objects-1/o-1", getRing)
+	require.NotNil(t, err)
+	_, _, _, err = parseQuarantinedItem(node+"/sda/objects-1", getRing)
+	require.NotNil(t, err)
+}
+
+func TestRestoreQuarantinedObject(t *testing.T) {
+	var lock sync.Mutex
+	puts := map[string]string{}
+	removed := false
+	sdcStatus := http.StatusConflict
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/recon/sda/quarantined/objects-1/item":
+			require.Equal(t, "s3cr3t", r.Header.Get("X-Admin-Token"))
+			w.Header().Set("X-Backend-Quarantined-Name", "/a/c/o")
+			w.Header().Set("X-Timestamp", "1500000000.00000")
+			w.Header().Set("Etag", "abc")
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("quarantined data"))
+		case r.Method == "PUT" && r.URL.Path == "/sdb/0/a/c/o":
+			require.Equal(t, "1500000000.00000", r.Header.Get("X-Timestamp"))
+			require.Equal(t, "abc", r.Header.Get("Etag"))
+			require.Equal(t, "1", r.Header.Get("X-Backend-Storage-Policy-Index"))
+			require.Equal(t, "", r.Header.Get("X-Admin-Token"))
+			body, err := ioutil.ReadAll(r.Body)
+			require.Nil(t, err)
+			puts["sdb"] = string(body)
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == "PUT" && r.URL.Path == "/sdc/0/a/c/o":
+			w.WriteHeader(sdcStatus)
+		case r.Method == "DELETE" && r.URL.Path == "/recon/sda/quarantined/objects-1/item":
+			removed = true
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+	dev := testServerDevice(t, ts, "sda")
+	item := &quarantinedItem{Scheme: "http", Ip: dev.Ip, Port: dev.Port, Device: "sda", Type: "objects-1", NameOnDevice: "item"}
+	primaries := []*ring.Device{testServerDevice(t, ts, "sdb"), testServerDevice(t, ts, "sdc")}
+	c := &direct.Client{HTTPClient: http.DefaultClient}
+	headers := http.Header{"X-Admin-Token": {"s3cr3t"}}
+	policy := &conf.Policy{Index: 1, Name: "gold", Type: "replication"}
+
+	sdcStatus = http.StatusInsufficientStorage
+	log, err := restoreQuarantined(context.Background(), c, headers, item, &FakeRing{Devs: primaries, nodeCalls: 1}, policy)
+	require.NotNil(t, err)
+	require.Equal(t, 2, len(log))
+	require.True(t, strings.HasPrefix(log[1], "Couldn't put it on "))
+	require.False(t, removed)
+
+	sdcStatus = http.StatusConflict
+	log, err = restoreQuarantined(context.Background(), c, headers, item, &FakeRing{Devs: primaries, nodeCalls: 1}, policy)
+	require.Nil(t, err)
+	require.Equal(t, []string{
+		"Put it on " + deviceId(dev.Ip, dev.Port, "sdb"),
+		deviceId(dev.Ip, dev.Port, "sdc") + " already has it or a newer version",
+		"Moved the quarantined copy to the quarantine history",
+	}, log)
+	require.Equal(t, "quarantined data", puts["sdb"])
+	require.True(t, removed)
+
+	_, err = restoreQuarantined(context.Background(), c, headers, item, &FakeRing{Devs: primaries, nodeCalls: 1}, &conf.Policy{Index: 1, Name: "ec", Type: "hec"})
+	require.NotNil(t, err)
+}
+
+func TestRestoreQuarantinedDB(t *testing.T) {
+	hash := "ff2d04f90fe4099ce8ecc514bbf514b2"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "PUT", r.Method)
+		require.Equal(t, "/recon/sda/quarantined/containers/"+hash+"-1", r.URL.Path)
+		require.Equal(t, "0", r.URL.Query().Get("partition"))
+		w.Write([]byte(`{"message": "restore complete"}`))
+	}))
+	defer ts.Close()
+	dev := testServerDevice(t, ts, "sda")
+	item := &quarantinedItem{Scheme: "http", Ip: dev.Ip, Port: dev.Port, Device: "sda", Type: "containers", NameOnDevice: hash + "-1"}
+	c := &direct.Client{HTTPClient: http.DefaultClient}
+	log, err := restoreQuarantined(context.Background(), c, nil, item, &FakeRing{}, nil)
+	require.Nil(t, err)
+	require.Equal(t, []string{"Moved it back into partition 0 on " + deviceId(dev.Ip, dev.Port, "sda") + "; replication will bring it up to date"}, log)
+}
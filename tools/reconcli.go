@@ -779,6 +779,7 @@ func (r *quarantineDetailReport) String() string {
 type quarantineDetailItem struct {
 	NameOnDevice string
 	NameInURL    string
+	Time         time.Time
 }
 
 func getQuarantineDetailReport(client common.HTTPClient, servers []*ipPort) *quarantineDetailReport {
@@ -1406,6 +1407,60 @@ func getRingActionReport(flags *flag.FlagSet) *ringActionReport {
 	return report
 }
 
+type workItemReport struct {
+	Name      string
+	Time      time.Time
+	Pass      bool
+	Errors    []string
+	WorkItems []*workItem
+}
+
+func (r *workItemReport) Passed() bool {
+	return r.Pass
+}
+
+func (r *workItemReport) String() string {
+	s := fmt.Sprintf(
+		"[%s] %s\n",
+		r.Time.Format("2006-01-02 15:04:05"),
+		r.Name,
+	)
+	for _, e := range r.Errors {
+		s += fmt.Sprintf("!! %s\n", e)
+	}
+	if len(r.WorkItems) == 0 && len(r.Errors) == 0 {
+		s += "No open work items\n"
+	}
+	for _, item := range r.WorkItems {
+		s += fmt.Sprintf("!! #%d %s %s %s: %s\n", item.ID, item.Created.Format("2006-01-02 15:04"), item.Kind, deviceId(item.Ip, item.Port, item.Device), item.Detail)
+	}
+	return s
+}
+
+// getWorkItemReport lists andrewd's open work items, passing only if there
+// are none.
+func getWorkItemReport(flags *flag.FlagSet) *workItemReport {
+	report := &workItemReport{
+		Name: "Work Item Report",
+		Time: time.Now().UTC(),
+	}
+	serverconf, err := getAndrewdConf(flags)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+		return report
+	}
+	db, err := newDB(serverconf, "")
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+		return report
+	}
+	if report.WorkItems, err = db.workItems(false); err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	report.Pass = len(report.Errors) == 0 && len(report.WorkItems) == 0
+	return report
+}
+
 type ringBalanceReport struct {
 	Name             string
 	Time             time.Time
@@ -1508,27 +1563,35 @@ func getAndrewdConf(flags *flag.FlagSet) (*conf.Config, error) {
 	}
 }
 
-func ReconClient(flags *flag.FlagSet, cnf srv.ConfigLoader) bool {
+// newReconHTTPClient returns a client for querying servers' recon
+// endpoints, using the cert and key files given, if any, for https.
+func newReconHTTPClient(certFile, keyFile string) (*http.Client, error) {
 	transport := &http.Transport{
 		MaxIdleConnsPerHost: 100,
 		MaxIdleConns:        0,
 	}
-	certFile := flags.Lookup("certfile").Value.(flag.Getter).Get().(string)
-	keyFile := flags.Lookup("keyfile").Value.(flag.Getter).Get().(string)
 	if certFile != "" && keyFile != "" {
 		tlsConf, err := common.NewClientTLSConfig(certFile, keyFile)
 		if err != nil {
-			fmt.Printf("Error getting TLS config: %v\n", err)
-			return false
+			return nil, fmt.Errorf("Error getting TLS config: %v", err)
 		}
 		transport.TLSClientConfig = tlsConf
 		if err = http2.ConfigureTransport(transport); err != nil {
-			fmt.Printf("Error setting up http2: %v\n", err)
-			return false
+			return nil, fmt.Errorf("Error setting up http2: %v", err)
 		}
 	}
 	// TODO: Do we want to trace requests from this client?
-	client := &http.Client{Timeout: 10 * time.Second, Transport: transport}
+	return &http.Client{Timeout: 10 * time.Second, Transport: transport}, nil
+}
+
+func ReconClient(flags *flag.FlagSet, cnf srv.ConfigLoader) bool {
+	certFile := flags.Lookup("certfile").Value.(flag.Getter).Get().(string)
+	keyFile := flags.Lookup("keyfile").Value.(flag.Getter).Get().(string)
+	client, err := newReconHTTPClient(certFile, keyFile)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
 	var reports []passable
 	if flags.Lookup("progress").Value.(flag.Getter).Get().(bool) {
 		reports = append(reports, getProgressReport(flags))
@@ -1559,6 +1622,16 @@ func ReconClient(flags *flag.FlagSet, cnf srv.ConfigLoader) bool {
 	if flags.Lookup("rc").Value.(flag.Getter).Get().(bool) {
 		reports = append(reports, getReplicationCanceledReport(client, nil))
 	}
+	lagLimit := flags.Lookup("lag-limit").Value.(flag.Getter).Get().(time.Duration)
+	if flags.Lookup("rl").Value.(flag.Getter).Get().(bool) {
+		reports = append(reports, getReplicationLagReport(client, nil, lagLimit))
+	}
+	if flags.Lookup("au").Value.(flag.Getter).Get().(bool) {
+		reports = append(reports, getAuditorReport(client, nil))
+	}
+	if flags.Lookup("health").Value.(flag.Getter).Get().(bool) {
+		reports = append(reports, getHealthReport(client, lagLimit))
+	}
 	if flags.Lookup("d").Value.(flag.Getter).Get().(bool) {
 		reports = append(reports, getDispersionReport(flags))
 	}
@@ -1571,6 +1644,12 @@ func ReconClient(flags *flag.FlagSet, cnf srv.ConfigLoader) bool {
 	if flags.Lookup("rbr").Value.(flag.Getter).Get().(bool) {
 		reports = append(reports, getRingBalanceReport(flags))
 	}
+	if flags.Lookup("wi").Value.(flag.Getter).Get().(bool) {
+		reports = append(reports, getWorkItemReport(flags))
+	}
+	if flags.Lookup("topo").Value.(flag.Getter).Get().(bool) {
+		reports = append(reports, getTopologyReport(client, nil))
+	}
 	if len(reports) == 0 {
 		flags.Usage()
 	}
@@ -376,3 +376,57 @@ func TestReconReportAsync(t *testing.T) {
 	out := report.String()
 	require.True(t, strings.Contains(out, "[async_pending] low: 50, high: 100, avg: 75.0, total: 150, Failed: 0.0%, no_result: 0, reported: 2"))
 }
+
+func TestReconReportAuditor(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/recon/auditor/object", r.URL.Path)
+		io.WriteString(w, `{"object_auditor_stats_ALL": {"passes": 10, "quarantined": 2, "errors": 1,
+			"indexdb_progress": {"sda": {"percent_complete": 40.0}, "sdb": {"percent_complete": 60.0}}},
+			"object_auditor_stats_ZBF": {"passes": 99}}`)
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	host, ports, _ := net.SplitHostPort(u.Host)
+	port, _ := strconv.Atoi(ports)
+
+	servers := []*ipPort{{ip: host, port: port, scheme: "http"}}
+	report := getAuditorReport(&http.Client{Timeout: 10 * time.Second}, servers)
+	require.True(t, report.Passed())
+	out := report.String()
+	require.True(t, strings.Contains(out, "[object_auditor_passes] low: 10, high: 10"))
+	require.True(t, strings.Contains(out, "[object_auditor_quarantined] low: 2, high: 2"))
+	require.True(t, strings.Contains(out, "[object_auditor_percent_complete] low: 50.000, high: 50.000"))
+}
+
+func TestReconReportReplicationLag(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/progress/object-replicator", r.URL.Path)
+		json.NewEncoder(w).Encode(map[string]map[string]interface{}{
+			"sda": {"LastPassFinishDate": now.Add(-time.Hour)},
+			"sdb": {"LastPassFinishDate": now.Add(-30 * time.Hour)},
+			"sdc": {},
+		})
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	host, ports, _ := net.SplitHostPort(u.Host)
+	port, _ := strconv.Atoi(ports)
+
+	servers := []*ipPort{{ip: host, port: port, replicationPort: port, scheme: "http"}}
+	client := &http.Client{Timeout: 10 * time.Second}
+	report := getReplicationLagReport(client, servers, 24*time.Hour)
+	require.False(t, report.Passed())
+	require.Equal(t, 2, len(report.Lagging))
+	require.Equal(t, -1.0, report.Lagging[deviceId(host, port, "sdc")])
+	require.InDelta(t, 30, report.Lagging[deviceId(host, port, "sdb")], 0.1)
+	require.InDelta(t, 30, report.Stats[serverId(host, port)], 0.1)
+	out := report.String()
+	require.True(t, strings.Contains(out, "sdc has never finished a replication pass"))
+	_, lagging := getReplicationLagReport(client, servers, 48*time.Hour).Lagging[deviceId(host, port, "sdb")]
+	require.False(t, lagging)
+}
@@ -0,0 +1,274 @@
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/ring"
+)
+
+// getDistinctObjectServers returns each object server in any of the
+// policies' rings once.
+func getDistinctObjectServers(errors []string) ([]*ipPort, []string) {
+	serversMap := map[string]*ipPort{}
+	prefix, suffix := getAffixes()
+	if policies, err := conf.GetPolicies(); err != nil {
+		errors = append(errors, err.Error())
+	} else {
+		for _, policy := range policies {
+			r, err := ring.GetRing("object", prefix, suffix, policy.Index)
+			if err != nil {
+				errors = append(errors, err.Error())
+				continue
+			}
+			for _, dev := range r.AllDevices() {
+				if dev == nil || dev.Weight < 0 {
+					continue
+				}
+				serversMap[serverId(dev.Ip, dev.Port)] = &ipPort{ip: dev.Ip, port: dev.Port, scheme: dev.Scheme, replicationPort: dev.ReplicationPort}
+			}
+		}
+	}
+	var servers []*ipPort
+	for _, server := range serversMap {
+		servers = append(servers, server)
+	}
+	return servers, errors
+}
+
+type auditorReport struct {
+	Name        string
+	Time        time.Time
+	Pass        bool
+	Servers     int
+	Successes   int
+	Errors      []string
+	Passes      map[string]int
+	Quarantined map[string]int
+	Failures    map[string]int
+	// Progress is how far through its IndexDBs each server's current pass
+	// is, as a percentage averaged over its devices, for the engines that
+	// report it.
+	Progress map[string]float64
+}
+
+func (r *auditorReport) Passed() bool {
+	return r.Pass
+}
+
+func (r *auditorReport) String() string {
+	s := fmt.Sprintf(
+		"[%s] %s\n",
+		r.Time.Format("2006-01-02 15:04:05"),
+		r.Name,
+	)
+	for _, e := range r.Errors {
+		s += fmt.Sprintf("!! %s\n", e)
+	}
+	s += statsLine("object_auditor_passes", r.Passes) + "\n"
+	s += statsLine("object_auditor_quarantined", r.Quarantined) + "\n"
+	s += statsLine("object_auditor_errors", r.Failures) + "\n"
+	if len(r.Progress) > 0 {
+		s += statsLineF("object_auditor_percent_complete", r.Progress) + "\n"
+	}
+	return s
+}
+
+type auditorStats struct {
+	Passes          int                               `json:"passes"`
+	Quarantined     int                               `json:"quarantined"`
+	Errors          int                               `json:"errors"`
+	IndexDBProgress map[string]map[string]interface{} `json:"indexdb_progress"`
+}
+
+func getAuditorReport(client common.HTTPClient, servers []*ipPort) *auditorReport {
+	// servers parameter is for overriding for tests, leave nil normally
+	report := &auditorReport{
+		Name:        "Object Auditor Report",
+		Time:        time.Now().UTC(),
+		Servers:     len(servers),
+		Passes:      map[string]int{},
+		Quarantined: map[string]int{},
+		Failures:    map[string]int{},
+		Progress:    map[string]float64{},
+	}
+	if servers == nil {
+		servers, report.Errors = getDistinctObjectServers(report.Errors)
+		report.Servers = len(servers)
+	}
+	for _, server := range servers {
+		id := serverId(server.ip, server.port)
+		report.Passes[id] = -1
+		report.Quarantined[id] = -1
+		report.Failures[id] = -1
+		rBytes, err := queryHostRecon(client, server, "auditor/object")
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", server, err))
+			continue
+		}
+		var rData map[string]*auditorStats
+		if err := json.Unmarshal(rBytes, &rData); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %s - %q", server, err, string(rBytes)))
+			continue
+		}
+		// The zero byte file auditor only checks files are there, so the
+		// full auditor's numbers are the ones that matter.
+		if stats := rData["object_auditor_stats_ALL"]; stats != nil {
+			report.Passes[id] = stats.Passes
+			report.Quarantined[id] = stats.Quarantined
+			report.Failures[id] = stats.Errors
+			total, count := 0.0, 0
+			for _, p := range stats.IndexDBProgress {
+				if pct, ok := p["percent_complete"].(float64); ok {
+					total += pct
+					count++
+				}
+			}
+			if count > 0 {
+				report.Progress[id] = total / float64(count)
+			}
+		}
+		report.Successes++
+	}
+	report.Pass = report.Successes == report.Servers
+	return report
+}
+
+type replicationLagReport struct {
+	Name      string
+	Time      time.Time
+	Pass      bool
+	Servers   int
+	Successes int
+	Errors    []string
+	Limit     time.Duration
+	// Stats is the hours since the server's longest waiting device last
+	// finished a replication pass.
+	Stats map[string]float64
+	// Lagging are the devices that haven't finished a pass within Limit,
+	// with the hours since they did or -1 if they never have.
+	Lagging map[string]float64
+}
+
+func (r *replicationLagReport) Passed() bool {
+	return r.Pass
+}
+
+func (r *replicationLagReport) String() string {
+	s := fmt.Sprintf(
+		"[%s] %s\n",
+		r.Time.Format("2006-01-02 15:04:05"),
+		r.Name,
+	)
+	for _, e := range r.Errors {
+		s += fmt.Sprintf("!! %s\n", e)
+	}
+	s += statsLineF("replication_lag_hours", r.Stats) + "\n"
+	var devs []string
+	for dev := range r.Lagging {
+		devs = append(devs, dev)
+	}
+	sort.Strings(devs)
+	for _, dev := range devs {
+		if r.Lagging[dev] < 0 {
+			s += fmt.Sprintf("!! %s has never finished a replication pass\n", dev)
+		} else {
+			s += fmt.Sprintf("!! %s last finished a replication pass %.1f hours ago\n", dev, r.Lagging[dev])
+		}
+	}
+	return s
+}
+
+func getReplicationLagReport(client common.HTTPClient, servers []*ipPort, limit time.Duration) *replicationLagReport {
+	// servers parameter is for overriding for tests, leave nil normally
+	report := &replicationLagReport{
+		Name:    "Replication Lag Report",
+		Time:    time.Now().UTC(),
+		Servers: len(servers),
+		Limit:   limit,
+		Stats:   map[string]float64{},
+		Lagging: map[string]float64{},
+	}
+	if servers == nil {
+		servers, report.Errors = getDistinctObjectReplicationServers(report.Errors)
+		report.Servers = len(servers)
+	}
+	for _, server := range servers {
+		data, err := queryHostReplication(client, server)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", server, err))
+			continue
+		}
+		maxLag := 0.0
+		for device, dStats := range data {
+			lag := -1.0
+			if !dStats.LastPassFinishDate.IsZero() {
+				lag = report.Time.Sub(dStats.LastPassFinishDate).Hours()
+				if lag > maxLag {
+					maxLag = lag
+				}
+			}
+			if lag < 0 || lag > limit.Hours() {
+				report.Lagging[deviceId(server.ip, server.replicationPort, device)] = lag
+			}
+		}
+		report.Stats[serverId(server.ip, server.replicationPort)] = maxLag
+		report.Successes++
+	}
+	report.Pass = report.Successes == report.Servers && len(report.Lagging) == 0
+	return report
+}
+
+// healthReport gathers the reports that say whether the cluster is healthy,
+// so they can be run and checked, or output as json, together.
+type healthReport struct {
+	Name    string
+	Time    time.Time
+	Pass    bool
+	Reports []passable
+}
+
+func (r *healthReport) Passed() bool {
+	return r.Pass
+}
+
+func (r *healthReport) String() string {
+	status := "HEALTHY"
+	if !r.Pass {
+		status = "UNHEALTHY"
+	}
+	s := fmt.Sprintf(
+		"[%s] %s: %s\n",
+		r.Time.Format("2006-01-02 15:04:05"),
+		r.Name,
+		status,
+	)
+	for _, report := range r.Reports {
+		s += "\n" + fmt.Sprint(report)
+	}
+	return s
+}
+
+func getHealthReport(client common.HTTPClient, lagLimit time.Duration) *healthReport {
+	report := &healthReport{
+		Name: "Cluster Health Report",
+		Time: time.Now().UTC(),
+		Reports: []passable{
+			getAsyncReport(client),
+			getReplicationLagReport(client, nil, lagLimit),
+			getAuditorReport(client, nil),
+			getQuarantineReport(client, nil),
+			getTimeReport(client, nil),
+			getRingMD5Report(client, nil, nil),
+		},
+	}
+	report.Pass = true
+	for _, r := range report.Reports {
+		report.Pass = report.Pass && r.Passed()
+	}
+	return report
+}
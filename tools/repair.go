@@ -0,0 +1,282 @@
+package tools
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/troubling/hummingbird/client/direct"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/srv"
+)
+
+// Headers from the source's GET that aren't the object's to copy.
+var repairSkippedHeaders = map[string]bool{
+	"Accept-Ranges":     true,
+	"Connection":        true,
+	"Content-Length":    true,
+	"Date":              true,
+	"Last-Modified":     true,
+	"Transfer-Encoding": true,
+	"X-Timestamp":       true,
+	"X-Trans-Id":        true,
+}
+
+// repairNode is what one of an object's nodes has for it.
+type repairNode struct {
+	Device  *ring.Device
+	Handoff bool
+	// Timestamp is the X-Timestamp of the node's copy, or of its tombstone
+	// if Deleted, and empty if it has neither.
+	Timestamp string
+	Deleted   bool
+	Err       error
+}
+
+func (n *repairNode) id() string {
+	return deviceId(n.Device.Ip, n.Device.Port, n.Device.Device)
+}
+
+func (n *repairNode) String() string {
+	switch {
+	case n.Err != nil:
+		return fmt.Sprintf("couldn't be checked: %v", n.Err)
+	case n.Timestamp == "":
+		return "missing"
+	case n.Deleted:
+		return "deleted at " + n.Timestamp
+	}
+	return "has " + n.Timestamp
+}
+
+// version names the copy or tombstone the node has.
+func (n *repairNode) version() string {
+	if n.Deleted {
+		return "the tombstone from " + n.Timestamp
+	}
+	return "the copy from " + n.Timestamp
+}
+
+// timestampBefore reports whether timestamp a is older than b.
+func timestampBefore(a, b string) bool {
+	ta, errA := common.ParseDate(a)
+	tb, errB := common.ParseDate(b)
+	if errA != nil || errB != nil {
+		return a < b
+	}
+	return ta.Before(tb)
+}
+
+// objectRepairer makes an object's nodes agree on its newest version.
+type objectRepairer struct {
+	client    *direct.Client
+	policy    int
+	partition uint64
+	account   string
+	container string
+	object    string
+	hash      string
+	dryRun    bool
+}
+
+// survey asks each of the object's primaries, then handoffs, what it has.
+func (o *objectRepairer) survey(ctx context.Context, primaries, handoffs []*ring.Device) []*repairNode {
+	devs := append(append([]*ring.Device{}, primaries...), handoffs...)
+	nodes := make([]*repairNode, len(devs))
+	byDev := make(map[*ring.Device]*repairNode, len(devs))
+	for i, dev := range devs {
+		nodes[i] = &repairNode{Device: dev, Handoff: i >= len(primaries)}
+		byDev[dev] = nodes[i]
+	}
+	direct.Each(ctx, devs, func(ctx context.Context, dev *ring.Device) error {
+		n := byDev[dev]
+		headers, err := o.client.HeadObject(ctx, dev, o.partition, o.policy, o.account, o.container, o.object, nil)
+		if se, ok := err.(*direct.StatusError); ok && se.StatusCode == http.StatusNotFound {
+			headers, err = se.Header, nil
+			n.Deleted = true
+		}
+		if err != nil {
+			n.Err = err
+			return err
+		}
+		if n.Timestamp = headers.Get("X-Backend-Timestamp"); n.Timestamp == "" {
+			n.Deleted = false
+		}
+		return nil
+	})
+	return nodes
+}
+
+// newestVersion returns the node with the newest copy or tombstone, or nil
+// if none of them have either.
+func newestVersion(nodes []*repairNode) *repairNode {
+	var newest *repairNode
+	for _, n := range nodes {
+		if n.Err == nil && n.Timestamp != "" && (newest == nil || timestampBefore(newest.Timestamp, n.Timestamp)) {
+			newest = n
+		}
+	}
+	return newest
+}
+
+// copyObject streams the object from one device to another, keeping its
+// timestamp and metadata. The Etag goes with it, so the receiving server
+// rejects a copy that isn't intact.
+func (o *objectRepairer) copyObject(ctx context.Context, from, to *ring.Device) error {
+	resp, err := o.client.GetObject(ctx, from, o.partition, o.policy, o.account, o.container, o.object, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	headers := http.Header{}
+	for k, v := range resp.Header {
+		if !repairSkippedHeaders[k] && !strings.HasPrefix(k, "X-Backend-") {
+			headers[k] = v
+		}
+	}
+	headers.Set("X-Timestamp", resp.Header.Get("X-Backend-Timestamp"))
+	_, err = o.client.PutObject(ctx, to, o.partition, o.policy, o.account, o.container, o.object, headers, resp.Body)
+	return err
+}
+
+// pushVersion brings n up to newest: a copy of the object from the first of
+// sources that can send it intact, or the tombstone.
+func (o *objectRepairer) pushVersion(ctx context.Context, n, newest *repairNode, sources []*repairNode) error {
+	if newest.Deleted {
+		err := o.client.DeleteObject(ctx, n.Device, o.partition, o.policy, o.account, o.container, o.object, http.Header{"X-Timestamp": {newest.Timestamp}})
+		// A 404 just means there was nothing there before the tombstone.
+		if direct.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	err := fmt.Errorf("no node has %s intact", newest.Timestamp)
+	for _, src := range sources {
+		if err = o.copyObject(ctx, src.Device, n.Device); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// repair brings the primaries up to the newest version any of the nodes
+// has, then removes the handoffs' copies once all the primaries have it. It
+// returns what it did, and whether all the primaries now have the newest
+// version.
+func (o *objectRepairer) repair(ctx context.Context, nodes []*repairNode) ([]string, bool) {
+	var log []string
+	ok := true
+	for _, n := range nodes {
+		if n.Err != nil && !n.Handoff {
+			ok = false
+		}
+	}
+	newest := newestVersion(nodes)
+	if newest == nil {
+		return append(log, "None of the nodes have the object or a tombstone for it"), ok
+	}
+	var sources []*repairNode
+	for _, n := range nodes {
+		if !n.Deleted && n.Err == nil && n.Timestamp != "" && !timestampBefore(n.Timestamp, newest.Timestamp) {
+			sources = append(sources, n)
+		}
+	}
+	for _, n := range nodes {
+		if n.Handoff || n.Err != nil {
+			continue
+		}
+		if n.Timestamp != "" && !timestampBefore(n.Timestamp, newest.Timestamp) {
+			continue
+		}
+		if o.dryRun {
+			log = append(log, fmt.Sprintf("Would update %s (%s) to %s", n.id(), n, newest.version()))
+			continue
+		}
+		if err := o.pushVersion(ctx, n, newest, sources); err != nil {
+			log = append(log, fmt.Sprintf("Couldn't update %s (%s): %v", n.id(), n, err))
+			ok = false
+		} else {
+			log = append(log, fmt.Sprintf("Updated %s (%s) to %s", n.id(), n, newest.version()))
+		}
+	}
+	for _, n := range nodes {
+		if !n.Handoff || n.Err != nil || n.Timestamp == "" {
+			continue
+		}
+		if !ok {
+			log = append(log, fmt.Sprintf("Left handoff %s (%s) as not all the primaries are up to date", n.id(), n))
+		} else if o.dryRun {
+			log = append(log, fmt.Sprintf("Would remove handoff %s (%s)", n.id(), n))
+		} else if err := o.client.RemoveHandoffObject(ctx, n.Device, o.policy, o.hash, newest.Timestamp); err != nil {
+			// Not every engine can remove a handoff's copy this way, but
+			// the replicator will once it sees the primaries have it.
+			log = append(log, fmt.Sprintf("Left handoff %s (%s) for the replicator: %v", n.id(), n, err))
+		} else {
+			log = append(log, fmt.Sprintf("Removed handoff %s (%s)", n.id(), n))
+		}
+	}
+	return log, ok
+}
+
+// Repair makes an object's nodes agree on its newest version, for after an
+// outage left some of them missing it or with an older one.
+func Repair(flags *flag.FlagSet, cnf srv.ConfigLoader) {
+	account, container, object := parseItemURL(flags.Arg(0))
+	if account == "" || container == "" || object == "" {
+		fmt.Println("Expected an object's path, like AUTH_test/cont/obj")
+		os.Exit(1)
+	}
+	allHandoffs := flags.Lookup("a").Value.(flag.Getter).Get().(bool)
+	policies, err := cnf.GetPolicies()
+	if err != nil {
+		fmt.Println("Unable to load policies:", err)
+		os.Exit(1)
+	}
+	ctx := context.Background()
+	c := newInfoClient(flags)
+	policy := objectPolicy(ctx, flags, c, policies, account, container)
+	if policy.Type == "hec" {
+		fmt.Printf("Policy %s is erasure coded; only replicated objects can be repaired\n", policy.Name)
+		os.Exit(1)
+	}
+	r, _ := getRing("", "object", policy.Index)
+	partition, primaries := direct.ObjectNodes(r, account, container, object)
+	var handoffs []*ring.Device
+	more := r.GetMoreNodes(partition)
+	for dev := more.Next(); dev != nil && (allHandoffs || len(handoffs) < len(primaries)); dev = more.Next() {
+		handoffs = append(handoffs, dev)
+	}
+	o := &objectRepairer{
+		client:    c,
+		policy:    policy.Index,
+		partition: partition,
+		account:   account,
+		container: container,
+		object:    object,
+		hash:      getPathHash(account, container, object),
+		dryRun:    flags.Lookup("n").Value.(flag.Getter).Get().(bool),
+	}
+	printInfoTarget(account, container, object, partition)
+	fmt.Printf("Policy   \t%v (%d)\n\n", policy.Name, policy.Index)
+	nodes := o.survey(ctx, primaries, handoffs)
+	for _, n := range nodes {
+		if n.Handoff {
+			fmt.Printf("%s %s [Handoff]\n", n.id(), n)
+		} else {
+			fmt.Printf("%s %s\n", n.id(), n)
+		}
+	}
+	log, ok := o.repair(ctx, nodes)
+	fmt.Println()
+	for _, line := range log {
+		fmt.Println(line)
+	}
+	if !ok {
+		fmt.Println("!! Not all the primaries have the newest version")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,135 @@
+package tools
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/client/direct"
+	"github.com/troubling/hummingbird/common/ring"
+)
+
+type fakeRepairObject struct {
+	timestamp string
+	deleted   bool
+	body      string
+	etag      string
+	color     string
+}
+
+// fakeRepairServer is an object server holding one object per device.
+type fakeRepairServer struct {
+	lock    sync.Mutex
+	objects map[string]*fakeRepairObject
+}
+
+func (f *fakeRepairServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 3)
+	if parts[0] == "rep-obj" {
+		delete(f.objects, parts[1])
+		w.WriteHeader(204)
+		return
+	}
+	dev := parts[0]
+	obj := f.objects[dev]
+	switch r.Method {
+	case "HEAD", "GET":
+		if obj == nil {
+			w.WriteHeader(404)
+			return
+		}
+		w.Header().Set("X-Backend-Timestamp", obj.timestamp)
+		if obj.deleted {
+			w.WriteHeader(404)
+			return
+		}
+		w.Header().Set("Etag", `"`+obj.etag+`"`)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("X-Object-Meta-Color", obj.color)
+		w.Write([]byte(obj.body))
+	case "PUT":
+		body, _ := ioutil.ReadAll(r.Body)
+		etag := fmt.Sprintf("%x", md5.Sum(body))
+		if expected := strings.Trim(r.Header.Get("Etag"), `"`); expected != etag {
+			w.WriteHeader(422)
+			return
+		}
+		f.objects[dev] = &fakeRepairObject{timestamp: r.Header.Get("X-Timestamp"), body: string(body), etag: etag, color: r.Header.Get("X-Object-Meta-Color")}
+		w.WriteHeader(201)
+	case "DELETE":
+		f.objects[dev] = &fakeRepairObject{timestamp: r.Header.Get("X-Timestamp"), deleted: true}
+		if obj == nil {
+			w.WriteHeader(404)
+		} else {
+			w.WriteHeader(204)
+		}
+	}
+}
+
+func TestRepair(t *testing.T) {
+	etag := func(s string) string { return fmt.Sprintf("%x", md5.Sum([]byte(s))) }
+	f := &fakeRepairServer{objects: map[string]*fakeRepairObject{
+		// sda's copy is damaged, so the repair has to come from the handoff.
+		"sda": {timestamp: "1500000002.00000", body: "damaged", etag: etag("new"), color: "blue"},
+		"sdb": {timestamp: "1500000001.00000", body: "old", etag: etag("old"), color: "red"},
+		"sdd": {timestamp: "1500000002.00000", body: "new", etag: etag("new"), color: "blue"},
+	}}
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.Nil(t, err)
+	var devs []*ring.Device
+	for _, name := range []string{"sda", "sdb", "sdc", "sdd"} {
+		devs = append(devs, &ring.Device{Scheme: "http", Ip: u.Hostname(), Port: port, ReplicationIp: u.Hostname(), ReplicationPort: port, Device: name})
+	}
+	o := &objectRepairer{client: &direct.Client{HTTPClient: http.DefaultClient}, account: "a", container: "c", object: "o", hash: "abc", dryRun: true}
+	ctx := context.Background()
+
+	nodes := o.survey(ctx, devs[:3], devs[3:])
+	require.Equal(t, "has 1500000001.00000", nodes[1].String())
+	require.Equal(t, "missing", nodes[2].String())
+	require.True(t, nodes[3].Handoff)
+	log, ok := o.repair(ctx, nodes)
+	require.True(t, ok)
+	require.Equal(t, 3, len(log))
+	require.Equal(t, "old", f.objects["sdb"].body)
+
+	o.dryRun = false
+	log, ok = o.repair(ctx, o.survey(ctx, devs[:3], devs[3:]))
+	require.True(t, ok, strings.Join(log, "\n"))
+	for _, dev := range []string{"sdb", "sdc"} {
+		require.Equal(t, "new", f.objects[dev].body)
+		require.Equal(t, "1500000002.00000", f.objects[dev].timestamp)
+		require.Equal(t, "blue", f.objects[dev].color)
+	}
+	require.Nil(t, f.objects["sdd"])
+
+	// A newer tombstone wins over the copies.
+	f.objects["sdc"] = &fakeRepairObject{timestamp: "1500000003.00000", deleted: true}
+	log, ok = o.repair(ctx, o.survey(ctx, devs[:3], devs[3:]))
+	require.True(t, ok, strings.Join(log, "\n"))
+	for _, dev := range []string{"sda", "sdb"} {
+		require.True(t, f.objects[dev].deleted)
+		require.Equal(t, "1500000003.00000", f.objects[dev].timestamp)
+	}
+
+	// Without every primary up to date, handoffs are left alone.
+	f.objects["sdd"] = &fakeRepairObject{timestamp: "1500000004.00000", body: "newest", etag: "bad"}
+	log, ok = o.repair(ctx, o.survey(ctx, devs[:3], devs[3:]))
+	require.False(t, ok)
+	require.NotNil(t, f.objects["sdd"])
+	require.True(t, strings.HasPrefix(log[len(log)-1], "Left handoff"))
+}
@@ -21,8 +21,10 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gholt/brimtext"
@@ -107,6 +109,113 @@ func RingBuildCmd(flags *flag.FlagSet) {
 		ring.PretendMinPartHoursPassed(pth)
 		return
 
+	case "check":
+		checkFlags := flag.NewFlagSet("check", flag.ExitOnError)
+		certFile := checkFlags.String("certfile", "", "Cert file to use for setting up https client")
+		keyFile := checkFlags.String("keyfile", "", "Key file to use for setting up https client")
+		if err := checkFlags.Parse(args[2:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		builder, err := ring.NewRingBuilderFromFile(pth, debug)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		ringFile := strings.TrimSuffix(pth, ".builder") + ".ring.gz"
+		r, err := ring.LoadRingMD5(ringFile, "", "")
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		client, err := newReconHTTPClient(*certFile, *keyFile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		report := getRingCheckReport(client, filepath.Base(ringFile), r, r.MD5(), builder)
+		if jsonOut {
+			b, err := json.MarshalIndent(report, "", "    ")
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			fmt.Println(string(b))
+		} else {
+			fmt.Print(report)
+		}
+		if !report.Passed() {
+			os.Exit(1)
+		}
+		return
+
+	case "compose":
+		if len(args) < 3 {
+			flags.Usage()
+			os.Exit(1)
+		}
+		if err := ring.Compose(pth, args[2:]...); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Composed %s from %d component rings\n", pth, len(args)-2)
+		return
+
+	case "set_overload":
+		if len(args) < 3 {
+			flags.Usage()
+			os.Exit(1)
+		}
+		overloadStr := strings.TrimSuffix(args[2], "%")
+		overload, err := strconv.ParseFloat(overloadStr, 64)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if overloadStr != args[2] {
+			overload /= 100
+		}
+		if err := ring.SetOverload(pth, overload); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("The overload factor is now %0.2f%% (%.6f)\n", overload*100, overload)
+		return
+
+	case "set_replicas":
+		if len(args) < 3 {
+			flags.Usage()
+			os.Exit(1)
+		}
+		replicas, err := strconv.ParseFloat(args[2], 64)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if err := ring.SetReplicas(pth, replicas); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("The replica count is now %.6f.\nThe change will take effect after the next rebalance.\n", replicas)
+		return
+
+	case "set_min_part_hours":
+		if len(args) < 3 {
+			flags.Usage()
+			os.Exit(1)
+		}
+		minPartHours, err := strconv.Atoi(args[2])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if err := ring.SetMinPartHours(pth, minPartHours); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("The minimum number of hours before a partition can be reassigned is now set to %d\n", minPartHours)
+		return
+
 	case "search":
 		searchFlags := flag.NewFlagSet("search", flag.ExitOnError)
 		region := searchFlags.Int64("region", -1, "Device region.")
@@ -165,6 +274,9 @@ func RingBuildCmd(flags *flag.FlagSet) {
 		newRepPort := changeFlags.Int64("change-replication-port", -1, "New replication port.")
 		newDevice := changeFlags.String("change-device", "", "New device name.")
 		newMeta := changeFlags.String("change-meta", "", "New meta data.")
+		newDiskType := changeFlags.String("change-disk-type", "", "New disk type, like hdd or ssd.")
+		newCapacity := changeFlags.Int64("change-capacity", -1, "New capacity in bytes.")
+		newLabels := changeFlags.String("change-labels", "", "New failure domain labels, like rack=r1,power=a.")
 		if err := changeFlags.Parse(args[2:]); err != nil {
 			fmt.Println(err)
 			os.Exit(1)
@@ -194,6 +306,9 @@ func RingBuildCmd(flags *flag.FlagSet) {
 				}
 			}
 			err := ring.SetInfo(pth, devs, *newIp, *newPort, *newRepIp, *newRepPort, *newDevice, *newMeta, *newScheme)
+			if err == nil && (*newDiskType != "" || *newCapacity >= 0 || *newLabels != "") {
+				err = ring.SetMetadata(pth, devs, *newDiskType, *newCapacity, *newLabels)
+			}
 			if err != nil {
 				fmt.Println(err)
 			} else {
@@ -429,6 +544,7 @@ func RingBuildCmd(flags *flag.FlagSet) {
 			fmt.Printf("%s, build version %d, %d partitions, %.6f replicas, %d regions, %d zones, %d devices, %.02f balance\n", pth, builder.Version, builder.Parts, builder.Replicas, regions, zones, devCount, balance)
 			fmt.Printf("The minimum number of hours before a partition can be reassigned is %v (%v remaining)\n", builder.MinPartHours, time.Duration(builder.MinPartSecondsLeft())*time.Second)
 			fmt.Printf("The overload factor is %0.2f%% (%.6f)\n", builder.Overload*100, builder.Overload)
+			fmt.Printf("Dispersion is %.06f%% as of the last rebalance\n", builder.GetDispersion())
 
 			// Compare ring file against builder file
 			// TODO: Figure out how to do ring comparisons
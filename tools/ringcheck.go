@@ -0,0 +1,177 @@
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/ring"
+)
+
+// ringCheckReport says whether a ring matches the cluster it's for: that
+// every device in it is reachable and mounted, and that every server has the
+// same copy of it. Given the ring's builder, it also has the balance and
+// dispersion of its last rebalance, and warns of any drift between the two.
+type ringCheckReport struct {
+	Name       string
+	Time       time.Time
+	Pass       bool
+	Errors     []string
+	Warnings   []string
+	Ring       string
+	MD5        string
+	Servers    int
+	Devices    int
+	Balance    float64
+	Dispersion float64
+}
+
+func (r *ringCheckReport) Passed() bool {
+	return r.Pass
+}
+
+func (r *ringCheckReport) String() string {
+	s := fmt.Sprintf(
+		"[%s] %s\n",
+		r.Time.Format("2006-01-02 15:04:05"),
+		r.Name,
+	)
+	for _, e := range r.Errors {
+		s += fmt.Sprintf("!! %s\n", e)
+	}
+	for _, w := range r.Warnings {
+		s += fmt.Sprintf("! %s\n", w)
+	}
+	s += fmt.Sprintf("%s (md5 %s): %d devices checked across %d servers\n", r.Ring, r.MD5, r.Devices, r.Servers)
+	s += fmt.Sprintf("Balance %.02f, dispersion %.02f%%\n", r.Balance, r.Dispersion)
+	return s
+}
+
+// getRingCheckReport checks the ring r, named ringName and with the given
+// md5, against the servers of the devices in it and, if it's not nil, the
+// builder it should have been written from.
+func getRingCheckReport(client common.HTTPClient, ringName string, r ring.Ring, ringMD5 string, builder *ring.RingBuilder) *ringCheckReport {
+	report := &ringCheckReport{
+		Name: "Ring Check Report",
+		Time: time.Now().UTC(),
+		Ring: ringName,
+		MD5:  ringMD5,
+	}
+	servers := map[string]*ipPort{}
+	serverDevs := map[string][]*ring.Device{}
+	for _, dev := range r.AllDevices() {
+		if dev == nil || dev.Weight < 0 {
+			continue
+		}
+		id := serverId(dev.Ip, dev.Port)
+		servers[id] = &ipPort{ip: dev.Ip, port: dev.Port, scheme: dev.Scheme, replicationPort: dev.ReplicationPort}
+		serverDevs[id] = append(serverDevs[id], dev)
+	}
+	for id, server := range servers {
+		report.Servers++
+		report.Devices += len(serverDevs[id])
+		data, err := queryHostRecon(client, server, "diskusage")
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: unreachable, with %d devices: %s", server, len(serverDevs[id]), err))
+			continue
+		}
+		var disks []topologyDiskUsage
+		if err = json.Unmarshal(data, &disks); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", server, err))
+			continue
+		}
+		mounted := map[string]bool{}
+		for _, disk := range disks {
+			mounted[disk.Device] = disk.Mounted
+		}
+		for _, dev := range serverDevs[id] {
+			if m, ok := mounted[dev.Device]; !ok {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: not found on its server", deviceId(dev.Ip, dev.Port, dev.Device)))
+			} else if !m {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: unmounted", deviceId(dev.Ip, dev.Port, dev.Device)))
+			}
+		}
+		data, err = queryHostRecon(client, server, "ringmd5")
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", server, err))
+			continue
+		}
+		var md5s map[string]string
+		if err = json.Unmarshal(data, &md5s); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %s - %q", server, err, string(data)))
+			continue
+		}
+		serverMD5 := ""
+		for fname, md5sum := range md5s {
+			if filepath.Base(fname) == ringName {
+				serverMD5 = md5sum
+			}
+		}
+		if serverMD5 != ringMD5 {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s://%s:%d/recon/ringmd5 (%s => %s) doesn't match %s", server.scheme, server.ip, server.port, ringName, serverMD5, ringMD5))
+		}
+	}
+	if builder != nil {
+		report.Balance = builder.GetBalance()
+		report.Dispersion = builder.GetDispersion()
+		report.Warnings = append(report.Warnings, ringDrift(builder, r)...)
+	}
+	report.Pass = len(report.Errors) == 0
+	return report
+}
+
+func driftDevice(dev *ring.Device) string {
+	return fmt.Sprintf("r%dz%d-%s weight %.02f", dev.Region, dev.Zone, deviceId(dev.Ip, dev.Port, dev.Device), dev.Weight)
+}
+
+// ringDrift describes how ring r differs from what builder would write now.
+func ringDrift(builder *ring.RingBuilder, r ring.Ring) []string {
+	var drift []string
+	if builder.DevsChanged {
+		drift = append(drift, "The builder has device changes that haven't been rebalanced")
+	}
+	built := builder.GetRing()
+	if built.ReplicaCount() == 0 || r.ReplicaCount() == 0 {
+		return append(drift, "The builder or ring has no partitions assigned")
+	}
+	if built.ReplicaCount() != r.ReplicaCount() || built.PartitionCount() != r.PartitionCount() {
+		return append(drift, fmt.Sprintf("The builder has %d partitions with %d replicas, but the ring has %d with %d; write_ring needs running",
+			built.PartitionCount(), built.ReplicaCount(), r.PartitionCount(), r.ReplicaCount()))
+	}
+	builtDevs := built.AllDevices()
+	ringDevs := r.AllDevices()
+	for id := 0; id < len(builtDevs) || id < len(ringDevs); id++ {
+		var a, b *ring.Device
+		if id < len(builtDevs) {
+			a = builtDevs[id]
+		}
+		if id < len(ringDevs) {
+			b = ringDevs[id]
+		}
+		if a == nil && b == nil {
+			continue
+		} else if a == nil {
+			drift = append(drift, fmt.Sprintf("Device %d is in the ring but not the builder", id))
+		} else if b == nil {
+			drift = append(drift, fmt.Sprintf("Device %d is in the builder but not the ring", id))
+		} else if a.Ip != b.Ip || a.Port != b.Port || a.Device != b.Device || a.Region != b.Region || a.Zone != b.Zone || a.Weight != b.Weight {
+			drift = append(drift, fmt.Sprintf("Device %d is %s in the builder but %s in the ring", id, driftDevice(a), driftDevice(b)))
+		}
+	}
+	moved := 0
+	for partition := uint64(0); partition < r.PartitionCount(); partition++ {
+		builtNodes := built.GetNodes(partition)
+		ringNodes := r.GetNodes(partition)
+		for i := range builtNodes {
+			if i >= len(ringNodes) || ringNodes[i] == nil || builtNodes[i] == nil || builtNodes[i].Id != ringNodes[i].Id {
+				moved++
+			}
+		}
+	}
+	if moved > 0 {
+		drift = append(drift, fmt.Sprintf("%d partition replicas are assigned differently in the builder; write_ring needs running", moved))
+	}
+	return drift
+}
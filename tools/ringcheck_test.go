@@ -0,0 +1,69 @@
+package tools
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/ring"
+)
+
+func TestRingCheckReport(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var content interface{}
+		switch r.URL.Path {
+		case "/recon/diskusage":
+			content = []map[string]interface{}{
+				{"device": "sda", "mounted": true},
+				{"device": "sdb", "mounted": true},
+				{"device": "sdc", "mounted": false},
+			}
+		case "/recon/ringmd5":
+			content = map[string]string{"/etc/hummingbird/object.ring.gz": "abc"}
+		default:
+			t.Fatalf("unexpected path %s", r.URL.Path)
+		}
+		serialized, _ := json.Marshal(content)
+		w.Write(serialized)
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	host, ports, _ := net.SplitHostPort(u.Host)
+	port, _ := strconv.Atoi(ports)
+
+	builder, err := ring.NewRingBuilder(4, 3, 0, false)
+	require.Nil(t, err)
+	for i, device := range []string{"sda", "sdb", "sdc"} {
+		_, err := builder.AddDev(&ring.RingBuilderDevice{Id: -1, Region: 1, Zone: int64(i), Scheme: "http", Ip: host, Port: int64(port), Device: device, Weight: 100})
+		require.Nil(t, err)
+	}
+	_, _, _, err = builder.Rebalance()
+	require.Nil(t, err)
+	r := builder.GetRing()
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	report := getRingCheckReport(client, "object.ring.gz", r, "abc", builder)
+	require.False(t, report.Passed())
+	require.Equal(t, []string{deviceId(host, port, "sdc") + ": unmounted"}, report.Errors)
+	require.Equal(t, 0, len(report.Warnings))
+	require.Equal(t, 1, report.Servers)
+	require.Equal(t, 3, report.Devices)
+
+	report = getRingCheckReport(client, "object.ring.gz", r, "def", builder)
+	require.Equal(t, 2, len(report.Errors))
+
+	require.Nil(t, builder.SetDevWeight(0, 50))
+	report = getRingCheckReport(client, "object.ring.gz", r, "abc", builder)
+	require.Equal(t, []string{
+		"The builder has device changes that haven't been rebalanced",
+		"Device 0 is r1z0-" + deviceId(host, port, "sda") + " weight 50.00 in the builder but r1z0-" + deviceId(host, port, "sda") + " weight 100.00 in the ring",
+	}, report.Warnings)
+}
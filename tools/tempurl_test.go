@@ -0,0 +1,41 @@
+package tools
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignTempURL(t *testing.T) {
+	expires := time.Unix(1500000000, 0)
+	signed, err := signTempURL("sha256", "GET", "/v1/a/c/o", "mykey", expires, false, "")
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(signed, "/v1/a/c/o?"))
+	u, err := url.Parse(signed)
+	require.Nil(t, err)
+	mac := hmac.New(sha256.New, []byte("mykey"))
+	mac.Write([]byte("GET\n1500000000\n/v1/a/c/o"))
+	require.Equal(t, hex.EncodeToString(mac.Sum(nil)), u.Query().Get("temp_url_sig"))
+	require.Equal(t, "1500000000", u.Query().Get("temp_url_expires"))
+
+	signed, err = signTempURL("sha256", "PUT", "/v1/a/c/pre", "mykey", expires, true, "192.0.2.0/24")
+	require.Nil(t, err)
+	u, err = url.Parse(signed)
+	require.Nil(t, err)
+	mac = hmac.New(sha256.New, []byte("mykey"))
+	mac.Write([]byte("ip=192.0.2.0/24\nPUT\n1500000000\nprefix:/v1/a/c/pre"))
+	require.Equal(t, hex.EncodeToString(mac.Sum(nil)), u.Query().Get("temp_url_sig"))
+	require.Equal(t, "pre", u.Query().Get("temp_url_prefix"))
+	require.Equal(t, "192.0.2.0/24", u.Query().Get("temp_url_ip_range"))
+
+	_, err = signTempURL("sha256", "GET", "/v1/a/c", "mykey", expires, false, "")
+	require.NotNil(t, err)
+	_, err = signTempURL("md5", "GET", "/v1/a/c/o", "mykey", expires, false, "")
+	require.NotNil(t, err)
+}
@@ -0,0 +1,295 @@
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/objectserver"
+)
+
+const (
+	// topologyFullUtilization is the used fraction past which a device is reported as at risk.
+	topologyFullUtilization = 0.9
+	// topologyStaleReplication is how long since a device's last replication pass before it's reported as at risk.
+	topologyStaleReplication = 24 * time.Hour
+)
+
+type topologyDevice struct {
+	Id               int
+	Region           int
+	Zone             int
+	Ip               string
+	Port             int
+	Device           string
+	Weight           float64
+	Partitions       int
+	Balance          float64
+	Reachable        bool
+	Mounted          bool
+	Size             int64
+	Used             int64
+	Utilization      float64
+	LastPassFinish   time.Time
+	LastPassDuration time.Duration
+	CancelCount      int64
+	Problems         []string
+}
+
+type topologyZone struct {
+	Region        int
+	Zone          int
+	Weight        float64
+	Partitions    int
+	Devices       int
+	DevicesAtRisk int
+}
+
+type topologyRing struct {
+	Policy             int
+	Name               string
+	PartitionCount     uint64
+	ReplicaCount       uint64
+	DegradedPartitions int
+	Zones              []*topologyZone
+	Devices            []*topologyDevice
+}
+
+// topologyReport describes each object ring's devices and failure domains,
+// along with the utilization and replication health their servers report.
+// As text it's a Graphviz dot document; with -json it's the report itself.
+type topologyReport struct {
+	Name     string
+	Time     time.Time
+	Pass     bool
+	Errors   []string
+	Warnings []string
+	Rings    []*topologyRing
+}
+
+func (r *topologyReport) Passed() bool {
+	return r.Pass
+}
+
+func (r *topologyReport) String() string {
+	s := fmt.Sprintf("// [%s] %s\n", r.Time.Format("2006-01-02 15:04:05"), r.Name)
+	for _, e := range r.Errors {
+		s += fmt.Sprintf("// !! %s\n", e)
+	}
+	for _, w := range r.Warnings {
+		s += fmt.Sprintf("// ! %s\n", w)
+	}
+	s += "digraph topology {\n\tnode [shape=box, style=filled];\n"
+	for _, tr := range r.Rings {
+		s += fmt.Sprintf("\tsubgraph cluster_p%d {\n\t\tlabel=%q;\n", tr.Policy,
+			fmt.Sprintf("%s\n%d partitions x %d replicas, %d degraded", tr.Name, tr.PartitionCount, tr.ReplicaCount, tr.DegradedPartitions))
+		for _, z := range tr.Zones {
+			color := "white"
+			if z.DevicesAtRisk > 0 {
+				color = "lightpink"
+			}
+			s += fmt.Sprintf("\t\tsubgraph cluster_p%d_r%d_z%d {\n\t\t\tlabel=%q;\n\t\t\tstyle=filled;\n\t\t\tfillcolor=%s;\n", tr.Policy, z.Region, z.Zone,
+				fmt.Sprintf("r%dz%d\nweight %.02f, %d partitions\n%d/%d devices at risk", z.Region, z.Zone, z.Weight, z.Partitions, z.DevicesAtRisk, z.Devices), color)
+			for _, d := range tr.Devices {
+				if d.Region != z.Region || d.Zone != z.Zone {
+					continue
+				}
+				color := "palegreen"
+				if len(d.Problems) > 0 {
+					color = "tomato"
+				}
+				label := fmt.Sprintf("%s\nweight %.02f, %d partitions, balance %.02f\n%.01f%% used",
+					deviceId(d.Ip, d.Port, d.Device), d.Weight, d.Partitions, d.Balance, d.Utilization*100)
+				if len(d.Problems) > 0 {
+					label += "\n" + strings.Join(d.Problems, ", ")
+				}
+				s += fmt.Sprintf("\t\t\tp%d_d%d [label=%q, fillcolor=%s];\n", tr.Policy, d.Id, label, color)
+			}
+			s += "\t\t}\n"
+		}
+		s += "\t}\n"
+	}
+	s += "}\n"
+	return s
+}
+
+type topologyDiskUsage struct {
+	Device  string `json:"device"`
+	Mounted bool   `json:"mounted"`
+	Size    int64  `json:"size"`
+	Used    int64  `json:"used"`
+}
+
+func getTopologyReport(client common.HTTPClient, rings map[int]ring.Ring) *topologyReport {
+	// rings parameter is for overriding for tests, leave nil normally
+	report := &topologyReport{
+		Name: "Topology Report",
+		Time: time.Now().UTC(),
+	}
+	if rings == nil {
+		rings = map[int]ring.Ring{}
+		prefix, suffix := getAffixes()
+		if policies, err := conf.GetPolicies(); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+		} else {
+			for _, policy := range policies {
+				if r, err := ring.GetRing("object", prefix, suffix, policy.Index); err != nil {
+					report.Errors = append(report.Errors, err.Error())
+				} else {
+					rings[policy.Index] = r
+				}
+			}
+		}
+	}
+	servers := map[string]*ipPort{}
+	for _, r := range rings {
+		for _, dev := range r.AllDevices() {
+			if dev == nil || dev.Weight < 0 {
+				continue
+			}
+			servers[serverId(dev.Ip, dev.Port)] = &ipPort{ip: dev.Ip, port: dev.Port, scheme: dev.Scheme, replicationPort: dev.ReplicationPort}
+		}
+	}
+	usage := map[string]topologyDiskUsage{}
+	replication := map[string]objectserver.DeviceStats{}
+	reachable := map[string]bool{}
+	for id, server := range servers {
+		data, err := queryHostRecon(client, server, "diskusage")
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", server, err))
+			continue
+		}
+		var disks []topologyDiskUsage
+		if err = json.Unmarshal(data, &disks); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", server, err))
+			continue
+		}
+		reachable[id] = true
+		for _, disk := range disks {
+			usage[deviceId(server.ip, server.port, disk.Device)] = disk
+		}
+		stats, err := queryHostReplication(client, server)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", server, err))
+			continue
+		}
+		for device, dStats := range stats {
+			replication[deviceId(server.ip, server.port, device)] = dStats
+		}
+	}
+	var policies []int
+	for policy := range rings {
+		policies = append(policies, policy)
+	}
+	sort.Ints(policies)
+	for _, policy := range policies {
+		tr := getTopologyRing(policy, rings[policy], usage, replication, reachable)
+		for _, d := range tr.Devices {
+			if len(d.Problems) > 0 {
+				report.Warnings = append(report.Warnings, fmt.Sprintf("%s %s: %s", tr.Name, deviceId(d.Ip, d.Port, d.Device), strings.Join(d.Problems, ", ")))
+			}
+		}
+		if tr.DegradedPartitions > 0 {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("%s has %d partitions with a replica on a device at risk", tr.Name, tr.DegradedPartitions))
+		}
+		report.Rings = append(report.Rings, tr)
+	}
+	report.Pass = len(report.Errors) == 0 && len(report.Warnings) == 0
+	return report
+}
+
+func getTopologyRing(policy int, r ring.Ring, usage map[string]topologyDiskUsage, replication map[string]objectserver.DeviceStats, reachable map[string]bool) *topologyRing {
+	tr := &topologyRing{
+		Policy:         policy,
+		Name:           "object",
+		PartitionCount: r.PartitionCount(),
+		ReplicaCount:   r.ReplicaCount(),
+	}
+	if policy != 0 {
+		tr.Name = fmt.Sprintf("object-%d", policy)
+	}
+	devices := map[int]*topologyDevice{}
+	totalWeight := float64(0)
+	for _, dev := range r.AllDevices() {
+		if dev == nil || dev.Weight < 0 {
+			continue
+		}
+		d := &topologyDevice{Id: dev.Id, Region: dev.Region, Zone: dev.Zone, Ip: dev.Ip, Port: dev.Port, Device: dev.Device, Weight: dev.Weight}
+		id := deviceId(dev.Ip, dev.Port, dev.Device)
+		d.Reachable = reachable[serverId(dev.Ip, dev.Port)]
+		if disk, ok := usage[id]; ok {
+			d.Mounted = disk.Mounted
+			d.Size = disk.Size
+			d.Used = disk.Used
+			if d.Size > 0 {
+				d.Utilization = float64(d.Used) / float64(d.Size)
+			}
+		}
+		if dStats, ok := replication[id]; ok {
+			d.LastPassFinish = dStats.LastPassFinishDate
+			d.LastPassDuration = dStats.LastPassDuration
+			d.CancelCount = dStats.CancelCount
+		}
+		if !d.Reachable {
+			d.Problems = append(d.Problems, "unreachable")
+		} else if !d.Mounted {
+			d.Problems = append(d.Problems, "unmounted")
+		} else {
+			if d.Utilization > topologyFullUtilization {
+				d.Problems = append(d.Problems, "nearly full")
+			}
+			if time.Since(d.LastPassFinish) > topologyStaleReplication {
+				d.Problems = append(d.Problems, "replication stale")
+			}
+			if d.CancelCount > 0 {
+				d.Problems = append(d.Problems, "replicator restarted")
+			}
+		}
+		devices[dev.Id] = d
+		tr.Devices = append(tr.Devices, d)
+		totalWeight += dev.Weight
+	}
+	for partition := uint64(0); partition < tr.PartitionCount; partition++ {
+		degraded := false
+		for _, dev := range r.GetNodes(partition) {
+			if d, ok := devices[dev.Id]; ok {
+				d.Partitions++
+				degraded = degraded || len(d.Problems) > 0
+			}
+		}
+		if degraded {
+			tr.DegradedPartitions++
+		}
+	}
+	zones := map[[2]int]*topologyZone{}
+	for _, d := range tr.Devices {
+		if totalWeight > 0 && d.Weight > 0 {
+			wanted := d.Weight / totalWeight * float64(tr.PartitionCount*tr.ReplicaCount)
+			d.Balance = 100 * (float64(d.Partitions)/wanted - 1)
+		}
+		z := zones[[2]int{d.Region, d.Zone}]
+		if z == nil {
+			z = &topologyZone{Region: d.Region, Zone: d.Zone}
+			zones[[2]int{d.Region, d.Zone}] = z
+			tr.Zones = append(tr.Zones, z)
+		}
+		z.Weight += d.Weight
+		z.Partitions += d.Partitions
+		z.Devices++
+		if len(d.Problems) > 0 {
+			z.DevicesAtRisk++
+		}
+	}
+	sort.Slice(tr.Zones, func(i, j int) bool {
+		if tr.Zones[i].Region != tr.Zones[j].Region {
+			return tr.Zones[i].Region < tr.Zones[j].Region
+		}
+		return tr.Zones[i].Zone < tr.Zones[j].Zone
+	})
+	return tr
+}
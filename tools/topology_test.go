@@ -0,0 +1,70 @@
+package tools
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/objectserver"
+)
+
+func TestTopologyReport(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var content interface{}
+		switch r.URL.Path {
+		case "/recon/diskusage":
+			content = []map[string]interface{}{
+				{"device": "sda", "mounted": true, "size": 100, "used": 40, "avail": 60},
+				{"device": "sdb", "mounted": false, "size": 0, "used": 0, "avail": 0},
+			}
+		case "/progress/object-replicator":
+			content = map[string]objectserver.DeviceStats{
+				"sda": {LastPassFinishDate: time.Now(), LastPassDuration: time.Minute},
+			}
+		default:
+			t.Fatalf("unexpected path %s", r.URL.Path)
+		}
+		serialized, _ := json.Marshal(content)
+		w.Write(serialized)
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	host, ports, _ := net.SplitHostPort(u.Host)
+	port, _ := strconv.Atoi(ports)
+
+	fr := &FakeRing{Devs: []*ring.Device{
+		{Id: 0, Device: "sda", Ip: host, Port: port, ReplicationPort: port, Scheme: "http", Region: 1, Zone: 1, Weight: 1},
+		{Id: 1, Device: "sdb", Ip: host, Port: port, ReplicationPort: port, Scheme: "http", Region: 1, Zone: 2, Weight: 1},
+	}, nodeCalls: 4}
+	client := &http.Client{Timeout: 10 * time.Second}
+	report := getTopologyReport(client, map[int]ring.Ring{1: fr})
+	require.Equal(t, 0, len(report.Errors))
+	require.False(t, report.Passed())
+	require.Equal(t, 1, len(report.Rings))
+	tr := report.Rings[0]
+	require.Equal(t, "object-1", tr.Name)
+	require.Equal(t, 4, tr.DegradedPartitions)
+	require.Equal(t, 2, len(tr.Zones))
+	require.Equal(t, 0, tr.Zones[0].DevicesAtRisk)
+	require.Equal(t, 1, tr.Zones[1].DevicesAtRisk)
+	require.Equal(t, 4, tr.Devices[0].Partitions)
+	require.Equal(t, 0.4, tr.Devices[0].Utilization)
+	require.Equal(t, float64(0), tr.Devices[0].Balance)
+	require.Equal(t, 0, len(tr.Devices[0].Problems))
+	require.Equal(t, []string{"unmounted"}, tr.Devices[1].Problems)
+
+	out := report.String()
+	require.True(t, strings.Contains(out, "digraph topology {"))
+	require.True(t, strings.Contains(out, "subgraph cluster_p1_r1_z2 {"))
+	require.True(t, strings.Contains(out, "p1_d1 [label=\""+deviceId(host, port, "sdb")+`\nweight 1.00, 4 partitions, balance 0.00\n0.0% used\nunmounted", fillcolor=tomato];`))
+}